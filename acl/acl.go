@@ -0,0 +1,204 @@
+// Package acl provides http.Handler middleware that allows or denies the requests based on the network of the client IP.
+//
+// The networks are IPv4 or IPv6 CIDRs (or single IPs), the IPv4 networks also match the IPv4-mapped IPv6 addresses.
+// A denied network takes precedence over an allowed one, the requests from the other networks get the default action.
+//
+// Examples of an ACL middleware:
+//
+//	// only the internal networks can reach the handler.
+//	acl.New(handler, acl.Allow("10.0.0.0/8", "fd00::/8"))
+//
+//	// blocks some networks, the client IP is read from X-Forwarded-For when the request comes from a trusted proxy.
+//	extractor, _ := utils.NewTrustedProxyExtractor("10.0.0.0/8")
+//	acl.New(handler, acl.Deny("192.0.2.0/24", "2001:db8::/32"), acl.SourceExtractor(extractor))
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// Action is the action applied to a request.
+type Action int
+
+const (
+	// AllowAction passes the request to the next handler.
+	AllowAction Action = iota + 1
+	// DenyAction rejects the request.
+	DenyAction
+)
+
+func (a Action) String() string {
+	switch a {
+	case AllowAction:
+		return "allow"
+	case DenyAction:
+		return "deny"
+	default:
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+}
+
+// ACL is a middleware that allows or denies the requests based on the client IP.
+type ACL struct {
+	next http.Handler
+
+	extract       utils.SourceExtractor
+	defaultAction Action
+	rejectHandler http.Handler
+
+	// allow and deny are the networks given to New, parsed into rules.
+	allow []string
+	deny  []string
+	rules atomic.Pointer[rules]
+
+	verbose bool
+	log     utils.Logger
+}
+
+// New creates a new ACL middleware.
+// By default, the client IP is the remote address of the request, see SourceExtractor,
+// and the requests not matching any network are allowed, unless some networks are allowed, see DefaultAction.
+// next can be nil, and set later with Wrap.
+func New(next http.Handler, options ...Option) (*ACL, error) {
+	a := &ACL{
+		next: next,
+		log:  &utils.NoopLogger{},
+	}
+
+	for _, o := range options {
+		if err := o(a); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.extract == nil {
+		extract, err := utils.NewTrustedProxyExtractor()
+		if err != nil {
+			return nil, err
+		}
+		a.extract = extract
+	}
+
+	if a.rejectHandler == nil {
+		a.rejectHandler = http.HandlerFunc(defaultReject)
+	}
+
+	if err := a.SetRules(a.allow, a.deny); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Wrap sets the next handler to be called by the ACL handler, when it was created without.
+func (a *ACL) Wrap(next http.Handler) error {
+	if err := utils.CheckWrap(a.next, next); err != nil {
+		return err
+	}
+	a.next = next
+	return nil
+}
+
+// SetRules replaces the allowed and denied networks, e.g. when a blocklist is refreshed.
+// The rules are swapped atomically: a request is evaluated against either the old or the new rules.
+// On error, the current rules are kept.
+func (a *ACL) SetRules(allow, deny []string) error {
+	r, err := newRules(allow, deny, a.defaultAction)
+	if err != nil {
+		return err
+	}
+
+	a.rules.Store(r)
+	return nil
+}
+
+func (a *ACL) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if a.verbose && utils.DebugEnabled(a.log) {
+		dump := utils.DumpHTTPRequest(req)
+		a.log.Debug("vulcand/oxy/acl: begin ServeHttp on request: %s", dump)
+		defer a.log.Debug("vulcand/oxy/acl: completed ServeHttp on request: %s", dump)
+	}
+
+	if a.next == nil {
+		utils.DefaultHandler.ServeHTTP(w, req, &utils.ErrNotWired{Middleware: "acl"})
+		return
+	}
+
+	token, _, err := a.extract.Extract(req)
+	if err != nil {
+		a.log.Warn("vulcand/oxy/acl: failed to extract the client IP, rejecting the request: %v", err)
+		a.rejectHandler.ServeHTTP(w, req)
+		return
+	}
+
+	ip := net.ParseIP(token)
+	if ip == nil {
+		a.log.Warn("vulcand/oxy/acl: invalid client IP %q, rejecting the request", token)
+		a.rejectHandler.ServeHTTP(w, req)
+		return
+	}
+
+	if action := a.rules.Load().action(ip); action != AllowAction {
+		a.log.Debug("vulcand/oxy/acl: client IP %s denied", ip)
+		a.rejectHandler.ServeHTTP(w, req)
+		return
+	}
+
+	a.next.ServeHTTP(w, req)
+}
+
+// rules is an immutable set of allowed and denied networks.
+type rules struct {
+	networks      trie
+	defaultAction Action
+}
+
+func newRules(allow, deny []string, defaultAction Action) (*rules, error) {
+	r := &rules{defaultAction: defaultAction}
+
+	for _, s := range allow {
+		n, err := utils.ParseNetwork(s)
+		if err != nil {
+			return nil, fmt.Errorf("allow: %w", err)
+		}
+		r.networks.insert(n, AllowAction)
+	}
+
+	for _, s := range deny {
+		n, err := utils.ParseNetwork(s)
+		if err != nil {
+			return nil, fmt.Errorf("deny: %w", err)
+		}
+		r.networks.insert(n, DenyAction)
+	}
+
+	if r.defaultAction == 0 {
+		r.defaultAction = AllowAction
+		if len(allow) > 0 {
+			r.defaultAction = DenyAction
+		}
+	}
+
+	return r, nil
+}
+
+func (r *rules) action(ip net.IP) Action {
+	allowed, denied := r.networks.lookup(ip)
+	switch {
+	case denied:
+		return DenyAction
+	case allowed:
+		return AllowAction
+	default:
+		return r.defaultAction
+	}
+}
+
+func defaultReject(w http.ResponseWriter, _ *http.Request) {
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
@@ -0,0 +1,186 @@
+package acl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+func TestACL_overlappingNetworks(t *testing.T) {
+	a, err := New(okHandler(),
+		Allow("10.0.0.0/8", "10.1.2.0/24", "192.168.1.1"),
+		Deny("10.1.0.0/16", "10.2.3.4"),
+	)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		remoteAddr string
+		expected   int
+	}{
+		{remoteAddr: "10.0.0.1:1234", expected: http.StatusOK},
+		{remoteAddr: "10.2.3.5:1234", expected: http.StatusOK},
+		{remoteAddr: "192.168.1.1:1234", expected: http.StatusOK},
+		// deny takes precedence, even over a longer allowed prefix.
+		{remoteAddr: "10.1.0.1:1234", expected: http.StatusForbidden},
+		{remoteAddr: "10.1.2.3:1234", expected: http.StatusForbidden},
+		{remoteAddr: "10.2.3.4:1234", expected: http.StatusForbidden},
+		// not allowed.
+		{remoteAddr: "11.0.0.1:1234", expected: http.StatusForbidden},
+		{remoteAddr: "192.168.1.2:1234", expected: http.StatusForbidden},
+		{remoteAddr: "[2001:db8::1]:1234", expected: http.StatusForbidden},
+	}
+
+	for _, test := range testCases {
+		assert.Equal(t, test.expected, serve(a, test.remoteAddr, ""), test.remoteAddr)
+	}
+}
+
+func TestACL_ipv6(t *testing.T) {
+	a, err := New(okHandler(),
+		Deny("2001:db8::/32", "192.0.2.0/24"),
+		Allow("2001:db8:1::1"),
+		DefaultAction(AllowAction),
+	)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		remoteAddr string
+		expected   int
+	}{
+		{remoteAddr: "[2001:db8::1]:1234", expected: http.StatusForbidden},
+		{remoteAddr: "[2001:db8:1::1]:1234", expected: http.StatusForbidden},
+		{remoteAddr: "[2001:db9::1]:1234", expected: http.StatusOK},
+		{remoteAddr: "[fe80::1%eth0]:1234", expected: http.StatusOK},
+		// the IPv4 networks match the IPv4-mapped addresses.
+		{remoteAddr: "192.0.2.1:1234", expected: http.StatusForbidden},
+		{remoteAddr: "[::ffff:192.0.2.1]:1234", expected: http.StatusForbidden},
+		{remoteAddr: "[::ffff:192.0.3.1]:1234", expected: http.StatusOK},
+		{remoteAddr: "192.0.3.1:1234", expected: http.StatusOK},
+	}
+
+	for _, test := range testCases {
+		assert.Equal(t, test.expected, serve(a, test.remoteAddr, ""), test.remoteAddr)
+	}
+}
+
+func TestACL_trustedProxies(t *testing.T) {
+	extractor, err := utils.NewTrustedProxyExtractor("172.16.0.0/12")
+	require.NoError(t, err)
+
+	a, err := New(okHandler(), Allow("10.0.0.0/8"), Deny("10.6.6.0/24"), SourceExtractor(extractor))
+	require.NoError(t, err)
+
+	// an untrusted client spoofing X-Forwarded-For.
+	assert.Equal(t, http.StatusForbidden, serve(a, "203.0.113.5:1234", "10.0.0.1"))
+
+	// a trusted proxy.
+	assert.Equal(t, http.StatusOK, serve(a, "172.16.0.1:1234", "10.0.0.1"))
+	assert.Equal(t, http.StatusForbidden, serve(a, "172.16.0.1:1234", "10.6.6.6"))
+	assert.Equal(t, http.StatusForbidden, serve(a, "172.16.0.1:1234", "10.0.0.1, 10.6.6.6"))
+
+	// without trusted proxies, the header is ignored.
+	a, err = New(okHandler(), Allow("10.0.0.0/8"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, serve(a, "203.0.113.5:1234", "10.0.0.1"))
+}
+
+func TestACL_defaultAction(t *testing.T) {
+	a, err := New(okHandler(), Deny("10.0.0.0/8"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, serve(a, "11.0.0.1:1234", ""))
+
+	a, err = New(okHandler(), Deny("10.0.0.0/8"), DefaultAction(DenyAction))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, serve(a, "11.0.0.1:1234", ""))
+
+	a, err = New(okHandler(), Allow("10.0.0.0/8"), DefaultAction(AllowAction))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, serve(a, "11.0.0.1:1234", ""))
+
+	_, err = New(okHandler(), DefaultAction(Action(42)))
+	require.Error(t, err)
+}
+
+func TestACL_rejectHandler(t *testing.T) {
+	reject := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	a, err := New(okHandler(), Deny("10.0.0.0/8"), RejectHandler(reject))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, serve(a, "10.0.0.1:1234", ""))
+
+	// the client IP can't be extracted.
+	assert.Equal(t, http.StatusNotFound, serve(a, "unknown", ""))
+}
+
+func TestACL_invalidOptions(t *testing.T) {
+	_, err := New(okHandler(), Allow("10.0.0.0/33"))
+	require.Error(t, err)
+
+	_, err = New(okHandler(), Deny("example.com"))
+	require.Error(t, err)
+
+	_, err = New(okHandler(), SourceExtractor(nil))
+	require.Error(t, err)
+
+	_, err = New(okHandler(), RejectHandler(nil))
+	require.Error(t, err)
+}
+
+func TestACL_SetRules(t *testing.T) {
+	a, err := New(okHandler(), Deny("10.0.0.0/8"))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				code := serve(a, "10.0.0.1:1234", "")
+				assert.Contains(t, []int{http.StatusOK, http.StatusForbidden}, code)
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			require.NoError(t, a.SetRules(nil, []string{"192.0.2.0/24"}))
+		} else {
+			require.NoError(t, a.SetRules(nil, []string{"10.0.0.0/8"}))
+		}
+	}
+	wg.Wait()
+
+	require.NoError(t, a.SetRules([]string{"10.0.0.0/8"}, nil))
+	assert.Equal(t, http.StatusOK, serve(a, "10.0.0.1:1234", ""))
+	assert.Equal(t, http.StatusForbidden, serve(a, "11.0.0.1:1234", ""))
+
+	// invalid rules keep the current ones.
+	require.Error(t, a.SetRules(nil, []string{"10.0.0.0/8", "invalid"}))
+	assert.Equal(t, http.StatusOK, serve(a, "10.0.0.1:1234", ""))
+}
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+}
+
+func serve(a *ACL, remoteAddr, forwarded string) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	if forwarded != "" {
+		req.Header.Set("X-Forwarded-For", forwarded)
+	}
+
+	rw := httptest.NewRecorder()
+	a.ServeHTTP(rw, req)
+	return rw.Code
+}
@@ -0,0 +1,80 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// Option represents an option you can pass to New.
+type Option func(a *ACL) error
+
+// Logger defines the logger used by ACL.
+func Logger(l utils.Logger) Option {
+	return func(a *ACL) error {
+		a.log = l
+		return nil
+	}
+}
+
+// Verbose additional debug information.
+func Verbose(verbose bool) Option {
+	return func(a *ACL) error {
+		a.verbose = verbose
+		return nil
+	}
+}
+
+// Allow allows the requests from the networks (e.g. "10.0.0.0/8", "fd00::/8" or a single IP).
+func Allow(cidrs ...string) Option {
+	return func(a *ACL) error {
+		a.allow = append(a.allow, cidrs...)
+		return nil
+	}
+}
+
+// Deny denies the requests from the networks (e.g. "192.0.2.0/24", "2001:db8::/32" or a single IP),
+// even if they belong to an allowed network.
+func Deny(cidrs ...string) Option {
+	return func(a *ACL) error {
+		a.deny = append(a.deny, cidrs...)
+		return nil
+	}
+}
+
+// SourceExtractor sets the extractor of the client IP, e.g. utils.NewTrustedProxyExtractor.
+// The token of the extractor must be an IP.
+func SourceExtractor(extract utils.SourceExtractor) Option {
+	return func(a *ACL) error {
+		if extract == nil {
+			return errors.New("source extractor can not be nil")
+		}
+		a.extract = extract
+		return nil
+	}
+}
+
+// DefaultAction sets the action for the requests not matching any network.
+// The default is DenyAction when some networks are allowed, AllowAction otherwise.
+func DefaultAction(action Action) Option {
+	return func(a *ACL) error {
+		if action != AllowAction && action != DenyAction {
+			return fmt.Errorf("invalid default action: %v", action)
+		}
+		a.defaultAction = action
+		return nil
+	}
+}
+
+// RejectHandler sets the handler of the rejected requests, the default answers 403 Forbidden in plain text.
+func RejectHandler(h http.Handler) Option {
+	return func(a *ACL) error {
+		if h == nil {
+			return errors.New("reject handler can not be nil")
+		}
+		a.rejectHandler = h
+		return nil
+	}
+}
@@ -0,0 +1,69 @@
+package acl
+
+import (
+	"net"
+)
+
+// trie is a binary prefix tree of the networks, keyed by the bits of the 16-byte form of their address:
+// the IPv4 networks are stored as IPv4-mapped IPv6 networks (::ffff:0:0/96), so that they match the mapped addresses.
+// A lookup walks at most 128 nodes, whatever the number of networks.
+type trie struct {
+	root node
+}
+
+type node struct {
+	children [2]*node
+	allow    bool
+	deny     bool
+}
+
+func (t *trie) insert(n *net.IPNet, action Action) {
+	ones, bits := n.Mask.Size()
+	ip := n.IP.To16()
+	if bits == 8*net.IPv4len {
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+
+	cur := &t.root
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if cur.children[b] == nil {
+			cur.children[b] = &node{}
+		}
+		cur = cur.children[b]
+	}
+
+	switch action {
+	case AllowAction:
+		cur.allow = true
+	case DenyAction:
+		cur.deny = true
+	}
+}
+
+// lookup returns whether ip belongs to an allowed network and whether it belongs to a denied network.
+func (t *trie) lookup(ip net.IP) (allowed, denied bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return false, false
+	}
+
+	cur := &t.root
+	for i := 0; ; i++ {
+		allowed = allowed || cur.allow
+		denied = denied || cur.deny
+
+		if i == 8*net.IPv6len {
+			return allowed, denied
+		}
+
+		cur = cur.children[bit(ip, i)]
+		if cur == nil {
+			return allowed, denied
+		}
+	}
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-i%8)) & 1
+}
@@ -0,0 +1,52 @@
+package buffer
+
+import (
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// DefaultAttemptBodyPreviewBytes is the size of the body preview of the attempts, see AttemptBodyPreviewBytes.
+const DefaultAttemptBodyPreviewBytes = 512
+
+// AttemptInfo describes the response of an attempt of the retry loop, see OnAttempt.
+type AttemptInfo struct {
+	// Attempt is the number of the attempt, starting at 1.
+	Attempt int
+	// StatusCode is the status code of the response.
+	StatusCode int
+	// Header is a copy of the headers of the response.
+	Header http.Header
+	// BodyPreview is the beginning of the response body, at most AttemptBodyPreviewBytes long.
+	BodyPreview []byte
+	// Duration is the time spent by the next handler on the attempt.
+	Duration time.Duration
+	// RetryFollows reports whether the request is replayed after this attempt, false for the final attempt.
+	RetryFollows bool
+	// RequestID is the ID of the request, e.g. set by the requestid middleware, see utils.WithRequestID.
+	RequestID string
+}
+
+// notifyAttempt passes the attempt to the OnAttempt callback, and logs its panic instead of propagating it:
+// the response of the final attempt has already been written to the client.
+func (b *RequestBuffer) notifyAttempt(info AttemptInfo) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			b.log.Error("vulcand/oxy/buffer: panic in OnAttempt callback: %v\n%s", recovered, debug.Stack())
+		}
+	}()
+
+	b.onAttempt(info)
+}
+
+// capture appends the beginning of buf to the body preview of the attempt, up to previewBytes.
+func (a *attemptWriter) capture(buf []byte) {
+	remaining := a.previewBytes - int64(len(a.preview))
+	if remaining <= 0 {
+		return
+	}
+	if int64(len(buf)) > remaining {
+		buf = buf[:remaining]
+	}
+	a.preview = append(a.preview, buf...)
+}
@@ -0,0 +1,115 @@
+package buffer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// scriptedHandler answers the attempts with the responses in turn, each attempt taking 10ms.
+func scriptedHandler(codes []int, bodies []string) http.Handler {
+	var calls atomic.Int64
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		i := int(calls.Add(1)) - 1
+		clock.Advance(10 * clock.Millisecond)
+		w.Header().Set("X-Attempt", bodies[i])
+		w.WriteHeader(codes[i])
+		_, _ = w.Write([]byte(bodies[i]))
+	})
+}
+
+func TestOnAttempt(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	var attempts []AttemptInfo
+	next := scriptedHandler([]int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK}, []string{"err-1", "err-2", "ok"})
+
+	st, err := New(next, Retry(`Attempts() <= 2`), OnAttempt(func(a AttemptInfo) {
+		attempts = append(attempts, a)
+	}))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, int64(2), re.ContentLength)
+	assert.Equal(t, "ok", re.Header.Get("X-Attempt"))
+
+	require.Len(t, attempts, 3)
+	expected := []struct {
+		code         int
+		preview      string
+		retryFollows bool
+	}{
+		{code: http.StatusServiceUnavailable, preview: "err-1", retryFollows: true},
+		{code: http.StatusServiceUnavailable, preview: "err-2", retryFollows: true},
+		{code: http.StatusOK, preview: "ok", retryFollows: false},
+	}
+	for i, e := range expected {
+		assert.Equal(t, i+1, attempts[i].Attempt)
+		assert.Equal(t, e.code, attempts[i].StatusCode)
+		assert.Equal(t, e.preview, string(attempts[i].BodyPreview))
+		assert.Equal(t, e.preview, attempts[i].Header.Get("X-Attempt"))
+		assert.Equal(t, e.retryFollows, attempts[i].RetryFollows)
+		assert.Equal(t, 10*clock.Millisecond, attempts[i].Duration)
+	}
+}
+
+func TestOnAttempt_previewBytes(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	var previews []string
+	next := scriptedHandler([]int{http.StatusBadGateway, http.StatusOK}, []string{"upstream unavailable", "ok"})
+
+	st, err := New(next, Retry(`Attempts() <= 1 && ResponseCode() == 502`), AttemptBodyPreviewBytes(8), OnAttempt(func(a AttemptInfo) {
+		previews = append(previews, string(a.BodyPreview))
+	}))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "ok", rw.Body.String())
+
+	assert.Equal(t, []string{"upstream", "ok"}, previews)
+}
+
+func TestOnAttempt_panic(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	var calls int
+	next := scriptedHandler([]int{http.StatusServiceUnavailable, http.StatusOK}, []string{"err-1", "ok"})
+
+	st, err := New(next, Retry(`Attempts() <= 1`), OnAttempt(func(AttemptInfo) {
+		calls++
+		panic("boom")
+	}))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "ok", rw.Body.String())
+	assert.Equal(t, 2, calls)
+}
+
+func TestOnAttempt_invalidOptions(t *testing.T) {
+	_, err := New(nil, OnAttempt(nil))
+	require.Error(t, err)
+
+	_, err = New(nil, AttemptBodyPreviewBytes(-1))
+	require.Error(t, err)
+
+	_, err = NewResponseBuffer(nil, OnAttempt(func(AttemptInfo) {}))
+	require.Error(t, err)
+}
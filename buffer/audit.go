@@ -0,0 +1,195 @@
+package buffer
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/multibuf"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// DefaultAuditMaxBodyBytes is the maximum size of the body of the audit entries, see AuditMaxBodyBytes.
+const DefaultAuditMaxBodyBytes = 64 << 10
+
+// auditRedacted replaces the values of the redacted headers, see AuditRedactHeaders.
+const auditRedacted = "[redacted]"
+
+// AuditWriter archives the buffered requests, see AuditSink.
+type AuditWriter interface {
+	// Write archives the entry. It is called from the goroutine of the buffer, one entry at a time.
+	Write(entry AuditEntry) error
+}
+
+// AuditEntry is a request archived by an AuditWriter.
+type AuditEntry struct {
+	// Time is the time the request body was buffered.
+	Time   time.Time
+	Method string
+	URL    *url.URL
+	Host   string
+	// Header is a copy of the request headers, the values of the redacted headers replaced (see AuditRedactHeaders).
+	Header http.Header
+	// Body is the request body, or its beginning if it is larger than AuditMaxBodyBytes.
+	Body []byte
+	// BodySize is the size of the whole request body.
+	BodySize int64
+	// StatusCode is the status code of the response.
+	StatusCode int
+	// RequestID is the ID of the request, e.g. set by the requestid middleware, see utils.WithRequestID.
+	RequestID string
+}
+
+// auditor hands the entries of the audited requests to the sink, through a queue serviced by its own goroutine.
+type auditor struct {
+	sink         AuditWriter
+	when         func(*http.Request) bool
+	maxBodyBytes int64
+	redact       []string
+	log          utils.Logger
+
+	mu      sync.Mutex
+	queue   chan *AuditEntry
+	started bool
+	closed  bool
+	done    chan struct{}
+
+	dropped atomic.Uint64
+}
+
+func newAuditor(b *Buffer) *auditor {
+	return &auditor{
+		sink:         b.auditSink,
+		when:         b.auditWhen,
+		maxBodyBytes: b.auditMaxBodyBytes,
+		redact:       b.auditRedact,
+		log:          b.log,
+		queue:        make(chan *AuditEntry, b.auditQueueDepth),
+		done:         make(chan struct{}),
+	}
+}
+
+// matches reports whether the request is audited.
+func (a *auditor) matches(req *http.Request) bool {
+	return a != nil && (a.when == nil || a.when(req))
+}
+
+// entry returns the entry of the request, with the beginning of its buffered body, which is rewound.
+func (a *auditor) entry(req *http.Request, body multibuf.MultiReader, size int64) (*AuditEntry, error) {
+	entry := &AuditEntry{
+		Time:     clock.Now(),
+		Method:   req.Method,
+		URL:      utils.CopyURL(req.URL),
+		Host:     req.Host,
+		Header:   req.Header.Clone(),
+		BodySize: size,
+	}
+	entry.RequestID, _ = utils.RequestIDFromContext(req.Context())
+	for _, name := range a.redact {
+		if values := entry.Header[name]; len(values) != 0 {
+			entry.Header[name] = []string{auditRedacted}
+		}
+	}
+
+	if body == nil || a.maxBodyBytes == 0 {
+		return entry, nil
+	}
+
+	n := size
+	if n > a.maxBodyBytes {
+		n = a.maxBodyBytes
+	}
+	entry.Body = make([]byte, n)
+	if _, err := io.ReadFull(body, entry.Body); err != nil {
+		return nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// enqueue hands the entry to the goroutine of the sink, started on the first entry.
+// The entry is dropped if the queue is full: the request is never blocked by the sink.
+func (a *auditor) enqueue(entry *AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		a.dropped.Add(1)
+		return
+	}
+	if !a.started {
+		a.started = true
+		go a.run()
+	}
+
+	select {
+	case a.queue <- entry:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+func (a *auditor) run() {
+	defer close(a.done)
+
+	for entry := range a.queue {
+		a.write(entry)
+	}
+}
+
+// write passes the entry to the sink, and logs its error or panic.
+func (a *auditor) write(entry *AuditEntry) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			a.log.Error("vulcand/oxy/buffer: panic in audit sink: %v\n%s", recovered, debug.Stack())
+		}
+	}()
+
+	if err := a.sink.Write(*entry); err != nil {
+		a.log.Error("vulcand/oxy/buffer: failed to write audit entry for %s %s, err: %v", entry.Method, entry.URL, err)
+	}
+}
+
+// close stops the goroutine of the sink, once the queued entries are written.
+func (a *auditor) close() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.queue)
+	started := a.started
+	a.mu.Unlock()
+
+	if started {
+		<-a.done
+	}
+}
+
+// statusCode returns the status code of the response written to the ProxyWriter of the request buffer.
+func statusCode(w http.ResponseWriter) int {
+	if pw, ok := w.(*utils.ProxyWriter); ok {
+		return pw.StatusCode()
+	}
+	return 0
+}
+
+// droppedEntries returns the number of entries dropped.
+func (a *auditor) droppedEntries() uint64 {
+	if a == nil {
+		return 0
+	}
+	return a.dropped.Load()
+}
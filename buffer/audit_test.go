@@ -0,0 +1,203 @@
+package buffer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// testAuditWriter records the entries, each write waiting for release if set.
+type testAuditWriter struct {
+	release chan struct{}
+
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (w *testAuditWriter) Write(entry AuditEntry) error {
+	if w.release != nil {
+		<-w.release
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.entries = append(w.entries, entry)
+	return nil
+}
+
+func (w *testAuditWriter) written() []AuditEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]AuditEntry(nil), w.entries...)
+}
+
+func auditPath(path string) func(*http.Request) bool {
+	return func(req *http.Request) bool {
+		return req.URL.Path == path
+	}
+}
+
+func TestBuffer_audit(t *testing.T) {
+	var received string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		received = string(body)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	})
+
+	sink := &testAuditWriter{}
+	st, err := New(handler, AuditSink(sink, auditPath("/audit"), 10), AuditRedactHeaders("authorization"), StreamRequestWhenPossible(true))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, _, err := testutils.Post(proxy.URL+"/audit?a=1", testutils.Body("hello audit"),
+		testutils.Header("Authorization", "Bearer secret"), testutils.Header("X-Trace", "1"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, re.StatusCode)
+	audited := received
+
+	_, _, err = testutils.Post(proxy.URL+"/other", testutils.Body("not audited"))
+	require.NoError(t, err)
+
+	require.NoError(t, st.Close())
+
+	entries := sink.written()
+	require.Len(t, entries, 1)
+
+	entry := entries[0]
+	assert.Equal(t, http.MethodPost, entry.Method)
+	assert.Equal(t, "/audit?a=1", entry.URL.String())
+	assert.Equal(t, "hello audit", audited)
+	assert.Equal(t, audited, string(entry.Body))
+	assert.Equal(t, int64(len(audited)), entry.BodySize)
+	assert.Equal(t, http.StatusCreated, entry.StatusCode)
+	assert.Equal(t, "[redacted]", entry.Header.Get("Authorization"))
+	assert.Equal(t, "1", entry.Header.Get("X-Trace"))
+	assert.False(t, entry.Time.IsZero())
+
+	assert.Equal(t, uint64(0), st.Stats().DroppedAuditEntries)
+}
+
+func TestBuffer_auditTruncatedBody(t *testing.T) {
+	var received string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		received = string(body)
+	})
+
+	sink := &testAuditWriter{}
+	st, err := NewRequestBuffer(handler, AuditSink(sink, nil, 10), AuditMaxBodyBytes(5))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	body := strings.Repeat("0123456789", 10)
+	_, _, err = testutils.Post(proxy.URL, testutils.Body(body))
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+
+	// The backend receives the whole body.
+	assert.Equal(t, body, received)
+
+	entries := sink.written()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "01234", string(entries[0].Body))
+	assert.Equal(t, int64(100), entries[0].BodySize)
+	assert.Equal(t, http.StatusOK, entries[0].StatusCode)
+}
+
+func TestBuffer_auditSlowSink(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	sink := &testAuditWriter{release: make(chan struct{})}
+	st, err := New(handler, AuditSink(sink, nil, 1))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	// The sink is stuck: the requests are served anyway.
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		re, _, err := testutils.Post(proxy.URL, testutils.Body("hello"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Less(t, time.Since(start), time.Second)
+	}
+
+	// At most one entry is written while the other one waits in the queue.
+	dropped := st.Stats().DroppedAuditEntries
+	assert.GreaterOrEqual(t, dropped, uint64(3))
+
+	close(sink.release)
+	require.NoError(t, st.Close())
+
+	assert.Equal(t, 5, len(sink.written())+int(dropped))
+}
+
+func TestBuffer_auditClose(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	sink := &testAuditWriter{release: make(chan struct{})}
+	st, err := New(handler, AuditSink(sink, nil, 10))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	for i := 0; i < 3; i++ {
+		_, _, err = testutils.Post(proxy.URL, testutils.Body("hello"))
+		require.NoError(t, err)
+	}
+	assert.Empty(t, sink.written())
+
+	// Close waits for the queued entries.
+	go close(sink.release)
+	require.NoError(t, st.Close())
+	assert.Len(t, sink.written(), 3)
+
+	// The entries of the requests served once closed are dropped.
+	_, _, err = testutils.Post(proxy.URL, testutils.Body("hello"))
+	require.NoError(t, err)
+	assert.Len(t, sink.written(), 3)
+	assert.Equal(t, uint64(1), st.Stats().DroppedAuditEntries)
+}
+
+func TestBuffer_auditOptions(t *testing.T) {
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+	_, err := New(handler, AuditSink(nil, nil, 10))
+	require.Error(t, err)
+
+	_, err = New(handler, AuditSink(&testAuditWriter{}, nil, 0))
+	require.Error(t, err)
+
+	_, err = New(handler, AuditMaxBodyBytes(-1))
+	require.Error(t, err)
+
+	_, err = NewResponseBuffer(handler, AuditSink(&testAuditWriter{}, nil, 10))
+	require.Error(t, err)
+
+	// Closing a buffer without sink is a no-op.
+	st, err := New(handler)
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+}
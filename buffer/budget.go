@@ -0,0 +1,84 @@
+package buffer
+
+import (
+	stdcontext "context"
+	"net/http"
+	"strconv"
+)
+
+// DefaultRetryBudgetHeader is the header carrying the retry budget between the proxy tiers, see RetryBudget.
+const DefaultRetryBudgetHeader = "X-Retry-Budget"
+
+type retryBudgetKey struct{}
+
+// RetryBudgetFromContext returns the number of retries left to the handlers below the buffer,
+// when the request has a retry budget, see RetryBudget.
+func RetryBudgetFromContext(ctx stdcontext.Context) (int, bool) {
+	remaining, ok := ctx.Value(retryBudgetKey{}).(int)
+	return remaining, ok
+}
+
+// retryBudget is the number of retries left to the whole chain of proxies, for a request.
+type retryBudget struct {
+	header    string
+	remaining int
+}
+
+// newRetryBudget reads the budget of the request, it returns nil when the request has none and the buffer does not emit one.
+func (b *RequestBuffer) newRetryBudget(req *http.Request) *retryBudget {
+	if b.retryBudgetHeader == "" {
+		return nil
+	}
+
+	if remaining, ok := parseRetryBudget(req.Header.Get(b.retryBudgetHeader)); ok {
+		return &retryBudget{header: b.retryBudgetHeader, remaining: remaining}
+	}
+
+	if b.emitRetryBudget {
+		return &retryBudget{header: b.retryBudgetHeader, remaining: DefaultMaxRetryAttempts}
+	}
+	return nil
+}
+
+// parseRetryBudget parses the value of the budget header, the negative budgets are exhausted.
+func parseRetryBudget(value string) (int, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	remaining, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, true
+}
+
+// apply sets the remaining budget on the request of an attempt.
+func (r *retryBudget) apply(req *http.Request) *http.Request {
+	req.Header.Set(r.header, strconv.Itoa(r.remaining))
+	return req.WithContext(stdcontext.WithValue(req.Context(), retryBudgetKey{}, r.remaining))
+}
+
+// update takes the budget left by the next tiers, reported in the response of an attempt, into account.
+func (r *retryBudget) update(header http.Header) {
+	if remaining, ok := parseRetryBudget(header.Get(r.header)); ok && remaining < r.remaining {
+		r.remaining = remaining
+	}
+}
+
+// spend consumes a retry, it returns false if the budget is exhausted.
+func (r *retryBudget) spend() bool {
+	if r.remaining <= 0 {
+		return false
+	}
+	r.remaining--
+	return true
+}
+
+// report sets the remaining budget on the response, for the previous tiers.
+func (r *retryBudget) report(header http.Header) {
+	header.Set(r.header, strconv.Itoa(r.remaining))
+}
@@ -0,0 +1,111 @@
+package buffer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/roundrobin"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// newRetryTier returns a proxy tier retrying the 502 responses of the target up to 5 attempts.
+func newRetryTier(t *testing.T, target string, opts ...Option) *httptest.Server {
+	t.Helper()
+
+	lb, err := roundrobin.New(forward.New(false))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(target)))
+
+	st, err := New(lb, append([]Option{Retry(`ResponseCode() == 502 && Attempts() <= 4`)}, opts...)...)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestBuffer_retryBudget(t *testing.T) {
+	var attempts atomic.Int64
+	var budgets []string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		attempts.Add(1)
+		budgets = append(budgets, req.Header.Get(DefaultRetryBudgetHeader))
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	t.Cleanup(srv.Close)
+
+	inner := newRetryTier(t, srv.URL, RetryBudget(""))
+	edge := newRetryTier(t, inner.URL, EmitRetryBudget(true))
+
+	re, _, err := testutils.Get(edge.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, "0", re.Header.Get(DefaultRetryBudgetHeader))
+
+	// Without the budget, the backend would get 5 * 5 attempts.
+	assert.Equal(t, int64(DefaultMaxRetryAttempts+1), attempts.Load())
+	assert.Equal(t, []string{"10", "9", "8", "7", "6", "5", "4", "3", "2", "1", "0"}, budgets)
+}
+
+func TestBuffer_retryBudgetExhausted(t *testing.T) {
+	var attempts atomic.Int64
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	t.Cleanup(srv.Close)
+
+	inner := newRetryTier(t, srv.URL, RetryBudget(""))
+	edge := newRetryTier(t, inner.URL, EmitRetryBudget(true))
+
+	re, _, err := testutils.Get(edge.URL, testutils.Header(DefaultRetryBudgetHeader, "0"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, int64(1), attempts.Load())
+}
+
+func TestBuffer_retryBudgetDisabled(t *testing.T) {
+	var attempts atomic.Int64
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		attempts.Add(1)
+		assert.Empty(t, req.Header.Get(DefaultRetryBudgetHeader))
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	t.Cleanup(srv.Close)
+
+	edge := newRetryTier(t, srv.URL)
+
+	re, _, err := testutils.Get(edge.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Empty(t, re.Header.Get(DefaultRetryBudgetHeader))
+	assert.Equal(t, int64(5), attempts.Load())
+}
+
+func TestBuffer_retryBudgetFromContext(t *testing.T) {
+	var budgets []int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		remaining, ok := RetryBudgetFromContext(req.Context())
+		assert.True(t, ok)
+		budgets = append(budgets, remaining)
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusBadGateway)))
+	})
+
+	st, err := New(handler, Retry(`ResponseCode() == 502 && Attempts() <= 4`), RetryBudget("X-Budget"))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, _, err := testutils.Get(proxy.URL, testutils.Header("X-Budget", "2"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, "0", re.Header.Get("X-Budget"))
+	assert.Equal(t, []int{2, 1, 0}, budgets)
+}
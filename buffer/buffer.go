@@ -4,6 +4,8 @@ Package buffer provides http.Handler middleware that solves several problems whe
 Reads the entire request and response into buffer, optionally buffering it to disk for large requests.
 Checks the limits for the requests and responses, rejecting in case if the limit was exceeded.
 Changes request content-transfer-encoding from chunked and provides total size to the handlers.
+Provides the buffered request body to the handlers as an io.ReadSeeker, see SeekerFromRequest.
+Lets selected requests, e.g. websockets and server-sent events, bypass the buffering, see SkipWhen.
 
 Examples of a buffering middleware:
 
@@ -31,16 +33,51 @@ Examples of a buffering middleware:
 	// Buffer will replay the request if the handler returns error at least 3 times
 	// before returning the response
 	buffer.New(handler, buffer.Retry(`IsNetworkError() && Attempts() <= 2`))
+
+	// The retries are shared with the other proxy tiers through the X-Retry-Budget header,
+	// the edge tier sets the budget of the requests without it.
+	buffer.New(handler,
+	  buffer.Retry(`IsNetworkError() && Attempts() <= 2`),
+	  buffer.RetryBudget(buffer.DefaultRetryBudgetHeader),
+	  buffer.EmitRetryBudget(true))
+
+	// The responses of the attempts, retried or not, are logged.
+	buffer.New(handler,
+	  buffer.Retry(`ResponseCode() == 503 && Attempts() <= 2`),
+	  buffer.OnAttempt(func(a buffer.AttemptInfo) {
+	    log.Printf("attempt %d: %d %q", a.Attempt, a.StatusCode, a.BodyPreview)
+	  }))
+
+Request and response buffering can also be used independently:
+
+	// Only the request is buffered, the response is streamed to the client.
+	buffer.NewRequestBuffer(handler,
+	  buffer.MaxRequestBodyBytes(10 * 1024 * 1024))
+
+	// Only the response is buffered.
+	buffer.NewResponseBuffer(handler,
+	  buffer.MaxResponseBodyBytes(10 * 1024 * 1024))
+
+	// The responses larger than 1MB are streamed to the client, and can't be retried.
+	buffer.New(handler,
+	  buffer.ResponseBufferThreshold(1024 * 1024),
+	  buffer.Retry(`IsNetworkError() && Attempts() <= 2`))
+
+	// The upgrades and the server-sent events are passed as is to the handler.
+	buffer.New(handler,
+	  buffer.MaxResponseBodyBytes(10 * 1024 * 1024),
+	  buffer.SkipWhen(buffer.SkipUpgradesAndSSE))
 */
 package buffer
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
-	"io"
-	"net"
 	"net/http"
-	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mailgun/multibuf"
 	"github.com/vulcand/oxy/v2/utils"
@@ -59,33 +96,155 @@ var errHandler utils.ErrorHandler = &SizeErrHandler{}
 
 // Buffer is responsible for buffering requests and responses
 // It buffers large requests and responses to disk,.
+// It is the composition of a RequestBuffer and a ResponseBuffer.
+// Its options can be updated while it serves requests, see UpdateOptions.
 type Buffer struct {
+	settings
+
+	skipped atomic.Uint64
+	audit   *auditor
+
+	next http.Handler
+
+	// mu serializes the updates of the options.
+	mu sync.Mutex
+	// config is the snapshot of the options the requests are served with, see UpdateOptions.
+	config atomic.Pointer[config]
+}
+
+// settings are the fields set by the options.
+type settings struct {
 	maxRequestBodyBytes int64
 	memRequestBodyBytes int64
 
 	maxResponseBodyBytes int64
 	memResponseBodyBytes int64
+	responseThreshold    int64
 
 	retryPredicate hpredicate
 
-	next       http.Handler
+	retryBudgetHeader string
+	emitRetryBudget   bool
+
+	onAttempt               func(AttemptInfo)
+	attemptBodyPreviewBytes int64
+
+	skip func(*http.Request) bool
+
+	streamRequest        bool
+	requireContentLength bool
+	strictContentLength  bool
+	convertTrailers      bool
+
+	requestDigestAlgorithms []string
+	requireDigest           bool
+	multipartLimits         *Limits
+	responseDigestAlgorithm string
+
+	minBackendBudget time.Duration
+
+	auditSink         AuditWriter
+	auditWhen         func(*http.Request) bool
+	auditQueueDepth   int
+	auditMaxBodyBytes int64
+	auditRedact       []string
+
 	errHandler utils.ErrorHandler
 
 	verbose bool
 	log     utils.Logger
+
+	// names of the options that only apply to one side of the buffering.
+	requestOptions  []string
+	responseOptions []string
+}
+
+// config is a snapshot of the options of a Buffer: the requests keep the snapshot of their start.
+type config struct {
+	skip       func(*http.Request) bool
+	errHandler utils.ErrorHandler
+	verbose    bool
+	log        utils.Logger
+
+	next    http.Handler
+	request *RequestBuffer
 }
 
 // New returns a new buffer middleware. New() function supports optional functional arguments.
+// next can be nil, and set later with Wrap.
 func New(next http.Handler, setters ...Option) (*Buffer, error) {
-	strm := &Buffer{
-		next: next,
+	strm, err := newBuffer(next, setters...)
+	if err != nil {
+		return nil, err
+	}
+
+	strm.config.Store(strm.newConfig())
+	return strm, nil
+}
+
+// newConfig builds the request and response buffers of the current options.
+func (b *Buffer) newConfig() *config {
+	// The requests to skip never reach the request and response buffers.
+	response := newResponseBuffer(b, b.next)
+	response.verbose = false
+	response.skip = nil
+	response.component = "buffer"
+	request := newRequestBuffer(b, response)
+	request.verbose = false
+	request.skip = nil
+	request.component = "buffer"
+
+	return &config{
+		skip:       b.skip,
+		errHandler: b.errHandler,
+		verbose:    b.verbose,
+		log:        b.log,
+		next:       b.next,
+		request:    request,
+	}
+}
+
+// UpdateOptions applies the options to the buffer while it serves requests, e.g. when its route is reloaded.
+// The options are applied on top of the current ones, all or none: if one of them fails, the buffer is left unchanged.
+// The requests in progress keep the options of their start, and the Stats are kept.
+// The audit options (AuditSink, AuditMaxBodyBytes, AuditRedactHeaders) can't be updated.
+func (b *Buffer) UpdateOptions(setters ...Option) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	updated := &Buffer{settings: b.settings, audit: b.audit, next: b.next}
+	// only the names of the updated options are checked, they are not kept.
+	updated.requestOptions, updated.responseOptions = nil, nil
+	for _, s := range setters {
+		if err := s(updated); err != nil {
+			return err
+		}
+	}
+	for _, name := range updated.requestOptions {
+		if strings.HasPrefix(name, "Audit") {
+			return fmt.Errorf("option can't be updated: %s", name)
+		}
+	}
+
+	updated.requestOptions, updated.responseOptions = nil, nil
+	b.settings = updated.settings
+	b.config.Store(b.newConfig())
+	return nil
+}
 
+func newBuffer(next http.Handler, setters ...Option) (*Buffer, error) {
+	strm := &Buffer{next: next}
+	strm.settings = settings{
 		maxRequestBodyBytes: DefaultMaxBodyBytes,
 		memRequestBodyBytes: DefaultMemBodyBytes,
 
 		maxResponseBodyBytes: DefaultMaxBodyBytes,
 		memResponseBodyBytes: DefaultMemBodyBytes,
 
+		attemptBodyPreviewBytes: DefaultAttemptBodyPreviewBytes,
+
+		auditMaxBodyBytes: DefaultAuditMaxBodyBytes,
+
 		log: &utils.NoopLogger{},
 	}
 
@@ -97,247 +256,120 @@ func New(next http.Handler, setters ...Option) (*Buffer, error) {
 	if strm.errHandler == nil {
 		strm.errHandler = errHandler
 	}
+	if strm.auditSink != nil {
+		strm.audit = newAuditor(strm)
+	}
 
 	return strm, nil
 }
 
-// Wrap sets the next handler to be called by buffer handler.
+// Wrap sets the next handler to be called by buffer handler, when it was created without.
 func (b *Buffer) Wrap(next http.Handler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := utils.CheckWrap(b.next, next); err != nil {
+		return err
+	}
 	b.next = next
+	b.config.Store(b.newConfig())
 	return nil
 }
 
 func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if b.verbose {
+	c := b.config.Load()
+
+	if c.verbose && utils.DebugEnabled(c.log) {
 		dump := utils.DumpHTTPRequest(req)
-		b.log.Debug("vulcand/oxy/buffer: begin ServeHttp on request: %s", dump)
-		defer b.log.Debug("vulcand/oxy/buffer: completed ServeHttp on request: %s", dump)
+		c.log.Debug("vulcand/oxy/buffer: begin ServeHttp on request: %s", dump)
+		defer c.log.Debug("vulcand/oxy/buffer: completed ServeHttp on request: %s", dump)
 	}
 
-	if err := b.checkLimit(req); err != nil {
-		b.log.Error("vulcand/oxy/buffer: request body over limit, err: %v", err)
-		b.errHandler.ServeHTTP(w, req, err)
+	if c.next == nil {
+		utils.ServeError(c.errHandler, w, req, "buffer", &utils.ErrNotWired{Middleware: "buffer"})
 		return
 	}
 
-	// Read the body while keeping limits in mind. This reader controls the maximum bytes
-	// to read into memory and disk. This reader returns an error if the total request size exceeds the
-	// predefined MaxSizeBytes. This can occur if we got chunked request, in this case ContentLength would be set to -1
-	// and the reader would be unbounded bufio in the http.Server
-	body, err := multibuf.New(req.Body, multibuf.MaxBytes(b.maxRequestBodyBytes), multibuf.MemBytes(b.memRequestBodyBytes))
-	if err != nil || body == nil {
-		if req.Context().Err() != nil {
-			b.log.Error("vulcand/oxy/buffer: error when reading request body, err: %v", req.Context().Err())
-			b.errHandler.ServeHTTP(w, req, req.Context().Err())
-			return
-		}
-
-		b.log.Error("vulcand/oxy/buffer: error when reading request body, err: %v", err)
-		b.errHandler.ServeHTTP(w, req, err)
+	if c.skip != nil && c.skip(req) {
+		b.skipped.Add(1)
+		c.next.ServeHTTP(w, req)
 		return
 	}
 
-	// Set request body to buffered reader that can replay the read and execute Seek
-	// Note that we don't change the original request body as it's handled by the http server
-	// and we don't want to mess with standard library
-	defer func() {
-		if body != nil {
-			errClose := body.Close()
-			if errClose != nil {
-				b.log.Error("vulcand/oxy/buffer: failed to close body, err: %v", errClose)
-			}
-		}
-	}()
-
-	// We need to set ContentLength based on known request size. The incoming request may have been
-	// set without content length or using chunked TransferEncoding
-	totalSize, err := body.Size()
-	if err != nil {
-		b.log.Error("vulcand/oxy/buffer: failed to get request size, err: %v", err)
-		b.errHandler.ServeHTTP(w, req, err)
-		return
-	}
-
-	if totalSize == 0 {
-		body = nil
-	}
-
-	outReq := b.copyRequest(req, body, totalSize)
-
-	attempt := 1
-	for {
-		// We create a special writer that will limit the response size, buffer it to disk if necessary
-		writer, err := multibuf.NewWriterOnce(multibuf.MaxBytes(b.maxResponseBodyBytes), multibuf.MemBytes(b.memResponseBodyBytes))
-		if err != nil {
-			b.log.Error("vulcand/oxy/buffer: failed create response writer, err: %v", err)
-			b.errHandler.ServeHTTP(w, req, err)
-			return
-		}
-
-		// We are mimicking http.ResponseWriter to replace writer with our special writer
-		bw := &bufferWriter{
-			header:         make(http.Header),
-			buffer:         writer,
-			responseWriter: w,
-			log:            b.log,
-		}
-		defer bw.Close()
-
-		b.next.ServeHTTP(bw, outReq)
-		if bw.hijacked {
-			b.log.Debug("vulcand/oxy/buffer: connection was hijacked downstream. Not taking any action in buffer.")
-			return
-		}
-
-		var reader multibuf.MultiReader
-		if bw.expectBody(outReq) {
-			rdr, err := writer.Reader()
-			if err != nil {
-				b.log.Error("vulcand/oxy/buffer: failed to read response, err: %v", err)
-				b.errHandler.ServeHTTP(w, req, err)
-				return
-			}
-			defer rdr.Close()
-			reader = rdr
-		}
-
-		if (b.retryPredicate == nil || attempt > DefaultMaxRetryAttempts) ||
-			!b.retryPredicate(&context{r: req, attempt: attempt, responseCode: bw.code}) {
-			utils.CopyHeaders(w.Header(), bw.Header())
-			w.WriteHeader(bw.code)
-			if reader != nil {
-				_, _ = io.Copy(w, reader)
-			}
-			return
-		}
-
-		attempt++
-		if body != nil {
-			if _, err := body.Seek(0, 0); err != nil {
-				b.log.Error("vulcand/oxy/buffer: failed to rewind response body, err: %v", err)
-				b.errHandler.ServeHTTP(w, req, err)
-				return
-			}
-		}
-
-		outReq = b.copyRequest(req, body, totalSize)
-		b.log.Debug("vulcand/oxy/buffer: retry Request(%v %v) attempt %v", req.Method, req.URL, attempt)
-	}
+	c.request.ServeHTTP(w, req)
 }
 
-func (b *Buffer) copyRequest(req *http.Request, body io.ReadCloser, bodySize int64) *http.Request {
-	o := *req
-	o.URL = utils.CopyURL(req.URL)
-	o.Header = make(http.Header)
-	utils.CopyHeaders(o.Header, req.Header)
-	o.ContentLength = bodySize
-	// remove TransferEncoding that could have been previously set because we have transformed the request from chunked encoding
-	o.TransferEncoding = []string{}
-	// http.Transport will close the request body on any error, we are controlling the close process ourselves, so we override the closer here
-	if body == nil {
-		o.Body = io.NopCloser(req.Body)
-	} else {
-		o.Body = io.NopCloser(body.(io.Reader))
-	}
-	return &o
+// Stats returns the statistics of the buffer.
+func (b *Buffer) Stats() Stats {
+	return Stats{SkippedRequests: b.skipped.Load(), DroppedAuditEntries: b.audit.droppedEntries()}
 }
 
-func (b *Buffer) checkLimit(req *http.Request) error {
-	if b.maxRequestBodyBytes <= 0 {
-		return nil
-	}
-	if req.ContentLength > b.maxRequestBodyBytes {
-		return &multibuf.MaxSizeReachedError{MaxSize: b.maxRequestBodyBytes}
-	}
+// Close stops the goroutine of the AuditSink, once the queued entries are written.
+// The entries of the requests completed afterwards are dropped.
+func (b *Buffer) Close() error {
+	b.audit.close()
 	return nil
 }
 
-type bufferWriter struct {
-	header         http.Header
-	code           int
-	buffer         multibuf.WriterOnce
-	responseWriter http.ResponseWriter
-	hijacked       bool
-	log            utils.Logger
-}
-
-// RFC2616 #4.4.
-func (b *bufferWriter) expectBody(r *http.Request) bool {
-	if r.Method == http.MethodHead {
-		return false
-	}
-	if (b.code >= 100 && b.code < 200) || b.code == 204 || b.code == 304 {
-		return false
-	}
-	// refer to https://github.com/vulcand/oxy/issues/113
-	// if b.header.Get("Content-Length") == "" && b.header.Get("Transfer-Encoding") == "" {
-	// 	return false
-	// }
-	if b.header.Get("Content-Length") == "0" {
-		return false
-	}
-	// Support for gRPC, gRPC Web.
-	if grpcStatus := b.header.Get("Grpc-Status"); grpcStatus != "" && grpcStatus != "0" {
-		return false
+// handlePanic passes the panic of the next handler to the error handler, as a utils.ErrPanicInHandler of the component.
+// If the response has already been started, the connection is aborted instead: the client must not take it as complete.
+func handlePanic(w http.ResponseWriter, req *http.Request, err *utils.ErrPanicInHandler, wroteHeader, hijacked bool,
+	errHandler utils.ErrorHandler, component string, log utils.Logger,
+) {
+	log.Error("vulcand/oxy/buffer: %v\n%s", err, err.Stack)
+
+	switch {
+	case hijacked:
+		// The connection belongs to the handler.
+	case wroteHeader:
+		panic(http.ErrAbortHandler)
+	default:
+		utils.ServeError(errHandler, w, req, component, err)
 	}
-	return true
 }
 
-func (b *bufferWriter) Close() error {
-	return b.buffer.Close()
-}
-
-func (b *bufferWriter) Header() http.Header {
-	return b.header
-}
+// SizeErrHandler Size error handler.
+type SizeErrHandler struct{}
 
-func (b *bufferWriter) Write(buf []byte) (int, error) {
-	length, err := b.buffer.Write(buf)
-	if err != nil {
-		// Since go1.11 (https://github.com/golang/go/commit/8f38f28222abccc505b9a1992deecfe3e2cb85de)
-		// if the writer returns an error, the reverse proxy panics
-		b.log.Error("write: %v", err)
-		length = len(buf)
+// It also answers 400 to the requests failing the digest verification, the Content-Length check or the multipart parse,
+// 413 or 415 to the multipart requests over their MultipartLimits, and 408 to the requests not buffered in time (see MinBackendBudget).
+func (e *SizeErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	var maxSize *multibuf.MaxSizeReachedError
+	if errors.As(err, &maxSize) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
+		return
 	}
-	return length, nil
-}
 
-// WriteHeader sets rw.Code.
-func (b *bufferWriter) WriteHeader(code int) {
-	b.code = code
-}
-
-// CloseNotify CloseNotifier interface - this allows downstream connections to be terminated when the client terminates.
-func (b *bufferWriter) CloseNotify() <-chan bool {
-	if cn, ok := b.responseWriter.(http.CloseNotifier); ok {
-		return cn.CloseNotify()
+	var errBudget *ErrBackendBudget
+	if errors.As(err, &errBudget) {
+		w.WriteHeader(http.StatusRequestTimeout)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusRequestTimeout)))
+		return
 	}
-	b.log.Warn("Upstream ResponseWriter of type %v does not implement http.CloseNotifier. Returning dummy channel.", reflect.TypeOf(b.responseWriter))
-	return make(<-chan bool)
-}
 
-// Hijack This allows connections to be hijacked for websockets for instance.
-func (b *bufferWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	if hi, ok := b.responseWriter.(http.Hijacker); ok {
-		conn, rw, err := hi.Hijack()
-		if err == nil {
-			b.hijacked = true
-		}
-		return conn, rw, err
+	var partLimit *MultipartLimitError
+	if errors.As(err, &partLimit) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
+		return
 	}
-	b.log.Warn("Upstream ResponseWriter of type %v does not implement http.Hijacker.", reflect.TypeOf(b.responseWriter))
-	return nil, nil, fmt.Errorf("the response writer wrapped in this proxy does not implement http.Hijacker. Its type is: %v", reflect.TypeOf(b.responseWriter))
-}
 
-// SizeErrHandler Size error handler.
-type SizeErrHandler struct{}
+	var partContentType *MultipartContentTypeError
+	if errors.As(err, &partContentType) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusUnsupportedMediaType)))
+		return
+	}
 
-func (e *SizeErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
-	//nolint:errorlint // must be changed
-	if _, ok := err.(*multibuf.MaxSizeReachedError); ok {
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
-		_, _ = w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
+	var mismatch *DigestMismatchError
+	var lengthMismatch *ErrContentLengthMismatch
+	var malformed *MalformedMultipartError
+	if errors.As(err, &mismatch) || errors.Is(err, ErrDigestRequired) || errors.As(err, &lengthMismatch) || errors.As(err, &malformed) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusBadRequest)))
 		return
 	}
+
 	utils.DefaultHandler.ServeHTTP(w, req, err)
 }
@@ -2,7 +2,9 @@ package buffer
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
@@ -14,6 +16,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/roundrobin"
 	"github.com/vulcand/oxy/v2/testutils"
 	"github.com/vulcand/oxy/v2/utils"
 )
@@ -46,6 +49,48 @@ func TestBuffer_simple(t *testing.T) {
 	assert.Equal(t, "hello", string(body))
 }
 
+// The buffered bodies can be hashed by the signer of the forwarder, the backend still receives them.
+func TestBuffer_signedBody(t *testing.T) {
+	var reqBody, reqHash string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		reqBody = string(body)
+		reqHash = req.Header.Get("X-Content-Sha256")
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	fwd := forward.New(false, forward.Signer(func(outReq *http.Request) error {
+		sum, err := forward.ContentSHA256(outReq)
+		if err != nil {
+			return err
+		}
+		outReq.Header.Set("X-Content-Sha256", sum)
+		return nil
+	}))
+
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := New(rdr)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Post(proxy.URL, testutils.Body("payload"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "payload", reqBody)
+
+	sum := sha256.Sum256([]byte("payload"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), reqHash)
+}
+
 func TestBuffer_chunkedEncodingSuccess(t *testing.T) {
 	var reqBody string
 	var contentLength int64
@@ -444,3 +489,42 @@ func TestBuffer_GRPC_OKResponse(t *testing.T) {
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 	assert.Equal(t, "grpc-body", string(body))
 }
+
+func TestBuffer_errorComponents(t *testing.T) {
+	var components []string
+	shared := utils.ChainErrorHandlers(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		var ec *utils.ErrorContext
+		require.ErrorAs(t, err, &ec)
+		components = append(components, ec.Component)
+		utils.PassError(w, req, err)
+	}), &SizeErrHandler{})
+
+	fwd := forward.New(false, forward.ErrorHandler(shared))
+
+	lb, err := roundrobin.New(fwd, roundrobin.ErrorHandler(shared))
+	require.NoError(t, err)
+
+	st, err := New(lb, MaxRequestBodyBytes(4), ErrorHandler(shared))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	// No server in the load balancer.
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+
+	// The request body is over the limit of the buffer.
+	re, _, err = testutils.Get(proxy.URL, testutils.Body("too large"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, re.StatusCode)
+
+	// The backend can't be reached.
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://localhost:63450")))
+	re, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+
+	assert.Equal(t, []string{"roundrobin", "buffer", "forward"}, components)
+}
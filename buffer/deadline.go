@@ -0,0 +1,128 @@
+package buffer
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// ErrBackendBudget is returned when the deadline of the request context does not leave MinBackendBudget to the backend
+// while the request body is buffered: the buffering is aborted, and the backend is not called.
+type ErrBackendBudget struct {
+	Deadline  time.Time
+	MinBudget time.Duration
+}
+
+func (e *ErrBackendBudget) Error() string {
+	return fmt.Sprintf("request deadline %s does not leave %v to the backend", e.Deadline.Format(time.RFC3339Nano), e.MinBudget)
+}
+
+// backendBudget checks that the deadline of a request leaves minBudget to the backend, see MinBackendBudget.
+// The deadline is converted to the clock of the buffer when the request is received.
+type backendBudget struct {
+	deadline  time.Time
+	end       clock.Time
+	minBudget time.Duration
+}
+
+// newBackendBudget returns the budget of a request whose context is ctx, nil if the context has no deadline.
+func newBackendBudget(ctx stdcontext.Context, minBudget time.Duration) *backendBudget {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	return &backendBudget{deadline: deadline, end: clock.Now().Add(time.Until(deadline)), minBudget: minBudget}
+}
+
+// check returns an ErrBackendBudget once the deadline does not leave minBudget to the backend.
+func (b *backendBudget) check() error {
+	if b == nil || b.left() > 0 {
+		return nil
+	}
+	return b.err()
+}
+
+// left returns the time until the deadline does not leave minBudget to the backend.
+func (b *backendBudget) left() time.Duration {
+	return b.end.Sub(clock.Now()) - b.minBudget
+}
+
+func (b *backendBudget) err() error {
+	return &ErrBackendBudget{Deadline: b.deadline, MinBudget: b.minBudget}
+}
+
+// deadlineReader fails the reads once the deadline of the request does not leave the budget to the backend.
+// The reads are done by a goroutine, so that a read blocked on a silent client is abandoned when the budget runs out:
+// the reader must not be read anymore once it has failed, and must be closed.
+type deadlineReader struct {
+	reader io.Reader
+	budget *backendBudget
+
+	timer clock.Timer
+	// sizes passes the size of the reads to the goroutine, which reads into buf and sends the result.
+	sizes   chan int
+	results chan readResult
+	buf     []byte
+	// expired is set once the budget ran out during a read.
+	expired bool
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func newDeadlineReader(reader io.Reader, budget *backendBudget) *deadlineReader {
+	return &deadlineReader{reader: reader, budget: budget}
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if d.expired {
+		return 0, d.budget.err()
+	}
+	if err := d.budget.check(); err != nil {
+		return 0, err
+	}
+
+	if d.sizes == nil {
+		d.timer = clock.NewTimer(d.budget.left())
+		d.sizes = make(chan int)
+		d.results = make(chan readResult, 1)
+		go d.run()
+	}
+	if len(d.buf) < len(p) {
+		d.buf = make([]byte, len(p))
+	}
+
+	d.sizes <- len(p)
+	select {
+	case r := <-d.results:
+		n := copy(p, d.buf[:r.n])
+		if r.err == nil {
+			r.err = d.budget.check()
+		}
+		return n, r.err
+	case <-d.timer.C():
+		d.expired = true
+		return 0, d.budget.err()
+	}
+}
+
+func (d *deadlineReader) run() {
+	for size := range d.sizes {
+		n, err := d.reader.Read(d.buf[:size])
+		d.results <- readResult{n: n, err: err}
+	}
+}
+
+// close stops the timer and the goroutine, once its pending read, if any, returns.
+func (d *deadlineReader) close() {
+	if d.sizes == nil {
+		return
+	}
+	d.timer.Stop()
+	close(d.sizes)
+}
@@ -0,0 +1,200 @@
+package buffer
+
+import (
+	"bufio"
+	stdcontext "context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// withDeadline serves the requests with h, with a deadline of the request context d after their start.
+// The time spent by h is sent to elapsed.
+func withDeadline(h http.Handler, d time.Duration, elapsed chan<- time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := clock.Now()
+		ctx, cancel := stdcontext.WithTimeout(req.Context(), d)
+		defer cancel()
+
+		h.ServeHTTP(w, req.WithContext(ctx))
+		elapsed <- clock.Since(start)
+	})
+}
+
+func TestMinBackendBudget_slowClient(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	var calls atomic.Int64
+	next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		calls.Add(1)
+	})
+
+	st, err := New(next, MinBackendBudget(500*time.Millisecond))
+	require.NoError(t, err)
+
+	elapsed := make(chan time.Duration, 1)
+	proxy := httptest.NewServer(withDeadline(st, time.Second, elapsed))
+	t.Cleanup(proxy.Close)
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 20\r\n\r\n"))
+	require.NoError(t, err)
+
+	// The client sends a byte every 100ms, until it gets the response.
+	responded := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < 20; i++ {
+			if _, err := conn.Write([]byte("a")); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			select {
+			case <-responded:
+				return
+			default:
+			}
+			clock.Advance(100 * time.Millisecond)
+		}
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	close(responded)
+	<-sent
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	assert.Equal(t, int64(0), calls.Load())
+
+	// The buffering is aborted on the first byte received from 500ms.
+	d := <-elapsed
+	assert.GreaterOrEqual(t, d, 500*time.Millisecond)
+	assert.LessOrEqual(t, d, 600*time.Millisecond)
+}
+
+func TestMinBackendBudget_stalledClient(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	var calls atomic.Int64
+	next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		calls.Add(1)
+	})
+
+	st, err := New(next, MinBackendBudget(500*time.Millisecond))
+	require.NoError(t, err)
+
+	elapsed := make(chan time.Duration, 1)
+	proxy := httptest.NewServer(withDeadline(st, 10*time.Second, elapsed))
+	t.Cleanup(proxy.Close)
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	// The client stops sending in the middle of the body, without closing the connection.
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 20\r\n\r\nhello"))
+	require.NoError(t, err)
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		done <- result{resp: resp, err: err}
+	}()
+
+	var res result
+	testutils.AdvanceUntil(t, func() bool {
+		select {
+		case res = <-done:
+			return true
+		default:
+			return false
+		}
+	}, 100*time.Millisecond, 10*time.Second)
+
+	require.NoError(t, res.err)
+	_ = res.resp.Body.Close()
+
+	assert.Equal(t, http.StatusRequestTimeout, res.resp.StatusCode)
+	assert.Equal(t, int64(0), calls.Load())
+
+	// The pending read is abandoned once the deadline leaves 500ms.
+	d := <-elapsed
+	assert.GreaterOrEqual(t, d, 9500*time.Millisecond)
+	assert.LessOrEqual(t, d, 9600*time.Millisecond)
+}
+
+func TestMinBackendBudget_fastClient(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		_, _ = w.Write(body)
+	})
+
+	st, err := New(next, MinBackendBudget(500*time.Millisecond))
+	require.NoError(t, err)
+
+	elapsed := make(chan time.Duration, 1)
+	proxy := httptest.NewServer(withDeadline(st, time.Second, elapsed))
+	t.Cleanup(proxy.Close)
+
+	resp, body, err := testutils.Post(proxy.URL, testutils.Body("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, time.Duration(0), <-elapsed)
+}
+
+func TestMinBackendBudget_retries(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	// Each attempt takes 200ms.
+	var calls atomic.Int64
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		clock.Advance(200 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("unavailable"))
+	})
+
+	st, err := New(next, Retry(`Attempts() <= 5`), MinBackendBudget(500*time.Millisecond))
+	require.NoError(t, err)
+
+	elapsed := make(chan time.Duration, 1)
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://localhost", strings.NewReader("hello"))
+	withDeadline(st, time.Second, elapsed).ServeHTTP(rw, req)
+
+	// The attempts start at 0, 200ms and 400ms: at 600ms, less than 500ms are left.
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "unavailable", rw.Body.String())
+	assert.Equal(t, int64(3), calls.Load())
+	assert.Equal(t, 600*time.Millisecond, <-elapsed)
+}
+
+func TestMinBackendBudget_invalid(t *testing.T) {
+	_, err := New(nil, MinBackendBudget(-time.Second))
+	require.Error(t, err)
+}
@@ -0,0 +1,118 @@
+package buffer
+
+import (
+	"crypto/md5" //nolint:gosec // Content-MD5 and the md5 digest are defined by RFC 1864 and RFC 3230.
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Digest algorithms, as registered for the Digest header (RFC 3230).
+const (
+	DigestSHA256 = "sha-256"
+	DigestSHA512 = "sha-512"
+	DigestMD5    = "md5"
+)
+
+const (
+	digestHeader     = "Digest"
+	contentMD5Header = "Content-Md5"
+)
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	DigestSHA256: sha256.New,
+	DigestSHA512: sha512.New,
+	DigestMD5:    md5.New,
+}
+
+// ErrDigestRequired is returned when RequireDigest is set and the request has no digest to verify.
+var ErrDigestRequired = errors.New("request digest required")
+
+// DigestMismatchError is returned when the digest of the request body does not match the digest sent by the client.
+type DigestMismatchError struct {
+	Algorithm string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("request body does not match the %s digest", e.Algorithm)
+}
+
+func normalizeDigestAlgorithm(algorithm string) (string, error) {
+	a := strings.ToLower(strings.TrimSpace(algorithm))
+	if _, ok := digestAlgorithms[a]; !ok {
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	return a, nil
+}
+
+// expectedDigest is a digest sent by the client, and the hash computing it over the received body.
+type expectedDigest struct {
+	algorithm string
+	value     string
+	hash      hash.Hash
+}
+
+// requestDigests returns the digests of the request using one of the accepted algorithms,
+// from the Digest and Content-MD5 headers.
+func requestDigests(h http.Header, accepted []string) []*expectedDigest {
+	var digests []*expectedDigest
+
+	for _, value := range h.Values(digestHeader) {
+		for _, v := range strings.Split(value, ",") {
+			algorithm, sum, ok := strings.Cut(strings.TrimSpace(v), "=")
+			if !ok {
+				continue
+			}
+			algorithm = strings.ToLower(algorithm)
+			if !contains(accepted, algorithm) {
+				continue
+			}
+			digests = append(digests, &expectedDigest{algorithm: algorithm, value: sum, hash: digestAlgorithms[algorithm]()})
+		}
+	}
+
+	if sum := h.Get(contentMD5Header); sum != "" && contains(accepted, DigestMD5) {
+		digests = append(digests, &expectedDigest{algorithm: DigestMD5, value: sum, hash: digestAlgorithms[DigestMD5]()})
+	}
+
+	return digests
+}
+
+// digestReader computes the digests while the body is read.
+func digestReader(r io.Reader, digests []*expectedDigest) io.Reader {
+	writers := make([]io.Writer, 0, len(digests))
+	for _, d := range digests {
+		writers = append(writers, d.hash)
+	}
+	return io.TeeReader(r, io.MultiWriter(writers...))
+}
+
+// verifyDigests checks the digests computed over the read body.
+func verifyDigests(digests []*expectedDigest) error {
+	for _, d := range digests {
+		if base64.StdEncoding.EncodeToString(d.hash.Sum(nil)) != strings.TrimSpace(d.value) {
+			return &DigestMismatchError{Algorithm: d.algorithm}
+		}
+	}
+	return nil
+}
+
+// digestValue returns the value of the Digest header for the computed hash.
+func digestValue(algorithm string, h hash.Hash) string {
+	return algorithm + "=" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package buffer
+
+import (
+	"crypto/md5" //nolint:gosec // Content-MD5 is defined by RFC 1864.
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestRequestBuffer_verifyDigest(t *testing.T) {
+	const body = "amount=42&currency=EUR"
+
+	sha := sha256.Sum256([]byte(body))
+	sum := md5.Sum([]byte(body)) //nolint:gosec // Content-MD5 is defined by RFC 1864.
+
+	testCases := []struct {
+		desc           string
+		body           string
+		header         http.Header
+		opts           []Option
+		expectedStatus int
+	}{
+		{
+			desc:           "valid sha-256",
+			body:           body,
+			header:         http.Header{"Digest": {"SHA-256=" + base64.StdEncoding.EncodeToString(sha[:])}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "tampered sha-256",
+			body:           "amount=4200&currency=EUR",
+			header:         http.Header{"Digest": {"sha-256=" + base64.StdEncoding.EncodeToString(sha[:])}},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "valid Content-MD5",
+			body:           body,
+			header:         http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "tampered Content-MD5",
+			body:           "amount=4200&currency=EUR",
+			header:         http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "algorithm not accepted",
+			body:           "amount=4200&currency=EUR",
+			header:         http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}},
+			opts:           []Option{VerifyRequestDigest(DigestSHA256)},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "missing digest",
+			body:           body,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			desc:           "missing required digest",
+			body:           body,
+			opts:           []Option{RequireDigest(true)},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var received string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				b, err := io.ReadAll(req.Body)
+				require.NoError(t, err)
+				received = string(b)
+			})
+
+			st, err := NewRequestBuffer(handler, append([]Option{VerifyRequestDigest()}, test.opts...)...)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+			for k, v := range test.header {
+				req.Header[k] = v
+			}
+
+			rw := httptest.NewRecorder()
+			st.ServeHTTP(rw, req)
+
+			assert.Equal(t, test.expectedStatus, rw.Code)
+			if test.expectedStatus == http.StatusOK {
+				assert.Equal(t, test.body, received)
+			} else {
+				assert.Empty(t, received)
+			}
+		})
+	}
+}
+
+func TestResponseBuffer_addDigest(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("payment "))
+		_, _ = w.Write([]byte("accepted"))
+	})
+
+	st, err := NewResponseBuffer(handler, AddResponseDigest("SHA-256"))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(body)
+	assert.Equal(t, "payment accepted", string(body))
+	assert.Equal(t, "sha-256="+base64.StdEncoding.EncodeToString(sum[:]), re.Header.Get("Digest"))
+}
+
+func TestDigestOptions(t *testing.T) {
+	_, err := NewRequestBuffer(nil, VerifyRequestDigest("crc32"))
+	require.Error(t, err)
+
+	_, err = NewResponseBuffer(nil, AddResponseDigest("crc32"))
+	require.Error(t, err)
+
+	_, err = NewResponseBuffer(nil, VerifyRequestDigest())
+	require.Error(t, err)
+
+	_, err = NewRequestBuffer(nil, AddResponseDigest(DigestSHA256))
+	require.Error(t, err)
+}
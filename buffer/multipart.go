@@ -0,0 +1,286 @@
+package buffer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Limits are the limits of the multipart/form-data requests, see MultipartLimits.
+// The zero values are not limited.
+type Limits struct {
+	// MaxParts is the maximum number of parts of a request.
+	MaxParts int
+	// MaxPartBytes is the maximum size of the file parts, the parts with a file name.
+	MaxPartBytes int64
+	// MaxFieldBytes is the maximum size of the other parts, the form fields.
+	MaxFieldBytes int64
+	// AllowedContentTypes are the media types accepted for the file parts, e.g. "image/png".
+	// The file parts without Content-Type are text/plain (RFC 7578).
+	AllowedContentTypes []string
+}
+
+func (l *Limits) validate() error {
+	if l.MaxParts < 0 || l.MaxPartBytes < 0 || l.MaxFieldBytes < 0 {
+		return fmt.Errorf("invalid multipart limits: %+v", *l)
+	}
+	for _, contentType := range l.AllowedContentTypes {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return fmt.Errorf("invalid multipart content type %q: %w", contentType, err)
+		}
+	}
+	return nil
+}
+
+// MultipartPart identifies a part of a multipart request.
+type MultipartPart struct {
+	// Index is the position of the part in the request, starting at 1.
+	Index int
+	// Name is the form name of the part.
+	Name string
+	// FileName is the file name of the file parts.
+	FileName string
+}
+
+func (p MultipartPart) String() string {
+	if p.FileName != "" {
+		return fmt.Sprintf("part %d (%q, file %q)", p.Index, p.Name, p.FileName)
+	}
+	return fmt.Sprintf("part %d (%q)", p.Index, p.Name)
+}
+
+// MultipartLimitError is returned when a multipart request has too many parts or a part is too large (413).
+type MultipartLimitError struct {
+	Part MultipartPart
+	// Limit is the name of the limit exceeded: MaxParts, MaxPartBytes or MaxFieldBytes.
+	Limit string
+	Max   int64
+}
+
+func (e *MultipartLimitError) Error() string {
+	return fmt.Sprintf("multipart %s exceeds %s of %d", e.Part, e.Limit, e.Max)
+}
+
+// MultipartContentTypeError is returned when the content type of a file part is not allowed (415).
+type MultipartContentTypeError struct {
+	Part        MultipartPart
+	ContentType string
+}
+
+func (e *MultipartContentTypeError) Error() string {
+	return fmt.Sprintf("multipart %s content type %q is not allowed", e.Part, e.ContentType)
+}
+
+// MalformedMultipartError is returned when the body of a multipart request can't be parsed,
+// e.g. when its boundary is missing or it is truncated (400).
+type MalformedMultipartError struct {
+	Err error
+}
+
+func (e *MalformedMultipartError) Error() string {
+	return fmt.Sprintf("malformed multipart request: %v", e.Err)
+}
+
+func (e *MalformedMultipartError) Unwrap() error {
+	return e.Err
+}
+
+// isMultipartLimitError reports whether err is one of the errors of the multipart limits.
+func isMultipartLimitError(err error) bool {
+	var limit *MultipartLimitError
+	var contentType *MultipartContentTypeError
+	var malformed *MalformedMultipartError
+	return errors.As(err, &limit) || errors.As(err, &contentType) || errors.As(err, &malformed)
+}
+
+// multipartBoundary returns the boundary of the multipart/form-data requests,
+// and false for the other requests.
+func multipartBoundary(h http.Header) (string, bool, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return "", false, nil
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" {
+		return "", true, &MalformedMultipartError{Err: errors.New("no boundary")}
+	}
+	return boundary, true, nil
+}
+
+// multipartReader passes the body through while a multipart.Reader parses it in a goroutine,
+// the parse is checked after each read: a violation fails the read, without waiting for the rest of the body.
+type multipartReader struct {
+	reader io.Reader
+	limits *Limits
+
+	// chunks are the bytes read, handed over to the parser.
+	chunks chan []byte
+	// consumed is signaled by the parser once it has consumed the last chunk and waits for the next one.
+	consumed chan struct{}
+	// done is closed once the parser has returned, with err.
+	done chan struct{}
+	err  error
+
+	closeOnce sync.Once
+}
+
+func newMultipartReader(reader io.Reader, boundary string, limits *Limits) *multipartReader {
+	m := &multipartReader{
+		reader:   reader,
+		limits:   limits,
+		chunks:   make(chan []byte),
+		consumed: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		defer close(m.done)
+		m.err = m.parse(multipart.NewReader(&chunkReader{chunks: m.chunks, consumed: m.consumed}, boundary))
+	}()
+
+	return m
+}
+
+func (m *multipartReader) Read(p []byte) (int, error) {
+	n, err := m.reader.Read(p)
+	if n > 0 {
+		if errParse := m.feed(p[:n]); errParse != nil {
+			return 0, errParse
+		}
+	}
+
+	if errors.Is(err, io.EOF) {
+		if errParse := m.close(); errParse != nil {
+			return 0, errParse
+		}
+	}
+	return n, err
+}
+
+// feed hands the chunk over to the parser, and waits until it has been parsed.
+func (m *multipartReader) feed(chunk []byte) error {
+	select {
+	case m.chunks <- chunk:
+	case <-m.done:
+		return m.err
+	}
+
+	select {
+	case <-m.consumed:
+		return nil
+	case <-m.done:
+		return m.err
+	}
+}
+
+// close ends the body of the parser, and returns the result of the parse.
+func (m *multipartReader) close() error {
+	m.closeOnce.Do(func() { close(m.chunks) })
+	<-m.done
+	return m.err
+}
+
+func (m *multipartReader) parse(mr *multipart.Reader) error {
+	for index := 1; ; index++ {
+		part, err := mr.NextRawPart()
+		// The truncated bodies are reported with a wrapped io.EOF.
+		if err == io.EOF { //nolint:errorlint // only the final boundary returns io.EOF itself.
+			// The epilogue is not parsed, the next chunks are passed through.
+			return nil
+		}
+		if err != nil {
+			return &MalformedMultipartError{Err: err}
+		}
+
+		if err := m.checkPart(index, part); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *multipartReader) checkPart(index int, part *multipart.Part) error {
+	info := MultipartPart{Index: index, Name: part.FormName(), FileName: part.FileName()}
+
+	if m.limits.MaxParts > 0 && index > m.limits.MaxParts {
+		return &MultipartLimitError{Part: info, Limit: "MaxParts", Max: int64(m.limits.MaxParts)}
+	}
+
+	limit, maxBytes := "MaxFieldBytes", m.limits.MaxFieldBytes
+	if info.FileName != "" {
+		limit, maxBytes = "MaxPartBytes", m.limits.MaxPartBytes
+
+		if err := m.checkContentType(info, part.Header.Get("Content-Type")); err != nil {
+			return err
+		}
+	}
+
+	var reader io.Reader = part
+	if maxBytes > 0 {
+		reader = io.LimitReader(part, maxBytes+1)
+	}
+
+	n, err := io.Copy(io.Discard, reader)
+	if err != nil {
+		return &MalformedMultipartError{Err: err}
+	}
+	if maxBytes > 0 && n > maxBytes {
+		return &MultipartLimitError{Part: info, Limit: limit, Max: maxBytes}
+	}
+	return nil
+}
+
+func (m *multipartReader) checkContentType(info MultipartPart, contentType string) error {
+	if len(m.limits.AllowedContentTypes) == 0 {
+		return nil
+	}
+
+	mediaType := "text/plain"
+	if contentType != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return &MultipartContentTypeError{Part: info, ContentType: contentType}
+		}
+	}
+
+	for _, allowed := range m.limits.AllowedContentTypes {
+		allowedType, _, _ := mime.ParseMediaType(allowed)
+		if strings.EqualFold(allowedType, mediaType) {
+			return nil
+		}
+	}
+	return &MultipartContentTypeError{Part: info, ContentType: contentType}
+}
+
+// chunkReader is the body read by the parser, made of the chunks read by the multipartReader.
+type chunkReader struct {
+	chunks   <-chan []byte
+	consumed chan<- struct{}
+	chunk    []byte
+	pending  bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.pending {
+			c.pending = false
+			c.consumed <- struct{}{}
+		}
+
+		chunk, ok := <-c.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		c.chunk, c.pending = chunk, true
+	}
+
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
@@ -0,0 +1,269 @@
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+var uploadLimits = Limits{
+	MaxParts:            10,
+	MaxPartBytes:        5 * 1024 * 1024,
+	MaxFieldBytes:       64 * 1024,
+	AllowedContentTypes: []string{"image/png", "application/pdf"},
+}
+
+// formPart is a part of a multipart/form-data body, a file part when it has a file name.
+type formPart struct {
+	name        string
+	fileName    string
+	contentType string
+	content     []byte
+}
+
+// multipartBody returns the multipart/form-data body of the parts, and its Content-Type.
+func multipartBody(t *testing.T, parts ...formPart) ([]byte, string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	for _, part := range parts {
+		h := make(textproto.MIMEHeader)
+		if part.fileName != "" {
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, part.name, part.fileName))
+		} else {
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q`, part.name))
+		}
+		if part.contentType != "" {
+			h.Set("Content-Type", part.contentType)
+		}
+
+		w, err := mw.CreatePart(h)
+		require.NoError(t, err)
+		_, err = w.Write(part.content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+
+	return buf.Bytes(), mw.FormDataContentType()
+}
+
+func newMultipartBuffer(t *testing.T, limits Limits) (*atomic.Pointer[[]byte], string) {
+	t.Helper()
+
+	var received atomic.Pointer[[]byte]
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		received.Store(&body)
+		_, _ = w.Write([]byte("uploaded"))
+	})
+
+	b, err := NewRequestBuffer(next, MultipartLimits(limits))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(b)
+	t.Cleanup(srv.Close)
+
+	return &received, srv.URL
+}
+
+func TestRequestBuffer_multipartLimits(t *testing.T) {
+	received, srvURL := newMultipartBuffer(t, uploadLimits)
+
+	body, contentType := multipartBody(t,
+		formPart{name: "title", content: []byte("holidays")},
+		formPart{name: "photo", fileName: "beach.png", contentType: "image/png", content: bytes.Repeat([]byte{0x89}, 1024*1024)},
+		formPart{name: "invoice", fileName: "invoice.pdf", contentType: "application/pdf", content: []byte("%PDF-1.7")},
+	)
+
+	re, respBody, err := testutils.Post(srvURL, testutils.Body(string(body)), testutils.Header("Content-Type", contentType))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "uploaded", string(respBody))
+
+	require.NotNil(t, received.Load())
+	assert.Equal(t, body, *received.Load())
+}
+
+func TestRequestBuffer_multipartLimits_rejected(t *testing.T) {
+	var tooManyParts []formPart
+	for i := 0; i < 11; i++ {
+		tooManyParts = append(tooManyParts, formPart{name: fmt.Sprintf("field%d", i), content: []byte("value")})
+	}
+
+	valid, contentType := multipartBody(t, formPart{name: "title", content: []byte("holidays")})
+
+	testCases := []struct {
+		desc           string
+		parts          []formPart
+		body           []byte
+		contentType    string
+		expectedStatus int
+	}{
+		{
+			desc:           "too many parts",
+			parts:          tooManyParts,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			desc:           "file too large",
+			parts:          []formPart{{name: "photo", fileName: "beach.png", contentType: "image/png", content: make([]byte, 6*1024*1024)}},
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			desc:           "field too large",
+			parts:          []formPart{{name: "title", content: make([]byte, 65*1024)}},
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			desc:           "content type not allowed",
+			parts:          []formPart{{name: "script", fileName: "run.sh", contentType: "application/x-sh", content: []byte("rm -rf /")}},
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:           "file without content type",
+			parts:          []formPart{{name: "notes", fileName: "notes.txt", content: []byte("notes")}},
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:           "truncated",
+			body:           valid[:len(valid)-10],
+			contentType:    contentType,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "bad boundary",
+			body:           valid,
+			contentType:    "multipart/form-data; boundary=other",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "no boundary",
+			body:           valid,
+			contentType:    "multipart/form-data",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			desc:           "not multipart",
+			body:           make([]byte, 6*1024*1024),
+			contentType:    "application/octet-stream",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			received, srvURL := newMultipartBuffer(t, uploadLimits)
+
+			body, contentType := test.body, test.contentType
+			if test.parts != nil {
+				body, contentType = multipartBody(t, test.parts...)
+			}
+
+			re, _, err := testutils.Post(srvURL, testutils.Body(string(body)), testutils.Header("Content-Type", contentType))
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedStatus, re.StatusCode)
+
+			if test.expectedStatus == http.StatusOK {
+				require.NotNil(t, received.Load())
+				assert.Equal(t, body, *received.Load())
+			} else {
+				assert.Nil(t, received.Load())
+			}
+		})
+	}
+}
+
+func TestRequestBuffer_multipartLimits_early(t *testing.T) {
+	var tooManyParts []formPart
+	for i := 0; i < 11; i++ {
+		tooManyParts = append(tooManyParts, formPart{name: fmt.Sprintf("file%d", i), fileName: "photo.png", contentType: "image/png", content: make([]byte, 512*1024)})
+	}
+
+	testCases := []struct {
+		desc  string
+		parts []formPart
+		// sent is the size of the beginning of the body sent before waiting for the response.
+		sent int
+	}{
+		{
+			desc:  "11th part",
+			parts: tooManyParts,
+			sent:  10*(512*1024+200) + 64*1024,
+		},
+		{
+			desc:  "6MB file",
+			parts: []formPart{{name: "photo", fileName: "beach.png", contentType: "image/png", content: make([]byte, 6*1024*1024)}},
+			sent:  5*1024*1024 + 256*1024,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			received, srvURL := newMultipartBuffer(t, uploadLimits)
+
+			body, contentType := multipartBody(t, test.parts...)
+			require.Less(t, test.sent, len(body))
+
+			// The client sends the beginning of the body, and the rest only once it has the response.
+			pr, pw := io.Pipe()
+			responded := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+
+				for sent := 0; sent < test.sent; sent += 32 * 1024 {
+					end := sent + 32*1024
+					if end > test.sent {
+						end = test.sent
+					}
+					if _, err := pw.Write(body[sent:end]); err != nil {
+						return
+					}
+				}
+				<-responded
+				_ = pw.CloseWithError(io.ErrClosedPipe)
+			}()
+
+			req, err := http.NewRequest(http.MethodPost, srvURL, pr)
+			require.NoError(t, err)
+			req.ContentLength = int64(len(body))
+			req.Header.Set("Content-Type", contentType)
+
+			re, err := http.DefaultClient.Do(req)
+			close(responded)
+			// unblocks the sender if the transport stopped reading the body.
+			_ = pr.CloseWithError(io.ErrClosedPipe)
+			<-done
+			require.NoError(t, err)
+			_ = re.Body.Close()
+
+			assert.Equal(t, http.StatusRequestEntityTooLarge, re.StatusCode)
+			assert.Nil(t, received.Load())
+		})
+	}
+}
+
+func TestMultipartLimits_invalid(t *testing.T) {
+	_, err := NewRequestBuffer(nil, MultipartLimits(Limits{MaxParts: -1}))
+	require.Error(t, err)
+
+	_, err = NewRequestBuffer(nil, MultipartLimits(Limits{AllowedContentTypes: []string{"image/"}}))
+	require.Error(t, err)
+
+	_, err = NewResponseBuffer(nil, MultipartLimits(uploadLimits))
+	require.Error(t, err)
+}
@@ -1,7 +1,10 @@
 package buffer
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/vulcand/oxy/v2/utils"
 )
@@ -37,12 +40,28 @@ func Cond(condition bool, setter Option) Option {
 	return setter
 }
 
+// SkipWhen passes the requests matching the predicate as is to the next handler,
+// with the original response writer and body: they are neither buffered nor limited.
+// See SkipUpgradesAndSSE for the requests that should usually not be buffered.
+func SkipWhen(skip func(*http.Request) bool) Option {
+	return func(b *Buffer) error {
+		if skip == nil {
+			return errors.New("skip predicate can't be nil")
+		}
+		b.skip = skip
+		return nil
+	}
+}
+
 // Retry provides a predicate that allows buffer middleware to replay the request
 // if it matches certain condition, e.g. returns special error code. Available functions are:
 //
 // Attempts() - limits the amount of retry attempts
 // ResponseCode() - returns http response code
 // IsNetworkError() - tests if response code is related to networking error
+// RequestMethod() - returns the method of the request, e.g. "POST"
+// Proto() - returns the protocol of the client, e.g. "HTTP/2.0"
+// UpstreamErrorIs("dial") - tests the kind of the error of the forwarder: "dial", "tls", "timeout" or "protocol"
 //
 // Example of the predicate:
 //
@@ -54,6 +73,66 @@ func Retry(predicate string) Option {
 			return err
 		}
 		b.retryPredicate = p
+		b.requestOptions = append(b.requestOptions, "Retry")
+		return nil
+	}
+}
+
+// RetryBudget shares the retries of the requests with the other proxy tiers, to prevent them from multiplying the retries.
+// The header (DefaultRetryBudgetHeader when empty) carries the number of retries left to the whole chain:
+// it is set to the remaining budget on the request of every attempt, and on the response for the previous tiers.
+// A request is not retried once its budget is exhausted, whatever the Retry predicate,
+// and the retries of the next tiers, reported in their responses, are taken from the budget.
+// The requests without the header have no budget, unless EmitRetryBudget is set.
+// The remaining budget is available to the next handlers with RetryBudgetFromContext. It has no effect without Retry.
+func RetryBudget(header string) Option {
+	return func(b *Buffer) error {
+		if header == "" {
+			header = DefaultRetryBudgetHeader
+		}
+		b.retryBudgetHeader = header
+		b.requestOptions = append(b.requestOptions, "RetryBudget")
+		return nil
+	}
+}
+
+// EmitRetryBudget gives a budget of DefaultMaxRetryAttempts to the requests without one, e.g. at the edge tier.
+// It enables RetryBudget with DefaultRetryBudgetHeader, if it is not set.
+func EmitRetryBudget(emit bool) Option {
+	return func(b *Buffer) error {
+		b.emitRetryBudget = emit
+		if b.retryBudgetHeader == "" {
+			b.retryBudgetHeader = DefaultRetryBudgetHeader
+		}
+		b.requestOptions = append(b.requestOptions, "EmitRetryBudget")
+		return nil
+	}
+}
+
+// OnAttempt calls fn after each attempt of the retry loop, the final one included, with the status code,
+// the headers and the beginning of the body of its response (see AttemptBodyPreviewBytes), e.g. to log the responses
+// of the failed attempts. fn is called synchronously between the attempts, its panics are recovered and logged.
+// It has no effect without Retry.
+func OnAttempt(fn func(AttemptInfo)) Option {
+	return func(b *Buffer) error {
+		if fn == nil {
+			return errors.New("attempt callback can't be nil")
+		}
+		b.onAttempt = fn
+		b.requestOptions = append(b.requestOptions, "OnAttempt")
+		return nil
+	}
+}
+
+// AttemptBodyPreviewBytes sets the maximum size of the body preview passed to OnAttempt,
+// DefaultAttemptBodyPreviewBytes by default. 0 disables the preview.
+func AttemptBodyPreviewBytes(n int64) Option {
+	return func(b *Buffer) error {
+		if n < 0 {
+			return fmt.Errorf("preview bytes should be >= 0 got %d", n)
+		}
+		b.attemptBodyPreviewBytes = n
+		b.requestOptions = append(b.requestOptions, "AttemptBodyPreviewBytes")
 		return nil
 	}
 }
@@ -73,6 +152,7 @@ func MaxRequestBodyBytes(m int64) Option {
 			return fmt.Errorf("max bytes should be >= 0 got %d", m)
 		}
 		b.maxRequestBodyBytes = m
+		b.requestOptions = append(b.requestOptions, "MaxRequestBodyBytes")
 		return nil
 	}
 }
@@ -85,6 +165,182 @@ func MemRequestBodyBytes(m int64) Option {
 			return fmt.Errorf("mem bytes should be >= 0 got %d", m)
 		}
 		b.memRequestBodyBytes = m
+		b.requestOptions = append(b.requestOptions, "MemRequestBodyBytes")
+		return nil
+	}
+}
+
+// StreamRequestWhenPossible forwards the request body to the next handler while it is being read,
+// instead of storing it before forwarding, when the request does not need to be replayed (no Retry option).
+// MaxRequestBodyBytes is still enforced: when the limit is crossed mid-stream, the context of the request
+// is canceled and a 413 is returned if the response has not been started yet.
+// In this mode the Content-Length of chunked requests is not computed.
+func StreamRequestWhenPossible(stream bool) Option {
+	return func(b *Buffer) error {
+		b.streamRequest = stream
+		b.requestOptions = append(b.requestOptions, "StreamRequestWhenPossible")
+		return nil
+	}
+}
+
+// RequireContentLength forces the request body to be buffered,
+// even when StreamRequestWhenPossible is set, so that the Content-Length of chunked requests is always computed.
+func RequireContentLength(require bool) Option {
+	return func(b *Buffer) error {
+		b.requireContentLength = require
+		b.requestOptions = append(b.requestOptions, "RequireContentLength")
+		return nil
+	}
+}
+
+// StrictContentLength rejects the requests whose body size differs from their Content-Length
+// with an ErrContentLengthMismatch (400), instead of forwarding them with the Content-Length of the buffered body.
+// The chunked requests, without Content-Length, are not checked.
+// The request body is always buffered, even when StreamRequestWhenPossible is set.
+func StrictContentLength(strict bool) Option {
+	return func(b *Buffer) error {
+		b.strictContentLength = strict
+		b.requestOptions = append(b.requestOptions, "StrictContentLength")
+		return nil
+	}
+}
+
+// TrailerHeaderPrefix is the prefix of the headers the request trailers are sent in, see ConvertTrailersToHeaders.
+const TrailerHeaderPrefix = "X-Trailer-"
+
+// ConvertTrailersToHeaders sends the trailers of the requests (e.g. a checksum computed while streaming the body)
+// in headers prefixed with TrailerHeaderPrefix, e.g. X-Trailer-X-Checksum, with the Content-Length of the buffered body.
+// By default, the requests with trailers are sent chunked, followed by their trailers, for every attempt.
+// The streamed requests (see StreamRequestWhenPossible) keep their trailers.
+func ConvertTrailersToHeaders(convert bool) Option {
+	return func(b *Buffer) error {
+		b.convertTrailers = convert
+		b.requestOptions = append(b.requestOptions, "ConvertTrailersToHeaders")
+		return nil
+	}
+}
+
+// MinBackendBudget sets the time the deadline of the request context, if any, must leave to the backend, 0 by default.
+// The buffering of the request body is aborted with an ErrBackendBudget (408) once the deadline can't leave it,
+// even while waiting for a client that stopped sending the body, instead of calling the backend without the time to answer, and the request is not retried once an attempt could not have it.
+// The streamed requests (see StreamRequestWhenPossible) are not checked.
+func MinBackendBudget(d time.Duration) Option {
+	return func(b *Buffer) error {
+		if d < 0 {
+			return fmt.Errorf("invalid min backend budget: %v", d)
+		}
+		b.minBackendBudget = d
+		b.requestOptions = append(b.requestOptions, "MinBackendBudget")
+		return nil
+	}
+}
+
+// VerifyRequestDigest verifies the Digest (RFC 3230, e.g. "sha-256=<base64>") and Content-MD5 headers of the requests
+// against the digest of the buffered body, the requests not matching are rejected with a DigestMismatchError (400).
+// The supported algorithms are sha-256, sha-512 and md5, all of them are accepted when none is given.
+// The requests without digest are passed through, unless RequireDigest is set.
+// The request body is always buffered when the digest is verified, even with StreamRequestWhenPossible.
+func VerifyRequestDigest(algorithms ...string) Option {
+	return func(b *Buffer) error {
+		if len(algorithms) == 0 {
+			algorithms = []string{DigestSHA256, DigestSHA512, DigestMD5}
+		}
+
+		b.requestDigestAlgorithms = nil
+		for _, algorithm := range algorithms {
+			a, err := normalizeDigestAlgorithm(algorithm)
+			if err != nil {
+				return err
+			}
+			b.requestDigestAlgorithms = append(b.requestDigestAlgorithms, a)
+		}
+		b.requestOptions = append(b.requestOptions, "VerifyRequestDigest")
+		return nil
+	}
+}
+
+// MultipartLimits checks the parts of the multipart/form-data requests while their body is buffered:
+// the requests are rejected as soon as a limit is crossed, without reading the rest of the body,
+// with a MultipartLimitError (413) or a MultipartContentTypeError (415) naming the part.
+// The malformed multipart bodies are rejected with a MalformedMultipartError (400).
+// The body is only parsed to be checked, the next handler receives it unchanged, and the other requests are not affected.
+// The request body is always buffered when the limits are set, even with StreamRequestWhenPossible.
+func MultipartLimits(limits Limits) Option {
+	return func(b *Buffer) error {
+		if err := limits.validate(); err != nil {
+			return err
+		}
+		b.multipartLimits = &limits
+		b.requestOptions = append(b.requestOptions, "MultipartLimits")
+		return nil
+	}
+}
+
+// RequireDigest rejects the requests without digest using one of the algorithms of VerifyRequestDigest,
+// with ErrDigestRequired (400).
+func RequireDigest(require bool) Option {
+	return func(b *Buffer) error {
+		b.requireDigest = require
+		b.requestOptions = append(b.requestOptions, "RequireDigest")
+		return nil
+	}
+}
+
+// AuditSink hands the requests matching when (all of them if nil) to the sink once their response is written,
+// with their headers and buffered body (see AuditMaxBodyBytes and AuditRedactHeaders), e.g. to archive them.
+// The entries are queued, up to queueDepth, and written by a goroutine of the buffer, started with the first entry
+// and stopped by Close: the entries are dropped when the queue is full, and counted in the Stats.
+// The body of the audited requests is always buffered, even with StreamRequestWhenPossible, the skipped ones are not audited.
+func AuditSink(sink AuditWriter, when func(*http.Request) bool, queueDepth int) Option {
+	return func(b *Buffer) error {
+		if sink == nil {
+			return errors.New("audit sink can't be nil")
+		}
+		if queueDepth <= 0 {
+			return fmt.Errorf("audit queue depth should be > 0 got %d", queueDepth)
+		}
+		b.auditSink = sink
+		b.auditWhen = when
+		b.auditQueueDepth = queueDepth
+		b.requestOptions = append(b.requestOptions, "AuditSink")
+		return nil
+	}
+}
+
+// AuditMaxBodyBytes sets the maximum size of the body of the audit entries, DefaultAuditMaxBodyBytes by default:
+// only the beginning of the larger bodies is kept, along with their size. 0 leaves the body out.
+func AuditMaxBodyBytes(n int64) Option {
+	return func(b *Buffer) error {
+		if n < 0 {
+			return fmt.Errorf("audit body bytes should be >= 0 got %d", n)
+		}
+		b.auditMaxBodyBytes = n
+		b.requestOptions = append(b.requestOptions, "AuditMaxBodyBytes")
+		return nil
+	}
+}
+
+// AuditRedactHeaders replaces the values of the headers in the audit entries, e.g. Authorization or Cookie.
+func AuditRedactHeaders(names ...string) Option {
+	return func(b *Buffer) error {
+		for _, name := range names {
+			b.auditRedact = append(b.auditRedact, http.CanonicalHeaderKey(name))
+		}
+		b.requestOptions = append(b.requestOptions, "AuditRedactHeaders")
+		return nil
+	}
+}
+
+// AddResponseDigest sets the Digest header of the responses, computed with the algorithm (sha-256, sha-512 or md5)
+// over the buffered body.
+func AddResponseDigest(algorithm string) Option {
+	return func(b *Buffer) error {
+		a, err := normalizeDigestAlgorithm(algorithm)
+		if err != nil {
+			return err
+		}
+		b.responseDigestAlgorithm = a
+		b.responseOptions = append(b.responseOptions, "AddResponseDigest")
 		return nil
 	}
 }
@@ -96,6 +352,24 @@ func MaxResponseBodyBytes(m int64) Option {
 			return fmt.Errorf("max bytes should be >= 0 got %d", m)
 		}
 		b.maxResponseBodyBytes = m
+		b.responseOptions = append(b.responseOptions, "MaxResponseBodyBytes")
+		return nil
+	}
+}
+
+// ResponseBufferThreshold streams the responses larger than n bytes to the client instead of buffering them entirely:
+// once the handler has written more than n bytes, the status code and the headers are sent without Content-Length,
+// followed by the buffered bytes and the rest of the response as it is written.
+// The smaller responses are buffered as usual. A streamed response can't be retried, whatever the Retry predicate,
+// and MaxResponseBodyBytes aborts it mid-stream. The digest of a streamed response (AddResponseDigest) is sent as a trailer.
+// 0 disables the streaming, which is the default.
+func ResponseBufferThreshold(n int64) Option {
+	return func(b *Buffer) error {
+		if n < 0 {
+			return fmt.Errorf("threshold should be >= 0 got %d", n)
+		}
+		b.responseThreshold = n
+		b.responseOptions = append(b.responseOptions, "ResponseBufferThreshold")
 		return nil
 	}
 }
@@ -108,6 +382,7 @@ func MemResponseBodyBytes(m int64) Option {
 			return fmt.Errorf("mem bytes should be >= 0 got %d", m)
 		}
 		b.memResponseBodyBytes = m
+		b.responseOptions = append(b.responseOptions, "MemResponseBodyBytes")
 		return nil
 	}
 }
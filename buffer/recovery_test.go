@@ -0,0 +1,109 @@
+package buffer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// panickingHandler reads the request body and writes a response spilling to disk before panicking.
+var panickingHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	_, _ = io.Copy(io.Discard, req.Body)
+	_, _ = w.Write([]byte(strings.Repeat("a", 64)))
+	panic("boom")
+})
+
+func TestBuffer_panic(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	var received error
+	st, err := New(panickingHandler, MemRequestBodyBytes(4), MemResponseBodyBytes(4),
+		ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+			received = err
+			errHandler.ServeHTTP(w, req, err)
+		})))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Body(strings.Repeat("b", 64)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+	assert.Equal(t, http.StatusText(http.StatusInternalServerError), string(body))
+
+	var errPanic *utils.ErrPanicInHandler
+	require.ErrorAs(t, received, &errPanic)
+	assert.Equal(t, "boom", errPanic.Recovered)
+	assert.NotEmpty(t, errPanic.Stack)
+
+	// The request and response bodies spilled to disk have been removed.
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRequestBuffer_panicAfterWrite(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		_, _ = w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		panic("boom")
+	})
+
+	rqb, err := NewRequestBuffer(handler)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(rqb)
+	t.Cleanup(proxy.Close)
+
+	// The response has been started: the connection is aborted, the client can't take the response as complete.
+	re, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	_, err = io.ReadAll(re.Body)
+	require.Error(t, err)
+	_ = re.Body.Close()
+}
+
+func TestBuffer_panicAbortHandler(t *testing.T) {
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+
+	st, err := New(handler)
+	require.NoError(t, err)
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		st.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
+
+func TestResponseBuffer_unreadResponseRemoved(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("a", 64)))
+	})
+
+	rsb, err := NewResponseBuffer(handler, MemResponseBodyBytes(4))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	rsb.ServeHTTP(rw, httptest.NewRequest(http.MethodHead, "/", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
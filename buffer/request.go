@@ -0,0 +1,787 @@
+package buffer
+
+import (
+	"bufio"
+	stdcontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/multibuf"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// RequestBuffer is responsible for buffering requests.
+// It reads the entire request body before passing the request to the next handler,
+// which allows to compute the Content-Length of chunked requests and to replay the request.
+// The response is not buffered, except when a retry predicate is set:
+// in that case the response of an attempt is discarded if the request is replayed.
+type RequestBuffer struct {
+	maxRequestBodyBytes int64
+	memRequestBodyBytes int64
+
+	retryPredicate hpredicate
+
+	retryBudgetHeader string
+	emitRetryBudget   bool
+
+	onAttempt               func(AttemptInfo)
+	attemptBodyPreviewBytes int64
+
+	skip    func(*http.Request) bool
+	skipped atomic.Uint64
+
+	streamRequest        bool
+	requireContentLength bool
+	strictContentLength  bool
+	convertTrailers      bool
+
+	digestAlgorithms []string
+	requireDigest    bool
+
+	multipartLimits *Limits
+
+	minBackendBudget time.Duration
+
+	audit *auditor
+
+	next       http.Handler
+	errHandler utils.ErrorHandler
+	// component is the name of the buffer passed to the error handler, see utils.ServeError.
+	component string
+
+	verbose bool
+	log     utils.Logger
+}
+
+// NewRequestBuffer returns a new request buffer middleware.
+// Only the request options (MaxRequestBodyBytes, MemRequestBodyBytes, Retry, RetryBudget, EmitRetryBudget, OnAttempt,
+// AttemptBodyPreviewBytes, StreamRequestWhenPossible, RequireContentLength, StrictContentLength, ConvertTrailersToHeaders,
+// VerifyRequestDigest, RequireDigest, MultipartLimits, MinBackendBudget, AuditSink, AuditMaxBodyBytes, AuditRedactHeaders)
+// and the common options are supported.
+func NewRequestBuffer(next http.Handler, setters ...Option) (*RequestBuffer, error) {
+	b, err := newBuffer(next, setters...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.responseOptions) != 0 {
+		return nil, fmt.Errorf("options not supported by the request buffer: %s", strings.Join(b.responseOptions, ", "))
+	}
+
+	return newRequestBuffer(b, next), nil
+}
+
+func newRequestBuffer(b *Buffer, next http.Handler) *RequestBuffer {
+	return &RequestBuffer{
+		maxRequestBodyBytes:     b.maxRequestBodyBytes,
+		memRequestBodyBytes:     b.memRequestBodyBytes,
+		retryPredicate:          b.retryPredicate,
+		retryBudgetHeader:       b.retryBudgetHeader,
+		emitRetryBudget:         b.emitRetryBudget,
+		onAttempt:               b.onAttempt,
+		attemptBodyPreviewBytes: b.attemptBodyPreviewBytes,
+		skip:                    b.skip,
+		streamRequest:           b.streamRequest,
+		requireContentLength:    b.requireContentLength,
+		strictContentLength:     b.strictContentLength,
+		convertTrailers:         b.convertTrailers,
+		digestAlgorithms:        b.requestDigestAlgorithms,
+		requireDigest:           b.requireDigest,
+		multipartLimits:         b.multipartLimits,
+		minBackendBudget:        b.minBackendBudget,
+		audit:                   b.audit,
+		next:                    next,
+		errHandler:              b.errHandler,
+		component:               "buffer/request",
+		verbose:                 b.verbose,
+		log:                     b.log,
+	}
+}
+
+// Stats returns the statistics of the request buffer.
+func (b *RequestBuffer) Stats() Stats {
+	return Stats{SkippedRequests: b.skipped.Load(), DroppedAuditEntries: b.audit.droppedEntries()}
+}
+
+// Close stops the goroutine of the AuditSink, once the queued entries are written.
+// The entries of the requests completed afterwards are dropped.
+func (b *RequestBuffer) Close() error {
+	b.audit.close()
+	return nil
+}
+
+// Wrap sets the next handler to be called by request buffer handler, when it was created without.
+func (b *RequestBuffer) Wrap(next http.Handler) error {
+	if err := utils.CheckWrap(b.next, next); err != nil {
+		return err
+	}
+	b.next = next
+	return nil
+}
+
+func (b *RequestBuffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if b.verbose && utils.DebugEnabled(b.log) {
+		dump := utils.DumpHTTPRequest(req)
+		b.log.Debug("vulcand/oxy/buffer/request: begin ServeHttp on request: %s", dump)
+		defer b.log.Debug("vulcand/oxy/buffer/request: completed ServeHttp on request: %s", dump)
+	}
+
+	if b.next == nil {
+		utils.ServeError(b.errHandler, w, req, "buffer/request", &utils.ErrNotWired{Middleware: "buffer/request"})
+		return
+	}
+
+	if b.skip != nil && b.skip(req) {
+		b.skipped.Add(1)
+		b.next.ServeHTTP(w, req)
+		return
+	}
+
+	// The panics of the next handler are recovered once the request body has been released.
+	pw := utils.NewProxyWriterWithLogger(w, b.log)
+	if err := utils.ServeRecovered(http.HandlerFunc(b.serve), pw, req); err != nil {
+		handlePanic(w, req, err, pw.HeaderWritten(), pw.Hijacked(), b.errHandler, b.component, b.log)
+	}
+}
+
+func (b *RequestBuffer) serve(w http.ResponseWriter, req *http.Request) {
+	if err := b.checkLimit(req); err != nil {
+		b.log.Error("vulcand/oxy/buffer: request body over limit, err: %v", err)
+		utils.ServeError(b.errHandler, w, req, b.component, err)
+		return
+	}
+
+	audited := b.audit.matches(req)
+	if b.canStream() && !audited {
+		b.serveStream(w, req)
+		return
+	}
+
+	var reader io.Reader = req.Body
+
+	// The digests are computed while the body is buffered.
+	var digests []*expectedDigest
+	if len(b.digestAlgorithms) != 0 {
+		digests = requestDigests(req.Header, b.digestAlgorithms)
+		if len(digests) == 0 && b.requireDigest {
+			b.log.Error("vulcand/oxy/buffer: request without digest")
+			utils.ServeError(b.errHandler, w, req, b.component, ErrDigestRequired)
+			return
+		}
+		if len(digests) != 0 && req.Body != nil {
+			reader = digestReader(req.Body, digests)
+		}
+	}
+
+	// The parts are checked while the body is buffered.
+	if b.multipartLimits != nil && req.Body != nil {
+		boundary, ok, err := multipartBoundary(req.Header)
+		if err != nil {
+			b.log.Error("vulcand/oxy/buffer: invalid multipart request, err: %v", err)
+			utils.ServeError(b.errHandler, w, req, b.component, err)
+			return
+		}
+		if ok {
+			parts := newMultipartReader(reader, boundary, b.multipartLimits)
+			defer func() { _ = parts.close() }()
+			reader = parts
+		}
+	}
+
+	// The bytes received are counted to report the requests shorter than their Content-Length.
+	var counter *countingReader
+	if b.strictContentLength && req.ContentLength >= 0 && req.Body != nil {
+		counter = &countingReader{reader: reader}
+		reader = counter
+	}
+
+	// The body is read as long as the deadline of the request leaves MinBackendBudget to the backend.
+	backend := newBackendBudget(req.Context(), b.minBackendBudget)
+	if backend != nil && req.Body != nil {
+		dr := newDeadlineReader(reader, backend)
+		defer dr.close()
+		reader = dr
+	}
+
+	// Read the body while keeping limits in mind. This reader controls the maximum bytes
+	// to read into memory and disk. This reader returns an error if the total request size exceeds the
+	// predefined MaxSizeBytes. This can occur if we got chunked request, in this case ContentLength would be set to -1
+	// and the reader would be unbounded bufio in the http.Server
+	body, err := multibuf.New(reader, multibuf.MaxBytes(b.maxRequestBodyBytes), multibuf.MemBytes(b.memRequestBodyBytes))
+	if err != nil || body == nil {
+		var errBudget *ErrBackendBudget
+		if errors.As(err, &errBudget) {
+			b.log.Error("vulcand/oxy/buffer: request body not buffered in time, err: %v", err)
+			// the rest of the body may still be read by the abandoned read: the connection can't be reused.
+			w.Header().Set("Connection", "close")
+			utils.ServeError(b.errHandler, w, req, b.component, err)
+			return
+		}
+
+		if isMultipartLimitError(err) {
+			b.log.Error("vulcand/oxy/buffer: multipart request over limits, err: %v", err)
+			utils.ServeError(b.errHandler, w, req, b.component, err)
+			return
+		}
+
+		if counter != nil && errors.Is(err, io.ErrUnexpectedEOF) {
+			b.rejectContentLength(w, req, counter.read)
+			return
+		}
+
+		if req.Context().Err() != nil {
+			b.log.Error("vulcand/oxy/buffer: error when reading request body, err: %v", req.Context().Err())
+			utils.ServeError(b.errHandler, w, req, b.component, req.Context().Err())
+			return
+		}
+
+		b.log.Error("vulcand/oxy/buffer: error when reading request body, err: %v", err)
+		utils.ServeError(b.errHandler, w, req, b.component, err)
+		return
+	}
+
+	// Set request body to buffered reader that can replay the read and execute Seek
+	// Note that we don't change the original request body as it's handled by the http server
+	// and we don't want to mess with standard library
+	defer func() {
+		if body != nil {
+			errClose := body.Close()
+			if errClose != nil {
+				b.log.Error("vulcand/oxy/buffer: failed to close body, err: %v", errClose)
+			}
+		}
+	}()
+
+	// We need to set ContentLength based on known request size. The incoming request may have been
+	// set without content length or using chunked TransferEncoding
+	totalSize, err := body.Size()
+	if err != nil {
+		b.log.Error("vulcand/oxy/buffer: failed to get request size, err: %v", err)
+		utils.ServeError(b.errHandler, w, req, b.component, err)
+		return
+	}
+
+	if b.strictContentLength && req.ContentLength >= 0 && totalSize != req.ContentLength {
+		b.rejectContentLength(w, req, totalSize)
+		return
+	}
+
+	if err := verifyDigests(digests); err != nil {
+		b.log.Error("vulcand/oxy/buffer: failed to verify request digest, err: %v", err)
+		utils.ServeError(b.errHandler, w, req, b.component, err)
+		return
+	}
+
+	if totalSize == 0 {
+		body = nil
+	}
+
+	if err := backend.check(); err != nil {
+		b.log.Error("vulcand/oxy/buffer: request body not buffered in time, err: %v", err)
+		utils.ServeError(b.errHandler, w, req, b.component, err)
+		return
+	}
+
+	if audited {
+		entry, err := b.audit.entry(req, body, totalSize)
+		if err != nil {
+			b.log.Error("vulcand/oxy/buffer: failed to copy request body for audit, err: %v", err)
+			utils.ServeError(b.errHandler, w, req, b.component, err)
+			return
+		}
+		defer func() {
+			entry.StatusCode = statusCode(w)
+			b.audit.enqueue(entry)
+		}()
+	}
+
+	outReq := copyRequest(req, body, totalSize, b.convertTrailers)
+
+	if b.retryPredicate == nil {
+		b.next.ServeHTTP(w, outReq)
+		return
+	}
+
+	budget := b.newRetryBudget(req)
+
+	attempt := 1
+	for {
+		if budget != nil {
+			outReq = budget.apply(outReq)
+		}
+
+		// The forwarder records its typed error in the context of each attempt, see UpstreamErrorIs.
+		outReq = outReq.WithContext(forward.WithErrorCapture(outReq.Context()))
+		attemptCtx := outReq.Context()
+
+		// We are mimicking http.ResponseWriter to be able to discard the response of the attempt
+		aw := &attemptWriter{
+			header:         make(http.Header),
+			responseWriter: w,
+			shouldRetry: func(code int, header http.Header) bool {
+				// An attempt is not started without MinBackendBudget before the deadline of the request.
+				retry := attempt <= DefaultMaxRetryAttempts &&
+					b.retryPredicate(&context{
+						r:            req,
+						attempt:      attempt,
+						responseCode: code,
+						upstreamErr:  forward.ErrorFromContext(attemptCtx),
+					}) &&
+					backend.check() == nil
+				if budget == nil {
+					return retry
+				}
+
+				// The retries of the next tiers are taken from the same budget.
+				budget.update(header)
+				retry = retry && budget.spend()
+				if !retry {
+					budget.report(header)
+				}
+				return retry
+			},
+			log: b.log,
+		}
+		if b.onAttempt != nil {
+			aw.previewBytes = b.attemptBodyPreviewBytes
+		}
+
+		start := clock.Now()
+		b.next.ServeHTTP(aw, outReq)
+		if aw.hijacked {
+			b.log.Debug("vulcand/oxy/buffer: connection was hijacked downstream. Not taking any action in buffer.")
+			return
+		}
+
+		aw.finish()
+		if b.onAttempt != nil {
+			requestID, _ := utils.RequestIDFromContext(req.Context())
+			b.notifyAttempt(AttemptInfo{
+				Attempt:      attempt,
+				StatusCode:   aw.code,
+				Header:       aw.header.Clone(),
+				BodyPreview:  aw.preview,
+				Duration:     clock.Since(start),
+				RetryFollows: aw.retry,
+				RequestID:    requestID,
+			})
+		}
+		if !aw.retry {
+			return
+		}
+
+		attempt++
+		if body != nil {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				b.log.Error("vulcand/oxy/buffer: failed to rewind response body, err: %v", err)
+				utils.ServeError(b.errHandler, w, req, b.component, err)
+				return
+			}
+		}
+
+		outReq = copyRequest(req, body, totalSize, b.convertTrailers)
+		b.log.Debug("vulcand/oxy/buffer: retry Request(%v %v) attempt %v", req.Method, req.URL, attempt)
+	}
+}
+
+// ErrContentLengthMismatch is returned when StrictContentLength is set and the size of the request body
+// differs from its Content-Length.
+type ErrContentLengthMismatch struct {
+	Declared int64
+	Actual   int64
+}
+
+func (e *ErrContentLengthMismatch) Error() string {
+	return fmt.Sprintf("request body of %d bytes does not match its Content-Length of %d", e.Actual, e.Declared)
+}
+
+// rejectContentLength answers the requests whose body size differs from their Content-Length, see StrictContentLength.
+func (b *RequestBuffer) rejectContentLength(w http.ResponseWriter, req *http.Request, actual int64) {
+	if b.verbose && utils.DebugEnabled(b.log) {
+		b.log.Debug("vulcand/oxy/buffer: request Content-Length mismatch, declared: %d, actual: %d", req.ContentLength, actual)
+	}
+
+	utils.ServeError(b.errHandler, w, req, b.component, &ErrContentLengthMismatch{Declared: req.ContentLength, Actual: actual})
+}
+
+func (b *RequestBuffer) checkLimit(req *http.Request) error {
+	if b.maxRequestBodyBytes <= 0 {
+		return nil
+	}
+	if req.ContentLength > b.maxRequestBodyBytes {
+		return &multibuf.MaxSizeReachedError{MaxSize: b.maxRequestBodyBytes}
+	}
+	return nil
+}
+
+// canStream returns true if the request body can be forwarded without being stored first.
+func (b *RequestBuffer) canStream() bool {
+	return b.streamRequest && !b.requireContentLength && !b.strictContentLength && b.retryPredicate == nil && len(b.digestAlgorithms) == 0 &&
+		b.multipartLimits == nil
+}
+
+// serveStream forwards the request body to the next handler while it is being read.
+// When the limit is crossed, the context of the request is canceled and a 413 is returned
+// if the response has not been started yet.
+func (b *RequestBuffer) serveStream(w http.ResponseWriter, req *http.Request) {
+	if b.maxRequestBodyBytes <= 0 || req.Body == nil || req.Body == http.NoBody {
+		b.next.ServeHTTP(w, req)
+		return
+	}
+
+	ctx, cancel := stdcontext.WithCancel(req.Context())
+	defer cancel()
+
+	body := &limitReader{reader: req.Body, max: b.maxRequestBodyBytes, onExceeded: cancel}
+	lw := &limitWriter{responseWriter: w, body: body, log: b.log}
+
+	outReq := req.WithContext(ctx)
+	outReq.Body = body
+
+	b.next.ServeHTTP(lw, outReq)
+
+	if !body.exceeded() || lw.hijacked || lw.wroteHeader {
+		return
+	}
+
+	err := &multibuf.MaxSizeReachedError{MaxSize: b.maxRequestBodyBytes}
+	b.log.Error("vulcand/oxy/buffer: request body over limit, err: %v", err)
+	utils.ServeError(b.errHandler, w, req, b.component, err)
+}
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+// limitReader counts the bytes read from the request body and fails once the limit is crossed.
+type limitReader struct {
+	reader     io.ReadCloser
+	max        int64
+	read       int64
+	over       int32
+	onExceeded func()
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.exceeded() {
+		return 0, &multibuf.MaxSizeReachedError{MaxSize: l.max}
+	}
+
+	n, err := l.reader.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		atomic.StoreInt32(&l.over, 1)
+		l.onExceeded()
+		return 0, &multibuf.MaxSizeReachedError{MaxSize: l.max}
+	}
+	return n, err
+}
+
+func (l *limitReader) Close() error {
+	return l.reader.Close()
+}
+
+func (l *limitReader) exceeded() bool {
+	return atomic.LoadInt32(&l.over) == 1
+}
+
+// limitWriter discards the response of the next handler once the request body limit has been crossed,
+// so that the 413 can be written instead, unless the response has already been started.
+type limitWriter struct {
+	responseWriter http.ResponseWriter
+	body           *limitReader
+	wroteHeader    bool
+	hijacked       bool
+	log            utils.Logger
+}
+
+func (l *limitWriter) Header() http.Header {
+	return l.responseWriter.Header()
+}
+
+func (l *limitWriter) Write(buf []byte) (int, error) {
+	if !l.wroteHeader {
+		l.WriteHeader(http.StatusOK)
+	}
+	if !l.wroteHeader {
+		return len(buf), nil
+	}
+	return l.responseWriter.Write(buf)
+}
+
+// WriteHeader writes the status code to the client, unless the request body limit has been crossed.
+func (l *limitWriter) WriteHeader(code int) {
+	if l.wroteHeader || l.body.exceeded() {
+		return
+	}
+	l.wroteHeader = true
+	l.responseWriter.WriteHeader(code)
+}
+
+// Flush flushes the response to the client unless it is discarded.
+func (l *limitWriter) Flush() {
+	if !l.wroteHeader {
+		return
+	}
+	if f, ok := l.responseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify CloseNotifier interface - this allows downstream connections to be terminated when the client terminates.
+func (l *limitWriter) CloseNotify() <-chan bool {
+	if cn, ok := l.responseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	l.log.Warn("Upstream ResponseWriter of type %v does not implement http.CloseNotifier. Returning dummy channel.", reflect.TypeOf(l.responseWriter))
+	return make(<-chan bool)
+}
+
+// Hijack This allows connections to be hijacked for websockets for instance.
+func (l *limitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := l.responseWriter.(http.Hijacker); ok {
+		conn, rw, err := hi.Hijack()
+		if err == nil {
+			l.hijacked = true
+		}
+		return conn, rw, err
+	}
+	l.log.Warn("Upstream ResponseWriter of type %v does not implement http.Hijacker.", reflect.TypeOf(l.responseWriter))
+	return nil, nil, fmt.Errorf("the response writer wrapped in this proxy does not implement http.Hijacker. Its type is: %v", reflect.TypeOf(l.responseWriter))
+}
+
+// copyRequest returns the request passed downstream, with the buffered body of req and its trailers.
+// Once the body has been read, req.Trailer holds the values of the trailers.
+func copyRequest(req *http.Request, body io.ReadSeeker, bodySize int64, convertTrailers bool) *http.Request {
+	o := *req
+	o.URL = utils.CopyURL(req.URL)
+	o.Header = make(http.Header)
+	utils.CopyHeaders(o.Header, req.Header)
+	o.ContentLength = bodySize
+	// remove TransferEncoding that could have been previously set because we have transformed the request from chunked encoding
+	o.TransferEncoding = []string{}
+	o.Trailer = nil
+	if len(req.Trailer) != 0 {
+		copyTrailers(&o, req.Trailer, convertTrailers)
+	}
+	// http.Transport will close the request body on any error, we are controlling the close process ourselves, so we override the closer here
+	if body == nil {
+		o.Body = io.NopCloser(req.Body)
+	} else {
+		o.Body = &seekableBody{body: body, size: bodySize}
+	}
+	return &o
+}
+
+// copyTrailers sets the trailers on the request o, each attempt getting its own copy.
+// The trailers can only follow a chunked body: o is sent without Content-Length,
+// unless the trailers are converted to headers, see ConvertTrailersToHeaders.
+func copyTrailers(o *http.Request, trailer http.Header, convert bool) {
+	if !convert {
+		o.Trailer = trailer.Clone()
+		o.ContentLength = -1
+		return
+	}
+
+	o.Header.Del("Trailer")
+	for name, values := range trailer {
+		if len(values) != 0 {
+			o.Header[http.CanonicalHeaderKey(TrailerHeaderPrefix+name)] = append([]string(nil), values...)
+		}
+	}
+}
+
+// seekableBody is the body of the requests passed downstream when it is buffered.
+// It implements io.ReadSeekCloser, Close is a no-op: the buffer is closed once the request is served.
+// The buffer can only be rewound, so seeking to an offset reads the buffer up to it.
+type seekableBody struct {
+	body io.ReadSeeker
+	size int64
+	pos  int64
+}
+
+func (b *seekableBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.pos += int64(n)
+	return n, err
+}
+
+func (b *seekableBody) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = b.pos + offset
+	case io.SeekEnd:
+		abs = b.size + offset
+	default:
+		return b.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if abs < 0 {
+		return b.pos, fmt.Errorf("negative position %d", abs)
+	}
+
+	if abs < b.pos {
+		if _, err := b.body.Seek(0, io.SeekStart); err != nil {
+			return b.pos, err
+		}
+		b.pos = 0
+	}
+
+	target := abs
+	if target > b.size {
+		target = b.size
+	}
+
+	if skip := target - b.pos; skip > 0 {
+		n, err := io.CopyN(io.Discard, b.body, skip)
+		b.pos += n
+		if err != nil {
+			return b.pos, err
+		}
+	}
+
+	b.pos = abs
+	return abs, nil
+}
+
+// Close does nothing.
+func (*seekableBody) Close() error {
+	return nil
+}
+
+// SeekerFromRequest returns the buffered body of a request passed downstream by the buffer,
+// e.g. to read it twice or to read its end first.
+// The body can only be repositioned, not modified: a handler that reads it before forwarding the request
+// must seek back to the start. The retries replay the body from the start regardless of its position.
+// It returns false when the body is not buffered, e.g. when it is empty or streamed (StreamRequestWhenPossible).
+func SeekerFromRequest(req *http.Request) (io.ReadSeeker, bool) {
+	if req == nil {
+		return nil, false
+	}
+	body, ok := req.Body.(*seekableBody)
+	if !ok {
+		return nil, false
+	}
+	return body, true
+}
+
+// attemptWriter forwards the response of an attempt to the client,
+// unless the retry predicate decides to replay the request, in which case the response is discarded.
+// The decision is taken when the status code is known, the attempt can't be retried once it is final, see finalize.
+type attemptWriter struct {
+	header         http.Header
+	code           int
+	decided        bool
+	retry          bool
+	hijacked       bool
+	final          bool
+	responseWriter http.ResponseWriter
+	shouldRetry    func(code int, header http.Header) bool
+	log            utils.Logger
+
+	// preview is the beginning of the response body, up to previewBytes, see OnAttempt.
+	preview      []byte
+	previewBytes int64
+}
+
+// finalWriter is implemented by the writers of the attempts:
+// the response buffer marks the attempt as final before streaming its response.
+type finalWriter interface {
+	finalize()
+}
+
+// finalize prevents the retry of the attempt, whatever the retry predicate.
+func (a *attemptWriter) finalize() {
+	a.final = true
+}
+
+// finish takes the decision for the handlers that have not written anything.
+func (a *attemptWriter) finish() {
+	if !a.decided {
+		a.WriteHeader(http.StatusOK)
+	}
+}
+
+func (a *attemptWriter) Header() http.Header {
+	return a.header
+}
+
+func (a *attemptWriter) Write(buf []byte) (int, error) {
+	if !a.decided {
+		a.WriteHeader(http.StatusOK)
+	}
+	a.capture(buf)
+	if a.retry {
+		return len(buf), nil
+	}
+	return a.responseWriter.Write(buf)
+}
+
+// WriteHeader decides whether the request will be replayed, and writes the status code to the client otherwise.
+func (a *attemptWriter) WriteHeader(code int) {
+	if a.decided {
+		return
+	}
+	a.decided = true
+	a.code = code
+
+	a.retry = !a.final && a.shouldRetry(code, a.header)
+	if a.retry {
+		return
+	}
+
+	utils.CopyHeaders(a.responseWriter.Header(), a.header)
+	a.responseWriter.WriteHeader(code)
+}
+
+// Flush flushes the response to the client unless it is discarded.
+func (a *attemptWriter) Flush() {
+	if !a.decided || a.retry {
+		return
+	}
+	if f, ok := a.responseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify CloseNotifier interface - this allows downstream connections to be terminated when the client terminates.
+func (a *attemptWriter) CloseNotify() <-chan bool {
+	if cn, ok := a.responseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	a.log.Warn("Upstream ResponseWriter of type %v does not implement http.CloseNotifier. Returning dummy channel.", reflect.TypeOf(a.responseWriter))
+	return make(<-chan bool)
+}
+
+// Hijack This allows connections to be hijacked for websockets for instance.
+func (a *attemptWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := a.responseWriter.(http.Hijacker); ok {
+		conn, rw, err := hi.Hijack()
+		if err == nil {
+			a.hijacked = true
+		}
+		return conn, rw, err
+	}
+	a.log.Warn("Upstream ResponseWriter of type %v does not implement http.Hijacker.", reflect.TypeOf(a.responseWriter))
+	return nil, nil, fmt.Errorf("the response writer wrapped in this proxy does not implement http.Hijacker. Its type is: %v", reflect.TypeOf(a.responseWriter))
+}
@@ -0,0 +1,778 @@
+package buffer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mailgun/multibuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/roundrobin"
+	"github.com/vulcand/oxy/v2/testutils"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+func TestRequestBuffer_chunkedEncoding(t *testing.T) {
+	var reqBody string
+	var contentLength int64
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		reqBody = string(body)
+		contentLength = req.ContentLength
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	fwd := forward.New(false)
+
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := NewRequestBuffer(rdr)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	conn, err := net.Dial("tcp", testutils.MustParseRequestURI(proxy.URL).Host)
+	require.NoError(t, err)
+
+	_, _ = fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ntest\r\n5\r\ntest1\r\n5\r\ntest2\r\n0\r\n\r\n")
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+
+	assert.Equal(t, "testtest1test2", reqBody)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+	assert.EqualValues(t, len(reqBody), contentLength)
+}
+
+func TestRequestBuffer_limitReached(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	st, err := NewRequestBuffer(handler, MaxRequestBodyBytes(4))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, _, err := testutils.Get(proxy.URL, testutils.Body("this request is too long"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, re.StatusCode)
+}
+
+func TestRequestBuffer_retry(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		w.Header().Set("X-Attempt", "last")
+		_, _ = w.Write(body)
+	})
+	t.Cleanup(srv.Close)
+
+	lb, err := roundrobin.New(forward.New(false))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://localhost:64321")))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(srv.URL)))
+
+	st, err := NewRequestBuffer(lb, Retry(`IsNetworkError() && Attempts() <= 2`))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Body("some request parameters"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "last", re.Header.Get("X-Attempt"))
+	assert.Equal(t, "some request parameters", string(body))
+}
+
+func TestRequestBuffer_retryDiscardsAttempts(t *testing.T) {
+	attempts := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		attempts++
+		w.Header().Set("X-Attempt", fmt.Sprint(attempts))
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = fmt.Fprintf(w, "attempt %d", attempts)
+	})
+
+	st, err := NewRequestBuffer(handler, Retry(`IsNetworkError() && Attempts() <= 2`))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Equal(t, []string{"3"}, rw.Header().Values("X-Attempt"))
+	assert.Equal(t, "attempt 3", rw.Body.String())
+}
+
+func TestRequestBuffer_retryUpstreamError(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	// A server answering garbage instead of HTTP.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("\x00\x01garbage\r\n\r\n"))
+			_ = conn.Close()
+		}
+	}()
+
+	testCases := []struct {
+		desc         string
+		firstBackend string
+		expected     int
+		attempts     int
+	}{
+		{
+			desc:         "dial error is retried",
+			firstBackend: "http://localhost:64321",
+			expected:     http.StatusOK,
+			attempts:     2,
+		},
+		{
+			desc:         "malformed response is not retried",
+			firstBackend: "http://" + l.Addr().String(),
+			expected:     http.StatusBadGateway,
+			attempts:     1,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			fwd := forward.New(false)
+
+			attempts := 0
+			rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				attempts++
+				if attempts == 1 {
+					req.URL = testutils.MustParseRequestURI(test.firstBackend)
+				} else {
+					req.URL = testutils.MustParseRequestURI(srv.URL)
+				}
+				fwd.ServeHTTP(w, req)
+			})
+
+			st, err := NewRequestBuffer(rdr, Retry(`UpstreamErrorIs("dial") && Attempts() <= 2`))
+			require.NoError(t, err)
+
+			proxy := httptest.NewServer(st)
+			t.Cleanup(proxy.Close)
+
+			re, _, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, re.StatusCode)
+			assert.Equal(t, test.attempts, attempts)
+		})
+	}
+}
+
+func TestRequestBuffer_seekBody(t *testing.T) {
+	var first, second string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, ok := req.Body.(io.ReadSeekCloser)
+		require.True(t, ok)
+
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		first = string(body)
+
+		seeker, ok := SeekerFromRequest(req)
+		require.True(t, ok)
+		_, err = seeker.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+
+		body, err = io.ReadAll(req.Body)
+		require.NoError(t, err)
+		second = string(body)
+
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	st, err := NewRequestBuffer(handler)
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("some request parameters")))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "some request parameters", first)
+	assert.Equal(t, first, second)
+}
+
+func TestRequestBuffer_retryAfterSeek(t *testing.T) {
+	var bodies []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// reads the end of the body first, as the handlers looking for a trailer section.
+		seeker, ok := SeekerFromRequest(req)
+		require.True(t, ok)
+		_, err := seeker.Seek(-10, io.SeekEnd)
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		_, err = seeker.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		_, _ = io.Copy(w, req.Body)
+	})
+
+	st, err := NewRequestBuffer(handler, Retry(`IsNetworkError() && Attempts() <= 2`))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("some request parameters")))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "some request parameters", rw.Body.String())
+	assert.Equal(t, []string{"parameters", "parameters"}, bodies)
+}
+
+func TestRequestBuffer_retryRewindsBody(t *testing.T) {
+	var bodies []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+
+		// leaves the body in the middle.
+		_, err = req.Body.(io.Seeker).Seek(5, io.SeekStart)
+		require.NoError(t, err)
+
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	st, err := NewRequestBuffer(handler, Retry(`IsNetworkError() && Attempts() <= 2`))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("some request parameters")))
+
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Equal(t, []string{"some request parameters", "some request parameters", "some request parameters"}, bodies)
+}
+
+// The buffered bodies are rewound by the forwarder to retry the requests failing on a stale connection.
+func TestBuffer_retryStaleConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	bodies := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+
+				// answers a single request per connection, and closes it when the next one is received.
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				body, _ := io.ReadAll(req.Body)
+				bodies <- string(body)
+				_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+
+				_, _ = http.ReadRequest(br)
+			}()
+		}
+	}()
+
+	fwd := forward.New(false, forward.RetryStaleConnections(1))
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI("http://" + ln.Addr().String())
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := New(rdr)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	for i := 0; i < 4; i++ {
+		re, body, err := testutils.MakeRequest(proxy.URL, testutils.Method(http.MethodPut), testutils.Body("payload"))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, re.StatusCode, i)
+		assert.Equal(t, "ok", string(body))
+		assert.Equal(t, "payload", <-bodies)
+	}
+}
+
+func TestSeekableBody(t *testing.T) {
+	mb, err := multibuf.New(strings.NewReader("0123456789"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = mb.Close() })
+
+	body := &seekableBody{body: mb, size: 10}
+
+	read := func(n int) string {
+		t.Helper()
+		p := make([]byte, n)
+		n, err := io.ReadFull(body, p)
+		require.NoError(t, err)
+		return string(p[:n])
+	}
+
+	assert.Equal(t, "012", read(3))
+
+	pos, err := body.Seek(2, io.SeekCurrent)
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, pos)
+	assert.Equal(t, "56", read(2))
+
+	pos, err = body.Seek(1, io.SeekStart)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, pos)
+	assert.Equal(t, "12", read(2))
+
+	pos, err = body.Seek(-3, io.SeekEnd)
+	require.NoError(t, err)
+	assert.EqualValues(t, 7, pos)
+	assert.Equal(t, "789", read(3))
+
+	pos, err = body.Seek(5, io.SeekEnd)
+	require.NoError(t, err)
+	assert.EqualValues(t, 15, pos)
+	n, err := body.Read(make([]byte, 1))
+	assert.Zero(t, n)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = body.Seek(-1, io.SeekStart)
+	require.Error(t, err)
+
+	pos, err = body.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	assert.Zero(t, pos)
+	assert.Equal(t, "0123456789", read(10))
+}
+
+func TestSeekerFromRequest_notBuffered(t *testing.T) {
+	var seekable []bool
+	handler := http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		_, ok := SeekerFromRequest(req)
+		seekable = append(seekable, ok)
+	})
+
+	st, err := NewRequestBuffer(handler, MaxRequestBodyBytes(100), StreamRequestWhenPossible(true))
+	require.NoError(t, err)
+
+	st.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("streamed")))
+	st.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, []bool{false, false}, seekable)
+
+	_, ok := SeekerFromRequest(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("not buffered")))
+	assert.False(t, ok)
+}
+
+func TestRequestBuffer_rejectsResponseOptions(t *testing.T) {
+	_, err := NewRequestBuffer(nil, MaxRequestBodyBytes(10), MaxResponseBodyBytes(10))
+	require.Error(t, err)
+
+	_, err = NewRequestBuffer(nil, MemResponseBodyBytes(10))
+	require.Error(t, err)
+
+	_, err = NewRequestBuffer(nil, MaxRequestBodyBytes(10), MemRequestBodyBytes(10), Retry(`Attempts() <= 2`),
+		StreamRequestWhenPossible(true), RequireContentLength(true), Verbose(true))
+	require.NoError(t, err)
+}
+
+func TestRequestBuffer_streamLargeChunkedBody(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	var received int64
+	var contentLength int64
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		n, err := io.Copy(io.Discard, req.Body)
+		require.NoError(t, err)
+		received = n
+		contentLength = req.ContentLength
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	fwd := forward.New(false)
+
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := NewRequestBuffer(rdr, MaxRequestBodyBytes(200<<20), StreamRequestWhenPossible(true))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	// the reader is wrapped to hide its size, so the request is chunked.
+	body := struct{ io.Reader }{io.LimitReader(zeroReader{}, 100<<20)}
+	re, err := http.Post(proxy.URL, "application/octet-stream", body)
+	require.NoError(t, err)
+	_ = re.Body.Close()
+
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.EqualValues(t, 100<<20, received)
+	assert.EqualValues(t, -1, contentLength)
+
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRequestBuffer_streamLimitReached(t *testing.T) {
+	backendErr := make(chan error, 1)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		_, err := io.Copy(io.Discard, req.Body)
+		backendErr <- err
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	fwd := forward.New(false)
+
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := NewRequestBuffer(rdr, MaxRequestBodyBytes(1<<20), StreamRequestWhenPossible(true))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	body := struct{ io.Reader }{io.LimitReader(zeroReader{}, 2<<20)}
+	re, err := http.Post(proxy.URL, "application/octet-stream", body)
+	require.NoError(t, err)
+	_ = re.Body.Close()
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, re.StatusCode)
+	assert.Error(t, <-backendErr)
+}
+
+func TestRequestBuffer_requireContentLength(t *testing.T) {
+	var contentLength int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		contentLength = req.ContentLength
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	st, err := NewRequestBuffer(handler, StreamRequestWhenPossible(true), RequireContentLength(true))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/", struct{ io.Reader }{strings.NewReader("testtest1test2")})
+	req.ContentLength = -1
+	st.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.EqualValues(t, 14, contentLength)
+}
+
+// The composition of the request and response buffers must behave as the Buffer.
+func TestBuffer_composition(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+
+		h := w.(http.Hijacker)
+		conn, _, _ := h.Hijack()
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nX-Content-Length: %d\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ntest\r\n5\r\ntest1\r\n5\r\ntest2\r\n0\r\n\r\n", req.ContentLength)
+		_, _ = fmt.Fprint(conn, string(body))
+		_ = conn.Close()
+	})
+	t.Cleanup(srv.Close)
+
+	fwd := forward.New(false)
+
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	buffer, err := New(rdr)
+	require.NoError(t, err)
+
+	respBuffer, err := NewResponseBuffer(rdr)
+	require.NoError(t, err)
+
+	reqBuffer, err := NewRequestBuffer(respBuffer)
+	require.NoError(t, err)
+
+	expected := rawResponse(t, buffer)
+	assert.Contains(t, expected, "Content-Length: 14\r\n")
+	assert.Contains(t, expected, "X-Content-Length: 14\r\n")
+	assert.True(t, strings.HasSuffix(expected, "\r\n\r\ntesttest1test2"))
+
+	assert.Equal(t, expected, rawResponse(t, reqBuffer))
+}
+
+func rawResponse(t *testing.T, handler http.Handler) string {
+	t.Helper()
+
+	proxy := httptest.NewServer(handler)
+	t.Cleanup(proxy.Close)
+
+	conn, err := net.Dial("tcp", testutils.MustParseRequestURI(proxy.URL).Host)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	_, _ = fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ntest\r\n5\r\ntest1\r\n5\r\ntest2\r\n0\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// The Date header is the only one that can change between two calls.
+	resp.Header.Del("Date")
+
+	raw, err := httputil.DumpResponse(resp, true)
+	require.NoError(t, err)
+
+	return string(raw)
+}
+
+func BenchmarkRequestBuffer(b *testing.B) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	st, err := NewRequestBuffer(handler)
+	require.NoError(b, err)
+
+	benchmarkBuffer(b, st)
+}
+
+func BenchmarkBuffer(b *testing.B) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	st, err := New(handler)
+	require.NoError(b, err)
+
+	benchmarkBuffer(b, st)
+}
+
+func benchmarkBuffer(b *testing.B, handler http.Handler) {
+	b.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	// The headers of the request are copied for the next handler.
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("X-Request-Id", "1bd36bcc-a0d1-4fc7-aedc-20bbdefa27c5")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// newStrictProxy returns a proxy buffering the requests with StrictContentLength,
+// and recording the error passed to the error handler and the requests passed to the next handler.
+func newStrictProxy(t *testing.T) (string, *error, *[]string) {
+	t.Helper()
+
+	var bodies []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, fmt.Sprintf("%d:%s", req.ContentLength, body))
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	var handled error
+	errHandler := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		handled = err
+		(&SizeErrHandler{}).ServeHTTP(w, req, err)
+	})
+
+	st, err := NewRequestBuffer(handler, StrictContentLength(true), ErrorHandler(errHandler))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	return proxy.URL, &handled, &bodies
+}
+
+// sendRaw writes raw to a new connection to the server at rawURL, and returns the status line of the response.
+// The connection is half-closed once raw is written, so that the server sees the end of a truncated body.
+func sendRaw(t *testing.T, rawURL, raw string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", testutils.MustParseRequestURI(rawURL).Host)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	_, err = fmt.Fprint(conn, raw)
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	return status
+}
+
+func TestRequestBuffer_strictContentLength(t *testing.T) {
+	proxyURL, handled, bodies := newStrictProxy(t)
+
+	status := sendRaw(t, proxyURL, "POST / HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nContent-Length: 100\r\n\r\n"+strings.Repeat("a", 40))
+	assert.Equal(t, "HTTP/1.1 400 Bad Request\r\n", status)
+
+	var mismatch *ErrContentLengthMismatch
+	require.ErrorAs(t, *handled, &mismatch)
+	assert.Equal(t, &ErrContentLengthMismatch{Declared: 100, Actual: 40}, mismatch)
+	assert.Empty(t, *bodies)
+
+	*handled = nil
+
+	status = sendRaw(t, proxyURL, "POST / HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nContent-Length: 4\r\n\r\ntest")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+
+	status = sendRaw(t, proxyURL, "POST / HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ntest\r\n5\r\ntest1\r\n0\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+
+	assert.NoError(t, *handled)
+	assert.Equal(t, []string{"4:test", "9:testtest1"}, *bodies)
+}
+
+func TestRequestBuffer_strictContentLengthBufferedSize(t *testing.T) {
+	var handled error
+	errHandler := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		handled = err
+		(&SizeErrHandler{}).ServeHTTP(w, req, err)
+	})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	st, err := NewRequestBuffer(handler, StrictContentLength(true), StreamRequestWhenPossible(true), ErrorHandler(errHandler))
+	require.NoError(t, err)
+
+	// The body of a request built in code can be larger than its Content-Length.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 40)))
+	req.ContentLength = 10
+
+	w := httptest.NewRecorder()
+	st.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, &ErrContentLengthMismatch{Declared: 10, Actual: 40}, errors.Unwrap(handled))
+}
+
+func TestRequestBuffer_trailers(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		opts     []Option
+		expected []string
+	}{
+		{
+			desc:     "trailers",
+			expected: []string{"body=testtest1 length=-1 trailer=abc123 header=", "body=testtest1 length=-1 trailer=abc123 header="},
+		},
+		{
+			desc:     "trailers converted to headers",
+			opts:     []Option{ConvertTrailersToHeaders(true)},
+			expected: []string{"body=testtest1 length=9 trailer= header=abc123", "body=testtest1 length=9 trailer= header=abc123"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			var attempts []string
+			srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				body, err := io.ReadAll(req.Body)
+				require.NoError(t, err)
+
+				attempts = append(attempts, fmt.Sprintf("body=%s length=%d trailer=%s header=%s",
+					body, req.ContentLength, req.Trailer.Get("X-Checksum"), req.Header.Get("X-Trailer-X-Checksum")))
+
+				// The first attempt is replayed.
+				if len(attempts) == 1 {
+					w.WriteHeader(http.StatusBadGateway)
+					_, _ = w.Write([]byte("bad gateway"))
+					return
+				}
+				_, _ = w.Write([]byte("hello"))
+			})
+			t.Cleanup(srv.Close)
+
+			fwd := forward.New(false)
+			rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.MustParseRequestURI(srv.URL)
+				fwd.ServeHTTP(w, req)
+			})
+
+			st, err := NewRequestBuffer(rdr, append(test.opts, Retry(`IsNetworkError() && Attempts() <= 2`))...)
+			require.NoError(t, err)
+
+			proxy := httptest.NewServer(st)
+			t.Cleanup(proxy.Close)
+
+			conn, err := net.Dial("tcp", testutils.MustParseRequestURI(proxy.URL).Host)
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = conn.Close() })
+
+			_, _ = fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n"+
+				"4\r\ntest\r\n5\r\ntest1\r\n0\r\nX-Checksum: abc123\r\n\r\n")
+			status, err := bufio.NewReader(conn).ReadString('\n')
+			require.NoError(t, err)
+
+			assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+			assert.Equal(t, test.expected, attempts)
+		})
+	}
+}
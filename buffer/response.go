@@ -0,0 +1,345 @@
+package buffer
+
+import (
+	"bufio"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mailgun/multibuf"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// ResponseBuffer is responsible for buffering responses.
+// It reads the entire response before writing it to the client,
+// which allows to enforce size limits and to set the Content-Length of the response.
+type ResponseBuffer struct {
+	maxResponseBodyBytes int64
+	memResponseBodyBytes int64
+	threshold            int64
+
+	digestAlgorithm string
+
+	skip    func(*http.Request) bool
+	skipped atomic.Uint64
+
+	next       http.Handler
+	errHandler utils.ErrorHandler
+	// component is the name of the buffer passed to the error handler, see utils.ServeError.
+	component string
+
+	verbose bool
+	log     utils.Logger
+}
+
+// NewResponseBuffer returns a new response buffer middleware.
+// Only the response options (MaxResponseBodyBytes, MemResponseBodyBytes, ResponseBufferThreshold, AddResponseDigest)
+// and the common options are supported.
+func NewResponseBuffer(next http.Handler, setters ...Option) (*ResponseBuffer, error) {
+	b, err := newBuffer(next, setters...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.requestOptions) != 0 {
+		return nil, fmt.Errorf("options not supported by the response buffer: %s", strings.Join(b.requestOptions, ", "))
+	}
+
+	return newResponseBuffer(b, next), nil
+}
+
+func newResponseBuffer(b *Buffer, next http.Handler) *ResponseBuffer {
+	return &ResponseBuffer{
+		maxResponseBodyBytes: b.maxResponseBodyBytes,
+		memResponseBodyBytes: b.memResponseBodyBytes,
+		threshold:            b.responseThreshold,
+		digestAlgorithm:      b.responseDigestAlgorithm,
+		skip:                 b.skip,
+		next:                 next,
+		errHandler:           b.errHandler,
+		component:            "buffer/response",
+		verbose:              b.verbose,
+		log:                  b.log,
+	}
+}
+
+// Stats returns the statistics of the response buffer.
+func (b *ResponseBuffer) Stats() Stats {
+	return Stats{SkippedRequests: b.skipped.Load()}
+}
+
+// Wrap sets the next handler to be called by response buffer handler, when it was created without.
+func (b *ResponseBuffer) Wrap(next http.Handler) error {
+	if err := utils.CheckWrap(b.next, next); err != nil {
+		return err
+	}
+	b.next = next
+	return nil
+}
+
+func (b *ResponseBuffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if b.verbose && utils.DebugEnabled(b.log) {
+		dump := utils.DumpHTTPRequest(req)
+		b.log.Debug("vulcand/oxy/buffer/response: begin ServeHttp on request: %s", dump)
+		defer b.log.Debug("vulcand/oxy/buffer/response: completed ServeHttp on request: %s", dump)
+	}
+
+	if b.next == nil {
+		utils.ServeError(b.errHandler, w, req, "buffer/response", &utils.ErrNotWired{Middleware: "buffer/response"})
+		return
+	}
+
+	if b.skip != nil && b.skip(req) {
+		b.skipped.Add(1)
+		b.next.ServeHTTP(w, req)
+		return
+	}
+
+	// We create a special writer that will limit the response size, buffer it to disk if necessary
+	writer, err := multibuf.NewWriterOnce(multibuf.MaxBytes(b.maxResponseBodyBytes), multibuf.MemBytes(b.memResponseBodyBytes))
+	if err != nil {
+		b.log.Error("vulcand/oxy/buffer: failed create response writer, err: %v", err)
+		utils.ServeError(b.errHandler, w, req, b.component, err)
+		return
+	}
+
+	// We are mimicking http.ResponseWriter to replace writer with our special writer
+	bw := &bufferWriter{
+		header:         make(http.Header),
+		code:           http.StatusOK,
+		buffer:         writer,
+		responseWriter: w,
+		threshold:      b.threshold,
+		maxBytes:       b.maxResponseBodyBytes,
+		log:            b.log,
+	}
+	if b.digestAlgorithm != "" {
+		bw.digest = digestAlgorithms[b.digestAlgorithm]()
+	}
+	defer bw.Close()
+
+	// Unless the response is streamed, nothing has been written to the client yet:
+	// the error handler answers instead of the panicking handler.
+	if err := utils.ServeRecovered(b.next, bw, req); err != nil {
+		handlePanic(w, req, err, bw.streaming, bw.hijacked, b.errHandler, b.component, b.log)
+		return
+	}
+	if bw.hijacked {
+		b.log.Debug("vulcand/oxy/buffer: connection was hijacked downstream. Not taking any action in buffer.")
+		return
+	}
+
+	if bw.streaming {
+		// The client must not take a truncated response as complete.
+		if bw.overLimit {
+			panic(http.ErrAbortHandler)
+		}
+		if bw.digest != nil {
+			w.Header().Set(digestHeader, digestValue(b.digestAlgorithm, bw.digest))
+		}
+		return
+	}
+
+	var reader multibuf.MultiReader
+	if bw.expectBody(req) {
+		rdr, err := writer.Reader()
+		if err != nil {
+			b.log.Error("vulcand/oxy/buffer: failed to read response, err: %v", err)
+			utils.ServeError(b.errHandler, w, req, b.component, err)
+			return
+		}
+		defer rdr.Close()
+		reader = rdr
+	}
+
+	utils.CopyHeaders(w.Header(), bw.Header())
+	if reader != nil {
+		if size, err := reader.Size(); err == nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+	}
+	if reader != nil && bw.digest != nil {
+		w.Header().Set(digestHeader, digestValue(b.digestAlgorithm, bw.digest))
+	}
+	w.WriteHeader(bw.code)
+	if reader != nil {
+		_, _ = io.Copy(w, reader)
+	}
+}
+
+type bufferWriter struct {
+	header         http.Header
+	code           int
+	buffer         multibuf.WriterOnce
+	responseWriter http.ResponseWriter
+	hijacked       bool
+	// digest is computed while the response is buffered.
+	digest hash.Hash
+
+	// threshold is the size over which the response is streamed, 0 if it is always buffered.
+	threshold int64
+	maxBytes  int64
+	written   int64
+	streaming bool
+	overLimit bool
+
+	log utils.Logger
+}
+
+// RFC2616 #4.4.
+func (b *bufferWriter) expectBody(r *http.Request) bool {
+	if r.Method == http.MethodHead {
+		return false
+	}
+	if (b.code >= 100 && b.code < 200) || b.code == 204 || b.code == 304 {
+		return false
+	}
+	// refer to https://github.com/vulcand/oxy/issues/113
+	// if b.header.Get("Content-Length") == "" && b.header.Get("Transfer-Encoding") == "" {
+	// 	return false
+	// }
+	if b.header.Get("Content-Length") == "0" {
+		return false
+	}
+	// Support for gRPC, gRPC Web.
+	if grpcStatus := b.header.Get("Grpc-Status"); grpcStatus != "" && grpcStatus != "0" {
+		return false
+	}
+	return true
+}
+
+// Close releases the buffered response.
+// The temporary file of a response that has not been read (e.g. a HEAD response, or a panicking handler) is only removed
+// by closing its reader: the WriterOnce closes the file without removing it.
+func (b *bufferWriter) Close() error {
+	if rdr, err := b.buffer.Reader(); err == nil {
+		return rdr.Close()
+	}
+	return b.buffer.Close()
+}
+
+func (b *bufferWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferWriter) Write(buf []byte) (int, error) {
+	if b.threshold > 0 && !b.streaming && b.written+int64(len(buf)) > b.threshold {
+		if err := b.startStreaming(); err != nil {
+			return 0, err
+		}
+	}
+	if b.streaming {
+		return b.writeStream(buf)
+	}
+
+	length, err := b.buffer.Write(buf)
+	b.written += int64(length)
+	if b.digest != nil {
+		_, _ = b.digest.Write(buf[:length])
+	}
+	if err != nil {
+		// Since go1.11 (https://github.com/golang/go/commit/8f38f28222abccc505b9a1992deecfe3e2cb85de)
+		// if the writer returns an error, the reverse proxy panics
+		b.log.Error("write: %v", err)
+		length = len(buf)
+	}
+	return length, nil
+}
+
+// WriteHeader sets rw.Code.
+func (b *bufferWriter) WriteHeader(code int) {
+	if b.streaming {
+		return
+	}
+	b.code = code
+}
+
+// Flush flushes the response to the client once it is streamed, it does nothing while the response is buffered.
+func (b *bufferWriter) Flush() {
+	if !b.streaming {
+		return
+	}
+	if f, ok := b.responseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// startStreaming writes the status code, the headers and the buffered bytes to the client.
+// The attempt of the request buffer, if any, becomes final: the response can't be discarded anymore.
+func (b *bufferWriter) startStreaming() error {
+	b.streaming = true
+
+	if fw, ok := b.responseWriter.(finalWriter); ok {
+		fw.finalize()
+	}
+
+	h := b.responseWriter.Header()
+	utils.CopyHeaders(h, b.header)
+	h.Del("Content-Length")
+	if b.digest != nil {
+		h.Add("Trailer", digestHeader)
+	}
+	b.responseWriter.WriteHeader(b.code)
+
+	if b.written == 0 {
+		return nil
+	}
+
+	rdr, err := b.buffer.Reader()
+	if err != nil {
+		b.log.Error("vulcand/oxy/buffer: failed to read response, err: %v", err)
+		return err
+	}
+	defer rdr.Close()
+
+	if _, err := io.Copy(b.responseWriter, rdr); err != nil {
+		b.log.Error("vulcand/oxy/buffer: failed to write response, err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// writeStream writes to the client the bytes of a streamed response, up to the maximum size of the response.
+func (b *bufferWriter) writeStream(buf []byte) (int, error) {
+	if b.maxBytes > 0 && b.written+int64(len(buf)) > b.maxBytes {
+		b.overLimit = true
+		err := &multibuf.MaxSizeReachedError{MaxSize: b.maxBytes}
+		b.log.Error("vulcand/oxy/buffer: response body over limit, err: %v", err)
+		return 0, err
+	}
+
+	length, err := b.responseWriter.Write(buf)
+	b.written += int64(length)
+	if b.digest != nil {
+		_, _ = b.digest.Write(buf[:length])
+	}
+	return length, err
+}
+
+// CloseNotify CloseNotifier interface - this allows downstream connections to be terminated when the client terminates.
+func (b *bufferWriter) CloseNotify() <-chan bool {
+	if cn, ok := b.responseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	b.log.Warn("Upstream ResponseWriter of type %v does not implement http.CloseNotifier. Returning dummy channel.", reflect.TypeOf(b.responseWriter))
+	return make(<-chan bool)
+}
+
+// Hijack This allows connections to be hijacked for websockets for instance.
+func (b *bufferWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := b.responseWriter.(http.Hijacker); ok {
+		conn, rw, err := hi.Hijack()
+		if err == nil {
+			b.hijacked = true
+		}
+		return conn, rw, err
+	}
+	b.log.Warn("Upstream ResponseWriter of type %v does not implement http.Hijacker.", reflect.TypeOf(b.responseWriter))
+	return nil, nil, fmt.Errorf("the response writer wrapped in this proxy does not implement http.Hijacker. Its type is: %v", reflect.TypeOf(b.responseWriter))
+}
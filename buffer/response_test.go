@@ -0,0 +1,197 @@
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestResponseBuffer_chunkedResponse(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		h := w.(http.Hijacker)
+		conn, _, _ := h.Hijack()
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ntest\r\n5\r\ntest1\r\n5\r\ntest2\r\n0\r\n\r\n")
+		_ = conn.Close()
+	})
+	t.Cleanup(srv.Close)
+
+	fwd := forward.New(false)
+
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := NewResponseBuffer(rdr)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "testtest1test2", string(body))
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, strconv.Itoa(len("testtest1test2")), re.Header.Get("Content-Length"))
+}
+
+func TestResponseBuffer_limitReached(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello, this response is too large"))
+	})
+
+	st, err := NewResponseBuffer(handler, MaxResponseBodyBytes(4))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+}
+
+func TestResponseBuffer_rejectsRequestOptions(t *testing.T) {
+	_, err := NewResponseBuffer(nil, MaxResponseBodyBytes(10), MaxRequestBodyBytes(10))
+	require.Error(t, err)
+
+	_, err = NewResponseBuffer(nil, Retry(`Attempts() <= 2`))
+	require.Error(t, err)
+
+	_, err = NewResponseBuffer(nil, StreamRequestWhenPossible(true))
+	require.Error(t, err)
+
+	_, err = NewRequestBuffer(nil, ResponseBufferThreshold(10))
+	require.Error(t, err)
+
+	_, err = NewResponseBuffer(nil, ResponseBufferThreshold(-1))
+	require.Error(t, err)
+
+	_, err = NewResponseBuffer(nil, MaxResponseBodyBytes(10), MemResponseBodyBytes(10), Verbose(true))
+	require.NoError(t, err)
+}
+
+func TestResponseBuffer_thresholdNotReached(t *testing.T) {
+	body := strings.Repeat("a", 10*1024)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(body))
+	})
+
+	st, err := NewResponseBuffer(handler, ResponseBufferThreshold(1024*1024))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, b, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(body)), re.Header.Get("Content-Length"))
+	assert.Empty(t, re.TransferEncoding)
+	assert.Equal(t, body, string(b))
+}
+
+func TestResponseBuffer_thresholdStreaming(t *testing.T) {
+	const size = 5 * 1024 * 1024
+
+	firstBytes := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write(bytes.Repeat([]byte("a"), 2*1024*1024))
+		w.(http.Flusher).Flush()
+
+		// The end of the response is only written once the client has received its beginning.
+		select {
+		case <-firstBytes:
+		case <-time.After(5 * time.Second):
+			return
+		}
+		_, _ = w.Write(bytes.Repeat([]byte("b"), size-2*1024*1024))
+	})
+
+	st, err := NewResponseBuffer(handler, ResponseBufferThreshold(1024*1024), MaxResponseBodyBytes(10*1024*1024))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	defer func() { _ = re.Body.Close() }()
+
+	assert.Equal(t, http.StatusAccepted, re.StatusCode)
+	assert.Equal(t, "yes", re.Header.Get("X-Upstream"))
+	assert.Equal(t, int64(-1), re.ContentLength)
+	assert.Equal(t, []string{"chunked"}, re.TransferEncoding)
+
+	head := make([]byte, 1024)
+	_, err = io.ReadFull(re.Body, head)
+	require.NoError(t, err)
+	close(firstBytes)
+
+	rest, err := io.ReadAll(re.Body)
+	require.NoError(t, err)
+	assert.Equal(t, size, len(head)+len(rest))
+	assert.Equal(t, byte('b'), rest[len(rest)-1])
+}
+
+func TestResponseBuffer_thresholdLimitReached(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		for i := 0; i < 10; i++ {
+			_, _ = w.Write(bytes.Repeat([]byte("a"), 1024))
+		}
+	})
+
+	st, err := NewResponseBuffer(handler, ResponseBufferThreshold(2048), MaxResponseBodyBytes(4096))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	defer func() { _ = re.Body.Close() }()
+
+	// The response has been started: it is aborted.
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	_, err = io.ReadAll(re.Body)
+	require.Error(t, err)
+}
+
+func TestBuffer_thresholdNoRetryOnceStreamed(t *testing.T) {
+	var attempts int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte("failed"))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write(bytes.Repeat([]byte("a"), 4096))
+	})
+
+	st, err := New(handler, Retry(`ResponseCode() >= 500 && Attempts() <= 5`), ResponseBufferThreshold(1024))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Len(t, body, 4096)
+	assert.Equal(t, 2, attempts)
+}
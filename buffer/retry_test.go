@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -72,6 +73,107 @@ func TestBuffer_retryExceedAttempts(t *testing.T) {
 	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
 }
 
+func TestBuffer_retryProto(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	// Only the HTTP/2 clients are retried.
+	lb, rt := newBufferMiddleware(t, `Proto() == "HTTP/2.0" && IsNetworkError() && Attempts() <= 2`)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://localhost:64321")))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(srv.URL)))
+
+	for _, http2 := range []bool{true, false} {
+		proxy := httptest.NewUnstartedServer(rt)
+		proxy.EnableHTTP2 = http2
+		proxy.StartTLS()
+		t.Cleanup(proxy.Close)
+
+		// The first attempt goes to the unreachable server.
+		re, err := proxy.Client().Get(proxy.URL)
+		require.NoError(t, err)
+		_ = re.Body.Close()
+
+		if http2 {
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+		} else {
+			assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+		}
+	}
+}
+
+func TestBuffer_roundRobinFailover(t *testing.T) {
+	a := testutils.NewChaosBackend(t, "a")
+	b := testutils.NewChaosBackend(t, "b")
+
+	lb, rt := newBufferMiddleware(t, `IsNetworkError() && Attempts() <= 2`)
+
+	proxy := httptest.NewServer(rt)
+	t.Cleanup(proxy.Close)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+
+	a.Kill()
+
+	// The requests sent to the killed backend are retried on the survivor.
+	for i := 0; i < 10; i++ {
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "b", string(body))
+	}
+
+	assert.Equal(t, int64(10), b.Stats().Requests)
+	assert.Equal(t, int64(0), a.Stats().Requests)
+}
+
+func TestBuffer_retryOnResetConnection(t *testing.T) {
+	a := testutils.NewChaosBackend(t, "a")
+	b := testutils.NewChaosBackend(t, "b")
+
+	lb, rt := newBufferMiddleware(t, `IsNetworkError() && Attempts() <= 2`)
+
+	proxy := httptest.NewServer(rt)
+	t.Cleanup(proxy.Close)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+
+	a.ResetConnections()
+	b.Hang()
+
+	type response struct {
+		code int
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		re, body, err := testutils.Get(proxy.URL, testutils.Body("some request parameters"))
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		responses <- response{code: re.StatusCode, body: string(body)}
+	}()
+
+	// The first attempt is reset, the retry waits for the hanging backend.
+	assert.Eventually(t, func() bool { return b.Stats().InFlight == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, int64(1), a.Stats().ConnectionsReset)
+	assert.Empty(t, responses)
+
+	b.Resume()
+
+	resp := <-responses
+	require.NoError(t, resp.err)
+	assert.Equal(t, http.StatusOK, resp.code)
+	assert.Equal(t, "b", resp.body)
+	assert.Equal(t, int64(1), b.Stats().Requests)
+}
+
 func newBufferMiddleware(t *testing.T, p string) (*roundrobin.RoundRobin, *Buffer) {
 	t.Helper()
 
@@ -0,0 +1,45 @@
+package buffer
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Stats are the statistics of a buffer.
+type Stats struct {
+	// SkippedRequests is the number of requests passed as is to the next handler, see SkipWhen.
+	SkippedRequests uint64
+	// DroppedAuditEntries is the number of audit entries dropped because the queue of the AuditSink was full.
+	DroppedAuditEntries uint64
+}
+
+// SkipUpgradesAndSSE is a SkipWhen predicate matching the protocol upgrades (e.g. websockets),
+// and the requests accepting server-sent events (Accept: text/event-stream).
+func SkipUpgradesAndSSE(req *http.Request) bool {
+	return hasToken(req.Header, "Connection", "upgrade") || acceptsEventStream(req.Header)
+}
+
+// hasToken reports whether the comma-separated values of the header contain the token, case-insensitively.
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func acceptsEventStream(h http.Header) bool {
+	for _, v := range h.Values("Accept") {
+		for _, t := range strings.Split(v, ",") {
+			mediaType, _, err := mime.ParseMediaType(t)
+			if err == nil && mediaType == "text/event-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
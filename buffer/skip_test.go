@@ -0,0 +1,175 @@
+package buffer
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestBuffer_skipWebsocket(t *testing.T) {
+	// The host is not passed to the backend: it checks the origin against its own address.
+	srv := testutils.NewWSEchoServer(t, testutils.WSAnyOrigin())
+
+	fwd := forward.New(false)
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := New(rdr, MaxRequestBodyBytes(4), MaxResponseBodyBytes(4), SkipWhen(SkipUpgradesAndSSE))
+	require.NoError(t, err)
+
+	for desc, handler := range map[string]http.Handler{"forward": rdr, "buffer": st} {
+		proxy := httptest.NewServer(handler)
+		t.Cleanup(proxy.Close)
+
+		conn, err := testutils.WSRequest(testutils.WSServer(proxy.Listener.Addr().String()), testutils.WSPath("/ws"))
+		require.NoError(t, err, desc)
+
+		require.NoError(t, conn.SendText("hello websocket"), desc)
+		require.NoError(t, conn.Expect("hello websocket"), desc)
+		_ = conn.Close()
+	}
+
+	assert.Equal(t, Stats{SkippedRequests: 1}, st.Stats())
+}
+
+func TestBuffer_skipSSE(t *testing.T) {
+	received := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+
+		// The second event is only sent once the client got the first one.
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			return
+		}
+		_, _ = w.Write([]byte("data: 2\n\n"))
+	})
+	t.Cleanup(srv.Close)
+
+	fwd := forward.New(false)
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := New(rdr, SkipWhen(SkipUpgradesAndSSE))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: 1\n", line)
+	close(received)
+
+	_, _ = br.ReadString('\n')
+	line, err = br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: 2\n", line)
+
+	assert.Equal(t, Stats{SkippedRequests: 1}, st.Stats())
+}
+
+func TestBuffer_skipLimitsOthers(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	fwd := forward.New(false)
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := New(rdr, MaxRequestBodyBytes(4), SkipWhen(SkipUpgradesAndSSE))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, _, err := testutils.Get(proxy.URL, testutils.Body("this request is too long"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, re.StatusCode)
+
+	// The predicate decides, whatever the body.
+	re, _, err = testutils.Get(proxy.URL, testutils.Body("this request is too long"), testutils.Header("Accept", "text/event-stream"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	assert.Equal(t, Stats{SkippedRequests: 1}, st.Stats())
+}
+
+func TestRequestResponseBuffer_skip(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("this response is too long"))
+	})
+	skip := func(req *http.Request) bool { return req.URL.Path == "/skip" }
+
+	rqb, err := NewRequestBuffer(handler, MaxRequestBodyBytes(4), SkipWhen(skip))
+	require.NoError(t, err)
+	rsb, err := NewResponseBuffer(handler, MaxResponseBodyBytes(4), SkipWhen(skip))
+	require.NoError(t, err)
+
+	for _, path := range []string{"/", "/skip"} {
+		rw := httptest.NewRecorder()
+		rqb.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, path, strings.NewReader("this request is too long")))
+		assert.Equal(t, path == "/skip", rw.Code == http.StatusOK, path)
+
+		rw = httptest.NewRecorder()
+		rsb.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, path == "/skip", rw.Code == http.StatusOK, path)
+	}
+
+	assert.Equal(t, Stats{SkippedRequests: 1}, rqb.Stats())
+	assert.Equal(t, Stats{SkippedRequests: 1}, rsb.Stats())
+
+	_, err = New(handler, SkipWhen(nil))
+	require.Error(t, err)
+}
+
+func TestSkipUpgradesAndSSE(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		header   http.Header
+		expected bool
+	}{
+		{desc: "plain", header: http.Header{"Accept": {"text/html"}}},
+		{desc: "websocket", header: http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, expected: true},
+		{desc: "upgrade token", header: http.Header{"Connection": {"keep-alive, upgrade"}}, expected: true},
+		{desc: "keep-alive", header: http.Header{"Connection": {"keep-alive"}}},
+		{desc: "event stream", header: http.Header{"Accept": {"text/event-stream"}}, expected: true},
+		{desc: "event stream among others", header: http.Header{"Accept": {"text/html, text/event-stream;q=0.9"}}, expected: true},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header = test.header
+			assert.Equal(t, test.expected, SkipUpgradesAndSSE(req))
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/vulcand/oxy/v2/forward"
 	"github.com/vulcand/predicate"
 )
 
@@ -29,10 +30,12 @@ func parseExpression(in string) (hpredicate, error) {
 			GE:  ge,
 		},
 		Functions: map[string]interface{}{
-			"RequestMethod":  requestMethod,
-			"IsNetworkError": isNetworkError,
-			"Attempts":       attempts,
-			"ResponseCode":   responseCode,
+			"RequestMethod":   requestMethod,
+			"Proto":           proto,
+			"IsNetworkError":  isNetworkError,
+			"Attempts":        attempts,
+			"ResponseCode":    responseCode,
+			"UpstreamErrorIs": upstreamErrorIs,
 		},
 	})
 	if err != nil {
@@ -56,6 +59,14 @@ func isNetworkError() hpredicate {
 	}
 }
 
+// UpstreamErrorIs returns a predicate that returns true if last attempt ended with an upstream error of the kind,
+// e.g. UpstreamErrorIs("dial"), see forward.ErrorKind.
+func upstreamErrorIs(kind string) hpredicate {
+	return func(c *context) bool {
+		return c.upstreamErr != nil && forward.ErrorKind(c.upstreamErr) == kind
+	}
+}
+
 // and returns predicate by joining the passed predicates with logical 'and'.
 func and(fns ...hpredicate) hpredicate {
 	return func(c *context) bool {
@@ -201,6 +212,8 @@ type context struct {
 	r            *http.Request
 	attempt      int
 	responseCode int
+	// upstreamErr is the typed error of the forwarder for the last attempt, if any.
+	upstreamErr error
 }
 
 type toString func(c *context) string
@@ -214,6 +227,13 @@ func requestMethod() toString {
 	}
 }
 
+// Proto returns mapper of the request to the protocol of the client e.g. HTTP/2.0.
+func proto() toString {
+	return func(c *context) string {
+		return c.r.Proto
+	}
+}
+
 // Attempts returns mapper of the request to the number of proxy attempts.
 func attempts() toInt {
 	return func(c *context) int {
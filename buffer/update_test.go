@@ -0,0 +1,181 @@
+package buffer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestBuffer_updateOptionsConcurrent(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		_, _ = w.Write(body)
+	})
+
+	st, err := New(handler, MaxRequestBodyBytes(1<<20))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	stop := make(chan struct{})
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			limit := int64(1 << 20)
+			if i%2 == 0 {
+				limit = 4
+			}
+			assert.NoError(t, st.UpdateOptions(MaxRequestBodyBytes(limit)))
+		}
+	}()
+
+	var ok, tooLarge atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				re, body, err := testutils.Post(proxy.URL, testutils.Body("0123456789"))
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				switch re.StatusCode {
+				case http.StatusOK:
+					ok.Add(1)
+					assert.Equal(t, "0123456789", string(body))
+				case http.StatusRequestEntityTooLarge:
+					tooLarge.Add(1)
+					assert.Equal(t, http.StatusText(http.StatusRequestEntityTooLarge), string(body))
+				default:
+					t.Errorf("unexpected response: %d %q", re.StatusCode, body)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	<-updated
+
+	assert.Equal(t, int64(200), ok.Load()+tooLarge.Load())
+}
+
+func TestBuffer_updateOptionsInvalid(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		_, _ = w.Write(body)
+	})
+
+	st, err := New(handler, MaxRequestBodyBytes(16))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	// The valid option before the invalid one is not applied either.
+	require.Error(t, st.UpdateOptions(MaxRequestBodyBytes(4), Retry("Attempts(")))
+	require.Error(t, st.UpdateOptions(MaxRequestBodyBytes(4), AuditMaxBodyBytes(10)))
+
+	re, body, err := testutils.Post(proxy.URL, testutils.Body("0123456789"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "0123456789", string(body))
+
+	require.NoError(t, st.UpdateOptions(MaxRequestBodyBytes(4)))
+
+	re, _, err = testutils.Post(proxy.URL, testutils.Body("0123456789"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, re.StatusCode)
+}
+
+func TestBuffer_updateOptionsRepeated(t *testing.T) {
+	st, err := New(nil, MaxRequestBodyBytes(16))
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, st.UpdateOptions(MaxRequestBodyBytes(int64(i+1)), MaxResponseBodyBytes(int64(i+1))))
+	}
+
+	// The names of the updated options are not kept.
+	assert.Empty(t, st.requestOptions)
+	assert.Empty(t, st.responseOptions)
+
+	// The audit options are still rejected.
+	require.Error(t, st.UpdateOptions(AuditMaxBodyBytes(10)))
+}
+
+func TestBuffer_updateOptionsSnapshot(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var attempts atomic.Int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/skip" {
+			return
+		}
+		if attempts.Add(1) == 1 {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte("bad gateway"))
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	skip := func(req *http.Request) bool { return req.URL.Path == "/skip" }
+	st, err := New(handler, Retry(`IsNetworkError() && Attempts() <= 2`), SkipWhen(skip))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	_, _, err = testutils.Get(proxy.URL + "/skip")
+	require.NoError(t, err)
+
+	type response struct {
+		code int
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		re, _, err := testutils.Get(proxy.URL)
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		responses <- response{code: re.StatusCode}
+	}()
+
+	// The request in progress keeps the retry predicate of its start.
+	<-started
+	require.NoError(t, st.UpdateOptions(Retry(`Attempts() < 1`)))
+	close(release)
+
+	resp := <-responses
+	require.NoError(t, resp.err)
+	assert.Equal(t, http.StatusOK, resp.code)
+	assert.Equal(t, int64(2), attempts.Load())
+
+	// The stats are kept.
+	_, _, err = testutils.Get(proxy.URL + "/skip")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), st.Stats().SkippedRequests)
+}
@@ -0,0 +1,666 @@
+// Package cache implements an in-memory cache of the responses of the next handler, e.g. in front of read-heavy APIs.
+//
+// The responses are stored as in a shared cache, according to their Cache-Control and Expires headers:
+// the private and no-store responses, and the responses without explicit freshness, are never stored.
+// A stored response is served without calling the next handler while it is fresh.
+// Once stale, it is revalidated by the next handler, with a conditional request when it has an ETag or a Last-Modified header:
+// a 304 response refreshes the stored response without replacing its body.
+// Within the stale-while-revalidate window of the response, the stale response is served while a single request per
+// response revalidates it in the background.
+//
+// The responses flushed by the next handler, e.g. long polls, the event streams and the responses without explicit freshness
+// are written through to the client as they are produced, and not stored.
+//
+// The responses of the cache carry an X-Cache header (HIT, MISS or STALE), and the stored ones an Age header.
+// The requests with an Authorization header, an Upgrade or a Range header, or a method other than GET and HEAD bypass the cache.
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// XCache is the header reporting how the cache served the response.
+const XCache = "X-Cache"
+
+// The values of the XCache header.
+const (
+	// Hit is a fresh stored response, or a stale one revalidated by the next handler.
+	Hit = "HIT"
+	// Miss is a response of the next handler.
+	Miss = "MISS"
+	// Stale is a stale stored response, revalidated in the background.
+	Stale = "STALE"
+)
+
+const (
+	defaultMaxEntries   = 10000
+	defaultMaxBodyBytes = 1 << 20
+	defaultMaxBytes     = 64 << 20
+)
+
+// cacheableStatuses are the status codes of the responses which can be stored.
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// Cache is a middleware storing the responses of the next handler in memory, see the package documentation.
+type Cache struct {
+	next http.Handler
+
+	key             func(*http.Request) string
+	now             func() clock.Time
+	methods         map[string]bool
+	cacheAuthorized bool
+	storeSetCookie  bool
+
+	maxEntries   int
+	maxBodyBytes int64
+	maxBytes     int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	// variants are the headers of the Vary header of the stored responses, by key of the request.
+	variants map[string]*variants
+	bytes    int64
+	// revalidating are the keys of the responses being revalidated in the background.
+	revalidating map[string]bool
+	// revalidations tracks the background revalidations.
+	revalidations sync.WaitGroup
+
+	log utils.Logger
+}
+
+// variants are the headers varying the responses of a key.
+type variants struct {
+	headers []string
+	// count is the number of stored responses varying on the headers.
+	count int
+}
+
+// New creates a new Cache middleware.
+// next can be nil, and set later with Wrap.
+func New(next http.Handler, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		next:         next,
+		key:          defaultKey,
+		now:          clock.Now,
+		methods:      map[string]bool{http.MethodGet: true, http.MethodHead: true},
+		maxEntries:   defaultMaxEntries,
+		maxBodyBytes: defaultMaxBodyBytes,
+		maxBytes:     defaultMaxBytes,
+		lru:          list.New(),
+		entries:      make(map[string]*list.Element),
+		variants:     make(map[string]*variants),
+		revalidating: make(map[string]bool),
+		log:          &utils.NoopLogger{},
+	}
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.maxBodyBytes > c.maxBytes {
+		c.maxBodyBytes = c.maxBytes
+	}
+	return c, nil
+}
+
+func defaultKey(req *http.Request) string {
+	return req.Method + " " + req.Host + req.URL.RequestURI()
+}
+
+// Wrap sets the next handler to be called by the cache, when it was created without.
+func (c *Cache) Wrap(next http.Handler) error {
+	if err := utils.CheckWrap(c.next, next); err != nil {
+		return err
+	}
+	c.next = next
+	return nil
+}
+
+// Next returns the next handler.
+func (c *Cache) Next() http.Handler {
+	return c.next
+}
+
+// Len returns the number of stored responses.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *Cache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if c.next == nil {
+		utils.ServeError(nil, w, req, "cache", &utils.ErrNotWired{Middleware: "cache"})
+		return
+	}
+
+	if c.bypass(req) {
+		c.next.ServeHTTP(w, req)
+		return
+	}
+
+	base := c.key(req)
+	now := c.now()
+
+	e := c.lookup(base, req)
+	if e == nil {
+		c.fetch(w, req, base, nil)
+		return
+	}
+
+	switch age := e.age(now); {
+	case age < e.freshness.lifetime:
+		c.serveEntry(w, req, e, now, Hit)
+	case age < e.freshness.lifetime+e.freshness.staleWhileRevalidate:
+		c.revalidateInBackground(req, base, e)
+		c.serveEntry(w, req, e, now, Stale)
+	default:
+		c.fetch(w, req, base, e)
+	}
+}
+
+// bypass reports whether the request is passed to the next handler without using the cache.
+func (c *Cache) bypass(req *http.Request) bool {
+	if !c.methods[req.Method] {
+		return true
+	}
+	if !c.cacheAuthorized && req.Header.Get("Authorization") != "" {
+		return true
+	}
+	return req.Header.Get("Upgrade") != "" || req.Header.Get("Range") != ""
+}
+
+// fetch serves the response of the next handler, and stores it if possible.
+// When stale is set, the request is a revalidation of the stale response, conditional if it has validators:
+// the stale response is refreshed and served if the next handler answers 304.
+func (c *Cache) fetch(w http.ResponseWriter, req *http.Request, base string, stale *entry) {
+	outReq := req
+	if stale != nil {
+		outReq = conditional(req, stale)
+	}
+
+	rec := newRecorder(w, c.maxBodyBytes)
+	c.next.ServeHTTP(rec, outReq)
+	if rec.passThrough {
+		return
+	}
+
+	if refreshed := c.update(req, base, stale, rec); refreshed != nil {
+		c.serveEntry(w, req, refreshed, c.now(), Hit)
+		return
+	}
+	rec.writeTo(w)
+}
+
+// revalidateInBackground revalidates e with a copy of req, unless it is already being revalidated.
+func (c *Cache) revalidateInBackground(req *http.Request, base string, e *entry) {
+	c.mu.Lock()
+	if c.revalidating[e.key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[e.key] = true
+	c.mu.Unlock()
+
+	// The revalidation outlives the request.
+	outReq := conditional(req.Clone(context.Background()), e)
+
+	c.revalidations.Add(1)
+	go func() {
+		defer c.revalidations.Done()
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, e.key)
+			c.mu.Unlock()
+		}()
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				c.log.Error("vulcand/oxy/cache: panic while revalidating %s: %v", e.key, recovered)
+			}
+		}()
+
+		rec := newRecorder(nil, c.maxBodyBytes)
+		c.next.ServeHTTP(rec, outReq)
+		if !rec.passThrough {
+			c.update(outReq, base, e, rec)
+		}
+	}()
+}
+
+// update stores the response of rec to req if possible.
+// When rec is a 304 answering the revalidation of stale, stale is refreshed instead, and the refreshed entry is returned.
+func (c *Cache) update(req *http.Request, base string, stale *entry, rec *recorder) *entry {
+	now := c.now()
+
+	if rec.code == http.StatusNotModified && stale != nil && stale.hasValidators() {
+		refreshed := stale.refresh(rec.header, now)
+		c.store(refreshed)
+		return refreshed
+	}
+
+	if e := c.newEntry(req, base, rec, now); e != nil {
+		c.store(e)
+	}
+	return nil
+}
+
+// newEntry returns the entry of the response of rec to req, nil if it can't be stored.
+func (c *Cache) newEntry(req *http.Request, base string, rec *recorder, now clock.Time) *entry {
+	if !cacheableStatuses[rec.code] {
+		return nil
+	}
+
+	cc := parseCacheControl(rec.header)
+	if cc.has("no-store") || cc.has("private") {
+		return nil
+	}
+
+	header := rec.header.Clone()
+	if len(header.Values("Set-Cookie")) > 0 {
+		if !c.storeSetCookie {
+			return nil
+		}
+		header.Del("Set-Cookie")
+	}
+
+	vary := varyHeaders(header)
+	if contains(vary, "*") {
+		return nil
+	}
+
+	f, ok := freshnessOf(header, now)
+	if !ok {
+		return nil
+	}
+
+	e := &entry{
+		base:       base,
+		status:     rec.code,
+		header:     header,
+		body:       append([]byte(nil), rec.body.Bytes()...),
+		vary:       vary,
+		stored:     now,
+		initialAge: ageOf(header),
+		freshness:  f,
+	}
+	// A response to revalidate on every request is only useful with validators.
+	if f.lifetime == 0 && f.staleWhileRevalidate == 0 && !e.hasValidators() {
+		return nil
+	}
+
+	e.key = variantKey(base, vary, req.Header)
+	e.size = e.computeSize()
+	if e.size > c.maxBytes {
+		return nil
+	}
+	return e
+}
+
+// lookup returns the stored response of req, nil if there is none.
+func (c *Cache) lookup(base string, req *http.Request) *entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := base
+	if v, ok := c.variants[base]; ok {
+		key = variantKey(base, v.headers, req.Header)
+	}
+
+	elt, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elt)
+	return elt.Value.(*entry)
+}
+
+// store adds e to the cache, replacing the stored response of its key, and evicts the least recently used responses
+// over the budget.
+func (c *Cache) store(e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elt, ok := c.entries[e.key]; ok {
+		c.remove(elt)
+	}
+
+	if len(e.vary) > 0 {
+		v, ok := c.variants[e.base]
+		if !ok || !equalHeaders(v.headers, e.vary) {
+			v = &variants{headers: e.vary}
+			c.variants[e.base] = v
+		}
+		v.count++
+		e.variants = v
+	} else {
+		delete(c.variants, e.base)
+	}
+
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.bytes += e.size
+
+	for c.lru.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes the stored response of elt, it must be called with the mutex held.
+func (c *Cache) remove(elt *list.Element) {
+	e := c.lru.Remove(elt).(*entry)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+
+	if e.variants != nil {
+		e.variants.count--
+		if e.variants.count == 0 && c.variants[e.base] == e.variants {
+			delete(c.variants, e.base)
+		}
+	}
+}
+
+// serveEntry writes the stored response e, or a 304 response if the request is conditional and e matches it.
+func (c *Cache) serveEntry(w http.ResponseWriter, req *http.Request, e *entry, now clock.Time, status string) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set("Age", strconv.FormatInt(int64(e.age(now)/clock.Second), 10))
+	h.Set(XCache, status)
+
+	if e.notModified(req) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(e.status)
+	if req.Method != http.MethodHead {
+		_, _ = w.Write(e.body)
+	}
+}
+
+// conditional returns a copy of req revalidating e: with the validators of e, if any.
+// The conditional headers of the client are replaced, they are evaluated against the stored response.
+func conditional(req *http.Request, e *entry) *http.Request {
+	if !e.hasValidators() {
+		return req
+	}
+
+	out := req.Clone(req.Context())
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	if etag := e.header.Get("ETag"); etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.header.Get("Last-Modified"); lastModified != "" {
+		out.Header.Set("If-Modified-Since", lastModified)
+	}
+	return out
+}
+
+// entry is a stored response. The entries are never modified once stored, the refreshed ones are replaced.
+type entry struct {
+	key  string
+	base string
+
+	status int
+	header http.Header
+	body   []byte
+	// vary are the canonical names of the headers of the Vary header of the response.
+	vary     []string
+	variants *variants
+
+	// stored is when the response was received, initialAge its Age header then.
+	stored     clock.Time
+	initialAge time.Duration
+	freshness  freshness
+
+	size int64
+}
+
+// age returns the age of the response at now.
+func (e *entry) age(now clock.Time) time.Duration {
+	age := e.initialAge + now.Sub(e.stored)
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+func (e *entry) hasValidators() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// refresh returns a copy of e updated with the headers of a 304 response received at now.
+func (e *entry) refresh(header http.Header, now clock.Time) *entry {
+	out := *e
+	out.header = e.header.Clone()
+	for k, v := range header {
+		switch k {
+		case "Content-Length", XCache, "Set-Cookie":
+			continue
+		}
+		out.header[k] = append([]string(nil), v...)
+	}
+
+	out.stored = now
+	out.initialAge = ageOf(header)
+	if f, ok := freshnessOf(out.header, now); ok {
+		out.freshness = f
+	} else {
+		out.freshness = freshness{}
+	}
+	out.size = out.computeSize()
+	return &out
+}
+
+// notModified reports whether the conditional headers of req match the stored response.
+func (e *entry) notModified(req *http.Request) bool {
+	if e.status != http.StatusOK || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return false
+	}
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, e.header.Get("ETag"))
+	}
+
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(e.header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
+
+func (e *entry) computeSize() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for k, values := range e.header {
+		for _, v := range values {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size
+}
+
+// varyHeaders returns the canonical names of the headers of the Vary header, sorted as they appear.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" && !contains(names, http.CanonicalHeaderKey(name)) {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// variantKey returns the key of the response of a request with the header, varying on the headers.
+func variantKey(base string, headers []string, h http.Header) string {
+	if len(headers) == 0 {
+		return base
+	}
+
+	var b strings.Builder
+	b.WriteString(base)
+	for _, name := range headers {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(h.Values(name), ","))
+	}
+	return b.String()
+}
+
+func equalHeaders(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// recorder buffers the response of the next handler, up to limit bytes of body.
+// A larger response is written through to w as a MISS, and not stored, as are the responses which are streamed:
+// flushed by the next handler, event streams, or without freshness information. w is nil for the background revalidations.
+type recorder struct {
+	w      http.ResponseWriter
+	header http.Header
+	code   int
+	body   bytes.Buffer
+	limit  int64
+
+	wroteHeader bool
+	// passThrough is set once the response is written through to w.
+	passThrough bool
+}
+
+func newRecorder(w http.ResponseWriter, limit int64) *recorder {
+	return &recorder{w: w, header: make(http.Header), code: http.StatusOK, limit: limit}
+}
+
+func (r *recorder) Header() http.Header {
+	if r.passThrough && r.w != nil {
+		return r.w.Header()
+	}
+	return r.header
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.code = code
+
+	// A 304 is kept to refresh the stored response.
+	if code != http.StatusNotModified && streamed(r.header) {
+		r.startPassThrough()
+	}
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+
+	if r.passThrough {
+		if r.w == nil {
+			return len(p), nil
+		}
+		return r.w.Write(p)
+	}
+
+	if int64(r.body.Len()+len(p)) <= r.limit {
+		return r.body.Write(p)
+	}
+
+	r.startPassThrough()
+	if r.w == nil {
+		return len(p), nil
+	}
+	return r.w.Write(p)
+}
+
+// Flush writes the response through to w, and flushes it.
+// The background revalidations keep buffering the response.
+func (r *recorder) Flush() {
+	if r.w == nil {
+		return
+	}
+
+	r.WriteHeader(http.StatusOK)
+	if !r.passThrough {
+		r.startPassThrough()
+	}
+	if f, ok := r.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// startPassThrough writes the buffered response to w, the rest of the response is written through.
+func (r *recorder) startPassThrough() {
+	r.passThrough = true
+	if r.w != nil {
+		r.writeTo(r.w)
+	}
+	r.body.Reset()
+}
+
+// streamed reports whether a response with the header is streamed rather than stored:
+// an event stream, or a response without freshness information.
+func streamed(h http.Header) bool {
+	if mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil && mediaType == "text/event-stream" {
+		return true
+	}
+	_, ok := freshnessOf(h, clock.Time{})
+	return !ok
+}
+
+// writeTo writes the buffered response to w as a MISS.
+func (r *recorder) writeTo(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range r.header {
+		h[k] = v
+	}
+	h.Set(XCache, Miss)
+	w.WriteHeader(r.code)
+	if r.body.Len() > 0 {
+		_, _ = w.Write(r.body.Bytes())
+	}
+}
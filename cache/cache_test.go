@@ -0,0 +1,429 @@
+package cache
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// backend counts the requests it gets, and records their headers.
+type backend struct {
+	mu       sync.Mutex
+	requests []http.Header
+	handler  http.HandlerFunc
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b.mu.Lock()
+	b.requests = append(b.requests, req.Header.Clone())
+	b.mu.Unlock()
+
+	b.handler(w, req)
+}
+
+func (b *backend) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.requests)
+}
+
+func (b *backend) last() http.Header {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.requests[len(b.requests)-1]
+}
+
+func get(h http.Handler, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com/users?page=2", nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestCache_missThenHit(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	b := &backend{handler: func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=30")
+		_, _ = w.Write([]byte("hello"))
+	}}
+
+	c, err := New(b)
+	require.NoError(t, err)
+
+	rw := get(c)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "hello", rw.Body.String())
+	assert.Equal(t, Miss, rw.Header().Get(XCache))
+
+	clock.Advance(10 * clock.Second)
+	rw = get(c)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "hello", rw.Body.String())
+	assert.Equal(t, Hit, rw.Header().Get(XCache))
+	assert.Equal(t, "10", rw.Header().Get("Age"))
+	assert.Equal(t, "public, max-age=30", rw.Header().Get("Cache-Control"))
+	assert.Equal(t, 1, b.count())
+
+	// Without validators, the stale response is fetched again.
+	clock.Advance(20 * clock.Second)
+	rw = get(c)
+	assert.Equal(t, Miss, rw.Header().Get(XCache))
+	assert.Equal(t, 2, b.count())
+	assert.Empty(t, b.last().Get("If-None-Match"))
+}
+
+func TestCache_staleWhileRevalidate(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	release := make(chan struct{})
+	b := &backend{}
+	b.handler = func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=30, stale-while-revalidate=120")
+		w.Header().Set("ETag", `"v1"`)
+		if b.count() > 1 {
+			<-release
+			w.Header().Set("ETag", `"v2"`)
+			_, _ = w.Write([]byte("v2"))
+			return
+		}
+		_, _ = w.Write([]byte("v1"))
+	}
+
+	c, err := New(b)
+	require.NoError(t, err)
+
+	assert.Equal(t, Miss, get(c).Header().Get(XCache))
+
+	// The stale response is served while a single request revalidates it.
+	clock.Advance(40 * clock.Second)
+	for i := 0; i < 3; i++ {
+		rw := get(c)
+		assert.Equal(t, Stale, rw.Header().Get(XCache))
+		assert.Equal(t, "40", rw.Header().Get("Age"))
+		assert.Equal(t, "v1", rw.Body.String())
+	}
+
+	close(release)
+	c.revalidations.Wait()
+
+	assert.Equal(t, 2, b.count())
+	assert.Equal(t, `"v1"`, b.last().Get("If-None-Match"))
+
+	rw := get(c)
+	assert.Equal(t, Hit, rw.Header().Get(XCache))
+	assert.Equal(t, "0", rw.Header().Get("Age"))
+	assert.Equal(t, "v2", rw.Body.String())
+	assert.Equal(t, 2, b.count())
+
+	// Beyond the stale-while-revalidate window, the response is revalidated before being served.
+	clock.Advance(151 * clock.Second)
+	rw = get(c)
+	assert.Equal(t, Miss, rw.Header().Get(XCache))
+	assert.Equal(t, "v2", rw.Body.String())
+	assert.Equal(t, 3, b.count())
+}
+
+func TestCache_vary(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	b := &backend{handler: func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding")
+		_, _ = w.Write([]byte("encoding=" + req.Header.Get("Accept-Encoding")))
+	}}
+
+	c, err := New(b)
+	require.NoError(t, err)
+
+	assert.Equal(t, Miss, get(c, "Accept-Encoding", "gzip").Header().Get(XCache))
+	assert.Equal(t, Miss, get(c, "Accept-Encoding", "br").Header().Get(XCache))
+
+	rw := get(c, "Accept-Encoding", "gzip")
+	assert.Equal(t, Hit, rw.Header().Get(XCache))
+	assert.Equal(t, "encoding=gzip", rw.Body.String())
+
+	rw = get(c, "Accept-Encoding", "br")
+	assert.Equal(t, Hit, rw.Header().Get(XCache))
+	assert.Equal(t, "encoding=br", rw.Body.String())
+
+	rw = get(c)
+	assert.Equal(t, Miss, rw.Header().Get(XCache))
+	assert.Equal(t, "encoding=", rw.Body.String())
+
+	assert.Equal(t, 3, b.count())
+	assert.Equal(t, 3, c.Len())
+}
+
+func TestCache_revalidateNotModified(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	b := &backend{}
+	b.handler = func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("hello"))
+	}
+
+	c, err := New(b)
+	require.NoError(t, err)
+
+	assert.Equal(t, Miss, get(c).Header().Get(XCache))
+
+	clock.Advance(20 * clock.Second)
+	rw := get(c)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, Hit, rw.Header().Get(XCache))
+	assert.Equal(t, "hello", rw.Body.String())
+	assert.Equal(t, "0", rw.Header().Get("Age"))
+	assert.Equal(t, "max-age=60", rw.Header().Get("Cache-Control"))
+	assert.Equal(t, 2, b.count())
+
+	// The 304 response refreshed the freshness of the stored response.
+	clock.Advance(50 * clock.Second)
+	rw = get(c)
+	assert.Equal(t, Hit, rw.Header().Get(XCache))
+	assert.Equal(t, "hello", rw.Body.String())
+	assert.Equal(t, "50", rw.Header().Get("Age"))
+	assert.Equal(t, 2, b.count())
+}
+
+func TestCache_conditionalClient(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	b := &backend{handler: func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("hello"))
+	}}
+
+	c, err := New(b)
+	require.NoError(t, err)
+
+	get(c)
+
+	rw := get(c, "If-None-Match", `W/"v0", "v1"`)
+	assert.Equal(t, http.StatusNotModified, rw.Code)
+	assert.Equal(t, Hit, rw.Header().Get(XCache))
+	assert.Empty(t, rw.Body.String())
+
+	rw = get(c, "If-None-Match", `"v0"`)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "hello", rw.Body.String())
+	assert.Equal(t, 1, b.count())
+}
+
+func TestCache_bypass(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	b := &backend{handler: func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("hello"))
+	}}
+
+	c, err := New(b)
+	require.NoError(t, err)
+
+	rw := get(c, "Authorization", "Bearer token")
+	assert.Empty(t, rw.Header().Get(XCache))
+	rw = get(c, "Authorization", "Bearer token")
+	assert.Empty(t, rw.Header().Get(XCache))
+	assert.Equal(t, 2, b.count())
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "http://api.example.com/users?page=2", nil))
+	assert.Empty(t, rw.Header().Get(XCache))
+	assert.Equal(t, 3, b.count())
+	assert.Zero(t, c.Len())
+
+	c, err = New(b, CacheAuthorized(true))
+	require.NoError(t, err)
+
+	get(c, "Authorization", "Bearer token")
+	assert.Equal(t, Hit, get(c, "Authorization", "Bearer token").Header().Get(XCache))
+}
+
+func TestCache_notStored(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	testCases := []struct {
+		desc   string
+		header http.Header
+		status int
+	}{
+		{desc: "private", header: http.Header{"Cache-Control": {"private, max-age=60"}}},
+		{desc: "no-store", header: http.Header{"Cache-Control": {"no-store"}}},
+		{desc: "no freshness", header: http.Header{}},
+		{desc: "event stream", header: http.Header{"Cache-Control": {"max-age=60"}, "Content-Type": {"text/event-stream"}}},
+		{desc: "no-cache without validators", header: http.Header{"Cache-Control": {"no-cache"}}},
+		{desc: "set-cookie", header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}}},
+		{desc: "vary all", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}},
+		{desc: "status", header: http.Header{"Cache-Control": {"max-age=60"}}, status: http.StatusInternalServerError},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			b := &backend{handler: func(w http.ResponseWriter, _ *http.Request) {
+				for k, v := range test.header {
+					w.Header()[k] = v
+				}
+				if test.status != 0 {
+					w.WriteHeader(test.status)
+				}
+				_, _ = w.Write([]byte("hello"))
+			}}
+
+			c, err := New(b)
+			require.NoError(t, err)
+
+			assert.Equal(t, Miss, get(c).Header().Get(XCache))
+			assert.Equal(t, Miss, get(c).Header().Get(XCache))
+			assert.Equal(t, 2, b.count())
+			assert.Zero(t, c.Len())
+		})
+	}
+}
+
+func TestCache_storeSetCookie(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	b := &backend{handler: func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Set-Cookie", "session=1")
+		_, _ = w.Write([]byte("hello"))
+	}}
+
+	c, err := New(b, StoreSetCookie(true))
+	require.NoError(t, err)
+
+	rw := get(c)
+	assert.Equal(t, "session=1", rw.Header().Get("Set-Cookie"))
+
+	rw = get(c)
+	assert.Equal(t, Hit, rw.Header().Get(XCache))
+	assert.Empty(t, rw.Header().Get("Set-Cookie"))
+}
+
+func TestCache_maxBodyBytes(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	body := strings.Repeat("a", 100)
+	b := &backend{handler: func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		for i := 0; i < 10; i++ {
+			_, _ = w.Write([]byte(body[i*10 : (i+1)*10]))
+		}
+	}}
+
+	c, err := New(b, MaxBodyBytes(64))
+	require.NoError(t, err)
+
+	rw := get(c)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, body, rw.Body.String())
+	assert.Equal(t, Miss, rw.Header().Get(XCache))
+	assert.Equal(t, "max-age=60", rw.Header().Get("Cache-Control"))
+	assert.Zero(t, c.Len())
+}
+
+func TestCache_flush(t *testing.T) {
+	release := make(chan struct{})
+	b := &backend{handler: func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+
+		<-release
+		_, _ = w.Write([]byte("data: 2\n\n"))
+	}}
+
+	c, err := New(b)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+	var once sync.Once
+	t.Cleanup(func() { once.Do(func() { close(release) }) })
+
+	// The client gives up if the chunk is held until the handler returns.
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	assert.Equal(t, Miss, resp.Header.Get(XCache))
+
+	// The flushed chunk reaches the client before the handler returns.
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: 1\n", line)
+
+	once.Do(func() { close(release) })
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "\ndata: 2\n\n", string(rest))
+	assert.Zero(t, c.Len())
+}
+
+func TestCache_eviction(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	b := &backend{handler: func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(req.URL.Path + strings.Repeat(".", 40)))
+	}}
+
+	c, err := New(b, MaxEntries(2))
+	require.NoError(t, err)
+
+	serve := func(path string) string {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://api.example.com"+path, nil))
+		return rw.Header().Get(XCache)
+	}
+
+	serve("/a")
+	serve("/b")
+	assert.Equal(t, Hit, serve("/a"))
+
+	// /b is the least recently used.
+	serve("/c")
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, Hit, serve("/a"))
+	assert.Equal(t, Miss, serve("/b"))
+
+	// The byte budget holds a single response.
+	c, err = New(b, MaxBytes(100))
+	require.NoError(t, err)
+
+	serve("/a")
+	serve("/b")
+	assert.Equal(t, 1, c.Len())
+	assert.Equal(t, Hit, serve("/b"))
+	assert.Equal(t, Miss, serve("/a"))
+}
+
+func TestCache_invalidOptions(t *testing.T) {
+	for _, opt := range []Option{MaxEntries(0), MaxBodyBytes(-1), MaxBytes(0), Key(nil), Clock(nil), Methods()} {
+		_, err := New(nil, opt)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// cacheControl holds the directives of the Cache-Control headers, by lowercased name.
+// The directives without argument have an empty value.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the argument of the directive as a duration, if it is present and valid.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * clock.Second, true
+}
+
+// freshness is the freshness of a stored response.
+type freshness struct {
+	// lifetime is how long the response is fresh from its generation.
+	lifetime time.Duration
+	// staleWhileRevalidate is how long the response can be served stale while it is revalidated.
+	staleWhileRevalidate time.Duration
+}
+
+// freshnessOf returns the freshness of a response received at now, and false when the response
+// has no explicit freshness (the responses are not stored on heuristics).
+// The s-maxage and max-age directives take precedence over the Expires header.
+// A response with no-cache is stale as soon as it is stored: it is revalidated on every request.
+func freshnessOf(h http.Header, now clock.Time) (freshness, bool) {
+	cc := parseCacheControl(h)
+
+	if cc.has("no-cache") {
+		return freshness{}, true
+	}
+
+	var f freshness
+	if maxAge, ok := cc.seconds("s-maxage"); ok {
+		f.lifetime = maxAge
+	} else if maxAge, ok = cc.seconds("max-age"); ok {
+		f.lifetime = maxAge
+	} else if expires := h.Get("Expires"); expires != "" {
+		f.lifetime = expiresLifetime(expires, h.Get("Date"), now)
+	} else {
+		return freshness{}, false
+	}
+
+	if !cc.has("must-revalidate") && !cc.has("proxy-revalidate") {
+		f.staleWhileRevalidate, _ = cc.seconds("stale-while-revalidate")
+	}
+	return f, true
+}
+
+// expiresLifetime returns the lifetime of a response from its Expires and Date headers.
+// An invalid Expires header means that the response is already expired.
+func expiresLifetime(expires, date string, now clock.Time) time.Duration {
+	t, err := http.ParseTime(expires)
+	if err != nil {
+		return 0
+	}
+
+	generated := now
+	if d, err := http.ParseTime(date); err == nil {
+		generated = d
+	}
+
+	if lifetime := t.Sub(generated); lifetime > 0 {
+		return lifetime
+	}
+	return 0
+}
+
+// ageOf returns the value of the Age header, the age of the response when it was received.
+func ageOf(h http.Header) time.Duration {
+	age, err := strconv.ParseInt(strings.TrimSpace(h.Get("Age")), 10, 64)
+	if err != nil || age < 0 {
+		return 0
+	}
+	return time.Duration(age) * clock.Second
+}
+
+// etagMatches reports whether the If-None-Match header value matches etag, with the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// Option is a functional option setter for Cache.
+type Option func(*Cache) error
+
+// MaxEntries sets the maximum number of responses stored, 10000 by default.
+// The least recently used responses are evicted first.
+func MaxEntries(n int) Option {
+	return func(c *Cache) error {
+		if n <= 0 {
+			return fmt.Errorf("max entries should be > 0, got %d", n)
+		}
+		c.maxEntries = n
+		return nil
+	}
+}
+
+// MaxBodyBytes sets the maximum size of the body of a stored response, 1MB by default.
+// The larger responses are passed through to the client as they are written, without being stored.
+func MaxBodyBytes(n int64) Option {
+	return func(c *Cache) error {
+		if n <= 0 {
+			return fmt.Errorf("max body bytes should be > 0, got %d", n)
+		}
+		c.maxBodyBytes = n
+		return nil
+	}
+}
+
+// MaxBytes sets the byte budget of the stored responses, bodies, headers and keys included, 64MB by default.
+// The least recently used responses are evicted first.
+func MaxBytes(n int64) Option {
+	return func(c *Cache) error {
+		if n <= 0 {
+			return fmt.Errorf("max bytes should be > 0, got %d", n)
+		}
+		c.maxBytes = n
+		return nil
+	}
+}
+
+// Key sets the function returning the key of the responses of a request,
+// by default its method, host and URI, e.g. "GET api.example.com/users?page=2".
+// The values of the headers listed in the Vary header of a stored response are added to its key.
+func Key(key func(*http.Request) string) Option {
+	return func(c *Cache) error {
+		if key == nil {
+			return errors.New("key function can't be nil")
+		}
+		c.key = key
+		return nil
+	}
+}
+
+// Clock sets the function returning the current time, from which the freshness and the Age of the responses
+// are computed, clock.Now by default.
+func Clock(now func() clock.Time) Option {
+	return func(c *Cache) error {
+		if now == nil {
+			return errors.New("clock can't be nil")
+		}
+		c.now = now
+		return nil
+	}
+}
+
+// Methods sets the methods of the requests whose responses are stored, GET and HEAD by default.
+// The requests with other methods bypass the cache.
+func Methods(methods ...string) Option {
+	return func(c *Cache) error {
+		if len(methods) == 0 {
+			return errors.New("at least one method is required")
+		}
+		c.methods = make(map[string]bool, len(methods))
+		for _, m := range methods {
+			c.methods[strings.ToUpper(m)] = true
+		}
+		return nil
+	}
+}
+
+// CacheAuthorized lets the requests with an Authorization header use the cache, they bypass it by default.
+// The Key should then tell the clients apart, unless the responses are the same for all of them.
+func CacheAuthorized(cache bool) Option {
+	return func(c *Cache) error {
+		c.cacheAuthorized = cache
+		return nil
+	}
+}
+
+// StoreSetCookie stores the responses with a Set-Cookie header, without the header:
+// the cookies are only sent to the client of the request which got the response from the next handler.
+// By default, the responses with a Set-Cookie header are not stored.
+func StoreSetCookie(store bool) Option {
+	return func(c *Cache) error {
+		c.storeSetCookie = store
+		return nil
+	}
+}
+
+// Logger defines the logger used by Cache.
+func Logger(l utils.Logger) Option {
+	return func(c *Cache) error {
+		c.log = l
+		return nil
+	}
+}
@@ -22,14 +22,38 @@
 //
 // * OnTripped action is called on transition (Standby -> Tripped)
 // * OnStandby action is called on transition (Recovering -> Standby)
+//
+// With a Classifier, requests are bucketed into classes (e.g. per path) that have their own metrics and state:
+// the condition is evaluated per class, and the fallback only applies to the requests of a tripped class.
+//
+// With AdaptiveShedding, a fraction of the requests is sent to the fallback in the Standby state when the metric of
+// the condition gets close to the trip threshold, which often prevents the trip.
+//
+// With FallbackChain, the fallback handlers are tried in order until one of them answers successfully,
+// e.g. a read-only replica, then a static response.
+//
+// The responses of the fallback carry a Retry-After header with the seconds left in the Tripped or Recovering state,
+// unless the fallback sets its own. FallbackStatusOverride replaces their status code, e.g. with 429.
+// The responses of the fallback have their own metrics, see FallbackErrorRatio, and OnFallbackUnhealthy alerts
+// when the fallback fails too while the circuit breaker is tripped.
+//
+// With GracePeriod and RequireMetricsReady, the condition can't trip a cold circuit breaker, e.g. right after a deploy.
+//
+// Every transition can also be recorded with EventLog or OnEvent, e.g. to build a timeline after an incident.
+//
+// When a proxy instance is replaced, ExportState and WithInitialState hand the state and the metrics over
+// to the new instance, so that a tripped circuit breaker does not start again in the Standby state.
 package cbreaker
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/vulcand/oxy/v2/forward"
 	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
 	"github.com/vulcand/oxy/v2/memmetrics"
 	"github.com/vulcand/oxy/v2/utils"
@@ -39,8 +63,13 @@ import (
 type CircuitBreaker struct {
 	m       *sync.RWMutex
 	metrics *memmetrics.RTMetrics
+	// errorClassifier decides which responses are network errors, nil means the memmetrics default.
+	errorClassifier memmetrics.ErrorClassifier
+	// ignoredStatuses are the status codes not recorded in the metrics, see IgnoreStatuses.
+	ignoredStatuses map[int]struct{}
 
-	condition hpredicate
+	condition  hpredicate
+	expression string
 
 	fallbackDuration time.Duration
 	recoveryDuration time.Duration
@@ -53,17 +82,54 @@ type CircuitBreaker struct {
 
 	rc *ratioController
 
+	// sheddingOptions are set by AdaptiveShedding, shedding is built from them and the condition.
+	sheddingOptions *SheddingOptions
+	shedding        *shedding
+	shedFraction    float64
+	// shedCredit accumulates the shed fraction of the requests, a request is shed every time it reaches shedScale.
+	shedCredit int64
+
 	checkPeriod time.Duration
 	lastCheck   clock.Time
 
-	fallback http.Handler
-	next     http.Handler
+	// started is when the circuit breaker was created or Reset, the grace period starts then, see GracePeriod.
+	started             clock.Time
+	gracePeriod         time.Duration
+	requireMetricsReady bool
+	// gate returns false while the condition can't trip the circuit breaker, see ConditionGate.
+	gate func(now time.Time) bool
+
+	// fallbacks is the fallback chain, see FallbackChain.
+	fallbacks           []http.Handler
+	fallbackLinkTimeout time.Duration
+	// fallbackStatus replaces the status code of the fallback responses, see FallbackStatusOverride.
+	fallbackStatus int
+	// fallbackMetrics records the responses of the fallback, apart from metrics, see FallbackErrorRatio.
+	fallbackMetrics *memmetrics.RTMetrics
+	fallbackHealth  *fallbackHealth
+	fallbackEpisode fallbackEpisode
+	next            http.Handler
+
+	classifier func(*http.Request) string
+	maxClasses int
+	classes    *classes
+	// class is the name of the class of requests tracked by this circuit breaker, see Classifier.
+	class string
+
+	name         string
+	eventWriter  io.Writer
+	eventHandler func(Event)
+	events       *eventDispatcher
+
+	// initialState is restored by New, see WithInitialState.
+	initialState *StateSnapshot
 
 	verbose bool
 	log     utils.Logger
 }
 
 // New creates a new CircuitBreaker middleware.
+// next can be nil, and set later with Wrap.
 func New(next http.Handler, expression string, options ...Option) (*CircuitBreaker, error) {
 	cb := &CircuitBreaker{
 		m:    &sync.RWMutex{},
@@ -72,7 +138,9 @@ func New(next http.Handler, expression string, options ...Option) (*CircuitBreak
 		checkPeriod:      defaultCheckPeriod,
 		fallbackDuration: defaultFallbackDuration,
 		recoveryDuration: defaultRecoveryDuration,
-		fallback:         defaultFallback,
+		fallbacks:        []http.Handler{defaultFallback},
+		maxClasses:       defaultMaxClasses,
+		started:          clock.Now(),
 		log:              &utils.NoopLogger{},
 	}
 
@@ -87,46 +155,97 @@ func New(next http.Handler, expression string, options ...Option) (*CircuitBreak
 		return nil, err
 	}
 	cb.condition = condition
+	cb.expression = expression
 
-	mt, err := memmetrics.NewRTMetrics()
+	if cb.sheddingOptions != nil {
+		cb.shedding, err = newShedding(*cb.sheddingOptions, expression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cb.eventWriter != nil || cb.eventHandler != nil {
+		cb.events = newEventDispatcher(cb.eventWriter, cb.eventHandler, cb.log)
+	}
+
+	if cb.classifier != nil {
+		cb.classes = newClasses(cb.maxClasses)
+	}
+
+	mt, err := cb.newMetrics()
 	if err != nil {
 		return nil, err
 	}
 	cb.metrics = mt
 
+	cb.fallbackMetrics, err = newFallbackMetrics()
+	if err != nil {
+		return nil, err
+	}
+
+	if cb.initialState != nil {
+		if err := cb.restoreState(*cb.initialState); err != nil {
+			return nil, fmt.Errorf("invalid initial state: %w", err)
+		}
+	}
+
 	return cb, nil
 }
 
+func (c *CircuitBreaker) newMetrics() (*memmetrics.RTMetrics, error) {
+	if c.errorClassifier == nil {
+		return memmetrics.NewRTMetrics()
+	}
+	return memmetrics.NewRTMetrics(memmetrics.RTErrorClassifier(c.errorClassifier))
+}
+
 func (c *CircuitBreaker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if c.verbose {
+	if c.verbose && utils.DebugEnabled(c.log) {
 		dump := utils.DumpHTTPRequest(req)
 		c.log.Debug("vulcand/oxy/circuitbreaker: begin ServeHttp on request: %s", dump)
 		defer c.log.Debug("vulcand/oxy/circuitbreaker: completed ServeHttp on request: %s", dump)
 	}
 
-	if c.activateFallback(w, req) {
-		c.fallback.ServeHTTP(w, req)
+	if c.next == nil {
+		utils.ServeError(nil, w, req, "circuitbreaker", &utils.ErrNotWired{Middleware: "circuitbreaker"})
+		return
+	}
+
+	cb := c.classOf(req)
+
+	if cb.shed() {
+		c.serveFallback(w, req, cb)
+		return
+	}
+
+	if until, ok := cb.activateFallback(w, req); ok {
+		c.serveFallback(w, req.WithContext(withRetryAt(req.Context(), until)), cb)
 		return
 	}
 
-	c.serve(w, req)
+	c.serve(w, req, cb)
 }
 
-// Fallback sets the fallback handler to be called by circuit breaker handler.
+// Fallback sets the fallback handler to be called by circuit breaker handler, in place of the fallback chain.
 func (c *CircuitBreaker) Fallback(f http.Handler) {
-	c.fallback = f
+	c.fallbacks = []http.Handler{f}
 }
 
-// Wrap sets the next handler to be called by circuit breaker handler.
-func (c *CircuitBreaker) Wrap(next http.Handler) {
+// Wrap sets the next handler to be called by circuit breaker handler, when it was created without.
+func (c *CircuitBreaker) Wrap(next http.Handler) error {
+	if err := utils.CheckWrap(c.next, next); err != nil {
+		return err
+	}
 	c.next = next
+	return nil
 }
 
-// updateState updates internal state and returns true if fallback should be used and false otherwise.
-func (c *CircuitBreaker) activateFallback(_ http.ResponseWriter, _ *http.Request) bool {
+// activateFallback updates internal state and returns true if fallback should be used and false otherwise.
+// When the fallback is used, it also returns the time until which the circuit breaker is expected to stay in the current state.
+func (c *CircuitBreaker) activateFallback(_ http.ResponseWriter, _ *http.Request) (clock.Time, bool) {
 	// Quick check with read locks optimized for normal operation use-case
 	if c.isStandby() {
-		return false
+		return clock.Time{}, false
 	}
 	// Circuit breaker is in tripped or recovering state
 	c.m.Lock()
@@ -137,10 +256,10 @@ func (c *CircuitBreaker) activateFallback(_ http.ResponseWriter, _ *http.Request
 	switch c.state {
 	case stateStandby:
 		// someone else has set it to standby just now
-		return false
+		return clock.Time{}, false
 	case stateTripped:
 		if clock.Now().UTC().Before(c.until) {
-			return true
+			return c.until, true
 		}
 		// We have been in active state enough, enter recovering state
 		c.setRecovering()
@@ -149,29 +268,58 @@ func (c *CircuitBreaker) activateFallback(_ http.ResponseWriter, _ *http.Request
 		// We have been in recovering state enough, enter standby and allow request
 		if clock.Now().UTC().After(c.until) {
 			c.setState(stateStandby, clock.Now().UTC())
-			return false
+			return clock.Time{}, false
 		}
 		// ratio controller allows this request
 		if c.rc.allowRequest() {
-			return false
+			return clock.Time{}, false
 		}
-		return true
+		return c.until, true
 	}
-	return false
+	return clock.Time{}, false
 }
 
-func (c *CircuitBreaker) serve(w http.ResponseWriter, req *http.Request) {
-	start := clock.Now().UTC()
+// serve calls the next handler and records the response in the metrics of the class of the request.
+// The hijacked connections (e.g. websockets) and the ignored status codes are not recorded:
+// their status code and latency do not tell anything about the health of the upstream.
+// The requests served by the fallback (including the shed ones) never reach serve,
+// so the circuit breaker does not record its own responses.
+// The panics of the next handler are recorded as 500 responses, and panicked again for the outer middlewares to handle.
+func (c *CircuitBreaker) serve(w http.ResponseWriter, req *http.Request, class *CircuitBreaker) {
+	start := clock.Now()
 	p := utils.NewProxyWriterWithLogger(w, c.log)
 
+	req = req.WithContext(forward.WithErrorCapture(req.Context()))
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if !p.Hijacked() {
+				c.record(req, class, http.StatusInternalServerError, clock.Since(start))
+			}
+			panic(recovered)
+		}
+	}()
+
 	c.next.ServeHTTP(p, req)
 
-	latency := clock.Now().UTC().Sub(start)
-	c.metrics.Record(p.StatusCode(), latency)
+	if p.Hijacked() {
+		return
+	}
+
+	c.record(req, class, p.StatusCode(), clock.Since(start))
+}
+
+// record records the response in the metrics of the class of the request, unless its status code is ignored.
+func (c *CircuitBreaker) record(req *http.Request, class *CircuitBreaker, code int, latency time.Duration) {
+	if _, ok := c.ignoredStatuses[code]; ok {
+		return
+	}
+
+	class.metrics.RecordWithError(code, forward.ErrorFromContext(req.Context()), latency)
 
 	// Note that this call is less expensive than it looks -- checkCondition only performs the real check
 	// periodically. Because of that we can afford to call it here on every single response.
-	c.checkAndSet()
+	class.checkAndSet()
 }
 
 func (c *CircuitBreaker) isStandby() bool {
@@ -182,11 +330,16 @@ func (c *CircuitBreaker) isStandby() bool {
 
 // String returns log-friendly representation of the circuit breaker state.
 func (c *CircuitBreaker) String() string {
+	var class string
+	if c.class != "" {
+		class = fmt.Sprintf("class=%s, ", c.class)
+	}
+
 	switch c.state {
 	case stateTripped, stateRecovering:
-		return fmt.Sprintf("CircuitBreaker(state=%v, until=%v)", c.state, c.until)
+		return fmt.Sprintf("CircuitBreaker(%sstate=%v, until=%v)", class, c.state, c.until)
 	default:
-		return fmt.Sprintf("CircuitBreaker(state=%v)", c.state)
+		return fmt.Sprintf("CircuitBreaker(%sstate=%v)", class, c.state)
 	}
 }
 
@@ -204,6 +357,10 @@ func (c *CircuitBreaker) exec(s SideEffect) {
 
 func (c *CircuitBreaker) setState(state cbState, until time.Time) {
 	c.log.Debug("%v setting state to %v, until %v", c, state, until)
+	c.emit(c.state, state)
+	if c.state == stateStandby && state == stateTripped {
+		c.fallbackEpisode = fallbackEpisode{}
+	}
 	c.state = state
 	c.until = until
 	switch state {
@@ -240,12 +397,84 @@ func (c *CircuitBreaker) checkAndSet() {
 		return
 	}
 
-	if !c.condition(c) {
+	if c.warming() {
+		return
+	}
+
+	if c.suppressed() || !c.condition(c) {
+		c.updateShedFraction()
 		return
 	}
 
 	c.setState(stateTripped, clock.Now().UTC().Add(c.fallbackDuration))
 	c.metrics.Reset()
+	c.updateShedFraction()
+}
+
+// warming reports whether the condition can't trip the circuit breaker yet, see GracePeriod and RequireMetricsReady.
+// It must be called with the lock held.
+func (c *CircuitBreaker) warming() bool {
+	if c.gracePeriod > 0 && clock.Since(c.started) < c.gracePeriod {
+		return true
+	}
+	return c.requireMetricsReady && c.state == stateStandby && !c.metrics.IsReady()
+}
+
+// Reset forgets the metrics and the state of the circuit breaker, and of its classes:
+// they go back to the Standby state, and their grace period starts again, see GracePeriod.
+func (c *CircuitBreaker) Reset() {
+	if c.classifier != nil {
+		for _, cb := range c.classes.all() {
+			cb.reset()
+		}
+	}
+	c.reset()
+}
+
+func (c *CircuitBreaker) reset() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.state != stateStandby {
+		c.setState(stateStandby, clock.Now().UTC())
+	}
+	c.metrics.Reset()
+	c.fallbackMetrics.Reset()
+	c.started = clock.Now()
+	c.lastCheck = clock.Time{}
+	c.shedFraction = 0
+	c.shedCredit = 0
+}
+
+// LoadFactor returns the fraction of the traffic the circuit breaker lets through: 1 in the Standby state,
+// 0 in the Tripped state, and the progress of the recovery in the Recovering state, from 0 to 1.
+// With a Classifier, it is the lowest factor of the classes.
+// It can tighten a rate limiter in front of the circuit breaker, see ratelimit.AdaptiveScale.
+func (c *CircuitBreaker) LoadFactor() float64 {
+	factor := c.loadFactor()
+	if c.classifier != nil {
+		for _, cb := range c.classes.all() {
+			factor = math.Min(factor, cb.loadFactor())
+		}
+	}
+	return factor
+}
+
+func (c *CircuitBreaker) loadFactor() float64 {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	switch c.state {
+	case stateTripped:
+		return 0
+	case stateRecovering:
+		left := c.until.Sub(clock.Now().UTC())
+		if left <= 0 || c.recoveryDuration <= 0 {
+			return 1
+		}
+		return math.Max(0, 1-float64(left)/float64(c.recoveryDuration))
+	}
+	return 1
 }
 
 func (c *CircuitBreaker) setRecovering() {
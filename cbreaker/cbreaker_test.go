@@ -1,17 +1,22 @@
 package cbreaker
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/buffer"
+	"github.com/vulcand/oxy/v2/forward"
 	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
 	"github.com/vulcand/oxy/v2/memmetrics"
 	"github.com/vulcand/oxy/v2/testutils"
@@ -332,3 +337,521 @@ type statusCode struct {
 	Code  int
 	Count int64
 }
+
+func TestCircuitBreaker_networkErrorClassifier(t *testing.T) {
+	fwd := forward.New(false)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/dial" {
+			req.URL = testutils.MustParseRequestURI("http://localhost:63450")
+			fwd.ServeHTTP(w, req)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	onlyDial := func(_ int, err error) bool {
+		return forward.ErrorKind(err) == forward.KindDial
+	}
+
+	cb, err := New(handler, triggerNetRatio, NetworkErrorClassifier(onlyDial))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	re, _, err := testutils.Get(srv.URL + "/plain")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, int64(0), cb.metrics.NetworkErrorCount())
+
+	re, _, err = testutils.Get(srv.URL + "/dial")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, int64(1), cb.metrics.NetworkErrorCount())
+	assert.Equal(t, int64(2), cb.metrics.TotalCount())
+
+	_, err = New(handler, triggerNetRatio, NetworkErrorClassifier(nil))
+	require.Error(t, err)
+}
+
+func TestCircuitBreaker_recoveryRecordsPassThroughOnly(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	cb, err := New(handler, triggerNetRatio)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	cb.metrics = statsNetErrors(0.6)
+	clock.Advance(defaultCheckPeriod + clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, cbState(stateTripped), cb.state)
+
+	// enters the recovering state, then lets some requests pass.
+	clock.Advance(defaultFallbackDuration + clock.Millisecond)
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	clock.Advance(5 * clock.Second)
+
+	passed, fallback := 0, 0
+	for i := 0; i < 100; i++ {
+		re, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		switch re.StatusCode {
+		case http.StatusOK:
+			passed++
+		case http.StatusServiceUnavailable:
+			fallback++
+		}
+	}
+	require.Equal(t, cbState(stateRecovering), cb.state)
+	assert.NotZero(t, passed)
+	assert.NotZero(t, fallback)
+
+	// the fallback responses are not recorded.
+	assert.Equal(t, int64(passed), cb.metrics.TotalCount())
+	assert.Equal(t, map[int]int64{http.StatusOK: int64(passed)}, cb.metrics.StatusCodesCounts())
+}
+
+func TestCircuitBreaker_hijackedNotRecorded(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// the connection lives longer than any regular response.
+		clock.Advance(clock.Minute)
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+		_ = conn.Close()
+	})
+
+	testutils.FreezeTime(t)
+
+	cb, err := New(handler, triggerNetRatio)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	rw := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+	cb.ServeHTTP(rw, req)
+	require.True(t, rw.hijacked)
+
+	assert.Equal(t, int64(0), cb.metrics.TotalCount())
+	assert.Empty(t, cb.metrics.StatusCodesCounts())
+
+	hist, err := cb.metrics.LatencyHistogram()
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), hist.LatencyAtQuantile(100))
+}
+
+func TestCircuitBreaker_wallClockStep(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// The wall clock goes back an hour, e.g. an NTP correction, while the request is served.
+		clock.Advance(100 * clock.Millisecond)
+		clock.StepWall(-clock.Hour)
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	cb, err := New(handler, triggerNetRatio)
+	require.NoError(t, err)
+
+	cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, int64(1), cb.metrics.TotalCount())
+
+	hist, err := cb.metrics.LatencyHistogram()
+	require.NoError(t, err)
+	assert.InDelta(t, 100*clock.Millisecond, hist.LatencyAtQuantile(100), float64(clock.Millisecond))
+}
+
+func TestCircuitBreaker_ignoreStatuses(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	cb, err := New(handler, triggerNetRatio, IgnoreStatuses(http.StatusSwitchingProtocols, http.StatusNoContent))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	re, _, err := testutils.Get(srv.URL + "/empty")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	assert.Equal(t, int64(1), cb.metrics.TotalCount())
+	assert.Equal(t, map[int]int64{http.StatusOK: 1}, cb.metrics.StatusCodesCounts())
+
+	_, err = New(handler, triggerNetRatio, IgnoreStatuses(http.StatusNoContent, 42))
+	require.Error(t, err)
+}
+
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+
+	hijacked bool
+}
+
+func (r *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	server, client := net.Pipe()
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func TestCircuitBreaker_networkErrorRatio(t *testing.T) {
+	failing := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	t.Cleanup(failing.Close)
+
+	// A backend answering with both a Content-Length and a Transfer-Encoding, the response is forwarded anyway.
+	framing := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:       http.StatusOK,
+			Header:           http.Header{"Content-Length": {"5"}, "Transfer-Encoding": {"chunked"}},
+			TransferEncoding: []string{"chunked"},
+			ContentLength:    -1,
+			Body:             io.NopCloser(strings.NewReader("hello")),
+			Request:          req,
+		}, nil
+	})
+
+	testCases := []struct {
+		desc     string
+		target   string
+		rt       http.RoundTripper
+		code     int
+		expected float64
+	}{
+		{desc: "backend 500", target: failing.URL, code: http.StatusInternalServerError, expected: 0},
+		{desc: "closed port", target: "http://localhost:63450", code: http.StatusBadGateway, expected: 1},
+		{desc: "framing mismatch", target: "http://localhost:63450", rt: framing, code: http.StatusOK, expected: 0},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			fwd := forward.New(false)
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req = req.WithContext(forward.WithRoundTripper(req.Context(), test.rt))
+				req.URL = testutils.MustParseRequestURI(test.target)
+				fwd.ServeHTTP(w, req)
+			})
+
+			// The condition never fires: the metrics are not reset.
+			cb, err := New(handler, "NetworkErrorRatio() > 1.0")
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(cb)
+			t.Cleanup(srv.Close)
+
+			for i := 0; i < 3; i++ {
+				re, _, err := testutils.Get(srv.URL)
+				require.NoError(t, err)
+				assert.Equal(t, test.code, re.StatusCode)
+			}
+
+			assert.Equal(t, int64(3), cb.metrics.TotalCount())
+			assert.Equal(t, test.expected, cb.metrics.NetworkErrorRatio())
+
+			// Only the network errors trip the circuit breaker.
+			cb, err = New(handler, triggerNetRatio)
+			require.NoError(t, err)
+
+			tripped := httptest.NewServer(cb)
+			t.Cleanup(tripped.Close)
+
+			codes := make([]int, 3)
+			for i := range codes {
+				re, _, err := testutils.Get(tripped.URL)
+				require.NoError(t, err)
+				codes[i] = re.StatusCode
+			}
+
+			if test.expected == 0 {
+				assert.Equal(t, []int{test.code, test.code, test.code}, codes)
+			} else {
+				assert.Equal(t, []int{test.code, http.StatusServiceUnavailable, http.StatusServiceUnavailable}, codes)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker_panic(t *testing.T) {
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	})
+
+	cb, err := New(handler, triggerNetRatio)
+	require.NoError(t, err)
+
+	// The buffer answers 500 to the panic, once recorded by the circuit breaker.
+	st, err := buffer.New(cb)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(st)
+	t.Cleanup(srv.Close)
+
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+
+	assert.Equal(t, int64(1), cb.metrics.TotalCount())
+	assert.Equal(t, map[int]int64{http.StatusInternalServerError: 1}, cb.metrics.StatusCodesCounts())
+	assert.Equal(t, int64(0), cb.metrics.NetworkErrorCount())
+
+	// The panic is not swallowed.
+	assert.PanicsWithValue(t, "boom", func() {
+		cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+	assert.Equal(t, int64(2), cb.metrics.TotalCount())
+}
+
+func TestCircuitBreaker_fallbackRetryAfter(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	cb, err := New(handler, triggerNetRatio, RecoveryDuration(4*clock.Second))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	cb.metrics = statsNetErrors(0.6)
+	clock.Advance(defaultCheckPeriod + clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, cbState(stateTripped), cb.state)
+
+	// The delay is the time left in the fallback.
+	clock.Advance(3 * clock.Second)
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, "7", re.Header.Get("Retry-After"))
+
+	// While recovering, the delay is the time left in the recovery.
+	clock.Advance(7*clock.Second + clock.Millisecond)
+	re, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, cbState(stateRecovering), cb.state)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, "4", re.Header.Get("Retry-After"))
+}
+
+func TestCircuitBreaker_fallbackRetryAfterRedirect(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	fallbackRedirect, err := NewRedirectFallback(Redirect{URL: "http://localhost:5000"})
+	require.NoError(t, err)
+
+	cb, err := New(handler, triggerNetRatio, Fallback(fallbackRedirect))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	cb.metrics = statsNetErrors(0.6)
+	clock.Advance(defaultCheckPeriod + clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	clock.Advance(3 * clock.Second)
+
+	client := &http.Client{
+		CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+			return errors.New("no redirects")
+		},
+	}
+
+	re, err := client.Get(srv.URL)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusFound, re.StatusCode)
+	assert.Equal(t, "7", re.Header.Get("Retry-After"))
+}
+
+func TestCircuitBreaker_fallbackStatusOverride(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	cb, err := New(handler, triggerNetRatio, FallbackStatusOverride(http.StatusTooManyRequests))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	// The requests passed through are not changed.
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	cb.metrics = statsNetErrors(0.6)
+	clock.Advance(defaultCheckPeriod + clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "10", re.Header.Get("Retry-After"))
+	assert.Equal(t, http.StatusText(http.StatusServiceUnavailable), string(body))
+
+	_, err = New(handler, triggerNetRatio, FallbackStatusOverride(42))
+	require.Error(t, err)
+}
+
+func TestCircuitBreaker_gracePeriod(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	cb, err := New(handler, triggerNetRatio, GracePeriod(5*clock.Second))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	cb.metrics = statsNetErrors(1.0)
+
+	// The condition matches, but the circuit breaker is warming for 5s.
+	for elapsed := clock.Duration(0); elapsed < 4*clock.Second; elapsed += defaultCheckPeriod + clock.Millisecond {
+		re, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, re.StatusCode)
+		clock.Advance(defaultCheckPeriod + clock.Millisecond)
+	}
+	assert.Equal(t, cbState(stateStandby), cb.state)
+	assert.Equal(t, []Status{{State: "warming"}}, cb.Status())
+
+	cb.metrics = statsNetErrors(1.0)
+	clock.Advance(clock.Second + defaultCheckPeriod)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), cb.state)
+
+	// Reset starts the grace period again.
+	cb.Reset()
+	assert.Equal(t, []Status{{State: "warming"}}, cb.Status())
+
+	cb.metrics = statsNetErrors(1.0)
+	clock.Advance(4 * clock.Second)
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, cbState(stateStandby), cb.state)
+
+	clock.Advance(clock.Second)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), cb.state)
+}
+
+func TestCircuitBreaker_requireMetricsReady(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	testutils.FreezeTime(t)
+
+	cb, err := New(handler, triggerNetRatio, RequireMetricsReady(true))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	// The counters have 10 buckets of 1s: the condition is evaluated once the requests span 10s.
+	for i := 0; i < 9; i++ {
+		re, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadGateway, re.StatusCode)
+		clock.Advance(clock.Second)
+	}
+	assert.Equal(t, cbState(stateStandby), cb.state)
+	assert.False(t, cb.metrics.IsReady())
+	assert.Equal(t, []Status{{State: "warming"}}, cb.Status())
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), cb.state)
+}
+
+func TestCircuitBreaker_gracePeriodInvalid(t *testing.T) {
+	_, err := New(nil, triggerNetRatio, GracePeriod(-clock.Second))
+	require.Error(t, err)
+}
+
+func TestCircuitBreaker_loadFactor(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	cb, err := New(nil, triggerNetRatio, RecoveryDuration(10*clock.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, cb.LoadFactor())
+
+	cb.m.Lock()
+	cb.setState(stateTripped, clock.Now().UTC().Add(defaultFallbackDuration))
+	cb.m.Unlock()
+	assert.Equal(t, 0.0, cb.LoadFactor())
+
+	cb.m.Lock()
+	cb.setRecovering()
+	cb.m.Unlock()
+	assert.Equal(t, 0.0, cb.LoadFactor())
+
+	clock.Advance(5 * clock.Second)
+	assert.InDelta(t, 0.5, cb.LoadFactor(), 1e-9)
+
+	clock.Advance(5 * clock.Second)
+	assert.Equal(t, 1.0, cb.LoadFactor())
+}
+
+func TestCircuitBreaker_loadFactorClasses(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	cb, err := New(nil, triggerNetRatio, Classifier(byPath))
+	require.NoError(t, err)
+
+	slow := cb.classOf(httptest.NewRequest(http.MethodGet, "/slow", nil))
+	cb.classOf(httptest.NewRequest(http.MethodGet, "/fast", nil))
+	assert.Equal(t, 1.0, cb.LoadFactor())
+
+	slow.m.Lock()
+	slow.setState(stateTripped, clock.Now().UTC().Add(defaultFallbackDuration))
+	slow.m.Unlock()
+	assert.Equal(t, 0.0, cb.LoadFactor())
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
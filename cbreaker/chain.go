@@ -0,0 +1,204 @@
+package cbreaker
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// serveFallbackChain passes the request to the links of the fallback chain until one of them succeeds,
+// the last one is always served as is. Each link reads the whole body of the request, see replayable.
+func (c *CircuitBreaker) serveFallbackChain(w http.ResponseWriter, req *http.Request) {
+	last := len(c.fallbacks) - 1
+	if last == 0 {
+		c.fallbacks[last].ServeHTTP(w, req)
+		return
+	}
+
+	req, err := replayable(req)
+	if err != nil {
+		c.log.Error("vulcand/oxy/circuitbreaker: failed to read request body: %v", err)
+		utils.ServeError(nil, w, req, "circuitbreaker", err)
+		return
+	}
+
+	for i, link := range c.fallbacks[:last] {
+		linkReq, err := rewind(req)
+		if err != nil {
+			c.log.Error("vulcand/oxy/circuitbreaker: failed to read request body for fallback link %d: %v", i, err)
+			continue
+		}
+		if c.serveFallbackLink(w, linkReq, link) {
+			return
+		}
+		if c.verbose && utils.DebugEnabled(c.log) {
+			c.log.Debug("vulcand/oxy/circuitbreaker: fallback link %d failed, trying the next one", i)
+		}
+	}
+
+	linkReq, err := rewind(req)
+	if err != nil {
+		c.log.Error("vulcand/oxy/circuitbreaker: failed to read request body: %v", err)
+		utils.ServeError(nil, w, req, "circuitbreaker", err)
+		return
+	}
+	c.fallbacks[last].ServeHTTP(w, linkReq)
+}
+
+// replayable returns the request with a GetBody function, so that its body can be passed to each link of the chain.
+// The body of the requests without GetBody is read in memory once.
+func replayable(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return req, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return req, err
+	}
+
+	outReq := req.WithContext(req.Context())
+	outReq.Body = io.NopCloser(bytes.NewReader(body))
+	outReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return outReq, nil
+}
+
+// rewind returns a copy of the request with a fresh body, read from GetBody.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.GetBody == nil || req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+
+	outReq := req.WithContext(req.Context())
+	outReq.Body = body
+	return outReq, nil
+}
+
+// serveFallbackLink passes the request to a link of the fallback chain, and returns whether it succeeded:
+// the response is only sent to the client once the link has answered with a 2xx or 3xx status code,
+// within the FallbackLinkTimeout.
+func (c *CircuitBreaker) serveFallbackLink(w http.ResponseWriter, req *http.Request, link http.Handler) bool {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	lw := &linkWriter{responseWriter: w, header: make(http.Header)}
+
+	if c.fallbackLinkTimeout > 0 {
+		timer := clock.AfterFunc(c.fallbackLinkTimeout, func() {
+			if lw.expire() {
+				cancel()
+			}
+		})
+		defer timer.Stop()
+	}
+
+	link.ServeHTTP(lw, req.WithContext(ctx))
+
+	return lw.finish()
+}
+
+// linkWriter holds the status code and the headers of a link of the fallback chain until its success is known.
+// The response of a successful link is then passed through, the response of a failing link is discarded.
+type linkWriter struct {
+	responseWriter http.ResponseWriter
+	header         http.Header
+
+	mu        sync.Mutex
+	decided   bool
+	succeeded bool
+}
+
+func (l *linkWriter) Header() http.Header {
+	if l.committed() {
+		return l.responseWriter.Header()
+	}
+	return l.header
+}
+
+func (l *linkWriter) WriteHeader(code int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.writeHeader(code)
+}
+
+func (l *linkWriter) writeHeader(code int) {
+	if l.decided {
+		if l.succeeded {
+			l.responseWriter.WriteHeader(code)
+		}
+		return
+	}
+
+	// The informational responses do not tell whether the link succeeds.
+	if code < http.StatusOK {
+		return
+	}
+	l.decided = true
+
+	if code >= http.StatusBadRequest {
+		return
+	}
+	l.succeeded = true
+
+	utils.CopyHeaders(l.responseWriter.Header(), l.header)
+	l.responseWriter.WriteHeader(code)
+}
+
+func (l *linkWriter) Write(b []byte) (int, error) {
+	if !l.finish() {
+		return len(b), nil
+	}
+	return l.responseWriter.Write(b)
+}
+
+func (l *linkWriter) Flush() {
+	if !l.committed() {
+		return
+	}
+	if flusher, ok := l.responseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// expire fails the link if it has not answered yet, and returns whether it did.
+func (l *linkWriter) expire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.decided {
+		return false
+	}
+	l.decided = true
+	return true
+}
+
+// finish returns whether the link succeeded, the links that have not written anything succeed with a 200.
+func (l *linkWriter) finish() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.decided {
+		l.writeHeader(http.StatusOK)
+	}
+	return l.succeeded
+}
+
+func (l *linkWriter) committed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.succeeded
+}
@@ -0,0 +1,240 @@
+package cbreaker
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// replicaFallback forwards the requests to the replica, with the header of the replica link.
+func replicaFallback(replicaURL string) http.Handler {
+	fwd := forward.New(false)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Fallback", "replica")
+		req.URL = testutils.MustParseRequestURI(replicaURL)
+		fwd.ServeHTTP(w, req)
+	})
+}
+
+func newChainBreaker(t *testing.T, opts ...Option) (*CircuitBreaker, string) {
+	t.Helper()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("primary"))
+	})
+
+	cb, err := New(handler, triggerNetRatio, opts...)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	// trips the circuit breaker.
+	cb.metrics = statsNetErrors(0.6)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, cbState(stateTripped), cb.state)
+
+	return cb, srv.URL
+}
+
+func newStaticFallback(t *testing.T) http.Handler {
+	t.Helper()
+
+	static, err := NewResponseFallback(Response{
+		StatusCode:  http.StatusServiceUnavailable,
+		ContentType: "application/json",
+		Body:        []byte(`{"error":"service unavailable"}`),
+	})
+	require.NoError(t, err)
+	return static
+}
+
+func TestFallbackChain(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		replica         http.HandlerFunc
+		replicaDown     bool
+		expectedStatus  int
+		expectedBody    string
+		expectedReplica bool
+	}{
+		{
+			desc: "replica healthy",
+			replica: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("X-Replica", "1")
+				_, _ = w.Write([]byte("replica"))
+			},
+			expectedStatus:  http.StatusOK,
+			expectedBody:    "replica",
+			expectedReplica: true,
+		},
+		{
+			desc:           "replica down",
+			replicaDown:    true,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   `{"error":"service unavailable"}`,
+		},
+		{
+			desc: "replica failing",
+			replica: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("X-Replica", "1")
+				w.Header().Set("Set-Cookie", "replica=1")
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte("replica error"))
+			},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   `{"error":"service unavailable"}`,
+		},
+		{
+			desc: "replica redirect",
+			replica: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("X-Replica", "1")
+				http.Redirect(w, req, "/elsewhere", http.StatusFound)
+			},
+			expectedStatus:  http.StatusFound,
+			expectedReplica: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			testutils.FreezeTime(t)
+
+			replica := testutils.NewHandler(test.replica)
+			t.Cleanup(replica.Close)
+			if test.replicaDown {
+				replica.Close()
+			}
+
+			cb, srvURL := newChainBreaker(t, FallbackChain(replicaFallback(replica.URL), newStaticFallback(t)))
+			total := cb.metrics.TotalCount()
+
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+			re, err := client.Get(srvURL)
+			require.NoError(t, err)
+			body, err := io.ReadAll(re.Body)
+			require.NoError(t, err)
+			_ = re.Body.Close()
+
+			assert.Equal(t, test.expectedStatus, re.StatusCode)
+			if test.expectedBody != "" {
+				assert.Equal(t, test.expectedBody, string(body))
+			}
+
+			// The headers of a failed link are not sent.
+			if test.expectedReplica {
+				assert.Equal(t, "replica", re.Header.Get("X-Fallback"))
+				assert.Equal(t, "1", re.Header.Get("X-Replica"))
+			} else {
+				assert.Empty(t, re.Header.Get("X-Fallback"))
+				assert.Empty(t, re.Header.Get("X-Replica"))
+				assert.Empty(t, re.Header.Get("Set-Cookie"))
+				assert.Equal(t, "application/json", re.Header.Get("Content-Type"))
+			}
+			assert.Equal(t, "10", re.Header.Get("Retry-After"))
+
+			// The fallbacks are not recorded.
+			assert.Equal(t, total, cb.metrics.TotalCount())
+			assert.Equal(t, cbState(stateTripped), cb.state)
+		})
+	}
+}
+
+func TestFallbackChain_linkTimeout(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	started := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-req.Context().Done()
+
+		// The late response is discarded.
+		w.Header().Set("X-Replica", "1")
+		_, _ = w.Write([]byte("late"))
+	})
+
+	_, srvURL := newChainBreaker(t, FallbackChain(slow, newStaticFallback(t)), FallbackLinkTimeout(time.Second))
+
+	type result struct {
+		re   *http.Response
+		body []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		re, body, err := testutils.Get(srvURL)
+		done <- result{re: re, body: body, err: err}
+	}()
+
+	<-started
+	clock.Advance(time.Second)
+
+	res := <-done
+	require.NoError(t, res.err)
+	assert.Equal(t, http.StatusServiceUnavailable, res.re.StatusCode)
+	assert.Equal(t, `{"error":"service unavailable"}`, string(res.body))
+	assert.Empty(t, res.re.Header.Get("X-Replica"))
+}
+
+func TestFallbackChain_lastLinkAsIs(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	failing := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	last := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Last", "1")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("last"))
+	})
+
+	_, srvURL := newChainBreaker(t, FallbackChain(failing, last))
+
+	re, body, err := testutils.Get(srvURL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+	assert.Equal(t, "last", string(body))
+	assert.Equal(t, "1", re.Header.Get("X-Last"))
+}
+
+func TestFallbackChain_requestBody(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	failing := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The link fails after reading a part of the body.
+		_, _ = io.ReadFull(req.Body, make([]byte, 5))
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	echo := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		_, _ = w.Write(body)
+	})
+
+	_, srvURL := newChainBreaker(t, FallbackChain(failing, echo, newStaticFallback(t)))
+
+	re, body, err := testutils.Post(srvURL, testutils.Body("hello, fallback"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello, fallback", string(body))
+}
+
+func TestFallbackChain_invalid(t *testing.T) {
+	_, err := New(nil, triggerNetRatio, FallbackChain())
+	require.Error(t, err)
+
+	_, err = New(nil, triggerNetRatio, FallbackChain(nil))
+	require.Error(t, err)
+
+	_, err = New(nil, triggerNetRatio, FallbackLinkTimeout(0))
+	require.Error(t, err)
+}
@@ -0,0 +1,180 @@
+package cbreaker
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// defaultMaxClasses is the maximum number of classes tracked when a Classifier is set.
+const defaultMaxClasses = 100
+
+// Status describes the state of a class of requests.
+type Status struct {
+	// Class is the name returned by the Classifier, empty when no Classifier is set.
+	Class string
+	// State is "standby", "tripped" or "recovering", or "warming" in the Standby state while the condition
+	// can't trip the circuit breaker, see GracePeriod and RequireMetricsReady.
+	State string
+	// Until is the time until which the class is expected to stay in the tripped or recovering state.
+	Until time.Time
+	// ShedFraction is the fraction of the requests currently shed in the standby state, see AdaptiveShedding.
+	ShedFraction float64
+	// Suppressed reports whether the trips are currently suppressed, see ConditionGate.
+	Suppressed bool
+	// FallbackErrorRatio is the ratio of the responses of the fallback that are 5xx or upstream errors, see FallbackErrorRatio.
+	FallbackErrorRatio float64
+}
+
+// classes holds the circuit breakers of the request classes, the least recently used is evicted
+// when the maximum number of classes is reached.
+type classes struct {
+	mu    sync.Mutex
+	max   int
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+func newClasses(maxClasses int) *classes {
+	return &classes{
+		max:   maxClasses,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the circuit breaker of the class, creating it if needed.
+func (s *classes) get(name string, create func() (*CircuitBreaker, error)) (*CircuitBreaker, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elt, ok := s.items[name]; ok {
+		s.lru.MoveToFront(elt)
+		return elt.Value.(*CircuitBreaker), nil
+	}
+
+	cb, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.lru.Len() >= s.max {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.items, oldest.Value.(*CircuitBreaker).class)
+	}
+
+	s.items[name] = s.lru.PushFront(cb)
+
+	return cb, nil
+}
+
+func (s *classes) all() []*CircuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := make([]*CircuitBreaker, 0, s.lru.Len())
+	for elt := s.lru.Front(); elt != nil; elt = elt.Next() {
+		all = append(all, elt.Value.(*CircuitBreaker))
+	}
+
+	return all
+}
+
+// classOf returns the circuit breaker tracking the class of the request.
+func (c *CircuitBreaker) classOf(req *http.Request) *CircuitBreaker {
+	if c.classifier == nil {
+		return c
+	}
+
+	name := c.classifier(req)
+
+	cb, err := c.classes.get(name, c.newClass(name))
+	if err != nil {
+		c.log.Error("vulcand/oxy/circuitbreaker: failed to create request class: %v", err)
+		return c
+	}
+
+	return cb
+}
+
+// newClass returns a circuit breaker sharing the configuration of c, with its own metrics and state.
+func (c *CircuitBreaker) newClass(name string) func() (*CircuitBreaker, error) {
+	return func() (*CircuitBreaker, error) {
+		mt, err := c.newMetrics()
+		if err != nil {
+			return nil, err
+		}
+
+		fallbackMt, err := newFallbackMetrics()
+		if err != nil {
+			return nil, err
+		}
+
+		return &CircuitBreaker{
+			m:                   &sync.RWMutex{},
+			metrics:             mt,
+			fallbackMetrics:     fallbackMt,
+			fallbackHealth:      c.fallbackHealth,
+			condition:           c.condition,
+			expression:          c.expression,
+			fallbackDuration:    c.fallbackDuration,
+			recoveryDuration:    c.recoveryDuration,
+			onTripped:           c.onTripped,
+			onStandby:           c.onStandby,
+			checkPeriod:         c.checkPeriod,
+			started:             clock.Now(),
+			gracePeriod:         c.gracePeriod,
+			requireMetricsReady: c.requireMetricsReady,
+			gate:                c.gate,
+			shedding:            c.shedding,
+			name:                c.name,
+			class:               name,
+			events:              c.events,
+			log:                 c.log,
+		}, nil
+	}
+}
+
+// Status returns the state of every class of requests sorted by class name,
+// or the state of the circuit breaker when no Classifier is set.
+func (c *CircuitBreaker) Status() []Status {
+	if c.classifier == nil {
+		return []Status{c.status()}
+	}
+
+	var status []Status
+	for _, cb := range c.classes.all() {
+		status = append(status, cb.status())
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Class < status[j].Class
+	})
+
+	return status
+}
+
+func (c *CircuitBreaker) status() Status {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	s := Status{
+		Class:              c.class,
+		State:              c.state.String(),
+		ShedFraction:       c.shedFraction,
+		Suppressed:         c.suppressed(),
+		FallbackErrorRatio: c.fallbackMetrics.NetworkErrorRatio(),
+	}
+	if c.state != stateStandby {
+		s.Until = c.until
+	} else if c.warming() {
+		s.State = "warming"
+	}
+
+	return s
+}
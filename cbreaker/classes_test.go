@@ -0,0 +1,160 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func byPath(req *http.Request) string {
+	return req.URL.Path
+}
+
+func TestCircuitBreaker_classifier(t *testing.T) {
+	var slowFailing int32 = 1
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" && atomic.LoadInt32(&slowFailing) == 1 {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	cb, err := New(handler, triggerNetRatio, CheckPeriod(clock.Microsecond), Classifier(byPath))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	re, _, err := testutils.Get(srv.URL + "/fast")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL + "/slow")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
+
+	clock.Advance(clock.Millisecond)
+
+	re, _, err = testutils.Get(srv.URL + "/slow")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL + "/fast")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	until := clock.Now().UTC().Add(defaultFallbackDuration - clock.Millisecond)
+	assert.Equal(t, []Status{
+		{Class: "/fast", State: "standby"},
+		// The default fallback answers 503.
+		{Class: "/slow", State: "tripped", Until: until, FallbackErrorRatio: 1},
+	}, cb.Status())
+
+	fast := class(t, cb, "/fast")
+	assert.EqualValues(t, 2, fast.metrics.TotalCount())
+
+	// recovery of /slow
+	atomic.StoreInt32(&slowFailing, 0)
+	clock.Advance(defaultFallbackDuration)
+
+	re, _, err = testutils.Get(srv.URL + "/slow")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, cbState(stateRecovering), class(t, cb, "/slow").state)
+
+	clock.Advance(defaultRecoveryDuration + clock.Millisecond)
+
+	re, _, err = testutils.Get(srv.URL + "/slow")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, cbState(stateStandby), class(t, cb, "/slow").state)
+
+	// the requests of the previous window have expired, only the new one must be counted.
+	re, _, err = testutils.Get(srv.URL + "/fast")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	assert.Equal(t, cbState(stateStandby), fast.state)
+	assert.EqualValues(t, 1, fast.metrics.TotalCount())
+	assert.Equal(t, float64(0), fast.metrics.NetworkErrorRatio())
+}
+
+func TestClassifyByProto(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	cb, err := New(handler, triggerNetRatio, Classifier(ClassifyByProto))
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(cb)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	re, err := srv.Client().Get(srv.URL)
+	require.NoError(t, err)
+	_ = re.Body.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	cb.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, []Status{
+		{Class: "HTTP/1.1", State: "standby"},
+		{Class: "HTTP/2.0", State: "standby"},
+	}, cb.Status())
+}
+
+func TestCircuitBreaker_maxClasses(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	cb, err := New(handler, triggerNetRatio, Classifier(byPath), MaxClasses(2))
+	require.NoError(t, err)
+
+	for _, path := range []string{"/a", "/b", "/a", "/c"} {
+		cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, []Status{
+		{Class: "/a", State: "standby"},
+		{Class: "/c", State: "standby"},
+	}, cb.Status())
+}
+
+func TestCircuitBreaker_statusWithoutClassifier(t *testing.T) {
+	cb, err := New(nil, triggerNetRatio)
+	require.NoError(t, err)
+
+	assert.Equal(t, []Status{{State: "standby"}}, cb.Status())
+}
+
+func TestCircuitBreaker_classifierOptions(t *testing.T) {
+	_, err := New(nil, triggerNetRatio, Classifier(nil))
+	require.Error(t, err)
+
+	_, err = New(nil, triggerNetRatio, MaxClasses(0))
+	require.Error(t, err)
+}
+
+func class(t *testing.T, cb *CircuitBreaker, name string) *CircuitBreaker {
+	t.Helper()
+
+	cb.classes.mu.Lock()
+	defer cb.classes.mu.Unlock()
+
+	elt, ok := cb.classes.items[name]
+	require.True(t, ok, "class %s not found", name)
+
+	return elt.Value.(*CircuitBreaker)
+}
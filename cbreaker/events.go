@@ -0,0 +1,158 @@
+package cbreaker
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/memmetrics"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// eventsBufferSize is the number of events waiting to be delivered before new ones are dropped.
+const eventsBufferSize = 128
+
+// Event describes a transition of the circuit breaker state.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Name identifies the circuit breaker, see Name.
+	Name string `json:"name,omitempty"`
+	// Class is the class of requests, see Classifier.
+	Class string `json:"class,omitempty"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	// Metrics is the snapshot of the metrics at transition time.
+	Metrics MetricsSnapshot `json:"metrics"`
+	// Condition is the expression that tripped the circuit breaker, only set for the transitions to the tripped state.
+	Condition string `json:"condition,omitempty"`
+}
+
+// MetricsSnapshot holds the metrics of the circuit breaker at a given time.
+type MetricsSnapshot struct {
+	NetworkErrorRatio float64       `json:"networkErrorRatio"`
+	TotalCount        int64         `json:"totalCount"`
+	StatusCodes       map[int]int64 `json:"statusCodes"`
+	LatencyP99        time.Duration `json:"latencyP99"`
+}
+
+func newMetricsSnapshot(m *memmetrics.RTMetrics) MetricsSnapshot {
+	s := MetricsSnapshot{
+		NetworkErrorRatio: m.NetworkErrorRatio(),
+		TotalCount:        m.TotalCount(),
+		StatusCodes:       m.StatusCodesCounts(),
+	}
+
+	if h, err := m.LatencyHistogram(); err == nil {
+		s.LatencyP99 = h.LatencyAtQuantile(99)
+	}
+
+	return s
+}
+
+// eventDispatcher delivers the events to the sinks without blocking the state transitions:
+// the events are dropped when the sinks are too slow.
+// The dispatcher of a circuit breaker is shared by its classes, see Classifier.
+// Its goroutine is started on demand, and exits once the queued events are delivered.
+type eventDispatcher struct {
+	mu      sync.Mutex
+	queue   []Event
+	running bool
+	dropped uint64
+
+	enc     *json.Encoder
+	onEvent func(Event)
+
+	log utils.Logger
+}
+
+func newEventDispatcher(w io.Writer, onEvent func(Event), log utils.Logger) *eventDispatcher {
+	d := &eventDispatcher{
+		onEvent: onEvent,
+		log:     log,
+	}
+
+	if w != nil {
+		d.enc = json.NewEncoder(w)
+	}
+
+	return d
+}
+
+func (d *eventDispatcher) dispatch(e Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.queue) >= eventsBufferSize {
+		d.dropped++
+		return
+	}
+
+	d.queue = append(d.queue, e)
+
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+}
+
+func (d *eventDispatcher) droppedEvents() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.dropped
+}
+
+func (d *eventDispatcher) run() {
+	for {
+		d.mu.Lock()
+		if len(d.queue) == 0 {
+			d.queue = nil
+			d.running = false
+			d.mu.Unlock()
+			return
+		}
+		e := d.queue[0]
+		d.queue = d.queue[1:]
+		d.mu.Unlock()
+
+		if d.enc != nil {
+			if err := d.enc.Encode(e); err != nil {
+				d.log.Error("vulcand/oxy/circuitbreaker: failed to write event: %v", err)
+			}
+		}
+
+		if d.onEvent != nil {
+			d.onEvent(e)
+		}
+	}
+}
+
+// DroppedEvents returns the number of events dropped because the event sinks were too slow.
+func (c *CircuitBreaker) DroppedEvents() uint64 {
+	if c.events == nil {
+		return 0
+	}
+	return c.events.droppedEvents()
+}
+
+func (c *CircuitBreaker) emit(from, to cbState) {
+	if c.events == nil {
+		return
+	}
+
+	e := Event{
+		Time:    clock.Now().UTC(),
+		Name:    c.name,
+		Class:   c.class,
+		From:    from.String(),
+		To:      to.String(),
+		Metrics: newMetricsSnapshot(c.metrics),
+	}
+	if to == stateTripped {
+		e.Condition = c.expression
+	}
+
+	c.events.dispatch(e)
+}
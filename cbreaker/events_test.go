@@ -0,0 +1,219 @@
+package cbreaker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/memmetrics"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestCircuitBreaker_events(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	eventLog := &syncBuffer{}
+	events := make(chan Event, 10)
+
+	cb, err := New(handler, triggerNetRatio,
+		CheckPeriod(clock.Microsecond),
+		Name("api"),
+		EventLog(eventLog),
+		OnEvent(func(e Event) { events <- e }),
+	)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	// standby -> tripped
+	cb.metrics = statsNetErrorsWithLatency(0.6, 10*clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), cb.state)
+
+	// tripped -> recovering
+	clock.Advance(10*clock.Second + clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateRecovering), cb.state)
+
+	recoveringCount := cb.metrics.TotalCount()
+
+	// recovering -> standby
+	clock.Advance(10*clock.Second + clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateStandby), cb.state)
+
+	// standby -> tripped
+	clock.Advance(clock.Second)
+	cb.metrics = statsNetErrorsWithLatency(0.8, 0)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), cb.state)
+
+	var received []Event
+	for i := 0; i < 4; i++ {
+		select {
+		case e := <-events:
+			received = append(received, e)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for events")
+		}
+	}
+
+	assert.Equal(t, "standby", received[0].From)
+	assert.Equal(t, "tripped", received[0].To)
+	assert.Equal(t, triggerNetRatio, received[0].Condition)
+	assert.Equal(t, int64(101), received[0].Metrics.TotalCount)
+	assert.InDelta(t, 60.0/101.0, received[0].Metrics.NetworkErrorRatio, 0.0001)
+	assert.Equal(t, map[int]int64{http.StatusOK: 41, http.StatusGatewayTimeout: 60}, received[0].Metrics.StatusCodes)
+	assert.InEpsilon(t, 10*clock.Millisecond, received[0].Metrics.LatencyP99, 0.01)
+
+	assert.Equal(t, "tripped", received[1].From)
+	assert.Equal(t, "recovering", received[1].To)
+	assert.Empty(t, received[1].Condition)
+	assert.Equal(t, int64(0), received[1].Metrics.TotalCount)
+
+	assert.Equal(t, "recovering", received[2].From)
+	assert.Equal(t, "standby", received[2].To)
+	assert.Empty(t, received[2].Condition)
+	assert.Equal(t, recoveringCount, received[2].Metrics.TotalCount)
+
+	assert.Equal(t, "standby", received[3].From)
+	assert.Equal(t, "tripped", received[3].To)
+	assert.Equal(t, int64(101), received[3].Metrics.TotalCount)
+	assert.InDelta(t, 80.0/101.0, received[3].Metrics.NetworkErrorRatio, 0.0001)
+
+	for i, e := range received {
+		assert.Equal(t, "api", e.Name)
+		if i > 0 {
+			assert.True(t, e.Time.After(received[i-1].Time))
+		}
+	}
+
+	// The writer receives the same events, one JSON object per line.
+	require.Eventually(t, func() bool { return len(eventLog.Lines()) == 4 }, 5*time.Second, 10*time.Millisecond)
+
+	for i, line := range eventLog.Lines() {
+		var e Event
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		assert.Equal(t, received[i], e)
+	}
+
+	assert.Zero(t, cb.DroppedEvents())
+}
+
+func TestCircuitBreaker_eventsDropped(t *testing.T) {
+	started := make(chan struct{}, 1)
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+
+	cb, err := New(nil, triggerNetRatio, OnEvent(func(Event) {
+		started <- struct{}{}
+		<-block
+	}))
+	require.NoError(t, err)
+
+	// The first event blocks the dispatcher.
+	cb.emit(stateStandby, stateTripped)
+	<-started
+
+	// The buffer holds the next ones, the others are dropped.
+	for i := 0; i < eventsBufferSize+10; i++ {
+		cb.emit(stateStandby, stateTripped)
+	}
+
+	assert.Equal(t, uint64(10), cb.DroppedEvents())
+}
+
+func TestCircuitBreaker_eventsIdle(t *testing.T) {
+	events := make(chan Event, 1)
+
+	cb, err := New(nil, triggerNetRatio, OnEvent(func(e Event) { events <- e }), Classifier(func(req *http.Request) string {
+		return req.URL.Path
+	}), MaxClasses(2))
+	require.NoError(t, err)
+
+	// No goroutine is started before the first event.
+	assert.False(t, dispatcherRunning(cb.events))
+
+	// The classes share the dispatcher of the circuit breaker, including the evicted ones.
+	for _, path := range []string{"/a", "/b", "/c"} {
+		class := cb.classOf(httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Same(t, cb.events, class.events)
+
+		class.emit(stateStandby, stateTripped)
+		assert.Equal(t, path, (<-events).Class)
+
+		// The goroutine exits once the events are delivered.
+		require.Eventually(t, func() bool { return !dispatcherRunning(cb.events) }, time.Second, time.Millisecond)
+	}
+
+	assert.Zero(t, cb.DroppedEvents())
+}
+
+func dispatcherRunning(d *eventDispatcher) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.running
+}
+
+func TestCircuitBreaker_nilEventSinks(t *testing.T) {
+	_, err := New(nil, triggerNetRatio, EventLog(nil))
+	require.Error(t, err)
+
+	_, err = New(nil, triggerNetRatio, OnEvent(nil))
+	require.Error(t, err)
+}
+
+func statsNetErrorsWithLatency(threshold float64, latency time.Duration) *memmetrics.RTMetrics {
+	m, err := memmetrics.NewRTMetrics()
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 100; i++ {
+		if i < int(threshold*100) {
+			m.Record(http.StatusGatewayTimeout, latency)
+		} else {
+			m.Record(http.StatusOK, latency)
+		}
+	}
+	return m
+}
@@ -1,13 +1,101 @@
 package cbreaker
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"math"
+	"mime"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"text/template"
 
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
 	"github.com/vulcand/oxy/v2/utils"
 )
 
+// DefaultRequestIDHeader is the header used to fill the RequestID of the fallback templates,
+// when the context of the request does not carry its ID.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+type retryAtKey struct{}
+
+// withRetryAt stores the time until which the circuit breaker will not let the request through.
+func withRetryAt(ctx context.Context, until clock.Time) context.Context {
+	return context.WithValue(ctx, retryAtKey{}, until)
+}
+
+// retryAfterSeconds returns the number of seconds until the circuit breaker may let the request through.
+func retryAfterSeconds(req *http.Request) (int, bool) {
+	until, ok := req.Context().Value(retryAtKey{}).(clock.Time)
+	if !ok || until.IsZero() {
+		return 0, false
+	}
+
+	seconds := math.Ceil(until.Sub(clock.Now().UTC()).Seconds())
+	if seconds < 0 {
+		return 0, true
+	}
+	return int(seconds), true
+}
+
+// serveFallback passes the request of the class to the fallback handler.
+// The responses carry the Retry-After header, unless the fallback sets its own, and the status code set by FallbackStatusOverride.
+func (c *CircuitBreaker) serveFallback(w http.ResponseWriter, req *http.Request, class *CircuitBreaker) {
+	c.serveObservedFallback(&fallbackWriter{ResponseWriter: w, req: req, status: c.fallbackStatus}, req, class)
+}
+
+// fallbackWriter completes the headers of the fallback responses before they are written.
+type fallbackWriter struct {
+	http.ResponseWriter
+
+	req    *http.Request
+	status int
+
+	wroteHeader bool
+}
+
+func (f *fallbackWriter) WriteHeader(code int) {
+	if f.wroteHeader {
+		f.ResponseWriter.WriteHeader(code)
+		return
+	}
+	f.wroteHeader = true
+
+	// The delay is computed when the response is written, the fallback may have waited.
+	if f.ResponseWriter.Header().Get("Retry-After") == "" {
+		if retryAfter, ok := retryAfterSeconds(f.req); ok {
+			f.ResponseWriter.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		}
+	}
+
+	if f.status != 0 {
+		code = f.status
+	}
+	f.ResponseWriter.WriteHeader(code)
+}
+
+func (f *fallbackWriter) Write(b []byte) (int, error) {
+	if !f.wroteHeader {
+		f.WriteHeader(http.StatusOK)
+	}
+	return f.ResponseWriter.Write(b)
+}
+
+func (f *fallbackWriter) Flush() {
+	if !f.wroteHeader {
+		f.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := f.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // Response response model.
 type Response struct {
 	StatusCode  int
@@ -15,17 +103,29 @@ type Response struct {
 	Body        []byte
 }
 
+// FallbackData is the data available to the fallback templates.
+// RequestID and Path come from the client: they are escaped for the HTML and JSON templates, see FallbackTemplates.
+type FallbackData struct {
+	RequestID         string
+	Path              string
+	RetryAfterSeconds int
+}
+
 // ResponseFallback fallback response handler.
 type ResponseFallback struct {
 	r Response
 
+	// templates are the templates of FallbackTemplates, by media type.
+	templates       map[string]contentTemplate
+	requestIDHeader string
+
 	debug bool
 	log   utils.Logger
 }
 
 // NewResponseFallback creates a new ResponseFallback.
 func NewResponseFallback(r Response, options ...ResponseFallbackOption) (*ResponseFallback, error) {
-	rf := &ResponseFallback{r: r, log: &utils.NoopLogger{}}
+	rf := &ResponseFallback{r: r, requestIDHeader: DefaultRequestIDHeader, log: &utils.NoopLogger{}}
 
 	for _, s := range options {
 		if err := s(rf); err != nil {
@@ -37,23 +137,176 @@ func NewResponseFallback(r Response, options ...ResponseFallbackOption) (*Respon
 }
 
 func (f *ResponseFallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if f.debug {
+	if f.debug && utils.DebugEnabled(f.log) {
 		dump := utils.DumpHTTPRequest(req)
 		f.log.Debug("vulcand/oxy/fallback/response: begin ServeHttp on request: %s", dump)
 		defer f.log.Debug("vulcand/oxy/fallback/response: completed ServeHttp on request: %s", dump)
 	}
 
-	if f.r.ContentType != "" {
-		w.Header().Set("Content-Type", f.r.ContentType)
+	retryAfter, hasRetryAfter := retryAfterSeconds(req)
+	if hasRetryAfter {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
 	}
-	w.Header().Set("Content-Length", strconv.Itoa(len(f.r.Body)))
+
+	contentType, body := f.r.ContentType, f.r.Body
+	if ct, tmpl := f.negotiate(req); tmpl != nil {
+		requestID, ok := utils.RequestIDFromContext(req.Context())
+		if !ok {
+			requestID = req.Header.Get(f.requestIDHeader)
+		}
+
+		data := FallbackData{
+			RequestID:         requestID,
+			Path:              req.URL.Path,
+			RetryAfterSeconds: retryAfter,
+		}
+		if isJSONType(ct) {
+			data.RequestID, data.Path = jsonEscape(data.RequestID), jsonEscape(data.Path)
+		}
+
+		buf := &bytes.Buffer{}
+		if err := tmpl.Execute(buf, data); err != nil {
+			f.log.Error("vulcand/oxy/fallback/response: failed to execute template for %s, err: %v", ct, err)
+		} else {
+			contentType, body = ct, buf.Bytes()
+		}
+	}
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
 	w.WriteHeader(f.r.StatusCode)
-	_, err := w.Write(f.r.Body)
+	_, err := w.Write(body)
 	if err != nil {
 		f.log.Error("vulcand/oxy/fallback/response: failed to write response, err: %v", err)
 	}
 }
 
+// negotiate selects the template matching the Accept header of the request.
+// Returns a nil template if the static body should be used.
+func (f *ResponseFallback) negotiate(req *http.Request) (string, fallbackTemplate) {
+	if len(f.templates) == 0 {
+		return "", nil
+	}
+
+	for _, mediaRange := range parseAccept(req.Header.Get("Accept")) {
+		if mediaRange == "*/*" {
+			// The static body is acceptable.
+			return "", nil
+		}
+
+		if t, ok := f.templates[mediaRange]; ok {
+			return t.contentType, t.tmpl
+		}
+
+		if strings.HasSuffix(mediaRange, "/*") {
+			prefix := strings.TrimSuffix(mediaRange, "*")
+			for _, mediaType := range f.mediaTypes() {
+				if strings.HasPrefix(mediaType, prefix) {
+					t := f.templates[mediaType]
+					return t.contentType, t.tmpl
+				}
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// fallbackTemplate is a text/template or html/template template.
+type fallbackTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+// contentTemplate is a template of FallbackTemplates, with the content type of the responses it renders.
+type contentTemplate struct {
+	contentType string
+	tmpl        fallbackTemplate
+}
+
+// newFallbackTemplate returns the template rendering the fallback body of the content type ct:
+// the templates of the HTML types are converted to html/template, to escape the values by context.
+func newFallbackTemplate(ct string, tmpl *template.Template) (fallbackTemplate, error) {
+	if !isHTMLType(ct) {
+		return tmpl, nil
+	}
+
+	out := htmltemplate.New(tmpl.Name())
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		// html/template rewrites the trees it escapes.
+		if _, err := out.AddParseTree(t.Name(), t.Tree.Copy()); err != nil {
+			return nil, err
+		}
+	}
+	return out.Lookup(tmpl.Name()), nil
+}
+
+func isHTMLType(ct string) bool {
+	mediaType, _, _ := mime.ParseMediaType(ct)
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+func isJSONType(ct string) bool {
+	mediaType, _, _ := mime.ParseMediaType(ct)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// jsonEscape returns s escaped for the content of a JSON string.
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
+func (f *ResponseFallback) mediaTypes() []string {
+	mediaTypes := make([]string, 0, len(f.templates))
+	for mediaType := range f.templates {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+	return mediaTypes
+}
+
+// parseAccept returns the media ranges of an Accept header ordered by preference.
+func parseAccept(header string) []string {
+	type mediaRange struct {
+		value string
+		q     float64
+	}
+
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		ranges = append(ranges, mediaRange{value: mediaType, q: q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	out := make([]string, len(ranges))
+	for i, r := range ranges {
+		out[i] = r.value
+	}
+	return out
+}
+
 // Redirect redirect model.
 type Redirect struct {
 	URL          string
@@ -89,7 +342,7 @@ func NewRedirectFallback(r Redirect, options ...RedirectFallbackOption) (*Redire
 }
 
 func (f *RedirectFallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if f.debug {
+	if f.debug && utils.DebugEnabled(f.log) {
 		dump := utils.DumpHTTPRequest(req)
 		f.log.Debug("vulcand/oxy/fallback/redirect: begin ServeHttp on request: %s", dump)
 		defer f.log.Debug("vulcand/oxy/fallback/redirect: completed ServeHttp on request: %s", dump)
@@ -0,0 +1,253 @@
+package cbreaker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestResponseFallback_templates(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	fallback, err := NewResponseFallback(
+		Response{StatusCode: http.StatusServiceUnavailable, ContentType: "text/plain", Body: []byte("unavailable")},
+		FallbackTemplates(map[string]*template.Template{
+			"application/json": template.Must(template.New("json").Parse(`{"id":"{{.RequestID}}","path":"{{.Path}}","retry":{{.RetryAfterSeconds}}}`)),
+			"text/html":        template.Must(template.New("html").Parse(`<p>{{.RequestID}} {{.Path}} {{.RetryAfterSeconds}}</p>`)),
+		}),
+	)
+	require.NoError(t, err)
+
+	cb, err := New(handler, triggerNetRatio, Fallback(fallback))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	cb.metrics = statsNetErrors(0.6)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), cb.state)
+
+	clock.Advance(3 * clock.Second)
+
+	testCases := []struct {
+		desc                string
+		accept              string
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			desc:                "json",
+			accept:              "application/json",
+			expectedContentType: "application/json",
+			expectedBody:        `{"id":"abc","path":"/api","retry":7}`,
+		},
+		{
+			desc:                "html",
+			accept:              "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			expectedContentType: "text/html",
+			expectedBody:        `<p>abc /api 7</p>`,
+		},
+		{
+			desc:                "quality",
+			accept:              "text/html;q=0.5, application/json",
+			expectedContentType: "application/json",
+			expectedBody:        `{"id":"abc","path":"/api","retry":7}`,
+		},
+		{
+			desc:                "wildcard subtype",
+			accept:              "application/*",
+			expectedContentType: "application/json",
+			expectedBody:        `{"id":"abc","path":"/api","retry":7}`,
+		},
+		{
+			desc:                "no match",
+			accept:              "image/png",
+			expectedContentType: "text/plain",
+			expectedBody:        "unavailable",
+		},
+		{
+			desc:                "no accept",
+			expectedContentType: "text/plain",
+			expectedBody:        "unavailable",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			opts := []testutils.ReqOption{testutils.Header("X-Request-Id", "abc")}
+			if test.accept != "" {
+				opts = append(opts, testutils.Header("Accept", test.accept))
+			}
+
+			re, body, err := testutils.Get(srv.URL+"/api", opts...)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+			assert.Equal(t, test.expectedContentType, re.Header.Get("Content-Type"))
+			assert.Equal(t, "7", re.Header.Get("Retry-After"))
+			assert.Equal(t, test.expectedBody, string(body))
+		})
+	}
+}
+
+func TestResponseFallback_templatesEscaping(t *testing.T) {
+	fallback, err := NewResponseFallback(
+		Response{StatusCode: http.StatusServiceUnavailable, ContentType: "text/plain", Body: []byte("unavailable")},
+		FallbackTemplates(map[string]*template.Template{
+			"application/json":         template.Must(template.New("json").Parse(`{"id":"{{.RequestID}}","path":"{{.Path}}"}`)),
+			"application/problem+json": template.Must(template.New("problem").Parse(`{"instance":"{{.Path}}"}`)),
+			"text/html":                template.Must(template.New("html").Parse(`<p title="{{.RequestID}}">{{.Path}}</p>`)),
+		}),
+	)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc         string
+		accept       string
+		expectedBody string
+		// expectedJSON is the decoded body of the JSON types.
+		expectedJSON map[string]string
+	}{
+		{
+			desc:         "json",
+			accept:       "application/json",
+			expectedBody: `{"id":"\"\u003cscript\u003ealert(1)\u003c/script\u003e","path":"/\u003cscript\u003e\""}`,
+			expectedJSON: map[string]string{"id": `"<script>alert(1)</script>`, "path": `/<script>"`},
+		},
+		{
+			desc:         "json suffix",
+			accept:       "application/problem+json",
+			expectedBody: `{"instance":"/\u003cscript\u003e\""}`,
+			expectedJSON: map[string]string{"instance": `/<script>"`},
+		},
+		{
+			desc:         "html",
+			accept:       "text/html",
+			expectedBody: `<p title="&#34;&lt;script&gt;alert(1)&lt;/script&gt;">/&lt;script&gt;&#34;</p>`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.URL.Path = `/<script>"`
+			req.Header.Set("Accept", test.accept)
+			req.Header.Set("X-Request-Id", `"<script>alert(1)</script>`)
+
+			rw := httptest.NewRecorder()
+			fallback.ServeHTTP(rw, req)
+
+			assert.Equal(t, test.accept, rw.Header().Get("Content-Type"))
+			assert.Equal(t, test.expectedBody, rw.Body.String())
+
+			if test.expectedJSON != nil {
+				var body map[string]string
+				require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &body))
+				assert.Equal(t, test.expectedJSON, body)
+			}
+		})
+	}
+}
+
+func TestResponseFallback_templateKeys(t *testing.T) {
+	testCases := []struct {
+		desc                string
+		key                 string
+		accept              string
+		expectedContentType string
+	}{
+		{
+			desc:                "parameters",
+			key:                 "application/json; charset=utf-8",
+			accept:              "application/json",
+			expectedContentType: "application/json; charset=utf-8",
+		},
+		{
+			desc:                "case",
+			key:                 "Application/JSON",
+			accept:              "application/json",
+			expectedContentType: "application/json",
+		},
+		{
+			desc:                "case and parameters with wildcard subtype",
+			key:                 "Application/JSON; Charset=UTF-8",
+			accept:              "application/*",
+			expectedContentType: "application/json; charset=UTF-8",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			fallback, err := NewResponseFallback(
+				Response{StatusCode: http.StatusServiceUnavailable, ContentType: "text/plain", Body: []byte("unavailable")},
+				FallbackTemplates(map[string]*template.Template{
+					test.key: template.Must(template.New("json").Parse(`{"id":"{{.RequestID}}"}`)),
+				}),
+			)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept", test.accept)
+			req.Header.Set("X-Request-Id", `"abc`)
+
+			rw := httptest.NewRecorder()
+			fallback.ServeHTTP(rw, req)
+
+			assert.Equal(t, test.expectedContentType, rw.Header().Get("Content-Type"))
+			assert.Equal(t, `{"id":"\"abc"}`, rw.Body.String())
+		})
+	}
+}
+
+func TestResponseFallback_invalidTemplateKeys(t *testing.T) {
+	tmpl := template.Must(template.New("json").Parse(`{}`))
+
+	_, err := NewResponseFallback(Response{StatusCode: http.StatusServiceUnavailable},
+		FallbackTemplates(map[string]*template.Template{"json": tmpl}))
+	require.Error(t, err)
+
+	_, err = NewResponseFallback(Response{StatusCode: http.StatusServiceUnavailable},
+		FallbackTemplates(map[string]*template.Template{"application/json": tmpl, "Application/JSON; charset=utf-8": tmpl}))
+	require.Error(t, err)
+}
+
+func TestResponseFallback_templateError(t *testing.T) {
+	fallback, err := NewResponseFallback(
+		Response{StatusCode: http.StatusServiceUnavailable, ContentType: "text/plain", Body: []byte("unavailable")},
+		FallbackTemplates(map[string]*template.Template{
+			"application/json": template.Must(template.New("json").Parse(`{{.Unknown}}`)),
+		}),
+		FallbackRequestIDHeader("X-Correlation-Id"),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+
+	rw := httptest.NewRecorder()
+	fallback.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "text/plain", rw.Header().Get("Content-Type"))
+	assert.Empty(t, rw.Header().Get("Retry-After"))
+	assert.Equal(t, "unavailable", rw.Body.String())
+}
+
+func TestResponseFallback_nilTemplate(t *testing.T) {
+	_, err := NewResponseFallback(Response{StatusCode: http.StatusServiceUnavailable},
+		FallbackTemplates(map[string]*template.Template{"application/json": nil}))
+	require.Error(t, err)
+}
@@ -0,0 +1,98 @@
+package cbreaker
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/memmetrics"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// fallbackHealth is the alert on the errors of the fallback, see OnFallbackUnhealthy.
+type fallbackHealth struct {
+	threshold  float64
+	minSamples int64
+	fn         func()
+}
+
+// fallbackEpisode counts the responses of the fallback since the circuit breaker tripped.
+type fallbackEpisode struct {
+	served  int64
+	failed  int64
+	alerted bool
+}
+
+// isFallbackError reports whether a response of the fallback is a failure: a 5xx or an upstream error.
+func isFallbackError(code int, err error) bool {
+	return err != nil || code >= http.StatusInternalServerError
+}
+
+// newFallbackMetrics creates the metrics of the fallback responses, separate from the metrics of the condition.
+func newFallbackMetrics() (*memmetrics.RTMetrics, error) {
+	return memmetrics.NewRTMetrics(memmetrics.RTErrorClassifier(isFallbackError))
+}
+
+// FallbackErrorRatio returns the ratio of the responses of the fallback that are 5xx or upstream errors,
+// over the window of the metrics. With a Classifier, it includes the responses of every class, see Status for a class.
+// The responses of the fallback are never recorded in the metrics of the condition.
+func (c *CircuitBreaker) FallbackErrorRatio() float64 {
+	return c.fallbackMetrics.NetworkErrorRatio()
+}
+
+// serveObservedFallback passes the request to the fallback chain, and records the response in the fallback metrics
+// of the circuit breaker and of the class of the request.
+func (c *CircuitBreaker) serveObservedFallback(w http.ResponseWriter, req *http.Request, class *CircuitBreaker) {
+	start := clock.Now()
+	p := utils.NewProxyWriterWithLogger(w, c.log)
+
+	req = req.WithContext(forward.WithErrorCapture(req.Context()))
+
+	c.serveFallbackChain(p, req)
+
+	if p.Hijacked() {
+		return
+	}
+
+	code, latency, err := p.StatusCode(), clock.Since(start), forward.ErrorFromContext(req.Context())
+	if class != c {
+		class.recordFallback(code, latency, err)
+	}
+	c.recordFallback(code, latency, err)
+}
+
+// recordFallback records a response of the fallback, and runs the OnFallbackUnhealthy callback once per trip
+// when the fallback fails too often.
+func (c *CircuitBreaker) recordFallback(code int, latency time.Duration, err error) {
+	c.fallbackMetrics.RecordError(code, latency, err)
+
+	if c.fallbackHealth == nil {
+		return
+	}
+
+	c.m.Lock()
+	// The requests shed in the Standby state are not part of a trip.
+	if c.state == stateStandby {
+		c.m.Unlock()
+		return
+	}
+
+	e := &c.fallbackEpisode
+	e.served++
+	if isFallbackError(code, err) {
+		e.failed++
+	}
+
+	alert := !e.alerted && e.served >= c.fallbackHealth.minSamples &&
+		float64(e.failed)/float64(e.served) > c.fallbackHealth.threshold
+	if alert {
+		e.alerted = true
+		c.log.Warn("%v fallback is failing: %d errors out of %d responses", c, e.failed, e.served)
+	}
+	c.m.Unlock()
+
+	if alert {
+		go c.fallbackHealth.fn()
+	}
+}
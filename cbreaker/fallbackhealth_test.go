@@ -0,0 +1,111 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestCircuitBreaker_fallbackUnhealthy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	testutils.FreezeTime(t)
+
+	var alerts atomic.Int64
+	alerted := make(chan struct{}, 10)
+	cb, err := New(handler, triggerNetRatio, Fallback(fallback), OnFallbackUnhealthy(0.5, 3, func() {
+		alerts.Add(1)
+		alerted <- struct{}{}
+	}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	cb.metrics = statsNetErrors(0.6)
+	clock.Advance(defaultCheckPeriod + clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, cbState(stateTripped), cb.state)
+
+	for i := 0; i < 5; i++ {
+		re, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+	}
+
+	select {
+	case <-alerted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fallback was not reported unhealthy")
+	}
+
+	// The callback is called once per trip.
+	assert.Equal(t, int64(1), alerts.Load())
+	assert.InDelta(t, 1.0, cb.FallbackErrorRatio(), 0.001)
+	assert.InDelta(t, 1.0, cb.Status()[0].FallbackErrorRatio, 0.001)
+
+	// The responses of the fallback are not recorded in the metrics of the condition, reset by the trip.
+	assert.Equal(t, int64(0), cb.metrics.TotalCount())
+}
+
+func TestCircuitBreaker_fallbackHealthy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("cached"))
+	})
+
+	testutils.FreezeTime(t)
+
+	var alerts atomic.Int64
+	cb, err := New(handler, triggerNetRatio, Fallback(fallback), FallbackStatusOverride(http.StatusServiceUnavailable),
+		OnFallbackUnhealthy(0.1, 1, func() { alerts.Add(1) }))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	cb.metrics = statsNetErrors(0.6)
+	clock.Advance(defaultCheckPeriod + clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, cbState(stateTripped), cb.state)
+
+	// The status override is not a failure of the fallback.
+	for i := 0; i < 5; i++ {
+		re, body, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+		assert.Equal(t, "cached", string(body))
+	}
+
+	assert.Equal(t, 0.0, cb.FallbackErrorRatio())
+	assert.Equal(t, int64(0), cb.metrics.TotalCount())
+	assert.Never(t, func() bool { return alerts.Load() > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestOnFallbackUnhealthy_invalid(t *testing.T) {
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	fn := func() {}
+
+	_, err := New(handler, triggerNetRatio, OnFallbackUnhealthy(1, 1, fn))
+	assert.Error(t, err)
+	_, err = New(handler, triggerNetRatio, OnFallbackUnhealthy(0.5, 0, fn))
+	assert.Error(t, err)
+	_, err = New(handler, triggerNetRatio, OnFallbackUnhealthy(0.5, 1, nil))
+	assert.Error(t, err)
+}
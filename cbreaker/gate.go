@@ -0,0 +1,61 @@
+package cbreaker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// week is the period of the maintenance windows.
+const week = 7 * 24 * time.Hour
+
+// Window is a weekly maintenance window, see MaintenanceWindows.
+type Window struct {
+	// Weekday is the day the window starts.
+	Weekday time.Weekday
+	// Start is the time of the day the window starts, e.g. 2*time.Hour for 02:00.
+	Start time.Duration
+	// Duration is the length of the window, it can run over the next days.
+	Duration time.Duration
+	// Location is the time zone of the window, UTC if nil.
+	Location *time.Location
+}
+
+func (w Window) validate() error {
+	if w.Weekday < time.Sunday || w.Weekday > time.Saturday {
+		return fmt.Errorf("invalid maintenance window weekday: %d", w.Weekday)
+	}
+	if w.Start < 0 || w.Start >= 24*time.Hour {
+		return fmt.Errorf("invalid maintenance window start: %v", w.Start)
+	}
+	if w.Duration <= 0 || w.Duration > week {
+		return fmt.Errorf("invalid maintenance window duration: %v", w.Duration)
+	}
+	return nil
+}
+
+// contains reports whether now is in the window, or in its occurrence of the previous week.
+func (w Window) contains(now time.Time) bool {
+	loc := w.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+
+	days := (int(now.Weekday()) - int(w.Weekday) + 7) % 7
+	year, month, day := now.Date()
+	start := time.Date(year, month, day-days, 0, 0, 0, 0, loc).Add(w.Start)
+
+	for _, s := range []time.Time{start, start.AddDate(0, 0, -7)} {
+		if !now.Before(s) && now.Before(s.Add(w.Duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+// suppressed reports whether the gate prevents the condition from tripping the circuit breaker, see ConditionGate.
+func (c *CircuitBreaker) suppressed() bool {
+	return c.gate != nil && !c.gate(clock.Now())
+}
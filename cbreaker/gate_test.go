@@ -0,0 +1,231 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// countingSideEffect counts its executions.
+type countingSideEffect struct {
+	count atomic.Int64
+}
+
+func (s *countingSideEffect) Exec() error {
+	s.count.Add(1)
+	return nil
+}
+
+// The time is frozen on Sunday at 05:06:07 UTC, the window starts at 05:10.
+var nightlyWindow = Window{Weekday: time.Sunday, Start: 5*time.Hour + 10*time.Minute, Duration: time.Hour}
+
+func TestCircuitBreaker_maintenanceWindow(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	onTripped := &countingSideEffect{}
+	cb, err := New(handler, triggerNetRatio, CheckPeriod(clock.Microsecond), OnTripped(onTripped),
+		MaintenanceWindows([]Window{nightlyWindow}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	assert.False(t, cb.Status()[0].Suppressed)
+
+	// The errors don't trip the circuit breaker during the window.
+	clock.Advance(10 * time.Minute)
+	cb.metrics = statsNetErrors(0.9)
+	for i := 0; i < 3; i++ {
+		re, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		clock.Advance(clock.Millisecond)
+	}
+	assert.Equal(t, cbState(stateStandby), cb.state)
+	assert.Equal(t, Status{State: "standby", Suppressed: true}, cb.Status()[0])
+
+	// Past the window, the persisting errors trip it on the next check.
+	clock.Advance(time.Hour)
+	assert.False(t, cb.Status()[0].Suppressed)
+	cb.metrics = statsNetErrors(0.9)
+
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, cbState(stateTripped), cb.state)
+
+	// Only the trip after the window has a side effect.
+	assert.Eventually(t, func() bool { return onTripped.count.Load() == 1 }, 5*time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int64(1), onTripped.count.Load())
+}
+
+func TestCircuitBreaker_maintenanceWindowRecovery(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	cb, err := New(handler, triggerNetRatio, CheckPeriod(clock.Microsecond), MaintenanceWindows([]Window{nightlyWindow}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	// Tripped before the window.
+	clock.Advance(3 * time.Minute)
+	cb.metrics = statsNetErrors(0.9)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), cb.state)
+
+	// Recovering during the window, the errors persisting.
+	clock.Advance(10*clock.Second + clock.Minute)
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, cbState(stateRecovering), cb.state)
+	assert.True(t, cb.Status()[0].Suppressed)
+
+	clock.Advance(5 * clock.Second)
+	cb.metrics = statsNetErrors(0.9)
+	for i := 0; i < 10; i++ {
+		_, _, err = testutils.Get(srv.URL)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, cbState(stateRecovering), cb.state)
+
+	// Back to standby.
+	clock.Advance(5*clock.Second + clock.Millisecond)
+	re, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, cbState(stateStandby), cb.state)
+}
+
+func TestCircuitBreaker_conditionGate(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	var open atomic.Bool
+	cb, err := New(handler, triggerNetRatio, CheckPeriod(clock.Microsecond), Classifier(ClassifyByProto),
+		ConditionGate(func(now time.Time) bool {
+			assert.Equal(t, clock.Now(), now)
+			return open.Load()
+		}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	// The classes share the gate.
+	class := cb.Status()[0]
+	assert.True(t, class.Suppressed)
+	cb.classes.all()[0].metrics = statsNetErrors(0.9)
+
+	clock.Advance(clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "standby", cb.Status()[0].State)
+
+	open.Store(true)
+	clock.Advance(clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "tripped", cb.Status()[0].State)
+	assert.False(t, cb.Status()[0].Suppressed)
+}
+
+func TestWindow_contains(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc     string
+		window   Window
+		now      time.Time
+		expected bool
+	}{
+		{
+			desc:     "inside",
+			window:   Window{Weekday: time.Sunday, Start: 2 * time.Hour, Duration: time.Hour},
+			now:      time.Date(2012, 3, 4, 2, 30, 0, 0, time.UTC),
+			expected: true,
+		},
+		{
+			desc:   "end excluded",
+			window: Window{Weekday: time.Sunday, Start: 2 * time.Hour, Duration: time.Hour},
+			now:    time.Date(2012, 3, 4, 3, 0, 0, 0, time.UTC),
+		},
+		{
+			desc:   "other day",
+			window: Window{Weekday: time.Monday, Start: 2 * time.Hour, Duration: time.Hour},
+			now:    time.Date(2012, 3, 4, 2, 30, 0, 0, time.UTC),
+		},
+		{
+			desc:     "over midnight",
+			window:   Window{Weekday: time.Saturday, Start: 23 * time.Hour, Duration: 2 * time.Hour},
+			now:      time.Date(2012, 3, 4, 0, 30, 0, 0, time.UTC),
+			expected: true,
+		},
+		{
+			desc:     "over the end of the week",
+			window:   Window{Weekday: time.Saturday, Start: 23 * time.Hour, Duration: 26 * time.Hour},
+			now:      time.Date(2012, 3, 5, 0, 30, 0, 0, time.UTC),
+			expected: true,
+		},
+		{
+			desc:     "location",
+			window:   Window{Weekday: time.Sunday, Start: 2 * time.Hour, Duration: time.Hour, Location: paris},
+			now:      time.Date(2012, 3, 4, 1, 30, 0, 0, time.UTC),
+			expected: true,
+		},
+		{
+			desc:   "location, UTC time",
+			window: Window{Weekday: time.Sunday, Start: 2 * time.Hour, Duration: time.Hour, Location: paris},
+			now:    time.Date(2012, 3, 4, 2, 30, 0, 0, time.UTC),
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.window.contains(test.now))
+		})
+	}
+}
+
+func TestMaintenanceWindows_invalid(t *testing.T) {
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+	for _, w := range []Window{
+		{Weekday: 7, Duration: time.Hour},
+		{Start: -time.Hour, Duration: time.Hour},
+		{Start: 24 * time.Hour, Duration: time.Hour},
+		{Duration: 0},
+		{Duration: 8 * 24 * time.Hour},
+	} {
+		_, err := New(handler, triggerNetRatio, MaintenanceWindows([]Window{w}))
+		assert.Error(t, err, "%+v", w)
+	}
+
+	_, err := New(handler, triggerNetRatio, ConditionGate(nil))
+	assert.Error(t, err)
+}
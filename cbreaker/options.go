@@ -1,9 +1,16 @@
 package cbreaker
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strings"
+	"text/template"
 	"time"
 
+	"github.com/vulcand/oxy/v2/memmetrics"
 	"github.com/vulcand/oxy/v2/utils"
 )
 
@@ -53,6 +60,65 @@ func CheckPeriod(d time.Duration) Option {
 	}
 }
 
+// GracePeriod prevents the condition from tripping the CircuitBreaker for d after it is created or Reset,
+// e.g. so that a connection error while the backend warms up after a deploy does not trip it with almost no data.
+// Status reports the "warming" state during the grace period.
+func GracePeriod(d time.Duration) Option {
+	return func(c *CircuitBreaker) error {
+		if d < 0 {
+			return fmt.Errorf("invalid grace period: %v", d)
+		}
+		c.gracePeriod = d
+		return nil
+	}
+}
+
+// RequireMetricsReady defers the evaluation of the condition in the Standby state until the metrics
+// have samples over their whole window, see memmetrics.RTMetrics.IsReady.
+// As the metrics are reset when the CircuitBreaker trips, it applies again once it is back in the Standby state.
+// Status reports the "warming" state until the metrics are ready.
+func RequireMetricsReady(require bool) Option {
+	return func(c *CircuitBreaker) error {
+		c.requireMetricsReady = require
+		return nil
+	}
+}
+
+// ConditionGate prevents the condition from tripping the CircuitBreaker while gate returns false for the current time,
+// e.g. during planned maintenances (see MaintenanceWindows). The suppressed trips have no effect at all:
+// no state change, no event and no SideEffect. A tripped or recovering CircuitBreaker still goes back to the Standby state,
+// and the AdaptiveShedding still applies. Status reports the suppression.
+func ConditionGate(gate func(now time.Time) bool) Option {
+	return func(c *CircuitBreaker) error {
+		if gate == nil {
+			return errors.New("condition gate can't be nil")
+		}
+		c.gate = gate
+		return nil
+	}
+}
+
+// MaintenanceWindows is a ConditionGate suppressing the trips during the weekly windows.
+func MaintenanceWindows(windows []Window) Option {
+	return func(c *CircuitBreaker) error {
+		for _, w := range windows {
+			if err := w.validate(); err != nil {
+				return err
+			}
+		}
+		windows = append([]Window(nil), windows...)
+
+		return ConditionGate(func(now time.Time) bool {
+			for _, w := range windows {
+				if w.contains(now) {
+					return false
+				}
+			}
+			return true
+		})(c)
+	}
+}
+
 // OnTripped sets a SideEffect to run when entering the Tripped state.
 // Only one SideEffect can be set for this hook.
 func OnTripped(s SideEffect) Option {
@@ -71,11 +137,200 @@ func OnStandby(s SideEffect) Option {
 	}
 }
 
+// Classifier buckets the requests into named classes, e.g. by path or method.
+// Each class has its own metrics and state: the condition is evaluated per class,
+// and the fallback only applies to the requests of a tripped class.
+func Classifier(fn func(*http.Request) string) Option {
+	return func(c *CircuitBreaker) error {
+		if fn == nil {
+			return errors.New("classifier can't be nil")
+		}
+		c.classifier = fn
+		return nil
+	}
+}
+
+// ClassifyByProto is a Classifier bucketing the requests by the protocol of the client, e.g. "HTTP/2.0".
+func ClassifyByProto(req *http.Request) string {
+	return req.Proto
+}
+
+// NetworkErrorClassifier sets the function deciding which responses count as network errors in the metrics.
+// The function receives the typed upstream error of the forwarder (see forward.ErrorFromContext), if any.
+func NetworkErrorClassifier(fn memmetrics.ErrorClassifier) Option {
+	return func(c *CircuitBreaker) error {
+		if fn == nil {
+			return errors.New("network error classifier can't be nil")
+		}
+		c.errorClassifier = fn
+		return nil
+	}
+}
+
+// IgnoreStatuses excludes the responses with the given status codes from the metrics, e.g. 101 and 204,
+// so that they do not skew the ratios and the latency quantiles.
+// The hijacked connections (e.g. websockets) are always excluded.
+func IgnoreStatuses(codes ...int) Option {
+	return func(c *CircuitBreaker) error {
+		for _, code := range codes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("invalid status code %d", code)
+			}
+		}
+
+		c.ignoredStatuses = make(map[int]struct{}, len(codes))
+		for _, code := range codes {
+			c.ignoredStatuses[code] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// WithInitialState restores the state exported by ExportState, e.g. from the instance being replaced,
+// so that a tripped circuit breaker stays tripped until the recorded time instead of starting in standby.
+func WithInitialState(s StateSnapshot) Option {
+	return func(c *CircuitBreaker) error {
+		c.initialState = &s
+		return nil
+	}
+}
+
+// AdaptiveShedding sheds a fraction of the requests to the fallback in the standby state,
+// when the metric of the condition is above opts.StartRatio but has not reached the trip threshold yet:
+// the fraction grows linearly up to opts.MaxShedFraction at the threshold, which often prevents the trip.
+// The condition must compare a single ratio with a constant, e.g. NetworkErrorRatio() > 0.5.
+// The shed requests are not recorded in the metrics, and the shed fraction is updated every CheckPeriod, see Status.
+func AdaptiveShedding(opts SheddingOptions) Option {
+	return func(c *CircuitBreaker) error {
+		if opts.StartRatio < 0 {
+			return fmt.Errorf("shedding start ratio should be >= 0, got %v", opts.StartRatio)
+		}
+		if opts.MaxShedFraction <= 0 || opts.MaxShedFraction > 1 {
+			return fmt.Errorf("max shed fraction should be in (0, 1], got %v", opts.MaxShedFraction)
+		}
+		c.sheddingOptions = &opts
+		return nil
+	}
+}
+
+// MaxClasses sets the maximum number of classes tracked when a Classifier is set.
+// When the maximum is reached, the least recently used class is evicted.
+func MaxClasses(n int) Option {
+	return func(c *CircuitBreaker) error {
+		if n <= 0 {
+			return fmt.Errorf("max classes should be > 0 got %d", n)
+		}
+		c.maxClasses = n
+		return nil
+	}
+}
+
+// Name sets the name identifying the CircuitBreaker in the events.
+func Name(name string) Option {
+	return func(c *CircuitBreaker) error {
+		c.name = name
+		return nil
+	}
+}
+
+// EventLog writes the state transitions to w, JSON-encoded one per line.
+// The events are written asynchronously, write errors are logged.
+func EventLog(w io.Writer) Option {
+	return func(c *CircuitBreaker) error {
+		if w == nil {
+			return errors.New("event log writer can't be nil")
+		}
+		c.eventWriter = w
+		return nil
+	}
+}
+
+// OnEvent sets a function called asynchronously on every state transition.
+func OnEvent(fn func(Event)) Option {
+	return func(c *CircuitBreaker) error {
+		if fn == nil {
+			return errors.New("event handler can't be nil")
+		}
+		c.eventHandler = fn
+		return nil
+	}
+}
+
 // Fallback defines the http.Handler that the CircuitBreaker should route
 // requests to when it prevents a request from taking its normal path.
+// It is a FallbackChain of a single handler.
 func Fallback(h http.Handler) Option {
 	return func(c *CircuitBreaker) error {
-		c.fallback = h
+		c.fallbacks = []http.Handler{h}
+		return nil
+	}
+}
+
+// FallbackChain sets the handlers that the CircuitBreaker routes the requests to when it prevents them from taking
+// their normal path, e.g. a read-only replica, then a static response.
+// The handlers are tried in order: the response of a handler is only sent to the client once its status code is 2xx or 3xx,
+// within the FallbackLinkTimeout, otherwise its status code, headers and body are discarded and the next handler is tried.
+// The response of the last handler is always sent as is.
+// Each handler receives the whole body of the request: without GetBody, the body is read in memory first,
+// see the buffer package to limit its size.
+// The responses of the handlers are not recorded in the metrics of the condition, but in their own, see FallbackErrorRatio.
+func FallbackChain(handlers ...http.Handler) Option {
+	return func(c *CircuitBreaker) error {
+		if len(handlers) == 0 {
+			return errors.New("the fallback chain can't be empty")
+		}
+		for _, h := range handlers {
+			if h == nil {
+				return errors.New("the fallback handlers can't be nil")
+			}
+		}
+		c.fallbacks = handlers
+		return nil
+	}
+}
+
+// FallbackLinkTimeout sets how long a handler of the FallbackChain, except the last one, has to answer successfully:
+// the request context of the handler is then canceled and the next handler is tried.
+// There is no timeout by default.
+func FallbackLinkTimeout(d time.Duration) Option {
+	return func(c *CircuitBreaker) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid fallback link timeout: %v", d)
+		}
+		c.fallbackLinkTimeout = d
+		return nil
+	}
+}
+
+// FallbackStatusOverride replaces the status code of the responses of the fallback, whatever the fallback handler,
+// e.g. http.StatusTooManyRequests. The Retry-After header is still added to the responses.
+func FallbackStatusOverride(code int) Option {
+	return func(c *CircuitBreaker) error {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid fallback status code: %d", code)
+		}
+		c.fallbackStatus = code
+		return nil
+	}
+}
+
+// OnFallbackUnhealthy calls fn when the fallback is failing too: once per trip, as soon as at least minSamples
+// requests have been sent to the fallback since the CircuitBreaker tripped, and more than threshold of them
+// were answered with a 5xx or an upstream error. With a Classifier, the trips of every class are watched.
+// fn is called in its own goroutine, e.g. to page someone: the clients are then served errors whatever the state.
+// The default fallback answers 503, it is meant to be used with a Fallback or a FallbackChain.
+func OnFallbackUnhealthy(threshold float64, minSamples int64, fn func()) Option {
+	return func(c *CircuitBreaker) error {
+		if threshold < 0 || threshold >= 1 {
+			return fmt.Errorf("invalid fallback error threshold: %v, must be in [0, 1)", threshold)
+		}
+		if minSamples < 1 {
+			return fmt.Errorf("invalid fallback min samples: %d, must be at least 1", minSamples)
+		}
+		if fn == nil {
+			return errors.New("fallback unhealthy callback can't be nil")
+		}
+		c.fallbackHealth = &fallbackHealth{threshold: threshold, minSamples: minSamples, fn: fn}
 		return nil
 	}
 }
@@ -99,6 +354,58 @@ func ResponseFallbackDebug(debug bool) ResponseFallbackOption {
 	}
 }
 
+// FallbackTemplates sets the templates used to render the fallback body, keyed by content type.
+// The keys are matched by media type, case-insensitively and without their parameters (e.g. "Application/JSON; charset=utf-8"
+// matches "application/json"), the normalized key being the Content-Type of the rendered responses.
+// Invalid keys, and keys with the same media type, are rejected.
+// The template is selected by negotiation with the Accept header of the request,
+// the static body is used when no template matches or when the template execution fails.
+// Templates are executed with FallbackData, whose RequestID and Path come from the client:
+// the templates of the HTML types (text/html, application/xhtml+xml) are executed with html/template,
+// which escapes the values by context, and the values passed to the templates of the JSON types
+// (application/json, */*+json) are escaped for the content of a JSON string, e.g. {"id":"{{.RequestID}}"}.
+// The functions added with Funcs are not available to the templates of the HTML types.
+func FallbackTemplates(templates map[string]*template.Template) ResponseFallbackOption {
+	return func(c *ResponseFallback) error {
+		c.templates = make(map[string]contentTemplate, len(templates))
+		for ct, tmpl := range templates {
+			if tmpl == nil {
+				return fmt.Errorf("nil template for content type %q", ct)
+			}
+
+			mediaType, params, err := mime.ParseMediaType(ct)
+			if err == nil && !strings.Contains(mediaType, "/") {
+				err = errors.New("missing subtype")
+			}
+			if err != nil {
+				return fmt.Errorf("invalid content type %q: %w", ct, err)
+			}
+			if other, ok := c.templates[mediaType]; ok {
+				return fmt.Errorf("content types %q and %q have the same media type", other.contentType, ct)
+			}
+
+			t, err := newFallbackTemplate(mediaType, tmpl)
+			if err != nil {
+				return fmt.Errorf("invalid template for content type %q: %w", ct, err)
+			}
+			c.templates[mediaType] = contentTemplate{contentType: mime.FormatMediaType(mediaType, params), tmpl: t}
+		}
+		return nil
+	}
+}
+
+// FallbackRequestIDHeader sets the header used to fill the RequestID of the fallback templates,
+// when the context of the request does not carry its ID (see utils.WithRequestID).
+func FallbackRequestIDHeader(name string) ResponseFallbackOption {
+	return func(c *ResponseFallback) error {
+		if name == "" {
+			return errors.New("request ID header name can't be empty")
+		}
+		c.requestIDHeader = http.CanonicalHeaderKey(name)
+		return nil
+	}
+}
+
 // RedirectFallbackOption represents an option you can pass to NewRedirectFallback.
 type RedirectFallbackOption func(*RedirectFallback) error
 
@@ -48,12 +48,9 @@ type toFloat64 func(c *CircuitBreaker) float64
 
 func latencyAtQuantile(quantile float64) toInt {
 	return func(c *CircuitBreaker) int {
-		h, err := c.metrics.LatencyHistogram()
-		if err != nil {
-			c.log.Error("Failed to get latency histogram, for %v error: %v", c, err)
-			return 0
-		}
-		return int(h.LatencyAtQuantile(quantile) / clock.Millisecond)
+		// The histogram is merged at most once per check period.
+		s := c.metrics.LatencySummary(c.checkPeriod)
+		return int(s.LatencyAtQuantile(quantile) / clock.Millisecond)
 	}
 }
 
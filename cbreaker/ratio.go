@@ -24,7 +24,7 @@ type ratioController struct {
 func newRatioController(rampUp time.Duration, log utils.Logger) *ratioController {
 	return &ratioController{
 		duration: rampUp,
-		start:    clock.Now().UTC(),
+		start:    clock.Now(),
 		log:      log,
 	}
 }
@@ -66,5 +66,5 @@ func (r *ratioController) targetRatio() float64 {
 	// after this point to achieve ratio of 1 (that can never be reached unless d is 0)
 	// so we stop from there
 	multiplier := 0.5 / float64(r.duration)
-	return multiplier * float64(clock.Now().UTC().Sub(r.start))
+	return multiplier * float64(clock.Since(r.start))
 }
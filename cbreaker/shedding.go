@@ -0,0 +1,135 @@
+package cbreaker
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/vulcand/predicate"
+)
+
+// shedScale is the resolution of the shedding sampler: the shed fraction is rounded to 1/shedScale.
+const shedScale = 1_000_000
+
+// SheddingOptions configures AdaptiveShedding.
+type SheddingOptions struct {
+	// StartRatio is the value of the metric of the condition above which the requests start to be shed.
+	StartRatio float64
+	// MaxShedFraction is the fraction of the requests shed when the metric reaches the trip threshold.
+	MaxShedFraction float64
+}
+
+// shedding computes the fraction of the requests to shed from the metric of the condition.
+type shedding struct {
+	opts SheddingOptions
+	// metric and threshold are the operands of the condition, e.g. NetworkErrorRatio() > 0.5.
+	metric    toFloat64
+	threshold float64
+}
+
+func newShedding(opts SheddingOptions, expression string) (*shedding, error) {
+	metric, threshold, err := parseThreshold(expression)
+	if err != nil {
+		return nil, fmt.Errorf("adaptive shedding: %w", err)
+	}
+	if opts.StartRatio >= threshold {
+		return nil, fmt.Errorf("adaptive shedding: start ratio %v should be lower than the trip threshold %v", opts.StartRatio, threshold)
+	}
+	return &shedding{opts: opts, metric: metric, threshold: threshold}, nil
+}
+
+// fraction returns the fraction of the requests to shed for the current metrics of c:
+// it grows linearly from 0 at StartRatio to MaxShedFraction at the trip threshold.
+func (s *shedding) fraction(c *CircuitBreaker) float64 {
+	value := s.metric(c)
+	if value <= s.opts.StartRatio {
+		return 0
+	}
+	return math.Min(s.opts.MaxShedFraction, (value-s.opts.StartRatio)/(s.threshold-s.opts.StartRatio)*s.opts.MaxShedFraction)
+}
+
+// updateShedFraction sets the fraction of the requests to shed. The requests are only shed in the standby state.
+// It must be called with the lock held.
+func (c *CircuitBreaker) updateShedFraction() {
+	if c.shedding == nil {
+		return
+	}
+
+	fraction := 0.0
+	if c.state == stateStandby {
+		fraction = c.shedding.fraction(c)
+	}
+
+	if fraction != c.shedFraction {
+		c.log.Debug("%v shedding %.3f of the requests", c, fraction)
+	}
+	c.shedFraction = fraction
+}
+
+// shed returns true if the request should be shed to the fallback.
+// The requests are sampled with a counter rather than randomly: exactly the shed fraction of the requests is shed.
+func (c *CircuitBreaker) shed() bool {
+	if c.shedding == nil {
+		return false
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.state != stateStandby || c.shedFraction == 0 {
+		return false
+	}
+
+	c.shedCredit += int64(math.Round(c.shedFraction * shedScale))
+	if c.shedCredit < shedScale {
+		return false
+	}
+	c.shedCredit -= shedScale
+	return true
+}
+
+// threshold is a comparison of a metric with a constant.
+type threshold struct {
+	metric toFloat64
+	value  float64
+}
+
+// parseThreshold returns the metric and the threshold of a condition comparing a ratio with a constant,
+// e.g. NetworkErrorRatio() > 0.5.
+func parseThreshold(expression string) (toFloat64, float64, error) {
+	compare := func(m interface{}, value interface{}) (*threshold, error) {
+		metric, ok := m.(toFloat64)
+		if !ok {
+			return nil, errors.New("the condition should compare a ratio, e.g. NetworkErrorRatio()")
+		}
+		v, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("expected float64, got %T", value)
+		}
+		return &threshold{metric: metric, value: v}, nil
+	}
+
+	p, err := predicate.NewParser(predicate.Def{
+		Operators: predicate.Operators{
+			GT: compare,
+			GE: compare,
+		},
+		Functions: map[string]interface{}{
+			"LatencyAtQuantileMS": latencyAtQuantile,
+			"NetworkErrorRatio":   networkErrorRatio,
+			"ResponseCodeRatio":   responseCodeRatio,
+		},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	out, err := p.Parse(expression)
+	if err != nil {
+		return nil, 0, fmt.Errorf("the condition should be a single ratio > threshold: %w", err)
+	}
+	t, ok := out.(*threshold)
+	if !ok {
+		return nil, 0, fmt.Errorf("the condition should be a single ratio > threshold, got %T", out)
+	}
+	return t.metric, t.value, nil
+}
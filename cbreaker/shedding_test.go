@@ -0,0 +1,118 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+const triggerErrorRatio = `ResponseCodeRatio(500, 600, 0, 600) > 0.5`
+
+func serveCodes(h http.Handler, n int) map[int]int {
+	codes := make(map[int]int)
+	for i := 0; i < n; i++ {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		codes[rw.Code]++
+	}
+	return codes
+}
+
+func TestCircuitBreaker_adaptiveShedding(t *testing.T) {
+	// The upstream fails 2 requests out of 5 until it recovers.
+	var served, recovered atomic.Int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if n := served.Add(1); recovered.Load() == 0 && (n%5 == 4 || n%5 == 0) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	cb, err := New(handler, triggerErrorRatio, AdaptiveShedding(SheddingOptions{StartRatio: 0.2, MaxShedFraction: 0.6}))
+	require.NoError(t, err)
+
+	// The condition is checked after the first response only.
+	assert.Equal(t, map[int]int{http.StatusOK: 3, http.StatusInternalServerError: 2}, serveCodes(cb, 5))
+	assert.Equal(t, map[int]int{http.StatusOK: 27, http.StatusInternalServerError: 17}, serveCodes(cb, 44))
+
+	// The error ratio is 40%: (0.4 - 0.2) / (0.5 - 0.2) * 0.6 = 40% of the requests are shed.
+	clock.Advance(defaultCheckPeriod + clock.Millisecond)
+	assert.Equal(t, map[int]int{http.StatusInternalServerError: 1}, serveCodes(cb, 1))
+	status := cb.Status()
+	require.Len(t, status, 1)
+	assert.Equal(t, "standby", status[0].State)
+	assert.InDelta(t, 0.4, status[0].ShedFraction, 1e-9)
+
+	codes := serveCodes(cb, 100)
+	assert.Equal(t, 40, codes[http.StatusServiceUnavailable])
+	assert.Equal(t, 60, codes[http.StatusOK]+codes[http.StatusInternalServerError])
+
+	// The shed requests are not recorded, and the circuit breaker never trips.
+	assert.Equal(t, int64(110), cb.metrics.TotalCount())
+	clock.Advance(defaultCheckPeriod + clock.Millisecond)
+	serveCodes(cb, 100)
+	assert.Equal(t, cbState(stateStandby), cb.state)
+
+	// The upstream recovers: shedding stops once the errors are out of the window of the metrics.
+	recovered.Store(1)
+	clock.Advance(10*clock.Second + clock.Millisecond)
+	assert.Equal(t, map[int]int{http.StatusOK: 1}, serveCodes(cb, 1))
+	assert.Equal(t, []Status{{State: "standby"}}, cb.Status())
+	assert.Equal(t, map[int]int{http.StatusOK: 100}, serveCodes(cb, 100))
+}
+
+func TestCircuitBreaker_adaptiveSheddingTripped(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	cb, err := New(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}), triggerErrorRatio, AdaptiveShedding(SheddingOptions{StartRatio: 0.2, MaxShedFraction: 1}))
+	require.NoError(t, err)
+
+	serveCodes(cb, 1)
+	assert.Equal(t, cbState(stateTripped), cb.state)
+
+	status := cb.Status()
+	require.Len(t, status, 1)
+	assert.Zero(t, status[0].ShedFraction)
+}
+
+func TestCircuitBreaker_adaptiveSheddingOptions(t *testing.T) {
+	opts := SheddingOptions{StartRatio: 0.2, MaxShedFraction: 0.5}
+
+	_, err := New(nil, triggerNetRatio, AdaptiveShedding(opts))
+	require.NoError(t, err)
+
+	_, err = New(nil, `NetworkErrorRatio() >= 0.5`, AdaptiveShedding(opts))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc       string
+		expression string
+		opts       SheddingOptions
+	}{
+		{desc: "negative start ratio", expression: triggerNetRatio, opts: SheddingOptions{StartRatio: -1, MaxShedFraction: 0.5}},
+		{desc: "no max shed fraction", expression: triggerNetRatio, opts: SheddingOptions{StartRatio: 0.2}},
+		{desc: "max shed fraction above 1", expression: triggerNetRatio, opts: SheddingOptions{StartRatio: 0.2, MaxShedFraction: 2}},
+		{desc: "start ratio above the threshold", expression: triggerNetRatio, opts: SheddingOptions{StartRatio: 0.5, MaxShedFraction: 0.5}},
+		{desc: "latency", expression: `LatencyAtQuantileMS(50.0) > 50`, opts: opts},
+		{desc: "lower than", expression: `NetworkErrorRatio() < 0.5`, opts: opts},
+		{desc: "several comparisons", expression: `NetworkErrorRatio() > 0.5 || ResponseCodeRatio(500, 600, 0, 600) > 0.5`, opts: opts},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(nil, test.expression, AdaptiveShedding(test.opts))
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package cbreaker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vulcand/oxy/v2/memmetrics"
+)
+
+// StateSnapshot is the JSON-serializable state of a circuit breaker,
+// to hand it over to a new instance (e.g. on a config reload or a blue/green cutover), see WithInitialState.
+// The times are absolute: a restored circuit breaker behaves as if the transitions happened at the recorded times.
+type StateSnapshot struct {
+	// Class is the class of requests, see Classifier.
+	Class string `json:"class,omitempty"`
+	State string `json:"state"`
+	// Until is the time until which the circuit breaker stays in the tripped or recovering state.
+	Until time.Time `json:"until"`
+	// Recovery is the progress of the recovery, only set in the recovering state.
+	Recovery *RecoverySnapshot            `json:"recovery,omitempty"`
+	Metrics  memmetrics.RTMetricsSnapshot `json:"metrics"`
+	// Classes holds the state of every class of requests when a Classifier is set.
+	Classes []StateSnapshot `json:"classes,omitempty"`
+}
+
+// RecoverySnapshot is the progress of the recovery of a circuit breaker.
+type RecoverySnapshot struct {
+	Start   time.Time `json:"start"`
+	Allowed int       `json:"allowed"`
+	Denied  int       `json:"denied"`
+}
+
+// ExportState returns the state of the circuit breaker, and of its classes of requests when a Classifier is set.
+func (c *CircuitBreaker) ExportState() StateSnapshot {
+	s := c.exportState()
+
+	if c.classifier != nil {
+		for _, cb := range c.classes.all() {
+			s.Classes = append(s.Classes, cb.exportState())
+		}
+	}
+
+	return s
+}
+
+func (c *CircuitBreaker) exportState() StateSnapshot {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	s := StateSnapshot{
+		Class:   c.class,
+		State:   c.state.String(),
+		Metrics: c.metrics.Snapshot(),
+	}
+
+	if c.state != stateStandby {
+		s.Until = c.until
+	}
+
+	if c.state == stateRecovering && c.rc != nil {
+		s.Recovery = &RecoverySnapshot{Start: c.rc.start, Allowed: c.rc.allowed, Denied: c.rc.denied}
+	}
+
+	return s
+}
+
+// restoreState sets the state of the circuit breaker and of its classes, see WithInitialState.
+func (c *CircuitBreaker) restoreState(s StateSnapshot) error {
+	if len(s.Classes) > 0 && c.classifier == nil {
+		return fmt.Errorf("snapshot has %d classes but no classifier is set", len(s.Classes))
+	}
+
+	if err := c.restore(s); err != nil {
+		return err
+	}
+
+	for _, cs := range s.Classes {
+		cb, err := c.classes.get(cs.Class, c.newClass(cs.Class))
+		if err != nil {
+			return err
+		}
+		if err := cb.restore(cs); err != nil {
+			return fmt.Errorf("class %q: %w", cs.Class, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *CircuitBreaker) restore(s StateSnapshot) error {
+	state, err := parseState(s.State)
+	if err != nil {
+		return err
+	}
+
+	if state != stateStandby && s.Until.IsZero() {
+		return fmt.Errorf("%v state without until time", state)
+	}
+
+	if state == stateRecovering && s.Recovery == nil {
+		return fmt.Errorf("%v state without recovery progress", state)
+	}
+
+	if err := c.metrics.Restore(s.Metrics); err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.state = state
+	c.until = time.Time{}
+	c.rc = nil
+
+	if state != stateStandby {
+		c.until = s.Until.UTC()
+	}
+
+	if state == stateRecovering {
+		c.rc = newRatioController(c.recoveryDuration, c.log)
+		c.rc.start = s.Recovery.Start.UTC()
+		c.rc.allowed = s.Recovery.Allowed
+		c.rc.denied = s.Recovery.Denied
+	}
+
+	return nil
+}
+
+func parseState(s string) (cbState, error) {
+	for _, state := range []cbState{stateStandby, stateTripped, stateRecovering} {
+		if state.String() == s {
+			return state, nil
+		}
+	}
+	return stateStandby, fmt.Errorf("unknown circuit breaker state %q", s)
+}
@@ -0,0 +1,177 @@
+package cbreaker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestCircuitBreaker_restoreTripped(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	old, err := New(handler, triggerNetRatio, CheckPeriod(clock.Microsecond))
+	require.NoError(t, err)
+
+	oldSrv := httptest.NewServer(old)
+	t.Cleanup(oldSrv.Close)
+
+	old.metrics = statsNetErrors(0.6)
+	_, _, err = testutils.Get(oldSrv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), old.state)
+
+	clock.Advance(4 * clock.Second)
+
+	// The snapshot is handed over as JSON, e.g. through a file.
+	s := exportJSON(t, old)
+
+	cb, err := New(handler, triggerNetRatio, CheckPeriod(clock.Microsecond), WithInitialState(s))
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateTripped), cb.state)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	// The fallback duration started when the old instance tripped.
+	clock.Advance(5 * clock.Second)
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, cbState(stateTripped), cb.state)
+
+	clock.Advance(clock.Second + clock.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, cbState(stateRecovering), cb.state)
+	assert.Equal(t, clock.Now().UTC().Add(defaultRecoveryDuration), cb.until)
+}
+
+func TestCircuitBreaker_restoreRecovering(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	testutils.FreezeTime(t)
+
+	old, err := New(handler, triggerNetRatio, CheckPeriod(clock.Microsecond))
+	require.NoError(t, err)
+
+	oldSrv := httptest.NewServer(old)
+	t.Cleanup(oldSrv.Close)
+
+	old.metrics = statsNetErrors(0.6)
+	_, _, err = testutils.Get(oldSrv.URL)
+	require.NoError(t, err)
+
+	clock.Advance(defaultFallbackDuration + clock.Millisecond)
+	_, _, err = testutils.Get(oldSrv.URL)
+	require.NoError(t, err)
+	require.Equal(t, cbState(stateRecovering), old.state)
+
+	clock.Advance(5 * clock.Second)
+	for i := 0; i < 10; i++ {
+		_, _, err = testutils.Get(oldSrv.URL)
+		require.NoError(t, err)
+	}
+
+	s := exportJSON(t, old)
+	require.NotNil(t, s.Recovery)
+	assert.Equal(t, old.rc.allowed, s.Recovery.Allowed)
+	assert.Equal(t, old.rc.denied, s.Recovery.Denied)
+
+	cb, err := New(handler, triggerNetRatio, CheckPeriod(clock.Microsecond), WithInitialState(s))
+	require.NoError(t, err)
+
+	assert.Equal(t, cbState(stateRecovering), cb.state)
+	assert.Equal(t, old.until, cb.until)
+	assert.Equal(t, old.rc.start, cb.rc.start)
+	assert.InDelta(t, old.rc.targetRatio(), cb.rc.targetRatio(), 0.0001)
+
+	srv := httptest.NewServer(cb)
+	t.Cleanup(srv.Close)
+
+	// The recovery ends when it would have ended on the old instance.
+	clock.Advance(defaultRecoveryDuration - 5*clock.Second + clock.Millisecond)
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, cbState(stateStandby), cb.state)
+}
+
+func TestCircuitBreaker_restoreMetrics(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	old, err := New(nil, triggerNetRatio)
+	require.NoError(t, err)
+	old.metrics = statsNetErrors(0.4)
+
+	cb, err := New(nil, triggerNetRatio, WithInitialState(exportJSON(t, old)))
+	require.NoError(t, err)
+
+	assert.Equal(t, cbState(stateStandby), cb.state)
+	assert.Equal(t, old.metrics.TotalCount(), cb.metrics.TotalCount())
+	assert.Equal(t, old.metrics.NetworkErrorCount(), cb.metrics.NetworkErrorCount())
+	assert.Equal(t, old.metrics.StatusCodesCounts(), cb.metrics.StatusCodesCounts())
+
+	// A few more errors trip the restored circuit breaker.
+	for i := 0; i < 30; i++ {
+		cb.metrics.Record(http.StatusBadGateway, 0)
+	}
+	clock.Advance(defaultCheckPeriod + clock.Millisecond)
+	cb.checkAndSet()
+	assert.Equal(t, cbState(stateTripped), cb.state)
+}
+
+func TestCircuitBreaker_restoreClasses(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	old, err := New(nil, triggerNetRatio, Classifier(byPath))
+	require.NoError(t, err)
+
+	slow := old.classOf(httptest.NewRequest(http.MethodGet, "/slow", nil))
+	slow.m.Lock()
+	slow.setState(stateTripped, clock.Now().UTC().Add(defaultFallbackDuration))
+	slow.m.Unlock()
+	old.classOf(httptest.NewRequest(http.MethodGet, "/fast", nil))
+
+	cb, err := New(nil, triggerNetRatio, Classifier(byPath), WithInitialState(exportJSON(t, old)))
+	require.NoError(t, err)
+
+	assert.Equal(t, old.Status(), cb.Status())
+
+	_, err = New(nil, triggerNetRatio, WithInitialState(exportJSON(t, old)))
+	require.Error(t, err)
+}
+
+func TestCircuitBreaker_invalidInitialState(t *testing.T) {
+	_, err := New(nil, triggerNetRatio, WithInitialState(StateSnapshot{State: "unknown"}))
+	require.Error(t, err)
+
+	_, err = New(nil, triggerNetRatio, WithInitialState(StateSnapshot{State: "tripped"}))
+	require.Error(t, err)
+
+	_, err = New(nil, triggerNetRatio, WithInitialState(StateSnapshot{State: "recovering", Until: clock.Now()}))
+	require.Error(t, err)
+}
+
+// exportJSON exports the state of the circuit breaker through a JSON round trip.
+func exportJSON(t *testing.T, cb *CircuitBreaker) StateSnapshot {
+	t.Helper()
+
+	data, err := json.Marshal(cb.ExportState())
+	require.NoError(t, err)
+
+	var s StateSnapshot
+	require.NoError(t, json.Unmarshal(data, &s))
+	return s
+}
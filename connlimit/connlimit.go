@@ -27,6 +27,7 @@ type ConnLimiter struct {
 }
 
 // New creates a new ConnLimiter.
+// next can be nil, and set later with Wrap.
 func New(next http.Handler, extract utils.SourceExtractor, maxConnections int64, options ...Option) (*ConnLimiter, error) {
 	if extract == nil {
 		return nil, errors.New("extract function can not be nil")
@@ -57,21 +58,30 @@ func New(next http.Handler, extract utils.SourceExtractor, maxConnections int64,
 	return cl, nil
 }
 
-// Wrap sets the next handler to be called by connection limiter handler.
-func (cl *ConnLimiter) Wrap(h http.Handler) {
+// Wrap sets the next handler to be called by connection limiter handler, when it was created without.
+func (cl *ConnLimiter) Wrap(h http.Handler) error {
+	if err := utils.CheckWrap(cl.next, h); err != nil {
+		return err
+	}
 	cl.next = h
+	return nil
 }
 
 func (cl *ConnLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if cl.next == nil {
+		utils.ServeError(cl.errHandler, w, r, "connlimit", &utils.ErrNotWired{Middleware: "connlimit"})
+		return
+	}
+
 	token, amount, err := cl.extract.Extract(r)
 	if err != nil {
 		cl.log.Error("failed to extract source of the connection: %v", err)
-		cl.errHandler.ServeHTTP(w, r, err)
+		utils.ServeError(cl.errHandler, w, r, "connlimit", err)
 		return
 	}
 	if err := cl.acquire(token, amount); err != nil {
 		cl.log.Debug("limiting request source %s: %v", token, err)
-		cl.errHandler.ServeHTTP(w, r, err)
+		utils.ServeError(cl.errHandler, w, r, "connlimit", err)
 		return
 	}
 
@@ -123,14 +133,14 @@ type ConnErrHandler struct {
 }
 
 func (e *ConnErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
-	if e.debug {
+	if e.debug && utils.DebugEnabled(e.log) {
 		dump := utils.DumpHTTPRequest(req)
 		e.log.Debug("vulcand/oxy/connlimit: begin ServeHttp on request: %s", dump)
 		defer e.log.Debug("vulcand/oxy/connlimit: completed ServeHttp on request: %s", dump)
 	}
 
-	//nolint:errorlint // must be changed
-	if _, ok := err.(*MaxConnError); ok {
+	var connErr *MaxConnError
+	if errors.As(err, &connErr) {
 		w.WriteHeader(http.StatusTooManyRequests)
 		_, _ = w.Write([]byte(err.Error()))
 		return
@@ -0,0 +1,347 @@
+// Package fairqueue provides http.Handler middleware that shares a concurrency limit fairly between the sources
+// of the requests, so that a noisy source can't starve the others when the limit is reached.
+//
+// At most Concurrency requests are passed to the next handler at once. When they are all in flight,
+// the requests wait in a FIFO queue per source, and the freed slots are granted round-robin to the sources
+// having waiting requests: each active source gets an equal share of the slots, whatever its arrival rate.
+//
+// Examples of a FairQueue middleware:
+//
+//	// 100 requests in flight, up to 20 waiting requests per client IP, for at most 5 seconds.
+//	extract, _ := utils.NewExtractor("client.ip")
+//	fairqueue.New(handler, extract, fairqueue.Config{Concurrency: 100, PerSourceQueueDepth: 20, MaxWait: 5 * time.Second})
+package fairqueue
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// Config is the configuration of a FairQueue.
+type Config struct {
+	// Concurrency is the maximum number of requests passed to the next handler at once.
+	Concurrency int
+	// PerSourceQueueDepth is the maximum number of waiting requests of a source,
+	// the next ones are rejected with an ErrQueueFull. Without depth, the requests are rejected instead of waiting.
+	PerSourceQueueDepth int
+	// MaxWait is the maximum time a request waits for a slot, it is then rejected with an ErrWaitTimeout.
+	// Without MaxWait, the requests wait until their context is done.
+	MaxWait time.Duration
+}
+
+// Stats is a snapshot of the state of a FairQueue, see (*FairQueue).Stats.
+type Stats struct {
+	// InFlight is the number of requests passed to the next handler and not answered yet.
+	InFlight int
+	// Queued is the number of waiting requests.
+	Queued int
+	// QueuedBySource is the number of waiting requests of the sources having some.
+	QueuedBySource map[string]int
+	// Rejected is the number of requests rejected because the queue of their source was full.
+	Rejected uint64
+	// TimedOut is the number of requests rejected after waiting for MaxWait.
+	TimedOut uint64
+	// Canceled is the number of requests whose context was done while waiting.
+	Canceled uint64
+}
+
+// ErrQueueFull is returned when a request can't wait, the queue of its source being full.
+// The default error handler answers 429.
+type ErrQueueFull struct {
+	Source string
+	Depth  int
+}
+
+func (e *ErrQueueFull) Error() string {
+	return fmt.Sprintf("queue of source %q full: %d waiting requests", e.Source, e.Depth)
+}
+
+// ErrWaitTimeout is returned when a request waited for MaxWait without getting a slot.
+// The default error handler answers 503.
+type ErrWaitTimeout struct {
+	Wait time.Duration
+}
+
+func (e *ErrWaitTimeout) Error() string {
+	return fmt.Sprintf("no slot available after waiting %v", e.Wait)
+}
+
+// FairQueue is a middleware limiting the concurrency of the requests, and granting the slots fairly to their sources.
+type FairQueue struct {
+	next       http.Handler
+	extract    utils.SourceExtractor
+	cfg        Config
+	errHandler utils.ErrorHandler
+
+	mu       sync.Mutex
+	inFlight int
+	queued   int
+	queues   map[string]*sourceQueue
+	// ring holds the sources having waiting requests, in the order the slots are granted to them,
+	// starting from ring[cursor].
+	ring   []*sourceQueue
+	cursor int
+
+	rejected uint64
+	timedOut uint64
+	canceled uint64
+
+	verbose bool
+	log     utils.Logger
+}
+
+// sourceQueue holds the waiting requests of a source.
+type sourceQueue struct {
+	source  string
+	waiters []*waiter
+}
+
+// waiter is a waiting request, ready is closed once it is granted a slot.
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// New creates a new FairQueue. The amount returned by the extractor is ignored: a request takes a single slot.
+// next can be nil, and set later with Wrap.
+func New(next http.Handler, extract utils.SourceExtractor, cfg Config, options ...Option) (*FairQueue, error) {
+	if extract == nil {
+		return nil, errors.New("extract function can not be nil")
+	}
+	if cfg.Concurrency <= 0 {
+		return nil, fmt.Errorf("concurrency must be positive: %d", cfg.Concurrency)
+	}
+	if cfg.PerSourceQueueDepth < 0 {
+		return nil, fmt.Errorf("per source queue depth can't be negative: %d", cfg.PerSourceQueueDepth)
+	}
+	if cfg.MaxWait < 0 {
+		return nil, fmt.Errorf("max wait can't be negative: %v", cfg.MaxWait)
+	}
+
+	q := &FairQueue{
+		next:    next,
+		extract: extract,
+		cfg:     cfg,
+		queues:  make(map[string]*sourceQueue),
+		log:     &utils.NoopLogger{},
+	}
+
+	for _, o := range options {
+		if err := o(q); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.errHandler == nil {
+		q.errHandler = defaultErrHandler
+	}
+	return q, nil
+}
+
+// Wrap sets the next handler to be called by the middleware, when it was created without.
+func (q *FairQueue) Wrap(next http.Handler) error {
+	if err := utils.CheckWrap(q.next, next); err != nil {
+		return err
+	}
+	q.next = next
+	return nil
+}
+
+func (q *FairQueue) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if q.next == nil {
+		utils.ServeError(q.errHandler, w, req, "fairqueue", &utils.ErrNotWired{Middleware: "fairqueue"})
+		return
+	}
+
+	source, _, err := q.extract.Extract(req)
+	if err != nil {
+		q.log.Error("vulcand/oxy/fairqueue: failed to extract source of the request: %v", err)
+		utils.ServeError(q.errHandler, w, req, "fairqueue", err)
+		return
+	}
+
+	if err := q.acquire(req, source); err != nil {
+		if q.verbose && utils.DebugEnabled(q.log) {
+			q.log.Debug("vulcand/oxy/fairqueue: rejecting %s %s of source %s: %v", req.Method, req.URL, source, err)
+		}
+		utils.ServeError(q.errHandler, w, req, "fairqueue", err)
+		return
+	}
+	// released even if the handler panics.
+	defer q.release()
+
+	q.next.ServeHTTP(w, req)
+}
+
+// Stats returns a snapshot of the state of the queue.
+func (q *FairQueue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := Stats{
+		InFlight:       q.inFlight,
+		Queued:         q.queued,
+		QueuedBySource: make(map[string]int, len(q.ring)),
+		Rejected:       q.rejected,
+		TimedOut:       q.timedOut,
+		Canceled:       q.canceled,
+	}
+	for _, sq := range q.ring {
+		stats.QueuedBySource[sq.source] = len(sq.waiters)
+	}
+	return stats
+}
+
+// acquire takes a slot for the request, waiting in the queue of its source when they are all in flight.
+func (q *FairQueue) acquire(req *http.Request, source string) error {
+	q.mu.Lock()
+
+	if q.inFlight < q.cfg.Concurrency {
+		q.inFlight++
+		q.mu.Unlock()
+		return nil
+	}
+
+	sq := q.queues[source]
+	if sq == nil {
+		sq = &sourceQueue{source: source}
+	}
+	if len(sq.waiters) >= q.cfg.PerSourceQueueDepth {
+		q.rejected++
+		q.mu.Unlock()
+		return &ErrQueueFull{Source: source, Depth: q.cfg.PerSourceQueueDepth}
+	}
+
+	if len(sq.waiters) == 0 {
+		// the source joins the round after the sources already waiting.
+		q.queues[source] = sq
+		q.ring = append(q.ring, sq)
+	}
+	w := &waiter{ready: make(chan struct{})}
+	sq.waiters = append(sq.waiters, w)
+	q.queued++
+
+	var timeout <-chan time.Time
+	if q.cfg.MaxWait > 0 {
+		timer := clock.NewTimer(q.cfg.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	q.mu.Unlock()
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timeout:
+		err = &ErrWaitTimeout{Wait: q.cfg.MaxWait}
+	case <-req.Context().Done():
+		err = req.Context().Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if w.granted {
+		// the slot was granted while giving up, it goes to the next waiting request.
+		q.grant()
+	} else {
+		q.remove(sq, w)
+	}
+
+	var timeoutErr *ErrWaitTimeout
+	if errors.As(err, &timeoutErr) {
+		q.timedOut++
+	} else {
+		q.canceled++
+	}
+	return err
+}
+
+// release frees the slot of a request.
+func (q *FairQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.grant()
+}
+
+// grant passes a freed slot to the next waiting request, round-robin across the sources.
+// It must be called with the mutex held.
+func (q *FairQueue) grant() {
+	if len(q.ring) == 0 {
+		q.inFlight--
+		return
+	}
+
+	if q.cursor >= len(q.ring) {
+		q.cursor = 0
+	}
+	sq := q.ring[q.cursor]
+
+	w := sq.waiters[0]
+	sq.waiters[0] = nil
+	sq.waiters = sq.waiters[1:]
+	q.queued--
+
+	if len(sq.waiters) == 0 {
+		q.removeSource(q.cursor)
+	} else {
+		q.cursor++
+	}
+
+	w.granted = true
+	close(w.ready)
+}
+
+// remove removes the waiting request w from the queue of its source. It must be called with the mutex held.
+func (q *FairQueue) remove(sq *sourceQueue, w *waiter) {
+	for i, sw := range sq.waiters {
+		if sw == w {
+			sq.waiters = append(sq.waiters[:i], sq.waiters[i+1:]...)
+			q.queued--
+			break
+		}
+	}
+
+	if len(sq.waiters) > 0 {
+		return
+	}
+	for i, s := range q.ring {
+		if s == sq {
+			q.removeSource(i)
+			return
+		}
+	}
+}
+
+// removeSource removes the source at index i of the ring, once it has no waiting request.
+// It must be called with the mutex held.
+func (q *FairQueue) removeSource(i int) {
+	delete(q.queues, q.ring[i].source)
+	q.ring = append(q.ring[:i], q.ring[i+1:]...)
+	if i < q.cursor {
+		q.cursor--
+	}
+}
+
+var defaultErrHandler utils.ErrorHandler = utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+	var fullErr *ErrQueueFull
+	if errors.As(err, &fullErr) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	var timeoutErr *ErrWaitTimeout
+	if errors.As(err, &timeoutErr) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+})
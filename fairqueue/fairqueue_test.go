@@ -0,0 +1,278 @@
+package fairqueue
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// headerSource extracts the source of the requests from their Source header.
+var headerSource = utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+	return req.Header.Get("Source"), 1, nil
+})
+
+// running is a request passed to the next handler, it is answered once done is closed.
+type running struct {
+	source string
+	done   chan struct{}
+}
+
+// blockingHandler returns a handler reporting the requests it is passed to started, and answering them once released.
+func blockingHandler(started chan<- running) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := running{source: req.Header.Get("Source"), done: make(chan struct{})}
+		started <- r
+		<-r.done
+		_, _ = w.Write([]byte("hello"))
+	})
+}
+
+// serveAsync serves a request of source in the background, and sends its status code to codes.
+func serveAsync(ctx context.Context, q *FairQueue, source string, codes chan<- int) {
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		req.Header.Set("Source", source)
+
+		rw := httptest.NewRecorder()
+		q.ServeHTTP(rw, req)
+		codes <- rw.Code
+	}()
+}
+
+func waitStats(t *testing.T, q *FairQueue, cond func(Stats) bool) {
+	t.Helper()
+	require.Eventually(t, func() bool { return cond(q.Stats()) }, 5*time.Second, time.Millisecond)
+}
+
+func TestFairQueue_fairness(t *testing.T) {
+	testutils.FreezeTime(t)
+	start := clock.Now()
+
+	started := make(chan running)
+	q, err := New(blockingHandler(started), headerSource, Config{Concurrency: 10, PerSourceQueueDepth: 100})
+	require.NoError(t, err)
+
+	codes := make(chan int, 100)
+
+	var inFlight []running
+	for i := 0; i < 10; i++ {
+		serveAsync(context.Background(), q, "a", codes)
+		inFlight = append(inFlight, <-started)
+	}
+
+	for i := 0; i < 80; i++ {
+		serveAsync(context.Background(), q, "a", codes)
+	}
+	waitStats(t, q, func(s Stats) bool { return s.Queued == 80 })
+
+	for i := 0; i < 10; i++ {
+		serveAsync(context.Background(), q, "b", codes)
+	}
+	waitStats(t, q, func(s Stats) bool { return s.QueuedBySource["b"] == 10 })
+
+	// The requests are answered one per second, in the order they were passed to the handler.
+	var order []string
+	completions := map[string][]time.Duration{}
+	for len(inFlight) > 0 {
+		r := inFlight[0]
+		inFlight = inFlight[1:]
+
+		clock.Advance(clock.Second)
+		completions[r.source] = append(completions[r.source], clock.Now().Sub(start))
+
+		queued := q.Stats().Queued
+		close(r.done)
+
+		if queued > 0 {
+			next := <-started
+			order = append(order, next.source)
+			inFlight = append(inFlight, next)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, http.StatusOK, <-codes)
+	}
+
+	// The slots alternate between the sources while both are waiting, instead of the 80 requests of a going first.
+	require.Len(t, order, 90)
+	for i, source := range order[:20] {
+		expected := "a"
+		if i%2 == 1 {
+			expected = "b"
+		}
+		assert.Equal(t, expected, source, i)
+	}
+
+	require.Len(t, completions["b"], 10)
+	require.Len(t, completions["a"], 90)
+	assert.LessOrEqual(t, completions["b"][9], 30*clock.Second)
+	assert.Less(t, mean(completions["b"]), mean(completions["a"]))
+
+	stats := q.Stats()
+	assert.Zero(t, stats.InFlight)
+	assert.Zero(t, stats.Queued)
+	assert.Empty(t, stats.QueuedBySource)
+}
+
+func TestFairQueue_queueFull(t *testing.T) {
+	started := make(chan running)
+	q, err := New(blockingHandler(started), headerSource, Config{Concurrency: 1, PerSourceQueueDepth: 2})
+	require.NoError(t, err)
+
+	codes := make(chan int, 4)
+
+	serveAsync(context.Background(), q, "a", codes)
+	first := <-started
+
+	serveAsync(context.Background(), q, "a", codes)
+	serveAsync(context.Background(), q, "a", codes)
+	waitStats(t, q, func(s Stats) bool { return s.Queued == 2 })
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Source", "a")
+	rw := httptest.NewRecorder()
+	q.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+
+	// The overflow of a does not reject b.
+	serveAsync(context.Background(), q, "b", codes)
+	waitStats(t, q, func(s Stats) bool { return s.Queued == 3 })
+
+	stats := q.Stats()
+	assert.Equal(t, 1, stats.InFlight)
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, stats.QueuedBySource)
+	assert.Equal(t, uint64(1), stats.Rejected)
+
+	close(first.done)
+	for i := 0; i < 3; i++ {
+		close((<-started).done)
+	}
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusOK, <-codes)
+	}
+}
+
+func TestFairQueue_withoutQueue(t *testing.T) {
+	started := make(chan running)
+	q, err := New(blockingHandler(started), headerSource, Config{Concurrency: 1})
+	require.NoError(t, err)
+
+	codes := make(chan int, 1)
+	serveAsync(context.Background(), q, "a", codes)
+	first := <-started
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Source", "b")
+	rw := httptest.NewRecorder()
+	q.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+
+	close(first.done)
+	assert.Equal(t, http.StatusOK, <-codes)
+}
+
+func TestFairQueue_cancel(t *testing.T) {
+	started := make(chan running)
+	q, err := New(blockingHandler(started), headerSource, Config{Concurrency: 1, PerSourceQueueDepth: 1})
+	require.NoError(t, err)
+
+	codes := make(chan int, 1)
+	serveAsync(context.Background(), q, "a", codes)
+	first := <-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan int, 1)
+	serveAsync(ctx, q, "a", canceled)
+	waitStats(t, q, func(s Stats) bool { return s.Queued == 1 })
+
+	// The request leaves the queue without waiting for the slot.
+	cancel()
+	assert.Equal(t, utils.StatusClientClosedRequest, <-canceled)
+
+	stats := q.Stats()
+	assert.Zero(t, stats.Queued)
+	assert.Empty(t, stats.QueuedBySource)
+	assert.Equal(t, uint64(1), stats.Canceled)
+
+	// Its place in the queue is free.
+	serveAsync(context.Background(), q, "a", codes)
+	waitStats(t, q, func(s Stats) bool { return s.Queued == 1 })
+	assert.Zero(t, q.Stats().Rejected)
+
+	close(first.done)
+	assert.Equal(t, http.StatusOK, <-codes)
+	close((<-started).done)
+	assert.Equal(t, http.StatusOK, <-codes)
+}
+
+func TestFairQueue_maxWait(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	started := make(chan running)
+	q, err := New(blockingHandler(started), headerSource, Config{Concurrency: 1, PerSourceQueueDepth: 1, MaxWait: clock.Second})
+	require.NoError(t, err)
+
+	codes := make(chan int, 1)
+	serveAsync(context.Background(), q, "a", codes)
+	first := <-started
+
+	timedOut := make(chan int, 1)
+	serveAsync(context.Background(), q, "b", timedOut)
+	waitStats(t, q, func(s Stats) bool { return s.Queued == 1 })
+
+	clock.Advance(clock.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, <-timedOut)
+
+	stats := q.Stats()
+	assert.Zero(t, stats.Queued)
+	assert.Equal(t, uint64(1), stats.TimedOut)
+
+	close(first.done)
+	assert.Equal(t, http.StatusOK, <-codes)
+	assert.Zero(t, q.Stats().InFlight)
+}
+
+func TestFairQueue_releaseOnPanic(t *testing.T) {
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+
+	q, err := New(handler, headerSource, Config{Concurrency: 1})
+	require.NoError(t, err)
+
+	assert.Panics(t, func() {
+		q.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+	assert.Zero(t, q.Stats().InFlight)
+}
+
+func TestNew_invalid(t *testing.T) {
+	_, err := New(nil, nil, Config{Concurrency: 1})
+	require.Error(t, err)
+
+	_, err = New(nil, headerSource, Config{})
+	require.Error(t, err)
+
+	_, err = New(nil, headerSource, Config{Concurrency: 1, PerSourceQueueDepth: -1})
+	require.Error(t, err)
+
+	_, err = New(nil, headerSource, Config{Concurrency: 1, MaxWait: -clock.Second})
+	require.Error(t, err)
+}
+
+func mean(durations []time.Duration) time.Duration {
+	var sum time.Duration
+	for _, d := range durations {
+		sum += d
+	}
+	return sum / time.Duration(len(durations))
+}
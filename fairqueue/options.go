@@ -0,0 +1,32 @@
+package fairqueue
+
+import (
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// Option represents an option you can pass to New.
+type Option func(q *FairQueue) error
+
+// ErrorHandler sets error handler of the middleware.
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(q *FairQueue) error {
+		q.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger used by the middleware.
+func Logger(l utils.Logger) Option {
+	return func(q *FairQueue) error {
+		q.log = l
+		return nil
+	}
+}
+
+// Verbose additional debug information.
+func Verbose(verbose bool) Option {
+	return func(q *FairQueue) error {
+		q.verbose = verbose
+		return nil
+	}
+}
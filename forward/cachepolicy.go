@@ -0,0 +1,182 @@
+package forward
+
+import (
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+)
+
+// CachePolicy controls the caching headers of the responses of the backends, e.g. for a CDN in front of the proxy,
+// see ResponseCachePolicy.
+type CachePolicy struct {
+	// OverrideCacheControl maps the responses to the Cache-Control replacing the one of the backend, or inserted.
+	// A key starting with "/" is a prefix of the path of the request, the longest matching prefix wins.
+	// Another key is the media type of the response, e.g. "text/css", or its wildcard, e.g. "image/*".
+	// The path prefixes take precedence over the media types.
+	OverrideCacheControl map[string]string
+	// EnsureVary are the members added to the Vary header of the responses, unless they are already there.
+	EnsureVary []string
+	// StripHeaders are the headers removed from the responses, e.g. X-Internal-Debug.
+	StripHeaders []string
+	// DefaultCacheControl is the Cache-Control of the responses the backend sent without one, and not overridden.
+	DefaultCacheControl string
+}
+
+// ResponseCachePolicy enforces the caching headers of the responses of the backends, before they are written to the client.
+// The policy is not applied to the server errors (5xx) and to the protocol upgrades.
+// It sets the ModifyResponse function of the ReverseProxy, calling the previous one if any:
+// replacing ModifyResponse afterwards disables the policy.
+func ResponseCachePolicy(policy CachePolicy) Option {
+	cp := policy.compile()
+
+	return func(p *httputil.ReverseProxy) error {
+		modify := p.ModifyResponse
+		p.ModifyResponse = func(resp *http.Response) error {
+			cp.apply(resp)
+			if modify != nil {
+				return modify(resp)
+			}
+			return nil
+		}
+		return nil
+	}
+}
+
+// pathCacheControl is the Cache-Control of the requests under a path prefix.
+type pathCacheControl struct {
+	prefix       string
+	cacheControl string
+}
+
+// cachePolicy is a CachePolicy compiled for its evaluation per response.
+type cachePolicy struct {
+	paths               []pathCacheControl
+	mediaTypes          map[string]string
+	vary                []string
+	strip               []string
+	defaultCacheControl string
+}
+
+func (policy CachePolicy) compile() *cachePolicy {
+	cp := &cachePolicy{
+		mediaTypes:          make(map[string]string),
+		defaultCacheControl: policy.DefaultCacheControl,
+	}
+
+	for key, cacheControl := range policy.OverrideCacheControl {
+		if strings.HasPrefix(key, "/") {
+			cp.paths = append(cp.paths, pathCacheControl{prefix: key, cacheControl: cacheControl})
+			continue
+		}
+		cp.mediaTypes[mediaType(key)] = cacheControl
+	}
+	sort.Slice(cp.paths, func(i, j int) bool {
+		return len(cp.paths[i].prefix) > len(cp.paths[j].prefix)
+	})
+
+	for _, member := range policy.EnsureVary {
+		if member = strings.TrimSpace(member); member != "" {
+			cp.vary = append(cp.vary, member)
+		}
+	}
+	for _, name := range policy.StripHeaders {
+		cp.strip = append(cp.strip, http.CanonicalHeaderKey(name))
+	}
+
+	return cp
+}
+
+func (cp *cachePolicy) apply(resp *http.Response) {
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+
+	for _, name := range cp.strip {
+		resp.Header.Del(name)
+	}
+
+	if cacheControl, ok := cp.override(resp); ok {
+		resp.Header.Set(CacheControl, cacheControl)
+	} else if cp.defaultCacheControl != "" && len(resp.Header.Values(CacheControl)) == 0 {
+		resp.Header.Set(CacheControl, cp.defaultCacheControl)
+	}
+
+	cp.ensureVary(resp.Header)
+}
+
+// override returns the Cache-Control of the first rule matching the response.
+func (cp *cachePolicy) override(resp *http.Response) (string, bool) {
+	if resp.Request != nil && resp.Request.URL != nil {
+		for _, p := range cp.paths {
+			if strings.HasPrefix(resp.Request.URL.Path, p.prefix) {
+				return p.cacheControl, true
+			}
+		}
+	}
+
+	if len(cp.mediaTypes) == 0 {
+		return "", false
+	}
+
+	mt := mediaType(resp.Header.Get("Content-Type"))
+	if cacheControl, ok := cp.mediaTypes[mt]; ok {
+		return cacheControl, true
+	}
+	if major, _, found := strings.Cut(mt, "/"); found {
+		cacheControl, ok := cp.mediaTypes[major+"/*"]
+		return cacheControl, ok
+	}
+	return "", false
+}
+
+// ensureVary adds the missing members to the Vary header, merged in a single value.
+func (cp *cachePolicy) ensureVary(h http.Header) {
+	if len(cp.vary) == 0 {
+		return
+	}
+
+	var members []string
+	for _, value := range h.Values(Vary) {
+		for _, member := range strings.Split(value, ",") {
+			if member = strings.TrimSpace(member); member != "" {
+				members = append(members, member)
+			}
+		}
+	}
+
+	if containsFold(members, "*") {
+		return
+	}
+
+	missing := false
+	for _, member := range cp.vary {
+		if !containsFold(members, member) {
+			members = append(members, member)
+			missing = true
+		}
+	}
+
+	if missing {
+		h.Set(Vary, strings.Join(members, ", "))
+	}
+}
+
+// mediaType returns the lowercase media type of a Content-Type, without its parameters.
+func mediaType(contentType string) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mt
+	}
+	mt, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mt))
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestResponseCachePolicy(t *testing.T) {
+	policy := CachePolicy{
+		OverrideCacheControl: map[string]string{
+			"/assets/":      "public, max-age=86400",
+			"/assets/live/": "no-store",
+			"text/css":      "public, max-age=3600",
+			"image/*":       "public, max-age=600",
+		},
+		EnsureVary:          []string{"Accept-Encoding", "Origin"},
+		StripHeaders:        []string{"x-internal-debug"},
+		DefaultCacheControl: "no-cache",
+	}
+
+	testCases := []struct {
+		desc     string
+		path     string
+		status   int
+		upstream http.Header
+		expected http.Header
+	}{
+		{
+			desc:     "default cache control",
+			path:     "/api",
+			upstream: http.Header{"Content-Type": {"application/json"}},
+			expected: http.Header{
+				"Content-Type":  {"application/json"},
+				"Cache-Control": {"no-cache"},
+				"Vary":          {"Accept-Encoding, Origin"},
+			},
+		},
+		{
+			desc:     "upstream cache control kept",
+			path:     "/api",
+			upstream: http.Header{"Content-Type": {"application/json"}, "Cache-Control": {"max-age=5"}},
+			expected: http.Header{
+				"Content-Type":  {"application/json"},
+				"Cache-Control": {"max-age=5"},
+				"Vary":          {"Accept-Encoding, Origin"},
+			},
+		},
+		{
+			desc:     "path prefix overrides private",
+			path:     "/assets/app.js",
+			upstream: http.Header{"Content-Type": {"text/css"}, "Cache-Control": {"private"}},
+			expected: http.Header{
+				"Content-Type":  {"text/css"},
+				"Cache-Control": {"public, max-age=86400"},
+				"Vary":          {"Accept-Encoding, Origin"},
+			},
+		},
+		{
+			desc:     "longest path prefix",
+			path:     "/assets/live/feed",
+			upstream: http.Header{"Content-Type": {"text/plain"}},
+			expected: http.Header{
+				"Content-Type":  {"text/plain"},
+				"Cache-Control": {"no-store"},
+				"Vary":          {"Accept-Encoding, Origin"},
+			},
+		},
+		{
+			desc:     "media type with parameters",
+			path:     "/style",
+			upstream: http.Header{"Content-Type": {"Text/CSS; charset=utf-8"}, "Cache-Control": {"private"}},
+			expected: http.Header{
+				"Content-Type":  {"Text/CSS; charset=utf-8"},
+				"Cache-Control": {"public, max-age=3600"},
+				"Vary":          {"Accept-Encoding, Origin"},
+			},
+		},
+		{
+			desc:     "wildcard media type",
+			path:     "/logo",
+			upstream: http.Header{"Content-Type": {"image/png"}},
+			expected: http.Header{
+				"Content-Type":  {"image/png"},
+				"Cache-Control": {"public, max-age=600"},
+				"Vary":          {"Accept-Encoding, Origin"},
+			},
+		},
+		{
+			desc:     "vary merged",
+			path:     "/api",
+			upstream: http.Header{"Content-Type": {"text/plain"}, "Vary": {"accept-encoding", "Cookie"}},
+			expected: http.Header{
+				"Content-Type":  {"text/plain"},
+				"Cache-Control": {"no-cache"},
+				"Vary":          {"accept-encoding, Cookie, Origin"},
+			},
+		},
+		{
+			desc:     "vary complete",
+			path:     "/api",
+			upstream: http.Header{"Content-Type": {"text/plain"}, "Vary": {"Origin,Accept-Encoding"}},
+			expected: http.Header{
+				"Content-Type":  {"text/plain"},
+				"Cache-Control": {"no-cache"},
+				"Vary":          {"Origin,Accept-Encoding"},
+			},
+		},
+		{
+			desc:     "vary all",
+			path:     "/api",
+			upstream: http.Header{"Content-Type": {"text/plain"}, "Vary": {"*"}},
+			expected: http.Header{
+				"Content-Type":  {"text/plain"},
+				"Cache-Control": {"no-cache"},
+				"Vary":          {"*"},
+			},
+		},
+		{
+			desc:     "stripped headers",
+			path:     "/api",
+			upstream: http.Header{"Content-Type": {"text/plain"}, "X-Internal-Debug": {"node-3"}, "X-Other": {"1"}},
+			expected: http.Header{
+				"Content-Type":  {"text/plain"},
+				"Cache-Control": {"no-cache"},
+				"Vary":          {"Accept-Encoding, Origin"},
+				"X-Other":       {"1"},
+			},
+		},
+		{
+			desc:     "client error",
+			path:     "/assets/missing.js",
+			status:   http.StatusNotFound,
+			upstream: http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"private"}},
+			expected: http.Header{
+				"Content-Type":  {"text/plain"},
+				"Cache-Control": {"public, max-age=86400"},
+				"Vary":          {"Accept-Encoding, Origin"},
+			},
+		},
+		{
+			desc:     "server error exempted",
+			path:     "/assets/app.js",
+			status:   http.StatusServiceUnavailable,
+			upstream: http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"private"}, "X-Internal-Debug": {"node-3"}},
+			expected: http.Header{
+				"Content-Type":     {"text/plain"},
+				"Cache-Control":    {"private"},
+				"X-Internal-Debug": {"node-3"},
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				for name, values := range test.upstream {
+					w.Header()[name] = values
+				}
+				if test.status != 0 {
+					w.WriteHeader(test.status)
+				}
+				_, _ = w.Write([]byte("hello"))
+			}))
+			t.Cleanup(srv.Close)
+
+			f := New(true, ResponseCachePolicy(policy))
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.MustParseRequestURI(srv.URL + req.URL.Path)
+				f.ServeHTTP(w, req)
+			}))
+			t.Cleanup(proxy.Close)
+
+			re, body, err := testutils.Get(proxy.URL + test.path)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(body))
+
+			header := re.Header.Clone()
+			header.Del("Date")
+			header.Del(ContentLength)
+			assert.Equal(t, test.expected, header)
+		})
+	}
+}
+
+func TestResponseCachePolicy_upgrade(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Header:     http.Header{Upgrade: {"websocket"}, "X-Internal-Debug": {"1"}},
+	}
+
+	p := New(true, ResponseCachePolicy(CachePolicy{StripHeaders: []string{"X-Internal-Debug"}, DefaultCacheControl: "no-cache"}))
+	require.NoError(t, p.ModifyResponse(resp))
+
+	assert.Equal(t, http.Header{Upgrade: {"websocket"}, "X-Internal-Debug": {"1"}}, resp.Header)
+}
@@ -0,0 +1,111 @@
+package forward
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// maxClientCertBytes is the maximum size of the DER encoding of a client certificate sent in the PEMHeader.
+const maxClientCertBytes = 8 << 10
+
+// ForwardClientCert sends the identity of the client certificate verified by the TLS server to the backends, in headers:
+// the headers of the config are set from the leaf certificate of the mTLS requests, websocket handshakes included.
+// The headers received from the client are removed from every request first, so that a client can't spoof an identity,
+// unless PassThrough is set.
+// Only the certificates verified by the server are forwarded, e.g. with tls.RequireAndVerifyClientCert or
+// tls.VerifyClientCertIfGiven: the certificates accepted without verification, e.g. with tls.RequireAnyClientCert,
+// are ignored.
+func ForwardClientCert(cfg ClientCert) Option {
+	return func(p *httputil.ReverseProxy) error {
+		cfg.SubjectHeader = http.CanonicalHeaderKey(cfg.SubjectHeader)
+		cfg.SANHeader = http.CanonicalHeaderKey(cfg.SANHeader)
+		cfg.FingerprintHeader = http.CanonicalHeaderKey(cfg.FingerprintHeader)
+		cfg.PEMHeader = http.CanonicalHeaderKey(cfg.PEMHeader)
+
+		h, err := rewriter(p, "ForwardClientCert")
+		if err != nil {
+			return err
+		}
+		h.ClientCert = cfg
+		return nil
+	}
+}
+
+// ClientCert defines the headers carrying the identity of the client certificate, see ForwardClientCert.
+// A header is not set when its name is empty.
+type ClientCert struct {
+	// SubjectHeader carries the subject distinguished name of the certificate, URL-encoded,
+	// e.g. CN%3Dclient%2CO%3DExample for CN=client,O=Example.
+	SubjectHeader string
+	// SANHeader carries the DNS and URI subject alternative names of the certificate, comma-separated.
+	SANHeader string
+	// FingerprintHeader carries the SHA-256 fingerprint of the DER encoding of the certificate, hex-encoded.
+	FingerprintHeader string
+	// PEMHeader carries the PEM body of the certificate: its DER encoding, base64-encoded, without the BEGIN and END lines.
+	// It is not set for the certificates larger than 8 KiB.
+	PEMHeader string
+	// PassThrough passes on the headers received with the requests without verified certificate,
+	// e.g. when the requests come from a trusted proxy terminating the TLS connections. They are removed otherwise.
+	PassThrough bool
+}
+
+func (c ClientCert) headers() []string {
+	var names []string
+	for _, name := range []string{c.SubjectHeader, c.SANHeader, c.FingerprintHeader, c.PEMHeader} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// rewrite sets the headers of the client certificate of req.
+func (c ClientCert) rewrite(req *http.Request) {
+	verified := req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0
+	if !verified && c.PassThrough {
+		return
+	}
+
+	for _, name := range c.headers() {
+		req.Header.Del(name)
+	}
+
+	if !verified {
+		return
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+
+	if c.SubjectHeader != "" {
+		req.Header.Set(c.SubjectHeader, url.QueryEscape(cert.Subject.String()))
+	}
+
+	if sans := subjectAltNames(cert); c.SANHeader != "" && len(sans) > 0 {
+		req.Header.Set(c.SANHeader, strings.Join(sans, ","))
+	}
+
+	if c.FingerprintHeader != "" {
+		sum := sha256.Sum256(cert.Raw)
+		req.Header.Set(c.FingerprintHeader, hex.EncodeToString(sum[:]))
+	}
+
+	if c.PEMHeader != "" && len(cert.Raw) <= maxClientCertBytes {
+		req.Header.Set(c.PEMHeader, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+}
+
+// subjectAltNames returns the DNS and URI subject alternative names of cert.
+func subjectAltNames(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
@@ -0,0 +1,208 @@
+package forward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+var testClientCert = ClientCert{
+	SubjectHeader:     "X-Client-Subject",
+	SANHeader:         "x-client-san",
+	FingerprintHeader: "X-Client-Fingerprint",
+	PEMHeader:         "X-Client-Cert",
+}
+
+func TestForwardClientCert(t *testing.T) {
+	ca, caKey := newTestCert(t, nil, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	})
+	client, clientKey := newTestCert(t, ca, caKey, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client", Organization: []string{"Example, Inc."}},
+		DNSNames:    []string{"client.example.com"},
+		URIs:        []*url.URL{testutils.MustParseRequestURI("spiffe://example.org/client")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	for _, websocket := range []bool{false, true} {
+		name := "http"
+		if websocket {
+			name = "websocket"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			pool := x509.NewCertPool()
+			pool.AddCert(ca)
+
+			// The spoofed identity is replaced.
+			header := serveClientCert(t, &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool},
+				tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}, websocket)
+
+			sum := sha256.Sum256(client.Raw)
+
+			assert.Equal(t, []string{"CN%3Dclient%2CO%3DExample%5C%2C+Inc."}, header.Values("X-Client-Subject"))
+			assert.Equal(t, []string{"client.example.com,spiffe://example.org/client"}, header.Values("X-Client-San"))
+			assert.Equal(t, hex.EncodeToString(sum[:]), header.Get("X-Client-Fingerprint"))
+			assert.Equal(t, base64.StdEncoding.EncodeToString(client.Raw), header.Get("X-Client-Cert"))
+		})
+	}
+}
+
+func TestForwardClientCert_unverifiedCert(t *testing.T) {
+	client, clientKey := newTestCert(t, nil, nil, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "admin"},
+		DNSNames:    []string{"admin.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	// The self-signed certificate is accepted by the server, but not verified.
+	header := serveClientCert(t, &tls.Config{ClientAuth: tls.RequireAnyClientCert},
+		tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}, false)
+
+	assert.Empty(t, header.Values("X-Client-Subject"))
+	assert.Empty(t, header.Values("X-Client-San"))
+	assert.Empty(t, header.Values("X-Client-Fingerprint"))
+	assert.Empty(t, header.Values("X-Client-Cert"))
+}
+
+func TestForwardClientCert_withoutCert(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		passThrough bool
+		expected    string
+	}{
+		{
+			desc: "removed",
+		},
+		{
+			desc:        "pass through",
+			passThrough: true,
+			expected:    "CN=admin",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			cfg := testClientCert
+			cfg.PassThrough = test.passThrough
+
+			f := New(true, ForwardClientCert(cfg))
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.Header.Set("X-Client-Subject", "CN=admin")
+			req.Header.Set("X-Client-Cert", "MIIB")
+			req.URL = testutils.MustParseRequestURI("http://backend.com/")
+
+			f.Director(req)
+
+			assert.Equal(t, test.expected, req.Header.Get("X-Client-Subject"))
+			if !test.passThrough {
+				assert.Empty(t, req.Header.Get("X-Client-Cert"))
+			}
+		})
+	}
+}
+
+func TestForwardClientCert_largeCert(t *testing.T) {
+	f := New(true, ForwardClientCert(testClientCert))
+
+	cert := &x509.Certificate{
+		Raw:      make([]byte, maxClientCertBytes+1),
+		Subject:  pkix.Name{CommonName: "client"},
+		DNSNames: []string{"client.example.com"},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	req.Header.Set("X-Client-Cert", "MIIB")
+	req.URL = testutils.MustParseRequestURI("http://backend.com/")
+
+	f.Director(req)
+
+	assert.Equal(t, "CN%3Dclient", req.Header.Get("X-Client-Subject"))
+	assert.Empty(t, req.Header.Get("X-Client-Cert"))
+}
+
+// serveClientCert sends a request with a spoofed identity and the client certificate cert to a TLS proxy
+// configured with tlsConfig and ForwardClientCert, and returns the header received by the backend.
+func serveClientCert(t *testing.T, tlsConfig *tls.Config, cert tls.Certificate, websocket bool) http.Header {
+	t.Helper()
+
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		header = req.Header
+	}))
+	t.Cleanup(srv.Close)
+
+	f := New(true, ForwardClientCert(testClientCert))
+
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	proxy.TLS = tlsConfig
+	proxy.StartTLS()
+	t.Cleanup(proxy.Close)
+
+	transport := proxy.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	httpClient := &http.Client{Transport: transport}
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Client-Subject", "CN=admin")
+	req.Header.Set("X-Client-San", "admin.example.com")
+	if websocket {
+		req.Header.Set(Connection, "Upgrade")
+		req.Header.Set(Upgrade, "websocket")
+	}
+
+	resp, err := httpClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	return header
+}
+
+// newTestCert returns a certificate from template, signed by parent or self-signed.
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
@@ -0,0 +1,121 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// CookieRewrite describes the rewriting of the cookies set by the backends, see RewriteSetCookies.
+type CookieRewrite struct {
+	// DomainMap maps the Domain attributes set by the backends (e.g. "backend.internal") to public domains.
+	// The domains are matched case-insensitively, ignoring a leading dot.
+	DomainMap map[string]string
+	// StripDomain removes the Domain attributes, making the cookies host-only. It takes precedence over DomainMap.
+	StripDomain bool
+	// PathPrefix is prepended to the Path attributes, e.g. "/app" exposed as "/public/app" with "/public".
+	PathPrefix string
+	// ForceSecure adds the Secure attribute.
+	ForceSecure bool
+	// ForceHTTPOnly adds the HttpOnly attribute.
+	ForceHTTPOnly bool
+	// ForceSameSite sets the SameSite attribute, unless it is 0 or http.SameSiteDefaultMode.
+	ForceSameSite http.SameSite
+}
+
+// RewriteSetCookies rewrites the Set-Cookie headers of the responses of the backends,
+// e.g. when the backends are exposed on another domain or path.
+// Only the targeted attributes are modified: the other ones, including the unknown extensions, are kept as is.
+// It sets the ModifyResponse function of the ReverseProxy, calling the previous one if any:
+// replacing ModifyResponse afterwards disables the rewriting.
+func RewriteSetCookies(rw CookieRewrite) Option {
+	return func(p *httputil.ReverseProxy) error {
+		modify := p.ModifyResponse
+		p.ModifyResponse = func(resp *http.Response) error {
+			rw.rewrite(resp.Header)
+			if modify != nil {
+				return modify(resp)
+			}
+			return nil
+		}
+		return nil
+	}
+}
+
+func (rw CookieRewrite) rewrite(h http.Header) {
+	cookies := h["Set-Cookie"]
+	for i, c := range cookies {
+		cookies[i] = rw.rewriteCookie(c)
+	}
+}
+
+// rewriteCookie rewrites the attributes of the Set-Cookie header value c, keeping its other bytes untouched.
+func (rw CookieRewrite) rewriteCookie(c string) string {
+	parts := strings.Split(c, ";")
+
+	var secure, httpOnly, sameSite bool
+	out := parts[:1]
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(part, "=")
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "domain":
+			if rw.StripDomain {
+				continue
+			}
+			if d, ok := rw.mapDomain(value); ok {
+				part = name + "=" + d
+			}
+		case "path":
+			if rw.PathPrefix != "" {
+				part = name + "=" + strings.TrimSuffix(rw.PathPrefix, "/") + strings.TrimSpace(value)
+			}
+		case "secure":
+			secure = true
+		case "httponly":
+			httpOnly = true
+		case "samesite":
+			sameSite = true
+			if s := sameSiteValue(rw.ForceSameSite); s != "" {
+				part = name + "=" + s
+			}
+		}
+
+		out = append(out, part)
+	}
+
+	if rw.ForceSecure && !secure {
+		out = append(out, " Secure")
+	}
+	if rw.ForceHTTPOnly && !httpOnly {
+		out = append(out, " HttpOnly")
+	}
+	if s := sameSiteValue(rw.ForceSameSite); s != "" && !sameSite {
+		out = append(out, " SameSite="+s)
+	}
+
+	return strings.Join(out, ";")
+}
+
+func (rw CookieRewrite) mapDomain(value string) (string, bool) {
+	domain := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(value)), ".")
+	for from, to := range rw.DomainMap {
+		if strings.TrimPrefix(strings.ToLower(from), ".") == domain {
+			return to, true
+		}
+	}
+	return "", false
+}
+
+func sameSiteValue(s http.SameSite) string {
+	switch s {
+	case http.SameSiteLaxMode:
+		return "Lax"
+	case http.SameSiteStrictMode:
+		return "Strict"
+	case http.SameSiteNoneMode:
+		return "None"
+	default:
+		return ""
+	}
+}
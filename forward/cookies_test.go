@@ -0,0 +1,122 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestRewriteSetCookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Domain=.Backend.internal; Path=/app; Expires=Wed, 21 Oct 2026 07:28:00 GMT; HttpOnly")
+		w.Header().Add("Set-Cookie", "pref=dark; path=/; Max-Age=3600; samesite=None; Partitioned; Priority=High")
+		w.Header().Add("Set-Cookie", "other=1; Domain=other.internal")
+	}))
+	t.Cleanup(srv.Close)
+
+	f := New(true, RewriteSetCookies(CookieRewrite{
+		DomainMap:     map[string]string{"backend.internal": "example.com"},
+		PathPrefix:    "/public/",
+		ForceSecure:   true,
+		ForceHTTPOnly: true,
+		ForceSameSite: http.SameSiteLaxMode,
+	}))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	assert.Equal(t, []string{
+		"session=abc; Domain=example.com; Path=/public/app; Expires=Wed, 21 Oct 2026 07:28:00 GMT; HttpOnly; Secure; SameSite=Lax",
+		"pref=dark; path=/public/; Max-Age=3600; samesite=Lax; Partitioned; Priority=High; Secure; HttpOnly",
+		"other=1; Domain=other.internal; Secure; HttpOnly; SameSite=Lax",
+	}, re.Header.Values("Set-Cookie"))
+}
+
+func TestRewriteSetCookies_previousModifyResponse(t *testing.T) {
+	p := New(true)
+
+	var called bool
+	p.ModifyResponse = func(resp *http.Response) error {
+		called = true
+		assert.Equal(t, "a=1", resp.Header.Get("Set-Cookie"))
+		return nil
+	}
+	RewriteSetCookies(CookieRewrite{StripDomain: true})(p)
+
+	resp := &http.Response{Header: http.Header{"Set-Cookie": {"a=1; Domain=backend.internal"}}}
+	require.NoError(t, p.ModifyResponse(resp))
+	assert.True(t, called)
+}
+
+func TestCookieRewrite_rewriteCookie(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		rewrite  CookieRewrite
+		cookie   string
+		expected string
+	}{
+		{
+			desc:     "no rewrite",
+			cookie:   "a=1; Domain=backend.internal; Path=/; Secure; ext=value",
+			expected: "a=1; Domain=backend.internal; Path=/; Secure; ext=value",
+		},
+		{
+			desc:     "strip domain",
+			rewrite:  CookieRewrite{StripDomain: true, DomainMap: map[string]string{"backend.internal": "example.com"}},
+			cookie:   "a=1; domain=backend.internal; Path=/",
+			expected: "a=1; Path=/",
+		},
+		{
+			desc:     "unmapped domain",
+			rewrite:  CookieRewrite{DomainMap: map[string]string{".backend.internal": "example.com"}},
+			cookie:   "a=1; Domain=other.internal",
+			expected: "a=1; Domain=other.internal",
+		},
+		{
+			desc:     "mapped domain with leading dot",
+			rewrite:  CookieRewrite{DomainMap: map[string]string{".backend.internal": "example.com"}},
+			cookie:   "a=1; Domain=backend.internal",
+			expected: "a=1; Domain=example.com",
+		},
+		{
+			desc:     "path prefix without path",
+			rewrite:  CookieRewrite{PathPrefix: "/public"},
+			cookie:   "a=1",
+			expected: "a=1",
+		},
+		{
+			desc:     "existing attributes are kept",
+			rewrite:  CookieRewrite{ForceSecure: true, ForceHTTPOnly: true, ForceSameSite: http.SameSiteStrictMode},
+			cookie:   "a=1; secure; httponly; SameSite=None",
+			expected: "a=1; secure; httponly; SameSite=Strict",
+		},
+		{
+			desc:     "default same site",
+			rewrite:  CookieRewrite{ForceSameSite: http.SameSiteDefaultMode},
+			cookie:   "a=1; SameSite=None",
+			expected: "a=1; SameSite=None",
+		},
+		{
+			desc:     "value with equal signs",
+			rewrite:  CookieRewrite{ForceSecure: true},
+			cookie:   "a=b=c",
+			expected: "a=b=c; Secure",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.rewrite.rewriteCookie(test.cookie))
+		})
+	}
+}
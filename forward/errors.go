@@ -0,0 +1,362 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// Kinds of upstream errors, see ErrorKind.
+const (
+	KindDial     = "dial"
+	KindTLS      = "tls"
+	KindTimeout  = "timeout"
+	KindProtocol = "protocol"
+	KindFraming  = "framing"
+)
+
+// UpstreamErrorHeader is set on the responses to the requests that failed because of the TLS handshake with the backend.
+const UpstreamErrorHeader = "X-Upstream-Error"
+
+// The upstream errors implement net.Error, so that utils.DefaultHandler answers 504 to the timeouts and 502 to the others.
+
+// ErrDial is returned when the connection to the backend can't be established.
+// Proxy is the proxy the connection went through, if any, see UpstreamProxy.
+type ErrDial struct {
+	URL   *url.URL
+	Proxy *url.URL
+	Err   error
+}
+
+func (e *ErrDial) Error() string {
+	if e.Proxy != nil {
+		return fmt.Sprintf("dial %s through proxy %s: %v", e.URL, e.Proxy.Redacted(), e.Err)
+	}
+	return fmt.Sprintf("dial %s: %v", e.URL, e.Err)
+}
+
+func (e *ErrDial) Unwrap() error {
+	return e.Err
+}
+
+// Timeout implements net.Error.
+func (e *ErrDial) Timeout() bool {
+	return false
+}
+
+// Temporary implements net.Error.
+func (e *ErrDial) Temporary() bool {
+	return false
+}
+
+// ErrTLSHandshake is returned when the TLS handshake with the backend fails, e.g. because of an invalid certificate.
+type ErrTLSHandshake struct {
+	URL *url.URL
+	Err error
+}
+
+func (e *ErrTLSHandshake) Error() string {
+	return fmt.Sprintf("TLS handshake with %s: %v", e.URL, e.Err)
+}
+
+func (e *ErrTLSHandshake) Unwrap() error {
+	return e.Err
+}
+
+// Timeout implements net.Error.
+func (e *ErrTLSHandshake) Timeout() bool {
+	return false
+}
+
+// Temporary implements net.Error.
+func (e *ErrTLSHandshake) Temporary() bool {
+	return false
+}
+
+// ErrTimeout is returned when the backend does not respond in time.
+type ErrTimeout struct {
+	URL *url.URL
+	Err error
+}
+
+func (e *ErrTimeout) Error() string {
+	return fmt.Sprintf("timeout from %s: %v", e.URL, e.Err)
+}
+
+func (e *ErrTimeout) Unwrap() error {
+	return e.Err
+}
+
+// Timeout implements net.Error.
+func (e *ErrTimeout) Timeout() bool {
+	return true
+}
+
+// Temporary implements net.Error.
+func (e *ErrTimeout) Temporary() bool {
+	return true
+}
+
+// ErrMalformedResponse is returned when the response of the backend can't be read, e.g. the backend is not an HTTP server.
+type ErrMalformedResponse struct {
+	URL *url.URL
+	Err error
+}
+
+func (e *ErrMalformedResponse) Error() string {
+	return fmt.Sprintf("malformed response from %s: %v", e.URL, e.Err)
+}
+
+func (e *ErrMalformedResponse) Unwrap() error {
+	return e.Err
+}
+
+// Timeout implements net.Error.
+func (e *ErrMalformedResponse) Timeout() bool {
+	return false
+}
+
+// Temporary implements net.Error.
+func (e *ErrMalformedResponse) Temporary() bool {
+	return false
+}
+
+// ErrorKind returns the kind of the upstream error (KindDial, KindTLS, KindTimeout, KindProtocol or KindFraming),
+// or an empty string if err is not an upstream error.
+func ErrorKind(err error) string {
+	var (
+		errDial      *ErrDial
+		errTLS       *ErrTLSHandshake
+		errTimeout   *ErrTimeout
+		errMalformed *ErrMalformedResponse
+		errFraming   *ErrFramingMismatch
+	)
+
+	switch {
+	case errors.As(err, &errDial):
+		return KindDial
+	case errors.As(err, &errTLS):
+		return KindTLS
+	case errors.As(err, &errTimeout):
+		return KindTimeout
+	case errors.As(err, &errMalformed):
+		return KindProtocol
+	case errors.As(err, &errFraming):
+		return KindFraming
+	default:
+		return ""
+	}
+}
+
+// upstreamError wraps the error of the round trip to target in the matching upstream error type.
+// The cancellation of the request by the client is not an upstream error.
+func upstreamError(target *url.URL, err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || ErrorKind(err) != "" {
+		return err
+	}
+
+	var errProxy *proxyError
+	if errors.As(err, &errProxy) {
+		return &ErrDial{URL: target, Proxy: errProxy.Proxy, Err: errProxy.Err}
+	}
+
+	var (
+		opErr        *net.OpError
+		netErr       net.Error
+		unknownCA    x509.UnknownAuthorityError
+		invalidCert  x509.CertificateInvalidError
+		hostnameErr  x509.HostnameError
+		recordHdrErr tls.RecordHeaderError
+	)
+
+	switch {
+	case errors.As(err, &unknownCA), errors.As(err, &invalidCert), errors.As(err, &hostnameErr),
+		errors.As(err, &recordHdrErr), strings.Contains(err.Error(), "tls: "):
+		return &ErrTLSHandshake{URL: target, Err: err}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return &ErrTimeout{URL: target, Err: err}
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return &ErrDial{URL: target, Err: err}
+	default:
+		return &ErrMalformedResponse{URL: target, Err: err}
+	}
+}
+
+type errorCaptureKey struct{}
+
+// errorCapture holds the upstream error and the framing mismatch of a request.
+// They are also recorded in the captures of the outer middlewares.
+type errorCapture struct {
+	mu      sync.Mutex
+	err     error
+	framing *ErrFramingMismatch
+	parent  *errorCapture
+
+	// retries is the number of retries of the request on a new connection, see RetryStaleConnections.
+	retries int
+}
+
+func (c *errorCapture) set(err error) {
+	for capture := c; capture != nil; capture = capture.parent {
+		capture.mu.Lock()
+		capture.err = err
+		capture.mu.Unlock()
+	}
+}
+
+func (c *errorCapture) get() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *errorCapture) setFraming(err *ErrFramingMismatch) {
+	for capture := c; capture != nil; capture = capture.parent {
+		capture.mu.Lock()
+		capture.framing = err
+		capture.mu.Unlock()
+	}
+}
+
+func (c *errorCapture) getFraming() *ErrFramingMismatch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.framing
+}
+
+func (c *errorCapture) addRetry() {
+	for capture := c; capture != nil; capture = capture.parent {
+		capture.mu.Lock()
+		capture.retries++
+		capture.mu.Unlock()
+	}
+}
+
+func (c *errorCapture) getRetries() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.retries
+}
+
+// WithErrorCapture returns a copy of ctx in which the forwarder records the upstream error of the request,
+// available with ErrorFromContext once the forwarder has written the response.
+func WithErrorCapture(ctx context.Context) context.Context {
+	parent, _ := ctx.Value(errorCaptureKey{}).(*errorCapture)
+	return context.WithValue(ctx, errorCaptureKey{}, &errorCapture{parent: parent})
+}
+
+// ErrorFromContext returns the upstream error (ErrDial, ErrTLSHandshake, ErrTimeout or ErrMalformedResponse)
+// of the last attempt to forward the request, if ctx has been created by WithErrorCapture.
+// It returns nil if the backend responded, ErrFramingMismatch if its response was aborted because its body
+// was shorter than its Content-Length, or ErrTransform if the transformation of its body failed,
+// see ResponseBodyTransformer. The framing mismatches of the responses forwarded anyway are reported
+// by FramingFromContext.
+func ErrorFromContext(ctx context.Context) error {
+	if c, ok := ctx.Value(errorCaptureKey{}).(*errorCapture); ok {
+		return c.get()
+	}
+	return nil
+}
+
+// FramingFromContext returns the framing mismatch of the response of the last attempt to forward the request,
+// if ctx has been created by WithErrorCapture: the response was forwarded anyway, without its Content-Length.
+// Unlike the upstream errors, it does not count as a failure of the backend in the metrics.
+func FramingFromContext(ctx context.Context) *ErrFramingMismatch {
+	if c, ok := ctx.Value(errorCaptureKey{}).(*errorCapture); ok {
+		return c.getFraming()
+	}
+	return nil
+}
+
+func recordError(ctx context.Context, err error) {
+	if c, ok := ctx.Value(errorCaptureKey{}).(*errorCapture); ok {
+		c.set(err)
+	}
+}
+
+func recordFraming(ctx context.Context, err *ErrFramingMismatch) {
+	if c, ok := ctx.Value(errorCaptureKey{}).(*errorCapture); ok {
+		c.setFraming(err)
+	}
+}
+
+func recordRetry(ctx context.Context) {
+	if c, ok := ctx.Value(errorCaptureKey{}).(*errorCapture); ok {
+		c.addRetry()
+	}
+}
+
+// errorHandler returns the ErrorHandler of the ReverseProxy:
+// it wraps the error in the matching upstream error type, records it in the context of the request,
+// and calls h with the "forward" component, see utils.ServeError.
+func errorHandler(h utils.ErrorHandler) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, req *http.Request, err error) {
+		// The requests rejected by the HeaderLimits or the Signer have not been sent.
+		var errLimit *ErrHeaderLimit
+		if errors.As(err, &errLimit) {
+			utils.ServeError(h, w, req, "forward", errLimit)
+			return
+		}
+		var errSign *ErrSign
+		if errors.As(err, &errSign) {
+			utils.ServeError(h, w, req, "forward", errSign)
+			return
+		}
+		var errDraining *ErrWebsocketDraining
+		if errors.As(err, &errDraining) {
+			utils.ServeError(h, w, req, "forward", errDraining)
+			return
+		}
+
+		err = upstreamError(req.URL, err)
+		recordError(req.Context(), err)
+		if isHTTP10(req) {
+			// the HTTP/1.0 clients may wait for the connection to be closed to end the error response.
+			w.Header().Set(Connection, "close")
+		}
+		utils.ServeError(h, w, req, "forward", err)
+	}
+}
+
+// defaultErrorHandler answers with the status code of utils.DefaultHandler,
+// and flags the TLS handshake failures with the UpstreamErrorHeader.
+// The requests rejected by the HeaderLimits get a 431, the ones the Signer failed to sign a 502,
+// and the websocket upgrades rejected while the sessions are drained a 503.
+var defaultErrorHandler = utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+	var errLimit *ErrHeaderLimit
+	if errors.As(err, &errLimit) {
+		w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusRequestHeaderFieldsTooLarge)))
+		return
+	}
+
+	var errSign *ErrSign
+	if errors.As(err, &errSign) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusBadGateway)))
+		return
+	}
+
+	var errDraining *ErrWebsocketDraining
+	if errors.As(err, &errDraining) {
+		// the client can reconnect at once, e.g. to another instance.
+		w.Header().Set(RetryAfter, "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+		return
+	}
+
+	if ErrorKind(err) == KindTLS {
+		w.Header().Set(UpstreamErrorHeader, "tls-handshake")
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+})
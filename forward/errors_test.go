@@ -0,0 +1,175 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+func TestUpstreamError_dial(t *testing.T) {
+	// Grab a free port and close it, so that the connection is refused.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	backendURL := "http://" + l.Addr().String()
+	require.NoError(t, l.Close())
+
+	resp, upstreamErr := serveWithErrorCapture(t, New(false), backendURL, nil)
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(UpstreamErrorHeader))
+
+	var errDial *ErrDial
+	require.ErrorAs(t, upstreamErr, &errDial)
+	assert.Equal(t, l.Addr().String(), errDial.URL.Host)
+	assert.Equal(t, KindDial, ErrorKind(upstreamErr))
+}
+
+func TestUpstreamError_tlsHandshake(t *testing.T) {
+	// The certificate of the test server is not trusted by the default transport.
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	t.Cleanup(srv.Close)
+
+	resp, upstreamErr := serveWithErrorCapture(t, New(false), srv.URL, nil)
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, "tls-handshake", resp.Header.Get(UpstreamErrorHeader))
+
+	var errTLS *ErrTLSHandshake
+	require.ErrorAs(t, upstreamErr, &errTLS)
+	assert.Equal(t, srv.Listener.Addr().String(), errTLS.URL.Host)
+	assert.Equal(t, KindTLS, ErrorKind(upstreamErr))
+}
+
+func TestUpstreamError_malformedResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("\x00\x01garbage\r\n\r\n"))
+			_ = conn.Close()
+		}
+	}()
+
+	backendURL := "http://" + l.Addr().String()
+
+	resp, upstreamErr := serveWithErrorCapture(t, New(false), backendURL, nil)
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	var errMalformed *ErrMalformedResponse
+	require.ErrorAs(t, upstreamErr, &errMalformed)
+	assert.Equal(t, l.Addr().String(), errMalformed.URL.Host)
+	assert.Equal(t, KindProtocol, ErrorKind(upstreamErr))
+}
+
+func TestUpstreamError_timeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+	})
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	rt := &http.Transport{ResponseHeaderTimeout: 50 * time.Millisecond}
+	t.Cleanup(rt.CloseIdleConnections)
+
+	resp, upstreamErr := serveWithErrorCapture(t, New(false), srv.URL, rt)
+
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+	var errTimeout *ErrTimeout
+	require.ErrorAs(t, upstreamErr, &errTimeout)
+	assert.True(t, errTimeout.Timeout())
+	assert.Equal(t, KindTimeout, ErrorKind(upstreamErr))
+}
+
+func TestUpstreamError_success(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	resp, upstreamErr := serveWithErrorCapture(t, New(false), srv.URL, nil)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, upstreamErr)
+}
+
+func TestUpstreamError_customErrorHandler(t *testing.T) {
+	var handled error
+	f := New(false, ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, _ *http.Request, err error) {
+		handled = err
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})))
+
+	rt := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	})
+
+	resp, upstreamErr := serveWithErrorCapture(t, f, "http://localhost:63450", rt)
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, KindDial, ErrorKind(handled))
+	assert.Equal(t, "forward", utils.ErrorComponent(handled))
+	assert.Equal(t, upstreamErr, errors.Unwrap(handled))
+}
+
+func TestErrorCapture_nested(t *testing.T) {
+	outer := WithErrorCapture(context.Background())
+	inner := WithErrorCapture(outer)
+
+	err := &ErrDial{Err: errors.New("boom")}
+	recordError(inner, err)
+
+	assert.Equal(t, err, ErrorFromContext(inner))
+	assert.Equal(t, err, ErrorFromContext(outer))
+
+	// A successful retry clears the error.
+	recordError(WithErrorCapture(outer), nil)
+	assert.NoError(t, ErrorFromContext(outer))
+	assert.NoError(t, ErrorFromContext(context.Background()))
+}
+
+// serveWithErrorCapture forwards a request to backendURL through f,
+// and returns the response and the upstream error observed by the handler wrapping f.
+func serveWithErrorCapture(t *testing.T, f http.Handler, backendURL string, rt http.RoundTripper) (*http.Response, error) {
+	t.Helper()
+
+	upstreamErr := make(chan error, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := WithErrorCapture(req.Context())
+		if rt != nil {
+			ctx = WithRoundTripper(ctx, rt)
+		}
+		req = req.WithContext(ctx)
+		req.URL = testutils.MustParseRequestURI(backendURL)
+
+		f.ServeHTTP(w, req)
+
+		upstreamErr <- ErrorFromContext(req.Context())
+	}))
+	t.Cleanup(proxy.Close)
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	return resp, <-upstreamErr
+}
@@ -0,0 +1,103 @@
+package forward
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// framingPrefetchBytes is the Content-Length up to which the body of a response is read before its headers are forwarded,
+// so that a body shorter than its Content-Length is forwarded without it.
+// The longer bodies are streamed, and a short one aborts the response.
+const framingPrefetchBytes = 4 << 10
+
+// ErrFramingMismatch is recorded when the framing of the response of the backend is inconsistent:
+// a Content-Length along with a Transfer-Encoding, or a body shorter than its Content-Length.
+// The response is forwarded anyway without the Content-Length, see FramingFromContext.
+// A body longer than framingPrefetchBytes is streamed: when it is found shorter than its Content-Length,
+// the response is aborted, and the mismatch is the upstream error of the request, see ErrorFromContext.
+type ErrFramingMismatch struct {
+	URL *url.URL
+	// Declared is the Content-Length of the response.
+	Declared int64
+	// Received is the size of the body, -1 if the response has a Transfer-Encoding.
+	Received int64
+}
+
+func (e *ErrFramingMismatch) Error() string {
+	if e.Received < 0 {
+		return fmt.Sprintf("framing mismatch from %s: Content-Length %d with a Transfer-Encoding", e.URL, e.Declared)
+	}
+	return fmt.Sprintf("framing mismatch from %s: Content-Length %d, received %d bytes", e.URL, e.Declared, e.Received)
+}
+
+// Timeout implements net.Error.
+func (e *ErrFramingMismatch) Timeout() bool {
+	return false
+}
+
+// Temporary implements net.Error.
+func (e *ErrFramingMismatch) Temporary() bool {
+	return false
+}
+
+// sanitizeFraming removes the framing headers of the backend from resp, the server of the forwarder frames the response itself.
+// The Content-Length of a response with a Transfer-Encoding is dropped,
+// so is the one of a body found shorter than declared, and the mismatch is recorded in the context of req.
+func sanitizeFraming(req *http.Request, resp *http.Response) (*http.Response, error) {
+	resp.Header.Del(TransferEncoding)
+
+	if len(resp.TransferEncoding) > 0 {
+		if cl := resp.Header.Get(ContentLength); cl != "" {
+			declared, _ := strconv.ParseInt(cl, 10, 64)
+			resp.Header.Del(ContentLength)
+			recordFraming(req.Context(), &ErrFramingMismatch{URL: req.URL, Declared: declared, Received: -1})
+		}
+		return resp, nil
+	}
+
+	if resp.ContentLength <= 0 || resp.Body == nil || resp.Body == http.NoBody ||
+		req.Method == http.MethodHead || resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, nil
+	}
+
+	if resp.ContentLength > framingPrefetchBytes {
+		resp.Body = &framingBody{ReadCloser: resp.Body, req: req, declared: resp.ContentLength}
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		recordFraming(req.Context(), &ErrFramingMismatch{URL: req.URL, Declared: resp.ContentLength, Received: int64(len(body))})
+		resp.Header.Del(ContentLength)
+		resp.ContentLength = -1
+	case err != nil:
+		return nil, err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// framingBody records the mismatch of a streamed body shorter than its Content-Length as the upstream error of the request.
+type framingBody struct {
+	io.ReadCloser
+	req      *http.Request
+	declared int64
+	read     int64
+}
+
+func (b *framingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		recordError(b.req.Context(), &ErrFramingMismatch{URL: b.req.URL, Declared: b.declared, Received: b.read})
+	}
+	return n, err
+}
@@ -0,0 +1,203 @@
+package forward
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestFraming(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		response string
+
+		expectedHeader           http.Header
+		expectedTransferEncoding []string
+		expectedBody             string
+		expectedErr              *ErrFramingMismatch
+	}{
+		{
+			desc:                     "Content-Length and Transfer-Encoding",
+			response:                 "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			expectedHeader:           http.Header{},
+			expectedTransferEncoding: []string{"chunked"},
+			expectedBody:             "hello",
+		},
+		{
+			desc:     "short body",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nContent-Type: text/plain\r\n\r\nhello",
+			expectedHeader: http.Header{
+				"Content-Type": {"text/plain"},
+			},
+			expectedTransferEncoding: []string{"chunked"},
+			expectedBody:             "hello",
+			expectedErr:              &ErrFramingMismatch{Declared: 10, Received: 5},
+		},
+		{
+			// The transport reads the declared length only, and does not reuse the connection.
+			desc:     "extra bytes",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\n\r\nhello world",
+			expectedHeader: http.Header{
+				"Content-Length": {"5"},
+				"Content-Type":   {"text/plain"},
+			},
+			expectedBody: "hello",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			backendURL := rawBackend(t, test.response)
+
+			framing := make(chan *ErrFramingMismatch, 1)
+			f := New(false)
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req = req.WithContext(WithErrorCapture(req.Context()))
+				req.URL = testutils.MustParseRequestURI(backendURL)
+				f.ServeHTTP(w, req)
+				assert.NoError(t, ErrorFromContext(req.Context()))
+				framing <- FramingFromContext(req.Context())
+			}))
+			t.Cleanup(proxy.Close)
+
+			resp, body := rawGet(t, proxy.Listener.Addr().String())
+
+			resp.Header.Del("Date")
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, test.expectedHeader, resp.Header)
+			assert.Equal(t, test.expectedTransferEncoding, resp.TransferEncoding)
+			assert.Equal(t, test.expectedBody, body)
+
+			errFraming := <-framing
+			if test.expectedErr == nil {
+				assert.Nil(t, errFraming)
+				return
+			}
+
+			require.NotNil(t, errFraming)
+			assert.Equal(t, test.expectedErr.Declared, errFraming.Declared)
+			assert.Equal(t, test.expectedErr.Received, errFraming.Received)
+			assert.Equal(t, strings.TrimPrefix(backendURL, "http://"), errFraming.URL.Host)
+		})
+	}
+}
+
+func TestFraming_shortStreamedBody(t *testing.T) {
+	body := strings.Repeat("a", framingPrefetchBytes+1)
+	backendURL := rawBackend(t, "HTTP/1.1 200 OK\r\nContent-Length: 10000\r\n\r\n"+body)
+
+	req := httptest.NewRequest(http.MethodGet, backendURL, nil)
+	req = req.WithContext(WithErrorCapture(req.Context()))
+	rw := httptest.NewRecorder()
+
+	// The headers are forwarded before the body is read:
+	// the response is aborted by an http.Server, and the client sees that the body is shorter than its Content-Length.
+	New(false).ServeHTTP(rw, req)
+	upstreamErr := ErrorFromContext(req.Context())
+
+	assert.Equal(t, "10000", rw.Header().Get(ContentLength))
+	assert.Equal(t, body, rw.Body.String())
+
+	var errFraming *ErrFramingMismatch
+	require.ErrorAs(t, upstreamErr, &errFraming)
+	assert.Equal(t, int64(10000), errFraming.Declared)
+	assert.Equal(t, int64(len(body)), errFraming.Received)
+	assert.Equal(t, KindFraming, ErrorKind(upstreamErr))
+}
+
+func TestFraming_roundTripper(t *testing.T) {
+	// A custom transport may keep both the Content-Length and the Transfer-Encoding of the backend.
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:       http.StatusOK,
+			Header:           http.Header{ContentLength: {"5"}, TransferEncoding: {"chunked"}},
+			TransferEncoding: []string{"chunked"},
+			ContentLength:    -1,
+			Body:             io.NopCloser(strings.NewReader("hello")),
+			Request:          req,
+		}, nil
+	})
+
+	framing := make(chan *ErrFramingMismatch, 1)
+	f := New(false)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req = req.WithContext(WithRoundTripper(WithErrorCapture(req.Context()), rt))
+		req.URL = testutils.MustParseRequestURI("http://localhost:63450")
+		f.ServeHTTP(w, req)
+
+		// The response is delivered: the backend did not fail.
+		assert.NoError(t, ErrorFromContext(req.Context()))
+		framing <- FramingFromContext(req.Context())
+	}))
+	t.Cleanup(proxy.Close)
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(ContentLength))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	errFraming := <-framing
+	require.NotNil(t, errFraming)
+	assert.Equal(t, int64(5), errFraming.Declared)
+	assert.Equal(t, int64(-1), errFraming.Received)
+}
+
+// rawBackend returns the URL of a backend writing response as is to every connection, then closing it.
+func rawBackend(t *testing.T, response string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(response))
+			}()
+		}
+	}()
+
+	return "http://" + l.Addr().String()
+}
+
+// rawGet sends a GET request on a new connection to addr, and returns the response as received.
+func rawGet(t *testing.T, addr string) (*http.Response, string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, string(body)
+}
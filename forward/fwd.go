@@ -2,29 +2,134 @@
 package forward
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/vulcand/oxy/v2/utils"
 )
 
+// Option configures the ReverseProxy created by New or Build.
+type Option func(*httputil.ReverseProxy) error
+
+// ErrCustomTransport is returned by the options configuring the Transport created by New,
+// e.g. MaxConnsPerHost or Signer, when they are combined with a custom Transport.
+type ErrCustomTransport struct {
+	Option string
+}
+
+func (e *ErrCustomTransport) Error() string {
+	return fmt.Sprintf("%s can't be combined with a custom Transport", e.Option)
+}
+
+// CopyBufferSize sets the size of the pooled buffers used to copy the response bodies.
+// A size lower than or equal to 0 keeps the default size (utils.DefaultBufferSize).
+func CopyBufferSize(n int) Option {
+	return func(p *httputil.ReverseProxy) error {
+		if n <= 0 {
+			return nil
+		}
+		p.BufferPool = utils.NewBufferPool(n)
+		return nil
+	}
+}
+
+// FirstByteTimeout cancels the request to the backend if the response headers are not received within d,
+// the client gets a 504.
+// Once the headers are received, the body can be streamed indefinitely (see BodyIdleTimeout).
+// It does not apply to websocket upgrades.
+func FirstByteTimeout(d time.Duration) Option {
+	return func(p *httputil.ReverseProxy) error {
+		timeouts(p).firstByteTimeout = d
+		return nil
+	}
+}
+
+// BodyIdleTimeout aborts the response if no body bytes are received from the backend for d,
+// e.g. a stalled event stream.
+// It does not apply to websocket upgrades.
+func BodyIdleTimeout(d time.Duration) Option {
+	return func(p *httputil.ReverseProxy) error {
+		timeouts(p).bodyIdleTimeout = d
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler of the errors of the forwarder.
+// The errors of the round trips to the backends are wrapped in ErrDial, ErrTLSHandshake, ErrTimeout or ErrMalformedResponse,
+// the requests rejected by the HeaderLimits get an ErrHeaderLimit, the ones the Signer failed to sign an ErrSign,
+// and the websocket upgrades rejected by DrainWebsockets an ErrWebsocketDraining.
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(p *httputil.ReverseProxy) error {
+		p.ErrorHandler = errorHandler(h)
+		return nil
+	}
+}
+
 // New creates a new ReverseProxy.
-func New(passHostHeader bool) *httputil.ReverseProxy {
+// The upstream errors are recorded in the context of the request, see WithErrorCapture.
+// The Transport of a request can be overridden with WithRoundTripper,
+// and the dialer of a websocket request with WithWebsocketDialer.
+// Replacing the Transport of the returned ReverseProxy disables these overrides.
+// The connections to the backends can be limited and observed with the pool options, see MaxConnsPerHost,
+// and the requests failing on a stale connection retried with RetryStaleConnections.
+// New panics if an option fails, see Build for the options loaded from a configuration.
+func New(passHostHeader bool, opts ...Option) *httputil.ReverseProxy {
+	p, err := Build(passHostHeader, opts...)
+	if err != nil {
+		panic("vulcand/oxy/forward: " + err.Error())
+	}
+	return p
+}
+
+// Build creates a new ReverseProxy like New, and returns the error of the first option failing,
+// e.g. an ErrCustomTransport.
+func Build(passHostHeader bool, opts ...Option) (*httputil.ReverseProxy, error) {
 	h := NewHeaderRewriter()
+	ct := &contextTransport{defaultTransport: http.DefaultTransport, rewriter: h}
 
-	return &httputil.ReverseProxy{
+	p := &httputil.ReverseProxy{
 		Director: func(request *http.Request) {
+			// The requests are forwarded with HTTP/1.1, see EmitClientProtoHeader.
+			clientProto := request.Proto
+
 			modifyRequest(request)
 
-			h.Rewrite(request)
+			h.rewrite(request, clientProto)
+
+			// The ReverseProxy does not append the client IP to a nil X-Forwarded-For,
+			// the header built by the rewriter is restored by the transport.
+			ctx := context.WithValue(request.Context(), forwardedForKey{}, request.Header.Values(XForwardedFor))
+			*request = *request.WithContext(ctx)
+			request.Header[XForwardedFor] = nil
 
 			if !passHostHeader {
 				request.Host = request.URL.Host
+				if host, ok := HostOverrideFromContext(request.Context()); ok {
+					request.Host = host
+				}
 			}
 		},
-		ErrorHandler: utils.DefaultHandler.ServeHTTP,
+		Transport:    ct,
+		BufferPool:   utils.DefaultBufferPool,
+		ErrorHandler: errorHandler(defaultErrorHandler),
+	}
+
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkPool(p, ct); err != nil {
+		return nil, err
 	}
+	applyProxy(ct)
+
+	return p, nil
 }
 
 // Modify the request to handle the target URL.
@@ -36,11 +141,50 @@ func modifyRequest(outReq *http.Request) {
 	outReq.URL.RawQuery = u.RawQuery
 	outReq.RequestURI = "" // Outgoing request should not have RequestURI
 
+	if !outReq.ProtoAtLeast(1, 1) {
+		// The protocol upgrades (e.g. websockets) require HTTP/1.1: the upgrade of an HTTP/1.0 request is not forwarded,
+		// so that the backend answers with a regular response, framed by the server according to the client protocol.
+		removeUpgrade(outReq.Header)
+
+		// The error handler gets the outgoing request, the client protocol is kept in its context.
+		*outReq = *outReq.WithContext(context.WithValue(outReq.Context(), http10Key{}, true))
+	}
+
 	outReq.Proto = "HTTP/1.1"
 	outReq.ProtoMajor = 1
 	outReq.ProtoMinor = 1
 }
 
+type http10Key struct{}
+
+// forwardedForKey is the context key of the X-Forwarded-For header built by the HeaderRewriter.
+type forwardedForKey struct{}
+
+// isHTTP10 reports whether the client of req uses HTTP/1.0, req being the incoming or the outgoing request.
+func isHTTP10(req *http.Request) bool {
+	http10, _ := req.Context().Value(http10Key{}).(bool)
+	return http10 || !req.ProtoAtLeast(1, 1)
+}
+
+// removeUpgrade removes the Upgrade header and the upgrade token of the Connection header.
+func removeUpgrade(h http.Header) {
+	h.Del(Upgrade)
+
+	var tokens []string
+	for _, v := range h.Values(Connection) {
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token != "" && !strings.EqualFold(token, "upgrade") {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+
+	h.Del(Connection)
+	if len(tokens) > 0 {
+		h.Set(Connection, strings.Join(tokens, ", "))
+	}
+}
+
 func getURLFromRequest(req *http.Request) *url.URL {
 	// If the Request was created by Go via a real HTTP request,
 	// RequestURI will contain the original query string.
@@ -1,9 +1,17 @@
 package forward
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -92,3 +100,224 @@ func TestForwardedProto(t *testing.T) {
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 	assert.Equal(t, "https", proto)
 }
+
+type recordingRoundTripper struct {
+	used int
+}
+
+func (r *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.used++
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set("X-Tenant-Transport", "true")
+	return resp, nil
+}
+
+func TestWithRoundTripper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	t.Cleanup(srv.Close)
+
+	f := New(true)
+
+	rt := &recordingRoundTripper{}
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Tenant") == "a" {
+			req = req.WithContext(WithRoundTripper(req.Context(), rt))
+		}
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header("X-Tenant", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "true", re.Header.Get("X-Tenant-Transport"))
+	assert.Equal(t, 1, rt.used)
+
+	re, body, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Empty(t, re.Header.Get("X-Tenant-Transport"))
+	assert.Equal(t, 1, rt.used)
+}
+
+func TestWithRoundTripper_nil(t *testing.T) {
+	ctx := context.Background()
+
+	assert.Equal(t, ctx, WithRoundTripper(ctx, nil))
+	assert.Equal(t, ctx, WithWebsocketDialer(ctx, nil))
+
+	_, ok := RoundTripperFromContext(ctx)
+	assert.False(t, ok)
+
+	_, ok = WebsocketDialerFromContext(ctx)
+	assert.False(t, ok)
+}
+
+func TestWithHostOverride(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(req.Host))
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, passHostHeader := range []bool{false, true} {
+		f := New(passHostHeader)
+
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req = req.WithContext(WithHostOverride(req.Context(), "api-pool.internal:8080"))
+			req.URL = testutils.MustParseRequestURI(srv.URL)
+			f.ServeHTTP(w, req)
+		}))
+		t.Cleanup(proxy.Close)
+
+		re, body, err := testutils.Get(proxy.URL, testutils.Host("client.example.com"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+
+		if passHostHeader {
+			assert.Equal(t, "client.example.com", string(body))
+		} else {
+			assert.Equal(t, "api-pool.internal:8080", string(body))
+		}
+	}
+
+	assert.Equal(t, context.Background(), WithHostOverride(context.Background(), ""))
+}
+
+func TestWithHostOverride_serverName(t *testing.T) {
+	var mu sync.Mutex
+	var serverNames []string
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(req.Host))
+	}))
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			mu.Lock()
+			serverNames = append(serverNames, hello.ServerName)
+			mu.Unlock()
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	f := New(false)
+	// The certificate of the test server is valid for example.com and 127.0.0.1.
+	findContextTransport(f.Transport).defaultTransport = srv.Client().Transport
+
+	srvURL := testutils.MustParseRequestURI(srv.URL)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Override") != "" {
+			req = req.WithContext(WithHostOverride(req.Context(), "example.com:"+srvURL.Port()))
+		}
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header("X-Override", "1"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "example.com:"+srvURL.Port(), string(body))
+
+	re, body, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, srvURL.Host, string(body))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"example.com", ""}, serverNames)
+}
+
+func TestCopyBufferSize_concurrent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte(req.URL.Query().Get("c")), 64*1024))
+	}))
+	t.Cleanup(srv.Close)
+
+	f := New(true, CopyBufferSize(1024))
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL + "?" + req.URL.RawQuery)
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 26; i++ {
+		wg.Add(1)
+		go func(c string) {
+			defer wg.Done()
+
+			for j := 0; j < 5; j++ {
+				re, body, err := testutils.Get(proxy.URL + "?c=" + c)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, http.StatusOK, re.StatusCode)
+				assert.Equal(t, strings.Repeat(c, 64*1024), string(body))
+			}
+		}(string(rune('a' + i)))
+	}
+	wg.Wait()
+}
+
+func BenchmarkForward_largeResponse(b *testing.B) {
+	const size = 100 * 1024 * 1024
+
+	chunk := make([]byte, 32*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set(ContentLength, strconv.Itoa(size))
+		for written := 0; written < size; written += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	b.Cleanup(srv.Close)
+
+	for _, pooled := range []bool{true, false} {
+		f := New(true)
+		if !pooled {
+			f.BufferPool = nil
+		}
+
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.MustParseRequestURI(srv.URL)
+			f.ServeHTTP(w, req)
+		}))
+		b.Cleanup(proxy.Close)
+
+		for _, parallelism := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("pooled=%t/parallelism=%d", pooled, parallelism), func(b *testing.B) {
+				b.SetBytes(size)
+				b.SetParallelism(parallelism)
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						resp, err := http.Get(proxy.URL)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						_, _ = io.Copy(io.Discard, resp.Body)
+						_ = resp.Body.Close()
+					}
+				})
+			})
+		}
+	}
+}
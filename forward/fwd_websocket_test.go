@@ -2,12 +2,15 @@ package forward
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"testing"
 
 	gorillawebsocket "github.com/gorilla/websocket"
@@ -15,7 +18,6 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
 	"github.com/vulcand/oxy/v2/testutils"
-	"golang.org/x/net/websocket"
 )
 
 func TestWebSocketTCPClose(t *testing.T) {
@@ -42,10 +44,10 @@ func TestWebSocketTCPClose(t *testing.T) {
 	proxy := createProxyWithForwarder(f, srv.URL)
 
 	proxyAddr := proxy.Listener.Addr().String()
-	_, conn, err := newWebsocketRequest(
-		withServer(proxyAddr),
-		withPath("/ws"),
-	).open()
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxyAddr),
+		testutils.WSPath("/ws"),
+	)
 	require.NoError(t, err)
 	_ = conn.Close()
 
@@ -88,14 +90,11 @@ func TestWebSocketPingPong(t *testing.T) {
 	})
 	t.Cleanup(proxy.Close)
 
-	serverAddr := proxy.Listener.Addr().String()
-
-	headers := http.Header{}
-	webSocketURL := "ws://" + serverAddr + "/ws"
-	headers.Add("Origin", webSocketURL)
-
-	conn, resp, err := gorillawebsocket.DefaultDialer.Dial(webSocketURL, headers)
-	require.NoError(t, err, "Error during Dial with response: %+v", resp)
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxy.Listener.Addr().String()),
+		testutils.WSPath("/ws"),
+	)
+	require.NoError(t, err)
 	defer conn.Close()
 
 	goodErr := fmt.Errorf("signal: %s", "Good data")
@@ -118,17 +117,7 @@ func TestWebSocketPingPong(t *testing.T) {
 func TestWebSocketEcho(t *testing.T) {
 	f := New(true)
 
-	mux := http.NewServeMux()
-	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
-		msg := make([]byte, 4)
-		_, _ = conn.Read(msg)
-		t.Log(string(msg))
-		_, _ = conn.Write(msg)
-		_ = conn.Close()
-	}))
-
-	srv := httptest.NewServer(mux)
-	t.Cleanup(srv.Close)
+	srv := testutils.NewWSEchoServer(t)
 
 	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		req.URL = testutils.MustParseRequestURI(srv.URL)
@@ -136,17 +125,14 @@ func TestWebSocketEcho(t *testing.T) {
 	})
 	t.Cleanup(proxy.Close)
 
-	serverAddr := proxy.Listener.Addr().String()
-
-	headers := http.Header{}
-	webSocketURL := "ws://" + serverAddr + "/ws"
-	headers.Add("Origin", webSocketURL)
-
-	conn, resp, err := gorillawebsocket.DefaultDialer.Dial(webSocketURL, headers)
-	require.NoError(t, err, "Error during Dial with response: %+v", resp)
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxy.Listener.Addr().String()),
+		testutils.WSPath("/ws"),
+	)
+	require.NoError(t, err)
 
-	_ = conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK"))
-	t.Log(conn.ReadMessage())
+	require.NoError(t, conn.SendText("OK"))
+	require.NoError(t, conn.Expect("OK"))
 
 	_ = conn.Close()
 }
@@ -172,44 +158,29 @@ func TestWebSocketPassHost(t *testing.T) {
 		t.Run(test.desc, func(t *testing.T) {
 			f := New(test.passHost)
 
-			mux := http.NewServeMux()
-			mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
-				req := conn.Request()
-
+			srv := testutils.NewWSEchoServer(t, testutils.WSAnyOrigin(), testutils.WSOnUpgrade(func(req *http.Request) {
 				if test.passHost {
-					require.Equal(t, test.expected, req.Host)
+					assert.Equal(t, test.expected, req.Host)
 				} else {
-					require.NotEqual(t, test.expected, req.Host)
+					assert.NotEqual(t, test.expected, req.Host)
 				}
-
-				msg := make([]byte, 4)
-				_, _ = conn.Read(msg)
-				t.Log(string(msg))
-				_, _ = conn.Write(msg)
-				_ = conn.Close()
 			}))
 
-			srv := httptest.NewServer(mux)
-			t.Cleanup(srv.Close)
-
 			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 				req.URL = testutils.MustParseRequestURI(srv.URL)
 				f.ServeHTTP(w, req)
 			})
 			t.Cleanup(proxy.Close)
 
-			serverAddr := proxy.Listener.Addr().String()
+			conn, err := testutils.WSRequest(
+				testutils.WSServer(proxy.Listener.Addr().String()),
+				testutils.WSPath("/ws"),
+				testutils.WSHeader("Host", "example.com"),
+			)
+			require.NoError(t, err)
 
-			headers := http.Header{}
-			webSocketURL := "ws://" + serverAddr + "/ws"
-			headers.Add("Origin", webSocketURL)
-			headers.Add("Host", "example.com")
-
-			conn, resp, err := gorillawebsocket.DefaultDialer.Dial(webSocketURL, headers)
-			require.NoError(t, err, "Error during Dial with response: %+v", resp)
-
-			_ = conn.WriteMessage(gorillawebsocket.TextMessage, []byte("OK"))
-			t.Log(conn.ReadMessage())
+			require.NoError(t, conn.SendText("OK"))
+			require.NoError(t, conn.Expect("OK"))
 
 			_ = conn.Close()
 		})
@@ -219,136 +190,77 @@ func TestWebSocketPassHost(t *testing.T) {
 func TestWebSocketServerWithoutCheckOrigin(t *testing.T) {
 	f := New(true)
 
-	upgrader := gorillawebsocket.Upgrader{CheckOrigin: func(_ *http.Request) bool {
-		return true
-	}}
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			return
-		}
-		defer c.Close()
-		for {
-			mt, message, err := c.ReadMessage()
-			if err != nil {
-				break
-			}
-			err = c.WriteMessage(mt, message)
-			if err != nil {
-				break
-			}
-		}
-	}))
-	t.Cleanup(srv.Close)
+	srv := testutils.NewWSEchoServer(t, testutils.WSAnyOrigin())
 
 	proxy := createProxyWithForwarder(f, srv.URL)
 	t.Cleanup(proxy.Close)
 
-	proxyAddr := proxy.Listener.Addr().String()
-	resp, err := newWebsocketRequest(
-		withServer(proxyAddr),
-		withPath("/ws"),
-		withData("ok"),
-		withOrigin("http://127.0.0.2"),
-	).send()
-
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxy.Listener.Addr().String()),
+		testutils.WSPath("/ws"),
+		testutils.WSOrigin("http://127.0.0.2"),
+	)
 	require.NoError(t, err)
-	assert.Equal(t, "ok", resp)
+	defer conn.Close()
+
+	require.NoError(t, conn.SendText("ok"))
+	require.NoError(t, conn.Expect("ok"))
 }
 
 func TestWebSocketRequestWithOrigin(t *testing.T) {
 	f := New(true)
 
-	upgrader := gorillawebsocket.Upgrader{}
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			return
-		}
-		defer c.Close()
-		for {
-			mt, message, err := c.ReadMessage()
-			if err != nil {
-				break
-			}
-			err = c.WriteMessage(mt, message)
-			if err != nil {
-				break
-			}
-		}
-	}))
-	t.Cleanup(srv.Close)
+	srv := testutils.NewWSEchoServer(t)
 
 	proxy := createProxyWithForwarder(f, srv.URL)
 	t.Cleanup(proxy.Close)
 
 	proxyAddr := proxy.Listener.Addr().String()
-	_, err := newWebsocketRequest(
-		withServer(proxyAddr),
-		withPath("/ws"),
-		withData("echo"),
-		withOrigin("http://127.0.0.2"),
-	).send()
-	require.EqualError(t, err, "bad status")
-
-	resp, err := newWebsocketRequest(
-		withServer(proxyAddr),
-		withPath("/ws"),
-		withData("ok"),
-	).send()
-
+	_, err := testutils.WSRequest(
+		testutils.WSServer(proxyAddr),
+		testutils.WSPath("/ws"),
+		testutils.WSOrigin("http://127.0.0.2"),
+	)
+	var errHandshake *testutils.ErrWSHandshake
+	require.ErrorAs(t, err, &errHandshake)
+	assert.Equal(t, http.StatusForbidden, errHandshake.Response.StatusCode)
+
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxyAddr),
+		testutils.WSPath("/ws"),
+	)
 	require.NoError(t, err)
-	assert.Equal(t, "ok", resp)
+	defer conn.Close()
+
+	require.NoError(t, conn.SendText("ok"))
+	require.NoError(t, conn.Expect("ok"))
 }
 
 func TestWebSocketRequestWithQueryParams(t *testing.T) {
 	f := New(true)
 
-	upgrader := gorillawebsocket.Upgrader{}
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			return
-		}
-		defer conn.Close()
-		assert.Equal(t, "test", r.URL.Query().Get("query"))
-		for {
-			mt, message, err := conn.ReadMessage()
-			if err != nil {
-				break
-			}
-			err = conn.WriteMessage(mt, message)
-			if err != nil {
-				break
-			}
-		}
+	srv := testutils.NewWSEchoServer(t, testutils.WSOnUpgrade(func(req *http.Request) {
+		assert.Equal(t, "test", req.URL.Query().Get("query"))
 	}))
-	t.Cleanup(srv.Close)
 
 	proxy := createProxyWithForwarder(f, srv.URL)
 	t.Cleanup(proxy.Close)
 
-	proxyAddr := proxy.Listener.Addr().String()
-
-	resp, err := newWebsocketRequest(
-		withServer(proxyAddr),
-		withPath("/ws?query=test"),
-		withData("ok"),
-	).send()
-
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxy.Listener.Addr().String()),
+		testutils.WSPath("/ws?query=test"),
+	)
 	require.NoError(t, err)
-	assert.Equal(t, "ok", resp)
+	defer conn.Close()
+
+	require.NoError(t, conn.SendText("ok"))
+	require.NoError(t, conn.Expect("ok"))
 }
 
 func TestWebSocketRequestWithHeadersInResponseWriter(t *testing.T) {
 	f := New(true)
 
-	mux := http.NewServeMux()
-	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
-		_ = conn.Close()
-	}))
-	srv := httptest.NewServer(mux)
-	t.Cleanup(srv.Close)
+	srv := testutils.NewWSEchoServer(t)
 
 	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		req.URL = testutils.MustParseRequestURI(srv.URL)
@@ -357,67 +269,41 @@ func TestWebSocketRequestWithHeadersInResponseWriter(t *testing.T) {
 	})
 	t.Cleanup(proxy.Close)
 
-	serverAddr := proxy.Listener.Addr().String()
-
-	headers := http.Header{}
-	webSocketURL := "ws://" + serverAddr + "/ws"
-	headers.Add("Origin", webSocketURL)
-	conn, resp, err := gorillawebsocket.DefaultDialer.Dial(webSocketURL, headers)
-	require.NoError(t, err, "Error during Dial with response: %+v", err, resp)
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxy.Listener.Addr().String()),
+		testutils.WSPath("/ws"),
+	)
+	require.NoError(t, err)
 	t.Cleanup(func() { _ = conn.Close() })
 
-	assert.Equal(t, "HEADER-VALUE", resp.Header.Get("HEADER-KEY"))
+	assert.Equal(t, "HEADER-VALUE", conn.HandshakeResponse().Header.Get("HEADER-KEY"))
 }
 
 func TestWebSocketRequestWithEncodedChar(t *testing.T) {
 	f := New(true)
 
-	upgrader := gorillawebsocket.Upgrader{}
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			return
-		}
-		defer conn.Close()
-		assert.Equal(t, "/%3A%2F%2F", r.URL.EscapedPath())
-		for {
-			mt, message, err := conn.ReadMessage()
-			if err != nil {
-				break
-			}
-			err = conn.WriteMessage(mt, message)
-			if err != nil {
-				break
-			}
-		}
+	srv := testutils.NewWSEchoServer(t, testutils.WSOnUpgrade(func(req *http.Request) {
+		assert.Equal(t, "/%3A%2F%2F", req.URL.EscapedPath())
 	}))
-	t.Cleanup(srv.Close)
 
 	proxy := createProxyWithForwarder(f, srv.URL)
 	t.Cleanup(proxy.Close)
 
-	proxyAddr := proxy.Listener.Addr().String()
-
-	resp, err := newWebsocketRequest(
-		withServer(proxyAddr),
-		withPath("/%3A%2F%2F"),
-		withData("ok"),
-	).send()
-
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxy.Listener.Addr().String()),
+		testutils.WSPath("/%3A%2F%2F"),
+	)
 	require.NoError(t, err)
-	assert.Equal(t, "ok", resp)
+	defer conn.Close()
+
+	require.NoError(t, conn.SendText("ok"))
+	require.NoError(t, conn.Expect("ok"))
 }
 
 func TestWebSocketUpgradeFailed(t *testing.T) {
 	f := New(true)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(http.StatusBadRequest)
-	})
-
-	srv := httptest.NewServer(mux)
-	t.Cleanup(srv.Close)
+	srv := testutils.NewWSRejectServer(t, http.StatusBadRequest)
 
 	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		path := req.URL.Path // keep the original path
@@ -453,51 +339,136 @@ func TestWebSocketUpgradeFailed(t *testing.T) {
 	assert.Equal(t, 400, resp.StatusCode)
 }
 
-func TestForwardsWebsocketTraffic(t *testing.T) {
+func TestWebSocketUpgradeFailed_http10(t *testing.T) {
 	f := New(true)
 
-	mux := http.NewServeMux()
-	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
-		_, _ = conn.Write([]byte("ok"))
-		_ = conn.Close()
+	var upgrade string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upgrade = req.Header.Get("Upgrade")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("bad upgrade"))
+		// the response of the backend is chunked.
+		w.(http.Flusher).Flush()
 	}))
-	srv := httptest.NewServer(mux)
 	t.Cleanup(srv.Close)
 
 	proxy := createProxyWithForwarder(f, srv.URL)
 	t.Cleanup(proxy.Close)
 
-	proxyAddr := proxy.Listener.Addr().String()
-	resp, err := newWebsocketRequest(
-		withServer(proxyAddr),
-		withPath("/ws"),
-		withData("echo"),
-	).send()
+	conn, err := net.DialTimeout("tcp", proxy.Listener.Addr().String(), dialTimeout)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = fmt.Fprint(conn, "GET /ws HTTP/1.0\r\nHost: 127.0.0.1\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	require.NoError(t, err)
 
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "HTTP/1.0", resp.Proto)
+	assert.Empty(t, resp.TransferEncoding)
+	assert.Empty(t, resp.Header.Get("Upgrade"))
+
+	body, err := io.ReadAll(resp.Body)
 	require.NoError(t, err)
-	assert.Equal(t, "ok", resp)
+	assert.Equal(t, "bad upgrade", string(body))
+
+	// the upgrade is not forwarded for HTTP/1.0 clients.
+	assert.Empty(t, upgrade)
+
+	assertClosed(t, conn, br)
 }
 
-func createTLSWebsocketServer() *httptest.Server {
-	upgrader := gorillawebsocket.Upgrader{}
-	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			return
-		}
-		defer conn.Close()
-		for {
-			mt, message, err := conn.ReadMessage()
-			if err != nil {
-				break
-			}
-			err = conn.WriteMessage(mt, message)
-			if err != nil {
-				break
-			}
-		}
-	}))
-	return srv
+func TestForwarder_errorHTTP10(t *testing.T) {
+	f := New(true)
+
+	proxy := createProxyWithForwarder(f, "http://localhost:63450")
+	t.Cleanup(proxy.Close)
+
+	conn, err := net.DialTimeout("tcp", proxy.Listener.Addr().String(), dialTimeout)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = fmt.Fprint(conn, "GET /ws HTTP/1.0\r\nHost: 127.0.0.1\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, "HTTP/1.0", resp.Proto)
+	assert.Empty(t, resp.TransferEncoding)
+	assert.True(t, resp.Close)
+
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assertClosed(t, conn, br)
+}
+
+// assertClosed asserts that the server closes the connection.
+func assertClosed(t *testing.T, conn net.Conn, br *bufio.Reader) {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(clock.Now().Add(clock.Second)))
+	_, err := br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestForwardsWebsocketTraffic(t *testing.T) {
+	f := New(true)
+
+	srv := testutils.NewWSEchoServer(t)
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	t.Cleanup(proxy.Close)
+
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxy.Listener.Addr().String()),
+		testutils.WSPath("/ws"),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SendText("echo"))
+	require.NoError(t, conn.Expect("echo"))
+}
+
+type recordingDialer struct {
+	dialer net.Dialer
+	dialed []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dialed = append(d.dialed, address)
+	return d.dialer.DialContext(ctx, network, address)
+}
+
+func TestWithWebsocketDialer(t *testing.T) {
+	f := New(true)
+
+	srv := testutils.NewWSEchoServer(t)
+
+	d := &recordingDialer{}
+
+	proxy := createProxyWithForwarder(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f.ServeHTTP(w, req.WithContext(WithWebsocketDialer(req.Context(), d)))
+	}), srv.URL)
+	t.Cleanup(proxy.Close)
+
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxy.Listener.Addr().String()),
+		testutils.WSPath("/ws"),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SendText("echo"))
+	require.NoError(t, conn.Expect("echo"))
+	assert.Equal(t, []string{srv.Listener.Addr().String()}, d.dialed)
 }
 
 func createProxyWithForwarder(forwarder http.Handler, uri string) *httptest.Server {
@@ -512,8 +483,7 @@ func createProxyWithForwarder(forwarder http.Handler, uri string) *httptest.Serv
 }
 
 func TestWebSocketTransferTLSConfig(t *testing.T) {
-	srv := createTLSWebsocketServer()
-	t.Cleanup(srv.Close)
+	srv := testutils.NewWSEchoServer(t, testutils.WSServerTLS())
 
 	forwarderWithoutTLSConfig := New(true)
 
@@ -522,13 +492,14 @@ func TestWebSocketTransferTLSConfig(t *testing.T) {
 
 	proxyAddr := proxyWithoutTLSConfig.Listener.Addr().String()
 
-	_, err := newWebsocketRequest(
-		withServer(proxyAddr),
-		withPath("/ws"),
-		withData("ok"),
-	).send()
+	_, err := testutils.WSRequest(
+		testutils.WSServer(proxyAddr),
+		testutils.WSPath("/ws"),
+	)
 
-	require.EqualError(t, err, "bad status")
+	var errHandshake *testutils.ErrWSHandshake
+	require.ErrorAs(t, err, &errHandshake)
+	assert.Equal(t, http.StatusBadGateway, errHandshake.Response.StatusCode)
 
 	transport := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
@@ -541,14 +512,7 @@ func TestWebSocketTransferTLSConfig(t *testing.T) {
 
 	proxyAddr = proxyWithTLSConfig.Listener.Addr().String()
 
-	resp, err := newWebsocketRequest(
-		withServer(proxyAddr),
-		withPath("/ws"),
-		withData("ok"),
-	).send()
-
-	require.NoError(t, err)
-	assert.Equal(t, "ok", resp)
+	assertEcho(t, proxyAddr, "ok")
 
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 
@@ -559,95 +523,62 @@ func TestWebSocketTransferTLSConfig(t *testing.T) {
 
 	proxyAddr = proxyWithTLSConfigFromDefaultTransport.Listener.Addr().String()
 
-	resp, err = newWebsocketRequest(
-		withServer(proxyAddr),
-		withPath("/ws"),
-		withData("ok"),
-	).send()
-
-	require.NoError(t, err)
-	assert.Equal(t, "ok", resp)
+	assertEcho(t, proxyAddr, "ok")
 }
 
-const dialTimeout = clock.Second
-
-type websocketRequestOpt func(w *websocketRequest)
+// assertEcho asserts that the message is echoed through the websocket proxy at proxyAddr.
+func assertEcho(t *testing.T, proxyAddr, msg string) {
+	t.Helper()
 
-func withServer(server string) websocketRequestOpt {
-	return func(w *websocketRequest) {
-		w.ServerAddr = server
-	}
-}
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxyAddr),
+		testutils.WSPath("/ws"),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
 
-func withPath(path string) websocketRequestOpt {
-	return func(w *websocketRequest) {
-		w.Path = path
-	}
+	require.NoError(t, conn.SendText(msg))
+	require.NoError(t, conn.Expect(msg))
 }
 
-func withData(data string) websocketRequestOpt {
-	return func(w *websocketRequest) {
-		w.Data = data
-	}
-}
+func TestWebSocketTLSWithHeaders(t *testing.T) {
+	tokens := make(chan string, 1)
+	srv := testutils.NewWSEchoServer(t, testutils.WSServerTLS(), testutils.WSOnUpgrade(func(req *http.Request) {
+		tokens <- req.Header.Get("X-Token")
+	}))
 
-func withOrigin(origin string) websocketRequestOpt {
-	return func(w *websocketRequest) {
-		w.Origin = origin
-	}
-}
+	f := New(true, func(p *httputil.ReverseProxy) error {
+		//nolint:gosec // test server
+		p.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		return nil
+	})
 
-func newWebsocketRequest(opts ...websocketRequestOpt) *websocketRequest {
-	wsrequest := &websocketRequest{}
-	for _, opt := range opts {
-		opt(wsrequest)
-	}
-	if wsrequest.Origin == "" {
-		wsrequest.Origin = "http://" + wsrequest.ServerAddr
-	}
-	if wsrequest.Config == nil {
-		wsrequest.Config, _ = websocket.NewConfig(fmt.Sprintf("ws://%s%s", wsrequest.ServerAddr, wsrequest.Path), wsrequest.Origin)
-	}
-	return wsrequest
-}
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL + req.URL.Path)
+		w.Header().Set("X-Proxy", "oxy")
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
 
-type websocketRequest struct {
-	ServerAddr string
-	Path       string
-	Data       string
-	Origin     string
-	Config     *websocket.Config
-}
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxy.Listener.Addr().String()),
+		testutils.WSPath("/ws"),
+		testutils.WSTLS(),
+		testutils.WSHeader("X-Token", "secret"),
+		testutils.WSDialTimeout(dialTimeout),
+	)
+	require.NoError(t, err)
 
-func (w *websocketRequest) send() (string, error) {
-	conn, _, err := w.open()
-	if err != nil {
-		return "", err
-	}
-	defer conn.Close()
-	if _, err := conn.Write([]byte(w.Data)); err != nil {
-		return "", err
-	}
+	assert.Equal(t, "secret", <-tokens)
 
-	msg := make([]byte, 512)
-	var n int
-	n, err = conn.Read(msg)
-	if err != nil {
-		return "", err
-	}
+	resp := conn.HandshakeResponse()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "oxy", resp.Header.Get("X-Proxy"))
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
 
-	received := string(msg[:n])
-	return received, nil
+	require.NoError(t, conn.SendText("over TLS"))
+	require.NoError(t, conn.Expect("over TLS"))
+	require.NoError(t, conn.CloseWithCode(gorillawebsocket.CloseNormalClosure))
 }
 
-func (w *websocketRequest) open() (*websocket.Conn, net.Conn, error) {
-	client, err := net.DialTimeout("tcp", w.ServerAddr, dialTimeout)
-	if err != nil {
-		return nil, nil, err
-	}
-	conn, err := websocket.NewClient(w.Config, client)
-	if err != nil {
-		return nil, nil, err
-	}
-	return conn, client, err
-}
+const dialTimeout = clock.Second
@@ -0,0 +1,192 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// DuplicatePolicy decides what happens to the repeated headers of the requests, see Limits.
+type DuplicatePolicy int
+
+const (
+	// DuplicateAllow forwards the repeated headers as received.
+	DuplicateAllow DuplicatePolicy = iota
+	// DuplicateReject rejects the requests repeating a header that is not a list (e.g. Authorization or X-Request-Id).
+	DuplicateReject
+	// DuplicateFirst keeps the first value of the repeated headers that are not lists.
+	DuplicateFirst
+	// DuplicateJoin joins the values of the repeated list headers (e.g. Accept) with commas,
+	// and rejects the requests repeating a header that is not a list: its values can't be joined.
+	DuplicateJoin
+)
+
+// The reasons of an ErrHeaderLimit.
+const (
+	HeaderLimitCount     = "count"
+	HeaderLimitBytes     = "bytes"
+	HeaderLimitValue     = "value"
+	HeaderLimitDuplicate = "duplicate"
+)
+
+// listHeaders are the request headers defined as comma-separated lists: they can be repeated, and their values joined.
+var listHeaders = map[string]struct{}{
+	"Accept":          {},
+	"Accept-Charset":  {},
+	"Accept-Encoding": {},
+	"Accept-Language": {},
+	"Cache-Control":   {},
+	Connection:        {},
+	"Forwarded":       {},
+	"If-Match":        {},
+	"If-None-Match":   {},
+	"Pragma":          {},
+	Te:                {},
+	TransferEncoding:  {},
+	Upgrade:           {},
+	"Via":             {},
+	"Warning":         {},
+	XForwardedFor:     {},
+}
+
+// Limits are the limits of the headers of the requests forwarded to the backends, see HeaderLimits.
+// The zero values disable the limits.
+type Limits struct {
+	// MaxHeaderBytes is the maximum size of the headers, each header line counting as "Name: value\r\n".
+	MaxHeaderBytes int
+	// MaxHeaderCount is the maximum number of header lines, a repeated header counting once per value.
+	MaxHeaderCount int
+	// MaxValueBytes is the maximum size of a header value.
+	MaxValueBytes int
+	// DuplicatePolicy decides what happens to the repeated headers.
+	DuplicatePolicy DuplicatePolicy
+}
+
+// ErrHeaderLimit is returned when the headers of a request exceed the HeaderLimits,
+// or repeat a header rejected by the DuplicatePolicy. The default error handler answers 431.
+type ErrHeaderLimit struct {
+	// Reason is HeaderLimitCount, HeaderLimitBytes, HeaderLimitValue or HeaderLimitDuplicate.
+	Reason string
+	// Header is the name of the header over the limit, empty when the limit is on all the headers.
+	Header string
+}
+
+func (e *ErrHeaderLimit) Error() string {
+	switch e.Reason {
+	case HeaderLimitCount:
+		return "too many request headers"
+	case HeaderLimitBytes:
+		return "request headers too large"
+	case HeaderLimitValue:
+		return fmt.Sprintf("request header %s too large", e.Header)
+	default:
+		return fmt.Sprintf("request header %s repeated", e.Header)
+	}
+}
+
+// HeaderLimits limits the headers of the requests forwarded to the backends, websocket upgrades included.
+// The duplicate policy is applied first, then the limits are checked on the headers sent to the backend,
+// including the forwarding headers (e.g. X-Forwarded-For).
+// The requests over the limits are not forwarded, the error handler gets an ErrHeaderLimit.
+// The requests within the limits are forwarded unchanged.
+func HeaderLimits(l Limits) Option {
+	return func(p *httputil.ReverseProxy) error {
+		p.Transport = &headerLimitsTransport{next: p.Transport, limits: l}
+		return nil
+	}
+}
+
+// headerLimitsTransport enforces the Limits before passing the requests to the next round tripper.
+type headerLimitsTransport struct {
+	next   http.RoundTripper
+	limits Limits
+}
+
+func (t *headerLimitsTransport) unwrap() http.RoundTripper {
+	return t.next
+}
+
+func (t *headerLimitsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	header, err := t.limits.apply(req.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	if header != nil {
+		outReq := *req
+		outReq.Header = header
+		req = &outReq
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// apply checks the headers against the limits.
+// It returns the headers changed by the duplicate policy, or nil if they are forwarded as is.
+func (l Limits) apply(h http.Header) (http.Header, error) {
+	var out http.Header
+
+	if l.DuplicatePolicy != DuplicateAllow {
+		for name, values := range h {
+			if len(values) < 2 {
+				continue
+			}
+
+			_, list := listHeaders[name]
+
+			var value string
+			switch {
+			case list && l.DuplicatePolicy != DuplicateJoin:
+				continue
+			case list:
+				value = strings.Join(values, ", ")
+			case l.DuplicatePolicy == DuplicateFirst:
+				value = values[0]
+			default:
+				return nil, &ErrHeaderLimit{Reason: HeaderLimitDuplicate, Header: name}
+			}
+
+			if out == nil {
+				out = h.Clone()
+			}
+			out[name] = []string{value}
+		}
+	}
+
+	checked := h
+	if out != nil {
+		checked = out
+	}
+
+	if err := l.check(checked); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// check checks the sizes of the headers.
+func (l Limits) check(h http.Header) error {
+	if l.MaxHeaderBytes <= 0 && l.MaxHeaderCount <= 0 && l.MaxValueBytes <= 0 {
+		return nil
+	}
+
+	count, size := 0, 0
+	for name, values := range h {
+		for _, v := range values {
+			if l.MaxValueBytes > 0 && len(v) > l.MaxValueBytes {
+				return &ErrHeaderLimit{Reason: HeaderLimitValue, Header: name}
+			}
+			count++
+			size += len(name) + len(v) + len(": \r\n")
+		}
+	}
+
+	if l.MaxHeaderCount > 0 && count > l.MaxHeaderCount {
+		return &ErrHeaderLimit{Reason: HeaderLimitCount}
+	}
+	if l.MaxHeaderBytes > 0 && size > l.MaxHeaderBytes {
+		return &ErrHeaderLimit{Reason: HeaderLimitBytes}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package forward
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// limitsBackend records the requests it receives.
+type limitsBackend struct {
+	url      string
+	requests atomic.Int64
+	header   atomic.Pointer[http.Header]
+	dump     atomic.Pointer[string]
+}
+
+func newLimitsBackend(t *testing.T) *limitsBackend {
+	t.Helper()
+
+	b := &limitsBackend{}
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		b.requests.Add(1)
+		h := req.Header.Clone()
+		b.header.Store(&h)
+		raw, _ := httputil.DumpRequest(req, true)
+		dump := string(raw)
+		b.dump.Store(&dump)
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	b.url = srv.URL
+	return b
+}
+
+// newLimitsProxy returns a proxy forwarding the requests to target, accepting 2MB of headers.
+// The recent servers also reject the requests with more than 500 header values.
+func newLimitsProxy(t *testing.T, target string, opts ...Option) string {
+	t.Helper()
+
+	f := New(false, opts...)
+
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(target)
+		f.ServeHTTP(w, req)
+	}))
+	proxy.Config.MaxHeaderBytes = 2 << 20
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+
+	return proxy.URL
+}
+
+func repeatedHeader(name string, n int) testutils.ReqOption {
+	h := make(http.Header)
+	for i := 0; i < n; i++ {
+		h.Add(name, "value-"+strconv.Itoa(i))
+	}
+	return testutils.Headers(h)
+}
+
+func TestHeaderLimits_count(t *testing.T) {
+	backend := newLimitsBackend(t)
+	proxyURL := newLimitsProxy(t, backend.url, HeaderLimits(Limits{MaxHeaderCount: 100}))
+
+	re, body, err := testutils.Get(proxyURL, repeatedHeader("X-Custom", 400))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, re.StatusCode)
+	assert.Equal(t, http.StatusText(http.StatusRequestHeaderFieldsTooLarge), string(body))
+	assert.Equal(t, int64(0), backend.requests.Load())
+
+	re, _, err = testutils.Get(proxyURL, repeatedHeader("X-Custom", 50))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Len(t, (*backend.header.Load()).Values("X-Custom"), 50)
+}
+
+func TestHeaderLimits_joinListHeaders(t *testing.T) {
+	backend := newLimitsBackend(t)
+	proxyURL := newLimitsProxy(t, backend.url, HeaderLimits(Limits{MaxHeaderCount: 100, DuplicatePolicy: DuplicateJoin}))
+
+	re, _, err := testutils.Get(proxyURL, repeatedHeader("Accept", 400))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	accept := (*backend.header.Load()).Values("Accept")
+	require.Len(t, accept, 1)
+	assert.Len(t, strings.Split(accept[0], ", "), 400)
+	assert.True(t, strings.HasPrefix(accept[0], "value-0, value-1, "))
+}
+
+func TestHeaderLimits_valueBytes(t *testing.T) {
+	backend := newLimitsBackend(t)
+	proxyURL := newLimitsProxy(t, backend.url, HeaderLimits(Limits{MaxValueBytes: 8 << 10, MaxHeaderBytes: 64 << 10}))
+
+	re, _, err := testutils.Get(proxyURL, testutils.Header("X-Large", strings.Repeat("a", 1<<20)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, re.StatusCode)
+
+	// The total size is also limited.
+	h := make(http.Header)
+	for i := 0; i < 16; i++ {
+		h.Set("X-Large-"+strconv.Itoa(i), strings.Repeat("a", 8<<10))
+	}
+	re, _, err = testutils.Get(proxyURL, testutils.Headers(h))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, re.StatusCode)
+
+	assert.Equal(t, int64(0), backend.requests.Load())
+}
+
+func TestHeaderLimits_duplicateAuthorization(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		policy   DuplicatePolicy
+		expected int
+		values   []string
+	}{
+		{desc: "allow", policy: DuplicateAllow, expected: http.StatusOK, values: []string{"Bearer a", "Bearer b"}},
+		{desc: "reject", policy: DuplicateReject, expected: http.StatusRequestHeaderFieldsTooLarge},
+		{desc: "first", policy: DuplicateFirst, expected: http.StatusOK, values: []string{"Bearer a"}},
+		{desc: "join", policy: DuplicateJoin, expected: http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			backend := newLimitsBackend(t)
+			proxyURL := newLimitsProxy(t, backend.url, HeaderLimits(Limits{DuplicatePolicy: test.policy}))
+
+			re, _, err := testutils.Get(proxyURL,
+				testutils.Header("Authorization", "Bearer a"),
+				testutils.Header("Authorization", "Bearer b"),
+				testutils.Header("Accept", "text/html"),
+				testutils.Header("Accept", "application/json"))
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, re.StatusCode)
+
+			if test.values == nil {
+				assert.Equal(t, int64(0), backend.requests.Load())
+				return
+			}
+
+			header := *backend.header.Load()
+			assert.Equal(t, test.values, header.Values("Authorization"))
+			// The list headers are repeated as received.
+			assert.Equal(t, []string{"text/html", "application/json"}, header.Values("Accept"))
+		})
+	}
+}
+
+func TestHeaderLimits_errorHandler(t *testing.T) {
+	backend := newLimitsBackend(t)
+
+	var handled error
+	proxyURL := newLimitsProxy(t, backend.url,
+		HeaderLimits(Limits{DuplicatePolicy: DuplicateReject}),
+		ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, _ *http.Request, err error) {
+			handled = err
+			w.WriteHeader(http.StatusBadRequest)
+		})))
+
+	re, _, err := testutils.Get(proxyURL,
+		testutils.Header("X-Request-Id", "a"),
+		testutils.Header("X-Request-Id", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, re.StatusCode)
+
+	var errLimit *ErrHeaderLimit
+	require.True(t, errors.As(handled, &errLimit))
+	assert.Equal(t, &ErrHeaderLimit{Reason: HeaderLimitDuplicate, Header: "X-Request-Id"}, errLimit)
+	assert.Equal(t, "forward", utils.ErrorComponent(handled))
+	assert.Empty(t, ErrorKind(handled))
+}
+
+func TestHeaderLimits_compliantRequestUnchanged(t *testing.T) {
+	backend := newLimitsBackend(t)
+	plainURL := newLimitsProxy(t, backend.url)
+	limitedURL := newLimitsProxy(t, backend.url, HeaderLimits(Limits{
+		MaxHeaderBytes:  8 << 10,
+		MaxHeaderCount:  50,
+		MaxValueBytes:   1 << 10,
+		DuplicatePolicy: DuplicateJoin,
+	}))
+
+	opts := []testutils.ReqOption{
+		testutils.Header("Authorization", "Bearer a"),
+		testutils.Header("X-Request-Id", "1bd36bcc"),
+		testutils.Header("Accept-Encoding", "identity"),
+		testutils.Host("example.com"),
+		testutils.Body("hello"),
+	}
+
+	_, _, err := testutils.Post(plainURL, opts...)
+	require.NoError(t, err)
+	expected := *backend.dump.Load()
+
+	re, _, err := testutils.Post(limitedURL, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// The forwarding headers carry the address of the proxy.
+	strip := func(dump string) string {
+		var lines []string
+		for _, line := range strings.Split(dump, "\r\n") {
+			if !strings.HasPrefix(line, "X-Forwarded-") {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\r\n")
+	}
+	assert.Equal(t, strip(expected), strip(*backend.dump.Load()))
+}
+
+func TestHeaderLimits_websocket(t *testing.T) {
+	srv := testutils.NewWSEchoServer(t, testutils.WSAnyOrigin())
+	proxyURL := newLimitsProxy(t, srv.URL, HeaderLimits(Limits{MaxValueBytes: 1 << 10}))
+	proxyAddr := testutils.MustParseRequestURI(proxyURL).Host
+
+	_, err := testutils.WSRequest(
+		testutils.WSServer(proxyAddr),
+		testutils.WSHeader("X-Large", strings.Repeat("a", 4<<10)),
+	)
+	var errHandshake *testutils.ErrWSHandshake
+	require.ErrorAs(t, err, &errHandshake)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, errHandshake.Response.StatusCode)
+
+	conn, err := testutils.WSRequest(testutils.WSServer(proxyAddr))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	require.NoError(t, conn.SendText("hello"))
+	require.NoError(t, conn.Expect("hello"))
+}
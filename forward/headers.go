@@ -8,6 +8,8 @@ const (
 	XForwardedPort   = "X-Forwarded-Port"
 	XForwardedServer = "X-Forwarded-Server"
 	XRealIP          = "X-Real-Ip"
+
+	XOxyUpstreamStatus = "X-Oxy-Upstream-Status"
 )
 
 // Headers names.
@@ -21,6 +23,11 @@ const (
 	TransferEncoding   = "Transfer-Encoding"
 	Upgrade            = "Upgrade"
 	ContentLength      = "Content-Length"
+	ContentEncoding    = "Content-Encoding"
+	ServerTiming       = "Server-Timing"
+	CacheControl       = "Cache-Control"
+	Vary               = "Vary"
+	RetryAfter         = "Retry-After"
 )
 
 // WebSocket Header names.
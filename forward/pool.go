@@ -0,0 +1,291 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolStat reports the connections of a forwarder to a backend, see PoolStats.
+type PoolStat struct {
+	// Active is the number of open connections serving a request, or not yet returned to the pool.
+	Active int64
+	// Idle is the number of open connections waiting in the pool.
+	Idle int64
+	// Dials is the number of connections dialed, including the dials of the websocket requests.
+	Dials uint64
+	// DialFailures is the number of dials that failed.
+	DialFailures uint64
+}
+
+// MaxConnsPerHost limits the number of connections to a backend, dialing, active and idle ones included.
+// The requests above the limit wait for a connection. 0 means no limit.
+// See PoolStats for the connections of the forwarder.
+//
+// The pool options (MaxConnsPerHost, MaxIdleConnsPerHost and IdleConnTimeout) configure a Transport dedicated
+// to the forwarder, created from http.DefaultTransport.
+// They return an ErrCustomTransport if they are combined with a custom Transport, whose pool is configured by its owner.
+func MaxConnsPerHost(n int) Option {
+	return func(p *httputil.ReverseProxy) error {
+		pt, err := pool(p, "MaxConnsPerHost")
+		if err != nil {
+			return err
+		}
+		pt.transport.MaxConnsPerHost = n
+		return nil
+	}
+}
+
+// MaxIdleConnsPerHost limits the number of idle connections kept to a backend, see MaxConnsPerHost.
+// 0 means http.DefaultMaxIdleConnsPerHost.
+func MaxIdleConnsPerHost(n int) Option {
+	return func(p *httputil.ReverseProxy) error {
+		pt, err := pool(p, "MaxIdleConnsPerHost")
+		if err != nil {
+			return err
+		}
+		pt.transport.MaxIdleConnsPerHost = n
+		return nil
+	}
+}
+
+// IdleConnTimeout closes the connections idle for d, see MaxConnsPerHost. 0 means no timeout.
+func IdleConnTimeout(d time.Duration) Option {
+	return func(p *httputil.ReverseProxy) error {
+		pt, err := pool(p, "IdleConnTimeout")
+		if err != nil {
+			return err
+		}
+		pt.transport.IdleConnTimeout = d
+		return nil
+	}
+}
+
+// PoolStats returns the connections of p to the backends, by host:port,
+// or nil if p has not been created with a pool option, see MaxConnsPerHost.
+// The websocket connections are counted in Dials, but not in Active once they are upgraded.
+// The HTTP/2 connections are reported active as long as they are open.
+func PoolStats(p *httputil.ReverseProxy) map[string]PoolStat {
+	ct := findContextTransport(p.Transport)
+	if ct == nil {
+		return nil
+	}
+	pt, ok := ct.defaultTransport.(*poolTransport)
+	if !ok {
+		return nil
+	}
+	return pt.stats()
+}
+
+// findContextTransport returns the contextTransport created by New, below the transports wrapping it.
+func findContextTransport(rt http.RoundTripper) *contextTransport {
+	t, _ := findTransport[*contextTransport](rt)
+	return t
+}
+
+// pool returns the poolTransport of p, replacing its default transport if needed.
+func pool(p *httputil.ReverseProxy, option string) (*poolTransport, error) {
+	ct := findContextTransport(p.Transport)
+	if ct == nil {
+		return nil, &ErrCustomTransport{Option: option}
+	}
+	if pt, ok := ct.defaultTransport.(*poolTransport); ok {
+		return pt, nil
+	}
+
+	pt := newPoolTransport()
+	pt.option = option
+	ct.defaultTransport = pt
+	return pt, nil
+}
+
+// checkPool returns an ErrCustomTransport if the pool options, the Signer or the UpstreamProxy have been applied to ct,
+// and p does not use it anymore.
+func checkPool(p *httputil.ReverseProxy, ct *contextTransport) error {
+	if findContextTransport(p.Transport) == ct {
+		return nil
+	}
+	if pt, ok := ct.defaultTransport.(*poolTransport); ok {
+		return &ErrCustomTransport{Option: pt.option}
+	}
+	if ct.signer != nil {
+		return &ErrCustomTransport{Option: "Signer"}
+	}
+	if ct.proxy != nil {
+		return &ErrCustomTransport{Option: "UpstreamProxy"}
+	}
+	if ct.proxyTLSConfig != nil {
+		return &ErrCustomTransport{Option: "UpstreamProxyTLSConfig"}
+	}
+	return nil
+}
+
+// poolTransport counts the connections of its transport, by backend.
+type poolTransport struct {
+	transport *http.Transport
+	// dialer is the dial of the transport, before counting the connections.
+	dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	// option is the pool option which created the transport, see checkPool.
+	option string
+
+	mu    sync.Mutex
+	hosts map[string]*hostStats
+}
+
+func newPoolTransport() *poolTransport {
+	var tr *http.Transport
+	if dt, ok := http.DefaultTransport.(*http.Transport); ok {
+		tr = dt.Clone()
+	} else {
+		tr = &http.Transport{}
+	}
+
+	dial := tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	pt := &poolTransport{transport: tr, dialer: dial, hosts: make(map[string]*hostStats)}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return pt.dial(ctx, dial, network, addr)
+	}
+
+	return pt
+}
+
+type untrackedConnKey struct{}
+
+func (t *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	// The upgraded connections are hijacked: they leave the pool.
+	if isWebsocketRequest(req) {
+		ctx = context.WithValue(ctx, untrackedConnKey{}, true)
+	}
+
+	var conn atomic.Pointer[trackedConn]
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if c := trackedConnOf(info.Conn); c != nil {
+				conn.Store(c)
+				c.setState(connIdle, connActive)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if c := conn.Load(); err == nil && c != nil {
+				c.setState(connActive, connIdle)
+			}
+		},
+	})
+
+	return t.transport.RoundTrip(req.WithContext(ctx))
+}
+
+func (t *poolTransport) dial(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error), network, addr string) (net.Conn, error) {
+	stats := t.host(addr)
+	stats.dials.Add(1)
+
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		stats.dialFailures.Add(1)
+		return nil, err
+	}
+
+	if untracked, _ := ctx.Value(untrackedConnKey{}).(bool); untracked {
+		return conn, nil
+	}
+
+	stats.active.Add(1)
+	return &trackedConn{Conn: conn, stats: stats}, nil
+}
+
+func (t *poolTransport) host(addr string) *hostStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.hosts[addr]
+	if !ok {
+		stats = &hostStats{}
+		t.hosts[addr] = stats
+	}
+	return stats
+}
+
+func (t *poolTransport) stats() map[string]PoolStat {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make(map[string]PoolStat, len(t.hosts))
+	for addr, stats := range t.hosts {
+		out[addr] = PoolStat{
+			Active:       stats.active.Load(),
+			Idle:         stats.idle.Load(),
+			Dials:        stats.dials.Load(),
+			DialFailures: stats.dialFailures.Load(),
+		}
+	}
+	return out
+}
+
+type hostStats struct {
+	active       atomic.Int64
+	idle         atomic.Int64
+	dials        atomic.Uint64
+	dialFailures atomic.Uint64
+}
+
+// The states of a trackedConn.
+const (
+	connActive int32 = iota
+	connIdle
+	connClosed
+)
+
+// trackedConn updates the stats of its backend when it becomes active, idle, or is closed.
+type trackedConn struct {
+	net.Conn
+
+	stats *hostStats
+	state atomic.Int32
+}
+
+// trackedConnOf returns the trackedConn below conn, e.g. below a TLS connection.
+func trackedConnOf(conn net.Conn) *trackedConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *trackedConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (c *trackedConn) setState(from, to int32) {
+	if c.state.CompareAndSwap(from, to) {
+		c.gauge(from).Add(-1)
+		c.gauge(to).Add(1)
+	}
+}
+
+func (c *trackedConn) gauge(state int32) *atomic.Int64 {
+	if state == connIdle {
+		return &c.stats.idle
+	}
+	return &c.stats.active
+}
+
+func (c *trackedConn) Close() error {
+	if from := c.state.Swap(connClosed); from != connClosed {
+		c.gauge(from).Add(-1)
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,146 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// newPoolProxy returns a proxy forwarding the requests to target with f.
+func newPoolProxy(t *testing.T, f *httputil.ReverseProxy, target string) string {
+	t.Helper()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(target)
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	return proxy.URL
+}
+
+func TestPool_maxConnsPerHost(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		open, maxOpen int
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte("slow"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch state {
+		case http.StateNew:
+			open++
+			if open > maxOpen {
+				maxOpen = open
+			}
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	f := New(false, MaxConnsPerHost(2), MaxIdleConnsPerHost(2), IdleConnTimeout(time.Minute))
+	proxyURL := newPoolProxy(t, f, srv.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			re, body, err := testutils.Get(proxyURL)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, "slow", string(body))
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	assert.LessOrEqual(t, maxOpen, 2)
+	mu.Unlock()
+
+	host := srv.Listener.Addr().String()
+	assert.Eventually(t, func() bool {
+		stat := PoolStats(f)[host]
+		return stat.Active == 0 && stat.Idle == int64(stat.Dials)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stat := PoolStats(f)[host]
+	assert.GreaterOrEqual(t, stat.Dials, uint64(1))
+	assert.LessOrEqual(t, stat.Dials, uint64(2))
+	assert.Zero(t, stat.DialFailures)
+}
+
+func TestPool_dialFailures(t *testing.T) {
+	f := New(false, MaxConnsPerHost(0))
+	proxyURL := newPoolProxy(t, f, "http://localhost:63450")
+
+	re, _, err := testutils.Get(proxyURL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+
+	stat := PoolStats(f)["localhost:63450"]
+	assert.NotZero(t, stat.Dials)
+	assert.Equal(t, stat.Dials, stat.DialFailures)
+	assert.Zero(t, stat.Active)
+	assert.Zero(t, stat.Idle)
+}
+
+func TestPool_websocket(t *testing.T) {
+	srv := testutils.NewWSEchoServer(t, testutils.WSAnyOrigin())
+	host := srv.Listener.Addr().String()
+
+	f := New(false, MaxConnsPerHost(2))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	conn, err := testutils.WSRequest(testutils.WSServer(proxy.Listener.Addr().String()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	require.NoError(t, conn.SendText("ping"))
+	require.NoError(t, conn.Expect("ping"))
+
+	// The upgraded connection is not part of the pool.
+	assert.Equal(t, PoolStat{Dials: 1}, PoolStats(f)[host])
+}
+
+func TestPool_customTransport(t *testing.T) {
+	custom := func(p *httputil.ReverseProxy) error {
+		p.Transport = &http.Transport{}
+		return nil
+	}
+
+	var errCustom *ErrCustomTransport
+	_, err := Build(false, custom, MaxConnsPerHost(2))
+	require.ErrorAs(t, err, &errCustom)
+	assert.Equal(t, "MaxConnsPerHost", errCustom.Option)
+
+	_, err = Build(false, IdleConnTimeout(time.Second), custom)
+	require.ErrorAs(t, err, &errCustom)
+	assert.Equal(t, "IdleConnTimeout", errCustom.Option)
+
+	assert.Panics(t, func() { New(false, custom, MaxIdleConnsPerHost(2)) })
+
+	assert.NotPanics(t, func() { New(false, FirstByteTimeout(time.Second), MaxConnsPerHost(2), SchemeProber(time.Minute)) })
+
+	assert.Nil(t, PoolStats(New(false)))
+	assert.NotNil(t, PoolStats(New(false, FirstByteTimeout(time.Second), MaxIdleConnsPerHost(2))))
+}
@@ -0,0 +1,383 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ProxyFunc returns the proxy the request is sent through, nil to send it directly.
+// Its semantics are the ones of http.Transport.Proxy.
+type ProxyFunc func(req *http.Request) (*url.URL, error)
+
+// UpstreamProxy sends the requests to the backends through the proxy returned by fn for each of them,
+// websocket upgrades included: the connection to the backend is tunneled with CONNECT through the http:// and https://
+// proxies, and with a SOCKS5 handshake through the socks5:// ones, before the TLS handshake with the backend.
+// The credentials of the proxy are taken from the userinfo of its URL.
+// The requests for which fn returns nil are sent directly, e.g. to bypass the proxy for some hosts,
+// and the environment variables (HTTP_PROXY, NO_PROXY, ...) are ignored.
+// The failures to connect to the backend through the proxy are ErrDial with the proxy URL.
+// The TLS connections to the https:// proxies are verified with the system roots, see UpstreamProxyTLSConfig:
+// the TLS configuration of the backends (client certificates, InsecureSkipVerify, ...) doesn't apply to them.
+//
+// It applies to the Transport created by New and to the dialers set with WithWebsocketDialer,
+// it can't be combined with a custom Transport. The round trippers set with WithRoundTripper are used as is.
+func UpstreamProxy(fn ProxyFunc) Option {
+	return func(p *httputil.ReverseProxy) error {
+		ct := findContextTransport(p.Transport)
+		if ct == nil {
+			return &ErrCustomTransport{Option: "UpstreamProxy"}
+		}
+		ct.proxy = fn
+		return nil
+	}
+}
+
+// UpstreamProxyTLSConfig sets the TLS configuration of the connections to the https:// proxies of UpstreamProxy,
+// e.g. to trust the CA of a private proxy or to present a client certificate to it.
+// Its ServerName is replaced with the host of the proxy.
+func UpstreamProxyTLSConfig(cfg *tls.Config) Option {
+	return func(p *httputil.ReverseProxy) error {
+		ct := findContextTransport(p.Transport)
+		if ct == nil {
+			return &ErrCustomTransport{Option: "UpstreamProxyTLSConfig"}
+		}
+		ct.proxyTLSConfig = cfg
+		return nil
+	}
+}
+
+// applyProxy makes the direct connections of ct ignore the proxy of the environment, when UpstreamProxy is set.
+func applyProxy(ct *contextTransport) {
+	if ct.proxy == nil {
+		return
+	}
+
+	switch dt := ct.defaultTransport.(type) {
+	case *http.Transport:
+		tr := dt.Clone()
+		tr.Proxy = nil
+		ct.defaultTransport = tr
+	case *poolTransport:
+		dt.transport.Proxy = nil
+	}
+}
+
+// upstreamProxy returns the proxy of req, nil if it is sent directly.
+func (t *contextTransport) upstreamProxy(req *http.Request) (*url.URL, error) {
+	if t.proxy == nil {
+		return nil, nil
+	}
+
+	proxy, err := t.proxy(req)
+	if err != nil {
+		return nil, &proxyError{Err: err}
+	}
+	if proxy == nil {
+		return nil, nil
+	}
+
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+		return proxy, nil
+	default:
+		return nil, &proxyError{Proxy: proxy, Err: fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)}
+	}
+}
+
+// proxyError is a failure to connect to a backend through a proxy, reported as an ErrDial.
+type proxyError struct {
+	Proxy *url.URL
+	Err   error
+}
+
+func (e *proxyError) Error() string {
+	if e.Proxy == nil {
+		return fmt.Sprintf("proxy: %v", e.Err)
+	}
+	return fmt.Sprintf("proxy %s: %v", e.Proxy.Redacted(), e.Err)
+}
+
+func (e *proxyError) Unwrap() error {
+	return e.Err
+}
+
+// proxyDialer establishes the connections to the backends through a proxy, the connection to the proxy being dialed with dial.
+// tlsConfig is the TLS configuration of the connection to an https:// proxy, never the one of the backends.
+type proxyDialer struct {
+	proxy     *url.URL
+	tlsConfig *tls.Config
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func newProxyDialer(proxy *url.URL, tlsConfig *tls.Config, dial func(ctx context.Context, network, address string) (net.Conn, error)) *proxyDialer {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return &proxyDialer{proxy: proxy, tlsConfig: tlsConfig, dial: dial}
+}
+
+// DialContext connects to address through the proxy.
+func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialProxy(ctx, network)
+	if err != nil {
+		return nil, &proxyError{Proxy: d.proxy, Err: err}
+	}
+
+	// The handshake is aborted when ctx is done.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if d.proxy.Scheme == "socks5" {
+		err = d.socks5Connect(conn, address)
+	} else {
+		conn, err = d.httpConnect(conn, address)
+	}
+
+	close(done)
+	<-stopped
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, &proxyError{Proxy: d.proxy, Err: err}
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// dialProxy connects to the proxy, with TLS for the https:// proxies.
+func (d *proxyDialer) dialProxy(ctx context.Context, network string) (net.Conn, error) {
+	addr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		addr = net.JoinHostPort(d.proxy.Hostname(), defaultProxyPort(d.proxy.Scheme))
+	}
+
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil || d.proxy.Scheme != "https" {
+		return conn, err
+	}
+
+	cfg := &tls.Config{}
+	if d.tlsConfig != nil {
+		cfg = d.tlsConfig.Clone()
+	}
+	cfg.ServerName = d.proxy.Hostname()
+	cfg.NextProtos = nil
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func defaultProxyPort(scheme string) string {
+	switch scheme {
+	case "https":
+		return "443"
+	case "socks5":
+		return "1080"
+	default:
+		return "80"
+	}
+}
+
+// httpConnect opens a tunnel to address with a CONNECT request.
+func (d *proxyDialer) httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u := d.proxy.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT %s: %s", address, resp.Status)
+	}
+
+	// The bytes of the backend read with the response are not lost.
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes have been read in r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// SOCKS5 protocol values, see RFC 1928 and RFC 1929.
+const (
+	socks5Version       = 0x05
+	socks5NoAuth        = 0x00
+	socks5UserPass      = 0x02
+	socks5CmdConnect    = 0x01
+	socks5AddrIPv4      = 0x01
+	socks5AddrDomain    = 0x03
+	socks5AddrIPv6      = 0x04
+	socks5Succeeded     = 0x00
+	socks5UserPassVer   = 0x01
+	socks5UserPassValid = 0x00
+)
+
+// socks5Connect opens a tunnel to address with a SOCKS5 CONNECT command.
+// The hostnames are resolved by the proxy.
+func (d *proxyDialer) socks5Connect(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	method := byte(socks5NoAuth)
+	if d.proxy.User != nil {
+		method = socks5UserPass
+	}
+	if _, err = conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	switch {
+	case reply[0] != socks5Version:
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	case reply[1] != method:
+		return errors.New("no acceptable SOCKS5 authentication method")
+	}
+
+	if method == socks5UserPass {
+		if err = d.socks5Auth(conn); err != nil {
+			return err
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	switch ip := net.ParseIP(host); {
+	case ip == nil:
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip.To4()...)
+	default:
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP, then the bound address, ignored.
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != socks5Succeeded {
+		return fmt.Errorf("SOCKS5 connect %s: failed with code %d", address, head[1])
+	}
+
+	var addrLen int
+	switch head[3] {
+	case socks5AddrIPv4:
+		addrLen = net.IPv4len
+	case socks5AddrIPv6:
+		addrLen = net.IPv6len
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		if _, err = io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type %d", head[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+// socks5Auth authenticates with the userinfo of the proxy URL.
+func (d *proxyDialer) socks5Auth(conn net.Conn) error {
+	username := d.proxy.User.Username()
+	password, _ := d.proxy.User.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("SOCKS5 username or password too long")
+	}
+
+	req := []byte{socks5UserPassVer, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != socks5UserPassValid {
+		return errors.New("SOCKS5 authentication failed")
+	}
+	return nil
+}
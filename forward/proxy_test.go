@@ -0,0 +1,464 @@
+package forward
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// testProxy is an in-process proxy recording the addresses it tunnels to.
+type testProxy struct {
+	URL *url.URL
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func (p *testProxy) record(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.targets = append(p.targets, addr)
+}
+
+func (p *testProxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// tunnel copies the bytes between the two connections until one of them is closed.
+func tunnel(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+}
+
+// newConnectProxy starts an HTTP proxy accepting CONNECT requests, with the credentials of user if it is set.
+func newConnectProxy(t *testing.T, user *url.Userinfo) *testProxy {
+	t.Helper()
+
+	p := &testProxy{}
+	srv := httptest.NewServer(p.connectHandler(user))
+	t.Cleanup(srv.Close)
+
+	p.URL = testutils.MustParseRequestURI(srv.URL)
+	p.URL.User = user
+	return p
+}
+
+// connectHandler tunnels the CONNECT requests with the credentials of user if it is set.
+func (p *testProxy) connectHandler(user *url.Userinfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if user != nil {
+			password, _ := user.Password()
+			expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password))
+			if req.Header.Get("Proxy-Authorization") != expected {
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+		}
+
+		backend, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		p.record(req.Host)
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = backend.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		tunnel(conn, backend)
+	})
+}
+
+// newSOCKS5Proxy starts a SOCKS5 proxy accepting CONNECT commands, with the credentials of user if it is set.
+func newSOCKS5Proxy(t *testing.T, user *url.Userinfo) *testProxy {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	p := &testProxy{URL: &url.URL{Scheme: "socks5", Host: l.Addr().String(), User: user}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				backend, err := p.socks5Handshake(bufio.NewReader(conn), conn, user)
+				if err != nil {
+					_ = conn.Close()
+					return
+				}
+				tunnel(conn, backend)
+			}()
+		}
+	}()
+
+	return p
+}
+
+func (p *testProxy) socks5Handshake(r *bufio.Reader, w io.Writer, user *url.Userinfo) (net.Conn, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+
+	method := byte(socks5NoAuth)
+	if user != nil {
+		method = socks5UserPass
+	}
+	if _, err := w.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+
+	if user != nil {
+		creds := make([]string, 2)
+		if _, err := r.ReadByte(); err != nil {
+			return nil, err
+		}
+		for i := range creds {
+			n, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			b := make([]byte, n)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, err
+			}
+			creds[i] = string(b)
+		}
+		password, _ := user.Password()
+		if creds[0] != user.Username() || creds[1] != password {
+			_, _ = w.Write([]byte{socks5UserPassVer, 1})
+			return nil, io.EOF
+		}
+		if _, err := w.Write([]byte{socks5UserPassVer, socks5UserPassValid}); err != nil {
+			return nil, err
+		}
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return nil, err
+	}
+
+	var host string
+	switch req[3] {
+	case socks5AddrDomain:
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		host = string(b)
+	default:
+		b := make([]byte, net.IPv4len)
+		if req[3] == socks5AddrIPv6 {
+			b = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		host = net.IP(b).String()
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	backend, err := net.Dial("tcp", addr)
+	if err != nil {
+		_, _ = w.Write([]byte{socks5Version, 0x05, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return nil, err
+	}
+	p.record(addr)
+
+	if _, err := w.Write([]byte{socks5Version, socks5Succeeded, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		_ = backend.Close()
+		return nil, err
+	}
+	return backend, nil
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		newProxy func(t *testing.T, user *url.Userinfo) *testProxy
+		user     *url.Userinfo
+	}{
+		{desc: "CONNECT", newProxy: newConnectProxy},
+		{desc: "CONNECT with credentials", newProxy: newConnectProxy, user: url.UserPassword("user", "secret")},
+		{desc: "SOCKS5", newProxy: newSOCKS5Proxy},
+		{desc: "SOCKS5 with credentials", newProxy: newSOCKS5Proxy, user: url.UserPassword("user", "secret")},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			p := test.newProxy(t, test.user)
+			f := New(true, UpstreamProxy(func(*http.Request) (*url.URL, error) {
+				return p.URL, nil
+			}))
+
+			backend := testutils.NewResponder(t, "hello")
+			proxy := createProxyWithForwarder(f, backend.URL)
+			t.Cleanup(proxy.Close)
+
+			resp, body, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "hello", string(body))
+
+			srv := testutils.NewWSEchoServer(t)
+			wsProxy := createProxyWithForwarder(f, srv.URL)
+			t.Cleanup(wsProxy.Close)
+			assertEcho(t, wsProxy.Listener.Addr().String(), "echo")
+
+			assert.Equal(t, []string{backend.Listener.Addr().String(), srv.Listener.Addr().String()}, p.Targets())
+		})
+	}
+}
+
+func TestUpstreamProxy_httpsProxy(t *testing.T) {
+	client, clientKey := newTestCert(t, nil, nil, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	p := &testProxy{}
+	var clientCerts atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientCerts.Add(int32(len(req.TLS.PeerCertificates)))
+		p.connectHandler(nil).ServeHTTP(w, req)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	p.URL = testutils.MustParseRequestURI(srv.URL)
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	t.Cleanup(backend.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	testCases := []struct {
+		desc     string
+		options  []Option
+		expected int
+	}{
+		{
+			// The InsecureSkipVerify of the backends doesn't apply to the proxy.
+			desc:     "untrusted proxy",
+			expected: http.StatusBadGateway,
+		},
+		{
+			desc:     "trusted proxy",
+			options:  []Option{UpstreamProxyTLSConfig(&tls.Config{RootCAs: roots})},
+			expected: http.StatusOK,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			f := New(true, append([]Option{UpstreamProxy(func(*http.Request) (*url.URL, error) {
+				return p.URL, nil
+			})}, test.options...)...)
+			findContextTransport(f.Transport).defaultTransport = &http.Transport{TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				Certificates:       []tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}},
+			}}
+
+			proxy := createProxyWithForwarder(f, backend.URL)
+			t.Cleanup(proxy.Close)
+
+			resp, err := http.Get(proxy.URL)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			assert.Equal(t, test.expected, resp.StatusCode)
+		})
+	}
+
+	// The client certificate of the backends is not presented to the proxy.
+	assert.Equal(t, []string{backend.Listener.Addr().String()}, p.Targets())
+	assert.Zero(t, clientCerts.Load())
+}
+
+func TestUpstreamProxy_websocketDialer(t *testing.T) {
+	p := newSOCKS5Proxy(t, nil)
+	f := New(true, UpstreamProxy(func(*http.Request) (*url.URL, error) {
+		return p.URL, nil
+	}))
+
+	srv := testutils.NewWSEchoServer(t)
+	d := &recordingDialer{}
+
+	proxy := createProxyWithForwarder(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f.ServeHTTP(w, req.WithContext(WithWebsocketDialer(req.Context(), d)))
+	}), srv.URL)
+	t.Cleanup(proxy.Close)
+
+	assertEcho(t, proxy.Listener.Addr().String(), "echo")
+
+	// The dialer connects to the proxy.
+	assert.Equal(t, []string{p.URL.Host}, d.dialed)
+	assert.Equal(t, []string{srv.Listener.Addr().String()}, p.Targets())
+}
+
+func TestUpstreamProxy_perRequest(t *testing.T) {
+	p := newConnectProxy(t, nil)
+	f := New(false, UpstreamProxy(func(req *http.Request) (*url.URL, error) {
+		if req.Header.Get("X-Proxied") == "" {
+			return nil, nil
+		}
+		return p.URL, nil
+	}))
+
+	direct := testutils.NewResponder(t, "direct")
+	proxied := testutils.NewResponder(t, "proxied")
+
+	directProxy := createProxyWithForwarder(f, direct.URL)
+	t.Cleanup(directProxy.Close)
+	proxiedProxy := createProxyWithForwarder(f, proxied.URL)
+	t.Cleanup(proxiedProxy.Close)
+
+	_, body, err := testutils.Get(directProxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "direct", string(body))
+
+	_, body, err = testutils.Get(proxiedProxy.URL, testutils.Header("X-Proxied", "true"))
+	require.NoError(t, err)
+	assert.Equal(t, "proxied", string(body))
+
+	assert.Equal(t, []string{proxied.Listener.Addr().String()}, p.Targets())
+}
+
+func TestUpstreamProxy_errors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	require.NoError(t, l.Close())
+
+	testCases := []struct {
+		desc  string
+		proxy func(t *testing.T) *url.URL
+	}{
+		{
+			desc:  "proxy unreachable",
+			proxy: func(*testing.T) *url.URL { return closed },
+		},
+		{
+			desc: "CONNECT rejected",
+			proxy: func(t *testing.T) *url.URL {
+				t.Helper()
+				// The proxy requires credentials.
+				p := newConnectProxy(t, url.UserPassword("user", "secret"))
+				u := *p.URL
+				u.User = nil
+				return &u
+			},
+		},
+		{
+			desc: "SOCKS5 authentication failed",
+			proxy: func(t *testing.T) *url.URL {
+				t.Helper()
+				p := newSOCKS5Proxy(t, url.UserPassword("user", "secret"))
+				u := *p.URL
+				u.User = url.UserPassword("user", "wrong")
+				return &u
+			},
+		},
+		{
+			desc:  "unsupported scheme",
+			proxy: func(*testing.T) *url.URL { return &url.URL{Scheme: "ftp", Host: "localhost:21"} },
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			proxyURL := test.proxy(t)
+			f := New(false, UpstreamProxy(func(*http.Request) (*url.URL, error) {
+				return proxyURL, nil
+			}))
+
+			backend := testutils.NewResponder(t, "hello")
+
+			upstreamErr := make(chan error, 1)
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req = req.WithContext(WithErrorCapture(req.Context()))
+				req.URL = testutils.MustParseRequestURI(backend.URL)
+				f.ServeHTTP(w, req)
+				upstreamErr <- ErrorFromContext(req.Context())
+			}))
+			t.Cleanup(proxy.Close)
+
+			resp, _, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+			var errDial *ErrDial
+			require.ErrorAs(t, <-upstreamErr, &errDial)
+			assert.Equal(t, proxyURL, errDial.Proxy)
+			assert.Equal(t, backend.Listener.Addr().String(), errDial.URL.Host)
+			assert.NotContains(t, errDial.Error(), "secret")
+		})
+	}
+}
+
+func TestUpstreamProxy_customTransport(t *testing.T) {
+	_, err := Build(false, UpstreamProxy(http.ProxyFromEnvironment), func(p *httputil.ReverseProxy) error {
+		p.Transport = http.DefaultTransport
+		return nil
+	})
+
+	var errCustom *ErrCustomTransport
+	require.ErrorAs(t, err, &errCustom)
+	assert.Equal(t, "UpstreamProxy", errCustom.Option)
+}
@@ -3,12 +3,114 @@ package forward
 import (
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"os"
 	"strings"
 
 	"github.com/vulcand/oxy/v2/utils"
 )
 
+// TrustForwardHeader defines whether the forwarding headers of the incoming requests (X-Forwarded-*, X-Real-Ip,
+// and the header of EmitClientProtoHeader) are kept, e.g. when the clients are trusted proxies.
+// Enabled by default, disabling it replaces them with the values of the proxy.
+func TrustForwardHeader(trust bool) Option {
+	return func(p *httputil.ReverseProxy) error {
+		h, err := rewriter(p, "TrustForwardHeader")
+		if err != nil {
+			return err
+		}
+		h.TrustForwardHeader = trust
+		return nil
+	}
+}
+
+// EmitClientProtoHeader sets the header to the protocol of the client on the requests sent to the backends,
+// websocket handshakes included, e.g. "HTTP/2.0" in X-Forwarded-Proto-Version: the requests are forwarded with HTTP/1.1.
+// The header of the incoming requests is kept when the forwarding headers are trusted, see TrustForwardHeader.
+func EmitClientProtoHeader(header string) Option {
+	return func(p *httputil.ReverseProxy) error {
+		h, err := rewriter(p, "EmitClientProtoHeader")
+		if err != nil {
+			return err
+		}
+		h.ClientProtoHeader = http.CanonicalHeaderKey(header)
+		return nil
+	}
+}
+
+// XFFOptions sets how the proxy builds the X-Forwarded-For header of the requests sent to the backends,
+// websocket handshakes included. It applies after TrustForwardHeader: the untrusted headers are removed first.
+func XFFOptions(xff XFF) Option {
+	return func(p *httputil.ReverseProxy) error {
+		h, err := rewriter(p, "XFFOptions")
+		if err != nil {
+			return err
+		}
+		h.XFF = xff
+		return nil
+	}
+}
+
+// XFF defines how the X-Forwarded-For header is built, see XFFOptions.
+// The zero value appends the address of the peer to the list received.
+type XFF struct {
+	// DedupeAdjacent drops the adjacent duplicate entries, e.g. "client, edge, edge" becomes "client, edge".
+	DedupeAdjacent bool
+	// OmitLoopback skips appending the address of the peer when it is a loopback or link-local address,
+	// e.g. for the health checks sent through localhost.
+	OmitLoopback bool
+	// MaxEntries truncates the list from the left when it has more entries, no limit when 0.
+	// The rightmost entries are kept, they are the ones added by the trusted proxies.
+	MaxEntries int
+}
+
+// rewrite sets the X-Forwarded-For header of req, with the address of its peer appended.
+func (x XFF) rewrite(req *http.Request) {
+	var entries []string
+	for _, value := range req.Header.Values(XForwardedFor) {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if peer := utils.ClientIP(req.RemoteAddr); peer != "" {
+		if ip := net.ParseIP(peer); !x.OmitLoopback || ip == nil || !(ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+			entries = append(entries, peer)
+		}
+	}
+
+	if x.DedupeAdjacent {
+		deduped := entries[:0]
+		for _, entry := range entries {
+			if len(deduped) == 0 || deduped[len(deduped)-1] != entry {
+				deduped = append(deduped, entry)
+			}
+		}
+		entries = deduped
+	}
+
+	if x.MaxEntries > 0 && len(entries) > x.MaxEntries {
+		entries = entries[len(entries)-x.MaxEntries:]
+	}
+
+	if len(entries) == 0 {
+		req.Header.Del(XForwardedFor)
+		return
+	}
+	req.Header.Set(XForwardedFor, strings.Join(entries, ", "))
+}
+
+// rewriter returns the HeaderRewriter of the Director created by New, found through its Transport.
+func rewriter(p *httputil.ReverseProxy, option string) (*HeaderRewriter, error) {
+	ct := findContextTransport(p.Transport)
+	if ct == nil || ct.rewriter == nil {
+		return nil, &ErrCustomTransport{Option: option}
+	}
+	return ct.rewriter, nil
+}
+
 // NewHeaderRewriter creates a new HeaderRewriter middleware.
 func NewHeaderRewriter() *HeaderRewriter {
 	h, err := os.Hostname()
@@ -22,25 +124,53 @@ func NewHeaderRewriter() *HeaderRewriter {
 type HeaderRewriter struct {
 	TrustForwardHeader bool
 	Hostname           string
-}
-
-// clean up IP in case if it is ipv6 address and it has {zone} information in it, like "[fe80::d806:a55d:eb1b:49cc%vEthernet (vmxnet3 Ethernet Adapter - Virtual Switch)]:64692".
-func ipv6fix(clientIP string) string {
-	return strings.Split(clientIP, "%")[0]
+	// ClientProtoHeader is the header carrying the protocol of the client (e.g. "HTTP/2.0"), not set when empty.
+	ClientProtoHeader string
+	// XFF defines how the X-Forwarded-For header is built, see XFFOptions.
+	XFF XFF
+	// ClientCert defines the headers carrying the identity of the client certificate, see ForwardClientCert.
+	ClientCert ClientCert
 }
 
 // Rewrite request headers.
 func (rw *HeaderRewriter) Rewrite(req *http.Request) {
+	rw.rewrite(req, req.Proto)
+}
+
+// rewrite sets the forwarding headers of req, clientProto being the protocol of the incoming request.
+func (rw *HeaderRewriter) rewrite(req *http.Request, clientProto string) {
 	if !rw.TrustForwardHeader {
 		utils.RemoveHeaders(req.Header, XHeaders...)
+		if rw.ClientProtoHeader != "" {
+			req.Header.Del(rw.ClientProtoHeader)
+		}
 	}
 
-	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		clientIP = ipv6fix(clientIP)
+	if rw.ClientProtoHeader != "" && req.Header.Get(rw.ClientProtoHeader) == "" {
+		req.Header.Set(rw.ClientProtoHeader, clientProto)
+	}
 
+	if clientIP := utils.ClientIP(req.RemoteAddr); clientIP != "" {
 		if req.Header.Get(XRealIP) == "" {
 			req.Header.Set(XRealIP, clientIP)
 		}
+
+		// The client IP is appended without the zone of IPv6 addresses, unlike the ReverseProxy that appends it as received
+		// (and only when the remote address has a port): the header is handed over to the transport, see Build.
+		if rw.XFF == (XFF{}) {
+			if prior := req.Header.Values(XForwardedFor); len(prior) > 0 {
+				clientIP = strings.Join(prior, ", ") + ", " + clientIP
+			}
+			req.Header.Set(XForwardedFor, clientIP)
+		}
+	}
+
+	if rw.XFF != (XFF{}) {
+		rw.XFF.rewrite(req)
+	}
+
+	if rw.ClientCert != (ClientCert{}) {
+		rw.ClientCert.rewrite(req)
 	}
 
 	xfProto := req.Header.Get(XForwardedProto)
@@ -56,6 +186,7 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 		req.Header.Set(XForwardedPort, forwardedPort(req))
 	}
 
+	// The Host is forwarded as received: it already contains the port when it is not the default one.
 	if xfHost := req.Header.Get(XForwardedHost); xfHost == "" && req.Host != "" {
 		req.Header.Set(XForwardedHost, req.Host)
 	}
@@ -1,61 +1,485 @@
 package forward
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
 )
 
-func Test_ipv6fix(t *testing.T) {
+func TestHeaderRewriter_hosts(t *testing.T) {
 	testCases := []struct {
-		desc     string
-		clientIP string
-		expected string
+		desc       string
+		remoteAddr string
+		host       string
+		expected   map[string]string
 	}{
 		{
-			desc:     "empty",
-			clientIP: "",
-			expected: "",
+			desc:       "ipv4",
+			remoteAddr: "10.0.0.1:1234",
+			host:       "example.com",
+			expected: map[string]string{
+				XForwardedFor:  "10.0.0.1",
+				XRealIP:        "10.0.0.1",
+				XForwardedHost: "example.com",
+				XForwardedPort: "80",
+			},
 		},
 		{
-			desc:     "ipv4 localhost",
-			clientIP: "127.0.0.1",
-			expected: "127.0.0.1",
+			desc:       "ipv4 without port",
+			remoteAddr: "10.0.0.1",
+			host:       "example.com",
+			expected: map[string]string{
+				XForwardedFor:  "10.0.0.1",
+				XRealIP:        "10.0.0.1",
+				XForwardedHost: "example.com",
+				XForwardedPort: "80",
+			},
 		},
 		{
-			desc:     "ipv4",
-			clientIP: "10.13.14.15",
-			expected: "10.13.14.15",
+			desc:       "ipv6",
+			remoteAddr: "[2001:db8::1]:54321",
+			host:       "example.com",
+			expected: map[string]string{
+				XForwardedFor:  "2001:db8::1",
+				XRealIP:        "2001:db8::1",
+				XForwardedHost: "example.com",
+				XForwardedPort: "80",
+			},
 		},
 		{
-			desc:     "ipv6 zone",
-			clientIP: `fe80::d806:a55d:eb1b:49cc%vEthernet (vmxnet3 Ethernet Adapter - Virtual Switch)`,
-			expected: "fe80::d806:a55d:eb1b:49cc",
+			desc:       "ipv6 without port",
+			remoteAddr: "2001:db8::1",
+			host:       "example.com",
+			expected: map[string]string{
+				XForwardedFor:  "2001:db8::1",
+				XRealIP:        "2001:db8::1",
+				XForwardedHost: "example.com",
+				XForwardedPort: "80",
+			},
 		},
 		{
-			desc:     "ipv6 medium",
-			clientIP: `fe80::1`,
-			expected: "fe80::1",
+			desc:       "ipv6 with zone",
+			remoteAddr: "[fe80::1%eth0]:54321",
+			host:       "example.com",
+			expected: map[string]string{
+				XForwardedFor:  "fe80::1",
+				XRealIP:        "fe80::1",
+				XForwardedHost: "example.com",
+				XForwardedPort: "80",
+			},
 		},
 		{
-			desc:     "ipv6 small",
-			clientIP: `2000::`,
-			expected: "2000::",
+			desc:       "ipv6 with zone without port",
+			remoteAddr: "fe80::1%eth0",
+			host:       "example.com",
+			expected: map[string]string{
+				XForwardedFor:  "fe80::1",
+				XRealIP:        "fe80::1",
+				XForwardedHost: "example.com",
+				XForwardedPort: "80",
+			},
 		},
 		{
-			desc:     "ipv6",
-			clientIP: `2001:3452:4952:2837::`,
-			expected: "2001:3452:4952:2837::",
+			desc:       "hostname with non-default port",
+			remoteAddr: "10.0.0.1:1234",
+			host:       "example.com:8080",
+			expected: map[string]string{
+				XForwardedFor:  "10.0.0.1",
+				XRealIP:        "10.0.0.1",
+				XForwardedHost: "example.com:8080",
+				XForwardedPort: "8080",
+			},
+		},
+		{
+			desc:       "ipv6 host with port",
+			remoteAddr: "[2001:db8::1]:54321",
+			host:       "[2001:db8::2]:8443",
+			expected: map[string]string{
+				XForwardedFor:  "2001:db8::1",
+				XRealIP:        "2001:db8::1",
+				XForwardedHost: "[2001:db8::2]:8443",
+				XForwardedPort: "8443",
+			},
+		},
+		{
+			desc:       "ipv6 host without port",
+			remoteAddr: "[2001:db8::1]:54321",
+			host:       "[2001:db8::2]",
+			expected: map[string]string{
+				XForwardedFor:  "2001:db8::1",
+				XRealIP:        "2001:db8::1",
+				XForwardedHost: "[2001:db8::2]",
+				XForwardedPort: "80",
+			},
+		},
+	}
+
+	for _, websocket := range []bool{false, true} {
+		for _, test := range testCases {
+			test := test
+			name := test.desc
+			if websocket {
+				name = "websocket " + name
+			}
+
+			t.Run(name, func(t *testing.T) {
+				var header http.Header
+				srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+					header = req.Header
+				}))
+				t.Cleanup(srv.Close)
+
+				f := New(true)
+
+				proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					req.RemoteAddr = test.remoteAddr
+					req.URL = testutils.MustParseRequestURI(srv.URL)
+					f.ServeHTTP(w, req)
+				}))
+				t.Cleanup(proxy.Close)
+
+				opts := []testutils.ReqOption{testutils.Host(test.host)}
+				if websocket {
+					opts = append(opts, testutils.Header(Connection, "Upgrade"), testutils.Header(Upgrade, "websocket"))
+				}
+
+				re, _, err := testutils.Get(proxy.URL, opts...)
+				require.NoError(t, err)
+				assert.Equal(t, http.StatusOK, re.StatusCode)
+
+				for name, value := range test.expected {
+					assert.Equal(t, []string{value}, header.Values(name), name)
+				}
+			})
+		}
+	}
+}
+
+func TestNew_ipv6BackendHost(t *testing.T) {
+	f := New(false)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.URL = testutils.MustParseRequestURI("http://[::1]:8080/")
+
+	f.Director(req)
+
+	assert.Equal(t, "[::1]:8080", req.Host)
+	assert.Equal(t, "[::1]:8080", req.URL.Host)
+}
+
+// clientProtoProxy returns a proxy forwarding to a backend recording the header of EmitClientProtoHeader.
+func clientProtoProxy(t *testing.T, http2 bool, opts ...Option) (*httptest.Server, *atomic.Pointer[string]) {
+	t.Helper()
+
+	var received atomic.Pointer[string]
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		proto := req.Header.Get("X-Forwarded-Proto-Version")
+		received.Store(&proto)
+		_, _ = w.Write([]byte(req.Proto))
+	})
+	t.Cleanup(srv.Close)
+
+	f := New(false, append([]Option{EmitClientProtoHeader("X-Forwarded-Proto-Version")}, opts...)...)
+
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	proxy.EnableHTTP2 = http2
+	proxy.StartTLS()
+	t.Cleanup(proxy.Close)
+
+	return proxy, &received
+}
+
+func TestEmitClientProtoHeader(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		http2         bool
+		spoofed       string
+		opts          []Option
+		expectedProto string
+	}{
+		{
+			desc:          "HTTP/2",
+			http2:         true,
+			expectedProto: "HTTP/2.0",
+		},
+		{
+			desc:          "HTTP/1.1",
+			expectedProto: "HTTP/1.1",
+		},
+		{
+			desc:          "trusted client",
+			spoofed:       "HTTP/3.0",
+			expectedProto: "HTTP/3.0",
+		},
+		{
+			desc:          "untrusted client",
+			http2:         true,
+			spoofed:       "HTTP/3.0",
+			opts:          []Option{TrustForwardHeader(false)},
+			expectedProto: "HTTP/2.0",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			proxy, received := clientProtoProxy(t, test.http2, test.opts...)
+
+			req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+			require.NoError(t, err)
+			if test.spoofed != "" {
+				req.Header.Set("X-Forwarded-Proto-Version", test.spoofed)
+			}
+
+			re, err := proxy.Client().Do(req)
+			require.NoError(t, err)
+			body, err := io.ReadAll(re.Body)
+			require.NoError(t, err)
+			_ = re.Body.Close()
+
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			// The backend is reached with HTTP/1.1.
+			assert.Equal(t, "HTTP/1.1", string(body))
+
+			require.NotNil(t, received.Load())
+			assert.Equal(t, test.expectedProto, *received.Load())
+		})
+	}
+}
+
+func TestEmitClientProtoHeader_websocket(t *testing.T) {
+	var received atomic.Pointer[string]
+	srv := testutils.NewWSEchoServer(t, testutils.WSAnyOrigin(), testutils.WSOnUpgrade(func(req *http.Request) {
+		proto := req.Header.Get("X-Forwarded-Proto-Version")
+		received.Store(&proto)
+	}))
+
+	f := New(false, EmitClientProtoHeader("X-Forwarded-Proto-Version"), TrustForwardHeader(false))
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	conn, err := testutils.WSRequest(testutils.WSServer(testutils.MustParseRequestURI(proxy.URL).Host))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	require.NoError(t, conn.SendText("hello"))
+	require.NoError(t, conn.Expect("hello"))
+
+	require.NotNil(t, received.Load())
+	assert.Equal(t, "HTTP/1.1", *received.Load())
+}
+
+func TestTrustForwardHeader(t *testing.T) {
+	var received atomic.Pointer[http.Header]
+	srv := testutils.NewHandler(func(_ http.ResponseWriter, req *http.Request) {
+		h := req.Header.Clone()
+		received.Store(&h)
+	})
+	t.Cleanup(srv.Close)
+
+	f := New(false, TrustForwardHeader(false))
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	t.Cleanup(proxy.Close)
+
+	_, _, err := testutils.Get(proxy.URL, testutils.Header(XForwardedProto, "https"), testutils.Header(XRealIP, "1.2.3.4"))
+	require.NoError(t, err)
+
+	require.NotNil(t, received.Load())
+	assert.Equal(t, "http", received.Load().Get(XForwardedProto))
+	assert.Equal(t, "127.0.0.1", received.Load().Get(XRealIP))
+}
+
+func TestXFFOptions(t *testing.T) {
+	var adversarial []string
+	for i := 0; i < 200; i++ {
+		adversarial = append(adversarial, fmt.Sprintf("10.0.%d.%d", i/100, i%100))
+	}
+
+	testCases := []struct {
+		desc       string
+		remoteAddr string
+		xff        []string
+		opts       []Option
+		expected   string
+	}{
+		{
+			desc:       "default",
+			remoteAddr: "10.0.0.2:4242",
+			xff:        []string{"1.1.1.1, 10.0.0.2"},
+			expected:   "1.1.1.1, 10.0.0.2, 10.0.0.2",
+		},
+		{
+			desc:       "chained proxies",
+			remoteAddr: "10.0.0.2:4242",
+			xff:        []string{"1.1.1.1, 10.0.0.2"},
+			opts:       []Option{XFFOptions(XFF{DedupeAdjacent: true})},
+			expected:   "1.1.1.1, 10.0.0.2",
+		},
+		{
+			desc:       "chained proxies, several headers",
+			remoteAddr: "10.0.0.3:4242",
+			xff:        []string{"1.1.1.1, 1.1.1.1", " 10.0.0.2 ,, 10.0.0.2", "10.0.0.3"},
+			opts:       []Option{XFFOptions(XFF{DedupeAdjacent: true})},
+			expected:   "1.1.1.1, 10.0.0.2, 10.0.0.3",
+		},
+		{
+			desc:       "non adjacent duplicates",
+			remoteAddr: "10.0.0.2:4242",
+			xff:        []string{"10.0.0.2, 1.1.1.1"},
+			opts:       []Option{XFFOptions(XFF{DedupeAdjacent: true})},
+			expected:   "10.0.0.2, 1.1.1.1, 10.0.0.2",
+		},
+		{
+			desc:       "loopback health check",
+			remoteAddr: "127.0.0.1:4242",
+			opts:       []Option{XFFOptions(XFF{OmitLoopback: true})},
+			expected:   "",
+		},
+		{
+			desc:       "loopback health check through a proxy",
+			remoteAddr: "[::1]:4242",
+			xff:        []string{"10.0.0.2"},
+			opts:       []Option{XFFOptions(XFF{OmitLoopback: true})},
+			expected:   "10.0.0.2",
+		},
+		{
+			desc:       "link-local peer",
+			remoteAddr: "[fe80::1%eth0]:4242",
+			xff:        []string{"1.1.1.1"},
+			opts:       []Option{XFFOptions(XFF{OmitLoopback: true})},
+			expected:   "1.1.1.1",
+		},
+		{
+			desc:       "link-local peer, default",
+			remoteAddr: "[fe80::1%eth0]:4242",
+			xff:        []string{"1.1.1.1"},
+			expected:   "1.1.1.1, fe80::1",
+		},
+		{
+			desc:       "link-local peer, chained proxies",
+			remoteAddr: "[fe80::1%eth0]:4242",
+			xff:        []string{"1.1.1.1, fe80::1"},
+			opts:       []Option{XFFOptions(XFF{DedupeAdjacent: true})},
+			expected:   "1.1.1.1, fe80::1",
+		},
+		{
+			desc:       "non loopback peer",
+			remoteAddr: "10.0.0.2:4242",
+			xff:        []string{"1.1.1.1"},
+			opts:       []Option{XFFOptions(XFF{OmitLoopback: true})},
+			expected:   "1.1.1.1, 10.0.0.2",
+		},
+		{
+			desc:       "adversarial list",
+			remoteAddr: "10.1.0.1:4242",
+			xff:        []string{strings.Join(adversarial, ",")},
+			opts:       []Option{XFFOptions(XFF{MaxEntries: 4})},
+			expected:   "10.0.1.97, 10.0.1.98, 10.0.1.99, 10.1.0.1",
+		},
+		{
+			desc:       "adversarial duplicates",
+			remoteAddr: "10.1.0.1:4242",
+			xff:        []string{strings.Repeat("6.6.6.6, ", 199) + "1.1.1.1"},
+			opts:       []Option{XFFOptions(XFF{DedupeAdjacent: true, MaxEntries: 4})},
+			expected:   "6.6.6.6, 1.1.1.1, 10.1.0.1",
+		},
+		{
+			desc:       "untrusted headers",
+			remoteAddr: "10.0.0.2:4242",
+			xff:        []string{"6.6.6.6, 10.0.0.2"},
+			opts:       []Option{TrustForwardHeader(false), XFFOptions(XFF{DedupeAdjacent: true, MaxEntries: 4})},
+			expected:   "10.0.0.2",
+		},
+		{
+			desc:       "untrusted headers, loopback peer",
+			remoteAddr: "127.0.0.1:4242",
+			xff:        []string{"6.6.6.6"},
+			opts:       []Option{TrustForwardHeader(false), XFFOptions(XFF{OmitLoopback: true})},
+			expected:   "",
 		},
 	}
 
 	for _, test := range testCases {
-		test := test
 		t.Run(test.desc, func(t *testing.T) {
-			t.Parallel()
+			var received atomic.Pointer[http.Header]
+			srv := testutils.NewHandler(func(_ http.ResponseWriter, req *http.Request) {
+				h := req.Header.Clone()
+				received.Store(&h)
+			})
+			t.Cleanup(srv.Close)
 
-			actual := ipv6fix(test.clientIP)
-			assert.Equal(t, test.expected, actual)
+			f := New(false, test.opts...)
+
+			req := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+			req.RemoteAddr = test.remoteAddr
+			for _, xff := range test.xff {
+				req.Header.Add(XForwardedFor, xff)
+			}
+
+			rw := httptest.NewRecorder()
+			f.ServeHTTP(rw, req)
+			assert.Equal(t, http.StatusOK, rw.Code)
+
+			require.NotNil(t, received.Load())
+			assert.Equal(t, test.expected, strings.Join(received.Load().Values(XForwardedFor), ", "))
 		})
 	}
 }
+
+func TestXFFOptions_websocket(t *testing.T) {
+	var received atomic.Pointer[string]
+	srv := testutils.NewWSEchoServer(t, testutils.WSAnyOrigin(), testutils.WSOnUpgrade(func(req *http.Request) {
+		xff := req.Header.Get(XForwardedFor)
+		received.Store(&xff)
+	}))
+
+	f := New(false, XFFOptions(XFF{DedupeAdjacent: true, OmitLoopback: true, MaxEntries: 2}))
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(testutils.MustParseRequestURI(proxy.URL).Host),
+		testutils.WSHeader(XForwardedFor, "6.6.6.6, 1.1.1.1, 10.0.0.2, 10.0.0.2"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	require.NoError(t, conn.SendText("hello"))
+	require.NoError(t, conn.Expect("hello"))
+
+	require.NotNil(t, received.Load())
+	assert.Equal(t, "1.1.1.1, 10.0.0.2", *received.Load())
+}
+
+func TestEmitClientProtoHeader_customTransport(t *testing.T) {
+	_, err := Build(false, func(p *httputil.ReverseProxy) error {
+		p.Transport = http.DefaultTransport
+		return nil
+	}, EmitClientProtoHeader("X-Forwarded-Proto-Version"))
+
+	var errCustom *ErrCustomTransport
+	require.ErrorAs(t, err, &errCustom)
+	assert.Equal(t, "EmitClientProtoHeader", errCustom.Option)
+}
@@ -0,0 +1,168 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// AutoScheme is the scheme of the target URLs whose scheme is resolved by probing the backend, see SchemeProber.
+const AutoScheme = "auto"
+
+// schemeProbeTimeout bounds each attempt of a probe.
+const schemeProbeTimeout = 2 * clock.Second
+
+// SchemeProber resolves the scheme of the target URLs without scheme, or with the AutoScheme (e.g. auto://10.0.0.5:8080):
+// the backend is probed with a TLS handshake, and is reached with http if the handshake fails.
+// If the backend can't be reached at all, the request fails with an ErrDial.
+// The scheme of a backend is cached for cacheTTL, and probed again early when a request fails
+// with a TLS or protocol error, e.g. after the backend switched to TLS.
+// The probe does not verify the certificate of the backend: the requests are still verified by the Transport.
+// See ProbedSchemes for the cached schemes.
+func SchemeProber(cacheTTL time.Duration) Option {
+	return func(p *httputil.ReverseProxy) error {
+		p.Transport = &schemeTransport{
+			next:    p.Transport,
+			ttl:     cacheTTL,
+			probe:   probeScheme,
+			schemes: make(map[string]probedScheme),
+		}
+		return nil
+	}
+}
+
+// ProbedSchemes returns the cached schemes of the backends probed by p, by host:port,
+// or nil if p has not been created with SchemeProber.
+func ProbedSchemes(p *httputil.ReverseProxy) map[string]string {
+	t, ok := findTransport[*schemeTransport](p.Transport)
+	if !ok {
+		return nil
+	}
+	return t.cached()
+}
+
+type probedScheme struct {
+	scheme  string
+	expires clock.Time
+}
+
+// schemeTransport resolves the scheme of the requests before passing them to the next round tripper.
+type schemeTransport struct {
+	next http.RoundTripper
+	ttl  time.Duration
+
+	// probe returns the scheme of the backend at hostPort.
+	probe func(ctx context.Context, hostPort string) (string, error)
+
+	mu      sync.Mutex
+	schemes map[string]probedScheme
+}
+
+func (t *schemeTransport) unwrap() http.RoundTripper {
+	return t.next
+}
+
+func (t *schemeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "" && req.URL.Scheme != AutoScheme {
+		return t.next.RoundTrip(req)
+	}
+
+	hostPort := req.URL.Host
+	scheme, err := t.scheme(req.Context(), hostPort)
+	if err != nil {
+		return nil, &ErrDial{URL: req.URL, Err: err}
+	}
+
+	outReq := req.WithContext(req.Context())
+	outReq.URL = utils.CopyURL(req.URL)
+	outReq.URL.Scheme = scheme
+
+	resp, err := t.next.RoundTrip(outReq)
+	if err != nil {
+		// The backend may not speak the cached scheme anymore.
+		if kind := ErrorKind(upstreamError(outReq.URL, err)); kind == KindTLS || kind == KindProtocol {
+			t.invalidate(hostPort)
+		}
+	}
+	return resp, err
+}
+
+// scheme returns the scheme of the backend at hostPort, probing it if it is not cached.
+func (t *schemeTransport) scheme(ctx context.Context, hostPort string) (string, error) {
+	t.mu.Lock()
+	entry, ok := t.schemes[hostPort]
+	t.mu.Unlock()
+
+	if ok && clock.Now().Before(entry.expires) {
+		return entry.scheme, nil
+	}
+
+	scheme, err := t.probe(ctx, hostPort)
+	if err != nil {
+		return "", err
+	}
+
+	t.mu.Lock()
+	t.schemes[hostPort] = probedScheme{scheme: scheme, expires: clock.Now().Add(t.ttl)}
+	t.mu.Unlock()
+
+	return scheme, nil
+}
+
+func (t *schemeTransport) invalidate(hostPort string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.schemes, hostPort)
+}
+
+func (t *schemeTransport) cached() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := clock.Now()
+	out := make(map[string]string, len(t.schemes))
+	for hostPort, entry := range t.schemes {
+		if now.Before(entry.expires) {
+			out[hostPort] = entry.scheme
+		}
+	}
+	return out
+}
+
+// probeScheme attempts a TLS handshake with the backend at hostPort, and falls back to a plain TCP connection.
+// Without port, the default ports of https and http are probed.
+func probeScheme(ctx context.Context, hostPort string) (string, error) {
+	host, _, err := net.SplitHostPort(hostPort)
+	tlsAddr, plainAddr := hostPort, hostPort
+	if err != nil {
+		host = hostPort
+		tlsAddr, plainAddr = net.JoinHostPort(hostPort, "443"), net.JoinHostPort(hostPort, "80")
+	}
+
+	dialer := &net.Dialer{Timeout: schemeProbeTimeout}
+
+	tlsDialer := &tls.Dialer{
+		NetDialer: dialer,
+		// Only the ability to complete a handshake is probed.
+		//nolint:gosec // the requests verify the certificates
+		Config: &tls.Config{ServerName: host, InsecureSkipVerify: true},
+	}
+	if conn, err := tlsDialer.DialContext(ctx, "tcp", tlsAddr); err == nil {
+		_ = conn.Close()
+		return "https", nil
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", plainAddr)
+	if err != nil {
+		return "", err
+	}
+	_ = conn.Close()
+	return "http", nil
+}
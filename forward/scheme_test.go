@@ -0,0 +1,230 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// probeCounter counts the probes of the scheme prober of p, by host:port.
+type probeCounter struct {
+	mu     sync.Mutex
+	probes map[string]int
+}
+
+func countProbes(t *testing.T, p *httputil.ReverseProxy) *probeCounter {
+	t.Helper()
+
+	st, ok := p.Transport.(*schemeTransport)
+	require.True(t, ok)
+
+	c := &probeCounter{probes: make(map[string]int)}
+	probe := st.probe
+	st.probe = func(ctx context.Context, hostPort string) (string, error) {
+		c.mu.Lock()
+		c.probes[hostPort]++
+		c.mu.Unlock()
+		return probe(ctx, hostPort)
+	}
+	return c
+}
+
+func (c *probeCounter) count(hostPort string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.probes[hostPort]
+}
+
+// newProberProxy returns a proxy forwarding the requests to auto://<X-Target header>.
+// The certificates of the test servers are not verified.
+func newProberProxy(t *testing.T, ttl time.Duration) (*httputil.ReverseProxy, string) {
+	t.Helper()
+
+	insecure := func(p *httputil.ReverseProxy) error {
+		//nolint:gosec // test servers
+		p.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		return nil
+	}
+	f := New(false, insecure, SchemeProber(ttl))
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(AutoScheme + "://" + req.Header.Get("X-Target"))
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	return f, proxy.URL
+}
+
+func getThrough(t *testing.T, proxyURL, target string) (int, string) {
+	t.Helper()
+
+	re, body, err := testutils.Get(proxyURL, testutils.Header("X-Target", target))
+	require.NoError(t, err)
+	return re.StatusCode, string(body)
+}
+
+func TestSchemeProber(t *testing.T) {
+	plain := testutils.NewResponder(t, "plain")
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	}))
+	t.Cleanup(secure.Close)
+
+	plainHost := testutils.MustParseRequestURI(plain.URL).Host
+	secureHost := testutils.MustParseRequestURI(secure.URL).Host
+
+	f, proxyURL := newProberProxy(t, time.Minute)
+	probes := countProbes(t, f)
+
+	for i := 0; i < 2; i++ {
+		code, body := getThrough(t, proxyURL, plainHost)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "plain", body)
+
+		code, body = getThrough(t, proxyURL, secureHost)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "secure", body)
+	}
+
+	assert.Equal(t, 1, probes.count(plainHost))
+	assert.Equal(t, 1, probes.count(secureHost))
+	assert.Equal(t, map[string]string{plainHost: "http", secureHost: "https"}, ProbedSchemes(f))
+
+	// A backend that can't be reached is not cached.
+	code, _ := getThrough(t, proxyURL, "localhost:63450")
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.NotContains(t, ProbedSchemes(f), "localhost:63450")
+
+	assert.Nil(t, ProbedSchemes(New(false)))
+}
+
+// The transports of the options are found below any combination of the others.
+func TestFindTransport_wrappers(t *testing.T) {
+	wrappers := []Option{
+		FirstByteTimeout(time.Second),
+		HeaderLimits(Limits{MaxHeaderCount: 100}),
+		EmitTimingHeaders(TimingConfig{ServerTimingHeader: true}),
+		RetryStaleConnections(1),
+		TrackWebsockets(),
+	}
+
+	for _, first := range []bool{true, false} {
+		opts := append([]Option{}, wrappers...)
+		if first {
+			opts = append([]Option{SchemeProber(time.Minute)}, opts...)
+		} else {
+			opts = append(opts, SchemeProber(time.Minute))
+		}
+
+		f := New(false, opts...)
+
+		assert.NotNil(t, ProbedSchemes(f))
+		assert.NotNil(t, findContextTransport(f.Transport))
+		assert.NotNil(t, findWebsocketsTransport(f.Transport))
+
+		_, ok := findTransport[*timingTransport](f.Transport)
+		assert.True(t, ok)
+	}
+
+	_, ok := findTransport[*schemeTransport](New(false, wrappers...).Transport)
+	assert.False(t, ok)
+}
+
+// restart closes srv, and serves handler on its address, with TLS if secure.
+func restart(t *testing.T, srv *httptest.Server, handler http.Handler, secure bool) *httptest.Server {
+	t.Helper()
+
+	addr := srv.Listener.Addr().String()
+	srv.Close()
+
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+
+	restarted := httptest.NewUnstartedServer(handler)
+	_ = restarted.Listener.Close()
+	restarted.Listener = l
+	if secure {
+		restarted.StartTLS()
+	} else {
+		restarted.Start()
+	}
+	t.Cleanup(restarted.Close)
+	return restarted
+}
+
+func TestSchemeProber_plainToTLS(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil {
+			_, _ = w.Write([]byte("secure"))
+			return
+		}
+		_, _ = w.Write([]byte("plain"))
+	})
+	srv := httptest.NewServer(handler)
+	host := srv.Listener.Addr().String()
+
+	f, proxyURL := newProberProxy(t, time.Minute)
+	probes := countProbes(t, f)
+
+	_, body := getThrough(t, proxyURL, host)
+	assert.Equal(t, "plain", body)
+
+	restart(t, srv, handler, true)
+
+	// The cached scheme is used until it expires.
+	code, _ := getThrough(t, proxyURL, host)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, 1, probes.count(host))
+
+	clock.Advance(time.Minute)
+
+	code, body = getThrough(t, proxyURL, host)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "secure", body)
+	assert.Equal(t, 2, probes.count(host))
+	assert.Equal(t, map[string]string{host: "https"}, ProbedSchemes(f))
+}
+
+func TestSchemeProber_invalidateOnProtocolError(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil {
+			_, _ = w.Write([]byte("secure"))
+			return
+		}
+		_, _ = w.Write([]byte("plain"))
+	})
+	srv := httptest.NewTLSServer(handler)
+	host := srv.Listener.Addr().String()
+
+	f, proxyURL := newProberProxy(t, time.Hour)
+	probes := countProbes(t, f)
+
+	_, body := getThrough(t, proxyURL, host)
+	assert.Equal(t, "secure", body)
+
+	restart(t, srv, handler, false)
+
+	// The backend answers in plain HTTP to the HTTPS request: the cached scheme is dropped.
+	code, _ := getThrough(t, proxyURL, host)
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Empty(t, ProbedSchemes(f))
+
+	code, body = getThrough(t, proxyURL, host)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "plain", body)
+	assert.Equal(t, 2, probes.count(host))
+}
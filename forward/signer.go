@@ -0,0 +1,117 @@
+package forward
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+)
+
+// SignerFunc signs the request sent to the backend, e.g. with an HMAC of its method, path, date and body hash.
+type SignerFunc func(outReq *http.Request) error
+
+// ErrSign is returned when the Signer fails, the request is not sent.
+// The default error handler answers 502.
+type ErrSign struct {
+	Err error
+}
+
+func (e *ErrSign) Error() string {
+	return fmt.Sprintf("sign request: %v", e.Err)
+}
+
+func (e *ErrSign) Unwrap() error {
+	return e.Err
+}
+
+// Signer calls fn with every request sent to the backend, websocket handshakes included,
+// once it is final: after the Director (URL, headers and X-Forwarded headers), the HeaderLimits and the SchemeProber,
+// right before the round trip. fn can add headers to the request, and must not replace its body.
+// If fn returns an error, the request is not sent and the error handler gets an ErrSign.
+// See ContentSHA256 for the hash of the body.
+//
+// The Signer applies to the Transport created by New, it can't be combined with a custom Transport.
+func Signer(fn SignerFunc) Option {
+	return func(p *httputil.ReverseProxy) error {
+		ct := findContextTransport(p.Transport)
+		if ct == nil {
+			return &ErrCustomTransport{Option: "Signer"}
+		}
+		ct.signer = fn
+		return nil
+	}
+}
+
+// sign calls the signer of the transport with req, with a cache for ContentSHA256.
+func (t *contextTransport) sign(req *http.Request) (*http.Request, error) {
+	req = req.WithContext(context.WithValue(req.Context(), contentHashKey{}, &contentHash{}))
+	if err := t.signer(req); err != nil {
+		return nil, &ErrSign{Err: err}
+	}
+	return req, nil
+}
+
+type contentHashKey struct{}
+
+// contentHash caches the hash of the body of a request being signed.
+type contentHash struct {
+	once sync.Once
+	sum  string
+	err  error
+}
+
+// ContentSHA256 returns the hex-encoded SHA-256 of the body of the request, e.g. for an x-amz-content-sha256 header.
+// The body is read from GetBody when it is set, or rewound after being read when it is an io.Seeker,
+// as the bodies of the requests buffered by the buffer package are: the backend receives it unchanged.
+// The other bodies can't be read without being consumed, an error is returned.
+// In a Signer, the hash is computed once per request.
+func ContentSHA256(req *http.Request) (string, error) {
+	if c, ok := req.Context().Value(contentHashKey{}).(*contentHash); ok {
+		c.once.Do(func() {
+			c.sum, c.err = contentSHA256(req)
+		})
+		return c.sum, c.err
+	}
+	return contentSHA256(req)
+}
+
+func contentSHA256(req *http.Request) (string, error) {
+	h := sha256.New()
+
+	switch {
+	case req.Body == nil || req.Body == http.NoBody:
+	case req.GetBody != nil:
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = body.Close() }()
+
+		if _, err := io.Copy(h, body); err != nil {
+			return "", err
+		}
+	default:
+		seeker, ok := req.Body.(io.Seeker)
+		if !ok {
+			return "", errors.New("the request body can't be replayed")
+		}
+
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(h, req.Body); err != nil {
+			return "", err
+		}
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,202 @@
+package forward
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// signature is an HMAC over the method, the host, the path, the date and the hash of the body.
+func signature(req *http.Request, bodyHash string) string {
+	mac := hmac.New(sha256.New, []byte("secret"))
+	_, _ = io.WriteString(mac, strings.Join([]string{req.Method, req.Host, req.URL.RequestURI(), req.Header.Get("Date"), bodyHash}, "\n"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedRequest is a request as seen by the signer or the backend.
+type signedRequest struct {
+	host       string
+	requestURI string
+	header     http.Header
+}
+
+func TestSigner(t *testing.T) {
+	var received atomic.Pointer[signedRequest]
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		received.Store(&signedRequest{host: req.Host, requestURI: req.RequestURI, header: req.Header.Clone()})
+
+		body, _ := io.ReadAll(req.Body)
+		sum := sha256.Sum256(body)
+		if req.Header.Get("X-Signature") != signature(req, hex.EncodeToString(sum[:])) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	var signed atomic.Pointer[signedRequest]
+	f := New(false, Signer(func(outReq *http.Request) error {
+		bodyHash, err := ContentSHA256(outReq)
+		if err != nil {
+			return err
+		}
+		outReq.Header.Set("X-Content-Sha256", bodyHash)
+		outReq.Header.Set("X-Signature", signature(outReq, bodyHash))
+
+		signed.Store(&signedRequest{host: outReq.Host, requestURI: outReq.URL.RequestURI(), header: outReq.Header.Clone()})
+		return nil
+	}))
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		// The body is replayable, as the bodies of the requests created with http.NewRequest.
+		body, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		f.ServeHTTP(w, req)
+	})
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Post(proxy.URL+"/path?q=1",
+		testutils.Body("payload"),
+		testutils.Header("Date", "Tue, 15 Nov 1994 08:12:31 GMT"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	// The signer saw the request received by the backend.
+	require.NotNil(t, signed.Load())
+	require.NotNil(t, received.Load())
+	assert.Equal(t, received.Load(), signed.Load())
+	assert.Equal(t, "/path?q=1", signed.Load().requestURI)
+	assert.NotEmpty(t, signed.Load().header.Get(XForwardedFor))
+
+	sum := sha256.Sum256([]byte("payload"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), received.Load().header.Get("X-Content-Sha256"))
+}
+
+func TestSigner_error(t *testing.T) {
+	var requests atomic.Int64
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	var handled error
+	f := New(false,
+		Signer(func(*http.Request) error { return errors.New("no key") }),
+		ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+			handled = err
+			defaultErrorHandler.ServeHTTP(w, req, err)
+		})))
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	t.Cleanup(proxy.Close)
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, int64(0), requests.Load())
+
+	var errSign *ErrSign
+	require.ErrorAs(t, handled, &errSign)
+	assert.EqualError(t, errSign, "sign request: no key")
+	assert.Empty(t, ErrorKind(handled))
+
+	// The request was not sent: it is not a network error.
+	var netErr net.Error
+	assert.False(t, errors.As(handled, &netErr))
+}
+
+func TestSigner_bodyNotReplayable(t *testing.T) {
+	var requests atomic.Int64
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+	})
+	t.Cleanup(srv.Close)
+
+	f := New(false, Signer(func(outReq *http.Request) error {
+		_, err := ContentSHA256(outReq)
+		return err
+	}))
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	t.Cleanup(proxy.Close)
+
+	// The body of a request received by the server can only be read once.
+	re, _, err := testutils.Post(proxy.URL, testutils.Body("payload"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, int64(0), requests.Load())
+
+	// Without body, there is nothing to replay.
+	re, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, int64(1), requests.Load())
+}
+
+func TestSigner_websocket(t *testing.T) {
+	var signature atomic.Pointer[string]
+	srv := testutils.NewWSEchoServer(t, testutils.WSAnyOrigin(), testutils.WSOnUpgrade(func(req *http.Request) {
+		s := req.Header.Get("X-Signature")
+		signature.Store(&s)
+	}))
+
+	f := New(false, Signer(func(outReq *http.Request) error {
+		outReq.Header.Set("X-Signature", outReq.URL.Path)
+		return nil
+	}))
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	conn, err := testutils.WSRequest(testutils.WSServer(testutils.MustParseRequestURI(proxy.URL).Host), testutils.WSPath("/ws"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	require.NoError(t, conn.SendText("hello"))
+	require.NoError(t, conn.Expect("hello"))
+
+	require.NotNil(t, signature.Load())
+	assert.Equal(t, "/ws", *signature.Load())
+}
+
+func TestSigner_customTransport(t *testing.T) {
+	_, err := Build(false, Signer(func(*http.Request) error { return nil }), func(p *httputil.ReverseProxy) error {
+		p.Transport = http.DefaultTransport
+		return nil
+	})
+
+	var errCustom *ErrCustomTransport
+	require.ErrorAs(t, err, &errCustom)
+	assert.Equal(t, "Signer", errCustom.Option)
+}
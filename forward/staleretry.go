@@ -0,0 +1,153 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// RetryStaleConnections retries the requests that failed on a pooled connection the backend had just closed,
+// e.g. at the end of its keep-alive timeout, at most maxRetries times per request.
+// A request is only retried when:
+//   - its body can be read again from GetBody, whatever its method;
+//   - or its method is idempotent, and it has no body or its body is rewound: an io.Seeker,
+//     as the bodies of the requests buffered by buffer.New are;
+//   - the connection was reused from the pool and failed with an EOF or a reset before the response headers,
+//     or the HTTP/2 stream was refused (REFUSED_STREAM or GOAWAY);
+//   - no response has been written to the client: the retries happen before the response of the backend is passed on.
+//
+// A retry is sent with Close set, its connection is not put back in the pool. The other idle connections are kept:
+// when a retry gets another stale connection, it is retried again, within maxRetries.
+// The retries are counted in the context of the request, see StaleRetriesFromContext.
+// A maxRetries lower than or equal to 0 disables the retries.
+func RetryStaleConnections(maxRetries int) Option {
+	return func(p *httputil.ReverseProxy) error {
+		if maxRetries <= 0 {
+			return nil
+		}
+		p.Transport = &staleRetryTransport{next: p.Transport, maxRetries: maxRetries}
+		return nil
+	}
+}
+
+// StaleRetriesFromContext returns the number of times the forwarder retried the request on a new connection,
+// see RetryStaleConnections, if ctx has been created by WithErrorCapture.
+func StaleRetriesFromContext(ctx context.Context) int {
+	if c, ok := ctx.Value(errorCaptureKey{}).(*errorCapture); ok {
+		return c.getRetries()
+	}
+	return 0
+}
+
+// staleRetryTransport retries the round trips that failed on a stale pooled connection.
+type staleRetryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+}
+
+func (t *staleRetryTransport) unwrap() http.RoundTripper {
+	return t.next
+}
+
+func (t *staleRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isReplayable(req) || isWebsocketRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	offset, err := bodyOffset(req)
+	if err != nil {
+		return t.next.RoundTrip(req)
+	}
+
+	for retries := 0; ; retries++ {
+		var reused atomic.Bool
+		ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				reused.Store(info.Reused)
+			},
+		})
+
+		resp, err := t.next.RoundTrip(req.WithContext(ctx))
+		if err == nil || retries >= t.maxRetries || req.Context().Err() != nil || !isStaleConnError(err, reused.Load()) {
+			return resp, err
+		}
+
+		if req, err = rewind(req, offset); err != nil {
+			return nil, err
+		}
+
+		recordRetry(req.Context())
+	}
+}
+
+// isReplayable reports whether the request can be sent again: its body can be read again with GetBody,
+// or its method is idempotent and it has no body or its body can be rewound.
+func isReplayable(req *http.Request) bool {
+	if req.GetBody != nil {
+		return true
+	}
+
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		_, ok := req.Body.(io.Seeker)
+		return ok
+	}
+	return true
+}
+
+// bodyOffset returns the offset of the body of the request before its first attempt, when it is rewound between the attempts.
+func bodyOffset(req *http.Request) (int64, error) {
+	seeker, ok := req.Body.(io.Seeker)
+	if req.GetBody != nil || !ok {
+		return 0, nil
+	}
+	return seeker.Seek(0, io.SeekCurrent)
+}
+
+// rewind returns a copy of the request to retry, with a new body read from GetBody,
+// or its body rewound to offset when it is an io.Seeker.
+// The connection of the retry is not put back in the pool.
+func rewind(req *http.Request, offset int64) (*http.Request, error) {
+	out := *req
+	out.Close = true
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	} else if seeker, ok := req.Body.(io.Seeker); ok {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return &out, nil
+}
+
+// isStaleConnError reports whether err is the failure of a connection closed by the backend before the response headers,
+// which is only stale if it was reused from the pool, or the refusal of an HTTP/2 stream.
+func isStaleConnError(err error, reused bool) bool {
+	msg := err.Error()
+	if strings.Contains(msg, "REFUSED_STREAM") || strings.Contains(msg, "GOAWAY") {
+		return true
+	}
+	if !reused {
+		return false
+	}
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		strings.Contains(msg, "server closed idle connection")
+}
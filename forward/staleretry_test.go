@@ -0,0 +1,158 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// newStaleBackend starts a backend answering a single request per connection without closing it:
+// it closes the connection when the next request is received, as at the end of a keep-alive timeout.
+func newStaleBackend(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				_, _ = io.Copy(io.Discard, req.Body)
+				_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+
+				_, _ = http.ReadRequest(br)
+			}()
+		}
+	}()
+
+	return "http://" + ln.Addr().String()
+}
+
+// newReplayingProxy forwards the requests to uri with their body buffered, replayable with GetBody,
+// except on /once.
+func newReplayingProxy(t *testing.T, f http.Handler, uri string, retries *[]int) *httptest.Server {
+	t.Helper()
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.MustParseRequestURI(uri)
+		req.URL.Path = path
+
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if path != "/once" {
+			req.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
+
+		req = req.WithContext(WithErrorCapture(req.Context()))
+		f.ServeHTTP(w, req)
+		*retries = append(*retries, StaleRetriesFromContext(req.Context()))
+	})
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestRetryStaleConnections(t *testing.T) {
+	backendURL := newStaleBackend(t)
+
+	var retries []int
+	proxy := newReplayingProxy(t, New(false, RetryStaleConnections(1)), backendURL, &retries)
+
+	for i := 0; i < 10; i++ {
+		re, body, err := testutils.Post(proxy.URL, testutils.Body("hello"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode, i)
+		assert.Equal(t, "ok", string(body))
+	}
+
+	// The connection of a retry is not put back in the pool: the request after a retry is sent on a new connection.
+	assert.Equal(t, []int{0, 1, 0, 1, 0, 1, 0, 1, 0, 1}, retries)
+}
+
+func TestRetryStaleConnections_disabled(t *testing.T) {
+	backendURL := newStaleBackend(t)
+
+	var retries []int
+	proxy := newReplayingProxy(t, New(false), backendURL, &retries)
+
+	var failed int
+	for i := 0; i < 10; i++ {
+		re, _, err := testutils.Post(proxy.URL, testutils.Body("hello"))
+		require.NoError(t, err)
+		if re.StatusCode == http.StatusBadGateway {
+			failed++
+		}
+	}
+
+	// Every request sent on a reused connection fails.
+	assert.Equal(t, 5, failed)
+	assert.Equal(t, make([]int, 10), retries)
+}
+
+func TestRetryStaleConnections_notReplayable(t *testing.T) {
+	backendURL := newStaleBackend(t)
+
+	var retries []int
+	proxy := newReplayingProxy(t, New(false, RetryStaleConnections(3)), backendURL, &retries)
+
+	re, _, err := testutils.Post(proxy.URL+"/once", testutils.Body("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// The POST without GetBody is sent on the stale connection, and is not retried.
+	re, _, err = testutils.Post(proxy.URL+"/once", testutils.Body("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, []int{0, 0}, retries)
+}
+
+func TestIsReplayable(t *testing.T) {
+	get := httptest.NewRequest(http.MethodGet, "/", nil)
+	get.Body = nil
+	assert.True(t, isReplayable(get))
+
+	post, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "http://localhost", bytes.NewReader([]byte("hello")))
+	require.NoError(t, err)
+	assert.True(t, isReplayable(post))
+
+	post.GetBody = nil
+	assert.False(t, isReplayable(post))
+
+	put := httptest.NewRequest(http.MethodPut, "/", bytes.NewReader([]byte("hello")))
+	assert.False(t, isReplayable(put))
+
+	// The seekable bodies are rewound, for the idempotent methods only.
+	seeker := struct {
+		io.ReadSeeker
+		io.Closer
+	}{ReadSeeker: bytes.NewReader([]byte("hello")), Closer: io.NopCloser(nil)}
+	put.Body = seeker
+	assert.True(t, isReplayable(put))
+
+	post.Body = seeker
+	assert.False(t, isReplayable(post))
+}
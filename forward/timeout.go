@@ -0,0 +1,127 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"sync/atomic"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// timeoutError is returned when the backend does not respond in time.
+// It implements net.Error, so the error handler answers 504 when the response has not started yet.
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+var (
+	errFirstByteTimeout = &timeoutError{msg: "timeout awaiting response headers"}
+	errBodyIdleTimeout  = &timeoutError{msg: "timeout awaiting response body"}
+)
+
+// timeoutTransport bounds the time until the response headers are received,
+// and the time between two reads of the response body.
+// The context of the outbound request is canceled when a timeout expires.
+type timeoutTransport struct {
+	next http.RoundTripper
+
+	firstByteTimeout time.Duration
+	bodyIdleTimeout  time.Duration
+}
+
+// timeouts returns the timeoutTransport of p, wrapping its current Transport if needed.
+func timeouts(p *httputil.ReverseProxy) *timeoutTransport {
+	if t, ok := p.Transport.(*timeoutTransport); ok {
+		return t
+	}
+	t := &timeoutTransport{next: p.Transport}
+	p.Transport = t
+	return t
+}
+
+func (t *timeoutTransport) unwrap() http.RoundTripper {
+	return t.next
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isWebsocketRequest(req) || (t.firstByteTimeout <= 0 && t.bodyIdleTimeout <= 0) {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+
+	var firstByte clock.Timer
+	if t.firstByteTimeout > 0 {
+		firstByte = clock.AfterFunc(t.firstByteTimeout, cancel)
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+
+	if firstByte != nil && !firstByte.Stop() {
+		// the timer has expired, the request has been (or is being) canceled.
+		cancel()
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		return nil, errFirstByteTimeout
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	body := &timeoutBody{ReadCloser: resp.Body, cancel: cancel}
+	if t.bodyIdleTimeout > 0 {
+		body.timeout = t.bodyIdleTimeout
+		body.timer = clock.AfterFunc(t.bodyIdleTimeout, func() {
+			atomic.StoreInt32(&body.expired, 1)
+			cancel()
+		})
+	}
+	resp.Body = body
+
+	return resp, nil
+}
+
+// timeoutBody cancels the request when no bytes are read during the idle timeout,
+// and releases the context of the request when closed.
+type timeoutBody struct {
+	io.ReadCloser
+
+	timer   clock.Timer
+	timeout time.Duration
+	expired int32
+
+	cancel context.CancelFunc
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.timer == nil {
+		return n, err
+	}
+
+	if atomic.LoadInt32(&b.expired) == 1 {
+		return n, errBodyIdleTimeout
+	}
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.cancel()
+	return b.ReadCloser.Close()
+}
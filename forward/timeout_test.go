@@ -0,0 +1,161 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+type result struct {
+	resp *http.Response
+	body string
+	err  error
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-clock.After(2 * clock.Second):
+		case <-req.Context().Done():
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+	t.Cleanup(srv.Close)
+
+	res := getAsync(t, New(false, FirstByteTimeout(clock.Second)), srv.URL)
+
+	r := awaitResult(t, res, 3*clock.Second)
+	require.NoError(t, r.err)
+	assert.Equal(t, http.StatusGatewayTimeout, r.resp.StatusCode)
+}
+
+func TestFirstByteTimeout_streamAfterHeaders(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for i := 0; i < 10; i++ {
+			clock.Sleep(clock.Second)
+			_, _ = fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	})
+	t.Cleanup(srv.Close)
+
+	res := getAsync(t, New(false, FirstByteTimeout(clock.Second)), srv.URL)
+
+	r := awaitResult(t, res, 20*clock.Second)
+	require.NoError(t, r.err)
+	assert.Equal(t, http.StatusOK, r.resp.StatusCode)
+	assert.Contains(t, r.body, "data: 9\n\n")
+}
+
+func TestBodyIdleTimeout(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+
+		for i := 0; i < 3; i++ {
+			_, _ = fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+
+		// the stream stalls.
+		<-req.Context().Done()
+	})
+	t.Cleanup(srv.Close)
+
+	res := getAsync(t, New(false, FirstByteTimeout(clock.Second), BodyIdleTimeout(clock.Second)), srv.URL)
+
+	r := awaitResult(t, res, 5*clock.Second)
+	require.Error(t, r.err)
+	assert.Equal(t, http.StatusOK, r.resp.StatusCode)
+	assert.Equal(t, "data: 0\n\ndata: 1\n\ndata: 2\n\n", r.body)
+}
+
+func TestTimeouts_websocketNoop(t *testing.T) {
+	var called int32
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&called, 1)
+		assert.NoError(t, req.Context().Err())
+		return &http.Response{StatusCode: http.StatusSwitchingProtocols, Body: http.NoBody}, nil
+	})
+
+	tr := &timeoutTransport{next: next, firstByteTimeout: clock.Nanosecond, bodyIdleTimeout: clock.Nanosecond}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set(Connection, "Upgrade")
+	req.Header.Set(Upgrade, "websocket")
+
+	resp, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, http.NoBody, resp.Body)
+	assert.EqualValues(t, 1, called)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// getAsync sends a request to the backend through the forwarder, the result is sent on the returned channel.
+func getAsync(t *testing.T, f http.Handler, backendURL string) <-chan result {
+	t.Helper()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(backendURL)
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	res := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(proxy.URL)
+		if err != nil {
+			res <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		res <- result{resp: resp, body: string(body), err: err}
+	}()
+
+	return res
+}
+
+// awaitResult advances the frozen time until the result is available.
+func awaitResult(t *testing.T, res <-chan result, max clock.Duration) result {
+	t.Helper()
+
+	var r result
+	var done bool
+	testutils.AdvanceUntil(t, func() bool {
+		select {
+		case r = <-res:
+			done = true
+		default:
+		}
+		return done
+	}, 100*clock.Millisecond, max)
+
+	return r
+}
@@ -0,0 +1,138 @@
+package forward
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// TimingConfig configures the timing headers added to the responses, see EmitTimingHeaders.
+type TimingConfig struct {
+	// ServerTimingHeader appends the timings of the upstream round trip to the Server-Timing header:
+	// <prefix>-upstream (until the response headers), <prefix>-dial and <prefix>-tls when a connection has been opened.
+	ServerTimingHeader bool
+	// Prefix is the prefix of the Server-Timing metric names, "oxy" by default.
+	Prefix string
+	// UpstreamStatusHeader sets the X-Oxy-Upstream-Status header to the status code returned by the backend,
+	// before ModifyResponse and the middlewares in front of the forwarder can rewrite it.
+	UpstreamStatusHeader bool
+}
+
+// EmitTimingHeaders adds the timing headers of TimingConfig to the responses of the backends.
+// The Server-Timing entries are appended to the ones set by the backend, never replacing them.
+// The websocket upgrades are left unchanged.
+func EmitTimingHeaders(cfg TimingConfig) Option {
+	if cfg.Prefix == "" {
+		cfg.Prefix = "oxy"
+	}
+	return func(p *httputil.ReverseProxy) error {
+		p.Transport = &timingTransport{next: p.Transport, cfg: cfg}
+		return nil
+	}
+}
+
+// timingTransport measures the round trips, and adds the timing headers to their responses.
+type timingTransport struct {
+	next http.RoundTripper
+	cfg  TimingConfig
+}
+
+func (t *timingTransport) unwrap() http.RoundTripper {
+	return t.next
+}
+
+func (t *timingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isWebsocketRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	timings := &roundTripTimings{}
+	start := clock.Now()
+
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), timings.clientTrace())))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, nil
+	}
+
+	if t.cfg.UpstreamStatusHeader {
+		resp.Header.Set(XOxyUpstreamStatus, strconv.Itoa(resp.StatusCode))
+	}
+
+	if t.cfg.ServerTimingHeader {
+		resp.Header.Add(ServerTiming, timings.serverTiming(t.cfg.Prefix, clock.Since(start)))
+	}
+
+	return resp, nil
+}
+
+// roundTripTimings are the durations of the steps of a round trip, measured with an httptrace.ClientTrace.
+// The connections can be dialed in other goroutines, and complete after the round trip.
+type roundTripTimings struct {
+	mu sync.Mutex
+
+	connectStart time.Time
+	dial         time.Duration
+	tlsStart     time.Time
+	tls          time.Duration
+}
+
+func (r *roundTripTimings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		ConnectStart: func(string, string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.connectStart.IsZero() {
+				r.connectStart = clock.Now()
+			}
+		},
+		ConnectDone: func(_, _ string, err error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if err == nil && !r.connectStart.IsZero() {
+				r.dial = clock.Since(r.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.tlsStart = clock.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if err == nil && !r.tlsStart.IsZero() {
+				r.tls = clock.Since(r.tlsStart)
+			}
+		},
+	}
+}
+
+// serverTiming returns the Server-Timing entries of the round trip, e.g. "oxy-upstream;dur=123.4, oxy-dial;dur=2.1".
+func (r *roundTripTimings) serverTiming(prefix string, upstream time.Duration) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := []string{timingEntry(prefix, "upstream", upstream)}
+	if r.dial > 0 {
+		entries = append(entries, timingEntry(prefix, "dial", r.dial))
+	}
+	if r.tls > 0 {
+		entries = append(entries, timingEntry(prefix, "tls", r.tls))
+	}
+	return strings.Join(entries, ", ")
+}
+
+func timingEntry(prefix, name string, d time.Duration) string {
+	return prefix + "-" + name + ";dur=" + strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+}
@@ -0,0 +1,118 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// serverTimingDurations returns the durations of the Server-Timing metrics, by name.
+func serverTimingDurations(t *testing.T, h http.Header) map[string]float64 {
+	t.Helper()
+
+	durations := make(map[string]float64)
+	for _, value := range h.Values(ServerTiming) {
+		for _, entry := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+			if !strings.HasPrefix(params, "dur=") {
+				durations[name] = 0
+				continue
+			}
+			d, err := strconv.ParseFloat(strings.TrimPrefix(params, "dur="), 64)
+			require.NoError(t, err)
+			durations[name] = d
+		}
+	}
+	return durations
+}
+
+func newTimingProxy(t *testing.T, backend http.HandlerFunc, opts ...Option) string {
+	t.Helper()
+
+	srv := testutils.NewHandler(backend)
+	t.Cleanup(srv.Close)
+
+	f := New(false, opts...)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	t.Cleanup(proxy.Close)
+
+	return proxy.URL
+}
+
+func TestEmitTimingHeaders(t *testing.T) {
+	proxyURL := newTimingProxy(t, func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte("hello"))
+	}, EmitTimingHeaders(TimingConfig{ServerTimingHeader: true, Prefix: "oxy"}))
+
+	re, body, err := testutils.Get(proxyURL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	durations := serverTimingDurations(t, re.Header)
+	require.Contains(t, durations, "oxy-upstream")
+	assert.GreaterOrEqual(t, durations["oxy-upstream"], 50.0)
+	require.Contains(t, durations, "oxy-dial")
+	assert.NotContains(t, durations, "oxy-tls")
+
+	assert.Empty(t, re.Header.Get(XOxyUpstreamStatus))
+}
+
+func TestEmitTimingHeaders_appended(t *testing.T) {
+	proxyURL := newTimingProxy(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set(ServerTiming, "db;dur=12.5, cache;desc=miss")
+		_, _ = w.Write([]byte("hello"))
+	}, EmitTimingHeaders(TimingConfig{ServerTimingHeader: true, Prefix: "edge"}))
+
+	re, _, err := testutils.Get(proxyURL)
+	require.NoError(t, err)
+
+	values := re.Header.Values(ServerTiming)
+	require.Len(t, values, 2)
+	assert.Equal(t, "db;dur=12.5, cache;desc=miss", values[0])
+	assert.True(t, strings.HasPrefix(values[1], "edge-upstream;dur="), values[1])
+
+	durations := serverTimingDurations(t, re.Header)
+	assert.Equal(t, 12.5, durations["db"])
+	assert.Contains(t, durations, "cache")
+	assert.Contains(t, durations, "edge-upstream")
+}
+
+func TestEmitTimingHeaders_upstreamStatus(t *testing.T) {
+	proxyURL := newTimingProxy(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	},
+		EmitTimingHeaders(TimingConfig{UpstreamStatusHeader: true}),
+		func(p *httputil.ReverseProxy) error {
+			p.ModifyResponse = func(resp *http.Response) error {
+				resp.StatusCode = http.StatusOK
+				return nil
+			}
+			return nil
+		})
+
+	re, _, err := testutils.Get(proxyURL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "503", re.Header.Get(XOxyUpstreamStatus))
+	assert.Empty(t, re.Header.Values(ServerTiming))
+}
+
+func TestEmitTimingHeaders_pool(t *testing.T) {
+	// The pool options still find the transport created by New.
+	assert.NotPanics(t, func() {
+		New(false, EmitTimingHeaders(TimingConfig{ServerTimingHeader: true}), MaxIdleConnsPerHost(4))
+	})
+}
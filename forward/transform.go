@@ -0,0 +1,198 @@
+package forward
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+)
+
+// transformBufferSize is the size of the chunks read by StringReplacer.
+const transformBufferSize = 32 << 10
+
+// TransformFunc transforms the body of a response as a stream: it reads the body of the backend from src,
+// and writes the body forwarded to the client to dst, see ResponseBodyTransformer.
+// It must return once src is exhausted, or as soon as a write to dst fails.
+type TransformFunc func(dst io.Writer, src io.Reader) error
+
+// ErrTransform is recorded when the transformation of the body of a response fails,
+// the response is then truncated, see ErrorFromContext.
+type ErrTransform struct {
+	URL *url.URL
+	Err error
+}
+
+func (e *ErrTransform) Error() string {
+	return fmt.Sprintf("transform the response of %s: %v", e.URL, e.Err)
+}
+
+func (e *ErrTransform) Unwrap() error {
+	return e.Err
+}
+
+// Timeout implements net.Error.
+func (e *ErrTransform) Timeout() bool {
+	return false
+}
+
+// Temporary implements net.Error.
+func (e *ErrTransform) Temporary() bool {
+	return false
+}
+
+// ResponseBodyTransformer transforms the bodies of the responses of the backends, e.g. to rewrite the internal URLs.
+// fn is called with each response, and returns the TransformFunc of its body and true to opt in (e.g. by Content-Type).
+// The body is transformed as it is streamed, never buffered as a whole:
+// the Content-Length of a transformed response is removed, the response is chunked.
+// The responses without body, and the ones with a Content-Encoding, are forwarded as is.
+// When the transformation fails, the response is truncated and an ErrTransform is recorded in the context of the request.
+// It sets the ModifyResponse function of the ReverseProxy, calling the previous one if any:
+// replacing ModifyResponse afterwards disables the transformation.
+func ResponseBodyTransformer(fn func(resp *http.Response) (TransformFunc, bool)) Option {
+	return func(p *httputil.ReverseProxy) error {
+		modify := p.ModifyResponse
+		p.ModifyResponse = func(resp *http.Response) error {
+			if modify != nil {
+				if err := modify(resp); err != nil {
+					return err
+				}
+			}
+
+			if !transformable(resp) {
+				return nil
+			}
+
+			transform, ok := fn(resp)
+			if !ok || transform == nil {
+				return nil
+			}
+
+			resp.Header.Del(ContentLength)
+			resp.ContentLength = -1
+			resp.Body = newTransformBody(resp.Request, resp.Body, transform)
+			return nil
+		}
+		return nil
+	}
+}
+
+// transformable reports whether resp has a body which can be transformed.
+func transformable(resp *http.Response) bool {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return false
+	}
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	switch {
+	case resp.StatusCode < http.StatusOK, resp.StatusCode == http.StatusNoContent, resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+	ce := resp.Header.Get(ContentEncoding)
+	return ce == "" || ce == "identity"
+}
+
+// transformBody is the body of a response transformed by a TransformFunc running in its own goroutine.
+type transformBody struct {
+	pr   *io.PipeReader
+	src  io.ReadCloser
+	done chan struct{}
+
+	closeOnce sync.Once
+}
+
+func newTransformBody(req *http.Request, src io.ReadCloser, transform TransformFunc) *transformBody {
+	pr, pw := io.Pipe()
+	b := &transformBody{pr: pr, src: src, done: make(chan struct{})}
+
+	go func() {
+		defer close(b.done)
+
+		err := transform(pw, src)
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			err = &ErrTransform{URL: req.URL, Err: err}
+			recordError(req.Context(), err)
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	return b
+}
+
+func (b *transformBody) Read(p []byte) (int, error) {
+	return b.pr.Read(p)
+}
+
+// Close stops the transformation, and waits for it to return.
+func (b *transformBody) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		_ = b.pr.Close()
+		err = b.src.Close()
+		<-b.done
+	})
+	return err
+}
+
+// StringReplacer returns a TransformFunc replacing the occurrences of old with new, like strings.ReplaceAll,
+// including the ones spanning several reads of the body.
+func StringReplacer(old, new string) TransformFunc {
+	return func(dst io.Writer, src io.Reader) error {
+		if old == "" {
+			_, err := io.Copy(dst, src)
+			return err
+		}
+
+		oldBytes, newBytes := []byte(old), []byte(new)
+		buf := make([]byte, 0, transformBufferSize+len(old))
+
+		for {
+			n, err := src.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+
+			eof := errors.Is(err, io.EOF)
+			if err != nil && !eof {
+				return err
+			}
+
+			pending := buf
+			for {
+				i := bytes.Index(pending, oldBytes)
+				if i < 0 {
+					break
+				}
+				if _, errW := dst.Write(pending[:i]); errW != nil {
+					return errW
+				}
+				if _, errW := dst.Write(newBytes); errW != nil {
+					return errW
+				}
+				pending = pending[i+len(old):]
+			}
+
+			// An occurrence starting in the last len(old)-1 bytes may end in the next read.
+			keep := len(old) - 1
+			switch {
+			case eof:
+				keep = 0
+			case len(pending) < keep:
+				keep = len(pending)
+			}
+			if flush := len(pending) - keep; flush > 0 {
+				if _, errW := dst.Write(pending[:flush]); errW != nil {
+					return errW
+				}
+				pending = pending[flush:]
+			}
+
+			if eof {
+				return nil
+			}
+			buf = buf[:copy(buf, pending)]
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package forward
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// transformHTML opts in for the HTML responses.
+func transformHTML(transform TransformFunc) func(resp *http.Response) (TransformFunc, bool) {
+	return func(resp *http.Response) (TransformFunc, bool) {
+		return transform, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html")
+	}
+}
+
+// serveTransformed serves the requests with f forwarding to backendURL, and sends their upstream errors to the returned channel.
+func serveTransformed(t *testing.T, f http.Handler, backendURL string) (*httptest.Server, <-chan error) {
+	t.Helper()
+
+	upstreamErr := make(chan error, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req = req.WithContext(WithErrorCapture(req.Context()))
+		// The forwarder aborts the handler when the body of the response fails.
+		defer func() { upstreamErr <- ErrorFromContext(req.Context()) }()
+
+		req.URL = testutils.MustParseRequestURI(backendURL)
+		f.ServeHTTP(w, req)
+	}))
+	t.Cleanup(proxy.Close)
+
+	return proxy, upstreamErr
+}
+
+func TestResponseBodyTransformer_html(t *testing.T) {
+	// The internal URLs are split across the writes of the backend.
+	chunks := []string{
+		`<html><a href="http://internal.lo`,
+		`cal/a">a</a><img src="http://int`,
+		`ernal.local/b.png"><a href="http://internal.local`,
+		`/c">c</a> http://internal.loca`,
+	}
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", "200")
+		for _, chunk := range chunks {
+			_, _ = w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+		_, _ = w.Write([]byte(strings.Repeat(" ", 200-len(strings.Join(chunks, "")))))
+	})
+	t.Cleanup(srv.Close)
+
+	f := New(false, ResponseBodyTransformer(transformHTML(StringReplacer("http://internal.local", "https://example.com"))))
+	proxy, upstreamErr := serveTransformed(t, f, srv.URL)
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(ContentLength))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	expected := `<html><a href="https://example.com/a">a</a><img src="https://example.com/b.png">` +
+		`<a href="https://example.com/c">c</a> http://internal.loca`
+	assert.Equal(t, expected, strings.TrimRight(string(body), " "))
+	assert.NoError(t, <-upstreamErr)
+}
+
+func TestResponseBodyTransformer_notOptedIn(t *testing.T) {
+	payload := `{"url":"http://internal.local/a"}`
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(payload))
+	})
+	t.Cleanup(srv.Close)
+
+	f := New(false, ResponseBodyTransformer(transformHTML(StringReplacer("http://internal.local", "https://example.com"))))
+	proxy, upstreamErr := serveTransformed(t, f, srv.URL)
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, payload, string(body))
+	assert.Equal(t, int64(len(payload)), resp.ContentLength)
+	assert.Empty(t, resp.TransferEncoding)
+	assert.NoError(t, <-upstreamErr)
+}
+
+func TestResponseBodyTransformer_contentEncoding(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "br")
+		_, _ = w.Write([]byte("http://internal.local"))
+	})
+	t.Cleanup(srv.Close)
+
+	f := New(false, ResponseBodyTransformer(transformHTML(StringReplacer("http://internal.local", "https://example.com"))))
+	proxy, _ := serveTransformed(t, f, srv.URL)
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, "http://internal.local", string(body))
+}
+
+func TestResponseBodyTransformer_error(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(strings.Repeat("a", 1000)))
+	})
+	t.Cleanup(srv.Close)
+
+	errBroken := errors.New("broken")
+	f := New(false, ResponseBodyTransformer(transformHTML(func(dst io.Writer, src io.Reader) error {
+		if _, err := io.CopyN(dst, src, 100); err != nil {
+			return err
+		}
+		return errBroken
+	})))
+	proxy, upstreamErr := serveTransformed(t, f, srv.URL)
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	// The response is truncated.
+	require.Error(t, err)
+	assert.Equal(t, strings.Repeat("a", 100), string(body))
+
+	var errTransform *ErrTransform
+	require.ErrorAs(t, <-upstreamErr, &errTransform)
+	assert.ErrorIs(t, errTransform, errBroken)
+	assert.Equal(t, srv.Listener.Addr().String(), errTransform.URL.Host)
+}
+
+func TestStringReplacer(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		old, new string
+		input    string
+	}{
+		{desc: "no occurrence", old: "foo", new: "bar", input: "hello world"},
+		{desc: "occurrences", old: "foo", new: "bar", input: "foofoo, foo and fo-foo fo"},
+		{desc: "longer replacement", old: "ab", new: "abab", input: "aabbab"},
+		{desc: "empty replacement", old: "ab", new: "", input: "aabbab"},
+		{desc: "empty old", old: "", new: "x", input: "hello"},
+		{desc: "partial occurrence at the end", old: "hello", new: "bye", input: "hello hell"},
+		{desc: "larger than the buffer", old: "needle", new: "pin", input: strings.Repeat("hay needle ", 10000)},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			expected := test.input
+			if test.old != "" {
+				expected = strings.ReplaceAll(test.input, test.old, test.new)
+			}
+
+			for _, src := range []io.Reader{strings.NewReader(test.input), iotest.OneByteReader(strings.NewReader(test.input))} {
+				var dst strings.Builder
+				require.NoError(t, StringReplacer(test.old, test.new)(&dst, src))
+				assert.Equal(t, expected, dst.String())
+			}
+		})
+	}
+}
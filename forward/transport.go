@@ -0,0 +1,272 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Dialer establishes the connections of the websocket requests.
+// *net.Dialer implements this interface.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type roundTripperKey struct{}
+
+type websocketDialerKey struct{}
+
+type hostOverrideKey struct{}
+
+// WithRoundTripper returns a copy of ctx in which rt is used by the forwarder
+// instead of its default Transport for the requests carrying this context.
+// The caller owns the connection pooling of the injected round tripper:
+// it should be reused across requests rather than created per request.
+// A nil rt leaves ctx unchanged.
+func WithRoundTripper(ctx context.Context, rt http.RoundTripper) context.Context {
+	if rt == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, roundTripperKey{}, rt)
+}
+
+// RoundTripperFromContext returns the round tripper set by WithRoundTripper, if any.
+func RoundTripperFromContext(ctx context.Context) (http.RoundTripper, bool) {
+	rt, ok := ctx.Value(roundTripperKey{}).(http.RoundTripper)
+	return rt, ok
+}
+
+// WithWebsocketDialer returns a copy of ctx in which d is used by the forwarder
+// to dial the backend of the websocket requests carrying this context.
+// Upgraded connections are never pooled, the caller owns the resources held by the dialer.
+// A nil d leaves ctx unchanged.
+func WithWebsocketDialer(ctx context.Context, d Dialer) context.Context {
+	if d == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, websocketDialerKey{}, d)
+}
+
+// WebsocketDialerFromContext returns the dialer set by WithWebsocketDialer, if any.
+func WebsocketDialerFromContext(ctx context.Context) (Dialer, bool) {
+	d, ok := ctx.Value(websocketDialerKey{}).(Dialer)
+	return d, ok
+}
+
+// WithHostOverride returns a copy of ctx in which host is the host of the backend of the requests carrying this context,
+// e.g. its hostname when the URL of the request has one of its IP addresses.
+// Unless the Host header of the client is passed, the forwarder sends host in the Host header,
+// and its hostname in the TLS server name (SNI) when the default Transport of New is used.
+// An empty host leaves ctx unchanged.
+func WithHostOverride(ctx context.Context, host string) context.Context {
+	if host == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, hostOverrideKey{}, host)
+}
+
+// HostOverrideFromContext returns the host set by WithHostOverride, if any.
+func HostOverrideFromContext(ctx context.Context) (string, bool) {
+	host, ok := ctx.Value(hostOverrideKey{}).(string)
+	return host, ok
+}
+
+// wrapperTransport is implemented by the round trippers added by the options around the transport of the forwarder.
+type wrapperTransport interface {
+	// unwrap returns the wrapped round tripper.
+	unwrap() http.RoundTripper
+}
+
+// findTransport returns the round tripper of type T in the chain of the wrapped round trippers starting at rt,
+// and whether it was found.
+func findTransport[T http.RoundTripper](rt http.RoundTripper) (T, bool) {
+	for rt != nil {
+		if t, ok := rt.(T); ok {
+			return t, true
+		}
+
+		w, ok := rt.(wrapperTransport)
+		if !ok {
+			break
+		}
+		rt = w.unwrap()
+	}
+
+	var zero T
+	return zero, false
+}
+
+// contextTransport selects the round tripper of a request from its context,
+// and falls back to the default one.
+type contextTransport struct {
+	defaultTransport http.RoundTripper
+	// signer signs the requests before the round trip, see Signer.
+	signer SignerFunc
+	// rewriter sets the forwarding headers in the Director created by New, see TrustForwardHeader.
+	rewriter *HeaderRewriter
+	// proxy selects the proxy of the requests, see UpstreamProxy.
+	proxy ProxyFunc
+	// proxyTLSConfig is the TLS configuration of the connections to the https:// proxies, see UpstreamProxyTLSConfig.
+	proxyTLSConfig *tls.Config
+
+	// copies are the copies of the default transport sending a TLS server name (see WithHostOverride),
+	// or connecting through a proxy (see UpstreamProxy), by proxy and name.
+	copies sync.Map
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if xff, ok := req.Context().Value(forwardedForKey{}).([]string); ok {
+		if len(xff) > 0 {
+			req.Header[XForwardedFor] = xff
+		} else {
+			req.Header.Del(XForwardedFor)
+		}
+	}
+
+	if t.signer != nil {
+		var err error
+		if req, err = t.sign(req); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := t.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// clears the error of a previous attempt.
+	recordError(req.Context(), nil)
+	recordFraming(req.Context(), nil)
+	return sanitizeFraming(req, resp)
+}
+
+func (t *contextTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	if rt, ok := RoundTripperFromContext(ctx); ok {
+		return rt.RoundTrip(req)
+	}
+
+	proxy, err := t.upstreamProxy(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if d, ok := WebsocketDialerFromContext(ctx); ok && isWebsocketRequest(req) {
+		tr := websocketTransport(d)
+		if t.proxy != nil {
+			tr.Proxy = nil
+		}
+		if proxy != nil {
+			tr.DialContext = newProxyDialer(proxy, t.proxyTLSConfig, d.DialContext).DialContext
+		}
+		return tr.RoundTrip(req)
+	}
+
+	var name string
+	if host, ok := HostOverrideFromContext(ctx); ok && req.URL.Scheme == "https" {
+		name = host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			name = h
+		}
+	}
+
+	if proxy != nil || name != "" {
+		return t.transportCopy(proxy, name).RoundTrip(req)
+	}
+
+	return t.defaultTransport.RoundTrip(req)
+}
+
+// transportCopy returns the copy of the default transport connecting through proxy, and sending name in the TLS server name,
+// when they are set. The copies keep their connections, one copy is created per proxy and name.
+// Without proxy, a default transport which is not created by New is returned as is.
+func (t *contextTransport) transportCopy(proxy *url.URL, name string) http.RoundTripper {
+	key := name
+	if proxy != nil {
+		key = proxy.String() + " " + name
+	}
+
+	if rt, ok := t.copies.Load(key); ok {
+		return rt.(http.RoundTripper)
+	}
+
+	var rt http.RoundTripper
+	switch dt := t.defaultTransport.(type) {
+	case *http.Transport:
+		tr := withServerName(dt, name)
+		if proxy != nil {
+			tr.DialContext = newProxyDialer(proxy, t.proxyTLSConfig, dt.DialContext).DialContext
+		}
+		rt = tr
+	case *poolTransport:
+		// The dials of the copy are still counted by dt, by backend, see PoolStats.
+		tr := withServerName(dt.transport, name)
+		if proxy != nil {
+			pd := newProxyDialer(proxy, t.proxyTLSConfig, dt.dialer)
+			tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dt.dial(ctx, pd.DialContext, network, addr)
+			}
+		}
+		rt = &poolTransport{transport: tr}
+	default:
+		if proxy == nil {
+			return t.defaultTransport
+		}
+		tr := withServerName(&http.Transport{}, name)
+		tr.DialContext = newProxyDialer(proxy, t.proxyTLSConfig, nil).DialContext
+		rt = tr
+	}
+
+	actual, _ := t.copies.LoadOrStore(key, rt)
+	return actual.(http.RoundTripper)
+}
+
+// withServerName returns a copy of tr without proxy, sending name in the TLS server name if it is set.
+func withServerName(tr *http.Transport, name string) *http.Transport {
+	out := tr.Clone()
+	if name != "" {
+		if out.TLSClientConfig == nil {
+			out.TLSClientConfig = &tls.Config{}
+		}
+		out.TLSClientConfig.ServerName = name
+	}
+	return out
+}
+
+// websocketTransport creates a transport dialing with d.
+// The connection is hijacked after the upgrade, so there is nothing to keep alive.
+func websocketTransport(d Dialer) *http.Transport {
+	var tr *http.Transport
+	if dt, ok := http.DefaultTransport.(*http.Transport); ok {
+		tr = dt.Clone()
+	} else {
+		tr = &http.Transport{}
+	}
+
+	tr.DialContext = d.DialContext
+	tr.DisableKeepAlives = true
+	tr.ForceAttemptHTTP2 = false
+
+	return tr
+}
+
+func isWebsocketRequest(req *http.Request) bool {
+	return headerContains(req.Header, Connection, "upgrade") && headerContains(req.Header, Upgrade, "websocket")
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
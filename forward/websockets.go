@@ -0,0 +1,378 @@
+package forward
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+)
+
+// maxCloseReason is the maximum length of the reason of a close frame: the payload of a control frame is limited to 125 bytes.
+const maxCloseReason = 123
+
+// ErrWebsocketDraining is returned for the websocket upgrades received while the sessions of the forwarder are drained,
+// see DrainWebsockets. The default error handler answers 503 with a Retry-After header.
+type ErrWebsocketDraining struct{}
+
+func (e *ErrWebsocketDraining) Error() string {
+	return "websocket sessions are being drained"
+}
+
+// TrackWebsockets tracks the websocket sessions open through the forwarder, to close them on shutdown,
+// see ActiveWebsockets and DrainWebsockets.
+// The frames are not decoded, only their headers are followed to close the sessions between two frames.
+func TrackWebsockets() Option {
+	return func(p *httputil.ReverseProxy) error {
+		if findWebsocketsTransport(p.Transport) != nil {
+			return nil
+		}
+		p.Transport = &websocketsTransport{next: p.Transport, sessions: make(map[*websocketSession]struct{})}
+		return nil
+	}
+}
+
+// ActiveWebsockets returns the number of websocket sessions open through p,
+// or 0 if p has not been created with TrackWebsockets.
+func ActiveWebsockets(p *httputil.ReverseProxy) int {
+	t := findWebsocketsTransport(p.Transport)
+	if t == nil {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sessions)
+}
+
+// DrainWebsockets closes the websocket sessions open through p, e.g. with websocket.CloseGoingAway on shutdown.
+// From then on, the upgrades are rejected with an ErrWebsocketDraining.
+// A close frame with code and reason is sent to the client and to the backend of every session, once the frames
+// being forwarded are complete. The close frames they answer with are dropped, and the sessions end once both
+// have closed their connections. The sessions still open when ctx is done are closed, and ctx.Err() is returned.
+// It does nothing if p has not been created with TrackWebsockets.
+func DrainWebsockets(ctx context.Context, p *httputil.ReverseProxy, code int, reason string) error {
+	if code < 1000 || code > 4999 {
+		return fmt.Errorf("invalid close code: %d", code)
+	}
+	if len(reason) > maxCloseReason {
+		return fmt.Errorf("close reason longer than %d bytes: %q", maxCloseReason, reason)
+	}
+
+	t := findWebsocketsTransport(p.Transport)
+	if t == nil {
+		return nil
+	}
+
+	payload := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(reason)), uint16(code))
+	payload = append(payload, reason...)
+
+	sessions := t.drain()
+	for _, s := range sessions {
+		// the write of the close frame waits for the backend to read the frames sent before.
+		go s.drain(payload)
+	}
+
+	for _, s := range sessions {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			for _, s := range sessions {
+				_ = s.Close()
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// findWebsocketsTransport returns the websocketsTransport of the forwarder, below the transports wrapping it.
+func findWebsocketsTransport(rt http.RoundTripper) *websocketsTransport {
+	t, _ := findTransport[*websocketsTransport](rt)
+	return t
+}
+
+// websocketsTransport registers the websocket sessions upgraded by the next round tripper.
+type websocketsTransport struct {
+	next http.RoundTripper
+
+	mu       sync.Mutex
+	sessions map[*websocketSession]struct{}
+	draining bool
+}
+
+func (t *websocketsTransport) unwrap() http.RoundTripper {
+	return t.next
+}
+
+func (t *websocketsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isWebsocketRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	draining := t.draining
+	t.mu.Unlock()
+	if draining {
+		return nil, &ErrWebsocketDraining{}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		return resp, err
+	}
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return resp, nil
+	}
+
+	s := &websocketSession{ReadWriteCloser: conn, transport: t, done: make(chan struct{})}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// the drain started during the handshake.
+	if t.draining {
+		_ = conn.Close()
+		return nil, &ErrWebsocketDraining{}
+	}
+
+	t.sessions[s] = struct{}{}
+	resp.Body = s
+	return resp, nil
+}
+
+// drain rejects the next upgrades, and returns the open sessions.
+func (t *websocketsTransport) drain() []*websocketSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.draining = true
+
+	sessions := make([]*websocketSession, 0, len(t.sessions))
+	for s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (t *websocketsTransport) remove(s *websocketSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, s)
+}
+
+// websocketSession is the connection to the backend of a websocket session, copied to and from the client by the ReverseProxy:
+// Read returns the frames of the backend, and Write is passed the frames of the client.
+// Once the session is drained, the close frame is inserted at the next frame boundary in both directions,
+// and the frames after it are dropped.
+type websocketSession struct {
+	io.ReadWriteCloser
+
+	transport *websocketsTransport
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// payload is the payload of the close frames, it is set before draining.
+	payload  []byte
+	draining atomic.Bool
+
+	// fromBackend, pending and closedToClient are only used by Read.
+	fromBackend    frameTracker
+	pending        []byte
+	closedToClient bool
+
+	// mu guards the writes to the backend.
+	mu              sync.Mutex
+	toBackend       frameTracker
+	closedToBackend bool
+}
+
+func (s *websocketSession) Read(p []byte) (int, error) {
+	for {
+		if len(s.pending) > 0 {
+			n := copy(p, s.pending)
+			s.pending = s.pending[n:]
+			return n, nil
+		}
+
+		if s.closedToClient {
+			// the frames sent by the backend after the close frame, e.g. its own close frame.
+			if _, err := s.ReadWriteCloser.Read(p); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if s.draining.Load() && s.fromBackend.boundary() {
+			s.pending = closeFrame(s.payload, false)
+			s.closedToClient = true
+			continue
+		}
+
+		n, err := s.ReadWriteCloser.Read(p)
+
+		draining := s.draining.Load()
+		m := 0
+		for m < n && !(draining && s.fromBackend.boundary()) {
+			m += s.fromBackend.advance(p[m:n])
+		}
+
+		if m > 0 || err != nil {
+			return m, err
+		}
+	}
+}
+
+func (s *websocketSession) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closedToBackend {
+		return len(p), nil
+	}
+
+	draining := s.draining.Load()
+	n := 0
+	for n < len(p) && !(draining && s.toBackend.boundary()) {
+		n += s.toBackend.advance(p[n:])
+	}
+
+	if n > 0 {
+		if _, err := s.ReadWriteCloser.Write(p[:n]); err != nil {
+			return 0, err
+		}
+	}
+
+	if draining && s.toBackend.boundary() {
+		if err := s.closeBackend(); err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *websocketSession) Close() error {
+	s.closeOnce.Do(func() {
+		s.transport.remove(s)
+		close(s.done)
+	})
+	return s.ReadWriteCloser.Close()
+}
+
+// drain sends the close frame to the backend if no frame of the client is being forwarded,
+// otherwise Write sends it after the frame. Read sends it to the client.
+func (s *websocketSession) drain(payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining.Load() {
+		return
+	}
+	s.payload = payload
+	s.draining.Store(true)
+
+	if s.toBackend.boundary() {
+		_ = s.closeBackend()
+	}
+}
+
+// closeBackend sends the close frame to the backend, masked as the frames of a client.
+func (s *websocketSession) closeBackend() error {
+	s.closedToBackend = true
+	_, err := s.ReadWriteCloser.Write(closeFrame(s.payload, true))
+	return err
+}
+
+// closeFrame returns a close frame with the payload, masked for the backends.
+func closeFrame(payload []byte, masked bool) []byte {
+	if !masked {
+		return append([]byte{0x88, byte(len(payload))}, payload...)
+	}
+
+	frame := make([]byte, 6, 6+len(payload))
+	frame[0], frame[1] = 0x88, 0x80|byte(len(payload))
+	_, _ = rand.Read(frame[2:6])
+	for i, b := range payload {
+		frame = append(frame, b^frame[2+i%4])
+	}
+	return frame
+}
+
+// frameTracker follows the boundaries of the frames of a websocket stream, from their headers.
+type frameTracker struct {
+	header    [14]byte
+	headerLen int
+	// remaining is the number of payload bytes of the current frame not consumed yet.
+	remaining uint64
+}
+
+// boundary reports whether the stream is between two frames.
+func (f *frameTracker) boundary() bool {
+	return f.headerLen == 0 && f.remaining == 0
+}
+
+// advance consumes the bytes of p up to the end of the current frame, or of the next one at a boundary,
+// and returns their number.
+func (f *frameTracker) advance(p []byte) int {
+	n := 0
+	if f.remaining == 0 {
+		for n < len(p) {
+			f.header[f.headerLen] = p[n]
+			f.headerLen++
+			n++
+
+			if size := headerSize(f.header[:f.headerLen]); size == f.headerLen {
+				f.remaining = payloadLength(f.header[:size])
+				f.headerLen = 0
+				break
+			}
+		}
+		if f.headerLen > 0 || f.remaining == 0 {
+			return n
+		}
+	}
+
+	k := uint64(len(p) - n)
+	if k > f.remaining {
+		k = f.remaining
+	}
+	f.remaining -= k
+	return n + int(k)
+}
+
+// headerSize returns the size of the frame header starting with h, known from its first 2 bytes.
+func headerSize(h []byte) int {
+	if len(h) < 2 {
+		return 2
+	}
+
+	size := 2
+	switch h[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if h[1]&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+// payloadLength returns the payload length of the complete frame header h.
+func payloadLength(h []byte) uint64 {
+	switch n := h[1] & 0x7f; n {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(h[2:10])
+	default:
+		return uint64(n)
+	}
+}
@@ -0,0 +1,218 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// newDrainBackend creates a websocket echo server sending the errors of its sessions to errs.
+// The sessions on /stuck do not read their messages until release is closed.
+func newDrainBackend(t *testing.T, errs chan<- error, release <-chan struct{}) *httptest.Server {
+	t.Helper()
+
+	upgrader := gorillawebsocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		if req.URL.Path == "/stuck" {
+			<-release
+		}
+
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := conn.WriteMessage(mt, msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDrainWebsockets(t *testing.T) {
+	errs := make(chan error, 4)
+	release := make(chan struct{})
+	srv := newDrainBackend(t, errs, release)
+
+	f := New(true, TrackWebsockets())
+	proxy := createProxyWithForwarder(f, srv.URL)
+	t.Cleanup(proxy.Close)
+	proxyAddr := proxy.Listener.Addr().String()
+
+	var conns []*testutils.WSConn
+	for _, path := range []string{"/ws", "/ws", "/ws", "/stuck"} {
+		conn, err := testutils.WSRequest(testutils.WSServer(proxyAddr), testutils.WSPath(path))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		conns = append(conns, conn)
+	}
+
+	for _, conn := range conns[:3] {
+		require.NoError(t, conn.SendText("hello"))
+		require.NoError(t, conn.Expect("hello"))
+	}
+	assert.Equal(t, 4, ActiveWebsockets(f))
+
+	drained := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		drained <- DrainWebsockets(ctx, f, gorillawebsocket.CloseGoingAway, "shutting down")
+	}()
+
+	for _, conn := range conns[:3] {
+		_, err := conn.ReadText()
+
+		var closeErr *gorillawebsocket.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, gorillawebsocket.CloseGoingAway, closeErr.Code)
+		assert.Equal(t, "shutting down", closeErr.Text)
+
+		// the client closes the connection once it has answered the close frame.
+		_ = conn.Close()
+	}
+
+	for i := 0; i < 3; i++ {
+		var closeErr *gorillawebsocket.CloseError
+		require.ErrorAs(t, <-errs, &closeErr)
+		assert.Equal(t, gorillawebsocket.CloseGoingAway, closeErr.Code)
+		assert.Equal(t, "shutting down", closeErr.Text)
+	}
+
+	// The drain waits for the stuck session, and rejects the upgrades meanwhile.
+	assert.Eventually(t, func() bool { return ActiveWebsockets(f) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, drained)
+
+	_, err := testutils.WSRequest(testutils.WSServer(proxyAddr), testutils.WSPath("/ws"))
+	var errHandshake *testutils.ErrWSHandshake
+	require.ErrorAs(t, err, &errHandshake)
+	assert.Equal(t, http.StatusServiceUnavailable, errHandshake.Response.StatusCode)
+	assert.Equal(t, "1", errHandshake.Response.Header.Get(RetryAfter))
+
+	close(release)
+
+	var closeErr *gorillawebsocket.CloseError
+	require.ErrorAs(t, <-errs, &closeErr)
+	assert.Equal(t, gorillawebsocket.CloseGoingAway, closeErr.Code)
+
+	_, err = conns[3].ReadText()
+	require.ErrorAs(t, err, &closeErr)
+	_ = conns[3].Close()
+
+	require.NoError(t, <-drained)
+	assert.Equal(t, 0, ActiveWebsockets(f))
+}
+
+func TestDrainWebsockets_timeout(t *testing.T) {
+	errs := make(chan error, 1)
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	srv := newDrainBackend(t, errs, release)
+
+	f := New(true, TrackWebsockets())
+	proxy := createProxyWithForwarder(f, srv.URL)
+	t.Cleanup(proxy.Close)
+
+	conn, err := testutils.WSRequest(testutils.WSServer(proxy.Listener.Addr().String()), testutils.WSPath("/stuck"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	assert.Equal(t, 1, ActiveWebsockets(f))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The sessions still open are closed.
+	require.ErrorIs(t, DrainWebsockets(ctx, f, gorillawebsocket.CloseGoingAway, ""), context.DeadlineExceeded)
+	assert.Equal(t, 0, ActiveWebsockets(f))
+
+	_, err = conn.ReadText()
+	require.Error(t, err)
+}
+
+func TestDrainWebsockets_invalid(t *testing.T) {
+	f := New(true, TrackWebsockets())
+
+	require.Error(t, DrainWebsockets(context.Background(), f, 999, ""))
+	require.Error(t, DrainWebsockets(context.Background(), f, gorillawebsocket.CloseGoingAway, string(make([]byte, 124))))
+
+	// Without tracking, there is nothing to drain.
+	require.NoError(t, DrainWebsockets(context.Background(), New(true), gorillawebsocket.CloseGoingAway, ""))
+	assert.Equal(t, 0, ActiveWebsockets(New(true)))
+}
+
+func TestFrameTracker(t *testing.T) {
+	frame := func(masked bool, payloadLen int) []byte {
+		var header []byte
+		switch {
+		case payloadLen < 126:
+			header = []byte{0x82, byte(payloadLen)}
+		case payloadLen < 1<<16:
+			header = []byte{0x82, 126, byte(payloadLen >> 8), byte(payloadLen)}
+		default:
+			header = []byte{0x82, 127, 0, 0, 0, 0, byte(payloadLen >> 24), byte(payloadLen >> 16), byte(payloadLen >> 8), byte(payloadLen)}
+		}
+		if masked {
+			header[1] |= 0x80
+			header = append(header, 1, 2, 3, 4)
+		}
+		return append(header, bytes.Repeat([]byte{0xff}, payloadLen)...)
+	}
+
+	var stream []byte
+	var boundaries []int
+	for _, masked := range []bool{false, true} {
+		for _, n := range []int{0, 5, 125, 126, 300, 70000} {
+			stream = append(stream, frame(masked, n)...)
+			boundaries = append(boundaries, len(stream))
+		}
+	}
+
+	for _, chunk := range []int{1, 3, 7, 4096, len(stream)} {
+		var f frameTracker
+		var found []int
+		for pos := 0; pos < len(stream); {
+			end := pos + chunk
+			if end > len(stream) {
+				end = len(stream)
+			}
+			for pos < end {
+				pos += f.advance(stream[pos:end])
+				if f.boundary() {
+					found = append(found, pos)
+				}
+			}
+		}
+		assert.Equal(t, boundaries, found, "chunk %d", chunk)
+	}
+}
+
+func TestCloseFrame(t *testing.T) {
+	payload := []byte{0x03, 0xe9, 'b', 'y', 'e'}
+
+	assert.Equal(t, append([]byte{0x88, 5}, payload...), closeFrame(payload, false))
+
+	masked := closeFrame(payload, true)
+	require.Len(t, masked, 11)
+	assert.Equal(t, []byte{0x88, 0x85}, masked[:2])
+	for i, b := range masked[6:] {
+		assert.Equal(t, payload[i], b^masked[2+i%4])
+	}
+}
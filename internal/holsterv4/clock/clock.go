@@ -14,7 +14,10 @@
 // not a channel, but a function that returns <-chan time.Time.
 package clock
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 var (
 	frozenAt time.Time
@@ -59,7 +62,19 @@ func Advance(d time.Duration) time.Duration {
 		panic("Freeze time first!")
 	}
 	ft.advance(d)
-	return Now().UTC().Sub(frozenAt)
+	return Since(frozenAt)
+}
+
+// StepWall makes the wall clock of the deterministic time jump by the specified
+// duration, e.g. to simulate an NTP correction or a VM pause. Now moves by d,
+// but the monotonic clock does not: the timers are not fired, and Since keeps
+// measuring the elapsed time of the times returned by Now before the step.
+func StepWall(d time.Duration) {
+	ft, ok := provider.(*frozenTime)
+	if !ok {
+		panic("Freeze time first!")
+	}
+	ft.stepWall(d)
 }
 
 // Wait4Scheduled blocks until either there are n or more scheduled events, or
@@ -79,11 +94,23 @@ func Sleep(d time.Duration) {
 	provider.Sleep(d)
 }
 
+// SleepCtx pauses for at least d, or until ctx is done. It returns ctx.Err()
+// if ctx is done first, nil otherwise.
+func SleepCtx(ctx context.Context, d time.Duration) error {
+	return provider.SleepCtx(ctx, d)
+}
+
 // After see time.After.
 func After(d time.Duration) <-chan time.Time {
 	return provider.After(d)
 }
 
+// AfterCtx is After, except that the timer is released once ctx is done:
+// the channel is then closed without a value.
+func AfterCtx(ctx context.Context, d time.Duration) <-chan time.Time {
+	return provider.AfterCtx(ctx, d)
+}
+
 // NewTimer see time.NewTimer.
 func NewTimer(d time.Duration) Timer {
 	return provider.NewTimer(d)
@@ -0,0 +1,36 @@
+package clock
+
+import (
+	"context"
+	"time"
+)
+
+// sleepCtx waits for the timer, or until ctx is done.
+func sleepCtx(ctx context.Context, timer Timer) error {
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// afterCtx forwards the time of the timer, or closes the channel once ctx is done.
+func afterCtx(ctx context.Context, timer Timer) <-chan time.Time {
+	c := make(chan time.Time, 1)
+
+	go func() {
+		defer timer.Stop()
+
+		select {
+		case t := <-timer.C():
+			c <- t
+		case <-ctx.Done():
+			close(c)
+		}
+	}()
+
+	return c
+}
@@ -1,16 +1,26 @@
 package clock
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
 )
 
 type frozenTime struct {
-	mu     sync.Mutex
+	mu sync.Mutex
+	// now is the monotonic clock, the timers are scheduled on it.
 	now    time.Time
 	timers []*frozenTimer
 	waiter *waiter
+
+	// wall is the offset of the wall clock from the monotonic one, see StepWall.
+	wall time.Duration
+	// zone is the location of the times returned by Now since the last StepWall,
+	// zones the offset of the wall clock by location: Since finds the monotonic
+	// reading of the times with it.
+	zone  *time.Location
+	zones map[*time.Location]time.Duration
 }
 
 type waiter struct {
@@ -19,19 +29,61 @@ type waiter struct {
 }
 
 func (ft *frozenTime) Now() time.Time {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if ft.zone == nil {
+		return ft.now
+	}
+	return ft.now.Add(ft.wall).In(ft.zone)
+}
+
+func (ft *frozenTime) Since(t time.Time) time.Duration {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if wall, ok := ft.zones[t.Location()]; ok {
+		t = t.Add(-wall)
+	}
+	return ft.now.Sub(t)
+}
+
+func (ft *frozenTime) monotonic() time.Time {
 	ft.mu.Lock()
 	defer ft.mu.Unlock()
 	return ft.now
 }
 
+func (ft *frozenTime) stepWall(d time.Duration) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	ft.wall += d
+	name, offset := ft.now.Zone()
+	ft.zone = time.FixedZone(name, offset)
+	if ft.zones == nil {
+		ft.zones = make(map[*time.Location]time.Duration)
+	}
+	ft.zones[ft.zone] = ft.wall
+}
+
 func (ft *frozenTime) Sleep(d time.Duration) {
 	<-ft.NewTimer(d).C()
 }
 
+func (ft *frozenTime) SleepCtx(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sleepCtx(ctx, ft.NewTimer(d))
+}
+
 func (ft *frozenTime) After(d time.Duration) <-chan time.Time {
 	return ft.NewTimer(d).C()
 }
 
+func (ft *frozenTime) AfterCtx(ctx context.Context, d time.Duration) <-chan time.Time {
+	return afterCtx(ctx, ft.NewTimer(d))
+}
+
 func (ft *frozenTime) NewTimer(d time.Duration) Timer {
 	return ft.AfterFunc(d, nil)
 }
@@ -39,7 +91,7 @@ func (ft *frozenTime) NewTimer(d time.Duration) Timer {
 func (ft *frozenTime) AfterFunc(d time.Duration, f func()) Timer {
 	t := &frozenTimer{
 		ft:   ft,
-		when: ft.Now().Add(d),
+		when: ft.monotonic().Add(d),
 		f:    f,
 	}
 	if f == nil {
@@ -168,7 +220,7 @@ func (t *frozenTimer) Stop() bool {
 
 func (t *frozenTimer) Reset(d time.Duration) bool {
 	active := t.ft.stopTimer(t)
-	t.when = t.ft.Now().Add(d)
+	t.when = t.ft.monotonic().Add(d)
 	t.ft.startTimer(t)
 	return active
 }
@@ -191,7 +243,7 @@ func (ft *frozenTime) NewTicker(d time.Duration) Ticker {
 	}
 	t := &frozenTimer{
 		ft:       ft,
-		when:     ft.Now().Add(d),
+		when:     ft.monotonic().Add(d),
 		interval: d,
 		c:        make(chan time.Time, 1),
 	}
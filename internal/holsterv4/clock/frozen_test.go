@@ -1,6 +1,7 @@
 package clock
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -310,6 +311,119 @@ func (s *FrozenSuite) TestUntil() {
 	s.Require().Equal(-Millisecond, Until(Now().Add(-Millisecond)))
 }
 
+func (s *FrozenSuite) TestStepWall() {
+	start := Now()
+	timer := NewTimer(Second)
+
+	// When
+	StepWall(-Hour)
+
+	// Then
+	s.Require().Equal(s.epoch.Add(-Hour).UnixNano(), Now().UnixNano())
+	s.Require().Equal(Duration(0), Since(start))
+	s.assertNotFired(timer.C())
+
+	s.Require().Equal(Second, Advance(Second))
+	s.Require().Equal(Second, Since(start))
+	<-timer.C()
+
+	// The times without monotonic reading measure the wall clock.
+	s.Require().Equal(Second-Hour, Now().UTC().Sub(start))
+
+	stepped := Now()
+	StepWall(2 * Hour)
+	Advance(Millisecond)
+	s.Require().Equal(Millisecond, Since(stepped))
+	s.Require().Equal(Second+Millisecond, Since(start))
+	s.Require().Equal(s.epoch.Add(Hour+Second+Millisecond).UnixNano(), Now().UnixNano())
+}
+
+func (s *FrozenSuite) TestSleepCtx() {
+	done := make(chan error, 1)
+	go func() {
+		done <- SleepCtx(context.Background(), 100*Millisecond)
+	}()
+	s.Require().True(Wait4Scheduled(1, time.Second))
+
+	// When
+	Advance(99 * Millisecond)
+
+	// Then
+	select {
+	case <-done:
+		s.Fail("Premature wake up")
+	default:
+	}
+
+	Advance(Millisecond)
+	select {
+	case err := <-done:
+		s.Require().NoError(err)
+	case <-time.After(time.Second):
+		s.Fail("Sleep did not complete")
+	}
+}
+
+func (s *FrozenSuite) TestSleepCtxCanceled() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- SleepCtx(ctx, Hour)
+	}()
+	s.Require().True(Wait4Scheduled(1, time.Second))
+
+	// When
+	cancel()
+
+	// Then
+	select {
+	case err := <-done:
+		s.Require().ErrorIs(err, context.Canceled)
+	case <-time.After(time.Second):
+		s.Fail("Sleep was not canceled")
+	}
+	s.Require().False(Wait4Scheduled(1, 0))
+
+	// A canceled context does not schedule anything.
+	s.Require().ErrorIs(SleepCtx(ctx, Hour), context.Canceled)
+	s.Require().False(Wait4Scheduled(1, 0))
+}
+
+func (s *FrozenSuite) TestAfterCtx() {
+	ch := AfterCtx(context.Background(), 100*Millisecond)
+	s.Require().True(Wait4Scheduled(1, time.Second))
+
+	// When
+	Advance(100 * Millisecond)
+
+	// Then
+	select {
+	case t, ok := <-ch:
+		s.Require().True(ok)
+		s.Require().Equal(s.epoch.Add(100*Millisecond), t)
+	case <-time.After(time.Second):
+		s.Fail("Timer did not fire")
+	}
+}
+
+func (s *FrozenSuite) TestAfterCtxCanceled() {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := AfterCtx(ctx, Hour)
+	s.Require().True(Wait4Scheduled(1, time.Second))
+
+	// When
+	cancel()
+
+	// Then
+	select {
+	case _, ok := <-ch:
+		s.Require().False(ok)
+	case <-time.After(time.Second):
+		s.Fail("Channel was not closed")
+	}
+	s.Require().False(Wait4Scheduled(1, 0))
+}
+
 func (s *FrozenSuite) assertHits(got <-chan int, want []int) {
 	for i, w := range want {
 		var g int
@@ -97,8 +97,10 @@ func Unix(sec int64, nsec int64) Time {
 	return time.Unix(sec, nsec)
 }
 
+// Since see time.Since. The elapsed time is measured with the monotonic clock,
+// unless t has lost its monotonic reading, e.g. with t.UTC().
 func Since(t Time) Duration {
-	return provider.Now().Sub(t)
+	return provider.Since(t)
 }
 
 func Until(t Time) Duration {
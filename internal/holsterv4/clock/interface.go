@@ -1,6 +1,9 @@
 package clock
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // Timer see time.Timer.
 type Timer interface {
@@ -25,8 +28,11 @@ func NewStoppedTimer() Timer {
 // Clock is an interface that mimics the one of the SDK time package.
 type Clock interface {
 	Now() time.Time
+	Since(t time.Time) time.Duration
 	Sleep(d time.Duration)
+	SleepCtx(ctx context.Context, d time.Duration) error
 	After(d time.Duration) <-chan time.Time
+	AfterCtx(ctx context.Context, d time.Duration) <-chan time.Time
 	NewTimer(d time.Duration) Timer
 	AfterFunc(d time.Duration, f func()) Timer
 	NewTicker(d time.Duration) Ticker
@@ -1,6 +1,9 @@
 package clock
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type systemTime struct{}
 
@@ -8,14 +11,29 @@ func (st *systemTime) Now() time.Time {
 	return time.Now()
 }
 
+func (st *systemTime) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
 func (st *systemTime) Sleep(d time.Duration) {
 	time.Sleep(d)
 }
 
+func (st *systemTime) SleepCtx(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sleepCtx(ctx, st.NewTimer(d))
+}
+
 func (st *systemTime) After(d time.Duration) <-chan time.Time {
 	return time.After(d)
 }
 
+func (st *systemTime) AfterCtx(ctx context.Context, d time.Duration) <-chan time.Time {
+	return afterCtx(ctx, st.NewTimer(d))
+}
+
 type systemTimer struct {
 	t *time.Timer
 }
@@ -1,6 +1,7 @@
 package clock
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -142,3 +143,47 @@ func TestNewStoppedTimer(t *testing.T) {
 	}
 	assert.Equal(t, false, timer.Stop())
 }
+
+func TestSleepCtx(t *testing.T) {
+	start := Now()
+
+	// When
+	err := SleepCtx(context.Background(), 100*time.Millisecond)
+
+	// Then
+	assert.NoError(t, err)
+	if Since(start) < 100*time.Millisecond {
+		assert.Fail(t, "Sleep did not last long enough")
+	}
+}
+
+func TestSleepCtxCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := Now()
+
+	// When
+	err := SleepCtx(ctx, time.Hour)
+
+	// Then
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	if Since(start) > 10*time.Second {
+		assert.Fail(t, "Sleep was not canceled")
+	}
+}
+
+func TestAfterCtxCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := AfterCtx(ctx, time.Hour)
+
+	// When
+	cancel()
+
+	// Then
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "Channel was not closed")
+	}
+}
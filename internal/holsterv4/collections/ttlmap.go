@@ -28,6 +28,10 @@ type TTLMap struct {
 	// executed when an entry has expired
 	OnExpire func(key string, i interface{})
 
+	// Optionally specifies a callback function to be
+	// executed when an entry is evicted to make room for a new one
+	OnEvict func(key string, i interface{})
+
 	capacity    int
 	elements    map[string]*mapElement
 	expiryTimes *PriorityQueue
@@ -63,6 +67,35 @@ func (m *TTLMap) Set(key string, value interface{}, ttlSeconds int) error {
 	return m.set(key, value, expiryTime)
 }
 
+// SetIfRoom sets the value like Set, but never evicts an entry that has not expired to make room for a new key:
+// it returns false without setting the value when the map is full.
+func (m *TTLMap) SetIfRoom(key string, value interface{}, ttlSeconds int) (bool, error) {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return false, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.elements[key]; !ok && len(m.elements) >= m.capacity {
+		if m.RemoveExpired(1) == 0 {
+			return false, nil
+		}
+	}
+	return true, m.set(key, value, expiryTime)
+}
+
+// Keys returns a snapshot of the keys in the map, expired or not.
+func (m *TTLMap) Keys() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	keys := make([]string, 0, len(m.elements))
+	for key := range m.elements {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 func (m *TTLMap) Len() int {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
@@ -208,6 +241,9 @@ func (m *TTLMap) RemoveExpired(iterations int) int {
 		}
 		m.expiryTimes.Pop()
 		mapEl := heapEl.Value.(*mapElement)
+		if m.OnExpire != nil {
+			m.OnExpire(mapEl.key, mapEl.value)
+		}
 		delete(m.elements, mapEl.key)
 		removed += 1
 	}
@@ -221,6 +257,9 @@ func (m *TTLMap) RemoveLastUsed(iterations int) {
 		}
 		heapEl := m.expiryTimes.Pop()
 		mapEl := heapEl.Value.(*mapElement)
+		if m.OnEvict != nil {
+			m.OnEvict(mapEl.key, mapEl.value)
+		}
 		delete(m.elements, mapEl.key)
 	}
 }
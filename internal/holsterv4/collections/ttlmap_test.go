@@ -335,3 +335,59 @@ func (s *TTLMapSuite) TestCallOnExpire() {
 	s.Require().Equal("a", key)
 	s.Require().Equal(1, val)
 }
+
+func (s *TTLMapSuite) TestCallOnExpireAndOnEvictToMakeRoom() {
+	var expired, evicted []string
+	m := NewTTLMap(1)
+	m.OnExpire = func(k string, _ interface{}) {
+		expired = append(expired, k)
+	}
+	m.OnEvict = func(k string, _ interface{}) {
+		evicted = append(evicted, k)
+	}
+
+	s.Require().NoError(m.Set("a", 1, 1))
+	clock.Advance(1 * clock.Second)
+
+	// "a" has expired.
+	s.Require().NoError(m.Set("b", 2, 10))
+	s.Require().Equal([]string{"a"}, expired)
+	s.Require().Empty(evicted)
+
+	// "b" is evicted.
+	s.Require().NoError(m.Set("c", 3, 10))
+	s.Require().Equal([]string{"a"}, expired)
+	s.Require().Equal([]string{"b"}, evicted)
+}
+
+func (s *TTLMapSuite) TestSetIfRoom() {
+	var evicted []string
+	m := NewTTLMap(1)
+	m.OnEvict = func(k string, _ interface{}) {
+		evicted = append(evicted, k)
+	}
+
+	ok, err := m.SetIfRoom("a", 1, 1)
+	s.Require().NoError(err)
+	s.Require().True(ok)
+
+	// "a" is kept.
+	ok, err = m.SetIfRoom("b", 2, 10)
+	s.Require().NoError(err)
+	s.Require().False(ok)
+	_, exists := m.Get("b")
+	s.Require().False(exists)
+
+	// "a" is updated.
+	ok, err = m.SetIfRoom("a", 3, 1)
+	s.Require().NoError(err)
+	s.Require().True(ok)
+
+	// "a" has expired.
+	clock.Advance(1 * clock.Second)
+	ok, err = m.SetIfRoom("b", 2, 10)
+	s.Require().NoError(err)
+	s.Require().True(ok)
+	s.Require().Empty(evicted)
+	s.Require().Equal([]string{"b"}, m.Keys())
+}
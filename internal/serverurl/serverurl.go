@@ -0,0 +1,32 @@
+// Package serverurl normalizes the URLs identifying the servers of the load balancers,
+// shared by roundrobin and roundrobin/stickycookie.
+package serverurl
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// Normalize returns a copy of the server URL u in the form used to identify the servers:
+// the scheme and the host are lowercased, the default port of the scheme is removed, and an empty path becomes "/".
+func Normalize(u *url.URL) *url.URL {
+	if u == nil {
+		return nil
+	}
+
+	out := utils.CopyURL(u)
+	out.Scheme = strings.ToLower(u.Scheme)
+	out.Host = strings.ToLower(u.Host)
+
+	switch port := out.Port(); {
+	case port == "", out.Scheme == "http" && port == "80", out.Scheme == "https" && port == "443":
+		out.Host = strings.TrimSuffix(out.Host, ":"+port)
+	}
+
+	if out.Path == "" {
+		out.Path = "/"
+	}
+	return out
+}
@@ -0,0 +1,91 @@
+package testsuite
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Correlation collects the request IDs seen by the parts of a stack of middlewares,
+// e.g. the backend, the trace records and the client, to check they all report the ID of the request.
+// Its methods are safe to call concurrently with the traffic.
+type Correlation struct {
+	mu  sync.Mutex
+	ids map[string][]string
+}
+
+// NewCorrelation creates a new Correlation.
+func NewCorrelation() *Correlation {
+	return &Correlation{ids: make(map[string][]string)}
+}
+
+// Observe records that source saw the request ID id.
+func (c *Correlation) Observe(source, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ids[source] = append(c.ids[source], id)
+}
+
+// ObserveHeader returns a function recording the header name of the requests as seen by source,
+// e.g. for testutils.ChaosBackend.OnRequest.
+func (c *Correlation) ObserveHeader(source, name string) func(req *http.Request) {
+	return func(req *http.Request) {
+		c.Observe(source, req.Header.Get(name))
+	}
+}
+
+// TraceWriter returns a writer of trace records recording their request_id as seen by source.
+// Every write must be a whole record, as written by the trace middleware.
+func (c *Correlation) TraceWriter(source string) io.Writer {
+	return traceWriter{c: c, source: source}
+}
+
+// Expect checks that the sources, and only them, saw the request ID id since the last call,
+// then forgets the observations.
+func (c *Correlation) Expect(t *testing.T, id string, sources ...string) {
+	t.Helper()
+
+	c.mu.Lock()
+	ids := c.ids
+	c.ids = make(map[string][]string)
+	c.mu.Unlock()
+
+	for _, source := range sources {
+		seen := ids[source]
+		if assert.NotEmpty(t, seen, "%s saw no request ID", source) {
+			for _, got := range seen {
+				assert.Equal(t, id, got, "request ID seen by %s", source)
+			}
+		}
+		delete(ids, source)
+	}
+
+	var unexpected []string
+	for source := range ids {
+		unexpected = append(unexpected, source)
+	}
+	sort.Strings(unexpected)
+	assert.Empty(t, unexpected, "unexpected observations of the request IDs %v", ids)
+}
+
+type traceWriter struct {
+	c      *Correlation
+	source string
+}
+
+func (w traceWriter) Write(p []byte) (int, error) {
+	var record struct {
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(p, &record); err != nil {
+		return 0, err
+	}
+	w.c.Observe(w.source, record.RequestID)
+	return len(p), nil
+}
@@ -0,0 +1,150 @@
+package testsuite
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/buffer"
+	"github.com/vulcand/oxy/v2/cbreaker"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/requestid"
+	"github.com/vulcand/oxy/v2/roundrobin"
+	"github.com/vulcand/oxy/v2/testutils"
+	"github.com/vulcand/oxy/v2/trace"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// newCorrelatedStack creates the stack requestid → trace → cbreaker → buffer → roundrobin → forward in front of the backends,
+// reporting the request IDs they see to c. The generated IDs are req-1, req-2, etc.
+func newCorrelatedStack(t *testing.T, c *Correlation, backends ...*testutils.ChaosBackend) *httptest.Server {
+	t.Helper()
+
+	fwd := forward.New(false, forward.ErrorHandler(utils.ProblemHandler))
+
+	lb, err := roundrobin.New(fwd)
+	require.NoError(t, err)
+	for _, b := range backends {
+		b.OnRequest(c.ObserveHeader("backend", requestid.DefaultHeader))
+		require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+	}
+
+	buf, err := buffer.New(lb,
+		buffer.Retry(`IsNetworkError() && Attempts() < 2`),
+		buffer.OnAttempt(func(a buffer.AttemptInfo) { c.Observe("attempt", a.RequestID) }),
+		buffer.ErrorHandler(utils.ProblemHandler),
+	)
+	require.NoError(t, err)
+
+	fallback, err := cbreaker.NewResponseFallback(
+		cbreaker.Response{StatusCode: http.StatusServiceUnavailable, ContentType: "text/plain", Body: []byte("unavailable")},
+		cbreaker.FallbackTemplates(map[string]*template.Template{
+			"application/json": template.Must(template.New("json").Parse(`{"request_id":"{{.RequestID}}"}`)),
+		}),
+	)
+	require.NoError(t, err)
+
+	cb, err := cbreaker.New(buf, "NetworkErrorRatio() > 0.5", cbreaker.Fallback(fallback))
+	require.NoError(t, err)
+
+	tr, err := trace.New(cb, c.TraceWriter("trace"))
+	require.NoError(t, err)
+
+	var n atomic.Int64
+	rid, err := requestid.New(tr, requestid.Generator(func() string {
+		return fmt.Sprintf("req-%d", n.Add(1))
+	}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(rid)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// get sends a request accepting JSON to the stack, and reports the request IDs of the response to c:
+// its header, and the request_id of its JSON body, if any.
+func get(t *testing.T, c *Correlation, srv *httptest.Server, id string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	if id != "" {
+		req.Header.Set(requestid.DefaultHeader, id)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	c.Observe("response", resp.Header.Get(requestid.DefaultHeader))
+
+	var body struct {
+		RequestID string `json:"request_id"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&body) == nil {
+		c.Observe("body", body.RequestID)
+	}
+	return resp
+}
+
+func TestCorrelation_success(t *testing.T) {
+	c := NewCorrelation()
+	srv := newCorrelatedStack(t, c, testutils.NewChaosBackend(t, "hello"))
+
+	resp := get(t, c, srv, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	c.Expect(t, "req-1", "backend", "attempt", "trace", "response")
+
+	// The ID of the client is passed on.
+	resp = get(t, c, srv, "client-id")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	c.Expect(t, "client-id", "backend", "attempt", "trace", "response")
+
+	// An invalid ID is replaced.
+	resp = get(t, c, srv, "client id")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	c.Expect(t, "req-2", "backend", "attempt", "trace", "response")
+}
+
+func TestCorrelation_retry(t *testing.T) {
+	c := NewCorrelation()
+	down := testutils.NewChaosBackend(t, "down")
+	down.ResetConnections()
+	srv := newCorrelatedStack(t, c, down, testutils.NewChaosBackend(t, "up"))
+
+	// The first attempt is reset by the first backend, the retry is answered by the second one.
+	resp := get(t, c, srv, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	c.Expect(t, "req-1", "backend", "attempt", "trace", "response")
+	assert.Equal(t, int64(1), down.Stats().ConnectionsReset)
+}
+
+func TestCorrelation_errorAndFallback(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	c := NewCorrelation()
+	backend := testutils.NewChaosBackend(t, "hello")
+	backend.Kill()
+	srv := newCorrelatedStack(t, c, backend)
+
+	// Both attempts fail, the error of the forwarder is answered with a problem document.
+	resp := get(t, c, srv, "")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	c.Expect(t, "req-1", "attempt", "trace", "response", "body")
+
+	// The circuit breaker trips on the next check, the request is answered by the fallback.
+	clock.Advance(clock.Second)
+	resp = get(t, c, srv, "")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	c.Expect(t, "req-2", "trace", "response", "body")
+}
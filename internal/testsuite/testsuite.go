@@ -0,0 +1,67 @@
+// Package testsuite provides the tests every middleware should pass.
+package testsuite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Middleware is an http.Handler wrapping a next handler, which can be set after its creation.
+type Middleware interface {
+	http.Handler
+	Wrap(next http.Handler) error
+}
+
+// Factory creates a middleware wrapping next, next being nil for the middlewares wired later.
+type Factory func(t *testing.T, next http.Handler) Middleware
+
+// Lifecycle checks the lifecycle of the middlewares created by newMiddleware:
+// a middleware created without next handler answers 500 until it is wired with Wrap,
+// Wrap refuses a nil handler, and the next handler of a middleware can only be set once.
+func Lifecycle(t *testing.T, newMiddleware Factory) {
+	t.Helper()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	t.Run("not wired", func(t *testing.T) {
+		m := newMiddleware(t, nil)
+
+		rw := serve(m)
+		assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	})
+
+	t.Run("wired later", func(t *testing.T) {
+		m := newMiddleware(t, nil)
+
+		require.Error(t, m.Wrap(nil))
+		require.NoError(t, m.Wrap(next))
+		require.Error(t, m.Wrap(next))
+
+		rw := serve(m)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "hello", rw.Body.String())
+	})
+
+	t.Run("wired at creation", func(t *testing.T) {
+		m := newMiddleware(t, next)
+
+		require.Error(t, m.Wrap(next))
+
+		rw := serve(m)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "hello", rw.Body.String())
+	})
+}
+
+func serve(h http.Handler) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
@@ -0,0 +1,112 @@
+package testsuite
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/acl"
+	"github.com/vulcand/oxy/v2/buffer"
+	"github.com/vulcand/oxy/v2/cbreaker"
+	"github.com/vulcand/oxy/v2/connlimit"
+	"github.com/vulcand/oxy/v2/fairqueue"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/ratelimit"
+	"github.com/vulcand/oxy/v2/requestid"
+	"github.com/vulcand/oxy/v2/roundrobin"
+	"github.com/vulcand/oxy/v2/stream"
+	"github.com/vulcand/oxy/v2/testutils"
+	"github.com/vulcand/oxy/v2/trace"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// The middlewares are all expected to pass the lifecycle tests, new middlewares should be added here.
+func TestLifecycle(t *testing.T) {
+	extract, err := utils.NewExtractor("client.ip")
+	require.NoError(t, err)
+
+	testCases := map[string]Factory{
+		"acl": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			m, err := acl.New(next)
+			require.NoError(t, err)
+			return m
+		},
+		"buffer": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			m, err := buffer.New(next)
+			require.NoError(t, err)
+			return m
+		},
+		"buffer/request": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			m, err := buffer.NewRequestBuffer(next)
+			require.NoError(t, err)
+			return m
+		},
+		"buffer/response": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			m, err := buffer.NewResponseBuffer(next)
+			require.NoError(t, err)
+			return m
+		},
+		"cbreaker": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			m, err := cbreaker.New(next, "NetworkErrorRatio() > 0.5")
+			require.NoError(t, err)
+			return m
+		},
+		"connlimit": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			m, err := connlimit.New(next, extract, 10)
+			require.NoError(t, err)
+			return m
+		},
+		"fairqueue": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			m, err := fairqueue.New(next, extract, fairqueue.Config{Concurrency: 10})
+			require.NoError(t, err)
+			return m
+		},
+		"ratelimit": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			rates := ratelimit.NewRateSet()
+			require.NoError(t, rates.Add(clock.Second, 10, 10))
+			m, err := ratelimit.New(next, extract, rates)
+			require.NoError(t, err)
+			return m
+		},
+		"requestid": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			m, err := requestid.New(next)
+			require.NoError(t, err)
+			return m
+		},
+		"roundrobin": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			m, err := roundrobin.New(next)
+			require.NoError(t, err)
+			require.NoError(t, m.UpsertServer(testutils.MustParseRequestURI("http://localhost:8080")))
+			return m
+		},
+		"stream": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			m, err := stream.New(next)
+			require.NoError(t, err)
+			return m
+		},
+		"trace": func(t *testing.T, next http.Handler) Middleware {
+			t.Helper()
+			m, err := trace.New(next, io.Discard)
+			require.NoError(t, err)
+			return m
+		},
+	}
+
+	for name, newMiddleware := range testCases {
+		t.Run(name, func(t *testing.T) {
+			Lifecycle(t, newMiddleware)
+		})
+	}
+}
@@ -3,6 +3,7 @@ package memmetrics
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/HdrHistogram/hdrhistogram-go"
@@ -80,6 +81,26 @@ func (h *HDRHistogram) Merge(other *HDRHistogram) error {
 	return nil
 }
 
+// SummarySnapshot holds the percentiles of the latencies of a RollingHDRHistogram, see RollingHDRHistogram.Summary.
+type SummarySnapshot struct {
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+	Count int64
+
+	// merged is the histogram the snapshot was computed from, it is never modified.
+	merged *HDRHistogram
+}
+
+// LatencyAtQuantile returns the latency at quantile of the histogram the snapshot was computed from.
+func (s SummarySnapshot) LatencyAtQuantile(q float64) time.Duration {
+	if s.merged == nil {
+		return 0
+	}
+	return s.merged.LatencyAtQuantile(q)
+}
+
 type rhOption func(r *RollingHDRHistogram) error
 
 // RollingHDRHistogram holds multiple histograms and rotates every period.
@@ -93,6 +114,11 @@ type RollingHDRHistogram struct {
 	high        int64
 	sigfigs     int
 	buckets     []*HDRHistogram
+
+	// summaryLock guards the cached summary, which is computed by the concurrent readers.
+	summaryLock sync.Mutex
+	summary     *SummarySnapshot
+	summaryAt   clock.Time
 }
 
 // NewRollingHDRHistogram created a new RollingHDRHistogram.
@@ -154,21 +180,24 @@ func (r *RollingHDRHistogram) Append(o *RollingHDRHistogram) error {
 			return err
 		}
 	}
+	r.invalidateSummary()
 	return nil
 }
 
 // Reset resets a RollingHDRHistogram.
 func (r *RollingHDRHistogram) Reset() {
 	r.idx = 0
-	r.lastRoll = clock.Now().UTC()
+	r.lastRoll = clock.Now()
 	for _, b := range r.buckets {
 		b.Reset()
 	}
+	r.invalidateSummary()
 }
 
 func (r *RollingHDRHistogram) rotate() {
 	r.idx = (r.idx + 1) % len(r.buckets)
 	r.buckets[r.idx].Reset()
+	r.invalidateSummary()
 }
 
 // Merged gets merged histogram.
@@ -185,10 +214,45 @@ func (r *RollingHDRHistogram) Merged() (*HDRHistogram, error) {
 	return m, nil
 }
 
+// Summary returns the percentiles of the merged histogram, computed at most once per maxStaleness:
+// the latencies recorded since the last computation are missing from the summary until it is maxStaleness old.
+// The summary is computed again after a Reset or a rotation.
+// Summary can be called concurrently with itself, but not with the methods recording values.
+func (r *RollingHDRHistogram) Summary(maxStaleness time.Duration) SummarySnapshot {
+	r.summaryLock.Lock()
+	defer r.summaryLock.Unlock()
+
+	if r.summary != nil && clock.Since(r.summaryAt) < maxStaleness {
+		return *r.summary
+	}
+
+	m, err := r.Merged()
+	if err != nil {
+		return SummarySnapshot{}
+	}
+
+	r.summary = &SummarySnapshot{
+		P50:    m.LatencyAtQuantile(50),
+		P90:    m.LatencyAtQuantile(90),
+		P99:    m.LatencyAtQuantile(99),
+		Max:    time.Duration(m.h.Max()) * clock.Microsecond,
+		Count:  m.h.TotalCount(),
+		merged: m,
+	}
+	r.summaryAt = clock.Now()
+	return *r.summary
+}
+
+func (r *RollingHDRHistogram) invalidateSummary() {
+	r.summaryLock.Lock()
+	r.summary = nil
+	r.summaryLock.Unlock()
+}
+
 func (r *RollingHDRHistogram) getHist() *HDRHistogram {
-	if clock.Now().UTC().Sub(r.lastRoll) >= r.period {
+	if clock.Since(r.lastRoll) >= r.period {
 		r.rotate()
-		r.lastRoll = clock.Now().UTC()
+		r.lastRoll = clock.Now()
 	}
 	return r.buckets[r.idx]
 }
@@ -2,6 +2,7 @@ package memmetrics
 
 import (
 	"testing"
+	"time"
 
 	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/stretchr/testify/assert"
@@ -119,6 +120,78 @@ func TestHDRHistogram_Reset(t *testing.T) {
 	assert.EqualValues(t, 5, m.ValueAtQuantile(100))
 }
 
+func TestRollingHDRHistogram_Summary(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	h, err := NewRollingHDRHistogram(1, 3600000000, 2, 10*clock.Second, 6)
+	require.NoError(t, err)
+
+	for i := 1; i <= 100; i++ {
+		require.NoError(t, h.RecordLatencies(time.Duration(i)*clock.Millisecond, 1))
+	}
+
+	s := h.Summary(clock.Second)
+	assert.EqualValues(t, 100, s.Count)
+	assert.InDelta(t, 50*clock.Millisecond, s.P50, float64(clock.Millisecond))
+	assert.InDelta(t, 90*clock.Millisecond, s.P90, float64(clock.Millisecond))
+	assert.InDelta(t, 99*clock.Millisecond, s.P99, float64(clock.Millisecond))
+	assert.InDelta(t, 100*clock.Millisecond, s.Max, float64(clock.Millisecond))
+	assert.Equal(t, s.P90, s.LatencyAtQuantile(90))
+
+	// The summary computed in the same instant may miss the latency.
+	require.NoError(t, h.RecordLatencies(clock.Second, 1))
+	assert.EqualValues(t, 100, h.Summary(clock.Second).Count)
+
+	clock.Advance(500 * clock.Millisecond)
+	assert.EqualValues(t, 100, h.Summary(clock.Second).Count)
+
+	// It is included once the summary is maxStaleness old.
+	clock.Advance(500 * clock.Millisecond)
+	s = h.Summary(clock.Second)
+	assert.EqualValues(t, 101, s.Count)
+	assert.InDelta(t, clock.Second, s.Max, float64(10*clock.Millisecond))
+
+	// A zero staleness computes the summary every time.
+	require.NoError(t, h.RecordLatencies(clock.Second, 1))
+	assert.EqualValues(t, 102, h.Summary(0).Count)
+}
+
+func TestRollingHDRHistogram_Summary_rotation(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	h, err := NewRollingHDRHistogram(1, 3600000000, 2, clock.Second, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, h.RecordLatencies(5*clock.Millisecond, 1))
+	assert.EqualValues(t, 1, h.Summary(clock.Minute).Count)
+
+	clock.Advance(clock.Second)
+	require.NoError(t, h.RecordLatencies(2*clock.Millisecond, 1))
+	assert.EqualValues(t, 2, h.Summary(clock.Minute).Count)
+
+	// The rotation drops the first latency, and the cached summary.
+	clock.Advance(clock.Second)
+	require.NoError(t, h.RecordLatencies(clock.Millisecond, 1))
+
+	s := h.Summary(clock.Minute)
+	assert.EqualValues(t, 2, s.Count)
+	assert.InDelta(t, 2*clock.Millisecond, s.Max, float64(100*clock.Microsecond))
+}
+
+func TestRollingHDRHistogram_Summary_Reset(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	h, err := NewRollingHDRHistogram(1, 3600000000, 2, clock.Second, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, h.RecordLatencies(5*clock.Millisecond, 1))
+	assert.EqualValues(t, 1, h.Summary(clock.Minute).Count)
+
+	h.Reset()
+	assert.Zero(t, h.Summary(clock.Minute).Count)
+	assert.Zero(t, h.Summary(clock.Minute).Max)
+}
+
 func TestHDRHistogram_Export_returnsNewCopy(t *testing.T) {
 	// Create HDRHistogram instance
 	a := HDRHistogram{
@@ -1,5 +1,10 @@
 package memmetrics
 
+import (
+	"errors"
+	"fmt"
+)
+
 // RTOption represents an option you can pass to NewRTMetrics.
 type RTOption func(r *RTMetrics) error
 
@@ -19,5 +24,29 @@ func RTHistogram(fn NewRollingHistogramFn) RTOption {
 	}
 }
 
+// RTErrorClassifier sets the function deciding whether a response is a network error, see RecordError.
+// By default, the 502 and 504 responses and the responses with an error are network errors.
+func RTErrorClassifier(fn ErrorClassifier) RTOption {
+	return func(r *RTMetrics) error {
+		if fn == nil {
+			return errors.New("error classifier can't be nil")
+		}
+		r.isNetworkError = fn
+		return nil
+	}
+}
+
 // RatioOption represents an option you can pass to NewRatioCounter.
 type RatioOption func(r *RatioCounter) error
+
+// MinSamples requires a TotalCount and a WindowTotal of n observations for the RatioCounter to be ready, see RatioCounter.IsReady.
+// The ratios of a few observations, e.g. of a server receiving little traffic, are not trusted.
+func MinSamples(n int64) RatioOption {
+	return func(r *RatioCounter) error {
+		if n < 0 {
+			return fmt.Errorf("invalid min samples: %d", n)
+		}
+		r.minSamples = n
+		return nil
+	}
+}
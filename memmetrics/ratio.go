@@ -6,6 +6,11 @@ import "time"
 type RatioCounter struct {
 	a *RollingCounter
 	b *RollingCounter
+
+	// total is the number of observations since the creation or the reset of the counter.
+	total int64
+	// minSamples is the number of observations in the window required to be ready, see MinSamples.
+	minSamples int64
 }
 
 // NewRatioCounter creates a new RatioCounter.
@@ -37,11 +42,21 @@ func NewRatioCounter(buckets int, resolution time.Duration, options ...RatioOpti
 func (r *RatioCounter) Reset() {
 	r.a.Reset()
 	r.b.Reset()
+	r.total = 0
 }
 
-// IsReady returns true if the counter is ready.
+// IsReady returns true if the counter is ready: the buckets of a window have been filled,
+// and with MinSamples(n), both TotalCount and WindowTotal are at least n.
+// The WindowTotal condition keeps the counter not ready after an idle period has rotated out the observations
+// of the window, see Ratio. Without MinSamples, the counter stays ready once the buckets have been filled.
 func (r *RatioCounter) IsReady() bool {
-	return r.a.countedBuckets+r.b.countedBuckets >= len(r.a.values)
+	if r.a.countedBuckets+r.b.countedBuckets < len(r.a.values) {
+		return false
+	}
+	if r.minSamples == 0 {
+		return true
+	}
+	return r.TotalCount() >= r.minSamples && r.WindowTotal() >= r.minSamples
 }
 
 // CountA gets count A.
@@ -54,6 +69,22 @@ func (r *RatioCounter) CountB() int64 {
 	return r.b.Count()
 }
 
+// Counts returns the counts A and B of the window.
+func (r *RatioCounter) Counts() (a, b int64) {
+	return r.a.Count(), r.b.Count()
+}
+
+// TotalCount returns the number of observations since the creation or the last reset of the counter,
+// including the ones rotated out of the window.
+func (r *RatioCounter) TotalCount() int64 {
+	return r.total
+}
+
+// WindowTotal returns the number of observations in the window, on which the ratio is computed.
+func (r *RatioCounter) WindowTotal() int64 {
+	return r.a.Count() + r.b.Count()
+}
+
 // Resolution gets resolution.
 func (r *RatioCounter) Resolution() time.Duration {
 	return r.a.Resolution()
@@ -75,6 +106,9 @@ func (r *RatioCounter) ProcessedCount() int64 {
 }
 
 // Ratio gets ratio.
+// It is computed on the observations of the window only: after an idle period, the buckets of the denominator
+// have been rotated out, and a single observation A gives a ratio of 1.
+// Such ratios can be detected by comparing WindowTotal to TotalCount, or excluded from IsReady with MinSamples.
 func (r *RatioCounter) Ratio() float64 {
 	a := r.a.Count()
 	b := r.b.Count()
@@ -88,11 +122,13 @@ func (r *RatioCounter) Ratio() float64 {
 // IncA increments counter A.
 func (r *RatioCounter) IncA(v int) {
 	r.a.Inc(v)
+	r.total += int64(v)
 }
 
 // IncB increments counter B.
 func (r *RatioCounter) IncB(v int) {
 	r.b.Inc(v)
+	r.total += int64(v)
 }
 
 // TestMeter a test meter.
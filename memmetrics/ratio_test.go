@@ -178,3 +178,47 @@ func TestRatioCounter_Reset(t *testing.T) {
 	assert.True(t, fr.IsReady())
 	assert.Equal(t, 1.0, fr.Ratio())
 }
+
+func TestRatioCounter_minSamples(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	fr, err := NewRatioCounter(1, clock.Second, MinSamples(10))
+	require.NoError(t, err)
+
+	fr.IncA(1)
+	fr.IncB(4)
+	assert.False(t, fr.IsReady())
+
+	fr.IncB(5)
+	assert.True(t, fr.IsReady())
+	assert.InDelta(t, 0.1, fr.Ratio(), 0.0001)
+
+	a, b := fr.Counts()
+	assert.Equal(t, int64(1), a)
+	assert.Equal(t, int64(9), b)
+	assert.Equal(t, int64(10), fr.TotalCount())
+	assert.Equal(t, int64(10), fr.WindowTotal())
+
+	_, err = NewRatioCounter(1, clock.Second, MinSamples(-1))
+	require.Error(t, err)
+}
+
+func TestRatioCounter_minSamplesAfterInactivity(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	fr, err := NewRatioCounter(2, clock.Second, MinSamples(3))
+	require.NoError(t, err)
+
+	fr.IncB(2)
+	clock.Advance(clock.Second)
+	fr.IncB(2)
+	assert.True(t, fr.IsReady())
+
+	// The denominator has been rotated out: the single observation is not trusted.
+	clock.Advance(100 * clock.Second)
+	fr.IncA(1)
+	assert.Equal(t, 1.0, fr.Ratio())
+	assert.Equal(t, int64(1), fr.WindowTotal())
+	assert.Equal(t, int64(5), fr.TotalCount())
+	assert.False(t, fr.IsReady())
+}
@@ -18,6 +18,10 @@ type NewCounterFn func() (*RollingCounter, error)
 // NewRollingHistogramFn builder function type.
 type NewRollingHistogramFn func() (*RollingHDRHistogram, error)
 
+// ErrorClassifier returns true if the response with the status code is a network error.
+// err is the error that caused the response, if known (e.g. an upstream error of the forwarder).
+type ErrorClassifier func(code int, err error) bool
+
 // RTMetrics provides aggregated performance metrics for HTTP requests processing
 // such as round trip latency, response codes counters network error and total requests.
 // all counters are collected as rolling window counters with defined precision, histograms
@@ -33,6 +37,8 @@ type RTMetrics struct {
 
 	newCounter NewCounterFn
 	newHist    NewRollingHistogramFn
+
+	isNetworkError ErrorClassifier
 }
 
 // NewRTMetrics returns new instance of metrics collector.
@@ -53,6 +59,10 @@ func NewRTMetrics(settings ...RTOption) (*RTMetrics, error) {
 		}
 	}
 
+	if m.isNetworkError == nil {
+		m.isNetworkError = isNetworkError
+	}
+
 	if m.newHist == nil {
 		m.newHist = func() (*RollingHDRHistogram, error) {
 			return NewRollingHDRHistogram(histMin, histMax, histSignificantFigures, histPeriod, histBuckets)
@@ -102,6 +112,7 @@ func (m *RTMetrics) Export() *RTMetrics {
 	}
 	export.newCounter = m.newCounter
 	export.newHist = m.newHist
+	export.isNetworkError = m.isNetworkError
 
 	return export
 }
@@ -111,8 +122,11 @@ func (m *RTMetrics) CounterWindowSize() time.Duration {
 	return m.total.WindowSize()
 }
 
-// NetworkErrorRatio calculates the amont of network errors such as time outs and dropped connection
+// NetworkErrorRatio calculates the amount of network errors such as time outs and dropped connection
 // that occurred in the given time window compared to the total requests count.
+// The network errors are decided by the ErrorClassifier (see RTErrorClassifier): by default,
+// the responses recorded with an error and the 502 and 504 responses, but not the other 5xx responses,
+// so that a backend answering 500 does not count as unreachable.
 func (m *RTMetrics) NetworkErrorRatio() float64 {
 	if m.total.Count() == 0 {
 		return 0
@@ -176,19 +190,40 @@ func (m *RTMetrics) Append(other *RTMetrics) error {
 
 // Record records a metric.
 func (m *RTMetrics) Record(code int, duration time.Duration) {
+	m.RecordError(code, duration, nil)
+}
+
+// RecordError records a metric, err is the error that caused the response, if any.
+// Whether the response is a network error is decided by the ErrorClassifier (see RTErrorClassifier).
+func (m *RTMetrics) RecordError(code int, duration time.Duration, err error) {
 	m.total.Inc(1)
-	if code == http.StatusGatewayTimeout || code == http.StatusBadGateway {
+	if m.isNetworkError(code, err) {
 		m.netErrors.Inc(1)
 	}
 	_ = m.recordStatusCode(code)
 	_ = m.recordLatency(duration)
 }
 
+// RecordWithError records a metric as RecordError, with the arguments in the order of the v1 API.
+func (m *RTMetrics) RecordWithError(code int, err error, duration time.Duration) {
+	m.RecordError(code, duration, err)
+}
+
+func isNetworkError(code int, err error) bool {
+	return err != nil || code == http.StatusGatewayTimeout || code == http.StatusBadGateway
+}
+
 // TotalCount returns total count of processed requests collected.
 func (m *RTMetrics) TotalCount() int64 {
 	return m.total.Count()
 }
 
+// IsReady returns true when the requests have been counted over the whole window of the counters,
+// so that the ratios are not computed from a handful of requests (see RatioCounter.IsReady).
+func (m *RTMetrics) IsReady() bool {
+	return m.total.CountedBuckets() >= m.total.Buckets()
+}
+
 // NetworkErrorCount returns total count of processed requests observed.
 func (m *RTMetrics) NetworkErrorCount() int64 {
 	return m.netErrors.Count()
@@ -214,6 +249,14 @@ func (m *RTMetrics) LatencyHistogram() (*HDRHistogram, error) {
 	return m.histogram.Merged()
 }
 
+// LatencySummary returns the percentiles of the latencies observed, computed at most once per maxStaleness.
+// It is cheaper than LatencyHistogram on the hot path, see RollingHDRHistogram.Summary.
+func (m *RTMetrics) LatencySummary(maxStaleness time.Duration) SummarySnapshot {
+	m.histogramLock.RLock()
+	defer m.histogramLock.RUnlock()
+	return m.histogram.Summary(maxStaleness)
+}
+
 // Reset reset metrics.
 func (m *RTMetrics) Reset() {
 	m.statusCodesLock.Lock()
@@ -1,6 +1,8 @@
 package memmetrics
 
 import (
+	"errors"
+	"net/http"
 	"runtime"
 	"sync"
 	"testing"
@@ -92,6 +94,31 @@ func TestRTMetrics_concurrentRecords(t *testing.T) {
 	}
 }
 
+func TestRTMetrics_concurrentSummary(t *testing.T) {
+	rr, err := NewRTMetrics()
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = rr.recordLatency(time.Duration(j) * time.Millisecond)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = rr.LatencySummary(time.Duration(j%3) * time.Microsecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 800, rr.LatencySummary(0).Count)
+}
+
 func TestRTMetric_Export_returnsNewCopy(t *testing.T) {
 	a := RTMetrics{
 		statusCodes:     map[int]*RollingCounter{},
@@ -148,3 +175,93 @@ func TestRTMetric_Export_returnsNewCopy(t *testing.T) {
 		}
 	}
 }
+
+func TestRTMetrics_errorClassifier(t *testing.T) {
+	m, err := NewRTMetrics()
+	require.NoError(t, err)
+
+	m.RecordError(http.StatusBadGateway, time.Second, nil)
+	m.RecordError(http.StatusOK, time.Second, errors.New("upstream error"))
+	m.Record(http.StatusOK, time.Second)
+	assert.Equal(t, int64(2), m.NetworkErrorCount())
+
+	m.RecordWithError(http.StatusOK, errors.New("upstream error"), time.Second)
+	m.RecordWithError(http.StatusInternalServerError, nil, time.Second)
+	assert.Equal(t, int64(3), m.NetworkErrorCount())
+	assert.Equal(t, int64(5), m.TotalCount())
+
+	m, err = NewRTMetrics(RTErrorClassifier(func(_ int, err error) bool {
+		return err != nil
+	}))
+	require.NoError(t, err)
+
+	m.RecordError(http.StatusBadGateway, time.Second, nil)
+	m.RecordError(http.StatusBadGateway, time.Second, errors.New("upstream error"))
+	assert.Equal(t, int64(1), m.NetworkErrorCount())
+
+	// The classifier is kept by the export.
+	out := m.Export()
+	out.RecordError(http.StatusGatewayTimeout, time.Second, nil)
+	assert.Equal(t, int64(1), out.NetworkErrorCount())
+
+	_, err = NewRTMetrics(RTErrorClassifier(nil))
+	require.Error(t, err)
+}
+
+func TestRTMetrics_IsReady(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	rr, err := NewRTMetrics()
+	require.NoError(t, err)
+
+	// The counters have 10 buckets of 1s.
+	for i := 0; i < 9; i++ {
+		rr.Record(http.StatusOK, time.Millisecond)
+		rr.Record(http.StatusOK, time.Millisecond)
+		assert.False(t, rr.IsReady())
+		clock.Advance(clock.Second)
+	}
+
+	rr.Record(http.StatusOK, time.Millisecond)
+	assert.True(t, rr.IsReady())
+
+	rr.Reset()
+	assert.False(t, rr.IsReady())
+}
+
+func newBenchmarkRTMetrics(b *testing.B) *RTMetrics {
+	b.Helper()
+
+	rr, err := NewRTMetrics()
+	require.NoError(b, err)
+	for i := 0; i < 10000; i++ {
+		rr.Record(http.StatusOK, time.Duration(i%1000)*time.Millisecond)
+	}
+	return rr
+}
+
+// BenchmarkRTMetrics_LatencyHistogram measures the latency check of the circuit breaker merging the histogram every time.
+func BenchmarkRTMetrics_LatencyHistogram(b *testing.B) {
+	rr := newBenchmarkRTMetrics(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h, err := rr.LatencyHistogram()
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = h.LatencyAtQuantile(99)
+	}
+}
+
+// BenchmarkRTMetrics_LatencySummary measures the latency check of the circuit breaker reading the cached summary.
+func BenchmarkRTMetrics_LatencySummary(b *testing.B) {
+	rr := newBenchmarkRTMetrics(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = rr.LatencySummary(100 * time.Millisecond).P99
+	}
+}
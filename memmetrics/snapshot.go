@@ -0,0 +1,169 @@
+package memmetrics
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// CounterSnapshot is the JSON-serializable state of a RollingCounter.
+type CounterSnapshot struct {
+	Resolution     time.Duration `json:"resolution"`
+	Values         []int         `json:"values"`
+	CountedBuckets int           `json:"countedBuckets"`
+	LastBucket     int           `json:"lastBucket"`
+	LastUpdated    time.Time     `json:"lastUpdated"`
+}
+
+// Snapshot returns the state of the counter.
+func (c *RollingCounter) Snapshot() CounterSnapshot {
+	c.cleanup()
+	values := make([]int, len(c.values))
+	copy(values, c.values)
+	return CounterSnapshot{
+		Resolution:     c.resolution,
+		Values:         values,
+		CountedBuckets: c.countedBuckets,
+		LastBucket:     c.lastBucket,
+		LastUpdated:    c.lastUpdated,
+	}
+}
+
+// NewCounterFromSnapshot creates a counter with the state of the snapshot.
+// The times of the snapshot are absolute: the buckets older than the window are dropped on the next use.
+func NewCounterFromSnapshot(s CounterSnapshot) (*RollingCounter, error) {
+	c, err := NewCounter(len(s.Values), s.Resolution)
+	if err != nil {
+		return nil, err
+	}
+	if s.LastBucket < -1 || s.LastBucket >= len(s.Values) {
+		return nil, fmt.Errorf("last bucket %d out of range", s.LastBucket)
+	}
+	copy(c.values, s.Values)
+	c.countedBuckets = s.CountedBuckets
+	c.lastBucket = s.LastBucket
+	c.lastUpdated = s.LastUpdated
+	return c, nil
+}
+
+// HistogramSnapshot is the JSON-serializable state of a RollingHDRHistogram.
+type HistogramSnapshot struct {
+	Index    int                      `json:"index"`
+	LastRoll time.Time                `json:"lastRoll"`
+	Period   time.Duration            `json:"period"`
+	Low      int64                    `json:"low"`
+	High     int64                    `json:"high"`
+	SigFigs  int                      `json:"sigFigs"`
+	Buckets  []*hdrhistogram.Snapshot `json:"buckets"`
+}
+
+// Snapshot returns the state of the histogram.
+func (r *RollingHDRHistogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Index:    r.idx,
+		LastRoll: r.lastRoll.UTC(),
+		Period:   r.period,
+		Low:      r.low,
+		High:     r.high,
+		SigFigs:  r.sigfigs,
+		Buckets:  make([]*hdrhistogram.Snapshot, len(r.buckets)),
+	}
+	for i, b := range r.buckets {
+		s.Buckets[i] = b.h.Export()
+	}
+	return s
+}
+
+// NewRollingHDRHistogramFromSnapshot creates a histogram with the state of the snapshot.
+func NewRollingHDRHistogramFromSnapshot(s HistogramSnapshot) (*RollingHDRHistogram, error) {
+	if len(s.Buckets) == 0 {
+		return nil, errors.New("histogram snapshot has no buckets")
+	}
+	if s.Index < 0 || s.Index >= len(s.Buckets) {
+		return nil, fmt.Errorf("histogram index %d out of range", s.Index)
+	}
+
+	r, err := NewRollingHDRHistogram(s.Low, s.High, s.SigFigs, s.Period, len(s.Buckets))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, b := range s.Buckets {
+		if b == nil || b.LowestTrackableValue != s.Low || b.HighestTrackableValue != s.High || b.SignificantFigures != int64(s.SigFigs) {
+			return nil, fmt.Errorf("histogram bucket %d does not match the histogram settings", i)
+		}
+		r.buckets[i].h = hdrhistogram.Import(b)
+	}
+	r.idx = s.Index
+	r.lastRoll = s.LastRoll
+	return r, nil
+}
+
+// RTMetricsSnapshot is the JSON-serializable state of a RTMetrics,
+// e.g. to hand the metrics over to another process.
+type RTMetricsSnapshot struct {
+	Total       CounterSnapshot         `json:"total"`
+	NetErrors   CounterSnapshot         `json:"netErrors"`
+	StatusCodes map[int]CounterSnapshot `json:"statusCodes"`
+	Histogram   HistogramSnapshot       `json:"histogram"`
+}
+
+// Snapshot returns the state of the metrics.
+func (m *RTMetrics) Snapshot() RTMetricsSnapshot {
+	m.statusCodesLock.RLock()
+	defer m.statusCodesLock.RUnlock()
+	m.histogramLock.RLock()
+	defer m.histogramLock.RUnlock()
+
+	s := RTMetricsSnapshot{
+		Total:       m.total.Snapshot(),
+		NetErrors:   m.netErrors.Snapshot(),
+		StatusCodes: make(map[int]CounterSnapshot, len(m.statusCodes)),
+		Histogram:   m.histogram.Snapshot(),
+	}
+	for code, c := range m.statusCodes {
+		s.StatusCodes[code] = c.Snapshot()
+	}
+	return s
+}
+
+// Restore replaces the state of the metrics with the state of the snapshot.
+// The settings of the metrics (e.g. the ErrorClassifier) are kept.
+func (m *RTMetrics) Restore(s RTMetricsSnapshot) error {
+	total, err := NewCounterFromSnapshot(s.Total)
+	if err != nil {
+		return fmt.Errorf("total: %w", err)
+	}
+
+	netErrors, err := NewCounterFromSnapshot(s.NetErrors)
+	if err != nil {
+		return fmt.Errorf("network errors: %w", err)
+	}
+
+	statusCodes := make(map[int]*RollingCounter, len(s.StatusCodes))
+	for code, cs := range s.StatusCodes {
+		c, errCounter := NewCounterFromSnapshot(cs)
+		if errCounter != nil {
+			return fmt.Errorf("status code %d: %w", code, errCounter)
+		}
+		statusCodes[code] = c
+	}
+
+	hist, err := NewRollingHDRHistogramFromSnapshot(s.Histogram)
+	if err != nil {
+		return fmt.Errorf("histogram: %w", err)
+	}
+
+	m.statusCodesLock.Lock()
+	defer m.statusCodesLock.Unlock()
+	m.histogramLock.Lock()
+	defer m.histogramLock.Unlock()
+
+	m.total = total
+	m.netErrors = netErrors
+	m.statusCodes = statusCodes
+	m.histogram = hist
+	return nil
+}
@@ -0,0 +1,68 @@
+package memmetrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestRTMetrics_snapshot(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	m, err := NewRTMetrics()
+	require.NoError(t, err)
+
+	m.Record(http.StatusOK, time.Second)
+	clock.Advance(clock.Second)
+	m.Record(http.StatusBadGateway, 2*time.Second)
+	m.Record(http.StatusOK, 3*time.Second)
+
+	data, err := json.Marshal(m.Snapshot())
+	require.NoError(t, err)
+
+	var s RTMetricsSnapshot
+	require.NoError(t, json.Unmarshal(data, &s))
+
+	restored, err := NewRTMetrics()
+	require.NoError(t, err)
+	require.NoError(t, restored.Restore(s))
+
+	assert.Equal(t, int64(3), restored.TotalCount())
+	assert.Equal(t, int64(1), restored.NetworkErrorCount())
+	assert.Equal(t, map[int]int64{http.StatusOK: 2, http.StatusBadGateway: 1}, restored.StatusCodesCounts())
+
+	h, err := m.LatencyHistogram()
+	require.NoError(t, err)
+	rh, err := restored.LatencyHistogram()
+	require.NoError(t, err)
+	assert.Equal(t, h.LatencyAtQuantile(100), rh.LatencyAtQuantile(100))
+	assert.Equal(t, h.LatencyAtQuantile(50), rh.LatencyAtQuantile(50))
+
+	// The restored counters roll over as the original ones.
+	clock.Advance(counterResolution * counterBuckets)
+	assert.Equal(t, m.TotalCount(), restored.TotalCount())
+	assert.Equal(t, int64(0), restored.TotalCount())
+}
+
+func TestRTMetrics_restoreInvalid(t *testing.T) {
+	m, err := NewRTMetrics()
+	require.NoError(t, err)
+
+	s := m.Snapshot()
+	s.Histogram.Buckets = nil
+	require.Error(t, m.Restore(s))
+
+	s = m.Snapshot()
+	s.Total.Resolution = 0
+	require.Error(t, m.Restore(s))
+
+	s = m.Snapshot()
+	s.Total.LastBucket = len(s.Total.Values)
+	require.Error(t, m.Restore(s))
+}
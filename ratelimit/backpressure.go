@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// DefaultMaxPenalty is the default maximum penalty of a source, see MaxPenalty.
+const DefaultMaxPenalty = time.Minute
+
+// defaultBackpressureStatuses are the upstream status codes applying the backpressure, see BackpressureStatuses.
+var defaultBackpressureStatuses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+
+// BackpressureError is returned when a source is rejected locally, during the penalty set by the upstream,
+// see BackpressureFromUpstream.
+type BackpressureError struct {
+	Delay time.Duration
+}
+
+func (e *BackpressureError) Error() string {
+	return fmt.Sprintf("upstream backpressure: retry-in %v", e.Delay)
+}
+
+// SourceState is a snapshot of the state of a source, see (*TokenLimiter).SourceState.
+type SourceState struct {
+	// Available is the number of tokens available in the bucket of each period,
+	// or the number of requests that can be admitted in the window of the SlidingWindowLog rates.
+	Available map[time.Duration]int64
+	// PenaltyUntil is the end of the penalty of the source, the zero time if it has none, see BackpressureFromUpstream.
+	PenaltyUntil time.Time
+}
+
+// SourceState returns the state of the source, if it is tracked.
+func (tl *TokenLimiter) SourceState(source string) (SourceState, bool) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	bucketSetI, exists := tl.bucketSets.Get(source)
+	if !exists {
+		return SourceState{}, false
+	}
+	bucketSet := bucketSetI.(*TokenBucketSet)
+
+	state := SourceState{Available: make(map[time.Duration]int64, len(bucketSet.buckets)+len(bucketSet.windows))}
+	for period, bucket := range bucketSet.buckets {
+		bucket.updateAvailableTokens()
+		state.Available[period] = bucket.availableTokens
+	}
+	for period, window := range bucketSet.windows {
+		state.Available[period] = window.available()
+	}
+	if clock.Now().Before(bucketSet.penaltyUntil) {
+		state.PenaltyUntil = bucketSet.penaltyUntil
+	}
+	return state, true
+}
+
+// checkPenalty returns a BackpressureError if the source is in a penalty. It must be called with the mutex held.
+func checkPenalty(bucketSet *TokenBucketSet) error {
+	if remaining := bucketSet.penaltyUntil.Sub(clock.Now()); remaining > 0 {
+		return &BackpressureError{Delay: remaining}
+	}
+	return nil
+}
+
+// observeUpstream applies the backpressure of the upstream response to the bucket set of the source:
+// a 429, or another backpressure status with a Retry-After, drains the buckets,
+// and the Retry-After, capped by the MaxPenalty, sets the penalty of the source.
+func (tl *TokenLimiter) observeUpstream(source string, bucketSet *TokenBucketSet, code int, header http.Header) {
+	now := clock.Now()
+
+	if code >= http.StatusOK && code < http.StatusMultipleChoices {
+		if tl.clearOnSuccess {
+			tl.mutex.Lock()
+			bucketSet.penaltyUntil = clock.Time{}
+			tl.mutex.Unlock()
+		}
+		return
+	}
+
+	if _, ok := tl.backpressureStatuses[code]; !ok {
+		return
+	}
+
+	retryAfter, hasRetryAfter := parseRetryAfter(header.Get("Retry-After"), now)
+	if !hasRetryAfter && code != http.StatusTooManyRequests {
+		return
+	}
+	if retryAfter > tl.maxPenalty {
+		retryAfter = tl.maxPenalty
+	}
+
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	bucketSet.drain()
+
+	until := now.Add(retryAfter)
+	if retryAfter <= 0 || !until.After(bucketSet.penaltyUntil) {
+		return
+	}
+	bucketSet.penaltyUntil = until
+
+	// The bucket set must not expire before the end of the penalty.
+	ttl := bucketSetTTL(bucketSet)
+	if penaltyTTL := int(math.Ceil(retryAfter.Seconds())) + 1; penaltyTTL > ttl {
+		ttl = penaltyTTL
+	}
+	if err := tl.bucketSets.Set(source, bucketSet, ttl); err != nil {
+		tl.log.Error("vulcand/oxy/ratelimit: failed to set the penalty of %q: %v", source, err)
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, in seconds or as an HTTP date.
+func parseRetryAfter(value string, now clock.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > int64(math.MaxInt64/time.Second) {
+			return math.MaxInt64, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := date.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// retryAfterHeader formats a delay as a Retry-After value, rounded up to the second.
+func retryAfterHeader(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
@@ -0,0 +1,257 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// backpressureBackend answers with the status and the Retry-After set for the next request, then 200.
+type backpressureBackend struct {
+	requests   atomic.Int64
+	status     atomic.Int64
+	retryAfter atomic.Pointer[string]
+}
+
+func (b *backpressureBackend) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	b.requests.Add(1)
+
+	if retryAfter := b.retryAfter.Swap(nil); retryAfter != nil {
+		w.Header().Set("Retry-After", *retryAfter)
+	}
+	if status := b.status.Swap(0); status != 0 {
+		w.WriteHeader(int(status))
+		return
+	}
+	_, _ = w.Write([]byte("hello"))
+}
+
+func (b *backpressureBackend) pushBack(status int, retryAfter string) {
+	b.status.Store(int64(status))
+	if retryAfter != "" {
+		b.retryAfter.Store(&retryAfter)
+	}
+}
+
+func newBackpressureLimiter(t *testing.T, backend http.Handler, opts ...TokenLimiterOption) (*TokenLimiter, string) {
+	t.Helper()
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 100, 100))
+
+	l, err := New(backend, headerLimit, rates, append([]TokenLimiterOption{BackpressureFromUpstream(true)}, opts...)...)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	t.Cleanup(srv.Close)
+
+	return l, srv.URL
+}
+
+func TestBackpressure(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	backend := &backpressureBackend{}
+	l, srvURL := newBackpressureLimiter(t, backend)
+
+	backend.pushBack(http.StatusTooManyRequests, "5")
+	re, _, err := testutils.Get(srvURL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, int64(1), backend.requests.Load())
+
+	state, ok := l.SourceState("a")
+	require.True(t, ok)
+	assert.Equal(t, map[time.Duration]int64{clock.Second: 0}, state.Available)
+	assert.Equal(t, clock.Now().Add(5*clock.Second), state.PenaltyUntil)
+
+	// The source is rejected locally during the penalty.
+	clock.Advance(2 * clock.Second)
+	re, body, err := testutils.Get(srvURL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "3", re.Header.Get("Retry-After"))
+	assert.Equal(t, "upstream backpressure: retry-in 3s", string(body))
+	assert.Equal(t, int64(1), backend.requests.Load())
+
+	// Other sources are not affected.
+	re, _, err = testutils.Get(srvURL, testutils.Header("Source", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, int64(2), backend.requests.Load())
+
+	clock.Advance(3 * clock.Second)
+	re, _, err = testutils.Get(srvURL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, int64(3), backend.requests.Load())
+
+	state, ok = l.SourceState("a")
+	require.True(t, ok)
+	assert.True(t, state.PenaltyUntil.IsZero())
+}
+
+func TestBackpressure_statuses(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		status     int
+		retryAfter string
+		// retryAfterDate sends the penalty as an HTTP date.
+		retryAfterDate bool
+		opts           []TokenLimiterOption
+		penalty        time.Duration
+		drained        bool
+	}{
+		{desc: "429 without Retry-After", status: http.StatusTooManyRequests, drained: true},
+		{desc: "503 with Retry-After", status: http.StatusServiceUnavailable, retryAfter: "5", penalty: 5 * clock.Second, drained: true},
+		{desc: "503 without Retry-After", status: http.StatusServiceUnavailable},
+		{desc: "500 with Retry-After", status: http.StatusInternalServerError, retryAfter: "5"},
+		{
+			desc:       "custom statuses",
+			status:     http.StatusInternalServerError,
+			retryAfter: "5",
+			opts:       []TokenLimiterOption{BackpressureStatuses(http.StatusInternalServerError)},
+			penalty:    5 * clock.Second,
+			drained:    true,
+		},
+		{
+			desc:       "max penalty",
+			status:     http.StatusTooManyRequests,
+			retryAfter: "3600",
+			opts:       []TokenLimiterOption{MaxPenalty(10 * clock.Second)},
+			penalty:    10 * clock.Second,
+			drained:    true,
+		},
+		{
+			desc:           "HTTP date",
+			status:         http.StatusTooManyRequests,
+			retryAfterDate: true,
+			penalty:        30 * clock.Second,
+			drained:        true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			testutils.FreezeTime(t)
+
+			backend := &backpressureBackend{}
+			l, srvURL := newBackpressureLimiter(t, backend, test.opts...)
+
+			retryAfter := test.retryAfter
+			if test.retryAfterDate {
+				retryAfter = clock.Now().Add(test.penalty).UTC().Format(http.TimeFormat)
+			}
+			backend.pushBack(test.status, retryAfter)
+
+			re, _, err := testutils.Get(srvURL, testutils.Header("Source", "a"))
+			require.NoError(t, err)
+			assert.Equal(t, test.status, re.StatusCode)
+
+			state, ok := l.SourceState("a")
+			require.True(t, ok)
+			if test.penalty == 0 {
+				assert.True(t, state.PenaltyUntil.IsZero())
+			} else {
+				assert.Equal(t, clock.Now().Add(test.penalty), state.PenaltyUntil)
+			}
+			if test.drained {
+				assert.Equal(t, int64(0), state.Available[clock.Second])
+			} else {
+				assert.Equal(t, int64(99), state.Available[clock.Second])
+			}
+		})
+	}
+}
+
+func TestBackpressure_clearOnSuccess(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	// The slow request is in flight when the penalty starts.
+	release := make(chan struct{})
+	backend := &backpressureBackend{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Slow") != "" {
+			<-release
+		}
+		backend.ServeHTTP(w, req)
+	})
+	l, srvURL := newBackpressureLimiter(t, handler, ClearOnSuccess(true))
+
+	slow := make(chan int)
+	go func() {
+		re, _, err := testutils.Get(srvURL, testutils.Header("Source", "a"), testutils.Header("Slow", "1"))
+		if err != nil {
+			slow <- 0
+			return
+		}
+		slow <- re.StatusCode
+	}()
+
+	require.Eventually(t, func() bool {
+		_, ok := l.SourceState("a")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	backend.pushBack(http.StatusTooManyRequests, "5")
+	re, _, err := testutils.Get(srvURL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	state, _ := l.SourceState("a")
+	assert.False(t, state.PenaltyUntil.IsZero())
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-slow)
+
+	state, _ = l.SourceState("a")
+	assert.True(t, state.PenaltyUntil.IsZero())
+
+	// The buckets drained by the 429 are refilled before the end of the penalty.
+	clock.Advance(clock.Second)
+	re, _, err = testutils.Get(srvURL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+}
+
+func TestBackpressure_disabled(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	backend := &backpressureBackend{}
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 100, 100))
+
+	l, err := New(backend, headerLimit, rates)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	t.Cleanup(srv.Close)
+
+	backend.pushBack(http.StatusTooManyRequests, "5")
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, int64(2), backend.requests.Load())
+}
+
+func TestBackpressure_invalidOptions(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 1, 1))
+
+	_, err := New(nil, headerLimit, rates, MaxPenalty(0))
+	require.Error(t, err)
+
+	_, err = New(nil, headerLimit, rates, BackpressureStatuses(http.StatusTooManyRequests, 1000))
+	require.Error(t, err)
+}
@@ -3,6 +3,8 @@ package ratelimit
 import (
 	"errors"
 	"fmt"
+	"math"
+	"math/bits"
 	"time"
 
 	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
@@ -16,9 +18,14 @@ type rate struct {
 	period  time.Duration
 	average int64
 	burst   int64
+	// algorithm is SlidingWindowLog for the rates added with RateSet.AddSlidingWindow.
+	algorithm RateAlgorithm
 }
 
 func (r *rate) String() string {
+	if r.algorithm == SlidingWindowLog {
+		return fmt.Sprintf("window(%v/%v)", r.average, r.period)
+	}
 	return fmt.Sprintf("rate(%v/%v, burst=%v)", r.average, r.period, r.burst)
 }
 
@@ -26,14 +33,16 @@ func (r *rate) String() string {
 type tokenBucket struct {
 	// The time period controlled by the bucket in nanoseconds.
 	period time.Duration
-	// The number of nanoseconds that takes to add one more token to the total
-	// number of available tokens. It effectively caches the value that could
-	// have been otherwise deduced from refillRate.
-	timePerToken time.Duration
+	// The number of tokens added to the bucket per period.
+	average int64
+	// The fraction of token accumulated since the last refill, expressed in
+	// 1/period units. It is always lower than period.
+	carry uint64
 	// The maximum number of tokens that can be accumulate in the bucket.
 	burst int64
 	// The number of tokens available for consumption at the moment. It can
-	// nether be larger then capacity.
+	// nether be larger then capacity. It is negative when tokens have been
+	// charged beyond the available ones (see charge).
 	availableTokens int64
 	// Tells when tokensAvailable was updated the last time.
 	lastRefresh clock.Time
@@ -50,9 +59,9 @@ func newTokenBucket(rate *rate) *tokenBucket {
 
 	return &tokenBucket{
 		period:          period,
-		timePerToken:    time.Duration(int64(period) / rate.average),
+		average:         rate.average,
 		burst:           rate.burst,
-		lastRefresh:     clock.Now().UTC(),
+		lastRefresh:     clock.Now(),
 		availableTokens: rate.burst,
 	}
 }
@@ -87,13 +96,34 @@ func (tb *tokenBucket) rollback() {
 	tb.lastConsumed = 0
 }
 
+// charge consumes the specified number of tokens even if they are not available:
+// the deficit is carried as a debt, that delays the following consumptions until it is refilled.
+// It cannot be rolled back.
+func (tb *tokenBucket) charge(tokens int64) {
+	if tokens <= 0 {
+		return
+	}
+	tb.updateAvailableTokens()
+	tb.availableTokens -= tokens
+	tb.lastConsumed = 0
+}
+
+// drain empties the bucket, it cannot be rolled back.
+func (tb *tokenBucket) drain() {
+	tb.updateAvailableTokens()
+	if tb.availableTokens > 0 {
+		tb.availableTokens = 0
+	}
+	tb.lastConsumed = 0
+}
+
 // update modifies `average` and `burst` fields of the token bucket according
 // to the provided `Rate`.
 func (tb *tokenBucket) update(rate *rate) error {
 	if rate.period != tb.period {
 		return fmt.Errorf("period mismatch: %v != %v", tb.period, rate.period)
 	}
-	tb.timePerToken = time.Duration(int64(tb.period) / rate.average)
+	tb.average = rate.average
 	tb.burst = rate.burst
 	if tb.availableTokens > rate.burst {
 		tb.availableTokens = rate.burst
@@ -103,31 +133,74 @@ func (tb *tokenBucket) update(rate *rate) error {
 
 // timeTillAvailable returns the number of nanoseconds that we need to
 // wait until the specified number of tokens becomes available for consumption.
+// The result is rounded up, so that the tokens are available once it has elapsed.
 func (tb *tokenBucket) timeTillAvailable(tokens int64) time.Duration {
 	missingTokens := tokens - tb.availableTokens
-	return time.Duration(missingTokens) * tb.timePerToken
+	if missingTokens <= 0 {
+		return 0
+	}
+
+	// The tokens are available when (elapsed*average + carry) / period >= missingTokens.
+	hi, lo := bits.Mul64(uint64(missingTokens), uint64(tb.period))
+	lo, borrow := bits.Sub64(lo, tb.carry, 0)
+	hi -= borrow
+
+	average := uint64(tb.average)
+	if hi >= average {
+		return math.MaxInt64
+	}
+
+	delay, rem := bits.Div64(hi, lo, average)
+	if rem != 0 {
+		delay++
+	}
+	if delay > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
 }
 
 // updateAvailableTokens updates the number of tokens available for consumption.
 // It is calculated based on the refill rate, the time passed since last refresh,
 // and is limited by the bucket capacity.
+// The fraction of token that has not been added yet is carried over to the next refill,
+// so that any rate is honored, whatever its precision.
 func (tb *tokenBucket) updateAvailableTokens() {
-	now := clock.Now().UTC()
-	timePassed := now.Sub(tb.lastRefresh)
+	// The time passed is measured with the monotonic clock, the times restored from a State have none.
+	timePassed := clock.Since(tb.lastRefresh)
+	tb.lastRefresh = tb.lastRefresh.Add(timePassed)
 
-	if tb.timePerToken == 0 {
+	// The clock went backwards: nothing to refill.
+	if timePassed <= 0 {
 		return
 	}
 
-	tokens := tb.availableTokens + int64(timePassed/tb.timePerToken)
-	// If we haven't added any tokens that means that not enough time has passed,
-	// in this case do not adjust last refill checkpoint, otherwise it will be
-	// always moving in time in case of frequent requests that exceed the rate
-	if tokens != tb.availableTokens {
-		tb.lastRefresh = now
-		tb.availableTokens = tokens
+	if tb.availableTokens >= tb.burst {
+		tb.availableTokens = tb.burst
+		tb.carry = 0
+		return
 	}
-	if tb.availableTokens > tb.burst {
+
+	// tokens = (timePassed*average + carry) / period, computed on 128 bits.
+	hi, lo := bits.Mul64(uint64(timePassed), uint64(tb.average))
+	lo, c := bits.Add64(lo, tb.carry, 0)
+	hi += c
+
+	period := uint64(tb.period)
+	if hi >= period {
+		// More tokens than an int64 can hold: the bucket is full.
 		tb.availableTokens = tb.burst
+		tb.carry = 0
+		return
 	}
+
+	tokens, carry := bits.Div64(hi, lo, period)
+	if tokens >= uint64(tb.burst-tb.availableTokens) {
+		tb.availableTokens = tb.burst
+		tb.carry = 0
+		return
+	}
+
+	tb.availableTokens += int64(tokens)
+	tb.carry = carry
 }
@@ -46,6 +46,29 @@ func Test_tokenBucket_consume_singleToken(t *testing.T) {
 	assert.Equal(t, clock.Second, delay)
 }
 
+func Test_tokenBucket_wallClockStep(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	tb := newTokenBucket(&rate{period: clock.Second, average: 1, burst: 2})
+
+	delay, err := tb.consume(2)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+
+	// A step forward of the wall clock does not refill the bucket.
+	clock.StepWall(clock.Hour)
+	delay, err = tb.consume(1)
+	require.NoError(t, err)
+	assert.Equal(t, clock.Second, delay)
+
+	// A step backward does not stop the refill.
+	clock.StepWall(-2 * clock.Hour)
+	clock.Advance(clock.Second)
+	delay, err = tb.consume(1)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+}
+
 func Test_tokenBucket_consume_fastConsumption(t *testing.T) {
 	testutils.FreezeTime(t)
 
@@ -61,14 +84,14 @@ func Test_tokenBucket_consume_fastConsumption(t *testing.T) {
 
 	delay, err = tb.consume(1)
 	require.NoError(t, err)
-	assert.Equal(t, clock.Second, delay)
+	assert.Equal(t, clock.Millisecond*800, delay)
 
 	// Try 700 ms later
 	clock.Advance(clock.Millisecond * 700)
 
 	delay, err = tb.consume(1)
 	require.NoError(t, err)
-	assert.Equal(t, clock.Second, delay)
+	assert.Equal(t, clock.Millisecond*100, delay)
 
 	// Try 100 ms later, success!
 	clock.Advance(clock.Millisecond * 100)
@@ -158,6 +181,118 @@ func Test_tokenBucket_consume_estimate(t *testing.T) {
 	assert.Equal(t, time.Duration(2)*clock.Second, delay)
 }
 
+func Test_tokenBucket_refillPrecision(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		average int64
+	}{
+		{desc: "1/s", average: 1},
+		{desc: "1000/s", average: 1000},
+		{desc: "10^7/s", average: 10_000_000},
+		{desc: "2*10^9/s", average: 2_000_000_000},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			testutils.FreezeTime(t)
+
+			const burst = 1 << 40
+
+			tb := newTokenBucket(&rate{period: clock.Second, average: test.average, burst: burst})
+
+			delay, err := tb.consume(burst)
+			require.NoError(t, err)
+			assert.Equal(t, time.Duration(0), delay)
+
+			var elapsed time.Duration
+			var consumed int64
+			for i := 0; i < 1000; i++ {
+				step := 333*clock.Millisecond + 333*clock.Microsecond + 337*clock.Nanosecond
+				clock.Advance(step)
+				elapsed += step
+
+				delay, err = tb.consume(1)
+				require.NoError(t, err)
+				if delay == 0 {
+					consumed++
+				}
+			}
+
+			tb.updateAvailableTokens()
+
+			expected := float64(elapsed) * float64(test.average) / float64(clock.Second)
+			assert.InDelta(t, expected, float64(tb.availableTokens+consumed), 1)
+		})
+	}
+}
+
+func Test_tokenBucket_timeTillAvailable_roundsUp(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	tb := newTokenBucket(&rate{period: clock.Second, average: 3, burst: 3})
+
+	delay, err := tb.consume(3)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+
+	// 1/3s cannot be represented in nanoseconds.
+	delay, err = tb.consume(1)
+	require.NoError(t, err)
+	assert.Equal(t, 333_333_334*clock.Nanosecond, delay)
+
+	clock.Advance(delay)
+
+	delay, err = tb.consume(1)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+}
+
+func Test_tokenBucket_clockBackwards(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	tb := newTokenBucket(&rate{period: clock.Second, average: 10, burst: 10})
+
+	delay, err := tb.consume(5)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+	assert.Equal(t, int64(5), tb.availableTokens)
+
+	clock.Advance(-5 * clock.Second)
+
+	tb.updateAvailableTokens()
+	assert.Equal(t, int64(5), tb.availableTokens)
+
+	// The refill resumes from the new time.
+	clock.Advance(200 * clock.Millisecond)
+
+	tb.updateAvailableTokens()
+	assert.Equal(t, int64(7), tb.availableTokens)
+}
+
+func Test_tokenBucket_charge(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	tb := newTokenBucket(&rate{period: clock.Second, average: 5, burst: 5})
+
+	tb.charge(10)
+	assert.Equal(t, int64(-5), tb.availableTokens)
+
+	// The charge cannot be rolled back.
+	tb.rollback()
+	assert.Equal(t, int64(-5), tb.availableTokens)
+
+	delay, err := tb.consume(1)
+	require.NoError(t, err)
+	assert.Equal(t, 1200*clock.Millisecond, delay)
+
+	clock.Advance(delay)
+
+	delay, err = tb.consume(1)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+	assert.Equal(t, int64(0), tb.availableTokens)
+}
+
 // If a rate with different period is passed to the `update` method, then an
 // error is returned but the state of the bucket remains valid and unchanged.
 func Test_tokenBucket_update_invalidPeriod(t *testing.T) {
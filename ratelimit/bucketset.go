@@ -8,39 +8,72 @@ import (
 )
 
 // TokenBucketSet represents a set of TokenBucket covering different time periods.
+// The rates enforced with the SlidingWindowLog algorithm are covered by window logs.
 type TokenBucketSet struct {
 	buckets   map[time.Duration]*tokenBucket
+	windows   map[time.Duration]*windowLog
 	maxPeriod time.Duration
+	// algorithm is the algorithm of the rates added with RateSet.Add, see Algorithm.
+	algorithm RateAlgorithm
+	// penaltyUntil is the end of the penalty set by the upstream, see BackpressureFromUpstream.
+	penaltyUntil time.Time
+	// scaleCredit is the fraction of token carried over between the scaled consumptions, see AdaptiveScale.
+	scaleCredit float64
 }
 
 // NewTokenBucketSet creates a `TokenBucketSet` from the specified `rates`.
 func NewTokenBucketSet(rates *RateSet) *TokenBucketSet {
-	tbs := new(TokenBucketSet)
+	return newTokenBucketSet(rates, TokenBucket)
+}
+
+func newTokenBucketSet(rates *RateSet, algorithm RateAlgorithm) *TokenBucketSet {
+	tbs := &TokenBucketSet{algorithm: algorithm}
 	// In the majority of cases we will have only one bucket.
 	tbs.buckets = make(map[time.Duration]*tokenBucket, len(rates.m))
+	tbs.windows = make(map[time.Duration]*windowLog)
 	for _, rate := range rates.m {
-		newBucket := newTokenBucket(rate)
-		tbs.buckets[rate.period] = newBucket
+		tbs.add(rate)
 		tbs.maxPeriod = maxDuration(tbs.maxPeriod, rate.period)
 	}
 	return tbs
 }
 
+// windowed reports whether the rate is enforced with the SlidingWindowLog algorithm.
+func (tbs *TokenBucketSet) windowed(rate *rate) bool {
+	return rate.algorithm == SlidingWindowLog || tbs.algorithm == SlidingWindowLog
+}
+
+func (tbs *TokenBucketSet) add(rate *rate) {
+	if tbs.windowed(rate) {
+		tbs.windows[rate.period] = newWindowLog(rate)
+	} else {
+		tbs.buckets[rate.period] = newTokenBucket(rate)
+	}
+}
+
 // Update brings the buckets in the set in accordance with the provided `rates`.
 func (tbs *TokenBucketSet) Update(rates *RateSet) {
 	// Update existing buckets and delete those that have no corresponding spec.
 	for _, bucket := range tbs.buckets {
-		if rate, ok := rates.m[bucket.period]; ok {
+		if rate, ok := rates.m[bucket.period]; ok && !tbs.windowed(rate) {
 			_ = bucket.update(rate)
 		} else {
 			delete(tbs.buckets, bucket.period)
 		}
 	}
+	for _, window := range tbs.windows {
+		if rate, ok := rates.m[window.period]; ok && tbs.windowed(rate) {
+			_ = window.update(rate)
+		} else {
+			delete(tbs.windows, window.period)
+		}
+	}
 	// Add missing buckets.
 	for _, rate := range rates.m {
-		if _, ok := tbs.buckets[rate.period]; !ok {
-			newBucket := newTokenBucket(rate)
-			tbs.buckets[rate.period] = newBucket
+		_, bucket := tbs.buckets[rate.period]
+		_, window := tbs.windows[rate.period]
+		if !bucket && !window {
+			tbs.add(rate)
 		}
 	}
 	// Identify the maximum period in the set
@@ -48,6 +81,9 @@ func (tbs *TokenBucketSet) Update(rates *RateSet) {
 	for _, bucket := range tbs.buckets {
 		tbs.maxPeriod = maxDuration(tbs.maxPeriod, bucket.period)
 	}
+	for _, window := range tbs.windows {
+		tbs.maxPeriod = maxDuration(tbs.maxPeriod, window.period)
+	}
 }
 
 // Consume consume tokens.
@@ -67,16 +103,93 @@ func (tbs *TokenBucketSet) Consume(tokens int64) (time.Duration, error) {
 			}
 		}
 	}
+	for _, window := range tbs.windows {
+		delay, err := window.consume(tokens)
+		if firstErr == nil {
+			if err != nil {
+				firstErr = err
+			} else {
+				maxDelay = maxDuration(maxDelay, delay)
+			}
+		}
+	}
 	// If we could not make ALL buckets consume tokens for whatever reason,
 	// then rollback consumption for all of them.
 	if firstErr != nil || maxDelay > 0 {
 		for _, tokenBucket := range tbs.buckets {
 			tokenBucket.rollback()
 		}
+		for _, window := range tbs.windows {
+			window.rollback()
+		}
 	}
 	return maxDelay, firstErr
 }
 
+// consumeScaled consumes amount tokens with the rates scaled by factor (see AdaptiveScale),
+// and returns a MaxRateError if they are not available.
+// The rates are scaled by consuming more tokens, the buckets are left untouched.
+func (tbs *TokenBucketSet) consumeScaled(amount int64, factor float64) error {
+	tokens, credit := amount, tbs.scaleCredit
+	if factor < 1 {
+		scaled := float64(amount)/factor + credit
+		tokens = int64(scaled)
+		credit = scaled - float64(tokens)
+
+		// The scaled burst can't hold the request: it is throttled until the scale recovers.
+		if burst, period := tbs.smallestBurst(); tokens > burst && amount <= burst {
+			return &MaxRateError{Delay: period}
+		}
+	}
+
+	delay, err := tbs.Consume(tokens)
+	if err != nil {
+		return err
+	}
+	if delay > 0 {
+		return &MaxRateError{Delay: delay}
+	}
+	tbs.scaleCredit = credit
+	return nil
+}
+
+// Charge consumes tokens from all the buckets, even if they are not available.
+// The buckets lacking tokens go into debt, which delays the next consumptions.
+func (tbs *TokenBucketSet) Charge(tokens int64) {
+	for _, tokenBucket := range tbs.buckets {
+		tokenBucket.charge(tokens)
+	}
+	for _, window := range tbs.windows {
+		window.charge(tokens)
+	}
+}
+
+// drain empties the buckets, the debts are kept.
+func (tbs *TokenBucketSet) drain() {
+	for _, tokenBucket := range tbs.buckets {
+		tokenBucket.drain()
+	}
+	for _, window := range tbs.windows {
+		window.drain()
+	}
+}
+
+// smallestBurst returns the largest amount of tokens that all the rates of the set can hold, and the period of its rate.
+func (tbs *TokenBucketSet) smallestBurst() (int64, time.Duration) {
+	burst, period := int64(-1), time.Duration(0)
+	for _, bucket := range tbs.buckets {
+		if burst < 0 || bucket.burst < burst {
+			burst, period = bucket.burst, bucket.period
+		}
+	}
+	for _, window := range tbs.windows {
+		if burst < 0 || window.limit < burst {
+			burst, period = window.limit, window.period
+		}
+	}
+	return burst, period
+}
+
 // GetMaxPeriod returns the max period.
 func (tbs *TokenBucketSet) GetMaxPeriod() time.Duration {
 	return tbs.maxPeriod
@@ -95,6 +208,15 @@ func (tbs *TokenBucketSet) debugState() string {
 		bucket := tbs.buckets[time.Duration(period)]
 		bucketRepr = append(bucketRepr, fmt.Sprintf("{%v: %v}", bucket.period, bucket.availableTokens))
 	}
+	periods = periods[:0]
+	for period := range tbs.windows {
+		periods = append(periods, int64(period))
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i] < periods[j] })
+	for _, period := range periods {
+		window := tbs.windows[time.Duration(period)]
+		bucketRepr = append(bucketRepr, fmt.Sprintf("{%v: %v/%v}", window.period, window.count, window.limit))
+	}
 	return strings.Join(bucketRepr, ", ")
 }
 
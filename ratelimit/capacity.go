@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"fmt"
+)
+
+// EvictReason is the reason why the bucket set of a source is dropped, see OnEviction.
+type EvictReason int
+
+const (
+	// EvictExpired is the expiry of the bucket set of a source after its TTL of inactivity.
+	EvictExpired EvictReason = iota
+	// EvictCapacity is the eviction of the bucket set of a source to make room for a new source,
+	// when the Capacity is reached: the limits of the source start again from scratch at its next request.
+	EvictCapacity
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictExpired:
+		return "expired"
+	case EvictCapacity:
+		return "capacity"
+	default:
+		return fmt.Sprintf("EvictReason(%d)", int(r))
+	}
+}
+
+// CapacityError is returned for the requests of a new source when the Capacity is reached,
+// see RejectOnCapacityPressure.
+type CapacityError struct {
+	Capacity int
+}
+
+func (c *CapacityError) Error() string {
+	return fmt.Sprintf("capacity reached: %d sources", c.Capacity)
+}
+
+// onExpired is the expiry callback of the bucket sets.
+func (tl *TokenLimiter) onExpired(source string, _ interface{}) {
+	tl.counters.evicted.Add(1)
+	tl.counters.expired.Add(1)
+	if tl.onEviction != nil {
+		tl.onEviction(source, EvictExpired)
+	}
+}
+
+// onEvictedForCapacity is the callback of the bucket sets evicted to make room for new ones.
+func (tl *TokenLimiter) onEvictedForCapacity(source string, _ interface{}) {
+	tl.counters.evicted.Add(1)
+	tl.counters.evictedForCapacity.Add(1)
+	if tl.onEviction != nil {
+		tl.onEviction(source, EvictCapacity)
+	}
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+type eviction struct {
+	source string
+	reason EvictReason
+}
+
+// newFullLimiter returns a limiter of capacity 3 tracking the sources a, b and c, which have all used their single token.
+func newFullLimiter(t *testing.T, opts ...TokenLimiterOption) (*TokenLimiter, *[]eviction) {
+	t.Helper()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(10*clock.Second, 1, 1))
+
+	var evictions []eviction
+	opts = append(opts, Capacity(3), OnEviction(func(source string, reason EvictReason) {
+		evictions = append(evictions, eviction{source: source, reason: reason})
+	}))
+
+	l, err := New(handler, headerLimit, rates, opts...)
+	require.NoError(t, err)
+
+	for _, source := range []string{"a", "b", "c"} {
+		require.Equal(t, http.StatusOK, serve(l, source, 0).Code)
+		clock.Advance(clock.Second)
+	}
+	return l, &evictions
+}
+
+func TestTokenLimiter_capacityEviction(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	l, evictions := newFullLimiter(t)
+
+	// The source closest to its expiry is evicted for the new one, and its limits start again.
+	assert.Equal(t, http.StatusOK, serve(l, "d", 0).Code)
+	assert.Equal(t, []eviction{{source: "a", reason: EvictCapacity}}, *evictions)
+	assert.Equal(t, http.StatusTooManyRequests, serve(l, "b", 0).Code)
+	assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+
+	c := l.Counters()
+	assert.Equal(t, uint64(2), c.BucketSetsEvictedForCapacity)
+	assert.Equal(t, uint64(0), c.BucketSetsExpired)
+	assert.Equal(t, uint64(2), c.BucketSetsEvicted)
+}
+
+func TestTokenLimiter_capacityPrefersExpired(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	l, evictions := newFullLimiter(t)
+
+	// Every bucket set has expired: the oldest one is dropped for its expiry, not evicted.
+	clock.Advance(101 * clock.Second)
+	assert.Equal(t, http.StatusOK, serve(l, "d", 0).Code)
+	assert.Equal(t, []eviction{{source: "a", reason: EvictExpired}}, *evictions)
+
+	c := l.Counters()
+	assert.Equal(t, uint64(1), c.BucketSetsExpired)
+	assert.Equal(t, uint64(0), c.BucketSetsEvictedForCapacity)
+}
+
+func TestTokenLimiter_rejectOnCapacityPressure(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	l, evictions := newFullLimiter(t, RejectOnCapacityPressure(true))
+
+	// The new source is rejected, and the known sources keep their limits.
+	re := serve(l, "d", 0)
+	assert.Equal(t, http.StatusServiceUnavailable, re.Code)
+	assert.Equal(t, (&CapacityError{Capacity: 3}).Error(), re.Body.String())
+	assert.Empty(t, *evictions)
+
+	for _, source := range []string{"a", "b", "c"} {
+		assert.Equal(t, http.StatusTooManyRequests, serve(l, source, 0).Code, source)
+	}
+
+	c := l.Counters()
+	assert.Equal(t, uint64(1), c.RejectedForCapacity)
+	assert.Equal(t, uint64(4), c.Rejected)
+	assert.Equal(t, uint64(3), c.ActiveSources)
+	assert.Equal(t, uint64(0), c.BucketSetsEvicted)
+
+	// Once a bucket set has expired, there is room for the new source.
+	clock.Advance(99 * clock.Second)
+	assert.Equal(t, http.StatusOK, serve(l, "d", 0).Code)
+	assert.Equal(t, []eviction{{source: "a", reason: EvictExpired}}, *evictions)
+}
+
+func TestCapacityError(t *testing.T) {
+	var err error = &CapacityError{Capacity: 3}
+	var caperr *CapacityError
+	require.True(t, errors.As(err, &caperr))
+	assert.Equal(t, "capacity reached: 3 sources", err.Error())
+	assert.Equal(t, "capacity", EvictCapacity.String())
+	assert.Equal(t, "expired", EvictExpired.String())
+}
@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// coalescer decides the concurrent requests of a source together, see DecisionCoalescing.
+type coalescer struct {
+	window   time.Duration
+	maxBatch int
+
+	mu sync.Mutex
+	// batches are the batches of the sources collecting requests, while their first request waits for the mutex of the limiter.
+	batches map[string]*decisionBatch
+	// rejections are the rejections reused for the window, by source.
+	rejections map[string]rejection
+	// concurrent are the last times the sources had concurrent requests.
+	concurrent map[string]clock.Time
+	lastSweep  clock.Time
+}
+
+func newCoalescer(window time.Duration, maxBatch int) *coalescer {
+	return &coalescer{
+		window:     window,
+		maxBatch:   maxBatch,
+		batches:    make(map[string]*decisionBatch),
+		rejections: make(map[string]rejection),
+		concurrent: make(map[string]clock.Time),
+	}
+}
+
+// decisionBatch is a batch of requests of a source, decided together by its first request.
+type decisionBatch struct {
+	amounts []int64
+	done    chan struct{}
+
+	// The outcome: the first admitted requests are admitted, the others are rejected with err.
+	bucketSet *TokenBucketSet
+	admitted  int
+	err       error
+}
+
+// rejection is the rejection of a source reused until the time.
+type rejection struct {
+	until clock.Time
+	err   error
+}
+
+// consume consumes amount tokens for the request of the source, with the concurrent requests of the source.
+// The first request of a batch consumes the tokens of the batch, once it holds the mutex of the limiter:
+// the requests of the source arriving in the meantime join the batch, and wait for its outcome.
+// A request without concurrent requests is decided at once.
+func (c *coalescer) consume(tl *TokenLimiter, req *http.Request, source string, amount int64) (*TokenBucketSet, error) {
+	now := clock.Now()
+
+	c.mu.Lock()
+	c.sweep(now)
+	if r, ok := c.rejections[source]; ok {
+		if now.Before(r.until) {
+			c.mu.Unlock()
+			return nil, r.err
+		}
+		delete(c.rejections, source)
+	}
+
+	if b, ok := c.batches[source]; ok {
+		c.concurrent[source] = now
+		i := len(b.amounts)
+		b.amounts = append(b.amounts, amount)
+		if len(b.amounts) >= c.maxBatch {
+			delete(c.batches, source)
+		}
+		c.mu.Unlock()
+
+		<-b.done
+		if i < b.admitted {
+			return b.bucketSet, nil
+		}
+		return nil, b.err
+	}
+
+	b := &decisionBatch{amounts: []int64{amount}, done: make(chan struct{})}
+	c.batches[source] = b
+	last, hot := c.concurrent[source]
+	hot = hot && now.Sub(last) < c.window
+	c.mu.Unlock()
+
+	// The first request of a source which had concurrent requests lets them join its batch.
+	if hot {
+		runtime.Gosched()
+	}
+
+	tl.decide(req, source, b, c.close(source, b))
+
+	c.reuse(source, b.err, now)
+	close(b.done)
+
+	if b.admitted > 0 {
+		return b.bucketSet, nil
+	}
+	return nil, b.err
+}
+
+// close stops the batch from collecting requests, once its first request holds the mutex of the limiter.
+func (c *coalescer) close(source string, b *decisionBatch) func() []int64 {
+	return func() []int64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.batches[source] == b {
+			delete(c.batches, source)
+		}
+		return b.amounts
+	}
+}
+
+// reuse rejects the requests of the source for the window after the rejection of a batch with a MaxRateError,
+// or until its delay if it is shorter: the tokens are not available before.
+func (c *coalescer) reuse(source string, err error, now clock.Time) {
+	var errRate *MaxRateError
+	if c.window <= 0 || !errors.As(err, &errRate) || errRate.Delay <= 0 {
+		return
+	}
+
+	d := c.window
+	if errRate.Delay < d {
+		d = errRate.Delay
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rejections[source] = rejection{until: now.Add(d), err: err}
+}
+
+// sweep forgets the rejections which are over, and the concurrency older than the window, at most once per window.
+// It must be called with the mutex held.
+func (c *coalescer) sweep(now clock.Time) {
+	if now.Sub(c.lastSweep) < c.window {
+		return
+	}
+	c.lastSweep = now
+
+	for source, r := range c.rejections {
+		if !now.Before(r.until) {
+			delete(c.rejections, source)
+		}
+	}
+	for source, last := range c.concurrent {
+		if now.Sub(last) >= c.window {
+			delete(c.concurrent, source)
+		}
+	}
+}
+
+// decide consumes the tokens of the requests of the batch returned by closeBatch, in their order of arrival,
+// with one acquisition of the mutex. The requests following the first one rejected are rejected with its error,
+// so that the batch never admits more requests than their individual consumptions would have.
+// The rates of the batch are the ones of its first request, see ExtractRates.
+func (tl *TokenLimiter) decide(req *http.Request, source string, b *decisionBatch, closeBatch func() []int64) {
+	factor := tl.scaleFactor()
+
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	amounts := closeBatch()
+
+	b.bucketSet, b.err = tl.bucketSet(req, source)
+	if b.err != nil {
+		return
+	}
+
+	for _, amount := range amounts {
+		if b.err = b.bucketSet.consumeScaled(amount, factor); b.err != nil {
+			return
+		}
+		b.admitted++
+	}
+}
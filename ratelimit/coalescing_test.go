@@ -0,0 +1,231 @@
+package ratelimit
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// countingRates returns a rate extractor counting its calls, one per acquisition of the mutex of the limiter.
+func countingRates(rates *RateSet, calls *atomic.Int64) RateExtractor {
+	return RateExtractorFunc(func(*http.Request) (*RateSet, error) {
+		calls.Add(1)
+		return rates, nil
+	})
+}
+
+// consumeConcurrently consumes amount tokens for n concurrent requests of source, and returns the number admitted.
+func consumeConcurrently(tl *TokenLimiter, source string, n int, amount int64) int {
+	var admitted atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			if _, err := tl.consumeRates(req, source, amount); err == nil {
+				admitted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	return int(admitted.Load())
+}
+
+func TestDecisionCoalescing_batch(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 5, 5))
+
+	var calls atomic.Int64
+	tl, err := New(nil, headerLimit, rates, ExtractRates(countingRates(rates, &calls)), DecisionCoalescing(0, 100))
+	require.NoError(t, err)
+
+	// The first request waits for the mutex, the others join its batch.
+	tl.mutex.Lock()
+	done := make(chan int)
+	go func() { done <- consumeConcurrently(tl, "a", 10, 1) }()
+
+	require.Eventually(t, func() bool {
+		tl.coalescer.mu.Lock()
+		defer tl.coalescer.mu.Unlock()
+		b := tl.coalescer.batches["a"]
+		return b != nil && len(b.amounts) == 10
+	}, 5*time.Second, time.Millisecond)
+	tl.mutex.Unlock()
+
+	assert.Equal(t, 5, <-done)
+	assert.Equal(t, int64(1), calls.Load())
+
+	// Without concurrent requests, the requests are decided one by one.
+	clock.Advance(clock.Second)
+	for i := 0; i < 5; i++ {
+		_, err = tl.consumeRates(httptest.NewRequest(http.MethodGet, "http://localhost", nil), "a", 1)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(6), calls.Load())
+}
+
+func TestDecisionCoalescing_maxBatch(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 100, 100))
+
+	var calls atomic.Int64
+	tl, err := New(nil, headerLimit, rates, ExtractRates(countingRates(rates, &calls)), DecisionCoalescing(0, 4))
+	require.NoError(t, err)
+
+	tl.mutex.Lock()
+
+	// The requests arrive one by one: once a batch is full, the next request starts another one.
+	admitted := make(chan int, 8)
+	var current *decisionBatch
+	for i := 0; i < 8; i++ {
+		go func() { admitted <- consumeConcurrently(tl, "a", 1, 1) }()
+
+		require.Eventually(t, func() bool {
+			tl.coalescer.mu.Lock()
+			defer tl.coalescer.mu.Unlock()
+			if i%4 == 0 {
+				current = tl.coalescer.batches["a"]
+			}
+			return current != nil && len(current.amounts) == i%4+1
+		}, 5*time.Second, time.Millisecond)
+	}
+	tl.mutex.Unlock()
+
+	total := 0
+	for i := 0; i < 8; i++ {
+		total += <-admitted
+	}
+	assert.Equal(t, 8, total)
+	assert.Equal(t, int64(2), calls.Load())
+}
+
+func TestDecisionCoalescing_rejection(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 1, 1))
+
+	var calls atomic.Int64
+	tl, err := New(nil, headerLimit, rates, ExtractRates(countingRates(rates, &calls)), DecisionCoalescing(5*time.Millisecond, 10))
+	require.NoError(t, err)
+
+	consume := func() error {
+		_, err := tl.consumeRates(httptest.NewRequest(http.MethodGet, "http://localhost", nil), "a", 1)
+		return err
+	}
+
+	require.NoError(t, consume())
+
+	var errRate *MaxRateError
+	require.ErrorAs(t, consume(), &errRate)
+	assert.Equal(t, clock.Second, errRate.Delay)
+	assert.Equal(t, int64(2), calls.Load())
+
+	// The rejection is reused for the window.
+	clock.Advance(4 * time.Millisecond)
+	require.ErrorAs(t, consume(), &errRate)
+	assert.Equal(t, clock.Second, errRate.Delay)
+	assert.Equal(t, int64(2), calls.Load())
+
+	clock.Advance(time.Millisecond)
+	require.ErrorAs(t, consume(), &errRate)
+	assert.Equal(t, int64(3), calls.Load())
+
+	// The other sources are not affected.
+	_, err = tl.consumeRates(httptest.NewRequest(http.MethodGet, "http://localhost", nil), "b", 1)
+	require.NoError(t, err)
+}
+
+// The coalesced limiter never admits more requests than the individual one, on random schedules of concurrent requests.
+func TestDecisionCoalescing_randomSchedules(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 50, 20))
+	require.NoError(t, rates.Add(10*clock.Second, 300, 300))
+
+	for seed := int64(1); seed <= 5; seed++ {
+		individual, err := New(nil, headerLimit, rates)
+		require.NoError(t, err)
+		coalesced, err := New(nil, headerLimit, rates, DecisionCoalescing(5*time.Millisecond, 8))
+		require.NoError(t, err)
+
+		rnd := rand.New(rand.NewSource(seed))
+		var individualAdmitted, coalescedAdmitted int
+		for step := 0; step < 200; step++ {
+			clock.Advance(time.Duration(rnd.Intn(50)) * time.Millisecond)
+			n := 1 + rnd.Intn(30)
+
+			for i := 0; i < n; i++ {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+				if _, err := individual.consumeRates(req, "a", 1); err == nil {
+					individualAdmitted++
+				}
+			}
+			coalescedAdmitted += consumeConcurrently(coalesced, "a", n, 1)
+
+			require.LessOrEqual(t, coalescedAdmitted, individualAdmitted, "seed %d, step %d", seed, step)
+		}
+		assert.Positive(t, coalescedAdmitted)
+	}
+}
+
+func TestDecisionCoalescing_invalidOptions(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 1, 1))
+
+	_, err := New(nil, headerLimit, rates, DecisionCoalescing(-time.Millisecond, 10))
+	require.Error(t, err)
+
+	_, err = New(nil, headerLimit, rates, DecisionCoalescing(time.Millisecond, 1))
+	require.Error(t, err)
+}
+
+// BenchmarkTokenLimiter_streams consumes the tokens of 100 concurrent streams per source,
+// and reports the acquisitions of the mutex of the limiter per request.
+func BenchmarkTokenLimiter_streams(b *testing.B) {
+	rates := NewRateSet()
+	require.NoError(b, rates.Add(clock.Second, 1<<40, 1<<40))
+
+	benchmarks := []struct {
+		desc string
+		opts []TokenLimiterOption
+	}{
+		{desc: "individual"},
+		{desc: "coalesced", opts: []TokenLimiterOption{DecisionCoalescing(5*time.Millisecond, 100)}},
+	}
+
+	for _, bench := range benchmarks {
+		b.Run(bench.desc, func(b *testing.B) {
+			var calls atomic.Int64
+			tl, err := New(nil, headerLimit, rates, append(bench.opts, ExtractRates(countingRates(rates, &calls)))...)
+			require.NoError(b, err)
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+
+			b.SetParallelism(100)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, _ = tl.consumeRates(req, "a", 1)
+				}
+			})
+
+			b.ReportMetric(float64(calls.Load())/float64(b.N), "locks/op")
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// ConcurrencyCostFunc returns the number of units a request holds while it is served.
+type ConcurrencyCostFunc func(req *http.Request) int64
+
+// MaxConcurrencyError is returned when the units in flight for a source would exceed the concurrency limit.
+type MaxConcurrencyError struct {
+	Max int64
+}
+
+func (m *MaxConcurrencyError) Error() string {
+	return fmt.Sprintf("max concurrency reached: %d units", m.Max)
+}
+
+// concurrencyLimiter is a weighted semaphore per source.
+// A source is only tracked while it has requests in flight or waiting,
+// so a semaphore is never dropped while it holds units.
+type concurrencyLimiter struct {
+	max     int64
+	cost    ConcurrencyCostFunc
+	maxWait time.Duration
+
+	mu         sync.Mutex
+	semaphores map[string]*semaphore
+}
+
+type semaphore struct {
+	inFlight int64
+	// users is the number of requests in flight or waiting.
+	users int
+	// released is closed and replaced when units are released.
+	released chan struct{}
+}
+
+func newConcurrencyLimiter(maxUnits int64, cost ConcurrencyCostFunc, maxWait time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		max:        maxUnits,
+		cost:       cost,
+		maxWait:    maxWait,
+		semaphores: make(map[string]*semaphore),
+	}
+}
+
+// acquire takes the units of the request, waiting up to maxWait for them to be released by the other requests.
+// The returned function releases the units, waited tells whether the request had to wait for them.
+func (c *concurrencyLimiter) acquire(req *http.Request, source string) (release func(), waited bool, err error) {
+	cost := c.cost(req)
+	if cost <= 0 {
+		return func() {}, false, nil
+	}
+	if cost > c.max {
+		return nil, false, &MaxConcurrencyError{Max: c.max}
+	}
+
+	c.mu.Lock()
+	sem, ok := c.semaphores[source]
+	if !ok {
+		sem = &semaphore{released: make(chan struct{})}
+		c.semaphores[source] = sem
+	}
+	sem.users++
+
+	var timeout <-chan time.Time
+	if c.maxWait > 0 {
+		timer := clock.NewTimer(c.maxWait)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+
+	for sem.inFlight+cost > c.max {
+		if c.maxWait <= 0 {
+			c.leave(source, sem)
+			c.mu.Unlock()
+			return nil, false, &MaxConcurrencyError{Max: c.max}
+		}
+
+		waited = true
+		released := sem.released
+		c.mu.Unlock()
+
+		if err := c.wait(req.Context(), released, timeout); err != nil {
+			c.mu.Lock()
+			c.leave(source, sem)
+			c.mu.Unlock()
+			return nil, waited, err
+		}
+
+		c.mu.Lock()
+	}
+
+	sem.inFlight += cost
+	c.mu.Unlock()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			sem.inFlight -= cost
+			close(sem.released)
+			sem.released = make(chan struct{})
+			c.leave(source, sem)
+		})
+	}
+	return release, waited, nil
+}
+
+// leave forgets the source once it has neither requests in flight nor waiting.
+func (c *concurrencyLimiter) leave(source string, sem *semaphore) {
+	sem.users--
+	if sem.users == 0 {
+		delete(c.semaphores, source)
+	}
+}
+
+func (c *concurrencyLimiter) inFlight(source string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if sem, ok := c.semaphores[source]; ok {
+		return sem.inFlight
+	}
+	return 0
+}
+
+func (c *concurrencyLimiter) wait(ctx context.Context, released <-chan struct{}, timeout <-chan time.Time) error {
+	select {
+	case <-released:
+		return nil
+	case <-timeout:
+		return &MaxConcurrencyError{Max: c.max}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
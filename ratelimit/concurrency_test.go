@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var once sync.Once
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Cost") == "4" {
+			once.Do(func() {
+				close(started)
+				<-unblock
+			})
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	l := newConcurrencyLimited(t, handler)
+
+	done := make(chan int)
+	go func() {
+		done <- serve(l, "a", 4).Code
+	}()
+	<-started
+
+	rw := serve(l, "a", 1)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "4", rw.Header().Get("X-Concurrency-Limit"))
+
+	rw = serve(l, "b", 1)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	close(unblock)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	assert.Zero(t, l.concurrency.inFlight("a"))
+	assert.Empty(t, l.concurrency.semaphores)
+
+	rw = serve(l, "a", 4)
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
+
+func TestConcurrencyLimit_releaseOnPanic(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hel"))
+		panic(http.ErrAbortHandler)
+	})
+
+	l := newConcurrencyLimited(t, handler)
+
+	assert.Panics(t, func() { serve(l, "a", 4) })
+
+	assert.Zero(t, l.concurrency.inFlight("a"))
+	assert.Empty(t, l.concurrency.semaphores)
+}
+
+func TestConcurrencyLimit_wait(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Cost") == "4" {
+			close(started)
+			<-unblock
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	l := newConcurrencyLimited(t, handler, ConcurrencyWait(time.Minute))
+
+	done := make(chan int)
+	go func() {
+		done <- serve(l, "a", 4).Code
+	}()
+	<-started
+
+	waiting := make(chan int)
+	go func() {
+		waiting <- serve(l, "a", 1).Code
+	}()
+
+	select {
+	case <-waiting:
+		t.Fatal("the request should wait for the units to be released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, <-waiting)
+	assert.Empty(t, l.concurrency.semaphores)
+	assert.Equal(t, uint64(1), l.Counters().Delayed)
+}
+
+func TestConcurrencyLimit_costAboveMax(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	l := newConcurrencyLimited(t, handler, ConcurrencyWait(time.Minute))
+
+	rw := serve(l, "a", 5)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+}
+
+func TestConcurrencyLimit_invalidOptions(t *testing.T) {
+	rates := NewRateSet()
+	err := rates.Add(clock.Second, 1, 1)
+	require.NoError(t, err)
+
+	_, err = New(nil, headerLimit, rates, ConcurrencyLimit(0, headerCost))
+	require.Error(t, err)
+
+	_, err = New(nil, headerLimit, rates, ConcurrencyLimit(4, nil))
+	require.Error(t, err)
+
+	_, err = New(nil, headerLimit, rates, ConcurrencyWait(-1))
+	require.Error(t, err)
+}
+
+func newConcurrencyLimited(t *testing.T, handler http.Handler, opts ...TokenLimiterOption) *TokenLimiter {
+	t.Helper()
+
+	rates := NewRateSet()
+	err := rates.Add(clock.Second, 100, 100)
+	require.NoError(t, err)
+
+	l, err := New(handler, headerLimit, rates, append([]TokenLimiterOption{ConcurrencyLimit(4, headerCost)}, opts...)...)
+	require.NoError(t, err)
+
+	return l
+}
+
+func serve(l http.Handler, source string, cost int64) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Source", source)
+	req.Header.Set("Cost", strconv.FormatInt(cost, 10))
+
+	rw := httptest.NewRecorder()
+	l.ServeHTTP(rw, req)
+	return rw
+}
+
+func headerCost(req *http.Request) int64 {
+	cost, _ := strconv.ParseInt(req.Header.Get("Cost"), 10, 64)
+	return cost
+}
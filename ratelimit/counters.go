@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"sync/atomic"
+)
+
+// Counters are the aggregate counters of a TokenLimiter, see (*TokenLimiter).Counters.
+// All the counters but ActiveSources only increase, until ResetCounters is called:
+// they map to OpenMetrics counters, e.g. ratelimit_requests_total.
+type Counters struct {
+	// Requests is the number of requests seen, Requests = Allowed + Rejected.
+	Requests uint64
+	// Allowed is the number of requests passed to the next handler.
+	Allowed uint64
+	// Delayed is the number of allowed requests that waited for concurrency units, see MaxConcurrency.
+	Delayed uint64
+	// Rejected is the number of requests rejected: rate or concurrency limit reached, upstream penalty, or unknown source.
+	Rejected uint64
+	// ActiveSources is the number of sources currently tracked, it is a gauge.
+	ActiveSources uint64
+	// BucketSetsCreated is the number of bucket sets created, one per new source.
+	BucketSetsCreated uint64
+	// BucketSetsEvicted is the number of bucket sets dropped, because they expired or to make room for new ones.
+	BucketSetsEvicted uint64
+	// BucketSetsExpired is the number of bucket sets dropped after their TTL of inactivity, included in BucketSetsEvicted.
+	BucketSetsExpired uint64
+	// BucketSetsEvictedForCapacity is the number of bucket sets dropped to make room for new ones when the Capacity
+	// is reached, included in BucketSetsEvicted: each of them resets the limits of its source.
+	BucketSetsEvictedForCapacity uint64
+	// RejectedForCapacity is the number of requests of new sources rejected because the Capacity is reached,
+	// included in Rejected, see RejectOnCapacityPressure.
+	RejectedForCapacity uint64
+	// StateEntriesSkipped is the number of entries skipped by ImportState:
+	// corrupt, or whose periods do not match the default rates.
+	StateEntriesSkipped uint64
+}
+
+// counters are updated with atomics on the hot path.
+type counters struct {
+	requests atomic.Uint64
+	allowed  atomic.Uint64
+	delayed  atomic.Uint64
+	rejected atomic.Uint64
+	created  atomic.Uint64
+	evicted  atomic.Uint64
+	skipped  atomic.Uint64
+
+	expired             atomic.Uint64
+	evictedForCapacity  atomic.Uint64
+	rejectedForCapacity atomic.Uint64
+}
+
+// Counters returns a copy of the aggregate counters of the limiter.
+func (tl *TokenLimiter) Counters() Counters {
+	return Counters{
+		Requests:          tl.counters.requests.Load(),
+		Allowed:           tl.counters.allowed.Load(),
+		Delayed:           tl.counters.delayed.Load(),
+		Rejected:          tl.counters.rejected.Load(),
+		ActiveSources:     uint64(tl.bucketSets.Len()),
+		BucketSetsCreated: tl.counters.created.Load(),
+		BucketSetsEvicted: tl.counters.evicted.Load(),
+
+		BucketSetsExpired:            tl.counters.expired.Load(),
+		BucketSetsEvictedForCapacity: tl.counters.evictedForCapacity.Load(),
+		RejectedForCapacity:          tl.counters.rejectedForCapacity.Load(),
+		StateEntriesSkipped:          tl.counters.skipped.Load(),
+	}
+}
+
+// ResetCounters sets the counters back to zero, e.g. between tests.
+func (tl *TokenLimiter) ResetCounters() {
+	tl.counters.requests.Store(0)
+	tl.counters.allowed.Store(0)
+	tl.counters.delayed.Store(0)
+	tl.counters.rejected.Store(0)
+	tl.counters.created.Store(0)
+	tl.counters.evicted.Store(0)
+	tl.counters.skipped.Store(0)
+	tl.counters.expired.Store(0)
+	tl.counters.evictedForCapacity.Store(0)
+	tl.counters.rejectedForCapacity.Store(0)
+}
@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestCounters(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	err := rates.Add(clock.Second, 1, 1)
+	require.NoError(t, err)
+
+	testutils.FreezeTime(t)
+
+	l, err := New(handler, headerLimit, rates)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(l, "a", 0).Code)
+	assert.Equal(t, http.StatusOK, serve(l, "b", 0).Code)
+
+	assert.Equal(t, Counters{
+		Requests:          3,
+		Allowed:           2,
+		Rejected:          1,
+		ActiveSources:     2,
+		BucketSetsCreated: 2,
+	}, l.Counters())
+
+	// the bucket set of "a" expires.
+	clock.Advance(24 * clock.Hour)
+	assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+
+	assert.Equal(t, Counters{
+		Requests:          4,
+		Allowed:           3,
+		Rejected:          1,
+		ActiveSources:     2,
+		BucketSetsCreated: 3,
+		BucketSetsEvicted: 1,
+		BucketSetsExpired: 1,
+	}, l.Counters())
+
+	l.ResetCounters()
+	assert.Equal(t, Counters{ActiveSources: 2}, l.Counters())
+}
+
+func TestCounters_evictedToMakeRoom(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	err := rates.Add(clock.Second, 10, 10)
+	require.NoError(t, err)
+
+	l, err := New(handler, headerLimit, rates, Capacity(1))
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+	assert.Equal(t, http.StatusOK, serve(l, "b", 0).Code)
+
+	c := l.Counters()
+	assert.Equal(t, uint64(1), c.ActiveSources)
+	assert.Equal(t, uint64(2), c.BucketSetsCreated)
+	assert.Equal(t, uint64(1), c.BucketSetsEvicted)
+	assert.Equal(t, uint64(1), c.BucketSetsEvictedForCapacity)
+}
+
+func TestCounters_unknownSource(t *testing.T) {
+	rates := NewRateSet()
+	err := rates.Add(clock.Second, 1, 1)
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	l, err := New(handler, faultyExtract, rates)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusInternalServerError, serve(l, "a", 0).Code)
+	assert.Equal(t, Counters{Requests: 1, Rejected: 1}, l.Counters())
+}
+
+func TestCounters_concurrent(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	err := rates.Add(clock.Second, 50, 50)
+	require.NoError(t, err)
+
+	l, err := New(handler, headerLimit, rates, Capacity(4), ConcurrencyLimit(2, headerCost))
+	require.NoError(t, err)
+
+	const goroutines, requests = 16, 200
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				serve(l, fmt.Sprintf("source-%d", (i+j)%8), 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c := l.Counters()
+	assert.Equal(t, uint64(goroutines*requests), c.Requests)
+	assert.Equal(t, c.Requests, c.Allowed+c.Rejected)
+	assert.NotZero(t, c.Rejected)
+	assert.LessOrEqual(t, c.ActiveSources, uint64(4))
+	assert.Equal(t, c.BucketSetsCreated-c.BucketSetsEvicted, c.ActiveSources)
+}
@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// writeOpenMetrics writes the counters in the OpenMetrics text format.
+// A Prometheus collector would do the same from its Collect method,
+// e.g. with prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(c.Requests)).
+func writeOpenMetrics(w io.Writer, c Counters) {
+	counters := []struct {
+		name  string
+		value uint64
+	}{
+		{name: "ratelimit_requests", value: c.Requests},
+		{name: "ratelimit_allowed", value: c.Allowed},
+		{name: "ratelimit_delayed", value: c.Delayed},
+		{name: "ratelimit_rejected", value: c.Rejected},
+		{name: "ratelimit_bucket_sets_created", value: c.BucketSetsCreated},
+		{name: "ratelimit_bucket_sets_evicted", value: c.BucketSetsEvicted},
+	}
+	for _, counter := range counters {
+		_, _ = fmt.Fprintf(w, "# TYPE %s counter\n%s_total %d\n", counter.name, counter.name, counter.value)
+	}
+
+	_, _ = fmt.Fprintf(w, "# TYPE ratelimit_active_sources gauge\nratelimit_active_sources %d\n", c.ActiveSources)
+	_, _ = fmt.Fprintln(w, "# EOF")
+}
+
+func ExampleTokenLimiter_Counters() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	_ = rates.Add(time.Minute, 1, 1)
+
+	extract, _ := utils.NewExtractor("request.header.Source")
+
+	l, err := New(handler, extract, rates)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, source := range []string{"a", "a", "b"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Source", source)
+		l.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// e.g. on each scrape of the metrics endpoint.
+	writeOpenMetrics(os.Stdout, l.Counters())
+
+	// output:
+	// # TYPE ratelimit_requests counter
+	// ratelimit_requests_total 3
+	// # TYPE ratelimit_allowed counter
+	// ratelimit_allowed_total 2
+	// # TYPE ratelimit_delayed counter
+	// ratelimit_delayed_total 0
+	// # TYPE ratelimit_rejected counter
+	// ratelimit_rejected_total 1
+	// # TYPE ratelimit_bucket_sets_created counter
+	// ratelimit_bucket_sets_created_total 2
+	// # TYPE ratelimit_bucket_sets_evicted counter
+	// ratelimit_bucket_sets_evicted_total 0
+	// # TYPE ratelimit_active_sources gauge
+	// ratelimit_active_sources 2
+	// # EOF
+}
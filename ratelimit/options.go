@@ -1,7 +1,10 @@
 package ratelimit
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/vulcand/oxy/v2/utils"
 )
@@ -25,7 +28,78 @@ func ExtractRates(e RateExtractor) TokenLimiterOption {
 	}
 }
 
-// Capacity sets the capacity.
+// Algorithm sets the algorithm enforcing the rates added with RateSet.Add, TokenBucket by default.
+// With SlidingWindowLog, a source never exceeds the average of a rate in any window of its period,
+// and the Retry-After of the rejected requests is the time until the oldest request of the window ages out.
+// The memory of a source is bounded by the average of its rates (4 bytes per request),
+// and the number of sources by the Capacity.
+// The rates added with RateSet.AddSlidingWindow always use SlidingWindowLog, both can be mixed in a set.
+func Algorithm(a RateAlgorithm) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if a != TokenBucket && a != SlidingWindowLog {
+			return fmt.Errorf("bad algorithm: %v", a)
+		}
+		cl.algorithm = a
+		return nil
+	}
+}
+
+// AdaptiveScale multiplies the average and the burst of every rate by the factor returned by scale,
+// evaluated on every request, e.g. to tighten the rates while the upstream is stressed:
+//
+//	ratelimit.AdaptiveScale(cb.LoadFactor)
+//
+// The factor is clamped between the floor (see AdaptiveScaleFloor) and 1. The rates are scaled by consuming
+// amount/factor tokens per request, so that the state of the sources is kept when the factor changes.
+// A request that the scaled burst can't hold is rejected with a MaxRateError.
+// With PostConsume, only the prepaid amount is scaled.
+func AdaptiveScale(scale func() float64) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if scale == nil {
+			return errors.New("scale function can't be nil")
+		}
+		cl.adaptiveScale = scale
+		return nil
+	}
+}
+
+// AdaptiveScaleFloor sets the lowest factor of the rates applied by AdaptiveScale, DefaultAdaptiveScaleFloor by default.
+func AdaptiveScaleFloor(floor float64) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if floor <= 0 || floor > 1 {
+			return fmt.Errorf("bad adaptive scale floor: %v", floor)
+		}
+		cl.scaleFloor = floor
+		return nil
+	}
+}
+
+// DecisionCoalescing decides the concurrent requests of a source together, e.g. the HTTP/2 streams of a browser:
+// the requests of a source arriving while one of its requests waits for the limiter join its batch,
+// of up to maxBatch requests, and the tokens of the batch are consumed with one acquisition of the mutex of the limiter.
+// The requests of a batch are admitted in their order of arrival until one can't be, the following ones
+// are rejected with its error. After such a MaxRateError, the requests of the source are rejected at once
+// with the same error for the window, or until its delay if it is shorter.
+// The coalescing never admits more requests than the individual decisions would have,
+// and a request without concurrent requests from its source within the window is decided at once,
+// the first request of a batch of the other sources yields the processor once to let the concurrent requests join.
+// The rates of a batch are extracted from its first request, see ExtractRates.
+func DecisionCoalescing(window time.Duration, maxBatch int) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if window < 0 {
+			return fmt.Errorf("bad coalescing window: %v", window)
+		}
+		if maxBatch < 2 {
+			return fmt.Errorf("bad coalescing batch size: %v", maxBatch)
+		}
+		cl.coalescer = newCoalescer(window, maxBatch)
+		return nil
+	}
+}
+
+// Capacity sets the maximum number of sources tracked, DefaultCapacity by default.
+// When it is reached, the expired bucket sets are dropped first, then the ones closest to their expiry, to make room
+// for a new source: this resets the limits of the evicted sources, see OnEviction and RejectOnCapacityPressure.
 func Capacity(capacity int) TokenLimiterOption {
 	return func(cl *TokenLimiter) error {
 		if capacity <= 0 {
@@ -36,6 +110,134 @@ func Capacity(capacity int) TokenLimiterOption {
 	}
 }
 
+// OnEviction sets a function called when the bucket set of a source is dropped, with the reason:
+// its TTL of inactivity expired, or it was evicted to make room for a new source, see Capacity.
+// It is called synchronously while the limiter is locked: it must be quick, and must not call the limiter.
+func OnEviction(fn func(source string, reason EvictReason)) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		tl.onEviction = fn
+		return nil
+	}
+}
+
+// RejectOnCapacityPressure rejects the requests of the new sources with a CapacityError (503) when the Capacity
+// is reached and no bucket set has expired, instead of evicting the bucket set of another source:
+// the limits of the known sources are kept, and the unknown sources are rejected until some room is freed.
+func RejectOnCapacityPressure(reject bool) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		tl.rejectOnCapacity = reject
+		return nil
+	}
+}
+
+// PostConsume enables the deferred accounting: the amount of tokens consumed by a request
+// is computed by fn once the response is served (e.g. from the bytes written).
+// Only the prepaid amount (see PrepaidAmount) is consumed before serving the request,
+// instead of the amount returned by the source extractor.
+// The rest is consumed after the response, even beyond the available tokens:
+// the deficit delays the next requests from the same source.
+// Nothing is given back when fn returns less than the prepaid amount.
+func PostConsume(fn PostConsumeFunc) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if fn == nil {
+			return errors.New("post consume function can't be nil")
+		}
+		cl.postConsume = fn
+		return nil
+	}
+}
+
+// PrepaidAmount sets the amount of tokens consumed before serving a request when PostConsume is used.
+// The default is DefaultPrepaidAmount.
+func PrepaidAmount(amount int64) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if amount <= 0 {
+			return fmt.Errorf("bad prepaid amount: %v", amount)
+		}
+		cl.prepaid = amount
+		return nil
+	}
+}
+
+// ConcurrencyLimit caps the units in flight per source, in addition to the rates:
+// a request holds cost(req) units from the token bucket check until its response completes.
+// The requests exceeding the cap are rejected with a MaxConcurrencyError (429 and X-Concurrency-Limit header),
+// unless ConcurrencyWait is set. The requests with a cost lower than or equal to 0 are not limited.
+func ConcurrencyLimit(maxUnits int64, cost ConcurrencyCostFunc) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if maxUnits <= 0 {
+			return fmt.Errorf("bad max units: %v", maxUnits)
+		}
+		if cost == nil {
+			return errors.New("concurrency cost function can't be nil")
+		}
+		cl.maxUnits = maxUnits
+		cl.concurrencyCost = cost
+		return nil
+	}
+}
+
+// ConcurrencyWait makes the requests exceeding the ConcurrencyLimit wait up to maxWait,
+// bounded by the request context, for units to be released instead of being rejected immediately.
+func ConcurrencyWait(maxWait time.Duration) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if maxWait < 0 {
+			return fmt.Errorf("bad max wait: %v", maxWait)
+		}
+		cl.concurrencyWait = maxWait
+		return nil
+	}
+}
+
+// BackpressureFromUpstream pauses the sources the upstream pushes back on.
+// When the response to a source is a 429, or a 503 with a Retry-After header (see BackpressureStatuses),
+// the buckets of the source are drained, and the source is in a penalty for the Retry-After delay,
+// capped by MaxPenalty: its requests are rejected with a BackpressureError (429 and the Retry-After left)
+// without reaching the next handler. See SourceState for the penalty of a source.
+func BackpressureFromUpstream(enable bool) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		tl.backpressure = enable
+		return nil
+	}
+}
+
+// BackpressureStatuses sets the upstream status codes applying the backpressure, see BackpressureFromUpstream.
+// The default is 429 and 503. The statuses other than 429 only apply it with a Retry-After header.
+func BackpressureStatuses(codes ...int) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		statuses := make(map[int]struct{}, len(codes))
+		for _, code := range codes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("invalid backpressure status code: %d", code)
+			}
+			statuses[code] = struct{}{}
+		}
+		tl.backpressureStatuses = statuses
+		return nil
+	}
+}
+
+// MaxPenalty caps the penalty of a source set by the Retry-After of the upstream, see BackpressureFromUpstream.
+// The default is DefaultMaxPenalty.
+func MaxPenalty(d time.Duration) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		if d <= 0 {
+			return fmt.Errorf("bad max penalty: %v", d)
+		}
+		tl.maxPenalty = d
+		return nil
+	}
+}
+
+// ClearOnSuccess ends the penalty of a source on its first successful (2xx) response,
+// e.g. a request in flight when the penalty started, see BackpressureFromUpstream.
+func ClearOnSuccess(clear bool) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		tl.clearOnSuccess = clear
+		return nil
+	}
+}
+
 // Logger defines the logger the TokenLimiter will use.
 func Logger(l utils.Logger) TokenLimiterOption {
 	return func(tl *TokenLimiter) error {
@@ -43,3 +245,18 @@ func Logger(l utils.Logger) TokenLimiterOption {
 		return nil
 	}
 }
+
+// ImportState restores the state of the buckets exported by (*TokenLimiter).ExportState, e.g. before a restart.
+// The buckets are refilled for the time elapsed since the export,
+// the window logs of the SlidingWindowLog rates keep the requests still in their windows.
+// The entries that are corrupt, or whose periods do not match the default rates, are skipped, see Counters.
+// The reader is consumed by New, which fails if it can't be read.
+func ImportState(r io.Reader) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		if r == nil {
+			return errors.New("import state: nil reader")
+		}
+		tl.importState = r
+		return nil
+	}
+}
@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Pacer paces the requests sent to a destination with a token bucket, e.g. to a backend enforcing a quota.
+// It is not safe for concurrent use: its callers synchronize it, e.g. with the lock of their load balancer.
+type Pacer struct {
+	bucket *tokenBucket
+}
+
+// NewPacer creates a pacer admitting average requests per period, with bursts of up to burst requests.
+func NewPacer(average, burst int64, period time.Duration) (*Pacer, error) {
+	if period <= 0 {
+		return nil, fmt.Errorf("invalid period: %v", period)
+	}
+	if average <= 0 {
+		return nil, fmt.Errorf("invalid average: %v", average)
+	}
+	if burst <= 0 {
+		return nil, fmt.Errorf("invalid burst: %v", burst)
+	}
+
+	return &Pacer{bucket: newTokenBucket(&rate{period: period, average: average, burst: burst})}, nil
+}
+
+// Delay returns the time until the pacer admits a request, 0 when it admits one now.
+func (p *Pacer) Delay() time.Duration {
+	p.bucket.updateAvailableTokens()
+	return p.bucket.timeTillAvailable(1)
+}
+
+// Take admits a request if the pacer can, otherwise it returns the time until it admits one.
+func (p *Pacer) Take() (time.Duration, bool) {
+	delay, _ := p.bucket.consume(1)
+	return delay, delay == 0
+}
@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestPacer(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	p, err := NewPacer(2, 2, clock.Second)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, time.Duration(0), p.Delay())
+		_, ok := p.Take()
+		require.True(t, ok)
+	}
+
+	// Delay does not take the request.
+	assert.Equal(t, 500*clock.Millisecond, p.Delay())
+	assert.Equal(t, 500*clock.Millisecond, p.Delay())
+	delay, ok := p.Take()
+	assert.False(t, ok)
+	assert.Equal(t, 500*clock.Millisecond, delay)
+
+	clock.Advance(500 * clock.Millisecond)
+	_, ok = p.Take()
+	assert.True(t, ok)
+	assert.Equal(t, 500*clock.Millisecond, p.Delay())
+}
+
+func TestNewPacer_invalid(t *testing.T) {
+	_, err := NewPacer(0, 1, clock.Second)
+	assert.Error(t, err)
+	_, err = NewPacer(1, 0, clock.Second)
+	assert.Error(t, err)
+	_, err = NewPacer(1, 1, 0)
+	assert.Error(t, err)
+}
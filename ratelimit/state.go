@@ -0,0 +1,170 @@
+package ratelimit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// maxStateLineBytes bounds the length of a line of the exported state.
+const maxStateLineBytes = 1 << 20
+
+// sourceState is a line of the exported state: the buckets of a source.
+type sourceState struct {
+	Source  string        `json:"source"`
+	Buckets []bucketState `json:"buckets"`
+	Windows []windowState `json:"windows,omitempty"`
+}
+
+// bucketState is the state of a bucket, identified by its period.
+type bucketState struct {
+	Period      time.Duration `json:"period"`
+	Available   int64         `json:"available"`
+	Carry       uint64        `json:"carry,omitempty"`
+	LastRefresh clock.Time    `json:"last_refresh"`
+}
+
+// windowState is the state of the window log of a SlidingWindowLog rate, identified by its period.
+type windowState struct {
+	Period time.Duration `json:"period"`
+	Times  []clock.Time  `json:"times"`
+}
+
+// ExportState writes the state of the buckets of all the tracked sources to w, one JSON line per source,
+// sorted by source. It is restored with the ImportState option.
+// The limiter is only locked while each source is copied: the requests are served during the export.
+func (tl *TokenLimiter) ExportState(w io.Writer) error {
+	sources := tl.bucketSets.Keys()
+	sort.Strings(sources)
+
+	enc := json.NewEncoder(w)
+	for _, source := range sources {
+		state, ok := tl.sourceState(source)
+		if !ok {
+			// Expired or evicted since the keys were listed.
+			continue
+		}
+		if err := enc.Encode(state); err != nil {
+			return fmt.Errorf("export state of %q: %w", source, err)
+		}
+	}
+	return nil
+}
+
+func (tl *TokenLimiter) sourceState(source string) (sourceState, bool) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	bucketSetI, exists := tl.bucketSets.Get(source)
+	if !exists {
+		return sourceState{}, false
+	}
+	bucketSet := bucketSetI.(*TokenBucketSet)
+
+	state := sourceState{Source: source, Buckets: make([]bucketState, 0, len(bucketSet.buckets))}
+	for _, bucket := range bucketSet.buckets {
+		state.Buckets = append(state.Buckets, bucketState{
+			Period:      bucket.period,
+			Available:   bucket.availableTokens,
+			Carry:       bucket.carry,
+			LastRefresh: bucket.lastRefresh.UTC(),
+		})
+	}
+	sort.Slice(state.Buckets, func(i, j int) bool { return state.Buckets[i].Period < state.Buckets[j].Period })
+
+	for _, window := range bucketSet.windows {
+		times := window.export()
+		for i := range times {
+			times[i] = times[i].UTC()
+		}
+		state.Windows = append(state.Windows, windowState{Period: window.period, Times: times})
+	}
+	sort.Slice(state.Windows, func(i, j int) bool { return state.Windows[i].Period < state.Windows[j].Period })
+	return state, true
+}
+
+// restoreState fills the bucket sets with the state exported to r.
+func (tl *TokenLimiter) restoreState(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxStateLineBytes)
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var state sourceState
+		if err := json.Unmarshal(scanner.Bytes(), &state); err != nil {
+			tl.counters.skipped.Add(1)
+			tl.log.Warn("vulcand/oxy/ratelimit: skipping corrupt state entry: %v", err)
+			continue
+		}
+
+		bucketSet, err := tl.restoreBucketSet(state)
+		if err != nil {
+			tl.counters.skipped.Add(1)
+			tl.log.Warn("vulcand/oxy/ratelimit: skipping state of %q: %v", state.Source, err)
+			continue
+		}
+
+		if err := tl.bucketSets.Set(state.Source, bucketSet, bucketSetTTL(bucketSet)); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("import state: %w", err)
+	}
+	return nil
+}
+
+// restoreBucketSet returns the bucket set of the default rates in the given state, refilled up to now.
+func (tl *TokenLimiter) restoreBucketSet(state sourceState) (*TokenBucketSet, error) {
+	if state.Source == "" {
+		return nil, errors.New("no source")
+	}
+
+	bucketSet := newTokenBucketSet(tl.defaultRates, tl.algorithm)
+	if len(state.Buckets) != len(bucketSet.buckets) {
+		return nil, fmt.Errorf("%d buckets, the rates have %d periods", len(state.Buckets), len(bucketSet.buckets))
+	}
+	if len(state.Windows) != len(bucketSet.windows) {
+		return nil, fmt.Errorf("%d windows, the rates have %d sliding window periods", len(state.Windows), len(bucketSet.windows))
+	}
+
+	seen := make(map[time.Duration]bool, len(state.Buckets))
+	for _, b := range state.Buckets {
+		bucket, ok := bucketSet.buckets[b.Period]
+		if !ok || seen[b.Period] {
+			return nil, fmt.Errorf("no rate for the period %v", b.Period)
+		}
+		seen[b.Period] = true
+		if b.Carry >= uint64(bucket.period) || b.LastRefresh.IsZero() {
+			return nil, fmt.Errorf("invalid bucket state for the period %v", b.Period)
+		}
+
+		bucket.availableTokens = b.Available
+		if bucket.availableTokens > bucket.burst {
+			bucket.availableTokens = bucket.burst
+		}
+		bucket.carry = b.Carry
+		bucket.lastRefresh = b.LastRefresh.UTC()
+		bucket.updateAvailableTokens()
+	}
+
+	seen = make(map[time.Duration]bool, len(state.Windows))
+	for _, w := range state.Windows {
+		window, ok := bucketSet.windows[w.Period]
+		if !ok || seen[w.Period] {
+			return nil, fmt.Errorf("no sliding window rate for the period %v", w.Period)
+		}
+		seen[w.Period] = true
+		window.restore(w.Times)
+	}
+	return bucketSet, nil
+}
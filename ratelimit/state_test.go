@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func bucketSetState(t *testing.T, l *TokenLimiter, source string) string {
+	t.Helper()
+
+	bucketSet, ok := l.bucketSets.Get(source)
+	require.True(t, ok)
+	return bucketSet.(*TokenBucketSet).debugState()
+}
+
+func TestExportImportState(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 1, 3))
+	require.NoError(t, rates.Add(clock.Hour, 60, 10))
+
+	testutils.FreezeTime(t)
+
+	l, err := New(handler, headerLimit, rates)
+	require.NoError(t, err)
+
+	// a is exhausted, b has consumed a single token.
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve(l, "a", 0).Code)
+	assert.Equal(t, http.StatusOK, serve(l, "b", 0).Code)
+
+	var state bytes.Buffer
+	require.NoError(t, l.ExportState(&state))
+	assert.Equal(t, 2, strings.Count(state.String(), "\n"))
+
+	// The export is deterministic.
+	var again bytes.Buffer
+	require.NoError(t, l.ExportState(&again))
+	assert.Equal(t, state.String(), again.String())
+
+	clock.Advance(30 * clock.Second)
+
+	restored, err := New(handler, headerLimit, rates, ImportState(&state))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), restored.Counters().ActiveSources)
+	assert.Zero(t, restored.Counters().StateEntriesSkipped)
+
+	// The restored buckets have been refilled for the downtime, as the buckets of the uninterrupted limiter.
+	for _, source := range []string{"a", "b"} {
+		_, err = l.consumeRates(nil, source, 0)
+		require.NoError(t, err)
+
+		assert.Equal(t, bucketSetState(t, l, source), bucketSetState(t, restored, source), source)
+	}
+	assert.Equal(t, "{1s: 3}, {1h0m0s: 7}", bucketSetState(t, restored, "a"))
+	assert.Equal(t, "{1s: 3}, {1h0m0s: 9}", bucketSetState(t, restored, "b"))
+
+	// The half token refilled during the downtime has been carried over.
+	clock.Advance(30 * clock.Second)
+	_, err = restored.consumeRates(nil, "a", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "{1s: 3}, {1h0m0s: 8}", bucketSetState(t, restored, "a"))
+
+	// The hour bucket of a only allows 8 more requests.
+	for i := 0; i < 8; i++ {
+		assert.Equal(t, http.StatusOK, serve(restored, "a", 0).Code)
+		clock.Advance(clock.Second)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve(restored, "a", 0).Code)
+}
+
+func TestImportState_skipped(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 1, 3))
+
+	testutils.FreezeTime(t)
+
+	l, err := New(nil, headerLimit, rates)
+	require.NoError(t, err)
+	_, err = l.consumeRates(nil, "a", 2)
+	require.NoError(t, err)
+
+	var state bytes.Buffer
+	require.NoError(t, l.ExportState(&state))
+
+	state.WriteString("{not json\n")
+	// A period that is not configured anymore.
+	state.WriteString(`{"source":"b","buckets":[{"period":60000000000,"available":1,"last_refresh":"2020-01-01T00:00:00Z"}]}` + "\n")
+	// A carry that can't be reached.
+	state.WriteString(`{"source":"c","buckets":[{"period":1000000000,"available":1,"carry":1000000000,"last_refresh":"2020-01-01T00:00:00Z"}]}` + "\n")
+	state.WriteString("\n")
+
+	restored, err := New(nil, headerLimit, rates, ImportState(&state))
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(1), restored.Counters().ActiveSources)
+	assert.Equal(t, uint64(3), restored.Counters().StateEntriesSkipped)
+	assert.Equal(t, "{1s: 1}", bucketSetState(t, restored, "a"))
+
+	restored.ResetCounters()
+	assert.Zero(t, restored.Counters().StateEntriesSkipped)
+
+	_, err = New(nil, headerLimit, rates, ImportState(nil))
+	require.Error(t, err)
+}
@@ -4,7 +4,10 @@ package ratelimit
 import (
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -16,6 +19,12 @@ import (
 // DefaultCapacity default capacity.
 const DefaultCapacity = 65536
 
+// DefaultPrepaidAmount is the amount of tokens consumed before serving a request, when PostConsume is used.
+const DefaultPrepaidAmount = 1
+
+// DefaultAdaptiveScaleFloor is the lowest factor of the rates, see AdaptiveScale.
+const DefaultAdaptiveScaleFloor = 0.05
+
 // RateSet maintains a set of rates. It can contain only one rate per period at a time.
 type RateSet struct {
 	m map[time.Duration]*rate
@@ -44,6 +53,20 @@ func (rs *RateSet) Add(period time.Duration, average int64, burst int64) error {
 	return nil
 }
 
+// AddSlidingWindow adds a rate enforced with the SlidingWindowLog algorithm to the set:
+// at most limit requests are admitted in any window of the period, whatever the Algorithm of the limiter.
+// If there is a rate with the same period in the set then the new rate overrides the old one.
+func (rs *RateSet) AddSlidingWindow(period time.Duration, limit int64) error {
+	if period <= 0 {
+		return fmt.Errorf("invalid period: %v", period)
+	}
+	if limit <= 0 {
+		return fmt.Errorf("invalid limit: %v", limit)
+	}
+	rs.m[period] = &rate{period: period, average: limit, burst: limit, algorithm: SlidingWindowLog}
+	return nil
+}
+
 func (rs *RateSet) String() string {
 	return fmt.Sprint(rs.m)
 }
@@ -72,10 +95,45 @@ type TokenLimiter struct {
 	capacity     int
 	next         http.Handler
 
+	// onEviction is called when the bucket set of a source is dropped, see OnEviction.
+	onEviction func(source string, reason EvictReason)
+	// rejectOnCapacity rejects the new sources instead of evicting the others, see RejectOnCapacityPressure.
+	rejectOnCapacity bool
+
+	// algorithm enforces the rates added with RateSet.Add, see Algorithm.
+	algorithm RateAlgorithm
+
+	postConsume PostConsumeFunc
+	prepaid     int64
+
+	maxUnits        int64
+	concurrencyCost ConcurrencyCostFunc
+	concurrencyWait time.Duration
+	concurrency     *concurrencyLimiter
+
+	// backpressure enables the upstream backpressure, see BackpressureFromUpstream.
+	backpressure         bool
+	backpressureStatuses map[int]struct{}
+	maxPenalty           time.Duration
+	clearOnSuccess       bool
+
+	// adaptiveScale returns the factor of the rates, see AdaptiveScale.
+	adaptiveScale func() float64
+	scaleFloor    float64
+
+	// coalescer decides the concurrent requests of a source together, nil when disabled, see DecisionCoalescing.
+	coalescer *coalescer
+
+	// importState is the state to restore at construction, see ImportState.
+	importState io.Reader
+
+	counters counters
+
 	log utils.Logger
 }
 
 // New constructs a `TokenLimiter` middleware instance.
+// next can be nil, and set later with Wrap.
 func New(next http.Handler, extract utils.SourceExtractor, defaultRates *RateSet, opts ...TokenLimiterOption) (*TokenLimiter, error) {
 	if defaultRates == nil || len(defaultRates.m) == 0 {
 		return nil, errors.New("provide default rates")
@@ -98,60 +156,194 @@ func New(next http.Handler, extract utils.SourceExtractor, defaultRates *RateSet
 	}
 	setDefaults(tl)
 	tl.bucketSets = collections.NewTTLMap(tl.capacity)
+	tl.bucketSets.OnExpire = tl.onExpired
+	tl.bucketSets.OnEvict = tl.onEvictedForCapacity
+	if tl.importState != nil {
+		if err := tl.restoreState(tl.importState); err != nil {
+			return nil, err
+		}
+		tl.importState = nil
+	}
+	if tl.concurrencyCost != nil {
+		tl.concurrency = newConcurrencyLimiter(tl.maxUnits, tl.concurrencyCost, tl.concurrencyWait)
+	}
 	return tl, nil
 }
 
-// Wrap sets the next handler to be called by token limiter handler.
-func (tl *TokenLimiter) Wrap(next http.Handler) {
+// Wrap sets the next handler to be called by token limiter handler, when it was created without.
+func (tl *TokenLimiter) Wrap(next http.Handler) error {
+	if err := utils.CheckWrap(tl.next, next); err != nil {
+		return err
+	}
 	tl.next = next
+	return nil
 }
 
 func (tl *TokenLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if tl.next == nil {
+		utils.ServeError(tl.errHandler, w, req, "ratelimit", &utils.ErrNotWired{Middleware: "ratelimit"})
+		return
+	}
+
+	tl.counters.requests.Add(1)
+
 	source, amount, err := tl.extract.Extract(req)
 	if err != nil {
-		tl.errHandler.ServeHTTP(w, req, err)
+		tl.counters.rejected.Add(1)
+		utils.ServeError(tl.errHandler, w, req, "ratelimit", err)
 		return
 	}
 
-	if err := tl.consumeRates(req, source, amount); err != nil {
+	if tl.postConsume != nil {
+		// The actual amount is known once the response is served.
+		amount = tl.prepaid
+	}
+
+	bucketSet, err := tl.consumeRates(req, source, amount)
+	if err != nil {
+		tl.counters.rejected.Add(1)
 		tl.log.Warn("limiting request %v %v, limit: %v", req.Method, req.URL, err)
-		tl.errHandler.ServeHTTP(w, req, err)
+		utils.ServeError(tl.errHandler, w, req, "ratelimit", err)
+		return
+	}
+
+	if tl.concurrency != nil {
+		release, waited, err := tl.concurrency.acquire(req, source)
+		if err != nil {
+			tl.counters.rejected.Add(1)
+			tl.log.Warn("limiting request %v %v, concurrency limit: %v", req.Method, req.URL, err)
+			utils.ServeError(tl.errHandler, w, req, "ratelimit", err)
+			return
+		}
+		// released even if the handler panics.
+		defer release()
+
+		if waited {
+			tl.counters.delayed.Add(1)
+		}
+	}
+
+	tl.counters.allowed.Add(1)
+
+	if tl.postConsume == nil && !tl.backpressure {
+		tl.next.ServeHTTP(w, req)
+		return
+	}
+
+	pw := utils.NewProxyWriterWithLogger(w, tl.log)
+	tl.next.ServeHTTP(pw, req)
+
+	if tl.backpressure {
+		tl.observeUpstream(source, bucketSet, pw.StatusCode(), pw.Header())
+	}
+
+	if tl.postConsume == nil {
 		return
 	}
 
-	tl.next.ServeHTTP(w, req)
+	cost := tl.postConsume(req, ResponseInfo{StatusCode: pw.StatusCode(), BytesWritten: pw.GetLength()})
+	if cost <= amount {
+		return
+	}
+
+	tl.mutex.Lock()
+	bucketSet.Charge(cost - amount)
+	tl.mutex.Unlock()
 }
 
-func (tl *TokenLimiter) consumeRates(req *http.Request, source string, amount int64) error {
+func (tl *TokenLimiter) consumeRates(req *http.Request, source string, amount int64) (*TokenBucketSet, error) {
+	if tl.coalescer != nil {
+		return tl.coalescer.consume(tl, req, source, amount)
+	}
+
+	factor := tl.scaleFactor()
+
 	tl.mutex.Lock()
 	defer tl.mutex.Unlock()
 
+	bucketSet, err := tl.bucketSet(req, source)
+	if err != nil {
+		return nil, err
+	}
+	if err := bucketSet.consumeScaled(amount, factor); err != nil {
+		return nil, err
+	}
+	return bucketSet, nil
+}
+
+// bucketSet returns the bucket set of the source, created or updated with the rates of req.
+// It must be called with the mutex held.
+func (tl *TokenLimiter) bucketSet(req *http.Request, source string) (*TokenBucketSet, error) {
 	effectiveRates := tl.resolveRates(req)
 	bucketSetI, exists := tl.bucketSets.Get(source)
 	var bucketSet *TokenBucketSet
 
 	if exists {
 		bucketSet = bucketSetI.(*TokenBucketSet)
+		if err := checkPenalty(bucketSet); err != nil {
+			return nil, err
+		}
+		maxPeriod := bucketSet.maxPeriod
 		bucketSet.Update(effectiveRates)
+		// The TTL follows the longest period of the rates: a longer period must not be expired mid-window,
+		// and a shorter one must not keep the entry longer than needed.
+		if bucketSet.maxPeriod != maxPeriod {
+			if err := tl.bucketSets.Set(source, bucketSet, bucketSetTTL(bucketSet)); err != nil {
+				return nil, err
+			}
+		}
 	} else {
-		bucketSet = NewTokenBucketSet(effectiveRates)
-		// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
-		// the counters for this ip will expire after 10 seconds of inactivity
-		err := tl.bucketSets.Set(source, bucketSet, int(bucketSet.maxPeriod/clock.Second)*10+1)
-		if err != nil {
-			return err
+		bucketSet = newTokenBucketSet(effectiveRates, tl.algorithm)
+		if err := tl.addBucketSet(source, bucketSet); err != nil {
+			return nil, err
 		}
+		tl.counters.created.Add(1)
+	}
+	return bucketSet, nil
+}
+
+// addBucketSet adds the bucket set of a new source. When the Capacity is reached, the expired bucket sets are dropped,
+// then the ones closest to their expiry, unless RejectOnCapacityPressure is set.
+// It must be called with the mutex held.
+func (tl *TokenLimiter) addBucketSet(source string, bucketSet *TokenBucketSet) error {
+	if !tl.rejectOnCapacity {
+		return tl.bucketSets.Set(source, bucketSet, bucketSetTTL(bucketSet))
 	}
-	delay, err := bucketSet.Consume(amount)
+
+	ok, err := tl.bucketSets.SetIfRoom(source, bucketSet, bucketSetTTL(bucketSet))
 	if err != nil {
 		return err
 	}
-	if delay > 0 {
-		return &MaxRateError{Delay: delay}
+	if !ok {
+		tl.counters.rejectedForCapacity.Add(1)
+		return &CapacityError{Capacity: tl.capacity}
 	}
 	return nil
 }
 
+// scaleFactor returns the factor of the rates returned by the AdaptiveScale function, between the floor and 1.
+func (tl *TokenLimiter) scaleFactor() float64 {
+	if tl.adaptiveScale == nil {
+		return 1
+	}
+
+	factor := tl.adaptiveScale()
+	if math.IsNaN(factor) || factor >= 1 {
+		return 1
+	}
+	if factor < tl.scaleFloor {
+		return tl.scaleFloor
+	}
+	return factor
+}
+
+// bucketSetTTL returns the ttl of a bucket set, in seconds.
+// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
+// the counters for this ip will expire after 10 seconds of inactivity.
+func bucketSetTTL(bucketSet *TokenBucketSet) int {
+	return int(bucketSet.maxPeriod/clock.Second)*10 + 1
+}
+
 // effectiveRates retrieves rates to be applied to the request.
 func (tl *TokenLimiter) resolveRates(req *http.Request) *RateSet {
 	// If configuration mapper is not specified for this instance, then return
@@ -174,6 +366,15 @@ func (tl *TokenLimiter) resolveRates(req *http.Request) *RateSet {
 	return rates
 }
 
+// ResponseInfo describes the response served to a request.
+type ResponseInfo struct {
+	StatusCode   int
+	BytesWritten int64
+}
+
+// PostConsumeFunc returns the amount of tokens consumed by a request, once its response is served.
+type PostConsumeFunc func(req *http.Request, resp ResponseInfo) int64
+
 // MaxRateError max rate error.
 type MaxRateError struct {
 	Delay time.Duration
@@ -187,14 +388,35 @@ func (m *MaxRateError) Error() string {
 type RateErrHandler struct{}
 
 func (e *RateErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
-	//nolint:errorlint // must be changed
-	if rerr, ok := err.(*MaxRateError); ok {
+	var rerr *MaxRateError
+	if errors.As(err, &rerr) {
 		w.Header().Set("Retry-After", fmt.Sprintf("%.0f", rerr.Delay.Seconds()))
 		w.Header().Set("X-Retry-In", rerr.Delay.String())
 		w.WriteHeader(http.StatusTooManyRequests)
 		_, _ = w.Write([]byte(err.Error()))
 		return
 	}
+	var berr *BackpressureError
+	if errors.As(err, &berr) {
+		w.Header().Set("Retry-After", retryAfterHeader(berr.Delay))
+		w.Header().Set("X-Retry-In", berr.Delay.String())
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	var cerr *MaxConcurrencyError
+	if errors.As(err, &cerr) {
+		w.Header().Set("X-Concurrency-Limit", strconv.FormatInt(cerr.Max, 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	var caperr *CapacityError
+	if errors.As(err, &caperr) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
 	utils.DefaultHandler.ServeHTTP(w, req, err)
 }
 
@@ -207,4 +429,19 @@ func setDefaults(tl *TokenLimiter) {
 	if tl.errHandler == nil {
 		tl.errHandler = defaultErrHandler
 	}
+	if tl.prepaid <= 0 {
+		tl.prepaid = DefaultPrepaidAmount
+	}
+	if tl.maxPenalty <= 0 {
+		tl.maxPenalty = DefaultMaxPenalty
+	}
+	if tl.scaleFloor <= 0 {
+		tl.scaleFloor = DefaultAdaptiveScaleFloor
+	}
+	if tl.backpressureStatuses == nil {
+		tl.backpressureStatuses = make(map[int]struct{}, len(defaultBackpressureStatuses))
+		for _, code := range defaultBackpressureStatuses {
+			tl.backpressureStatuses[code] = struct{}{}
+		}
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -209,6 +210,115 @@ func TestExtractRates(t *testing.T) {
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 }
 
+// When the rates grow a longer period, the bucket set lives long enough to account for it.
+func TestExtractRates_longerPeriod(t *testing.T) {
+	var hourly atomic.Bool
+	extractRates := func(*http.Request) (*RateSet, error) {
+		rates := NewRateSet()
+		if err := rates.Add(clock.Second, 100, 100); err != nil {
+			return nil, err
+		}
+		if hourly.Load() {
+			if err := rates.Add(clock.Hour, 10, 10); err != nil {
+				return nil, err
+			}
+		}
+		return rates, nil
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	err := rates.Add(clock.Second, 100, 100)
+	require.NoError(t, err)
+
+	testutils.FreezeTime(t)
+
+	tl, err := New(handler, headerLimit, rates, ExtractRates(RateExtractorFunc(extractRates)))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tl)
+	t.Cleanup(srv.Close)
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// Most of the hourly quota is consumed.
+	hourly.Store(true)
+	for i := 0; i < 8; i++ {
+		re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+
+	// 15 minutes later, well past the TTL of the 1s rate, the hourly quota is still accounted for:
+	// 2 tokens were left, and 2.5 were refilled.
+	clock.Advance(15 * clock.Minute)
+	for i := 0; i < 4; i++ {
+		re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+}
+
+// When the rates shrink their longest period, the bucket set expires on the shorter schedule.
+func TestExtractRates_shorterPeriod(t *testing.T) {
+	var hourly atomic.Bool
+	hourly.Store(true)
+	extractRates := func(*http.Request) (*RateSet, error) {
+		rates := NewRateSet()
+		if err := rates.Add(clock.Second, 100, 100); err != nil {
+			return nil, err
+		}
+		if hourly.Load() {
+			if err := rates.Add(clock.Hour, 10, 10); err != nil {
+				return nil, err
+			}
+		}
+		return rates, nil
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	err := rates.Add(clock.Second, 100, 100)
+	require.NoError(t, err)
+
+	testutils.FreezeTime(t)
+
+	tl, err := New(handler, headerLimit, rates, ExtractRates(RateExtractorFunc(extractRates)))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tl)
+	t.Cleanup(srv.Close)
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	hourly.Store(false)
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	clock.Advance(10 * clock.Second)
+	_, ok := tl.bucketSets.Get("a")
+	assert.True(t, ok)
+
+	clock.Advance(2 * clock.Second)
+	_, ok = tl.bucketSets.Get("a")
+	assert.False(t, ok)
+}
+
 // If configMapper returns error, then the default rate is applied.
 func TestBadRateExtractor(t *testing.T) {
 	// Given
@@ -337,6 +447,99 @@ func TestOptions(t *testing.T) {
 	assert.Equal(t, http.StatusTeapot, re.StatusCode)
 }
 
+// The cost of a response is only known after serving it, the next request pays the debt.
+func TestPostConsume(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("0123456789"))
+	})
+
+	rates := NewRateSet()
+	err := rates.Add(clock.Second, 5, 5)
+	require.NoError(t, err)
+
+	testutils.FreezeTime(t)
+
+	var info ResponseInfo
+	l, err := New(handler, headerLimit, rates, PostConsume(func(_ *http.Request, resp ResponseInfo) int64 {
+		info = resp
+		return resp.BytesWritten
+	}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	t.Cleanup(srv.Close)
+
+	// The first request is not rejected, even if it costs more than the burst.
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, ResponseInfo{StatusCode: http.StatusOK, BytesWritten: 10}, info)
+
+	// 5 - 10 = -5 tokens: 6 tokens are missing for the next request.
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "1", re.Header.Get("Retry-After"))
+	assert.Equal(t, "1.2s", re.Header.Get("X-Retry-In"))
+
+	// Other sources are not affected.
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	clock.Advance(clock.Second)
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	clock.Advance(200 * clock.Millisecond)
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+}
+
+// A request costing less than the prepaid amount is not refunded.
+func TestPostConsume_prepaid(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	err := rates.Add(clock.Second, 1, 3)
+	require.NoError(t, err)
+
+	testutils.FreezeTime(t)
+
+	l, err := New(handler, headerLimit, rates,
+		PostConsume(func(*http.Request, ResponseInfo) int64 { return 0 }),
+		PrepaidAmount(2))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	t.Cleanup(srv.Close)
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "1s", re.Header.Get("X-Retry-In"))
+}
+
+func TestPostConsume_invalidOptions(t *testing.T) {
+	rates := NewRateSet()
+	err := rates.Add(clock.Second, 1, 1)
+	require.NoError(t, err)
+
+	_, err = New(nil, headerLimit, rates, PostConsume(nil))
+	require.Error(t, err)
+
+	_, err = New(nil, headerLimit, rates, PrepaidAmount(0))
+	require.Error(t, err)
+}
+
 func headerLimiter(req *http.Request) (string, int64, error) {
 	return req.Header.Get("Source"), 1, nil
 }
@@ -345,6 +548,113 @@ func faultyExtractor(_ *http.Request) (string, int64, error) {
 	return "", -1, errors.New("oops")
 }
 
+func TestAdaptiveScale(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 10, 10))
+
+	factor := 1.0
+	scaled, err := New(handler, headerLimit, rates, AdaptiveScale(func() float64 { return factor }))
+	require.NoError(t, err)
+
+	plain, err := New(handler, headerLimit, rates)
+	require.NoError(t, err)
+
+	// passed sends 40 requests over 2 seconds to both limiters, and returns the number of requests they let through.
+	passed := func() (int, int) {
+		var s, p int
+		for i := 0; i < 40; i++ {
+			for _, l := range []*TokenLimiter{scaled, plain} {
+				rw := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+				req.Header.Set("Source", "a")
+				l.ServeHTTP(rw, req)
+				if rw.Code != http.StatusOK {
+					assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+					continue
+				}
+				if l == scaled {
+					s++
+				} else {
+					p++
+				}
+			}
+			clock.Advance(50 * clock.Millisecond)
+		}
+		// The buckets are full again.
+		clock.Advance(clock.Second)
+		return s, p
+	}
+
+	// Standby.
+	s, p := passed()
+	assert.Equal(t, 29, p)
+	assert.Equal(t, p, s)
+
+	// Tripped: all the requests are throttled.
+	factor = 0
+	s, p = passed()
+	assert.Equal(t, 29, p)
+	assert.Equal(t, 0, s)
+
+	// Recovering: half the rate passes.
+	factor = 0.5
+	s, p = passed()
+	assert.Equal(t, 29, p)
+	assert.InDelta(t, p/2, s, 1)
+
+	// Back to standby.
+	factor = 1
+	s, p = passed()
+	assert.Equal(t, p, s)
+}
+
+func TestAdaptiveScale_fraction(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 100, 100))
+
+	// The fractions of tokens are carried over: 70% of the rate passes, not 50%.
+	l, err := New(handler, headerLimit, rates, AdaptiveScale(func() float64 { return 0.7 }))
+	require.NoError(t, err)
+
+	var passed int
+	for i := 0; i < 200; i++ {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.Header.Set("Source", "a")
+		l.ServeHTTP(rw, req)
+		if rw.Code == http.StatusOK {
+			passed++
+		}
+	}
+	assert.Equal(t, 70, passed)
+}
+
+func TestAdaptiveScale_invalidOptions(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 10, 10))
+
+	_, err := New(nil, headerLimit, rates, AdaptiveScale(nil))
+	require.Error(t, err)
+
+	_, err = New(nil, headerLimit, rates, AdaptiveScaleFloor(0))
+	require.Error(t, err)
+
+	_, err = New(nil, headerLimit, rates, AdaptiveScaleFloor(1.5))
+	require.Error(t, err)
+}
+
 var headerLimit = utils.ExtractorFunc(headerLimiter)
 
 var faultyExtract = utils.ExtractorFunc(faultyExtractor)
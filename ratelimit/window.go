@@ -0,0 +1,262 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// RateAlgorithm is the algorithm enforcing a rate, see Algorithm.
+type RateAlgorithm int
+
+const (
+	// TokenBucket lets the sources consume the tokens refilled at the average rate,
+	// up to the burst: the tokens accumulated while idle allow short bursts above the average.
+	TokenBucket RateAlgorithm = iota
+	// SlidingWindowLog admits a request only if fewer than average requests were admitted in the trailing period:
+	// a source never exceeds average requests in any window of the period, and the burst is ignored.
+	// The times of the requests of the trailing period are kept, at most average per source and period.
+	SlidingWindowLog
+)
+
+func (a RateAlgorithm) String() string {
+	switch a {
+	case TokenBucket:
+		return "TokenBucket"
+	case SlidingWindowLog:
+		return "SlidingWindowLog"
+	default:
+		return fmt.Sprintf("RateAlgorithm(%d)", int(a))
+	}
+}
+
+const (
+	// maxWindowUnits bounds the number of units of a period, so that the offsets of the log fit in an uint32.
+	maxWindowUnits = 1 << 30
+	// rebaseOffset is the offset from which the base of the log is moved forward.
+	rebaseOffset = 1 << 31
+)
+
+// windowLog implements the sliding window log algorithm: it keeps the times of the requests admitted
+// in the trailing period, in a ring buffer of at most limit entries.
+// The times are stored as uint32 offsets from a base, in units of the period, rounded up:
+// a request leaves the window once its time rounded up is a period old, never earlier.
+type windowLog struct {
+	period time.Duration
+	limit  int64
+	// unit is the resolution of the offsets, the smallest of 1ns, 1µs, 1ms or 1s fitting the period in maxWindowUnits.
+	unit time.Duration
+
+	base clock.Time
+	// times is the ring buffer of the offsets, from the oldest at head. It grows up to limit.
+	times []uint32
+	head  int
+	count int
+
+	// lastConsumed is the number of times recorded by the last consumption, for the rollback.
+	lastConsumed int
+}
+
+func newWindowLog(rate *rate) *windowLog {
+	unit := time.Nanosecond
+	for _, u := range []time.Duration{time.Microsecond, time.Millisecond, time.Second} {
+		if rate.period/unit <= maxWindowUnits {
+			break
+		}
+		unit = u
+	}
+
+	return &windowLog{
+		period: rate.period,
+		limit:  rate.average,
+		unit:   unit,
+		base:   clock.Now(),
+	}
+}
+
+// consume records the specified number of requests if fewer than limit would be in the window.
+// Otherwise, it returns the delay until enough requests leave the window.
+// An error is returned when the tokens exceed the limit.
+func (w *windowLog) consume(tokens int64) (time.Duration, error) {
+	w.lastConsumed = 0
+	if tokens > w.limit {
+		return UndefinedDelay, errors.New("requested tokens larger than max tokens")
+	}
+
+	elapsed := w.slide()
+	if missing := int64(w.count) + tokens - w.limit; missing > 0 {
+		// The request is admitted once the missing-th oldest request leaves the window.
+		return w.expiry(int(missing)-1) - elapsed, nil
+	}
+
+	w.record(elapsed, int(tokens))
+	w.lastConsumed = int(tokens)
+	return 0, nil
+}
+
+// rollback forgets the requests recorded by the most recent consumption.
+func (w *windowLog) rollback() {
+	w.count -= w.lastConsumed
+	w.lastConsumed = 0
+}
+
+// charge records the specified number of requests even if the window is full:
+// the oldest requests are replaced, which delays the following consumptions.
+func (w *windowLog) charge(tokens int64) {
+	w.lastConsumed = 0
+	if tokens <= 0 {
+		return
+	}
+	if tokens > w.limit {
+		tokens = w.limit
+	}
+	w.record(w.slide(), int(tokens))
+}
+
+// drain fills the window with requests made now.
+func (w *windowLog) drain() {
+	w.lastConsumed = 0
+	elapsed := w.slide()
+	w.record(elapsed, int(w.limit)-w.count)
+}
+
+// available returns the number of requests that can be admitted now.
+func (w *windowLog) available() int64 {
+	w.slide()
+	return w.limit - int64(w.count)
+}
+
+// update changes the limit of the log, the oldest requests over the new limit are forgotten.
+func (w *windowLog) update(rate *rate) error {
+	if rate.period != w.period {
+		return fmt.Errorf("period mismatch: %v != %v", w.period, rate.period)
+	}
+
+	w.limit = rate.average
+	w.lastConsumed = 0
+	if int64(len(w.times)) > w.limit {
+		if excess := w.count - int(w.limit); excess > 0 {
+			w.head = (w.head + excess) % len(w.times)
+			w.count -= excess
+		}
+		w.resize(int(w.limit))
+	}
+	return nil
+}
+
+// restore records the requests made at the given times in an empty log, the ones out of the window are ignored.
+func (w *windowLog) restore(times []clock.Time) {
+	sorted := make([]clock.Time, len(times))
+	copy(sorted, times)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+
+	// The times of the window are after the base.
+	w.base = clock.Now().Add(-w.period)
+	w.count = 0
+	elapsed := w.period
+
+	for _, t := range sorted {
+		age := clock.Since(t)
+		if age < 0 || age >= w.period || int64(w.count) >= w.limit {
+			continue
+		}
+		w.record(elapsed-age, 1)
+	}
+}
+
+// export returns the times of the requests in the window, from the oldest.
+func (w *windowLog) export() []clock.Time {
+	w.slide()
+	times := make([]clock.Time, 0, w.count)
+	for i := 0; i < w.count; i++ {
+		times = append(times, w.base.Add(time.Duration(w.at(i))*w.unit))
+	}
+	return times
+}
+
+// slide forgets the requests out of the window, and returns the time elapsed since the base.
+func (w *windowLog) slide() time.Duration {
+	elapsed := clock.Since(w.base)
+	// The clock went backwards: the requests are recorded at the base.
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	for w.count > 0 && w.expiry(0) <= elapsed {
+		w.head = (w.head + 1) % len(w.times)
+		w.count--
+	}
+
+	if elapsed/w.unit >= rebaseOffset {
+		elapsed = w.rebase(elapsed)
+	}
+	return elapsed
+}
+
+// rebase moves the base forward to the oldest request of the window, or to now when it is empty,
+// and returns the time elapsed since the new base.
+func (w *windowLog) rebase(elapsed time.Duration) time.Duration {
+	shift := uint32(elapsed / w.unit)
+	if w.count > 0 {
+		shift = w.at(0)
+	}
+	for i := 0; i < w.count; i++ {
+		w.times[(w.head+i)%len(w.times)] -= shift
+	}
+
+	d := time.Duration(shift) * w.unit
+	w.base = w.base.Add(d)
+	return elapsed - d
+}
+
+// expiry returns the time since the base when the i-th oldest request leaves the window.
+func (w *windowLog) expiry(i int) time.Duration {
+	return time.Duration(w.at(i))*w.unit + w.period
+}
+
+func (w *windowLog) at(i int) uint32 {
+	return w.times[(w.head+i)%len(w.times)]
+}
+
+// record adds n requests made at elapsed since the base, replacing the oldest ones when the log is full.
+func (w *windowLog) record(elapsed time.Duration, n int) {
+	// Rounded up, so that the requests never leave the window early.
+	offset := uint32((elapsed + w.unit - 1) / w.unit)
+
+	for i := 0; i < n; i++ {
+		if w.count == len(w.times) {
+			if int64(len(w.times)) < w.limit {
+				w.resize(w.grownSize())
+			} else {
+				w.head = (w.head + 1) % len(w.times)
+				w.count--
+			}
+		}
+		w.times[(w.head+w.count)%len(w.times)] = offset
+		w.count++
+	}
+}
+
+func (w *windowLog) grownSize() int {
+	size := 2 * len(w.times)
+	if size < 8 {
+		size = 8
+	}
+	if int64(size) > w.limit {
+		size = int(w.limit)
+	}
+	return size
+}
+
+// resize copies the requests of the log into a ring buffer of the given size, which must hold them.
+func (w *windowLog) resize(size int) {
+	times := make([]uint32, size)
+	for i := 0; i < w.count; i++ {
+		times[i] = w.at(i)
+	}
+	w.times = times
+	w.head = 0
+}
@@ -0,0 +1,273 @@
+package ratelimit
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestSlidingWindowLog(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Minute, 5, 100))
+
+	testutils.FreezeTime(t)
+
+	l, err := New(handler, headerLimit, rates, Algorithm(SlidingWindowLog))
+	require.NoError(t, err)
+
+	// The burst is ignored.
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+	}
+	rw := serve(l, "a", 0)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "60", rw.Header().Get("Retry-After"))
+
+	clock.Advance(59 * clock.Second)
+	rw = serve(l, "a", 0)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+
+	// Exactly one request leaves the window at a time.
+	clock.Advance(clock.Second)
+	assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+	assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+	assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+	assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+	assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+	rw = serve(l, "a", 0)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "60", rw.Header().Get("Retry-After"))
+
+	// The sources have their own windows.
+	assert.Equal(t, http.StatusOK, serve(l, "b", 0).Code)
+
+	state, ok := l.SourceState("a")
+	require.True(t, ok)
+	assert.Equal(t, map[time.Duration]int64{time.Minute: 0}, state.Available)
+}
+
+func TestSlidingWindowLog_mixed(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 1, 1))
+	require.NoError(t, rates.AddSlidingWindow(time.Minute, 5))
+
+	testutils.FreezeTime(t)
+
+	l, err := New(handler, headerLimit, rates)
+	require.NoError(t, err)
+
+	// The bucket limits the requests to one per second.
+	assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(l, "a", 0).Code)
+
+	for i := 0; i < 4; i++ {
+		clock.Advance(clock.Second)
+		assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+	}
+
+	// The window limits them to five per minute, the rejected requests are not recorded.
+	clock.Advance(clock.Second)
+	rw := serve(l, "a", 0)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "55", rw.Header().Get("Retry-After"))
+
+	clock.Advance(55 * clock.Second)
+	assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+}
+
+// referenceWindow is a naive sliding window log, keeping all the times of the admitted requests.
+type referenceWindow struct {
+	period time.Duration
+	limit  int64
+	times  []time.Duration
+}
+
+func (r *referenceWindow) consume(now time.Duration, tokens int64) time.Duration {
+	var inWindow []time.Duration
+	for _, t := range r.times {
+		if now-t < r.period {
+			inWindow = append(inWindow, t)
+		}
+	}
+	sort.Slice(inWindow, func(i, j int) bool { return inWindow[i] < inWindow[j] })
+
+	if missing := int64(len(inWindow)) + tokens - r.limit; missing > 0 {
+		return inWindow[missing-1] + r.period - now
+	}
+	for i := int64(0); i < tokens; i++ {
+		r.times = append(r.times, now)
+	}
+	return 0
+}
+
+func Test_windowLog_reference(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+
+		period := []time.Duration{time.Millisecond, 250 * time.Millisecond, time.Second, time.Minute}[rnd.Intn(4)]
+		limit := int64(1 + rnd.Intn(20))
+
+		testutils.FreezeTime(t)
+
+		w := newWindowLog(&rate{period: period, average: limit})
+		ref := &referenceWindow{period: period, limit: limit}
+
+		var now time.Duration
+		for i := 0; i < 2000; i++ {
+			step := time.Duration(rnd.Int63n(int64(period/5)+int64(time.Millisecond))) / time.Millisecond * time.Millisecond
+			clock.Advance(step)
+			now += step
+
+			tokens := int64(1 + rnd.Intn(3))
+			if tokens > limit {
+				tokens = limit
+			}
+
+			delay, err := w.consume(tokens)
+			require.NoError(t, err)
+			require.Equal(t, ref.consume(now, tokens), delay, "seed %d, period %v, limit %d, request %d at %v", seed, period, limit, i, now)
+			require.LessOrEqual(t, int64(len(w.times)), limit)
+		}
+	}
+}
+
+func Test_windowLog_rebase(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	// The offsets of a 1s period are in nanoseconds, the base moves forward every 2s or so.
+	w := newWindowLog(&rate{period: clock.Second, average: 2})
+	ref := &referenceWindow{period: clock.Second, limit: 2}
+
+	var now time.Duration
+	for i := 0; i < 100; i++ {
+		delay, err := w.consume(1)
+		require.NoError(t, err)
+		require.Equal(t, ref.consume(now, 1), delay, "request %d at %v", i, now)
+
+		clock.Advance(300 * clock.Millisecond)
+		now += 300 * clock.Millisecond
+	}
+	assert.Less(t, clock.Since(w.base), 3*clock.Second)
+}
+
+func Test_windowLog_rollback(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	w := newWindowLog(&rate{period: clock.Second, average: 3})
+
+	delay, err := w.consume(2)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+
+	w.rollback()
+	w.rollback()
+	assert.Equal(t, int64(3), w.available())
+
+	_, err = w.consume(4)
+	require.Error(t, err)
+}
+
+func Test_windowLog_charge(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	w := newWindowLog(&rate{period: clock.Second, average: 3})
+
+	_, err := w.consume(1)
+	require.NoError(t, err)
+
+	// The log never holds more than the limit.
+	clock.Advance(500 * clock.Millisecond)
+	w.charge(10)
+	assert.Len(t, w.times, 3)
+	assert.Equal(t, int64(0), w.available())
+
+	delay, err := w.consume(1)
+	require.NoError(t, err)
+	assert.Equal(t, clock.Second, delay)
+}
+
+func Test_windowLog_update(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	w := newWindowLog(&rate{period: clock.Second, average: 5})
+	for i := 0; i < 5; i++ {
+		_, err := w.consume(1)
+		require.NoError(t, err)
+		clock.Advance(100 * clock.Millisecond)
+	}
+
+	require.NoError(t, w.update(&rate{period: clock.Second, average: 2}))
+	assert.Len(t, w.times, 2)
+
+	// The newest requests are kept, the oldest one left is 200ms old.
+	delay, err := w.consume(1)
+	require.NoError(t, err)
+	assert.Equal(t, 800*clock.Millisecond, delay)
+
+	require.Error(t, w.update(&rate{period: clock.Minute, average: 2}))
+}
+
+func TestSlidingWindowLog_exportImportState(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 10, 10))
+	require.NoError(t, rates.AddSlidingWindow(time.Minute, 3))
+
+	testutils.FreezeTime(t)
+
+	l, err := New(handler, headerLimit, rates)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve(l, "a", 0).Code)
+		clock.Advance(10 * clock.Second)
+	}
+
+	var state bytes.Buffer
+	require.NoError(t, l.ExportState(&state))
+
+	clock.Advance(5 * clock.Second)
+
+	restored, err := New(handler, headerLimit, rates, ImportState(&state))
+	require.NoError(t, err)
+	assert.Zero(t, restored.Counters().StateEntriesSkipped)
+
+	// The first request leaves the window 60s after it was made.
+	rw := serve(restored, "a", 0)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "25", rw.Header().Get("Retry-After"))
+
+	clock.Advance(25 * clock.Second)
+	assert.Equal(t, http.StatusOK, serve(restored, "a", 0).Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(restored, "a", 0).Code)
+}
+
+func TestAlgorithm_invalid(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(clock.Second, 1, 1))
+
+	_, err := New(nil, headerLimit, rates, Algorithm(RateAlgorithm(7)))
+	require.Error(t, err)
+
+	require.Error(t, rates.AddSlidingWindow(clock.Second, 0))
+}
@@ -0,0 +1,58 @@
+package requestid
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// Option represents an option you can pass to New.
+type Option func(r *RequestID) error
+
+// Header sets the header carrying the ID of the requests, DefaultHeader by default.
+func Header(name string) Option {
+	return func(r *RequestID) error {
+		if name == "" {
+			return errors.New("request ID header name can't be empty")
+		}
+		r.header = http.CanonicalHeaderKey(name)
+		return nil
+	}
+}
+
+// Generator sets the function generating the ID of the requests without one, random IDs by default.
+// It is called concurrently, and must return a non-empty ID.
+func Generator(fn func() string) Option {
+	return func(r *RequestID) error {
+		if fn == nil {
+			return errors.New("request ID generator can't be nil")
+		}
+		r.generate = fn
+		return nil
+	}
+}
+
+// ErrorHandler sets error handler of the middleware.
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(r *RequestID) error {
+		r.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger used by the middleware.
+func Logger(l utils.Logger) Option {
+	return func(r *RequestID) error {
+		r.log = l
+		return nil
+	}
+}
+
+// Verbose additional debug information.
+func Verbose(verbose bool) Option {
+	return func(r *RequestID) error {
+		r.verbose = verbose
+		return nil
+	}
+}
@@ -0,0 +1,127 @@
+// Package requestid provides http.Handler middleware that ensures every request has an ID,
+// to correlate what the middlewares report about it.
+//
+// The ID of the request is read from its header, or generated when the header is missing or invalid.
+// It is set in the header of the request passed to the next handler, and so sent to the backends,
+// in the header of the response, and in the context of the request (see FromContext), where the other
+// middlewares find it: trace adds it to its records, buffer to its attempts and audit entries,
+// cbreaker to its fallback templates, and utils.ProblemHandler to its problem details.
+//
+// Examples of a RequestID middleware:
+//
+//	// the ID of the requests is read from and written to X-Request-Id.
+//	requestid.New(handler)
+//
+//	// the IDs are generated by the application.
+//	requestid.New(handler, requestid.Header("X-Correlation-Id"), requestid.Generator(newID))
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// DefaultHeader is the header carrying the ID of the requests, see Header.
+const DefaultHeader = "X-Request-Id"
+
+// maxLength is the maximum length of the IDs read from the requests.
+const maxLength = 128
+
+// RequestID is a middleware that ensures every request has an ID.
+type RequestID struct {
+	next       http.Handler
+	errHandler utils.ErrorHandler
+
+	header   string
+	generate func() string
+
+	verbose bool
+	log     utils.Logger
+}
+
+// New creates a new RequestID middleware.
+// By default, the ID of the requests is read from the DefaultHeader, and a random ID is generated when it is missing.
+// next can be nil, and set later with Wrap.
+func New(next http.Handler, options ...Option) (*RequestID, error) {
+	r := &RequestID{
+		next:     next,
+		header:   DefaultHeader,
+		generate: randomID,
+		log:      &utils.NoopLogger{},
+	}
+
+	for _, o := range options {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.errHandler == nil {
+		r.errHandler = utils.DefaultHandler
+	}
+	return r, nil
+}
+
+// Wrap sets the next handler to be called by the middleware, when it was created without.
+func (r *RequestID) Wrap(next http.Handler) error {
+	if err := utils.CheckWrap(r.next, next); err != nil {
+		return err
+	}
+	r.next = next
+	return nil
+}
+
+func (r *RequestID) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.next == nil {
+		utils.ServeError(r.errHandler, w, req, "requestid", &utils.ErrNotWired{Middleware: "requestid"})
+		return
+	}
+
+	id := req.Header.Get(r.header)
+	if !valid(id) {
+		id = r.generate()
+		if r.verbose && utils.DebugEnabled(r.log) {
+			r.log.Debug("vulcand/oxy/requestid: generated ID %s for %s %s", id, req.Method, req.URL)
+		}
+	}
+
+	outReq := req.WithContext(utils.WithRequestID(req.Context(), id))
+	outReq.Header = req.Header.Clone()
+	if outReq.Header == nil {
+		outReq.Header = make(http.Header)
+	}
+	outReq.Header.Set(r.header, id)
+
+	w.Header().Set(r.header, id)
+
+	r.next.ServeHTTP(w, outReq)
+}
+
+// FromContext returns the ID of the request carried by ctx, set by the RequestID middleware.
+func FromContext(ctx context.Context) (string, bool) {
+	return utils.RequestIDFromContext(ctx)
+}
+
+// valid reports whether id can be passed on: a non-empty string of at most maxLength visible ASCII characters.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// randomID returns 16 random bytes, hex encoded.
+func randomID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,87 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen, seenHeader string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen, _ = FromContext(req.Context())
+		seenHeader = req.Header.Get(DefaultHeader)
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	m, err := New(next, Generator(func() string { return "generated" }))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc     string
+		incoming string
+		expected string
+	}{
+		{desc: "missing", expected: "generated"},
+		{desc: "kept", incoming: "abc-123", expected: "abc-123"},
+		{desc: "space", incoming: "abc 123", expected: "generated"},
+		{desc: "control character", incoming: "abc\x01", expected: "generated"},
+		{desc: "too long", incoming: strings.Repeat("a", 129), expected: "generated"},
+		{desc: "max length", incoming: strings.Repeat("a", 128), expected: strings.Repeat("a", 128)},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			seen, seenHeader = "", ""
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.incoming != "" {
+				req.Header.Set(DefaultHeader, test.incoming)
+			}
+
+			rw := httptest.NewRecorder()
+			m.ServeHTTP(rw, req)
+
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.Equal(t, test.expected, seen)
+			assert.Equal(t, test.expected, seenHeader)
+			assert.Equal(t, test.expected, rw.Header().Get(DefaultHeader))
+
+			// The request of the caller is not modified.
+			assert.Equal(t, test.incoming, req.Header.Get(DefaultHeader))
+		})
+	}
+}
+
+func TestRequestID_header(t *testing.T) {
+	var seen string
+	next := http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		seen = req.Header.Get("X-Correlation-Id")
+	})
+
+	m, err := New(next, Header("x-correlation-id"))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(DefaultHeader, "ignored")
+
+	rw := httptest.NewRecorder()
+	m.ServeHTTP(rw, req)
+
+	// A random ID is generated.
+	assert.Len(t, seen, 32)
+	assert.Equal(t, seen, rw.Header().Get("X-Correlation-Id"))
+	assert.Empty(t, rw.Header().Get(DefaultHeader))
+}
+
+func TestRequestID_invalidOptions(t *testing.T) {
+	_, err := New(nil, Header(""))
+	require.Error(t, err)
+
+	_, err = New(nil, Generator(nil))
+	require.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package roundrobin
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/segmentio/fasthash/fnv1a"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// affinityBalancer is implemented by the balancers selecting the servers by hashing an attribute of the requests,
+// e.g. RoundRobin with EnableHashAffinity.
+type affinityBalancer interface {
+	affinityOptions(req *http.Request) []NextOption
+}
+
+// affinityOptions returns the options selecting the server of the request by hashing its affinity key, if any.
+func (r *RoundRobin) affinityOptions(req *http.Request) []NextOption {
+	if r.hashAffinity == nil {
+		return nil
+	}
+
+	key, _, err := r.hashAffinity.Extract(req)
+	if err != nil {
+		r.log.Debug("vulcand/oxy/roundrobin/rr: no affinity key: %v", err)
+		return nil
+	}
+	if key == "" {
+		return nil
+	}
+	return []NextOption{HashKey(key)}
+}
+
+// affinityOptions returns the affinity options of the balancer, if it supports it.
+func affinityOptions(b BalancerHandler, req *http.Request) []NextOption {
+	if ab, ok := b.(affinityBalancer); ok {
+		return ab.affinityOptions(req)
+	}
+	return nil
+}
+
+// hashServer selects the server of key among the candidates by weighted rendezvous (highest random weight) hashing:
+// each server gets a score from the hash of the key and of its URL, scaled by its weight, and the highest score wins.
+// Only the keys of a removed server move, and they are spread over the other servers according to their weights.
+func (r *RoundRobin) hashServer(key string, candidates []*server) (*server, error) {
+	if candidates == nil {
+		candidates = r.servers
+	}
+
+	var best *server
+	bestScore := 0.0
+	now := clock.Now()
+	for _, srv := range candidates {
+		if srv.weight == 0 {
+			continue
+		}
+
+		// -weight/ln(h) with h uniform in (0, 1): the probability to win is proportional to the weight.
+		h := (float64(mix64(fnv1a.AddString64(fnv1a.HashString64(key), srv.id))>>11) + 0.5) / (1 << 53)
+		score := -float64(srv.effectiveWeight(now)) / math.Log(h)
+		if best == nil || score > bestScore {
+			best, bestScore = srv, score
+		}
+	}
+
+	if best == nil {
+		return nil, ErrAllServersZeroWeight
+	}
+	return best, nil
+}
+
+// mix64 is the finalizer of splitmix64, it spreads the bits of the FNV hash.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
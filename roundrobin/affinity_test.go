@@ -0,0 +1,214 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/testutils"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+func deviceIDExtractor(t *testing.T) utils.SourceExtractor {
+	t.Helper()
+
+	extract, err := utils.NewExtractor("request.header.X-Device-Id")
+	require.NoError(t, err)
+	return extract
+}
+
+// hashedHosts returns the host selected for each of n keys.
+func hashedHosts(t *testing.T, lb *RoundRobin, n int) map[string]string {
+	t.Helper()
+
+	hosts := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("device-%d", i)
+		u, err := lb.NextServerWith(context.Background(), HashKey(key))
+		require.NoError(t, err)
+		hosts[key] = u.Host
+	}
+	return hosts
+}
+
+func TestRoundRobin_hashAffinity(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+	c := testutils.NewResponder(t, "c")
+
+	lb, err := New(forward.New(false), EnableHashAffinity(deviceIDExtractor(t)))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(c.URL)))
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	var first string
+	for i := 0; i < 100; i++ {
+		_, body, err := testutils.Get(proxy.URL, testutils.Header("X-Device-Id", "phone-42"))
+		require.NoError(t, err)
+		if i == 0 {
+			first = string(body)
+		}
+		require.Equal(t, first, string(body))
+	}
+
+	// The requests without device ID follow the rotation, which the hashed requests did not move.
+	assert.Equal(t, []string{"a", "b", "c", "a"}, seq(t, proxy.URL, 4))
+}
+
+func TestRoundRobin_hashAffinityRotation(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+
+	lb, err := New(forward.New(false), EnableHashAffinity(deviceIDExtractor(t)))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	assert.Equal(t, []string{"a", "b", "a"}, seq(t, proxy.URL, 3))
+}
+
+func TestRoundRobin_hashAffinityRemoveServer(t *testing.T) {
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	for _, host := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://"+host)))
+	}
+
+	before := hashedHosts(t, lb, 1000)
+
+	require.NoError(t, lb.RemoveServer(testutils.MustParseRequestURI("http://b")))
+
+	after := hashedHosts(t, lb, 1000)
+
+	var moved int
+	for key, host := range before {
+		if host != "b" {
+			assert.Equal(t, host, after[key], key)
+			continue
+		}
+		moved++
+		assert.NotEqual(t, "b", after[key], key)
+	}
+	assert.InDelta(t, 250, moved, 50)
+}
+
+func TestRoundRobin_hashAffinityWeights(t *testing.T) {
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	c := testutils.MustParseRequestURI("http://c")
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(a, Weight(3)))
+	require.NoError(t, lb.UpsertServer(b, Weight(1)))
+	require.NoError(t, lb.UpsertServer(c))
+	// A server added with a zero weight gets the default weight.
+	require.NoError(t, lb.UpsertServer(c, Weight(0)))
+
+	counts := make(map[string]int)
+	for _, host := range hashedHosts(t, lb, 4000) {
+		counts[host]++
+	}
+	assert.Zero(t, counts["c"])
+	assert.InDelta(t, 3000, counts["a"], 150)
+	assert.InDelta(t, 1000, counts["b"], 150)
+
+	// The excluded servers are never selected.
+	u, err := lb.NextServerWith(context.Background(), HashKey("device-0"), Exclude(a))
+	require.NoError(t, err)
+	assert.Equal(t, "b", u.Host)
+
+	require.NoError(t, lb.UpsertServer(a, Weight(0)))
+	require.NoError(t, lb.UpsertServer(b, Weight(0)))
+	_, err = lb.NextServerWith(context.Background(), HashKey("device-0"))
+	require.ErrorIs(t, err, ErrAllServersZeroWeight)
+}
+
+func TestRoundRobin_hashAffinityStickyCookie(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+
+	lb, err := New(forward.New(false), EnableHashAffinity(deviceIDExtractor(t)), EnableStickySession(NewStickySession("test")))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	_, body, err := testutils.Get(proxy.URL, testutils.Header("X-Device-Id", "phone-42"))
+	require.NoError(t, err)
+
+	other := a.URL
+	if string(body) == "a" {
+		other = b.URL
+	}
+
+	// The cookie wins over the hash.
+	_, cookieBody, err := testutils.Get(proxy.URL,
+		testutils.Header("X-Device-Id", "phone-42"),
+		testutils.Header("Cookie", (&http.Cookie{Name: "test", Value: other}).String()))
+	require.NoError(t, err)
+	assert.NotEqual(t, string(body), string(cookieBody))
+}
+
+func TestRebalancer_hashAffinity(t *testing.T) {
+	lb, err := New(forward.New(false), EnableHashAffinity(deviceIDExtractor(t)))
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(lb)
+	require.NoError(t, err)
+
+	var hosts []*url.URL
+	for _, name := range []string{"a", "b", "c"} {
+		srv := testutils.NewResponder(t, name)
+		u := testutils.MustParseRequestURI(srv.URL)
+		hosts = append(hosts, u)
+		require.NoError(t, rb.UpsertServer(u))
+	}
+
+	proxy := httptest.NewServer(rb)
+	t.Cleanup(proxy.Close)
+
+	_, first, err := testutils.Get(proxy.URL, testutils.Header("X-Device-Id", "phone-42"))
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, body, err := testutils.Get(proxy.URL, testutils.Header("X-Device-Id", "phone-42"))
+		require.NoError(t, err)
+		require.Equal(t, string(first), string(body))
+	}
+
+	// The rebalancer adjusts the weights of the servers of lb with weightPermille: they are the hashing weights.
+	counts := make(map[string]int)
+	for _, host := range hashedHosts(t, lb, 3000) {
+		counts[host]++
+	}
+	for _, u := range hosts {
+		assert.InDelta(t, 1000, counts[u.Host], 150, u.Host)
+	}
+
+	require.NoError(t, lb.UpsertServer(hosts[0], weightPermille(4*weightScale)))
+	counts = make(map[string]int)
+	for _, host := range hashedHosts(t, lb, 3000) {
+		counts[host]++
+	}
+	assert.InDelta(t, 2000, counts[hosts[0].Host], 150)
+}
@@ -0,0 +1,114 @@
+package roundrobin
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DebugRoutingConfig configures the routing of the requests by headers, see DebugRouting.
+type DebugRoutingConfig struct {
+	// PinHeader is the header naming the server the request is sent to, e.g. "X-Oxy-Pin".
+	PinHeader string
+	// ExcludeHeader is the header listing the servers the request can't be sent to, separated by commas, e.g. "X-Oxy-Exclude".
+	ExcludeHeader string
+	// Authorize reports whether the request can be routed by the headers, e.g. because it comes from an on-call engineer.
+	Authorize func(*http.Request) bool
+}
+
+// debugRouting routes the authorized requests by headers.
+type debugRouting struct {
+	pinHeader     string
+	excludeHeader string
+	authorize     func(*http.Request) bool
+}
+
+func newDebugRouting(cfg DebugRoutingConfig) (*debugRouting, error) {
+	if cfg.Authorize == nil {
+		return nil, errors.New("debug routing authorize can't be nil")
+	}
+	if cfg.PinHeader == "" && cfg.ExcludeHeader == "" {
+		return nil, errors.New("debug routing needs a pin or an exclude header")
+	}
+	return &debugRouting{
+		pinHeader:     http.CanonicalHeaderKey(cfg.PinHeader),
+		excludeHeader: http.CanonicalHeaderKey(cfg.ExcludeHeader),
+		authorize:     cfg.Authorize,
+	}, nil
+}
+
+// debugRoute is the routing requested by the headers of a request.
+type debugRoute struct {
+	// pin is the value of the pin header, empty when the request is not pinned.
+	pin     string
+	exclude []*url.URL
+}
+
+func (d *debugRoute) excluded(u *url.URL) bool {
+	for _, e := range d.exclude {
+		if sameURL(e, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the routing requested by req, and strips the headers from newReq, the request sent downstream.
+// The headers of the requests failing Authorize are ignored.
+func (d *debugRouting) route(req, newReq *http.Request, clonedHeader bool) debugRoute {
+	pin := d.values(req, d.pinHeader)
+	exclude := d.values(req, d.excludeHeader)
+	if len(pin) == 0 && len(exclude) == 0 {
+		return debugRoute{}
+	}
+
+	if !clonedHeader {
+		newReq.Header = newReq.Header.Clone()
+	}
+	if d.pinHeader != "" {
+		newReq.Header.Del(d.pinHeader)
+	}
+	if d.excludeHeader != "" {
+		newReq.Header.Del(d.excludeHeader)
+	}
+
+	if !d.authorize(req) {
+		return debugRoute{}
+	}
+
+	var route debugRoute
+	if len(pin) > 0 {
+		route.pin = strings.TrimSpace(pin[0])
+	}
+	for _, value := range exclude {
+		for _, raw := range strings.Split(value, ",") {
+			if u, err := url.Parse(strings.TrimSpace(raw)); err == nil && u.Host != "" {
+				route.exclude = append(route.exclude, u)
+			}
+		}
+	}
+	return route
+}
+
+func (d *debugRouting) values(req *http.Request, header string) []string {
+	if header == "" {
+		return nil
+	}
+	return req.Header.Values(header)
+}
+
+// pinnedServer returns the server named by pin, by its URL (see NormalizeURL).
+func (r *RoundRobin) pinnedServer(pin string) (*url.URL, error) {
+	u, err := url.Parse(pin)
+	if err != nil || u.Host == "" {
+		return nil, &ErrPinnedServerNotFound{Server: pin}
+	}
+
+	for _, srv := range r.Servers() {
+		if sameURL(srv, u) {
+			return srv, nil
+		}
+	}
+	return nil, &ErrPinnedServerNotFound{Server: pin}
+}
@@ -0,0 +1,181 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+var debugRoutingConfig = DebugRoutingConfig{
+	PinHeader:     "X-Oxy-Pin",
+	ExcludeHeader: "X-Oxy-Exclude",
+	Authorize: func(req *http.Request) bool {
+		return req.Header.Get("X-On-Call") == "secret"
+	},
+}
+
+// debugBackend answers its name, and records the headers it received.
+type debugBackend struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	headers []http.Header
+}
+
+func newDebugBackend(t *testing.T, name string) *debugBackend {
+	t.Helper()
+
+	b := &debugBackend{}
+	b.Server = testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		b.mu.Lock()
+		b.headers = append(b.headers, req.Header.Clone())
+		b.mu.Unlock()
+		_, _ = w.Write([]byte(name))
+	})
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *debugBackend) received() []http.Header {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.headers
+}
+
+func newDebugRoutingProxy(t *testing.T, opts []LBOption, backends ...*debugBackend) string {
+	t.Helper()
+
+	lb, err := New(forward.New(false), append([]LBOption{DebugRouting(debugRoutingConfig)}, opts...)...)
+	require.NoError(t, err)
+
+	for _, backend := range backends {
+		require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(backend.URL)))
+	}
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	return proxy.URL
+}
+
+func TestDebugRouting_pin(t *testing.T) {
+	a := newDebugBackend(t, "a")
+	b := newDebugBackend(t, "b")
+	c := newDebugBackend(t, "c")
+
+	proxyURL := newDebugRoutingProxy(t, nil, a, b, c)
+
+	// The pin names the server by its URL, in any form identifying it.
+	for _, pin := range []string{c.URL, c.URL + "/", "HTTP://" + testutils.MustParseRequestURI(c.URL).Host} {
+		re, body, err := testutils.Get(proxyURL, testutils.Header("X-Oxy-Pin", pin), testutils.Header("X-On-Call", "secret"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "c", string(body))
+	}
+
+	require.Len(t, c.received(), 3)
+	for _, h := range c.received() {
+		assert.Empty(t, h.Values("X-Oxy-Pin"))
+	}
+	assert.Empty(t, a.received())
+	assert.Empty(t, b.received())
+}
+
+func TestDebugRouting_pinNotFound(t *testing.T) {
+	a := newDebugBackend(t, "a")
+
+	proxyURL := newDebugRoutingProxy(t, nil, a)
+
+	for _, pin := range []string{"http://10.0.0.1:8080", "node-3"} {
+		re, _, err := testutils.Get(proxyURL, testutils.Header("X-Oxy-Pin", pin), testutils.Header("X-On-Call", "secret"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, re.StatusCode)
+	}
+	assert.Empty(t, a.received())
+}
+
+func TestDebugRouting_unauthorized(t *testing.T) {
+	a := newDebugBackend(t, "a")
+	b := newDebugBackend(t, "b")
+
+	proxyURL := newDebugRoutingProxy(t, nil, a, b)
+
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		re, body, err := testutils.Get(proxyURL,
+			testutils.Header("X-Oxy-Pin", b.URL),
+			testutils.Header("X-Oxy-Exclude", a.URL),
+			testutils.Header("X-On-Call", "guess"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		bodies = append(bodies, string(body))
+	}
+
+	// The headers are ignored, and stripped.
+	assert.Equal(t, []string{"a", "b", "a", "b"}, bodies)
+	for _, h := range append(a.received(), b.received()...) {
+		assert.Empty(t, h.Values("X-Oxy-Pin"))
+		assert.Empty(t, h.Values("X-Oxy-Exclude"))
+	}
+}
+
+func TestDebugRouting_exclude(t *testing.T) {
+	a := newDebugBackend(t, "a")
+	b := newDebugBackend(t, "b")
+	c := newDebugBackend(t, "c")
+
+	proxyURL := newDebugRoutingProxy(t, nil, a, b, c)
+
+	get := func(opts ...testutils.ReqOption) string {
+		re, body, err := testutils.Get(proxyURL, opts...)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, re.StatusCode)
+		return string(body)
+	}
+
+	assert.Equal(t, "a", get())
+
+	// b is next in the rotation, the request goes to the following server.
+	exclude := []testutils.ReqOption{testutils.Header("X-Oxy-Exclude", b.URL+", http://10.0.0.1"), testutils.Header("X-On-Call", "secret")}
+	assert.Equal(t, "c", get(exclude...))
+	for _, h := range c.received() {
+		assert.Empty(t, h.Values("X-Oxy-Exclude"))
+	}
+
+	// The exclusion is for that request only.
+	assert.Equal(t, "b", get())
+}
+
+func TestDebugRouting_excludeSticky(t *testing.T) {
+	a := newDebugBackend(t, "a")
+	b := newDebugBackend(t, "b")
+
+	proxyURL := newDebugRoutingProxy(t, []LBOption{EnableStickySession(NewStickySession("sticky"))}, a, b)
+
+	re, body, err := testutils.Get(proxyURL)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(body))
+	require.Len(t, re.Cookies(), 1)
+	cookie := re.Cookies()[0]
+
+	_, body, err = testutils.Get(proxyURL,
+		testutils.Header("Cookie", cookie.Name+"="+cookie.Value),
+		testutils.Header("X-Oxy-Exclude", a.URL),
+		testutils.Header("X-On-Call", "secret"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(body))
+}
+
+func TestDebugRouting_invalid(t *testing.T) {
+	_, err := New(nil, DebugRouting(DebugRoutingConfig{PinHeader: "X-Oxy-Pin"}))
+	require.Error(t, err)
+
+	_, err = New(nil, DebugRouting(DebugRoutingConfig{Authorize: func(*http.Request) bool { return true }}))
+	require.Error(t, err)
+}
@@ -0,0 +1,82 @@
+package roundrobin
+
+import (
+	"net/url"
+
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// DecisionReason is the reason of a weight change of the rebalancer, see Decision.
+type DecisionReason string
+
+// Reasons of the weight changes.
+const (
+	// DecisionMarkedGood is the increase of the weights of the servers rated better than the others.
+	DecisionMarkedGood DecisionReason = "marked-good"
+	// DecisionConverge is the return of the weights towards their original values, once the servers are rated alike.
+	DecisionConverge DecisionReason = "converge"
+	// DecisionReset is the reset of the weights to their original values, when the servers change.
+	DecisionReset DecisionReason = "reset"
+)
+
+// Decision is a weight change of the rebalancer, see RebalancerDecisionLog.
+type Decision struct {
+	URL *url.URL
+	// OldWeightPermille and NewWeightPermille are the weights of the server before and after the change, in thousandths of Weight.
+	OldWeightPermille int
+	NewWeightPermille int
+	// Rating is the rating of the server when the change was decided, see Meter.
+	Rating float64
+	Reason DecisionReason
+	// DryRun is set when the change is not applied to the wrapped balancer, see RebalancerDryRun.
+	DryRun bool
+}
+
+// SetDryRun enables or disables the dry run, see RebalancerDryRun.
+// The weights computed during the dry run are applied to the wrapped balancer as soon as it is disabled.
+func (rb *Rebalancer) SetDryRun(dryRun bool) {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	if rb.dryRun == dryRun {
+		return
+	}
+	rb.dryRun = dryRun
+	if !dryRun {
+		rb.applyWeights()
+	}
+}
+
+// currentWeights returns the current weights of the servers, nil without decision log.
+func (rb *Rebalancer) currentWeights(servers []*rbServer) []int {
+	if rb.decisionLog == nil {
+		return nil
+	}
+
+	weights := make([]int, len(servers))
+	for i, srv := range servers {
+		weights[i] = srv.curWeight
+	}
+	return weights
+}
+
+// logDecisions calls the decision log with the servers whose weight changed from the old weights returned by currentWeights.
+func (rb *Rebalancer) logDecisions(servers []*rbServer, old []int, reason DecisionReason) {
+	if rb.decisionLog == nil {
+		return
+	}
+
+	for i, srv := range servers {
+		if srv.curWeight == old[i] {
+			continue
+		}
+		rb.decisionLog(Decision{
+			URL:               utils.CopyURL(srv.url),
+			OldWeightPermille: old[i],
+			NewWeightPermille: srv.curWeight,
+			Rating:            srv.meter.Rating(),
+			Reason:            reason,
+			DryRun:            rb.dryRun,
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package roundrobin
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// newDecisionRebalancer creates a rebalancer of two servers logging its decisions, the first one rated worse than the second.
+func newDecisionRebalancer(t *testing.T, opts ...RebalancerOption) (*RoundRobin, *Rebalancer, *[]Decision, string) {
+	t.Helper()
+
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+
+	lb, err := New(forward.New(false))
+	require.NoError(t, err)
+
+	var decisions []Decision
+	opts = append(opts,
+		RebalancerMeter(func() (Meter, error) { return &testMeter{}, nil }),
+		RebalancerDecisionLog(func(d Decision) { decisions = append(decisions, d) }),
+	)
+	rb, err := NewRebalancer(lb, opts...)
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+
+	rb.servers[0].meter.(*testMeter).rating = 0.3
+
+	proxy := httptest.NewServer(rb)
+	t.Cleanup(proxy.Close)
+
+	return lb, rb, &decisions, proxy.URL
+}
+
+// adjustmentCycle sends requests to the rebalancer, and waits for the backoff.
+func adjustmentCycle(t *testing.T, rb *Rebalancer, proxyURL string) {
+	t.Helper()
+
+	for i := 0; i < 2; i++ {
+		_, _, err := testutils.Get(proxyURL)
+		require.NoError(t, err)
+	}
+	clock.Advance(rb.backoffDuration + clock.Second)
+}
+
+func innerWeights(lb *RoundRobin) []int {
+	return []int{lb.servers[0].weight, lb.servers[1].weight}
+}
+
+func TestRebalancer_dryRun(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, rb, decisions, proxyURL := newDecisionRebalancer(t, RebalancerDryRun(true))
+
+	for i := 0; i < 6; i++ {
+		adjustmentCycle(t, rb, proxyURL)
+	}
+
+	// The weights are computed, not applied.
+	assert.Equal(t, FSMMaxWeight*weightScale, rb.servers[1].curWeight)
+	assert.Equal(t, []int{weightScale, weightScale}, innerWeights(lb))
+
+	require.NotEmpty(t, *decisions)
+	last := (*decisions)[len(*decisions)-1]
+	assert.Equal(t, rb.servers[1].url.String(), last.URL.String())
+	assert.Equal(t, FSMMaxWeight*weightScale, last.NewWeightPermille)
+	assert.Equal(t, DecisionMarkedGood, last.Reason)
+	assert.True(t, last.DryRun)
+	for _, d := range *decisions {
+		assert.True(t, d.DryRun)
+		assert.Equal(t, DecisionMarkedGood, d.Reason)
+	}
+
+	// Enforcing applies the computed weights at once.
+	rb.SetDryRun(false)
+	assert.Equal(t, []int{weightScale, FSMMaxWeight * weightScale}, innerWeights(lb))
+
+	// The next adjustments are applied, and logged as such.
+	rb.servers[0].meter.(*testMeter).rating = 0
+	n := len(*decisions)
+	adjustmentCycle(t, rb, proxyURL)
+
+	require.Greater(t, len(*decisions), n)
+	d := (*decisions)[n]
+	assert.Equal(t, DecisionConverge, d.Reason)
+	assert.False(t, d.DryRun)
+	assert.Equal(t, []int{weightScale, d.NewWeightPermille}, innerWeights(lb))
+}
+
+func TestRebalancer_decisionLog(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, rb, decisions, proxyURL := newDecisionRebalancer(t)
+
+	// The weights follow the decisions.
+	weights := map[string]int{}
+	for _, srv := range rb.servers {
+		weights[srv.url.String()] = srv.origWeight
+	}
+	trajectory := func() []int {
+		for _, d := range *decisions {
+			assert.Equal(t, weights[d.URL.String()], d.OldWeightPermille)
+			assert.False(t, d.DryRun)
+			weights[d.URL.String()] = d.NewWeightPermille
+		}
+		*decisions = nil
+		return []int{weights[rb.servers[0].url.String()], weights[rb.servers[1].url.String()]}
+	}
+
+	var reasons []DecisionReason
+	recordReasons := func() {
+		for _, d := range *decisions {
+			reasons = append(reasons, d.Reason)
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		adjustmentCycle(t, rb, proxyURL)
+		recordReasons()
+		assert.Equal(t, innerWeights(lb), trajectory())
+	}
+	assert.Equal(t, []int{weightScale, FSMMaxWeight * weightScale}, innerWeights(lb))
+
+	rb.servers[0].meter.(*testMeter).rating = 0
+	for i := 0; i < 6; i++ {
+		adjustmentCycle(t, rb, proxyURL)
+		recordReasons()
+		assert.Equal(t, innerWeights(lb), trajectory())
+	}
+	assert.Equal(t, []int{weightScale, weightScale}, innerWeights(lb))
+	assert.Contains(t, reasons, DecisionMarkedGood)
+	assert.Contains(t, reasons, DecisionConverge)
+
+	// The changes of the servers reset the weights.
+	rb.servers[0].meter.(*testMeter).rating = 0.3
+	adjustmentCycle(t, rb, proxyURL)
+	require.NotEmpty(t, *decisions)
+
+	c := testutils.NewResponder(t, "c")
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(c.URL)))
+
+	last := (*decisions)[len(*decisions)-1]
+	assert.Equal(t, DecisionReset, last.Reason)
+	assert.Equal(t, weightScale, last.NewWeightPermille)
+	assert.Equal(t, innerWeights(lb), trajectory())
+}
+
+func TestRebalancer_dryRunReset(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, rb, decisions, proxyURL := newDecisionRebalancer(t, RebalancerDryRun(true))
+	adjustmentCycle(t, rb, proxyURL)
+	require.NotEmpty(t, *decisions)
+
+	u, err := url.Parse(lb.servers[0].url.String())
+	require.NoError(t, err)
+	require.NoError(t, rb.UpsertServer(u, Weight(2)))
+
+	last := (*decisions)[len(*decisions)-1]
+	assert.Equal(t, DecisionReset, last.Reason)
+	assert.True(t, last.DryRun)
+	// The inner balancer gets the weight set with UpsertServer only.
+	assert.Equal(t, []int{2 * weightScale, weightScale}, innerWeights(lb))
+}
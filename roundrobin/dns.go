@@ -0,0 +1,165 @@
+package roundrobin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// Resolver resolves the hostnames of the servers added with DNSServer.
+// *net.Resolver implements this interface.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSEvent reports a resolution of a server added with DNSServer which changed its addresses or failed, see OnDNSEvent.
+type DNSEvent struct {
+	// Server is the URL of the server, with its hostname.
+	Server *url.URL
+	// Added and Removed are the servers added and removed by the resolution, with the resolved addresses.
+	Added   []*url.URL
+	Removed []*url.URL
+	// Err is the error of the resolution, the servers of the last successful resolution are kept.
+	Err error
+}
+
+// dnsTimeout bounds the resolutions of the hostnames.
+const dnsTimeout = 10 * time.Second
+
+// dnsServer is a server added with DNSServer, balanced as one server per address of its hostname.
+type dnsServer struct {
+	url     *url.URL
+	refresh time.Duration
+	// options are the options of the servers of the addresses, the host override included.
+	options []ServerOption
+
+	// servers are the URLs of the servers of the addresses, by IP.
+	// They are only accessed by the resolution in progress.
+	servers map[string]*url.URL
+
+	// lastResolve and resolving are guarded by the mutex of the RoundRobin.
+	lastResolve clock.Time
+	resolving   bool
+}
+
+func newDNSServer(u *url.URL, refresh time.Duration, opts []ServerOption) (*dnsServer, error) {
+	if err := validateServerURL(u); err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("server URL %s has no hostname", u.Redacted())
+	}
+	if refresh <= 0 {
+		return nil, fmt.Errorf("invalid refresh interval: %v", refresh)
+	}
+
+	options := make([]ServerOption, 0, len(opts)+1)
+	options = append(options, opts...)
+	options = append(options, HostOverride(u.Host))
+
+	return &dnsServer{
+		url:     utils.CopyURL(u),
+		refresh: refresh,
+		options: options,
+		servers: make(map[string]*url.URL),
+	}, nil
+}
+
+// addressURL returns the URL of the server of ip: the URL of d with ip as host, the port being kept.
+func (d *dnsServer) addressURL(ip net.IP) *url.URL {
+	u := utils.CopyURL(d.url)
+	if port := d.url.Port(); port != "" {
+		u.Host = net.JoinHostPort(ip.String(), port)
+	} else if ip.To4() == nil {
+		u.Host = "[" + ip.String() + "]"
+	} else {
+		u.Host = ip.String()
+	}
+	return u
+}
+
+// staleDNSServers marks the servers added with DNSServer due for a resolution, and returns them.
+// It must be called with the mutex held.
+func (r *RoundRobin) staleDNSServers(now clock.Time) []*dnsServer {
+	var stale []*dnsServer
+	for _, d := range r.dnsServers {
+		if !d.resolving && now.Sub(d.lastResolve) >= d.refresh {
+			d.resolving = true
+			stale = append(stale, d)
+		}
+	}
+	return stale
+}
+
+// resolve resolves the hostname of d, and replaces the servers of the addresses which changed.
+// The servers are kept when the resolution fails. d must have been marked as resolving.
+func (r *RoundRobin) resolve(d *dnsServer) {
+	host := d.url.Hostname()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	cancel()
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses")
+	}
+
+	event := DNSEvent{Server: utils.CopyURL(d.url)}
+	if err != nil {
+		event.Err = fmt.Errorf("failed to resolve %s: %w", host, err)
+		r.log.Warn("vulcand/oxy/roundrobin/rr: %v, keeping its %d servers", event.Err, len(d.servers))
+	} else {
+		event.Added, event.Removed = r.applyAddresses(d, addrs)
+	}
+
+	r.mutex.Lock()
+	d.resolving = false
+	d.lastResolve = clock.Now()
+	r.mutex.Unlock()
+
+	if r.dnsListener != nil && (event.Err != nil || len(event.Added) > 0 || len(event.Removed) > 0) {
+		r.dnsListener(event)
+	}
+}
+
+// applyAddresses removes the servers of the addresses of d which are not in addrs, and adds the new ones.
+// The servers of the unchanged addresses are left as they are, with their weights and state.
+func (r *RoundRobin) applyAddresses(d *dnsServer, addrs []net.IPAddr) (added, removed []*url.URL) {
+	resolved := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		resolved[addr.IP.String()] = true
+	}
+
+	for ip, u := range d.servers {
+		if resolved[ip] {
+			continue
+		}
+		// The server may have been removed with RemoveServer already.
+		_ = r.RemoveServer(u)
+		delete(d.servers, ip)
+		removed = append(removed, u)
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Host < removed[j].Host })
+
+	for _, addr := range addrs {
+		ip := addr.IP.String()
+		if _, ok := d.servers[ip]; ok {
+			continue
+		}
+
+		u := d.addressURL(addr.IP)
+		if err := r.UpsertServer(u, d.options...); err != nil {
+			r.log.Error("vulcand/oxy/roundrobin/rr: failed to add server %s of %s: %v", u, d.url.Hostname(), err)
+			continue
+		}
+		d.servers[ip] = u
+		added = append(added, u)
+	}
+	return added, removed
+}
@@ -0,0 +1,240 @@
+package roundrobin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// fakeResolver resolves the hostnames to the addresses set with set.
+type fakeResolver struct {
+	mu    sync.Mutex
+	addrs map[string][]net.IPAddr
+	err   error
+}
+
+func (f *fakeResolver) set(host string, err error, ips ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.addrs == nil {
+		f.addrs = make(map[string][]net.IPAddr)
+	}
+	f.addrs[host] = nil
+	for _, ip := range ips {
+		f.addrs[host] = append(f.addrs[host], net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	f.err = err
+}
+
+func (f *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.addrs[host], nil
+}
+
+// hostRecorder records the hosts of the requests, and their host overrides.
+type hostRecorder struct {
+	mu        sync.Mutex
+	hosts     []string
+	overrides []string
+}
+
+func (h *hostRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	override, _ := forward.HostOverrideFromContext(req.Context())
+
+	h.mu.Lock()
+	h.hosts = append(h.hosts, req.URL.Host)
+	h.overrides = append(h.overrides, override)
+	h.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func serversOf(lb *RoundRobin) []string {
+	var hosts []string
+	for _, u := range lb.Servers() {
+		hosts = append(hosts, u.Host)
+	}
+	return hosts
+}
+
+func TestDNSServer(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	resolver := &fakeResolver{}
+	resolver.set("api-pool.internal", nil, "10.0.0.1", "10.0.0.2", "10.0.0.3")
+
+	next := &hostRecorder{}
+	lb, err := New(next,
+		DNSResolver(resolver),
+		DNSServer(testutils.MustParseRequestURI("http://api-pool.internal:8080"), clock.Minute, Labels(map[string]string{"pool": "api"})))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}, serversOf(lb))
+
+	for i := 0; i < 6; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/", nil))
+	}
+
+	assert.Equal(t, []string{
+		"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080",
+		"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080",
+	}, next.hosts)
+	for _, override := range next.overrides {
+		assert.Equal(t, "api-pool.internal:8080", override)
+	}
+}
+
+func TestDNSServer_refresh(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	resolver := &fakeResolver{}
+	resolver.set("api-pool.internal", nil, "10.0.0.1", "10.0.0.2", "10.0.0.3")
+
+	events := make(chan DNSEvent, 10)
+	lb, err := New(&hostRecorder{},
+		DNSResolver(resolver),
+		OnDNSEvent(func(e DNSEvent) { events <- e }),
+		DNSServer(testutils.MustParseRequestURI("http://api-pool.internal:8080"), clock.Minute))
+	require.NoError(t, err)
+
+	initial := <-events
+	assert.Len(t, initial.Added, 3)
+	assert.Empty(t, initial.Removed)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://10.0.0.2:8080"), Weight(5)))
+	resolver.set("api-pool.internal", nil, "10.0.0.2", "10.0.0.3", "10.0.0.4")
+
+	// The addresses are kept until the refresh.
+	clock.Advance(59 * clock.Second)
+	_, err = lb.NextServer()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}, serversOf(lb))
+
+	clock.Advance(clock.Second)
+	_, err = lb.NextServer()
+	require.NoError(t, err)
+
+	var e DNSEvent
+	select {
+	case e = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hostname was not resolved again")
+	}
+	require.NoError(t, e.Err)
+	assert.Equal(t, "http://api-pool.internal:8080", e.Server.String())
+	require.Len(t, e.Added, 1)
+	assert.Equal(t, "http://10.0.0.4:8080", e.Added[0].String())
+	require.Len(t, e.Removed, 1)
+	assert.Equal(t, "http://10.0.0.1:8080", e.Removed[0].String())
+
+	// The unchanged servers keep their weights.
+	assert.Equal(t, []string{"10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.4:8080"}, serversOf(lb))
+	w, ok := lb.ServerWeight(testutils.MustParseRequestURI("http://10.0.0.2:8080"))
+	require.True(t, ok)
+	assert.Equal(t, 5, w)
+}
+
+func TestDNSServer_failure(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	resolver := &fakeResolver{}
+	resolver.set("api-pool.internal", nil, "10.0.0.1", "10.0.0.2")
+
+	events := make(chan DNSEvent, 10)
+	lb, err := New(&hostRecorder{},
+		DNSResolver(resolver),
+		OnDNSEvent(func(e DNSEvent) { events <- e }),
+		DNSServer(testutils.MustParseRequestURI("http://api-pool.internal:8080"), clock.Minute))
+	require.NoError(t, err)
+	<-events
+
+	resolver.set("api-pool.internal", errors.New("server misbehaving"))
+
+	clock.Advance(clock.Minute)
+	_, err = lb.NextServer()
+	require.NoError(t, err)
+
+	var e DNSEvent
+	select {
+	case e = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failure was not reported")
+	}
+	require.Error(t, e.Err)
+	assert.Contains(t, e.Err.Error(), "server misbehaving")
+	assert.Empty(t, e.Added)
+	assert.Empty(t, e.Removed)
+
+	// The last known addresses are kept.
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, serversOf(lb))
+}
+
+func TestDNSServer_hostHeader(t *testing.T) {
+	backend := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(req.Host))
+	})
+	t.Cleanup(backend.Close)
+
+	port := testutils.MustParseRequestURI(backend.URL).Port()
+
+	resolver := &fakeResolver{}
+	resolver.set("api-pool.internal", nil, "127.0.0.1")
+
+	lb, err := New(forward.New(false),
+		DNSResolver(resolver),
+		DNSServer(testutils.MustParseRequestURI("http://api-pool.internal:"+port), clock.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:" + port}, serversOf(lb))
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "api-pool.internal:"+port, string(body))
+}
+
+func TestDNSServer_addressURL(t *testing.T) {
+	d, err := newDNSServer(testutils.MustParseRequestURI("https://api-pool.internal/v1"), clock.Minute, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "https://10.0.0.1/v1", d.addressURL(net.ParseIP("10.0.0.1")).String())
+	assert.Equal(t, "https://[fd00::1]/v1", d.addressURL(net.ParseIP("fd00::1")).String())
+
+	d, err = newDNSServer(testutils.MustParseRequestURI("http://api-pool.internal:8080"), clock.Minute, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "http://[fd00::1]:8080", d.addressURL(net.ParseIP("fd00::1")).String())
+}
+
+func TestDNSServer_invalid(t *testing.T) {
+	_, err := New(nil, DNSServer(testutils.MustParseRequestURI("http://api-pool.internal"), 0))
+	require.Error(t, err)
+
+	_, err = New(nil, DNSServer(testutils.MustParseRequestURI("http://api-pool.internal/?a=b"), clock.Minute))
+	require.Error(t, err)
+
+	_, err = New(nil, DNSServer(testutils.MustParseRequestURI("file:///tmp"), clock.Minute))
+	require.Error(t, err)
+
+	_, err = New(nil, DNSResolver(nil))
+	require.Error(t, err)
+}
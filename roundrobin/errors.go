@@ -0,0 +1,108 @@
+package roundrobin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// The errors of the selection of a server are passed to the error handler of the load balancers,
+// which can tell them apart with errors.Is and errors.As.
+// The default error handler answers 500 to ErrNoServers and ErrAllServersZeroWeight,
+// 400 to ErrCookieInvalid (only passed with FailOnInvalidCookie), 404 to ErrPinnedServerNotFound,
+// 503 with a Retry-After header to ErrSendRateLimited, and 503 to ErrNoEligibleServers.
+
+// ErrNoServers indicates that there are no servers registered for the given Backend.
+var ErrNoServers = errors.New("no servers in the pool")
+
+// ErrAllServersZeroWeight indicates that all the servers of the pool have a zero weight.
+var ErrAllServersZeroWeight = errors.New("all servers have 0 weight")
+
+// ErrStickyTargetGone indicates that the sticky cookie does not point to one of the servers of the pool,
+// e.g. because its server was removed: the load balancers select another server,
+// and pass the error to the function set with StickySession.OnTargetGone.
+type ErrStickyTargetGone struct {
+	// Target is the server of the cookie, nil when the cookie value does not reveal it (e.g. stickycookie.HashValue).
+	Target *url.URL
+}
+
+func (e *ErrStickyTargetGone) Error() string {
+	if e.Target == nil {
+		return "sticky cookie points to an unknown server"
+	}
+	return fmt.Sprintf("sticky cookie points to an unknown server: %s", e.Target)
+}
+
+// ErrCookieInvalid indicates that the sticky cookie can't be decoded, e.g. it was tampered with or it expired.
+// The load balancers select another server, unless FailOnInvalidCookie is set.
+type ErrCookieInvalid struct {
+	Cause error
+}
+
+func (e *ErrCookieInvalid) Error() string {
+	return fmt.Sprintf("invalid sticky cookie: %v", e.Cause)
+}
+
+func (e *ErrCookieInvalid) Unwrap() error {
+	return e.Cause
+}
+
+// ErrPinnedServerNotFound indicates that the pin header of an authorized request names a server
+// which is not in the pool, see DebugRouting.
+type ErrPinnedServerNotFound struct {
+	// Server is the value of the pin header.
+	Server string
+}
+
+func (e *ErrPinnedServerNotFound) Error() string {
+	return fmt.Sprintf("pinned server not found: %q", e.Server)
+}
+
+// ErrSendRateLimited indicates that the servers a request could be sent to have all reached their send rate, see SendRate.
+type ErrSendRateLimited struct {
+	// RetryAfter is the time until one of the servers admits a request.
+	RetryAfter time.Duration
+}
+
+func (e *ErrSendRateLimited) Error() string {
+	return fmt.Sprintf("servers send rate reached: retry-in %v", e.RetryAfter)
+}
+
+var defaultErrHandler utils.ErrorHandler = utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+	var errCookie *ErrCookieInvalid
+	if errors.As(err, &errCookie) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+		return
+	}
+
+	var errPinned *ErrPinnedServerNotFound
+	if errors.As(err, &errPinned) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusNotFound)))
+		return
+	}
+
+	var errLimited *ErrSendRateLimited
+	if errors.As(err, &errLimited) {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(errLimited.RetryAfter.Seconds())), 10))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+		return
+	}
+
+	var errNoEligible *ErrNoEligibleServers
+	if errors.As(err, &errNoEligible) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+		return
+	}
+
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+})
@@ -0,0 +1,205 @@
+package roundrobin
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/roundrobin/stickycookie"
+	"github.com/vulcand/oxy/v2/testutils"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// hostHandler answers with the host of the selected server.
+var hostHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	_, _ = w.Write([]byte(req.URL.Host))
+})
+
+// recordingErrHandler records the errors passed to the error handler, and answers with the default error handler.
+type recordingErrHandler struct {
+	errs []error
+}
+
+func (h *recordingErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	h.errs = append(h.errs, err)
+	defaultErrHandler.ServeHTTP(w, req, err)
+}
+
+func serveWithCookie(handler http.Handler, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestRoundRobin_errNoServers(t *testing.T) {
+	errHandler := &recordingErrHandler{}
+	lb, err := New(hostHandler, ErrorHandler(errHandler))
+	require.NoError(t, err)
+
+	rw := serveWithCookie(lb, nil)
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	require.Len(t, errHandler.errs, 1)
+	assert.ErrorIs(t, errHandler.errs[0], ErrNoServers)
+}
+
+func TestRoundRobin_errAllServersZeroWeight(t *testing.T) {
+	errHandler := &recordingErrHandler{}
+	lb, err := New(hostHandler, ErrorHandler(errHandler))
+	require.NoError(t, err)
+	// A new server gets the default weight, an existing one can be set to 0.
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a")))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a"), Weight(0)))
+
+	rw := serveWithCookie(lb, nil)
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	require.Len(t, errHandler.errs, 1)
+	assert.ErrorIs(t, errHandler.errs[0], ErrAllServersZeroWeight)
+}
+
+func TestRoundRobin_errCookieInvalid(t *testing.T) {
+	value, err := stickycookie.NewAESValue([]byte("95Bx9JkKX3xbd7z3"), 5*clock.Second)
+	require.NoError(t, err)
+	cookie := &http.Cookie{Name: "test", Value: "tampered"}
+
+	// By default, another server is selected.
+	errHandler := &recordingErrHandler{}
+	lb, err := New(hostHandler, ErrorHandler(errHandler), EnableStickySession(NewStickySession("test").SetCookieValue(value)))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a")))
+
+	rw := serveWithCookie(lb, cookie)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "a", rw.Body.String())
+	assert.Empty(t, errHandler.errs)
+
+	lb, err = New(hostHandler, ErrorHandler(errHandler), EnableStickySession(NewStickySession("test").SetCookieValue(value)),
+		FailOnInvalidCookie(true))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a")))
+
+	rw = serveWithCookie(lb, cookie)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	require.Len(t, errHandler.errs, 1)
+	var errCookie *ErrCookieInvalid
+	require.ErrorAs(t, errHandler.errs[0], &errCookie)
+	assert.Error(t, errCookie.Cause)
+
+	// The valid cookies are still used.
+	rw = serveWithCookie(lb, &http.Cookie{Name: "test", Value: value.Get(testutils.MustParseRequestURI("http://a"))})
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Len(t, errHandler.errs, 1)
+}
+
+func TestRebalancer_errCookieInvalid(t *testing.T) {
+	value, err := stickycookie.NewAESValue([]byte("95Bx9JkKX3xbd7z3"), 5*clock.Second)
+	require.NoError(t, err)
+
+	lb, err := New(hostHandler)
+	require.NoError(t, err)
+
+	var received error
+	rb, err := NewRebalancer(lb,
+		RebalancerStickySession(NewStickySession("test").SetCookieValue(value)),
+		RebalancerFailOnInvalidCookie(true),
+		RebalancerErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+			received = err
+			defaultErrHandler.ServeHTTP(w, req, err)
+		})))
+	require.NoError(t, err)
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI("http://a")))
+
+	rw := serveWithCookie(rb, &http.Cookie{Name: "test", Value: "tampered"})
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	var errCookie *ErrCookieInvalid
+	assert.ErrorAs(t, received, &errCookie)
+}
+
+func TestRoundRobin_errStickyTargetGone(t *testing.T) {
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+
+	var gone []*ErrStickyTargetGone
+	sticky := NewStickySession("test").OnTargetGone(func(_ *http.Request, err *ErrStickyTargetGone) {
+		gone = append(gone, err)
+	})
+	errHandler := &recordingErrHandler{}
+	lb, err := New(hostHandler, ErrorHandler(errHandler), EnableStickySession(sticky), FailOnInvalidCookie(true))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(a))
+
+	cookie := &http.Cookie{Name: "test", Value: b.String()}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.AddCookie(cookie)
+	_, present, err := sticky.getBackend(req, lb.Servers())
+	assert.False(t, present)
+	var errGone *ErrStickyTargetGone
+	require.ErrorAs(t, err, &errGone)
+	assert.Equal(t, b, errGone.Target)
+
+	// GetBackend does not report the missing servers as errors.
+	_, present, err = sticky.GetBackend(req, lb.Servers())
+	require.NoError(t, err)
+	assert.False(t, present)
+
+	// Another server is selected, even with FailOnInvalidCookie.
+	rw := serveWithCookie(lb, cookie)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "a", rw.Body.String())
+	assert.Empty(t, errHandler.errs)
+
+	// The missing server is reported to OnTargetGone.
+	require.Len(t, gone, 1)
+	assert.Equal(t, b, gone[0].Target)
+}
+
+func TestRebalancer_errStickyTargetGone(t *testing.T) {
+	lb, err := New(hostHandler)
+	require.NoError(t, err)
+
+	var gone []*ErrStickyTargetGone
+	sticky := NewStickySession("test").OnTargetGone(func(_ *http.Request, err *ErrStickyTargetGone) {
+		gone = append(gone, err)
+	})
+	rb, err := NewRebalancer(lb, RebalancerStickySession(sticky))
+	require.NoError(t, err)
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI("http://a")))
+
+	rw := serveWithCookie(rb, &http.Cookie{Name: "test", Value: "http://b"})
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "a", rw.Body.String())
+
+	require.Len(t, gone, 1)
+	assert.Equal(t, testutils.MustParseRequestURI("http://b"), gone[0].Target)
+}
+
+func TestErrStickyTargetGone_error(t *testing.T) {
+	err := error(&ErrStickyTargetGone{})
+	assert.Equal(t, "sticky cookie points to an unknown server", err.Error())
+
+	err = &ErrCookieInvalid{Cause: errors.New("boom")}
+	assert.Equal(t, "invalid sticky cookie: boom", err.Error())
+	assert.Equal(t, "boom", errors.Unwrap(err).Error())
+}
+
+func TestRoundRobin_errNotWired(t *testing.T) {
+	errHandler := &recordingErrHandler{}
+	lb, err := New(nil, ErrorHandler(errHandler))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a")))
+
+	rw := serveWithCookie(lb, nil)
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	require.Len(t, errHandler.errs, 1)
+	var errNotWired *utils.ErrNotWired
+	require.ErrorAs(t, errHandler.errs[0], &errNotWired)
+	assert.Equal(t, "roundrobin", errNotWired.Middleware)
+}
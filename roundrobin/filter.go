@@ -0,0 +1,353 @@
+package roundrobin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// The names of the built-in filters of the selection chain, see BuiltinFilter.
+const (
+	// FilterExclude removes the servers excluded by the Exclude option, and fails with ErrNoServers if none is left.
+	FilterExclude = "exclude"
+	// FilterTier keeps the servers of the first tier having some, see Tier.
+	FilterTier = "tier"
+	// FilterLabels keeps the servers matching the PreferLabel options, or all of them if none matches.
+	FilterLabels = "labels"
+	// FilterSendRate removes the servers having reached their SendRate, and fails with ErrSendRateLimited if none is left.
+	FilterSendRate = "sendrate"
+)
+
+// ServerView is a read-only view of a server of the load balancer, passed to the SelectionFilter functions.
+type ServerView struct {
+	// URL is the URL the server was added with, it must not be modified.
+	URL *url.URL
+	// WeightPermille is the weight of the server in thousandths, see ServerWeightPermille.
+	WeightPermille int
+	// Labels are the labels of the server, see Labels. They must not be modified.
+	Labels map[string]string
+	// Tier is the priority tier of the server, see Tier.
+	Tier int
+	// InFlight is the number of requests passed to the server by ServeHTTP and not answered yet.
+	InFlight int64
+	// WarmingUp reports whether the weight of the server is still ramping up, see WarmUp.
+	WarmingUp bool
+	// SendRateLimited reports whether the server has reached its SendRate.
+	SendRateLimited bool
+
+	srv *server
+}
+
+// SelectionFilterFunc returns the candidates a request can be sent to, a subset of candidates.
+// It is called with the mutex of the load balancer held, for every selection: it must be cheap,
+// must not call the load balancer, and must not retain the candidates, which are reused.
+// req is nil when the selection is not made for a request, see ForRequest.
+type SelectionFilterFunc func(req *http.Request, candidates []ServerView) []ServerView
+
+// ErrNoEligibleServers indicates that a SelectionFilter removed all the candidates of a selection.
+type ErrNoEligibleServers struct {
+	// Filter is the name of the filter.
+	Filter string
+}
+
+func (e *ErrNoEligibleServers) Error() string {
+	return fmt.Sprintf("no eligible servers: all removed by the %q filter", e.Filter)
+}
+
+// ForRequest passes the request the server is selected for to the SelectionFilter functions.
+// ServeHTTP passes its request.
+func ForRequest(req *http.Request) NextOption {
+	return func(o *nextOptions) {
+		o.req = req
+	}
+}
+
+// SelectionFilter adds a filter to the selection chain: the weighted selection runs over the servers kept by the chain,
+// and the selection fails with an ErrNoEligibleServers naming the filter that removed all of them.
+// The filters run in the order of the options. By default, the user filters run after the built-in filters
+// FilterExclude, FilterTier and FilterLabels, and before FilterSendRate, so that a server is only skipped
+// for its send rate if the filters would keep it. BuiltinFilter places a built-in filter elsewhere in the chain,
+// e.g. before a filter excluding a zone to fail over to the next tier when the zone is the active tier:
+//
+//	roundrobin.New(fwd,
+//		roundrobin.SelectionFilter("zone", excludeZone),
+//		roundrobin.BuiltinFilter(roundrobin.FilterTier),
+//	)
+//
+// The requests stuck to a server by a cookie are not filtered.
+// The InFlight counts of the servers are only tracked with a SelectionFilter.
+func SelectionFilter(name string, fn SelectionFilterFunc) LBOption {
+	return func(r *RoundRobin) error {
+		if fn == nil {
+			return errors.New("selection filter can't be nil")
+		}
+		if name == "" || builtinFilters[name] != nil {
+			return fmt.Errorf("invalid selection filter name: %q", name)
+		}
+		return r.addFilter(&selectionFilter{name: name, fn: fn})
+	}
+}
+
+// BuiltinFilter places the built-in filter name (FilterExclude, FilterTier, FilterLabels or FilterSendRate)
+// at this position of the selection chain, see SelectionFilter.
+func BuiltinFilter(name string) LBOption {
+	return func(r *RoundRobin) error {
+		f := builtinFilters[name]
+		if f == nil {
+			return fmt.Errorf("unknown built-in selection filter: %q", name)
+		}
+		return r.addFilter(f)
+	}
+}
+
+// selectionFilter is a filter of the selection chain: a built-in filter, or a user filter calling fn.
+type selectionFilter struct {
+	name string
+	fn   SelectionFilterFunc
+
+	// active reports whether the built-in filter may remove a server from the selection.
+	active func(r *RoundRobin, o *nextOptions) bool
+	// apply returns the candidates kept by the built-in filter, reusing the candidates slice.
+	apply func(r *RoundRobin, o *nextOptions, candidates []*server) ([]*server, error)
+}
+
+var (
+	excludeFilter = &selectionFilter{
+		name:   FilterExclude,
+		active: func(_ *RoundRobin, o *nextOptions) bool { return len(o.exclude) > 0 },
+		apply:  applyExclude,
+	}
+	tierFilter = &selectionFilter{
+		name:   FilterTier,
+		active: func(r *RoundRobin, _ *nextOptions) bool { return r.tiered },
+		apply:  applyTier,
+	}
+	labelsFilter = &selectionFilter{
+		name:   FilterLabels,
+		active: func(_ *RoundRobin, o *nextOptions) bool { return len(o.labels) > 0 },
+		apply:  applyLabels,
+	}
+	sendRateFilter = &selectionFilter{
+		name:   FilterSendRate,
+		active: func(r *RoundRobin, _ *nextOptions) bool { return r.paced.Load() },
+		apply:  applySendRate,
+	}
+
+	builtinFilters = map[string]*selectionFilter{
+		FilterExclude:  excludeFilter,
+		FilterTier:     tierFilter,
+		FilterLabels:   labelsFilter,
+		FilterSendRate: sendRateFilter,
+	}
+
+	// defaultFilters is the selection chain without user filters.
+	defaultFilters = []*selectionFilter{excludeFilter, tierFilter, labelsFilter, sendRateFilter}
+)
+
+// addFilter appends f to the selection chain set by the options.
+func (r *RoundRobin) addFilter(f *selectionFilter) error {
+	for _, existing := range r.filters {
+		if existing.name == f.name {
+			return fmt.Errorf("duplicate selection filter: %q", f.name)
+		}
+	}
+	r.filters = append(r.filters, f)
+	return nil
+}
+
+// initFilters completes the selection chain set by the options with the built-in filters not placed by BuiltinFilter.
+func (r *RoundRobin) initFilters() {
+	if len(r.filters) == 0 {
+		r.filters = defaultFilters
+		return
+	}
+
+	placed := make(map[string]bool, len(r.filters))
+	for _, f := range r.filters {
+		placed[f.name] = true
+		r.filtered = r.filtered || f.fn != nil
+	}
+
+	var chain []*selectionFilter
+	for _, f := range []*selectionFilter{excludeFilter, tierFilter, labelsFilter} {
+		if !placed[f.name] {
+			chain = append(chain, f)
+		}
+	}
+	chain = append(chain, r.filters...)
+	if !placed[FilterSendRate] {
+		chain = append(chain, sendRateFilter)
+	}
+	r.filters = chain
+}
+
+// filterServers runs the selection chain, and returns the candidates of the selection, nil meaning all the servers.
+// Only the servers with a non-zero weight are candidates, so that a server is always selected.
+func (r *RoundRobin) filterServers(o *nextOptions) ([]*server, error) {
+	// None of the filters can remove a server.
+	if !r.filtered && len(o.exclude) == 0 && len(o.labels) == 0 && !r.tiered && !r.paced.Load() {
+		return nil, nil
+	}
+
+	var candidates []*server
+	for _, f := range r.filters {
+		if f.fn == nil && !f.active(r, o) {
+			continue
+		}
+
+		if candidates == nil {
+			candidates = make([]*server, 0, len(r.servers))
+			for _, srv := range r.servers {
+				if srv.weight != 0 {
+					candidates = append(candidates, srv)
+				}
+			}
+			if len(candidates) == 0 {
+				if len(o.exclude) == 0 && len(o.labels) == 0 {
+					return nil, ErrAllServersZeroWeight
+				}
+				return nil, ErrNoServers
+			}
+		}
+
+		var err error
+		if f.fn != nil {
+			candidates = r.applyUserFilter(f, o.req, candidates)
+		} else {
+			candidates, err = f.apply(r, o, candidates)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(candidates) == 0 {
+			return nil, &ErrNoEligibleServers{Filter: f.name}
+		}
+	}
+	return candidates, nil
+}
+
+// applyUserFilter passes the views of the candidates to the filter, and returns the candidates it kept.
+func (r *RoundRobin) applyUserFilter(f *selectionFilter, req *http.Request, candidates []*server) []*server {
+	now := clock.Now()
+	paced := r.paced.Load()
+
+	views := make([]ServerView, len(candidates))
+	for i, srv := range candidates {
+		views[i] = ServerView{
+			URL:             srv.url,
+			WeightPermille:  srv.weight,
+			Labels:          srv.labels,
+			Tier:            srv.tier,
+			InFlight:        srv.inFlight.Load(),
+			WarmingUp:       srv.effectiveWeight(now) != srv.weight,
+			SendRateLimited: paced && srv.sendRate != nil && srv.sendRate.Delay() > 0,
+			srv:             srv,
+		}
+	}
+
+	out := candidates[:0]
+	for _, v := range f.fn(req, views) {
+		if v.srv != nil {
+			out = append(out, v.srv)
+		}
+	}
+	return out
+}
+
+func applyExclude(_ *RoundRobin, o *nextOptions, candidates []*server) ([]*server, error) {
+	out := candidates[:0]
+	for _, srv := range candidates {
+		if !o.excluded(srv.url) {
+			out = append(out, srv)
+		}
+	}
+	if len(out) == 0 {
+		return nil, ErrNoServers
+	}
+	return out, nil
+}
+
+// applyTier keeps the candidates of the first tier having some, see tierOrder.
+func applyTier(r *RoundRobin, _ *nextOptions, candidates []*server) ([]*server, error) {
+	for _, tier := range r.tierOrder() {
+		if !hasServer(candidates, func(srv *server) bool { return srv.tier == tier }) {
+			continue
+		}
+
+		out := candidates[:0]
+		for _, srv := range candidates {
+			if srv.tier == tier {
+				out = append(out, srv)
+			}
+		}
+		return out, nil
+	}
+	return candidates, nil
+}
+
+// applyLabels keeps the candidates matching the labels, or all of them if none matches.
+func applyLabels(_ *RoundRobin, o *nextOptions, candidates []*server) ([]*server, error) {
+	if !hasServer(candidates, o.preferred) {
+		return candidates, nil
+	}
+
+	out := candidates[:0]
+	for _, srv := range candidates {
+		if o.preferred(srv) {
+			out = append(out, srv)
+		}
+	}
+	return out, nil
+}
+
+// applySendRate keeps the candidates whose send rate admits a request now, see SendRate.
+// When the candidates have all reached their send rate,
+// it returns an ErrSendRateLimited with the time until the first of them admits a request.
+func applySendRate(_ *RoundRobin, _ *nextOptions, candidates []*server) ([]*server, error) {
+	out := candidates[:0]
+	var retryAfter time.Duration
+	for _, srv := range candidates {
+		if srv.sendRate != nil {
+			if delay := srv.sendRate.Delay(); delay > 0 {
+				if retryAfter == 0 || delay < retryAfter {
+					retryAfter = delay
+				}
+				continue
+			}
+		}
+		out = append(out, srv)
+	}
+
+	if len(out) == 0 {
+		return nil, &ErrSendRateLimited{RetryAfter: retryAfter}
+	}
+	return out, nil
+}
+
+// trackInFlight counts the request passed to the server u until done is called, see ServerView.
+func (r *RoundRobin) trackInFlight(u *url.URL) (done func()) {
+	r.mutex.Lock()
+	srv, _ := r.findServerByURL(u)
+	r.mutex.Unlock()
+
+	if srv == nil {
+		return func() {}
+	}
+
+	srv.inFlight.Add(1)
+	return func() { srv.inFlight.Add(-1) }
+}
+
+// hasServer reports whether one of the servers matches.
+func hasServer(servers []*server, match func(*server) bool) bool {
+	for _, srv := range servers {
+		if match(srv) {
+			return true
+		}
+	}
+	return false
+}
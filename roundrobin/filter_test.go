@@ -0,0 +1,223 @@
+package roundrobin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// excludeLabel returns a filter removing the servers having the label key=value.
+func excludeLabel(key, value string) SelectionFilterFunc {
+	return func(_ *http.Request, candidates []ServerView) []ServerView {
+		var out []ServerView
+		for _, v := range candidates {
+			if v.Labels[key] != value {
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+}
+
+func TestRoundRobin_selectionFilter(t *testing.T) {
+	lb, err := New(nil, SelectionFilter("no-canary", excludeLabel("track", "canary")))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a"), Labels(map[string]string{"track": "canary"})))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://b")))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://c"), Tier(1)))
+
+	// The tier filter keeps a and b, the canary a is then removed.
+	assert.Equal(t, map[string]int{"http://b": 100}, selections(t, lb, 100))
+
+	// The filters compose with the options: without b, the tier filter keeps a, which is then removed.
+	_, err = lb.NextServerWith(context.Background(), Exclude(testutils.MustParseRequestURI("http://b")))
+
+	var errNoEligible *ErrNoEligibleServers
+	require.ErrorAs(t, err, &errNoEligible)
+	assert.Equal(t, "no-canary", errNoEligible.Filter)
+}
+
+func TestRoundRobin_selectionFilterOrder(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		options  []LBOption
+		expected string
+	}{
+		{
+			desc:    "filter after the tier",
+			options: []LBOption{SelectionFilter("no-canary", excludeLabel("track", "canary"))},
+		},
+		{
+			desc: "filter before the tier",
+			options: []LBOption{
+				SelectionFilter("no-canary", excludeLabel("track", "canary")),
+				BuiltinFilter(FilterTier),
+			},
+			expected: "http://c",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			lb, err := New(nil, test.options...)
+			require.NoError(t, err)
+
+			canary := Labels(map[string]string{"track": "canary"})
+			require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a"), canary))
+			require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://b"), canary))
+			require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://c"), Tier(1)))
+
+			u, err := lb.NextServer()
+			if test.expected == "" {
+				// The active tier only has canaries.
+				var errNoEligible *ErrNoEligibleServers
+				require.ErrorAs(t, err, &errNoEligible)
+				assert.Equal(t, "no-canary", errNoEligible.Filter)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, u.String())
+		})
+	}
+}
+
+func TestRoundRobin_selectionFilterChain(t *testing.T) {
+	var calls []string
+	keep := func(name string) SelectionFilterFunc {
+		return func(_ *http.Request, candidates []ServerView) []ServerView {
+			calls = append(calls, name)
+			return candidates
+		}
+	}
+
+	lb, err := New(nil,
+		SelectionFilter("first", keep("first")),
+		SelectionFilter("second", keep("second")),
+		SelectionFilter("empty", func(*http.Request, []ServerView) []ServerView {
+			calls = append(calls, "empty")
+			return nil
+		}),
+		SelectionFilter("last", keep("last")),
+	)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a")))
+
+	_, err = lb.NextServer()
+
+	var errNoEligible *ErrNoEligibleServers
+	require.ErrorAs(t, err, &errNoEligible)
+	assert.Equal(t, "empty", errNoEligible.Filter)
+	assert.Equal(t, []string{"first", "second", "empty"}, calls)
+}
+
+func TestRoundRobin_selectionFilterServeHTTP(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Slow") != "" {
+			close(started)
+			<-release
+		}
+		_, _ = w.Write([]byte(req.URL.Host))
+	})
+
+	var views []ServerView
+	internal := func(req *http.Request, candidates []ServerView) []ServerView {
+		views = append(views[:0], candidates...)
+		if req.Header.Get("X-Internal") == "" {
+			return candidates
+		}
+		return excludeLabel("track", "canary")(req, candidates)
+	}
+
+	lb, err := New(handler, SelectionFilter("internal", internal))
+	require.NoError(t, err)
+
+	a := testutils.MustParseRequestURI("http://a")
+	require.NoError(t, lb.UpsertServer(a, Weight(2), Labels(map[string]string{"track": "canary"})))
+
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Slow", "true")
+		lb.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+
+	recorder := httptest.NewRecorder()
+	lb.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "a", recorder.Body.String())
+
+	require.Len(t, views, 1)
+	assert.Equal(t, "http://a", views[0].URL.String())
+	assert.Equal(t, 2000, views[0].WeightPermille)
+	assert.Equal(t, map[string]string{"track": "canary"}, views[0].Labels)
+	assert.Equal(t, 0, views[0].Tier)
+	// The slow request is in flight.
+	assert.Equal(t, int64(1), views[0].InFlight)
+	assert.False(t, views[0].SendRateLimited)
+
+	close(release)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Internal", "true")
+	recorder = httptest.NewRecorder()
+	lb.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
+
+func TestRoundRobin_selectionFilterInvalid(t *testing.T) {
+	keep := func(_ *http.Request, candidates []ServerView) []ServerView { return candidates }
+
+	_, err := New(nil, SelectionFilter("keep", nil))
+	require.Error(t, err)
+
+	_, err = New(nil, SelectionFilter("", keep))
+	require.Error(t, err)
+
+	_, err = New(nil, SelectionFilter(FilterTier, keep))
+	require.Error(t, err)
+
+	_, err = New(nil, SelectionFilter("keep", keep), SelectionFilter("keep", keep))
+	require.Error(t, err)
+
+	_, err = New(nil, BuiltinFilter("health"))
+	require.Error(t, err)
+
+	_, err = New(nil, BuiltinFilter(FilterTier), BuiltinFilter(FilterTier))
+	require.Error(t, err)
+}
+
+func BenchmarkRoundRobin_NextServer(b *testing.B) {
+	keep := func(_ *http.Request, candidates []ServerView) []ServerView { return candidates }
+
+	for _, bench := range []struct {
+		desc    string
+		options []LBOption
+	}{
+		{desc: "no filter"},
+		{desc: "filter", options: []LBOption{SelectionFilter("keep", keep)}},
+	} {
+		b.Run(bench.desc, func(b *testing.B) {
+			lb, err := New(nil, bench.options...)
+			require.NoError(b, err)
+			for i, u := range []string{"http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3", "http://10.0.0.4"} {
+				require.NoError(b, lb.UpsertServer(testutils.MustParseRequestURI(u), Weight(i+1)))
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, _ = lb.NextServer()
+			}
+		})
+	}
+}
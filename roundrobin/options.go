@@ -2,8 +2,12 @@ package roundrobin
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/vulcand/oxy/v2/ratelimit"
 	"github.com/vulcand/oxy/v2/utils"
 )
 
@@ -26,6 +30,19 @@ func RebalancerMeter(newMeter NewMeterFn) RebalancerOption {
 	}
 }
 
+// RebalancerMeterMinSamples requires n requests in the window of the default meter before the ratings are trusted,
+// see memmetrics.MinSamples: the weights are not adjusted while a server, e.g. a canary, has received fewer requests.
+// It does not apply to the meters set with RebalancerMeter.
+func RebalancerMeterMinSamples(n int64) RebalancerOption {
+	return func(r *Rebalancer) error {
+		if n < 0 {
+			return fmt.Errorf("invalid meter min samples: %d", n)
+		}
+		r.meterMinSamples = n
+		return nil
+	}
+}
+
 // RebalancerErrorHandler is a functional argument that sets error handler of the server.
 func RebalancerErrorHandler(h utils.ErrorHandler) RebalancerOption {
 	return func(r *Rebalancer) error {
@@ -42,6 +59,25 @@ func RebalancerStickySession(stickySession *StickySession) RebalancerOption {
 	}
 }
 
+// RebalancerFailOnInvalidCookie rejects the requests with an invalid sticky cookie, see FailOnInvalidCookie.
+func RebalancerFailOnInvalidCookie(fail bool) RebalancerOption {
+	return func(r *Rebalancer) error {
+		r.failOnInvalidCookie = fail
+		return nil
+	}
+}
+
+// RebalancerIncludeStickyInRatings records the requests sent by a sticky cookie in the meters of the servers.
+// By default, only the requests sent by the wrapped balancer are rated: the sticky requests ignore the weights,
+// and their share of the traffic of a server follows the cookies of the clients.
+// The requests are counted in the ServerInfos either way.
+func RebalancerIncludeStickyInRatings(include bool) RebalancerOption {
+	return func(r *Rebalancer) error {
+		r.includeStickyInRatings = include
+		return nil
+	}
+}
+
 // RebalancerRequestRewriteListener is a functional argument that sets error handler of the server.
 func RebalancerRequestRewriteListener(rrl RequestRewriteListener) RebalancerOption {
 	return func(r *Rebalancer) error {
@@ -50,6 +86,34 @@ func RebalancerRequestRewriteListener(rrl RequestRewriteListener) RebalancerOpti
 	}
 }
 
+// RebalancerCloneRequest defines whether the request passed downstream has its own copy of the headers and URL.
+// Enabled by default, disabling it saves allocations but lets the next handlers mutate the caller's request.
+func RebalancerCloneRequest(clone bool) RebalancerOption {
+	return func(rb *Rebalancer) error {
+		rb.cloneRequest = clone
+		return nil
+	}
+}
+
+// RebalancerDryRun computes the weights of the servers without applying them to the wrapped balancer,
+// e.g. to observe the decisions of the rebalancer (see RebalancerDecisionLog) before enforcing them.
+// It can be toggled at runtime with SetDryRun.
+func RebalancerDryRun(dryRun bool) RebalancerOption {
+	return func(rb *Rebalancer) error {
+		rb.dryRun = dryRun
+		return nil
+	}
+}
+
+// RebalancerDecisionLog sets the function called with each weight change of the rebalancer, applied or not (see RebalancerDryRun).
+// It is called with the mutex of the rebalancer held, and must not call the rebalancer.
+func RebalancerDecisionLog(fn func(Decision)) RebalancerOption {
+	return func(rb *Rebalancer) error {
+		rb.decisionLog = fn
+		return nil
+	}
+}
+
 // RebalancerLogger defines the logger used by Rebalancer.
 func RebalancerLogger(l utils.Logger) RebalancerOption {
 	return func(rb *Rebalancer) error {
@@ -75,11 +139,162 @@ func Weight(w int) ServerOption {
 		if w < 0 {
 			return errors.New("Weight should be >= 0")
 		}
-		s.weight = w
+		s.weight = w * weightScale
+		return nil
+	}
+}
+
+// WeightPermille is an optional functional argument that sets the weight of the server in thousandths of Weight(1),
+// for fine-grained traffic splitting, e.g. WeightPermille(995) and WeightPermille(5) send 0.5% of the requests to the second server.
+func WeightPermille(n int) ServerOption {
+	return func(s *server) error {
+		if n < 0 || n > weightScale {
+			return fmt.Errorf("weight permille should be between 0 and %d, got %d", weightScale, n)
+		}
+		return weightPermille(n)(s)
+	}
+}
+
+// weightPermille sets the weight of the server in thousandths, without upper bound (used by the Rebalancer).
+func weightPermille(n int) ServerOption {
+	return func(s *server) error {
+		if n < 0 {
+			return errors.New("weight permille should be >= 0")
+		}
+		s.weight = n
+		return nil
+	}
+}
+
+// ServerWarmUp is an optional functional argument that sets the warm-up of a new server, overriding the WarmUp of the load balancer.
+// A zero duration disables the warm-up of the server. It has no effect on a server already in the load balancer.
+func ServerWarmUp(d time.Duration, startFraction float64) ServerOption {
+	return func(s *server) error {
+		w, err := newWarmUp(d, startFraction)
+		if err != nil {
+			return err
+		}
+		if s.warmUpStart.IsZero() {
+			s.warmUp = w
+		}
+		return nil
+	}
+}
+
+// Labels is an optional functional argument that sets the labels of the server.
+// The labels are used by PreferLabel.
+func Labels(labels map[string]string) ServerOption {
+	return func(s *server) error {
+		s.labels = make(map[string]string, len(labels))
+		for k, v := range labels {
+			s.labels[k] = v
+		}
+		return nil
+	}
+}
+
+// HostOverride is an optional functional argument that sets the host sent to the server by the forwarder,
+// in the Host header and the TLS server name, e.g. the hostname of a server added by IP address.
+// It is passed in the context of the request, see forward.WithHostOverride.
+func HostOverride(host string) ServerOption {
+	return func(s *server) error {
+		s.hostOverride = host
+		return nil
+	}
+}
+
+// Tier is an optional functional argument that sets the priority tier of the server, 0 by default:
+// the servers are selected from the lowest tier having a server with a non-zero weight, the active tier,
+// e.g. Tier(1) for the backups of the servers of tier 0. When the active tier has no such server anymore
+// (removed or with a zero weight), the traffic fails over to the next tier at once, and fails back
+// when the lower tier has one again, see TierFailbackDelay. A request whose options exclude all the servers
+// of the active tier, e.g. a retry, is sent to the next tier having a candidate.
+func Tier(n int) ServerOption {
+	return func(s *server) error {
+		if n < 0 {
+			return fmt.Errorf("tier should be >= 0, got %d", n)
+		}
+		s.tier = n
+		return nil
+	}
+}
+
+// SendRate is an optional functional argument that paces the requests sent to the server with a token bucket,
+// e.g. for a backend enforcing a quota: it admits average requests per period, with bursts of up to burst requests.
+// The server is skipped by the selections while it admits no request, the other servers being selected instead.
+// When the servers a request could be sent to have all reached their send rate, including the server of a sticky request,
+// the request waits as configured by SendRateMaxWait, or fails with an ErrSendRateLimited.
+// Setting it on a server already in the load balancer refills its bucket.
+func SendRate(average, burst int64, per time.Duration) ServerOption {
+	return func(s *server) error {
+		p, err := ratelimit.NewPacer(average, burst, per)
+		if err != nil {
+			return fmt.Errorf("invalid send rate: %w", err)
+		}
+		s.sendRate = p
 		return nil
 	}
 }
 
+// NextOption provides options for the selection of the next server.
+type NextOption func(*nextOptions)
+
+type nextOptions struct {
+	exclude []*url.URL
+	labels  map[string]string
+	hashKey string
+	req     *http.Request
+}
+
+func (o *nextOptions) excluded(u *url.URL) bool {
+	for _, e := range o.exclude {
+		if e != nil && sameURL(e, u) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *nextOptions) preferred(s *server) bool {
+	if len(o.labels) == 0 {
+		return false
+	}
+	for k, v := range o.labels {
+		if s.labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Exclude prevents the selection of the given servers, e.g. the ones already tried by a retry.
+func Exclude(urls ...*url.URL) NextOption {
+	return func(o *nextOptions) {
+		o.exclude = append(o.exclude, urls...)
+	}
+}
+
+// PreferLabel restricts the selection to the servers having the label key=value (see Labels).
+// Any server can be selected if none matches.
+// When used several times, the servers must match all the labels.
+func PreferLabel(key, value string) NextOption {
+	return func(o *nextOptions) {
+		if o.labels == nil {
+			o.labels = make(map[string]string)
+		}
+		o.labels[key] = value
+	}
+}
+
+// HashKey selects the server by hashing key instead of taking the next server in the rotation:
+// the same key selects the same server as long as the servers do not change, see EnableHashAffinity.
+// The weights are honored across the keys, and an empty key selects the next server in the rotation.
+func HashKey(key string) NextOption {
+	return func(o *nextOptions) {
+		o.hashKey = key
+	}
+}
+
 // LBOption provides options for load balancer.
 type LBOption func(*RoundRobin) error
 
@@ -91,6 +306,101 @@ func ErrorHandler(h utils.ErrorHandler) LBOption {
 	}
 }
 
+// FailOnInvalidCookie passes the requests with an invalid sticky cookie (ErrCookieInvalid) to the error handler,
+// answering 400 by default, instead of selecting another server, e.g. when a tampered cookie is a sign of an attack.
+func FailOnInvalidCookie(fail bool) LBOption {
+	return func(s *RoundRobin) error {
+		s.failOnInvalidCookie = fail
+		return nil
+	}
+}
+
+// EnableHashAffinity sends the requests to a server selected by hashing the key extracted from them, e.g. a device ID header,
+// for stickiness without cookies. The requests without key (empty key or extraction error) follow the rotation.
+// The weights, including the ones set by a Rebalancer, are honored across the keys, and a sticky cookie still wins.
+// See HashKey.
+func EnableHashAffinity(extract utils.SourceExtractor) LBOption {
+	return func(r *RoundRobin) error {
+		if extract == nil {
+			return errors.New("hash affinity extractor can't be nil")
+		}
+		r.hashAffinity = extract
+		return nil
+	}
+}
+
+// WriteAffinity pins a client to the backend of its last write for the window, e.g. to read its writes
+// from an asynchronously replicated backend. When a request with one of the methods is answered with a 2xx or 3xx,
+// a cookie expiring with the window pins the client to its backend: the following requests are sent there,
+// as with a sticky session, taking precedence over the sticky session cookie.
+// A pin to a removed server, or whose window is over, is ignored without touching the cookie.
+// The Rebalancer does not apply it: it selects the servers of the RoundRobin itself.
+func WriteAffinity(cfg WriteAffinityConfig) LBOption {
+	return func(r *RoundRobin) error {
+		wa, err := newWriteAffinity(cfg)
+		if err != nil {
+			return err
+		}
+		r.writeAffinity = wa
+		return nil
+	}
+}
+
+// DebugRouting lets the requests authorized by cfg.Authorize choose their server with headers, e.g. to probe a given backend:
+// the pin header names the server the request is sent to, by its URL (see NormalizeURL),
+// bypassing the rotation, the affinities and the sticky sessions; a server which is not in the pool
+// is an ErrPinnedServerNotFound (404 by default). The exclude header lists the servers the request can't be sent to.
+// The headers are always removed from the request sent downstream, and ignored on the requests failing Authorize.
+// The Rebalancer does not apply it: it selects the servers of the RoundRobin itself.
+func DebugRouting(cfg DebugRoutingConfig) LBOption {
+	return func(r *RoundRobin) error {
+		d, err := newDebugRouting(cfg)
+		if err != nil {
+			return err
+		}
+		r.debugRouting = d
+		return nil
+	}
+}
+
+// DNSServer adds a server by hostname, e.g. http://api-pool.internal:8080, balanced as one server per address:
+// the hostname is resolved by New, then every refresh, on the first selection after it, in the background.
+// The server of an address has the URL with the address as host, the port being kept, the options and
+// a HostOverride with the host of u, so that the backends still get the hostname in the Host header and the TLS server name.
+// A new resolution only adds and removes the servers of the addresses which changed, the others keep their weights and state.
+// A failed resolution keeps the servers of the last successful one, and is reported to the listener of OnDNSEvent.
+// The Rebalancer does not know the servers of the addresses: they are added to the RoundRobin itself.
+func DNSServer(u *url.URL, refresh time.Duration, opts ...ServerOption) LBOption {
+	return func(r *RoundRobin) error {
+		d, err := newDNSServer(u, refresh, opts)
+		if err != nil {
+			return err
+		}
+		r.dnsServers = append(r.dnsServers, d)
+		return nil
+	}
+}
+
+// DNSResolver sets the resolver of the hostnames of the servers added with DNSServer, net.DefaultResolver by default.
+func DNSResolver(resolver Resolver) LBOption {
+	return func(r *RoundRobin) error {
+		if resolver == nil {
+			return errors.New("resolver can't be nil")
+		}
+		r.resolver = resolver
+		return nil
+	}
+}
+
+// OnDNSEvent sets the function called after the resolutions of the servers added with DNSServer
+// which changed their addresses or failed, see DNSEvent.
+func OnDNSEvent(fn func(DNSEvent)) LBOption {
+	return func(r *RoundRobin) error {
+		r.dnsListener = fn
+		return nil
+	}
+}
+
 // EnableStickySession enable sticky session.
 func EnableStickySession(stickySession *StickySession) LBOption {
 	return func(s *RoundRobin) error {
@@ -107,6 +417,117 @@ func RoundRobinRequestRewriteListener(rrl RequestRewriteListener) LBOption {
 	}
 }
 
+// CloneRequest defines whether the request passed downstream has its own copy of the headers and URL.
+// Enabled by default, disabling it saves allocations but lets the next handlers mutate the caller's request.
+func CloneRequest(clone bool) LBOption {
+	return func(r *RoundRobin) error {
+		r.cloneRequest = clone
+		return nil
+	}
+}
+
+// WaitForServers makes the selection of a server wait up to maxWait, bounded by the request context,
+// for a server to be added when none is available (e.g. all the servers are being replaced),
+// instead of failing immediately.
+func WaitForServers(maxWait time.Duration) LBOption {
+	return func(r *RoundRobin) error {
+		if maxWait < 0 {
+			return fmt.Errorf("invalid max wait: %v", maxWait)
+		}
+		r.waitForServers = maxWait
+		return nil
+	}
+}
+
+// SendRateMaxWait makes the requests wait up to maxWait, bounded by the request context,
+// for a server to admit them when the servers they could be sent to have all reached their SendRate,
+// instead of failing immediately with an ErrSendRateLimited.
+// A request waiting longer than maxWait fails at once.
+func SendRateMaxWait(maxWait time.Duration) LBOption {
+	return func(r *RoundRobin) error {
+		if maxWait < 0 {
+			return fmt.Errorf("invalid max wait: %v", maxWait)
+		}
+		r.sendRateMaxWait = maxWait
+		return nil
+	}
+}
+
+// TierFailbackDelay makes the traffic fail back to a lower tier once it has had a server with a non-zero weight for d,
+// instead of as soon as it has one, so that a flapping tier does not get the traffic back and forth, see Tier.
+// The delay is measured on the selections of the servers: the traffic shifts on the first selection after it.
+func TierFailbackDelay(d time.Duration) LBOption {
+	return func(r *RoundRobin) error {
+		if d < 0 {
+			return fmt.Errorf("invalid tier failback delay: %v", d)
+		}
+		r.failbackDelay = d
+		return nil
+	}
+}
+
+// StickyAcrossTiers defines whether a sticky cookie pinned to a server outside the active tier keeps selecting it,
+// e.g. a backup server after the failback, as long as the server is in the load balancer (see Tier).
+// Enabled by default, disabling it moves the clients of such cookies to the servers of the active tier.
+// The Rebalancer does not apply it: its sticky session selects any server.
+func StickyAcrossTiers(keep bool) LBOption {
+	return func(r *RoundRobin) error {
+		r.stickyInActiveTier = !keep
+		return nil
+	}
+}
+
+// RestickSpread spreads over the window the clients stuck to a removed server being stuck to another one,
+// e.g. so that the synchronized clients of a loaded server do not all land on its replacement in the same second.
+// During the window after the removal, such a client is served by the rotation without a new cookie until its slot,
+// given by hashing its cookie and its address into [0, window), has arrived. A zero window sticks the clients at once.
+// The Rebalancer does not apply it: its sticky session is its own.
+func RestickSpread(window time.Duration) LBOption {
+	return func(r *RoundRobin) error {
+		if window < 0 {
+			return fmt.Errorf("invalid restick spread window: %v", window)
+		}
+		r.restickSpread = window
+		return nil
+	}
+}
+
+// WarmUp ramps up the traffic sent to the servers added to the load balancer, e.g. to let freshly started backends
+// fill their caches and connection pools: the effective weight of a new server starts at startFraction × weight
+// and grows linearly to its weight over d. A server updated with UpsertServer keeps its ramp,
+// a server removed then added again starts a new one. See ServerWarmUp to override it per server.
+func WarmUp(d time.Duration, startFraction float64) LBOption {
+	return func(r *RoundRobin) error {
+		w, err := newWarmUp(d, startFraction)
+		if err != nil {
+			return err
+		}
+		r.warmUp = w
+		return nil
+	}
+}
+
+func newWarmUp(d time.Duration, startFraction float64) (*warmUp, error) {
+	if d < 0 {
+		return nil, fmt.Errorf("invalid warm-up duration: %v", d)
+	}
+	if startFraction < 0 || startFraction > 1 {
+		return nil, fmt.Errorf("warm-up start fraction should be between 0 and 1, got %v", startFraction)
+	}
+	if d == 0 {
+		return nil, nil
+	}
+	return &warmUp{duration: d, startFraction: startFraction}, nil
+}
+
+// OnWeightScheduleDone sets the listener called when the schedule of the weight of a server completes, see ScheduleWeight.
+func OnWeightScheduleDone(l WeightScheduleListener) LBOption {
+	return func(r *RoundRobin) error {
+		r.weightScheduleListener = l
+		return nil
+	}
+}
+
 // Logger defines the logger the RoundRobin will use.
 func Logger(l utils.Logger) LBOption {
 	return func(r *RoundRobin) error {
@@ -1,19 +1,22 @@
 package roundrobin
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"sync"
 	"time"
 
+	"github.com/vulcand/oxy/v2/forward"
 	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
 	"github.com/vulcand/oxy/v2/memmetrics"
 	"github.com/vulcand/oxy/v2/utils"
 )
 
 const (
-	// FSMMaxWeight is the maximum weight that handler will set for the server.
+	// FSMMaxWeight is the maximum weight that handler will set for the server, in units of Weight.
 	FSMMaxWeight = 4096
 	// FSMGrowFactor Multiplier for the server weight.
 	FSMGrowFactor = 4
@@ -33,6 +36,22 @@ type BalancerHandler interface {
 	Next() http.Handler
 }
 
+// OptionsBalancer is implemented by the balancers selecting the next server with options, e.g. RoundRobin.
+// The Rebalancer passes its options to the balancers implementing it, see NextServerWith.
+type OptionsBalancer interface {
+	NextServerWith(ctx context.Context, opts ...NextOption) (*url.URL, error)
+}
+
+// permilleBalancer is implemented by the balancers exposing the weights in thousandths, e.g. RoundRobin.
+type permilleBalancer interface {
+	ServerWeightPermille(u *url.URL) (int, bool)
+}
+
+// pacedBalancer is implemented by the balancers pacing the requests sent to their servers, e.g. RoundRobin, see SendRate.
+type pacedBalancer interface {
+	paceServer(ctx context.Context, u *url.URL) error
+}
+
 // Meter measures server performance and returns its relative value via rating.
 type Meter interface {
 	Rating() float64
@@ -40,6 +59,12 @@ type Meter interface {
 	IsReady() bool
 }
 
+// ErrorMeter is implemented by the meters recording the upstream errors of the forwarder (see forward.ErrorFromContext).
+// The rebalancer calls RecordError instead of Record on such meters.
+type ErrorMeter interface {
+	RecordError(code int, latency time.Duration, err error)
+}
+
 // NewMeterFn type of functions to create new Meter.
 type NewMeterFn func() (Meter, error)
 
@@ -58,17 +83,30 @@ type Rebalancer struct {
 	next BalancerHandler
 	// errHandler is HTTP handler called in case of errors
 	errHandler utils.ErrorHandler
-
-	ratings []float64
+	// tier is the active tier of the wrapped balancer, whose servers have their weights adjusted, see Tier.
+	tier int
 
 	// creates new meters
 	newMeter NewMeterFn
+	// meterMinSamples is the number of requests required by the default meter, see RebalancerMeterMinSamples.
+	meterMinSamples int64
 
 	// sticky session object
 	stickySession *StickySession
+	// failOnInvalidCookie rejects the requests with an invalid sticky cookie, see RebalancerFailOnInvalidCookie.
+	failOnInvalidCookie bool
+	// includeStickyInRatings records the sticky requests in the meters, see RebalancerIncludeStickyInRatings.
+	includeStickyInRatings bool
 
 	requestRewriteListener RequestRewriteListener
 
+	cloneRequest bool
+
+	// dryRun computes the weights without applying them to the wrapped balancer, see RebalancerDryRun.
+	dryRun bool
+	// decisionLog is called with the weight changes, see RebalancerDecisionLog.
+	decisionLog func(Decision)
+
 	debug bool
 	log   utils.Logger
 }
@@ -79,6 +117,7 @@ func NewRebalancer(handler BalancerHandler, opts ...RebalancerOption) (*Rebalanc
 		mtx:           &sync.Mutex{},
 		next:          handler,
 		stickySession: nil,
+		cloneRequest:  true,
 
 		log: &utils.NoopLogger{},
 	}
@@ -92,7 +131,7 @@ func NewRebalancer(handler BalancerHandler, opts ...RebalancerOption) (*Rebalanc
 	}
 	if rb.newMeter == nil {
 		rb.newMeter = func() (Meter, error) {
-			rc, err := memmetrics.NewRatioCounter(10, clock.Second)
+			rc, err := memmetrics.NewRatioCounter(10, clock.Second, memmetrics.MinSamples(rb.meterMinSamples))
 			if err != nil {
 				return nil, err
 			}
@@ -104,7 +143,7 @@ func NewRebalancer(handler BalancerHandler, opts ...RebalancerOption) (*Rebalanc
 		}
 	}
 	if rb.errHandler == nil {
-		rb.errHandler = utils.DefaultHandler
+		rb.errHandler = defaultErrHandler
 	}
 	return rb, nil
 }
@@ -117,46 +156,72 @@ func (rb *Rebalancer) Servers() []*url.URL {
 	return rb.next.Servers()
 }
 
+// NextServerWith gets the next server matching the options from the wrapped balancer.
+// The options are ignored if the balancer does not implement OptionsBalancer.
+func (rb *Rebalancer) NextServerWith(ctx context.Context, opts ...NextOption) (*url.URL, error) {
+	if ob, ok := rb.next.(OptionsBalancer); ok {
+		return ob.NextServerWith(ctx, opts...)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return rb.next.NextServer()
+}
+
 func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if rb.debug {
+	if rb.debug && utils.DebugEnabled(rb.log) {
 		dump := utils.DumpHTTPRequest(req)
 		rb.log.Debug("vulcand/oxy/roundrobin/rebalancer: begin ServeHttp on request: %s", dump)
 		defer rb.log.Debug("vulcand/oxy/roundrobin/rebalancer: completed ServeHttp on request: %s", dump)
 	}
 
-	pw := utils.NewProxyWriter(w)
-	start := clock.Now().UTC()
+	if rb.next == nil || rb.next.Next() == nil {
+		utils.ServeError(rb.errHandler, w, req, "roundrobin/rebalancer", &utils.ErrNotWired{Middleware: "roundrobin/rebalancer"})
+		return
+	}
 
-	// make shallow copy of request before changing anything to avoid side effects
-	newReq := *req
+	start := clock.Now()
+
+	// make a copy of request before changing anything to avoid side effects
+	newReq := copyRequest(req, rb.cloneRequest)
 	stuck := false
 
 	if rb.stickySession != nil {
-		cookieURL, present, err := rb.stickySession.GetBackend(&newReq, rb.Servers())
-		if err != nil {
-			rb.log.Warn("vulcand/oxy/roundrobin/rebalancer: error using server from cookie: %v", err)
+		cookieURL, present, err := rb.stickySession.getBackend(newReq, rb.Servers())
+		if err != nil && !rb.stickySession.handleError(w, req, err, rb.failOnInvalidCookie, rb.errHandler, "roundrobin/rebalancer", rb.log) {
+			return
 		}
 
 		if present {
-			newReq.URL = cookieURL
+			newReq.URL = utils.CopyURL(cookieURL)
 			stuck = true
 		}
 	}
 
+	if pb, ok := rb.next.(pacedBalancer); ok && stuck {
+		if err := pb.paceServer(req.Context(), newReq.URL); err != nil {
+			utils.ServeError(rb.errHandler, w, req, "roundrobin/rebalancer", err)
+			return
+		}
+	}
+
 	if !stuck {
-		fwdURL, err := rb.next.NextServer()
+		fwdURL, err := rb.NextServerWith(req.Context(), append(affinityOptions(rb.next, req), ForRequest(req))...)
 		if err != nil {
-			rb.errHandler.ServeHTTP(w, req, err)
+			utils.ServeError(rb.errHandler, w, req, "roundrobin/rebalancer", err)
 			return
 		}
 
-		if rb.debug {
+		if rb.debug && utils.DebugEnabled(rb.log) {
 			// log which backend URL we're sending this request to
 			rb.log.Debug("vulcand/oxy/roundrobin/rebalancer: Forwarding this request to URL (%s) :%s", fwdURL, utils.DumpHTTPRequest(req))
 		}
 
 		if rb.stickySession != nil {
-			rb.stickySession.StickBackend(fwdURL, w)
+			// the cookie is only set if the backend answers successfully.
+			sw := rb.stickySession.stickyWriter(fwdURL, w, newReq)
+			defer sw.finish()
+			w = sw
 		}
 
 		newReq.URL = fwdURL
@@ -164,34 +229,70 @@ func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	// Emit event to a listener if one exists
 	if rb.requestRewriteListener != nil {
-		rb.requestRewriteListener(req, &newReq)
+		rb.requestRewriteListener(req, newReq)
 	}
 
-	rb.next.Next().ServeHTTP(pw, &newReq)
+	newReq = newReq.WithContext(forward.WithErrorCapture(newReq.Context()))
+
+	pw := utils.NewProxyWriter(w)
+	rb.next.Next().ServeHTTP(pw, newReq)
 
-	rb.recordMetrics(newReq.URL, pw.StatusCode(), clock.Now().UTC().Sub(start))
+	rb.recordMetrics(newReq.URL, stuck, pw.StatusCode(), clock.Since(start), forward.ErrorFromContext(newReq.Context()))
 	rb.adjustWeights()
 }
 
-func (rb *Rebalancer) recordMetrics(u *url.URL, code int, latency time.Duration) {
+// recordMetrics counts the request, and records it in the meter of the server.
+// The sticky requests are not recorded unless includeStickyInRatings is set:
+// they don't depend on the weights, and their distribution between the servers follows the cookies.
+func (rb *Rebalancer) recordMetrics(u *url.URL, stuck bool, code int, latency time.Duration, err error) {
 	rb.mtx.Lock()
 	defer rb.mtx.Unlock()
-	if srv, i := rb.findServer(u); i != -1 {
-		srv.meter.Record(code, latency)
+	srv, i := rb.findServer(u)
+	if i == -1 {
+		return
+	}
+	if stuck {
+		srv.stickyRequests++
+		if !rb.includeStickyInRatings {
+			return
+		}
+	} else {
+		srv.balancedRequests++
+	}
+	if m, ok := srv.meter.(ErrorMeter); ok {
+		m.RecordError(code, latency, err)
+		return
 	}
+	srv.meter.Record(code, latency)
 }
 
 func (rb *Rebalancer) reset() {
+	rb.trackSchedules()
+
+	var servers []*rbServer
 	for _, s := range rb.servers {
+		if !s.scheduled {
+			servers = append(servers, s)
+		}
+	}
+
+	old := rb.currentWeights(servers)
+	for _, s := range servers {
 		s.curWeight = s.origWeight
-		_ = rb.next.UpsertServer(s.url, Weight(s.origWeight))
+		if !rb.dryRun {
+			_ = rb.next.UpsertServer(s.url, weightPermille(s.origWeight))
+		}
 	}
+	rb.logDecisions(servers, old, DecisionReset)
+
 	rb.timer = clock.Now().UTC().Add(-1 * clock.Second)
-	rb.ratings = make([]float64, len(rb.servers))
 }
 
 // Wrap sets the next handler to be called by rebalancer handler.
 func (rb *Rebalancer) Wrap(next BalancerHandler) error {
+	if next == nil {
+		return errors.New("next handler can't be nil")
+	}
 	if rb.next != nil {
 		return fmt.Errorf("already bound to %T", rb.next)
 	}
@@ -199,7 +300,7 @@ func (rb *Rebalancer) Wrap(next BalancerHandler) error {
 	return nil
 }
 
-// UpsertServer upsert a server.
+// UpsertServer upsert a server, identified by its normalized URL (see NormalizeURL).
 func (rb *Rebalancer) UpsertServer(u *url.URL, options ...ServerOption) error {
 	rb.mtx.Lock()
 	defer rb.mtx.Unlock()
@@ -207,8 +308,7 @@ func (rb *Rebalancer) UpsertServer(u *url.URL, options ...ServerOption) error {
 	if err := rb.next.UpsertServer(u, options...); err != nil {
 		return err
 	}
-	weight, _ := rb.next.ServerWeight(u)
-	if err := rb.upsertServer(u, weight); err != nil {
+	if err := rb.upsertServer(u, rb.serverWeight(u), rb.serverTier(u)); err != nil {
 		_ = rb.next.RemoveServer(u)
 		return err
 	}
@@ -216,7 +316,7 @@ func (rb *Rebalancer) UpsertServer(u *url.URL, options ...ServerOption) error {
 	return nil
 }
 
-// RemoveServer remove a server.
+// RemoveServer remove a server, identified by its normalized URL (see NormalizeURL).
 func (rb *Rebalancer) RemoveServer(u *url.URL) error {
 	rb.mtx.Lock()
 	defer rb.mtx.Unlock()
@@ -237,9 +337,21 @@ func (rb *Rebalancer) removeServer(u *url.URL) error {
 	return nil
 }
 
-func (rb *Rebalancer) upsertServer(u *url.URL, weight int) error {
+// serverWeight returns the weight of the server in thousandths, see WeightPermille.
+func (rb *Rebalancer) serverWeight(u *url.URL) int {
+	if pb, ok := rb.next.(permilleBalancer); ok {
+		weight, _ := pb.ServerWeightPermille(u)
+		return weight
+	}
+	weight, _ := rb.next.ServerWeight(u)
+	return weight * weightScale
+}
+
+func (rb *Rebalancer) upsertServer(u *url.URL, weight, tier int) error {
 	if s, i := rb.findServer(u); i != -1 {
 		s.origWeight = weight
+		s.tier = tier
+		return nil
 	}
 	meter, err := rb.newMeter()
 	if err != nil {
@@ -249,6 +361,7 @@ func (rb *Rebalancer) upsertServer(u *url.URL, weight int) error {
 		url:        utils.CopyURL(u),
 		origWeight: weight,
 		curWeight:  weight,
+		tier:       tier,
 		meter:      meter,
 	}
 	rb.servers = append(rb.servers, rbSrv)
@@ -269,46 +382,62 @@ func (rb *Rebalancer) findServer(u *url.URL) (*rbServer, int) {
 
 // adjustWeights Called on every load balancer ServeHTTP call, returns the suggested weights
 // on every call, can adjust weights if needed.
+// Only the weights of the servers of the active tier are adjusted, see Tier.
 func (rb *Rebalancer) adjustWeights() {
 	rb.mtx.Lock()
 	defer rb.mtx.Unlock()
 
+	rb.trackSchedules()
+
+	if rb.syncTier() {
+		return
+	}
+	servers := rb.activeServers()
+
 	// In this case adjusting weights would have no effect, so do nothing
-	if len(rb.servers) < 2 {
+	if len(servers) < 2 {
 		return
 	}
 	// Metrics are not ready
-	if !rb.metricsReady() {
+	if !metricsReady(servers) {
 		return
 	}
 	if !rb.timerExpired() {
 		return
 	}
-	if rb.markServers() {
-		if rb.setMarkedWeights() {
+	if rb.markServers(servers) {
+		if rb.setMarkedWeights(servers) {
 			rb.setTimer()
 		}
 	} else { // No servers that are different by their quality, so converge weights
-		if rb.convergeWeights() {
+		if rb.convergeWeights(servers) {
 			rb.setTimer()
 		}
 	}
 }
 
+// applyWeights sets the current weights of the servers on the wrapped balancer, unless in dry run.
 func (rb *Rebalancer) applyWeights() {
+	if rb.dryRun {
+		return
+	}
 	for _, srv := range rb.servers {
+		if srv.scheduled {
+			continue
+		}
 		rb.log.Debug("upsert server %v, weight %v", srv.url, srv.curWeight)
-		_ = rb.next.UpsertServer(srv.url, Weight(srv.curWeight))
+		_ = rb.next.UpsertServer(srv.url, weightPermille(srv.curWeight))
 	}
 }
 
-func (rb *Rebalancer) setMarkedWeights() bool {
+func (rb *Rebalancer) setMarkedWeights(servers []*rbServer) bool {
 	changed := false
+	old := rb.currentWeights(servers)
 	// Increase weights on servers marked as good
-	for _, srv := range rb.servers {
-		if srv.good {
+	for _, srv := range servers {
+		if srv.good && !srv.scheduled {
 			weight := increase(srv.curWeight)
-			if weight <= FSMMaxWeight {
+			if weight <= FSMMaxWeight*weightScale {
 				rb.log.Debug("increasing weight of %v from %v to %v", srv.url, srv.curWeight, weight)
 				srv.curWeight = weight
 				changed = true
@@ -316,7 +445,8 @@ func (rb *Rebalancer) setMarkedWeights() bool {
 		}
 	}
 	if changed {
-		rb.normalizeWeights()
+		rb.normalizeWeights(servers)
+		rb.logDecisions(servers, old, DecisionMarkedGood)
 		rb.applyWeights()
 		return true
 	}
@@ -331,8 +461,8 @@ func (rb *Rebalancer) timerExpired() bool {
 	return rb.timer.Before(clock.Now().UTC())
 }
 
-func (rb *Rebalancer) metricsReady() bool {
-	for _, s := range rb.servers {
+func metricsReady(servers []*rbServer) bool {
+	for _, s := range servers {
 		if !s.meter.IsReady() {
 			return false
 		}
@@ -343,28 +473,30 @@ func (rb *Rebalancer) metricsReady() bool {
 // markServers splits servers into two groups of servers with bad and good failure rate.
 // It does compare relative performances of the servers though, so if all servers have approximately the same error rate
 // this function returns the result as if all servers are equally good.
-func (rb *Rebalancer) markServers() bool {
-	for i, srv := range rb.servers {
-		rb.ratings[i] = srv.meter.Rating()
-	}
-	g, b := memmetrics.SplitFloat64(splitThreshold, 0, rb.ratings)
-	for i, srv := range rb.servers {
-		if g[rb.ratings[i]] {
+func (rb *Rebalancer) markServers(servers []*rbServer) bool {
+	ratings := make([]float64, len(servers))
+	for i, srv := range servers {
+		ratings[i] = srv.meter.Rating()
+	}
+	g, b := memmetrics.SplitFloat64(splitThreshold, 0, ratings)
+	for i, srv := range servers {
+		if g[ratings[i]] {
 			srv.good = true
 		} else {
 			srv.good = false
 		}
 	}
 	if len(g) != 0 && len(b) != 0 {
-		rb.log.Debug("bad: %v good: %v, ratings: %v", b, g, rb.ratings)
+		rb.log.Debug("bad: %v good: %v, ratings: %v", b, g, ratings)
 	}
 	return len(g) != 0 && len(b) != 0
 }
 
-func (rb *Rebalancer) convergeWeights() bool {
+func (rb *Rebalancer) convergeWeights(servers []*rbServer) bool {
 	// If we have previously changed servers try to restore weights to the original state
 	changed := false
-	for _, s := range rb.servers {
+	old := rb.currentWeights(servers)
+	for _, s := range servers {
 		if s.origWeight == s.curWeight {
 			continue
 		}
@@ -376,14 +508,15 @@ func (rb *Rebalancer) convergeWeights() bool {
 	if !changed {
 		return false
 	}
-	rb.normalizeWeights()
+	rb.normalizeWeights(servers)
+	rb.logDecisions(servers, old, DecisionConverge)
 	rb.applyWeights()
 	return true
 }
 
-func (rb *Rebalancer) weightsGcd() int {
+func weightsGcd(servers []*rbServer) int {
 	divisor := -1
-	for _, w := range rb.servers {
+	for _, w := range servers {
 		if divisor == -1 {
 			divisor = w.curWeight
 		} else {
@@ -393,13 +526,16 @@ func (rb *Rebalancer) weightsGcd() int {
 	return divisor
 }
 
-func (rb *Rebalancer) normalizeWeights() {
-	gcd := rb.weightsGcd()
-	if gcd <= 1 {
+// normalizeWeights divides the weights by their greatest common divisor,
+// down to the scale of Weight(1) so that the weights set with WeightPermille keep their precision.
+// The weights are not normalized while a schedule is in progress: the scheduled weights are not adjusted.
+func (rb *Rebalancer) normalizeWeights(servers []*rbServer) {
+	gcd := weightsGcd(servers)
+	if gcd <= weightScale || rb.hasSchedules() {
 		return
 	}
-	for _, s := range rb.servers {
-		s.curWeight /= gcd
+	for _, s := range servers {
+		s.curWeight = s.curWeight / gcd * weightScale
 	}
 }
 
@@ -418,10 +554,51 @@ func decrease(target, current int) int {
 // rebalancer server record that keeps track of the original weight supplied by user.
 type rbServer struct {
 	url        *url.URL
-	origWeight int // original weight supplied by user
-	curWeight  int // current weight
+	origWeight int // original weight supplied by user, in thousandths
+	curWeight  int // current weight, in thousandths
 	good       bool
 	meter      Meter
+	// tier is the tier of the server in the wrapped balancer, see Tier.
+	tier int
+	// scheduled is set while the weight of the server follows a schedule of the wrapped balancer, see ScheduleWeight.
+	scheduled bool
+	// stickyRequests and balancedRequests count the requests sent to the server by a sticky cookie, and by the balancer.
+	stickyRequests   uint64
+	balancedRequests uint64
+}
+
+// ServerInfo is a snapshot of a server of the rebalancer, see ServerInfos.
+type ServerInfo struct {
+	URL *url.URL
+	// OriginalWeightPermille is the weight of the server set with UpsertServer, in thousandths of Weight.
+	OriginalWeightPermille int
+	// WeightPermille is the weight of the server adjusted by the rebalancer, in thousandths of Weight.
+	WeightPermille int
+	// Tier is the tier of the server, see Tier.
+	Tier int
+	// StickyRequests is the number of requests sent to the server by their sticky cookie.
+	StickyRequests uint64
+	// BalancedRequests is the number of requests sent to the server by the wrapped balancer.
+	BalancedRequests uint64
+}
+
+// ServerInfos returns a snapshot of the servers, e.g. to compare their sticky and balanced traffic.
+func (rb *Rebalancer) ServerInfos() []ServerInfo {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	infos := make([]ServerInfo, 0, len(rb.servers))
+	for _, srv := range rb.servers {
+		infos = append(infos, ServerInfo{
+			URL:                    utils.CopyURL(srv.url),
+			OriginalWeightPermille: srv.origWeight,
+			WeightPermille:         srv.curWeight,
+			Tier:                   srv.tier,
+			StickyRequests:         srv.stickyRequests,
+			BalancedRequests:       srv.balancedRequests,
+		})
+	}
+	return infos
 }
 
 type codeMeter struct {
@@ -436,8 +613,13 @@ func (n *codeMeter) Rating() float64 {
 }
 
 // Record records a meter.
-func (n *codeMeter) Record(code int, _ time.Duration) {
-	if code >= n.codeS && code < n.codeE {
+func (n *codeMeter) Record(code int, latency time.Duration) {
+	n.RecordError(code, latency, nil)
+}
+
+// RecordError records a meter, the upstream errors are failures whatever the status code written by the error handler.
+func (n *codeMeter) RecordError(code int, _ time.Duration, err error) {
+	if err != nil || (code >= n.codeS && code < n.codeE) {
 		n.r.IncA(1)
 	} else {
 		n.r.IncB(1)
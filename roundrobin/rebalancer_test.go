@@ -1,9 +1,12 @@
 package roundrobin
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -11,6 +14,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/v2/forward"
 	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/memmetrics"
 	"github.com/vulcand/oxy/v2/testutils"
 )
 
@@ -37,6 +41,76 @@ func TestRebalancer_normalOperation(t *testing.T) {
 	assert.Equal(t, []string{"a", "a", "a"}, seq(t, proxy.URL, 3))
 }
 
+// basicBalancer implements BalancerHandler only, as the balancers written before OptionsBalancer.
+type basicBalancer struct {
+	lb *RoundRobin
+}
+
+func (b *basicBalancer) Servers() []*url.URL { return b.lb.Servers() }
+
+func (b *basicBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) { b.lb.ServeHTTP(w, req) }
+
+func (b *basicBalancer) ServerWeight(u *url.URL) (int, bool) { return b.lb.ServerWeight(u) }
+
+func (b *basicBalancer) RemoveServer(u *url.URL) error { return b.lb.RemoveServer(u) }
+
+func (b *basicBalancer) UpsertServer(u *url.URL, options ...ServerOption) error {
+	return b.lb.UpsertServer(u, options...)
+}
+
+func (b *basicBalancer) NextServer() (*url.URL, error) { return b.lb.NextServer() }
+
+func (b *basicBalancer) Next() http.Handler { return b.lb.Next() }
+
+func TestRebalancer_basicBalancer(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+
+	lb, err := New(forward.New(false))
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(&basicBalancer{lb: lb})
+	require.NoError(t, err)
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+
+	proxy := httptest.NewServer(rb)
+	t.Cleanup(proxy.Close)
+
+	assert.Equal(t, []string{"a", "b", "a"}, seq(t, proxy.URL, 3))
+
+	// The options are ignored: b is next in the rotation.
+	u, err := rb.NextServerWith(context.Background(), Exclude(testutils.MustParseRequestURI(b.URL)))
+	require.NoError(t, err)
+	assert.Equal(t, b.URL, u.String())
+}
+
+func TestRebalancer_wallClockStep(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	a := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		// The wall clock goes back an hour, e.g. an NTP correction, while the request is served.
+		clock.Advance(100 * clock.Millisecond)
+		clock.StepWall(-clock.Hour)
+		_, _ = w.Write([]byte("a"))
+	})
+	t.Cleanup(a.Close)
+
+	lb, err := New(forward.New(false))
+	require.NoError(t, err)
+
+	meter := &latencyMeter{}
+	rb, err := NewRebalancer(lb, RebalancerMeter(func() (Meter, error) { return meter, nil }))
+	require.NoError(t, err)
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+
+	proxy := httptest.NewServer(rb)
+	t.Cleanup(proxy.Close)
+
+	assert.Equal(t, []string{"a"}, seq(t, proxy.URL, 1))
+	assert.Equal(t, []time.Duration{100 * clock.Millisecond}, meter.latencies)
+}
+
 func TestRebalancer_noServers(t *testing.T) {
 	fwd := forward.New(false)
 
@@ -116,11 +190,11 @@ func TestRebalancer_recovery(t *testing.T) {
 		clock.Advance(rb.backoffDuration + clock.Second)
 	}
 
-	assert.Equal(t, 1, rb.servers[0].curWeight)
-	assert.Equal(t, FSMMaxWeight, rb.servers[1].curWeight)
+	assert.Equal(t, weightScale, rb.servers[0].curWeight)
+	assert.Equal(t, FSMMaxWeight*weightScale, rb.servers[1].curWeight)
 
-	assert.Equal(t, 1, lb.servers[0].weight)
-	assert.Equal(t, FSMMaxWeight, lb.servers[1].weight)
+	assert.Equal(t, weightScale, lb.servers[0].weight)
+	assert.Equal(t, FSMMaxWeight*weightScale, lb.servers[1].weight)
 
 	// server a is now recovering, the weights should go back to the original state
 	rb.servers[0].meter.(*testMeter).rating = 0
@@ -133,12 +207,68 @@ func TestRebalancer_recovery(t *testing.T) {
 		clock.Advance(rb.backoffDuration + clock.Second)
 	}
 
-	assert.Equal(t, 1, rb.servers[0].curWeight)
-	assert.Equal(t, 1, rb.servers[1].curWeight)
+	assert.Equal(t, weightScale, rb.servers[0].curWeight)
+	assert.Equal(t, weightScale, rb.servers[1].curWeight)
 
 	// Make sure we have applied the weights to the inner load balancer
-	assert.Equal(t, 1, lb.servers[0].weight)
-	assert.Equal(t, 1, lb.servers[1].weight)
+	assert.Equal(t, weightScale, lb.servers[0].weight)
+	assert.Equal(t, weightScale, lb.servers[1].weight)
+}
+
+func TestRebalancer_recoveryPermille(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+
+	fwd := forward.New(false)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	newMeter := func() (Meter, error) {
+		return &testMeter{}, nil
+	}
+
+	testutils.FreezeTime(t)
+
+	rb, err := NewRebalancer(lb, RebalancerMeter(newMeter))
+	require.NoError(t, err)
+
+	err = rb.UpsertServer(testutils.MustParseRequestURI(a.URL), WeightPermille(5))
+	require.NoError(t, err)
+	err = rb.UpsertServer(testutils.MustParseRequestURI(b.URL), WeightPermille(995))
+	require.NoError(t, err)
+
+	rb.servers[0].meter.(*testMeter).rating = 0.3
+
+	proxy := httptest.NewServer(rb)
+	t.Cleanup(proxy.Close)
+
+	for i := 0; i < 6; i++ {
+		_, _, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		_, _, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		clock.Advance(rb.backoffDuration + clock.Second)
+	}
+
+	// The weights are not normalized below the permille precision.
+	assert.Equal(t, 5, rb.servers[0].curWeight)
+	assert.Equal(t, 995*4096, rb.servers[1].curWeight) // 995 * FSMGrowFactor^6
+	assert.Equal(t, 5, lb.servers[0].weight)
+
+	// server a is now recovering, the weights should go back to the original state
+	rb.servers[0].meter.(*testMeter).rating = 0
+
+	for i := 0; i < 6; i++ {
+		_, _, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		_, _, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		clock.Advance(rb.backoffDuration + clock.Second)
+	}
+
+	assert.Equal(t, 5, lb.servers[0].weight)
+	assert.Equal(t, 995, lb.servers[1].weight)
 }
 
 // Test scenario when increaing the weight on good endpoints made it worse.
@@ -182,9 +312,9 @@ func TestRebalancer_cascading(t *testing.T) {
 	}
 
 	// We have increased the load, and the situation became worse as the other servers started failing
-	assert.Equal(t, 1, rb.servers[0].curWeight)
-	assert.Equal(t, FSMMaxWeight, rb.servers[1].curWeight)
-	assert.Equal(t, FSMMaxWeight, rb.servers[2].curWeight)
+	assert.Equal(t, weightScale, rb.servers[0].curWeight)
+	assert.Equal(t, FSMMaxWeight*weightScale, rb.servers[1].curWeight)
+	assert.Equal(t, FSMMaxWeight*weightScale, rb.servers[2].curWeight)
 
 	// server a is now recovering, the weights should go back to the original state
 	rb.servers[0].meter.(*testMeter).rating = 0.3
@@ -200,9 +330,9 @@ func TestRebalancer_cascading(t *testing.T) {
 	}
 
 	// the algo reverted it back
-	assert.Equal(t, 1, rb.servers[0].curWeight)
-	assert.Equal(t, 1, rb.servers[1].curWeight)
-	assert.Equal(t, 1, rb.servers[2].curWeight)
+	assert.Equal(t, weightScale, rb.servers[0].curWeight)
+	assert.Equal(t, weightScale, rb.servers[1].curWeight)
+	assert.Equal(t, weightScale, rb.servers[2].curWeight)
 }
 
 // Test scenario when all servers started failing.
@@ -248,9 +378,9 @@ func TestRebalancer_allBad(t *testing.T) {
 	}
 
 	// load balancer does nothing
-	assert.Equal(t, 1, rb.servers[0].curWeight)
-	assert.Equal(t, 1, rb.servers[1].curWeight)
-	assert.Equal(t, 1, rb.servers[2].curWeight)
+	assert.Equal(t, weightScale, rb.servers[0].curWeight)
+	assert.Equal(t, weightScale, rb.servers[1].curWeight)
+	assert.Equal(t, weightScale, rb.servers[2].curWeight)
 }
 
 // Removing the server resets the state.
@@ -296,16 +426,16 @@ func TestRebalancer_reset(t *testing.T) {
 	}
 
 	// load balancer changed weights
-	assert.Equal(t, 1, rb.servers[0].curWeight)
-	assert.Equal(t, FSMMaxWeight, rb.servers[1].curWeight)
-	assert.Equal(t, FSMMaxWeight, rb.servers[2].curWeight)
+	assert.Equal(t, weightScale, rb.servers[0].curWeight)
+	assert.Equal(t, FSMMaxWeight*weightScale, rb.servers[1].curWeight)
+	assert.Equal(t, FSMMaxWeight*weightScale, rb.servers[2].curWeight)
 
 	// Removing servers has reset the state
 	err = rb.RemoveServer(testutils.MustParseRequestURI(d.URL))
 	require.NoError(t, err)
 
-	assert.Equal(t, 1, rb.servers[0].curWeight)
-	assert.Equal(t, 1, rb.servers[1].curWeight)
+	assert.Equal(t, weightScale, rb.servers[0].curWeight)
+	assert.Equal(t, weightScale, rb.servers[1].curWeight)
 }
 
 func TestRebalancer_requestRewriteListenerLive(t *testing.T) {
@@ -332,18 +462,20 @@ func TestRebalancer_requestRewriteListenerLive(t *testing.T) {
 	proxy := httptest.NewServer(rb)
 	t.Cleanup(proxy.Close)
 
-	for i := 0; i < 1000; i++ {
-		_, _, err = testutils.Get(proxy.URL)
-		require.NoError(t, err)
-		if i%10 == 0 {
-			clock.Advance(rb.backoffDuration + clock.Second)
+	// load balancer changes weights
+	testutils.AdvanceUntil(t, func() bool {
+		for i := 0; i < 10; i++ {
+			_, _, err = testutils.Get(proxy.URL)
+			require.NoError(t, err)
 		}
-	}
 
-	// load balancer changed weights
-	assert.Equal(t, FSMMaxWeight, rb.servers[0].curWeight)
-	assert.Equal(t, FSMMaxWeight, rb.servers[1].curWeight)
-	assert.Equal(t, 1, rb.servers[2].curWeight)
+		rb.mtx.Lock()
+		defer rb.mtx.Unlock()
+
+		return rb.servers[0].curWeight == FSMMaxWeight*weightScale &&
+			rb.servers[1].curWeight == FSMMaxWeight*weightScale &&
+			rb.servers[2].curWeight == weightScale
+	}, rb.backoffDuration+clock.Second, 100*(rb.backoffDuration+clock.Second))
 }
 
 func TestRebalancer_requestRewriteListener(t *testing.T) {
@@ -362,6 +494,104 @@ func TestRebalancer_requestRewriteListener(t *testing.T) {
 	assert.NotNil(t, rb.requestRewriteListener)
 }
 
+func TestRebalancer_cloneRequest(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+
+	// mutates the request headers like the forwarder adding X-Forwarded-For.
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 100; i++ {
+			req.Header.Add(forward.XForwardedFor, "10.0.0.1")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	lb, err := New(next)
+	require.NoError(t, err)
+
+	var rewritten *http.Request
+	rb, err := NewRebalancer(lb, RebalancerRequestRewriteListener(func(_ *http.Request, newReq *http.Request) {
+		rewritten = newReq
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				_ = req.Header.Get(forward.XForwardedFor)
+			}
+		}()
+
+		rb.ServeHTTP(w, req)
+		<-done
+
+		assert.Empty(t, req.Header.Values(forward.XForwardedFor))
+		assert.NotSame(t, req.URL, rewritten.URL)
+	}))
+	t.Cleanup(proxy.Close)
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	require.NotNil(t, rewritten)
+	assert.Len(t, rewritten.Header.Values(forward.XForwardedFor), 100)
+}
+
+func TestRebalancer_cloneRequestDisabled(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Add(forward.XForwardedFor, "10.0.0.1")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	lb, err := New(next)
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(lb, RebalancerCloneRequest(false))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rb.ServeHTTP(w, req)
+
+		assert.Equal(t, "10.0.0.1", req.Header.Get(forward.XForwardedFor))
+	}))
+	t.Cleanup(proxy.Close)
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+}
+
+func TestRebalancer_stickySessionNoCookieOnError(t *testing.T) {
+	dead := testutils.NewResponder(t, "dead")
+	dead.Close()
+	b := testutils.NewResponder(t, "b")
+
+	sticky := NewStickySession("test")
+
+	fwd := forward.New(false)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(lb, RebalancerStickySession(sticky))
+	require.NoError(t, err)
+
+	err = rb.UpsertServer(testutils.MustParseRequestURI(dead.URL))
+	require.NoError(t, err)
+	err = rb.UpsertServer(testutils.MustParseRequestURI(b.URL))
+	require.NoError(t, err)
+
+	testStickyOnSuccess(t, rb, b.URL)
+}
+
 func TestRebalancer_stickySession(t *testing.T) {
 	a := testutils.NewResponder(t, "a")
 	b := testutils.NewResponder(t, "b")
@@ -410,6 +640,87 @@ func TestRebalancer_stickySession(t *testing.T) {
 	assert.Equal(t, []string{"x", "x", "x"}, seq(t, proxy.URL, 3))
 }
 
+func TestRebalancer_stickyRatings(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		includeSticky  bool
+		expectAdjusted bool
+	}{
+		{desc: "sticky requests excluded", expectAdjusted: false},
+		{desc: "sticky requests included", includeSticky: true, expectAdjusted: true},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			testutils.FreezeTime(t)
+
+			// a fails 1 out of 5 requests sent by their sticky cookie.
+			var stickyCount int
+			a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				if _, err := req.Cookie("test"); err == nil {
+					stickyCount++
+					if stickyCount%5 == 0 {
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+				}
+				_, _ = w.Write([]byte("a"))
+			})
+			t.Cleanup(a.Close)
+			b := testutils.NewResponder(t, "b")
+
+			lb, err := New(forward.New(false))
+			require.NoError(t, err)
+
+			rb, err := NewRebalancer(lb,
+				RebalancerStickySession(NewStickySession("test")),
+				RebalancerIncludeStickyInRatings(test.includeSticky))
+			require.NoError(t, err)
+
+			require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+			require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+
+			proxy := httptest.NewServer(rb)
+			t.Cleanup(proxy.Close)
+
+			// 90% of the requests are pinned to a, the others are balanced between a and b:
+			// both meters get a balanced request every second, and are ready after 10 seconds.
+			for i := 0; i < 20; i++ {
+				for j := 0; j < 18; j++ {
+					_, _, err = testutils.Get(proxy.URL, testutils.Header("Cookie", "test="+a.URL))
+					require.NoError(t, err)
+				}
+				_, _, err = testutils.Get(proxy.URL)
+				require.NoError(t, err)
+				_, _, err = testutils.Get(proxy.URL)
+				require.NoError(t, err)
+				clock.Advance(clock.Second)
+			}
+
+			weightA, _ := lb.ServerWeight(testutils.MustParseRequestURI(a.URL))
+			weightB, _ := lb.ServerWeight(testutils.MustParseRequestURI(b.URL))
+			if test.expectAdjusted {
+				assert.Equal(t, 1, weightA)
+				assert.Greater(t, weightB, 1)
+			} else {
+				assert.Equal(t, 1, weightA)
+				assert.Equal(t, 1, weightB)
+			}
+
+			infos := rb.ServerInfos()
+			require.Len(t, infos, 2)
+			assert.Equal(t, a.URL, infos[0].URL.String())
+			assert.Equal(t, uint64(360), infos[0].StickyRequests)
+			assert.Equal(t, uint64(0), infos[1].StickyRequests)
+			// The balanced requests follow the weights.
+			assert.Equal(t, uint64(40), infos[0].BalancedRequests+infos[1].BalancedRequests)
+			if !test.expectAdjusted {
+				assert.Equal(t, uint64(20), infos[1].BalancedRequests)
+			}
+		})
+	}
+}
+
 type testMeter struct {
 	rating   float64
 	notReady bool
@@ -425,3 +736,138 @@ func (tm *testMeter) Record(int, time.Duration) {
 func (tm *testMeter) IsReady() bool {
 	return !tm.notReady
 }
+
+// latencyMeter records the latencies.
+type latencyMeter struct {
+	testMeter
+	latencies []time.Duration
+}
+
+func (m *latencyMeter) Record(_ int, latency time.Duration) {
+	m.latencies = append(m.latencies, latency)
+}
+
+// errorMeter records the upstream errors.
+type errorMeter struct {
+	testMeter
+	errs []error
+}
+
+func (m *errorMeter) RecordError(_ int, _ time.Duration, err error) {
+	m.errs = append(m.errs, err)
+}
+
+func TestRebalancer_recordUpstreamErrors(t *testing.T) {
+	dead := testutils.NewResponder(t, "dead")
+	dead.Close()
+	failing := testutils.NewHandler(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	t.Cleanup(failing.Close)
+
+	lb, err := New(forward.New(false))
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(lb, RebalancerMeter(func() (Meter, error) {
+		return &errorMeter{}, nil
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(dead.URL)))
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(failing.URL)))
+
+	proxy := httptest.NewServer(rb)
+	t.Cleanup(proxy.Close)
+
+	for i := 0; i < 2; i++ {
+		re, _, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Contains(t, []int{http.StatusBadGateway, http.StatusInternalServerError}, re.StatusCode)
+	}
+
+	deadMeter := rb.servers[0].meter.(*errorMeter)
+	require.Len(t, deadMeter.errs, 1)
+	assert.Equal(t, forward.KindDial, forward.ErrorKind(deadMeter.errs[0]))
+
+	failingMeter := rb.servers[1].meter.(*errorMeter)
+	assert.Equal(t, []error{nil}, failingMeter.errs)
+}
+
+func TestCodeMeter_recordError(t *testing.T) {
+	r, err := memmetrics.NewRatioCounter(1, clock.Second)
+	require.NoError(t, err)
+	m := &codeMeter{r: r, codeS: http.StatusInternalServerError, codeE: http.StatusGatewayTimeout + 1}
+
+	m.Record(http.StatusOK, 0)
+	m.Record(http.StatusBadGateway, 0)
+	// The error handler may answer with any status code.
+	m.RecordError(http.StatusOK, 0, errors.New("dial"))
+	m.RecordError(http.StatusOK, 0, nil)
+
+	assert.InDelta(t, 0.5, m.Rating(), 0.0001)
+}
+
+func TestRebalancer_meterMinSamples(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		opts     []RebalancerOption
+		expected []int
+	}{
+		{
+			desc:     "without min samples",
+			expected: []int{4, 1},
+		},
+		{
+			desc:     "min samples",
+			opts:     []RebalancerOption{RebalancerMeterMinSamples(10)},
+			expected: []int{1, 1},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			testutils.FreezeTime(t)
+
+			lb, err := New(nil)
+			require.NoError(t, err)
+
+			rb, err := NewRebalancer(lb, test.opts...)
+			require.NoError(t, err)
+
+			a := testutils.MustParseRequestURI("http://a")
+			canary := testutils.MustParseRequestURI("http://canary")
+			require.NoError(t, rb.UpsertServer(a))
+			require.NoError(t, rb.UpsertServer(canary))
+
+			aMeter, canaryMeter := rb.servers[0].meter, rb.servers[1].meter
+
+			// The canary received some traffic, then stayed idle for longer than the window.
+			for i := 0; i < 10; i++ {
+				canaryMeter.Record(http.StatusOK, 0)
+				clock.Advance(clock.Second)
+			}
+			clock.Advance(time.Minute)
+
+			for i := 0; i < 10; i++ {
+				for j := 0; j < 10; j++ {
+					aMeter.Record(http.StatusOK, 0)
+				}
+				clock.Advance(clock.Second)
+			}
+
+			// A single failure of the canary in the window.
+			canaryMeter.Record(http.StatusOK, 0)
+			canaryMeter.Record(http.StatusInternalServerError, 0)
+
+			rb.adjustWeights()
+
+			// The canary is down-weighted by raising the weight of the other server.
+			aWeight, _ := lb.ServerWeight(a)
+			canaryWeight, _ := lb.ServerWeight(canary)
+			assert.Equal(t, test.expected, []int{aWeight, canaryWeight})
+		})
+	}
+
+	_, err := NewRebalancer(nil, RebalancerMeterMinSamples(-1))
+	require.Error(t, err)
+}
@@ -0,0 +1,89 @@
+package roundrobin
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/segmentio/fasthash/fnv1a"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// removedServer is a server removed from the load balancer, remembered for the restick spread window.
+type removedServer struct {
+	url *url.URL
+	at  clock.Time
+}
+
+// rememberRemoved records the removal of srv at now, when the resticks are spread (see RestickSpread).
+// The servers removed for longer than the window are forgotten.
+func (r *RoundRobin) rememberRemoved(srv *server, now clock.Time) {
+	if r.restickSpread == 0 {
+		return
+	}
+
+	r.forgetRemoved(now)
+	if r.removed == nil {
+		r.removed = make(map[string]removedServer)
+	}
+	r.removed[srv.id] = removedServer{url: srv.url, at: now}
+}
+
+// forgetRemoved forgets the servers removed for longer than the restick spread window at now.
+func (r *RoundRobin) forgetRemoved(now clock.Time) {
+	for id, rs := range r.removed {
+		if now.Sub(rs.at) >= r.restickSpread {
+			delete(r.removed, id)
+		}
+	}
+}
+
+// deferRestick reports whether the request, whose sticky cookie points at a removed server, is served without a new cookie:
+// its client is stuck again once its slot in the window after the removal has arrived, see RestickSpread.
+func (r *RoundRobin) deferRestick(req *http.Request) bool {
+	if r.restickSpread == 0 {
+		return false
+	}
+
+	cookie, err := req.Cookie(r.stickySession.cookieName)
+	if err != nil {
+		return false
+	}
+
+	now := clock.Now()
+
+	r.mutex.Lock()
+	r.forgetRemoved(now)
+	removed := make([]*url.URL, 0, len(r.removed))
+	for _, rs := range r.removed {
+		removed = append(removed, rs.url)
+	}
+	r.mutex.Unlock()
+
+	if len(removed) == 0 {
+		return false
+	}
+
+	u, present, err := r.stickySession.getBackend(req, removed)
+	if err != nil || !present {
+		return false
+	}
+
+	r.mutex.Lock()
+	rs, ok := r.removed[NormalizeURL(u).String()]
+	r.mutex.Unlock()
+
+	return ok && now.Sub(rs.at) < restickSlot(req, cookie.Value, r.restickSpread)
+}
+
+// restickSlot returns the delay after the removal of its server from which the client of the request is stuck again.
+// It hashes the cookie value with the address of the client, as the cookies of the clients of a server may be the same
+// (e.g. stickycookie.RawValue): the slots of the clients are spread uniformly over the window.
+func restickSlot(req *http.Request, value string, window time.Duration) time.Duration {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return time.Duration(mix64(fnv1a.AddString64(fnv1a.HashString64(value), host)) % uint64(window))
+}
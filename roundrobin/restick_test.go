@@ -0,0 +1,105 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestRoundRobin_restickSpread(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+	c := testutils.NewResponder(t, "c")
+
+	testutils.FreezeTime(t)
+
+	lb, err := New(forward.New(false), EnableStickySession(NewStickySession("test")), RestickSpread(10*time.Second))
+	require.NoError(t, err)
+
+	for _, u := range []string{a.URL, b.URL, c.URL} {
+		require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(u)))
+	}
+	require.NoError(t, lb.RemoveServer(testutils.MustParseRequestURI(a.URL)))
+
+	// 100 clients stuck to a send a request every second.
+	resticked := make(map[int]bool)
+	var counts []int
+	for step := 0; step <= 10; step++ {
+		for i := 0; i < 100; i++ {
+			if resticked[i] {
+				continue
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:4000", i/250, i%250+1)
+			req.AddCookie(&http.Cookie{Name: "test", Value: a.URL})
+
+			rw := httptest.NewRecorder()
+			lb.ServeHTTP(rw, req)
+			require.Equal(t, http.StatusOK, rw.Code)
+			require.NotEqual(t, "a", rw.Body.String())
+
+			if rw.Header().Get("Set-Cookie") != "" {
+				resticked[i] = true
+			}
+		}
+		counts = append(counts, len(resticked))
+		clock.Advance(time.Second)
+	}
+
+	// The clients are stuck again at a roughly constant rate over the window, all of them once it is over.
+	for step, count := range counts[:10] {
+		assert.InDelta(t, 10*step, count, 15, "step %d: %v", step, counts)
+	}
+	assert.Equal(t, 100, counts[10])
+}
+
+func TestRoundRobin_restickSpreadDisabled(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+
+	lb, err := New(forward.New(false), EnableStickySession(NewStickySession("test")))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+	require.NoError(t, lb.RemoveServer(testutils.MustParseRequestURI(a.URL)))
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.AddCookie(&http.Cookie{Name: "test", Value: a.URL})
+
+	rw := httptest.NewRecorder()
+	lb.ServeHTTP(rw, req)
+	assert.Equal(t, "b", rw.Body.String())
+	assert.Equal(t, "test="+b.URL+"; Path=/", rw.Header().Get("Set-Cookie"))
+}
+
+func TestRoundRobin_restickSpreadReadded(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+
+	testutils.FreezeTime(t)
+
+	lb, err := New(forward.New(false), EnableStickySession(NewStickySession("test")), RestickSpread(10*time.Second))
+	require.NoError(t, err)
+
+	u := testutils.MustParseRequestURI(a.URL)
+	require.NoError(t, lb.UpsertServer(u))
+	require.NoError(t, lb.RemoveServer(u))
+	assert.Len(t, lb.removed, 1)
+
+	require.NoError(t, lb.UpsertServer(u))
+	assert.Empty(t, lb.removed)
+}
+
+func TestRoundRobin_restickSpreadInvalid(t *testing.T) {
+	_, err := New(nil, RestickSpread(-time.Second))
+	require.Error(t, err)
+}
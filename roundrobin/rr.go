@@ -2,41 +2,104 @@
 package roundrobin
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/internal/serverurl"
+	"github.com/vulcand/oxy/v2/ratelimit"
 	"github.com/vulcand/oxy/v2/utils"
 )
 
-// ErrNoServers indicates that there are no servers registered for the given Backend.
-var ErrNoServers = errors.New("no servers in the pool")
-
 // RoundRobin implements dynamic weighted round-robin load balancer http handler.
 type RoundRobin struct {
-	mutex      *sync.Mutex
-	next       http.Handler
-	errHandler utils.ErrorHandler
-	// Current index (starts from -1)
-	index                  int
+	mutex                  *sync.Mutex
+	next                   http.Handler
+	errHandler             utils.ErrorHandler
 	servers                []*server
-	currentWeight          int
 	stickySession          *StickySession
 	requestRewriteListener RequestRewriteListener
+	cloneRequest           bool
+
+	// waitForServers is how long a selection waits for a server when none is available.
+	waitForServers time.Duration
+	// serversChanged is closed, then replaced, when the servers change.
+	serversChanged chan struct{}
+
+	// failOnInvalidCookie rejects the requests with an invalid sticky cookie, see FailOnInvalidCookie.
+	failOnInvalidCookie bool
+
+	// warmUp is the ramp of the servers added to the pool, nil when disabled, see WarmUp.
+	warmUp *warmUp
+
+	// writeAffinity pins the clients to the backend of their last write, see WriteAffinity.
+	writeAffinity *writeAffinity
+
+	// hashAffinity extracts the key of the requests selecting their server by hashing, see EnableHashAffinity.
+	hashAffinity utils.SourceExtractor
+
+	// debugRouting lets the authorized requests choose their server with headers, see DebugRouting.
+	debugRouting *debugRouting
+
+	// weightScheduleListener is called when a weight schedule completes, see ScheduleWeight.
+	weightScheduleListener WeightScheduleListener
+
+	// dnsServers are the servers added by hostname, resolved into one server per address, see DNSServer.
+	dnsServers  []*dnsServer
+	resolver    Resolver
+	dnsListener func(DNSEvent)
+
+	// hostOverrides reports whether a server has a HostOverride, to skip the lookup of the override otherwise.
+	hostOverrides atomic.Bool
+
+	// tiered reports whether a server has a Tier other than 0, to skip the selection of the tier otherwise.
+	tiered bool
+	// activeTier is the tier the servers are selected from, see Tier.
+	activeTier    int
+	failbackDelay time.Duration
+	// failbackTier is the tier lower than the active one having servers since failbackStart, waiting for the failback delay.
+	failbackTier  int
+	failbackStart clock.Time
+	// stickyInActiveTier ignores the sticky cookies of the servers outside the active tier, see StickyAcrossTiers.
+	stickyInActiveTier bool
+
+	// filters is the selection chain, see SelectionFilter.
+	filters []*selectionFilter
+	// filtered reports whether the selection chain has user filters, to skip the tracking of the requests in flight otherwise.
+	filtered bool
+
+	// paced reports whether a server has a SendRate, to skip the pacing of the selection otherwise.
+	paced atomic.Bool
+	// sendRateMaxWait is how long a request waits for a server to admit it when all have reached their SendRate.
+	sendRateMaxWait time.Duration
+
+	// restickSpread is the window over which the clients of a removed server are stuck again, see RestickSpread.
+	restickSpread time.Duration
+	// removed are the servers removed for less than restickSpread, by normalized URL.
+	removed map[string]removedServer
 
 	verbose bool
 	log     utils.Logger
 }
 
 // New created a new RoundRobin.
+// next can be nil, and set later with Wrap.
 func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
 	rr := &RoundRobin{
-		next:          next,
-		index:         -1,
-		mutex:         &sync.Mutex{},
-		servers:       []*server{},
-		stickySession: nil,
+		next:           next,
+		mutex:          &sync.Mutex{},
+		servers:        []*server{},
+		stickySession:  nil,
+		cloneRequest:   true,
+		serversChanged: make(chan struct{}),
 
 		log: &utils.NoopLogger{},
 	}
@@ -46,110 +109,297 @@ func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
 		}
 	}
 	if rr.errHandler == nil {
-		rr.errHandler = utils.DefaultHandler
+		rr.errHandler = defaultErrHandler
+	}
+	rr.initFilters()
+	if rr.resolver == nil {
+		rr.resolver = net.DefaultResolver
+	}
+	for _, d := range rr.dnsServers {
+		d.resolving = true
+		rr.resolve(d)
 	}
 	return rr, nil
 }
 
+// Wrap sets the next handler to be called by the load balancer, when it was created without.
+func (r *RoundRobin) Wrap(next http.Handler) error {
+	if err := utils.CheckWrap(r.next, next); err != nil {
+		return err
+	}
+	r.next = next
+	return nil
+}
+
 // Next returns the next handler.
 func (r *RoundRobin) Next() http.Handler {
 	return r.next
 }
 
 func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if r.verbose {
+	if r.verbose && utils.DebugEnabled(r.log) {
 		dump := utils.DumpHTTPRequest(req)
 		r.log.Debug("vulcand/oxy/roundrobin/rr: begin ServeHttp on request: %s", dump)
 		defer r.log.Debug("vulcand/oxy/roundrobin/rr: completed ServeHttp on request: %s", dump)
 	}
 
-	// make shallow copy of request before chaning anything to avoid side effects
-	newReq := *req
-	stuck := false
-	if r.stickySession != nil {
-		cookieURL, present, err := r.stickySession.GetBackend(&newReq, r.Servers())
+	if r.next == nil {
+		utils.ServeError(r.errHandler, w, req, "roundrobin", &utils.ErrNotWired{Middleware: "roundrobin"})
+		return
+	}
+
+	// make a copy of request before changing anything to avoid side effects
+	newReq := copyRequest(req, r.cloneRequest)
+
+	var route debugRoute
+	if r.debugRouting != nil {
+		route = r.debugRouting.route(req, newReq, r.cloneRequest)
+	}
+
+	if route.pin != "" {
+		uri, err := r.pinnedServer(route.pin)
 		if err != nil {
-			r.log.Warn("vulcand/oxy/roundrobin/rr: error using server from cookie: %v", err)
+			utils.ServeError(r.errHandler, w, req, "roundrobin", err)
+			return
+		}
+		newReq.URL = uri
+		r.forward(w, req, newReq)
+		return
+	}
+
+	stuck := false
+	if r.writeAffinity != nil {
+		var ok bool
+		if stuck, ok = r.stick(r.writeAffinity.session, w, req, newReq); !ok {
+			return
 		}
+	}
 
-		if present {
-			newReq.URL = cookieURL
-			stuck = true
+	if !stuck && r.stickySession != nil {
+		var ok bool
+		if stuck, ok = r.stick(r.stickySession, w, req, newReq); !ok {
+			return
+		}
+	}
+
+	// The excluded servers are not selected, even by a cookie.
+	if stuck && route.excluded(newReq.URL) {
+		stuck = false
+	}
+
+	if stuck {
+		if err := r.paceServer(req.Context(), newReq.URL); err != nil {
+			utils.ServeError(r.errHandler, w, req, "roundrobin", err)
+			return
 		}
 	}
 
 	if !stuck {
-		uri, err := r.NextServer()
+		opts := r.affinityOptions(req)
+		if len(route.exclude) > 0 {
+			opts = append(opts, Exclude(route.exclude...))
+		}
+		if r.filtered {
+			opts = append(opts, ForRequest(req))
+		}
+
+		uri, err := r.NextServerWith(req.Context(), opts...)
 		if err != nil {
-			r.errHandler.ServeHTTP(w, req, err)
+			utils.ServeError(r.errHandler, w, req, "roundrobin", err)
 			return
 		}
 
-		if r.stickySession != nil {
-			r.stickySession.StickBackend(uri, w)
+		if r.stickySession != nil && !r.deferRestick(newReq) {
+			// the cookie is only set if the backend answers successfully.
+			sw := r.stickySession.stickyWriter(uri, w, newReq)
+			defer sw.finish()
+			w = sw
 		}
 		newReq.URL = uri
 	}
 
-	if r.verbose {
+	if r.writeAffinity != nil && r.writeAffinity.isWrite(req) {
+		// the client is pinned to the backend of the write, whether it was stuck or not.
+		sw := r.writeAffinity.session.stickyWriter(newReq.URL, w, newReq)
+		defer sw.finish()
+		w = sw
+	}
+
+	r.forward(w, req, newReq)
+}
+
+// forward passes newReq, the copy of req with the URL of the selected server, to the next handler.
+func (r *RoundRobin) forward(w http.ResponseWriter, req, newReq *http.Request) {
+	if r.verbose && utils.DebugEnabled(r.log) {
 		// log which backend URL we're sending this request to
 		dump := utils.DumpHTTPRequest(req)
 		r.log.Debug("vulcand/oxy/roundrobin/rr: Forwarding this request to URL (%s): %s", newReq.URL, dump)
 	}
 
+	if host := r.hostOverride(newReq.URL); host != "" {
+		newReq = newReq.WithContext(forward.WithHostOverride(newReq.Context(), host))
+	}
+
 	// Emit event to a listener if one exists
 	if r.requestRewriteListener != nil {
-		r.requestRewriteListener(req, &newReq)
+		r.requestRewriteListener(req, newReq)
+	}
+
+	if r.filtered {
+		defer r.trackInFlight(newReq.URL)()
+	}
+
+	r.next.ServeHTTP(w, newReq)
+}
+
+// stick sets the URL of newReq to the backend of the cookie of session, and reports whether it did.
+// ok is false when the request has been rejected because of an invalid cookie, see FailOnInvalidCookie.
+func (r *RoundRobin) stick(session *StickySession, w http.ResponseWriter, req, newReq *http.Request) (stuck, ok bool) {
+	cookieURL, present, err := session.getBackend(newReq, r.stickyServers())
+	if err != nil && !session.handleError(w, req, err, r.failOnInvalidCookie, r.errHandler, "roundrobin", r.log) {
+		return false, false
 	}
 
-	r.next.ServeHTTP(w, &newReq)
+	if present {
+		newReq.URL = utils.CopyURL(cookieURL)
+	}
+	return present, true
 }
 
 // NextServer gets the next server.
 func (r *RoundRobin) NextServer() (*url.URL, error) {
-	srv, err := r.nextServer()
+	return r.NextServerWith(context.Background())
+}
+
+// NextServerWith gets the next server matching the options.
+// A selection excluding servers (see Exclude) does not move the rotation: it returns the server the rotation would select
+// among the remaining ones, e.g. the following one when the next server is excluded, and leaves the state of all the servers
+// untouched, so the following calls select the same servers as without the exclusion.
+// When no server is available, it waits for one as configured by WaitForServers, as long as ctx is not done.
+// When the servers have all reached their SendRate, it waits for one as configured by SendRateMaxWait.
+func (r *RoundRobin) NextServerWith(ctx context.Context, opts ...NextOption) (*url.URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	o := &nextOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	srv, changed, err := r.nextServer(o)
+	if err != nil && r.waitForServers > 0 && (errors.Is(err, ErrNoServers) || errors.Is(err, ErrAllServersZeroWeight)) {
+		srv, err = r.waitServer(ctx, o, changed, err)
+	}
+	var limited *ErrSendRateLimited
+	if errors.As(err, &limited) && r.sendRateMaxWait > 0 {
+		srv, err = r.waitSendRate(ctx, o, limited)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return utils.CopyURL(srv.url), nil
 }
 
-func (r *RoundRobin) nextServer() (*server, error) {
+// waitServer retries the selection every time the servers change, until a server is selected or the wait is over.
+// On timeout, it returns the error of the first selection.
+func (r *RoundRobin) waitServer(ctx context.Context, o *nextOptions, changed <-chan struct{}, origErr error) (*server, error) {
+	timer := clock.NewTimer(r.waitForServers)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-changed:
+		case <-timer.C():
+			return nil, origErr
+		case <-ctx.Done():
+			return nil, origErr
+		}
+
+		var srv *server
+		var err error
+		srv, changed, err = r.nextServer(o)
+		if err == nil {
+			return srv, nil
+		}
+	}
+}
+
+// nextServer selects the next server.
+// It also returns the channel closed on the next change of the servers, to wait for a server when none is available.
+func (r *RoundRobin) nextServer(o *nextOptions) (*server, <-chan struct{}, error) {
 	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	now := clock.Now()
+	done := r.applySchedules(now)
+	r.updateTier(now)
+	srv, err := r.selectServer(o)
+	if err == nil && srv.sendRate != nil {
+		srv.sendRate.Take()
+	}
+	changed := r.serversChanged
+	stale := r.staleDNSServers(now)
+	r.mutex.Unlock()
+
+	r.notifySchedules(done)
+	for _, d := range stale {
+		go r.resolve(d)
+	}
+	return srv, changed, err
+}
 
+func (r *RoundRobin) selectServer(o *nextOptions) (*server, error) {
 	if len(r.servers) == 0 {
 		return nil, ErrNoServers
 	}
 
-	// The algo below may look messy, but is actually very simple
-	// it calculates the GCD  and subtracts it on every iteration, what interleaves servers
-	// and allows us not to build an iterator every time we readjust weights
+	candidates, err := r.filterServers(o)
+	if err != nil {
+		return nil, err
+	}
 
-	// GCD across all enabled servers
-	gcd := r.weightGcd()
-	// Maximum weight across all enabled servers
-	maxWeight := r.maxWeight()
+	// The hashed selections do not take part in the rotation.
+	if o.hashKey != "" {
+		return r.hashServer(o.hashKey, candidates)
+	}
 
-	for {
-		r.index = (r.index + 1) % len(r.servers)
-		if r.index == 0 {
-			r.currentWeight -= gcd
-			if r.currentWeight <= 0 {
-				r.currentWeight = maxWeight
-				if r.currentWeight == 0 {
-					return nil, errors.New("all servers have 0 weight")
-				}
-			}
+	// Smooth weighted round robin, as in nginx: on every selection, each candidate gains its weight,
+	// the one with the highest current weight is selected and loses the total weight of the candidates.
+	// It interleaves the servers evenly, even when the weights are skewed (e.g. 995 and 5 permille).
+	// The selections excluding servers only look at the current weights, without updating them.
+	var best *server
+	bestWeight, bestCurrent, total := 0, 0, 0
+	now := clock.Now()
+	if candidates == nil {
+		candidates = r.servers
+	}
+	for _, srv := range candidates {
+		if srv.weight == 0 {
+			continue
 		}
-		srv := r.servers[r.index]
-		if srv.weight >= r.currentWeight {
-			return srv, nil
+		weight := srv.effectiveWeight(now)
+		current := srv.currentWeight + weight
+		total += weight
+		if best == nil || current > bestCurrent || (current == bestCurrent && weight > bestWeight) {
+			best, bestWeight, bestCurrent = srv, weight, current
 		}
 	}
+
+	if best == nil {
+		return nil, ErrAllServersZeroWeight
+	}
+
+	if len(o.exclude) == 0 {
+		for _, srv := range candidates {
+			if srv.weight != 0 {
+				srv.currentWeight += srv.effectiveWeight(now)
+			}
+		}
+		best.currentWeight -= total
+	}
+	return best, nil
 }
 
-// RemoveServer remove a server.
+// RemoveServer remove a server, identified by its normalized URL (see NormalizeURL).
 func (r *RoundRobin) RemoveServer(u *url.URL) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
@@ -158,7 +408,9 @@ func (r *RoundRobin) RemoveServer(u *url.URL) error {
 	if e == nil {
 		return errors.New("server not found")
 	}
+	e.schedule = nil
 	r.servers = append(r.servers[:index], r.servers[index+1:]...)
+	r.rememberRemoved(e, clock.Now())
 	r.resetState()
 	return nil
 }
@@ -176,36 +428,66 @@ func (r *RoundRobin) Servers() []*url.URL {
 }
 
 // ServerWeight gets the server weight.
+// A weight set with WeightPermille is rounded up to whole units, so that a server that receives traffic
+// never reports a weight of 0; use ServerWeightPermille to get the exact weight.
 func (r *RoundRobin) ServerWeight(u *url.URL) (int, bool) {
+	w, ok := r.ServerWeightPermille(u)
+	if !ok {
+		return -1, false
+	}
+	return (w + weightScale - 1) / weightScale, true
+}
+
+// ServerWeightPermille gets the server weight in thousandths, e.g. 1000 for Weight(1) and 5 for WeightPermille(5).
+// During the warm-up of the server, it is the weight the server ramps to, see WarmUp.
+// During a schedule, it is the current weight of the server, see ScheduleWeight.
+func (r *RoundRobin) ServerWeightPermille(u *url.URL) (int, bool) {
 	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	done := r.applySchedules(clock.Now())
 
+	weight, ok := -1, false
 	if s, _ := r.findServerByURL(u); s != nil {
-		return s.weight, true
+		weight, ok = s.weight, true
 	}
-	return -1, false
+	r.mutex.Unlock()
+
+	r.notifySchedules(done)
+	return weight, ok
 }
 
-// UpsertServer In case if server is already present in the load balancer, returns error.
+// UpsertServer adds the server, or updates it with the options if it is already present.
+// The servers are identified by their normalized URLs (see NormalizeURL), and keep the URL they were added with.
+// The URLs with a query or a fragment are rejected.
 func (r *RoundRobin) UpsertServer(u *url.URL, options ...ServerOption) error {
+	// The completed schedules are reported once the mutex is released.
+	var done []*server
+	defer func() { r.notifySchedules(done) }()
+
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if u == nil {
-		return errors.New("server URL can't be nil")
+	if err := validateServerURL(u); err != nil {
+		return err
 	}
 
 	if s, _ := r.findServerByURL(u); s != nil {
+		// The schedule of the server is canceled if its weight is set.
+		done = r.applySchedules(clock.Now())
+		weight := s.weight
 		for _, o := range options {
 			if err := o(s); err != nil {
 				return err
 			}
 		}
+		if s.weight != weight {
+			s.schedule = nil
+		}
 		r.resetState()
 		return nil
 	}
 
-	srv := &server{url: utils.CopyURL(u)}
+	srv := &server{url: utils.CopyURL(u), id: NormalizeURL(u).String(), warmUp: r.warmUp}
+	delete(r.removed, srv.id)
 	for _, o := range options {
 		if err := o(srv); err != nil {
 			return err
@@ -213,7 +495,11 @@ func (r *RoundRobin) UpsertServer(u *url.URL, options ...ServerOption) error {
 	}
 
 	if srv.weight == 0 {
-		srv.weight = defaultWeight
+		srv.weight = defaultWeight * weightScale
+	}
+
+	if srv.warmUp != nil {
+		srv.warmUpStart = clock.Now()
 	}
 
 	r.servers = append(r.servers, srv)
@@ -222,12 +508,32 @@ func (r *RoundRobin) UpsertServer(u *url.URL, options ...ServerOption) error {
 }
 
 func (r *RoundRobin) resetIterator() {
-	r.index = -1
-	r.currentWeight = 0
+	for _, s := range r.servers {
+		s.currentWeight = 0
+	}
 }
 
 func (r *RoundRobin) resetState() {
 	r.resetIterator()
+
+	hostOverrides, tiered, paced := false, false, false
+	for _, s := range r.servers {
+		hostOverrides = hostOverrides || s.hostOverride != ""
+		tiered = tiered || s.tier != 0
+		paced = paced || s.sendRate != nil
+	}
+	r.hostOverrides.Store(hostOverrides)
+	r.paced.Store(paced)
+
+	r.tiered = tiered
+	if !tiered {
+		r.activeTier = 0
+		r.failbackStart = clock.Time{}
+	}
+
+	// Wake up the selections waiting for a server.
+	close(r.serversChanged)
+	r.serversChanged = make(chan struct{})
 }
 
 func (r *RoundRobin) findServerByURL(u *url.URL) (*server, int) {
@@ -242,26 +548,19 @@ func (r *RoundRobin) findServerByURL(u *url.URL) (*server, int) {
 	return nil, -1
 }
 
-func (r *RoundRobin) maxWeight() int {
-	maxWeight := -1
-	for _, s := range r.servers {
-		if s.weight > maxWeight {
-			maxWeight = s.weight
-		}
+// hostOverride returns the HostOverride of the server u, if any.
+func (r *RoundRobin) hostOverride(u *url.URL) string {
+	if !r.hostOverrides.Load() {
+		return ""
 	}
-	return maxWeight
-}
 
-func (r *RoundRobin) weightGcd() int {
-	divisor := -1
-	for _, s := range r.servers {
-		if divisor == -1 {
-			divisor = s.weight
-		} else {
-			divisor = gcd(divisor, s.weight)
-		}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if s, _ := r.findServerByURL(u); s != nil {
+		return s.hostOverride
 	}
-	return divisor
+	return ""
 }
 
 func gcd(a, b int) int {
@@ -274,10 +573,65 @@ func gcd(a, b int) int {
 // Set additional parameters for the server can be supplied when adding server.
 type server struct {
 	url *url.URL
-	// Relative weight for the enpoint to other enpoints in the load balancer
+	// id is the normalized URL of the server, hashed by the affinity.
+	id string
+	// Relative weight for the enpoint to other enpoints in the load balancer, in thousandths (see weightScale).
 	weight int
+	// currentWeight is the state of the server in the smooth weighted round-robin.
+	currentWeight int
+	// Labels describing the server, used to prefer servers during the selection.
+	labels map[string]string
+	// hostOverride is the host sent to the server by the forwarder, see HostOverride.
+	hostOverride string
+	// tier is the priority tier of the server, see Tier.
+	tier int
+	// warmUp is the ramp of the server from its addition, nil when disabled or over.
+	warmUp      *warmUp
+	warmUpStart clock.Time
+	// schedule is the interpolation of the weight of the server, nil when none is in progress, see ScheduleWeight.
+	schedule *weightSchedule
+	// sendRate paces the requests sent to the server, nil when unlimited, see SendRate.
+	sendRate *ratelimit.Pacer
+	// inFlight is the number of requests passed to the server by ServeHTTP, only tracked with a SelectionFilter.
+	inFlight atomic.Int64
+}
+
+// warmUp is a linear ramp of the weight of a server, from startFraction × weight to weight over duration.
+type warmUp struct {
+	duration      time.Duration
+	startFraction float64
+}
+
+// effectiveWeight returns the weight of the server at now, taking its warm-up into account.
+// The ramp is computed lazily on selection, and forgotten once over.
+func (s *server) effectiveWeight(now clock.Time) int {
+	if s.warmUp == nil {
+		return s.weight
+	}
+
+	elapsed := now.Sub(s.warmUpStart)
+	if elapsed >= s.warmUp.duration {
+		s.warmUp = nil
+		return s.weight
+	}
+
+	fraction := s.warmUp.startFraction
+	if elapsed > 0 {
+		fraction += (1 - fraction) * float64(elapsed) / float64(s.warmUp.duration)
+	}
+
+	// a server with a weight always gets some traffic.
+	w := int(float64(s.weight) * fraction)
+	if w < 1 {
+		w = 1
+	}
+	return w
 }
 
+// weightScale is the number of thousandths in a unit of weight:
+// the weights are stored in thousandths so that WeightPermille can split the traffic finely.
+const weightScale = 1000
+
 var defaultWeight = 1
 
 // SetDefaultWeight sets the default server weight.
@@ -289,6 +643,39 @@ func SetDefaultWeight(weight int) error {
 	return nil
 }
 
+// copyRequest makes a copy of the request that is safe to pass downstream.
+// When deep is set, the header map is cloned too, so that mutations made by the next handlers
+// (e.g. the forwarder adding X-Forwarded-* headers) are not visible to the caller.
+func copyRequest(req *http.Request, deep bool) *http.Request {
+	out := *req
+	if deep {
+		out.URL = utils.CopyURL(req.URL)
+		out.Header = make(http.Header, len(req.Header))
+		utils.CopyHeaders(out.Header, req.Header)
+	}
+	return &out
+}
+
+// NormalizeURL returns a copy of the server URL u in the form used to identify the servers:
+// the scheme and the host are lowercased, the default port of the scheme is removed, and an empty path becomes "/".
+// The servers are compared by their normalized URLs, e.g. http://10.0.0.5:80/ and HTTP://10.0.0.5 are the same server.
+// The sticky cookies match their servers in the same form.
+func NormalizeURL(u *url.URL) *url.URL {
+	return serverurl.Normalize(u)
+}
+
+// validateServerURL checks that u identifies a server: the query and the fragment are not part of the identity of a server.
+func validateServerURL(u *url.URL) error {
+	if u == nil {
+		return errors.New("server URL can't be nil")
+	}
+	if u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return fmt.Errorf("server URL %s can't have a query or a fragment", u.Redacted())
+	}
+	return nil
+}
+
 func sameURL(a, b *url.URL) bool {
+	a, b = NormalizeURL(a), NormalizeURL(b)
 	return a.Path == b.Path && a.Host == b.Host && a.Scheme == b.Scheme
 }
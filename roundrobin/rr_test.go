@@ -1,13 +1,18 @@
 package roundrobin
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
 	"github.com/vulcand/oxy/v2/testutils"
 	"github.com/vulcand/oxy/v2/utils"
 )
@@ -168,7 +173,8 @@ func TestRoundRobin_weighted(t *testing.T) {
 	proxy := httptest.NewServer(lb)
 	t.Cleanup(proxy.Close)
 
-	assert.Equal(t, []string{"a", "a", "b", "a", "b", "a"}, seq(t, proxy.URL, 6))
+	// The servers are interleaved evenly: a, b, a, b, a, then the cycle starts again.
+	assert.Equal(t, []string{"a", "b", "a", "b", "a", "a"}, seq(t, proxy.URL, 6))
 
 	w, ok := lb.ServerWeight(testutils.MustParseRequestURI(a.URL))
 	assert.Equal(t, 3, w)
@@ -187,6 +193,143 @@ func TestRoundRobin_weighted(t *testing.T) {
 	assert.False(t, ok)
 }
 
+func TestRoundRobin_weightPermille(t *testing.T) {
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(a, WeightPermille(995)))
+	require.NoError(t, lb.UpsertServer(b, WeightPermille(5)))
+
+	counts := map[string]int{}
+	maxGap, last := 0, -1
+	for i := 0; i < 10000; i++ {
+		u, err := lb.NextServer()
+		require.NoError(t, err)
+
+		counts[u.Host]++
+		if u.Host == "b" {
+			if last >= 0 && i-last > maxGap {
+				maxGap = i - last
+			}
+			last = i
+		}
+	}
+
+	assert.InDelta(t, 9950, counts["a"], 20)
+	assert.InDelta(t, 50, counts["b"], 20)
+	// The minority server is selected once every 200 requests, not in bursts.
+	assert.LessOrEqual(t, maxGap, 200)
+
+	w, ok := lb.ServerWeightPermille(b)
+	assert.True(t, ok)
+	assert.Equal(t, 5, w)
+
+	// The whole weight is rounded up, the server is not reported as disabled.
+	w, ok = lb.ServerWeight(b)
+	assert.True(t, ok)
+	assert.Equal(t, 1, w)
+}
+
+func TestRoundRobin_weightPermilleMixed(t *testing.T) {
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	// Weight(1) is WeightPermille(1000).
+	require.NoError(t, lb.UpsertServer(a, Weight(1)))
+	require.NoError(t, lb.UpsertServer(b, WeightPermille(500)))
+
+	assert.Equal(t, []string{"a", "b", "a", "a", "b", "a"}, nextSeq(t, lb, 6))
+
+	w, ok := lb.ServerWeightPermille(a)
+	assert.True(t, ok)
+	assert.Equal(t, 1000, w)
+
+	w, ok = lb.ServerWeight(a)
+	assert.True(t, ok)
+	assert.Equal(t, 1, w)
+
+	w, ok = lb.ServerWeight(b)
+	assert.True(t, ok)
+	assert.Equal(t, 1, w)
+}
+
+func TestRoundRobin_weightPermilleInvalid(t *testing.T) {
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	u := testutils.MustParseRequestURI("http://a")
+	require.Error(t, lb.UpsertServer(u, WeightPermille(-1)))
+	require.Error(t, lb.UpsertServer(u, WeightPermille(1001)))
+}
+
+func TestRoundRobin_smooth(t *testing.T) {
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	require.NoError(t, lb.UpsertServer(a, Weight(5)))
+	require.NoError(t, lb.UpsertServer(b, Weight(1)))
+
+	counts := map[string]int{}
+	run, longestRun := 0, 0
+	for i := 0; i < 600; i++ {
+		u, err := lb.NextServer()
+		require.NoError(t, err)
+		counts[u.Host]++
+
+		if u.Host == "a" {
+			run++
+		} else {
+			run = 0
+		}
+		if run > longestRun {
+			longestRun = run
+		}
+	}
+
+	assert.Equal(t, map[string]int{"a": 500, "b": 100}, counts)
+	assert.LessOrEqual(t, longestRun, 5)
+}
+
+func TestRoundRobin_smoothConcurrent(t *testing.T) {
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a"), Weight(5)))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://b"), Weight(1)))
+
+	var mu sync.Mutex
+	counts := map[string]int{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 75; j++ {
+				u, err := lb.NextServer()
+				if !assert.NoError(t, err) {
+					return
+				}
+				mu.Lock()
+				counts[u.Host]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.InDelta(t, 500, counts["a"], 1)
+	assert.InDelta(t, 100, counts["b"], 1)
+}
+
 func TestRoundRobinRequestRewriteListener(t *testing.T) {
 	testutils.NewResponder(t, "a")
 	testutils.NewResponder(t, "b")
@@ -200,6 +343,397 @@ func TestRoundRobinRequestRewriteListener(t *testing.T) {
 	assert.NotNil(t, lb.requestRewriteListener)
 }
 
+func TestRoundRobin_cloneRequest(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+
+	// mutates the request headers like a rewriting middleware would do.
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 100; i++ {
+			req.Header.Add(forward.XForwardedFor, "10.0.0.1")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var rewritten *http.Request
+	lb, err := New(next, RoundRobinRequestRewriteListener(func(_ *http.Request, newReq *http.Request) {
+		rewritten = newReq
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				_ = req.Header.Get(forward.XForwardedFor)
+			}
+		}()
+
+		lb.ServeHTTP(w, req)
+		<-done
+
+		assert.Empty(t, req.Header.Values(forward.XForwardedFor))
+		assert.NotSame(t, req.URL, rewritten.URL)
+	}))
+	t.Cleanup(proxy.Close)
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	require.NotNil(t, rewritten)
+	assert.Len(t, rewritten.Header.Values(forward.XForwardedFor), 100)
+}
+
+func TestRoundRobin_cloneRequestDisabled(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Add(forward.XForwardedFor, "10.0.0.1")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	lb, err := New(next, CloneRequest(false))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lb.ServeHTTP(w, req)
+
+		assert.Equal(t, "10.0.0.1", req.Header.Get(forward.XForwardedFor))
+	}))
+	t.Cleanup(proxy.Close)
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+}
+
+func TestRoundRobin_NextServerWith_exclude(t *testing.T) {
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	c := testutils.MustParseRequestURI("http://c")
+
+	newLB := func() *RoundRobin {
+		lb, err := New(nil)
+		require.NoError(t, err)
+
+		require.NoError(t, lb.UpsertServer(a))
+		require.NoError(t, lb.UpsertServer(b))
+		require.NoError(t, lb.UpsertServer(c))
+		return lb
+	}
+	lb, reference := newLB(), newLB()
+
+	// a is the next server in the rotation.
+	u, err := lb.NextServerWith(context.Background(), Exclude(a))
+	require.NoError(t, err)
+	assert.Equal(t, "b", u.Host)
+
+	// The rotation is unchanged.
+	assert.Equal(t, []string{"a", "b", "c", "a"}, nextSeq(t, lb, 4))
+	assert.Equal(t, []string{"a", "b", "c", "a"}, nextSeq(t, reference, 4))
+
+	// b is the next server in the rotation.
+	u, err = lb.NextServerWith(context.Background(), Exclude(a, b))
+	require.NoError(t, err)
+	assert.Equal(t, "c", u.Host)
+
+	_, err = lb.NextServerWith(context.Background(), Exclude(a, b, c))
+	require.ErrorIs(t, err, ErrNoServers)
+
+	assert.Equal(t, nextSeq(t, reference, 6), nextSeq(t, lb, 6))
+}
+
+func TestRoundRobin_NextServerWith_excludeWeighted(t *testing.T) {
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	c := testutils.MustParseRequestURI("http://c")
+
+	newLB := func() *RoundRobin {
+		lb, err := New(nil)
+		require.NoError(t, err)
+
+		require.NoError(t, lb.UpsertServer(a, Weight(3)))
+		require.NoError(t, lb.UpsertServer(b, Weight(2)))
+		require.NoError(t, lb.UpsertServer(c, Weight(1)))
+		return lb
+	}
+	lb, reference := newLB(), newLB()
+
+	for i := 0; i < 12; i++ {
+		next := nextSeq(t, reference, 1)[0]
+
+		// The next server in the rotation is excluded, the selection is the one of the rotation without it.
+		u, err := lb.NextServerWith(context.Background(), Exclude(testutils.MustParseRequestURI("http://"+next)))
+		require.NoError(t, err)
+		assert.NotEqual(t, next, u.Host)
+
+		// The rotation goes on as without the exclusion.
+		assert.Equal(t, []string{next}, nextSeq(t, lb, 1))
+	}
+}
+
+func TestRoundRobin_NextServerWith_preferLabel(t *testing.T) {
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	c := testutils.MustParseRequestURI("http://c")
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(a, Labels(map[string]string{"zone": "eu"})))
+	require.NoError(t, lb.UpsertServer(b, Labels(map[string]string{"zone": "us"})))
+	require.NoError(t, lb.UpsertServer(c, Labels(map[string]string{"zone": "eu", "tier": "gold"})))
+
+	var hosts []string
+	for i := 0; i < 4; i++ {
+		u, err := lb.NextServerWith(context.Background(), PreferLabel("zone", "eu"))
+		require.NoError(t, err)
+		hosts = append(hosts, u.Host)
+	}
+	assert.Equal(t, []string{"a", "c", "a", "c"}, hosts)
+
+	u, err := lb.NextServerWith(context.Background(), PreferLabel("zone", "eu"), PreferLabel("tier", "gold"))
+	require.NoError(t, err)
+	assert.Equal(t, "c", u.Host)
+
+	// No server matches: any server can be selected.
+	u, err = lb.NextServerWith(context.Background(), PreferLabel("zone", "ap"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", u.Host)
+
+	// The excluded servers are never selected, even when they match.
+	u, err = lb.NextServerWith(context.Background(), PreferLabel("zone", "eu"), Exclude(a, c))
+	require.NoError(t, err)
+	assert.Equal(t, "b", u.Host)
+}
+
+func TestRoundRobin_NextServerWith_canceledContext(t *testing.T) {
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = lb.NextServerWith(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRoundRobin_waitForServers(t *testing.T) {
+	a := testutils.NewResponder(t, "a")
+
+	testutils.FreezeTime(t)
+
+	lb, err := New(forward.New(false), WaitForServers(clock.Second))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+	require.NoError(t, lb.RemoveServer(testutils.MustParseRequestURI(a.URL)))
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		re, body, err := testutils.Get(proxy.URL)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		done <- result{code: re.StatusCode, body: string(body)}
+	}()
+
+	// Wait for the request to wait for a server.
+	require.True(t, clock.Wait4Scheduled(1, 5*time.Second))
+
+	clock.Advance(50 * clock.Millisecond)
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+
+	select {
+	case res := <-done:
+		require.NoError(t, res.err)
+		assert.Equal(t, http.StatusOK, res.code)
+		assert.Equal(t, "a", res.body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the request")
+	}
+}
+
+func TestRoundRobin_waitForServers_timeout(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, err := New(forward.New(false), WaitForServers(100*clock.Millisecond))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	done := make(chan int, 1)
+	go func() {
+		re, _, err := testutils.Get(proxy.URL)
+		if err != nil {
+			done <- 0
+			return
+		}
+		done <- re.StatusCode
+	}()
+
+	require.True(t, clock.Wait4Scheduled(1, 5*time.Second))
+
+	clock.Advance(50 * clock.Millisecond)
+
+	select {
+	case <-done:
+		t.Fatal("the request should still be waiting")
+	default:
+	}
+
+	clock.Advance(50 * clock.Millisecond)
+
+	select {
+	case code := <-done:
+		assert.Equal(t, http.StatusInternalServerError, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the request")
+	}
+}
+
+func TestRoundRobin_waitForServers_canceled(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, err := New(nil, WaitForServers(clock.Minute))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := lb.NextServerWith(ctx)
+		done <- err
+	}()
+
+	require.True(t, clock.Wait4Scheduled(1, 5*time.Second))
+	cancel()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, ErrNoServers)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the selection")
+	}
+}
+
+func TestRoundRobin_warmUp(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+
+	lb, err := New(nil, WarmUp(10*time.Second, 0.1))
+	require.NoError(t, err)
+
+	// a joined before the warm-up window of b: its ramp is over.
+	require.NoError(t, lb.UpsertServer(a))
+	clock.Advance(10 * time.Second)
+	require.NoError(t, lb.UpsertServer(b))
+
+	assert.InDelta(t, 1.0/11, share(t, lb, "b", 1000), 0.01)
+
+	clock.Advance(5 * time.Second)
+	assert.InDelta(t, 0.55/1.55, share(t, lb, "b", 1000), 0.01)
+
+	// Re-upserting b does not restart its ramp.
+	require.NoError(t, lb.UpsertServer(b))
+	assert.InDelta(t, 0.55/1.55, share(t, lb, "b", 1000), 0.01)
+
+	// The weight of b during its warm-up is the target weight.
+	weight, ok := lb.ServerWeight(b)
+	require.True(t, ok)
+	assert.Equal(t, 1, weight)
+
+	clock.Advance(5 * time.Second)
+	assert.InDelta(t, 0.5, share(t, lb, "b", 1000), 0.001)
+	assert.Equal(t, []string{"a", "b", "a", "b"}, nextSeq(t, lb, 4))
+
+	// b starts a new ramp once removed and added again.
+	require.NoError(t, lb.RemoveServer(b))
+	require.NoError(t, lb.UpsertServer(b))
+	assert.InDelta(t, 1.0/11, share(t, lb, "b", 1000), 0.01)
+}
+
+func TestRoundRobin_serverWarmUp(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	c := testutils.MustParseRequestURI("http://c")
+
+	lb, err := New(nil, WarmUp(10*time.Second, 0.1))
+	require.NoError(t, err)
+
+	// a and b have no warm-up, c overrides the warm-up of the load balancer.
+	require.NoError(t, lb.UpsertServer(a, ServerWarmUp(0, 0)))
+	require.NoError(t, lb.UpsertServer(b, ServerWarmUp(0, 0)))
+	require.NoError(t, lb.UpsertServer(c, ServerWarmUp(20*time.Second, 0.5)))
+
+	assert.InDelta(t, 0.5/2.5, share(t, lb, "c", 1000), 0.01)
+
+	clock.Advance(10 * time.Second)
+	assert.InDelta(t, 0.75/2.75, share(t, lb, "c", 1000), 0.01)
+
+	clock.Advance(10 * time.Second)
+	assert.InDelta(t, 1.0/3, share(t, lb, "c", 999), 0.001)
+}
+
+func TestRoundRobin_warmUpInvalid(t *testing.T) {
+	_, err := New(nil, WarmUp(-time.Second, 0.1))
+	require.Error(t, err)
+
+	_, err = New(nil, WarmUp(time.Second, 1.5))
+	require.Error(t, err)
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+	require.Error(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a"), ServerWarmUp(time.Second, -0.1)))
+}
+
+// share returns the share of the selections of host among repeat selections.
+func share(t *testing.T, lb *RoundRobin, host string, repeat int) float64 {
+	t.Helper()
+
+	var n int
+	for _, h := range nextSeq(t, lb, repeat) {
+		if h == host {
+			n++
+		}
+	}
+	return float64(n) / float64(repeat)
+}
+
+func nextSeq(t *testing.T, lb *RoundRobin, repeat int) []string {
+	t.Helper()
+
+	var out []string
+	for i := 0; i < repeat; i++ {
+		u, err := lb.NextServer()
+		require.NoError(t, err)
+		out = append(out, u.Host)
+	}
+	return out
+}
+
 func seq(t *testing.T, url string, repeat int) []string {
 	t.Helper()
 
@@ -211,3 +745,98 @@ func seq(t *testing.T, url string, repeat int) []string {
 	}
 	return out
 }
+
+func TestNormalizeURL(t *testing.T) {
+	testCases := []struct {
+		in       string
+		expected string
+	}{
+		{in: "http://10.0.0.5:80/", expected: "http://10.0.0.5/"},
+		{in: "http://10.0.0.5", expected: "http://10.0.0.5/"},
+		{in: "HTTP://Backend.Internal", expected: "http://backend.internal/"},
+		{in: "https://backend:443/app", expected: "https://backend/app"},
+		{in: "https://backend:80", expected: "https://backend:80/"},
+		{in: "http://[::1]:80", expected: "http://[::1]/"},
+		{in: "http://backend:8080/App/", expected: "http://backend:8080/App/"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.in, func(t *testing.T) {
+			u := testutils.MustParseRequestURI(test.in)
+			assert.Equal(t, test.expected, NormalizeURL(u).String())
+			// The URL is not modified.
+			assert.Equal(t, testutils.MustParseRequestURI(test.in), u)
+		})
+	}
+
+	assert.Nil(t, NormalizeURL(nil))
+}
+
+func TestRoundRobin_normalizedServers(t *testing.T) {
+	lb, err := New(hostHandler)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://10.0.0.5:80/"), Weight(2)))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("HTTP://10.0.0.5")))
+	// The server keeps the URL it was added with.
+	require.Len(t, lb.Servers(), 1)
+	assert.Equal(t, "http://10.0.0.5:80/", lb.Servers()[0].String())
+
+	w, ok := lb.ServerWeight(testutils.MustParseRequestURI("http://10.0.0.5"))
+	assert.True(t, ok)
+	assert.Equal(t, 2, w)
+
+	require.NoError(t, lb.RemoveServer(testutils.MustParseRequestURI("http://10.0.0.5")))
+	assert.Empty(t, lb.Servers())
+
+	err = lb.UpsertServer(testutils.MustParseRequestURI("http://10.0.0.5/?a=b"))
+	require.Error(t, err)
+	u, err := url.Parse("http://10.0.0.5/#a")
+	require.NoError(t, err)
+	err = lb.UpsertServer(u)
+	require.Error(t, err)
+	assert.Empty(t, lb.Servers())
+}
+
+func TestRebalancer_normalizedServers(t *testing.T) {
+	lb, err := New(hostHandler)
+	require.NoError(t, err)
+	rb, err := NewRebalancer(lb)
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI("https://backend:443")))
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI("https://BACKEND/")))
+	assert.Len(t, rb.Servers(), 1)
+	assert.Len(t, lb.Servers(), 1)
+
+	require.NoError(t, rb.RemoveServer(testutils.MustParseRequestURI("https://backend")))
+	assert.Empty(t, rb.Servers())
+	assert.Empty(t, lb.Servers())
+
+	require.Error(t, rb.UpsertServer(testutils.MustParseRequestURI("https://backend/?a=b")))
+	assert.Empty(t, rb.Servers())
+}
+
+func BenchmarkRoundRobin_cloneRequest(b *testing.B) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	lb, err := New(handler)
+	require.NoError(b, err)
+	require.NoError(b, lb.UpsertServer(testutils.MustParseRequestURI("http://localhost:5000")))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	// The headers of the request are copied for the next handler.
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("X-Request-Id", "1bd36bcc-a0d1-4fc7-aedc-20bbdefa27c5")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
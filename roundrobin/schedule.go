@@ -0,0 +1,183 @@
+package roundrobin
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/utils"
+)
+
+// WeightScheduleListener is called when the schedule of the weight of a server completes, see ScheduleWeight.
+// weight is the weight reached by the server, in units of Weight.
+type WeightScheduleListener func(u *url.URL, weight int)
+
+// weightScheduler is implemented by the balancers supporting the scheduled weight changes, e.g. RoundRobin.
+type weightScheduler interface {
+	ScheduleWeight(u *url.URL, target int, over time.Duration) (func(), error)
+	ScheduledWeight(u *url.URL) (int, bool)
+}
+
+// weightSchedule is a linear interpolation of the weight of a server, in thousandths, from `from` to `to` over duration.
+type weightSchedule struct {
+	from     int
+	to       int
+	start    clock.Time
+	duration time.Duration
+}
+
+// weightAt returns the weight at now, and whether the schedule is over.
+func (s *weightSchedule) weightAt(now clock.Time) (int, bool) {
+	elapsed := now.Sub(s.start)
+	if elapsed >= s.duration {
+		return s.to, true
+	}
+	if elapsed <= 0 {
+		return s.from, false
+	}
+	return s.from + int(int64(s.to-s.from)*int64(elapsed)/int64(s.duration)), false
+}
+
+// ScheduleWeight shifts the weight of the server, identified by its normalized URL (see NormalizeURL),
+// linearly from its current weight to target over the duration, e.g. for a progressive rollout.
+// The weight is interpolated on every selection, the progress does not depend on any caller once scheduled.
+// A server has at most one schedule: a new schedule replaces the previous one, from the current weight.
+// cancel freezes the weight at its current value, it has no effect once the schedule is over or replaced.
+// Setting the weight of the server with UpsertServer, or removing the server, cancels the schedule.
+// The completion is reported to the listener set with OnWeightScheduleDone, on the first selection after it.
+func (r *RoundRobin) ScheduleWeight(u *url.URL, target int, over time.Duration) (func(), error) {
+	if target < 0 {
+		return nil, errors.New("target weight should be >= 0")
+	}
+	if over <= 0 {
+		return nil, fmt.Errorf("invalid schedule duration: %v", over)
+	}
+
+	r.mutex.Lock()
+	now := clock.Now()
+	done := r.applySchedules(now)
+
+	s, _ := r.findServerByURL(u)
+	if s == nil {
+		r.mutex.Unlock()
+		r.notifySchedules(done)
+		return nil, errors.New("server not found")
+	}
+
+	schedule := &weightSchedule{from: s.weight, to: target * weightScale, start: now, duration: over}
+	s.schedule = schedule
+	r.mutex.Unlock()
+	r.notifySchedules(done)
+
+	cancel := func() {
+		r.mutex.Lock()
+		done := r.applySchedules(clock.Now())
+		if s.schedule == schedule {
+			s.schedule = nil
+		}
+		r.mutex.Unlock()
+		r.notifySchedules(done)
+	}
+	return cancel, nil
+}
+
+// ScheduledWeight returns the target weight of the schedule of the server, if it has one in progress, see ScheduleWeight.
+func (r *RoundRobin) ScheduledWeight(u *url.URL) (int, bool) {
+	r.mutex.Lock()
+	done := r.applySchedules(clock.Now())
+
+	target, ok := -1, false
+	if s, _ := r.findServerByURL(u); s != nil && s.schedule != nil {
+		target, ok = s.schedule.to/weightScale, true
+	}
+	r.mutex.Unlock()
+
+	r.notifySchedules(done)
+	return target, ok
+}
+
+// applySchedules updates the weights of the servers having a schedule, and returns the servers whose schedule is over.
+// It must be called with the mutex held.
+func (r *RoundRobin) applySchedules(now clock.Time) []*server {
+	var done []*server
+	for _, s := range r.servers {
+		if s.schedule == nil {
+			continue
+		}
+		weight, over := s.schedule.weightAt(now)
+		s.weight = weight
+		if over {
+			s.schedule = nil
+			done = append(done, s)
+		}
+	}
+	return done
+}
+
+// notifySchedules reports the completed schedules to the listener, it must be called without the mutex.
+func (r *RoundRobin) notifySchedules(done []*server) {
+	if r.weightScheduleListener == nil {
+		return
+	}
+	for _, s := range done {
+		r.weightScheduleListener(utils.CopyURL(s.url), s.weight/weightScale)
+	}
+}
+
+// ScheduleWeight shifts the weight of the server linearly from its current weight to target over the duration,
+// see RoundRobin.ScheduleWeight. The wrapped balancer must support the schedules, as RoundRobin does.
+// The original weight of the server follows the schedule, and the weight of the server is not adjusted while it is in progress.
+func (rb *Rebalancer) ScheduleWeight(u *url.URL, target int, over time.Duration) (func(), error) {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	ws, ok := rb.next.(weightScheduler)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support the weight schedules", rb.next)
+	}
+
+	srv, i := rb.findServer(u)
+	if i == -1 {
+		return nil, fmt.Errorf("%v not found", u)
+	}
+
+	cancel, err := ws.ScheduleWeight(u, target, over)
+	if err != nil {
+		return nil, err
+	}
+	srv.scheduled = true
+
+	return cancel, nil
+}
+
+// trackSchedules sets the original and current weights of the servers having a schedule to their scheduled weight,
+// so that the weights are not adjusted against the schedules. It must be called with the mutex held.
+func (rb *Rebalancer) trackSchedules() {
+	ws, ok := rb.next.(weightScheduler)
+	if !ok {
+		return
+	}
+
+	for _, srv := range rb.servers {
+		if !srv.scheduled {
+			continue
+		}
+		// The weight is read first: it completes the schedule if it is over.
+		weight := rb.serverWeight(srv.url)
+		_, srv.scheduled = ws.ScheduledWeight(srv.url)
+		srv.origWeight = weight
+		srv.curWeight = weight
+	}
+}
+
+// hasSchedules reports whether a server has a schedule in progress, see trackSchedules.
+func (rb *Rebalancer) hasSchedules() bool {
+	for _, srv := range rb.servers {
+		if srv.scheduled {
+			return true
+		}
+	}
+	return false
+}
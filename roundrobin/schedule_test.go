@@ -0,0 +1,223 @@
+package roundrobin
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// shareOf returns the share of the n next servers of lb that are u.
+func shareOf(t *testing.T, lb *RoundRobin, u *url.URL, n int) float64 {
+	t.Helper()
+
+	var hits int
+	for i := 0; i < n; i++ {
+		next, err := lb.NextServer()
+		require.NoError(t, err)
+		if next.String() == u.String() {
+			hits++
+		}
+	}
+	return float64(hits) / float64(n)
+}
+
+func TestRoundRobin_scheduleWeight(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	var completed []int
+	lb, err := New(nil, OnWeightScheduleDone(func(u *url.URL, weight int) {
+		assert.Equal(t, "http://b", u.String())
+		completed = append(completed, weight)
+	}))
+	require.NoError(t, err)
+
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	require.NoError(t, lb.UpsertServer(a, Weight(100)))
+	require.NoError(t, lb.UpsertServer(b, Weight(1)))
+
+	_, err = lb.ScheduleWeight(b, 100, 10*time.Minute)
+	require.NoError(t, err)
+
+	target, ok := lb.ScheduledWeight(b)
+	assert.True(t, ok)
+	assert.Equal(t, 100, target)
+
+	for _, step := range []struct {
+		elapsed time.Duration
+		weight  float64
+	}{
+		{elapsed: 150 * time.Second, weight: 25.75},
+		{elapsed: 300 * time.Second, weight: 50.5},
+		{elapsed: 450 * time.Second, weight: 75.25},
+	} {
+		clock.Advance(150 * time.Second)
+
+		expected := step.weight / (100 + step.weight)
+		assert.InDelta(t, expected, shareOf(t, lb, b, 1000), 0.01, step.elapsed)
+	}
+	assert.Empty(t, completed)
+
+	clock.Advance(150 * time.Second)
+
+	assert.InDelta(t, 0.5, shareOf(t, lb, b, 1000), 0.01)
+	assert.Equal(t, []int{100}, completed)
+
+	weight, _ := lb.ServerWeight(b)
+	assert.Equal(t, 100, weight)
+
+	_, ok = lb.ScheduledWeight(b)
+	assert.False(t, ok)
+}
+
+func TestRoundRobin_scheduleWeightCancel(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	require.NoError(t, lb.UpsertServer(a, Weight(100)))
+	require.NoError(t, lb.UpsertServer(b, Weight(1)))
+
+	cancel, err := lb.ScheduleWeight(b, 100, 10*time.Minute)
+	require.NoError(t, err)
+
+	clock.Advance(5 * time.Minute)
+	cancel()
+
+	frozen := 50.5 / 150.5
+	assert.InDelta(t, frozen, shareOf(t, lb, b, 1000), 0.01)
+
+	clock.Advance(5 * time.Minute)
+	assert.InDelta(t, frozen, shareOf(t, lb, b, 1000), 0.01)
+
+	weight, _ := lb.ServerWeightPermille(b)
+	assert.Equal(t, 50500, weight)
+
+	_, ok := lb.ScheduledWeight(b)
+	assert.False(t, ok)
+}
+
+func TestRoundRobin_scheduleWeightReplace(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	b := testutils.MustParseRequestURI("http://b")
+	require.NoError(t, lb.UpsertServer(b, Weight(10)))
+
+	cancel, err := lb.ScheduleWeight(b, 20, 10*time.Minute)
+	require.NoError(t, err)
+
+	clock.Advance(5 * time.Minute)
+
+	// The new schedule starts from the current weight, the cancellation of the replaced one has no effect.
+	_, err = lb.ScheduleWeight(b, 5, 10*time.Minute)
+	require.NoError(t, err)
+	cancel()
+
+	clock.Advance(5 * time.Minute)
+
+	weight, _ := lb.ServerWeightPermille(b)
+	assert.Equal(t, 10000, weight)
+
+	// Setting the weight cancels the schedule.
+	require.NoError(t, lb.UpsertServer(b, Weight(3)))
+	clock.Advance(5 * time.Minute)
+
+	weight, _ = lb.ServerWeight(b)
+	assert.Equal(t, 3, weight)
+}
+
+func TestRoundRobin_scheduleWeightRemoveServer(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	var completed int
+	lb, err := New(nil, OnWeightScheduleDone(func(*url.URL, int) { completed++ }))
+	require.NoError(t, err)
+
+	b := testutils.MustParseRequestURI("http://b")
+	require.NoError(t, lb.UpsertServer(b, Weight(1)))
+
+	_, err = lb.ScheduleWeight(b, 100, 10*time.Minute)
+	require.NoError(t, err)
+
+	clock.Advance(5 * time.Minute)
+	require.NoError(t, lb.RemoveServer(b))
+
+	_, ok := lb.ScheduledWeight(b)
+	assert.False(t, ok)
+
+	// The server added again does not resume the schedule.
+	require.NoError(t, lb.UpsertServer(b, Weight(1)))
+	clock.Advance(10 * time.Minute)
+
+	weight, _ := lb.ServerWeight(b)
+	assert.Equal(t, 1, weight)
+	assert.Zero(t, completed)
+}
+
+func TestRoundRobin_scheduleWeightInvalid(t *testing.T) {
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	b := testutils.MustParseRequestURI("http://b")
+
+	_, err = lb.ScheduleWeight(b, 10, time.Minute)
+	require.Error(t, err)
+
+	require.NoError(t, lb.UpsertServer(b))
+
+	_, err = lb.ScheduleWeight(b, -1, time.Minute)
+	require.Error(t, err)
+
+	_, err = lb.ScheduleWeight(b, 10, 0)
+	require.Error(t, err)
+}
+
+func TestRebalancer_scheduleWeight(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(lb)
+	require.NoError(t, err)
+
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	require.NoError(t, rb.UpsertServer(a, Weight(100)))
+	require.NoError(t, rb.UpsertServer(b, Weight(1)))
+
+	_, err = rb.ScheduleWeight(b, 100, 10*time.Minute)
+	require.NoError(t, err)
+
+	clock.Advance(5 * time.Minute)
+
+	// The reset of the weights, e.g. on a change of the servers, does not interrupt the schedule.
+	c := testutils.MustParseRequestURI("http://c")
+	require.NoError(t, rb.UpsertServer(c, Weight(100)))
+
+	srv, _ := rb.findServer(b)
+	assert.Equal(t, 50500, srv.origWeight)
+	assert.Equal(t, 50500, srv.curWeight)
+
+	clock.Advance(5 * time.Minute)
+	rb.adjustWeights()
+
+	weight, _ := lb.ServerWeight(b)
+	assert.Equal(t, 100, weight)
+	assert.Equal(t, 100000, srv.origWeight)
+	assert.False(t, srv.scheduled)
+
+	_, err = rb.ScheduleWeight(testutils.MustParseRequestURI("http://d"), 10, time.Minute)
+	require.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package roundrobin
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// waitSendRate retries the selection once a server admits a request, as configured by SendRateMaxWait.
+// On timeout, it returns the ErrSendRateLimited of the last selection.
+func (r *RoundRobin) waitSendRate(ctx context.Context, o *nextOptions, limited *ErrSendRateLimited) (*server, error) {
+	deadline := clock.Now().Add(r.sendRateMaxWait)
+	for {
+		if !waitUntil(ctx, deadline, limited.RetryAfter) {
+			return nil, limited
+		}
+
+		srv, _, err := r.nextServer(o)
+		if !errors.As(err, &limited) {
+			return srv, err
+		}
+	}
+}
+
+// paceServer takes a request from the send rate of the server u, selected without the rotation (e.g. by a sticky cookie).
+// It waits for the server to admit the request as configured by SendRateMaxWait, or returns an ErrSendRateLimited.
+func (r *RoundRobin) paceServer(ctx context.Context, u *url.URL) error {
+	if !r.paced.Load() {
+		return nil
+	}
+
+	deadline := clock.Now().Add(r.sendRateMaxWait)
+	for {
+		var delay time.Duration
+		r.mutex.Lock()
+		if srv, _ := r.findServerByURL(u); srv != nil && srv.sendRate != nil {
+			delay, _ = srv.sendRate.Take()
+		}
+		r.mutex.Unlock()
+
+		if delay == 0 {
+			return nil
+		}
+		if !waitUntil(ctx, deadline, delay) {
+			return &ErrSendRateLimited{RetryAfter: delay}
+		}
+	}
+}
+
+// waitUntil waits for delay, and reports whether it did: it does not wait past the deadline, and stops when ctx is done.
+func waitUntil(ctx context.Context, deadline clock.Time, delay time.Duration) bool {
+	if delay > deadline.Sub(clock.Now()) {
+		return false
+	}
+
+	timer := clock.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
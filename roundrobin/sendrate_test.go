@@ -0,0 +1,178 @@
+package roundrobin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func TestRoundRobin_sendRate(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	require.NoError(t, lb.UpsertServer(a, SendRate(2, 2, time.Second)))
+	require.NoError(t, lb.UpsertServer(b))
+
+	// The burst is sent to the other server once the capped one has reached its send rate.
+	assert.Equal(t, map[string]int{"http://a": 2, "http://b": 8}, selections(t, lb, 10))
+
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, map[string]int{"http://a": 1, "http://b": 9}, selections(t, lb, 10))
+
+	// Without the other server, the requests fail.
+	require.NoError(t, lb.RemoveServer(b))
+	_, err = lb.NextServer()
+	var limited *ErrSendRateLimited
+	require.ErrorAs(t, err, &limited)
+	assert.Equal(t, 500*time.Millisecond, limited.RetryAfter)
+}
+
+func TestRoundRobin_sendRateMaxWait(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, err := New(nil, SendRateMaxWait(time.Second))
+	require.NoError(t, err)
+
+	a := testutils.MustParseRequestURI("http://a")
+	require.NoError(t, lb.UpsertServer(a, SendRate(2, 2, time.Second)))
+
+	assert.Equal(t, map[string]int{"http://a": 2}, selections(t, lb, 2))
+
+	// The requests are spaced out to the send rate.
+	for i := 0; i < 3; i++ {
+		selected := make(chan error, 1)
+		go func() {
+			_, err := lb.NextServerWith(context.Background())
+			selected <- err
+		}()
+
+		require.True(t, testutils.Wait4Scheduled(1, 5*time.Second))
+		clock.Advance(499 * time.Millisecond)
+		assert.Empty(t, selected)
+
+		clock.Advance(time.Millisecond)
+		require.NoError(t, <-selected)
+	}
+
+	// The wait is bounded by the request context.
+	ctx, cancel := context.WithCancel(context.Background())
+	selected := make(chan error, 1)
+	go func() {
+		_, err := lb.NextServerWith(ctx)
+		selected <- err
+	}()
+
+	require.True(t, testutils.Wait4Scheduled(1, 5*time.Second))
+	cancel()
+
+	var limited *ErrSendRateLimited
+	require.ErrorAs(t, <-selected, &limited)
+	assert.Equal(t, 500*time.Millisecond, limited.RetryAfter)
+}
+
+func TestRoundRobin_sendRateRetryAfter(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	a := testutils.NewResponder(t, "a")
+
+	lb, err := New(forward.New(false), SendRateMaxWait(300*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL), SendRate(2, 2, time.Second)))
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	for i := 0; i < 2; i++ {
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "a", string(body))
+	}
+
+	// The wait for the server would be longer than the max wait: the request fails at once.
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, "1", re.Header.Get("Retry-After"))
+}
+
+func TestRoundRobin_sendRateSticky(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+
+	lb, err := New(forward.New(false), EnableStickySession(NewStickySession("test")))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL), SendRate(1, 1, time.Second)))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	stuckToA := testutils.Header("Cookie", (&http.Cookie{Name: "test", Value: a.URL}).String())
+
+	re, body, err := testutils.Get(proxy.URL, stuckToA)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "a", string(body))
+
+	// The sticky requests are not sent to another server.
+	re, _, err = testutils.Get(proxy.URL, stuckToA)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, "1", re.Header.Get("Retry-After"))
+
+	clock.Advance(time.Second)
+	re, body, err = testutils.Get(proxy.URL, stuckToA)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "a", string(body))
+}
+
+func TestRebalancer_sendRate(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(lb)
+	require.NoError(t, err)
+
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	require.NoError(t, rb.UpsertServer(a, SendRate(2, 2, time.Second)))
+	require.NoError(t, rb.UpsertServer(b))
+
+	assert.Equal(t, map[string]int{"http://a": 2, "http://b": 8}, selections(t, lb, 10))
+
+	// The weights set by the rebalancer keep the send rate.
+	require.NoError(t, lb.UpsertServer(a, Weight(2)))
+	clock.Advance(time.Second)
+	assert.Equal(t, map[string]int{"http://a": 2, "http://b": 8}, selections(t, lb, 10))
+}
+
+func TestSendRate_invalid(t *testing.T) {
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	u := &url.URL{Scheme: "http", Host: "a"}
+	assert.Error(t, lb.UpsertServer(u, SendRate(0, 1, time.Second)))
+	assert.Error(t, lb.UpsertServer(u, SendRate(1, 1, 0)))
+
+	_, err = New(nil, SendRateMaxWait(-time.Second))
+	assert.Error(t, err)
+}
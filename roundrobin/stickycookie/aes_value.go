@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
@@ -21,11 +22,18 @@ import (
 type AESValue struct {
 	block cipher.AEAD
 	ttl   time.Duration
+	opts  *options
 }
 
 // NewAESValue takes a fixed-size key and returns an CookieValue or an error.
 // Key size must be exactly one of 16, 24, or 32 bytes to select AES-128, AES-192, or AES-256.
-func NewAESValue(key []byte, ttl time.Duration) (*AESValue, error) {
+// With BindTo, the binding is the additional data of the AEAD: the cookies set without binding are rejected.
+func NewAESValue(key []byte, ttl time.Duration, opts ...Option) (*AESValue, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -36,11 +44,20 @@ func NewAESValue(key []byte, ttl time.Duration) (*AESValue, error) {
 		return nil, err
 	}
 
-	return &AESValue{block: gcm, ttl: ttl}, nil
+	return &AESValue{block: gcm, ttl: ttl, opts: o}, nil
 }
 
 // Get hashes the sticky value.
 func (v *AESValue) Get(raw *url.URL) string {
+	return v.seal(raw, "")
+}
+
+// GetFor hashes the sticky value, bound to the client of req.
+func (v *AESValue) GetFor(req *http.Request, raw *url.URL) string {
+	return v.seal(raw, v.opts.binding(req))
+}
+
+func (v *AESValue) seal(raw *url.URL, binding string) string {
 	base := raw.String()
 	if v.ttl > 0 {
 		base = fmt.Sprintf("%s|%d", base, clock.Now().UTC().Add(v.ttl).Unix())
@@ -66,7 +83,7 @@ func (v *AESValue) Get(raw *url.URL) string {
 		nonce[i+8] = rpend[i]
 	}
 
-	obfuscated := v.block.Seal(nil, nonce, []byte(base), nil)
+	obfuscated := v.block.Seal(nil, nonce, []byte(base), []byte(binding))
 	// We append the 12byte nonce onto the end of the message
 	obfuscated = append(obfuscated, nonce...)
 	obfuscatedStr := base64.RawURLEncoding.EncodeToString(obfuscated)
@@ -76,11 +93,32 @@ func (v *AESValue) Get(raw *url.URL) string {
 
 // FindURL gets url from array that match the value.
 func (v *AESValue) FindURL(raw string, urls []*url.URL) (*url.URL, error) {
-	rawURL, err := v.fromValue(raw)
+	rawURL, err := v.fromValue(raw, "")
 	if err != nil {
 		return nil, err
 	}
 
+	return findURL(rawURL, urls)
+}
+
+// FindURLFor gets url from array that match the value, if the value is bound to the client of req.
+func (v *AESValue) FindURLFor(req *http.Request, raw string, urls []*url.URL) (*url.URL, error) {
+	binding := v.opts.binding(req)
+
+	rawURL, err := v.fromValue(raw, binding)
+	if err != nil {
+		var errOpen *openError
+		if binding != "" && errors.As(err, &errOpen) {
+			// bound to another client, or set without binding.
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return findURL(rawURL, urls)
+}
+
+func findURL(rawURL string, urls []*url.URL) (*url.URL, error) {
 	for _, u := range urls {
 		ok, err := areURLEqual(rawURL, u)
 		if err != nil {
@@ -95,7 +133,20 @@ func (v *AESValue) FindURL(raw string, urls []*url.URL) (*url.URL, error) {
 	return nil, nil
 }
 
-func (v *AESValue) fromValue(obfuscatedStr string) (string, error) {
+// openError is returned when the value can't be decrypted, e.g. because of the binding.
+type openError struct {
+	err error
+}
+
+func (e *openError) Error() string {
+	return e.err.Error()
+}
+
+func (e *openError) Unwrap() error {
+	return e.err
+}
+
+func (v *AESValue) fromValue(obfuscatedStr, binding string) (string, error) {
 	obfuscated, err := base64.RawURLEncoding.DecodeString(obfuscatedStr)
 	if err != nil {
 		return "", err
@@ -111,9 +162,9 @@ func (v *AESValue) fromValue(obfuscatedStr string) (string, error) {
 	nonce := obfuscated[n:]
 	obfuscated = obfuscated[:n]
 
-	raw, err := v.block.Open(nil, nonce, obfuscated, nil)
+	raw, err := v.block.Open(nil, nonce, obfuscated, []byte(binding))
 	if err != nil {
-		return "", err
+		return "", &openError{err: err}
 	}
 
 	if v.ttl > 0 {
@@ -0,0 +1,72 @@
+package stickycookie
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// Option configures a CookieValue.
+type Option func(*options) error
+
+type options struct {
+	binder func(*http.Request) string
+}
+
+// BindTo binds the cookies to the client attribute returned by binder, e.g. a hash of the client IP network
+// or a TLS session attribute: a cookie is only honored for the clients with the same attribute as the client it was set for.
+// The cookies presented by other clients are ignored, as if they were absent.
+// The binder is called on every request, it must be cheap and deterministic.
+func BindTo(binder func(*http.Request) string) Option {
+	return func(o *options) error {
+		if binder == nil {
+			return errors.New("binder can't be nil")
+		}
+		o.binder = binder
+		return nil
+	}
+}
+
+func newOptions(opts []Option) (*options, error) {
+	o := &options{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// binding returns the attribute of the client the cookie is bound to, empty when no binder is set.
+func (o *options) binding(req *http.Request) string {
+	if o == nil || o.binder == nil || req == nil {
+		return ""
+	}
+	return o.binder(req)
+}
+
+// BoundCookieValue is a CookieValue that can bind the cookies to the clients, see BindTo.
+type BoundCookieValue interface {
+	CookieValue
+
+	// GetFor converts raw value to an expected sticky format, bound to the client of req.
+	GetFor(req *http.Request, raw *url.URL) string
+
+	// FindURLFor gets url from array that match the value, if the value is bound to the client of req.
+	// It returns nil when the value is bound to another client.
+	FindURLFor(req *http.Request, raw string, urls []*url.URL) (*url.URL, error)
+}
+
+func getFor(v CookieValue, req *http.Request, raw *url.URL) string {
+	if bv, ok := v.(BoundCookieValue); ok {
+		return bv.GetFor(req, raw)
+	}
+	return v.Get(raw)
+}
+
+func findURLFor(v CookieValue, req *http.Request, raw string, urls []*url.URL) (*url.URL, error) {
+	if bv, ok := v.(BoundCookieValue); ok {
+		return bv.FindURLFor(req, raw, urls)
+	}
+	return v.FindURL(raw, urls)
+}
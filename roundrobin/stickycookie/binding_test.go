@@ -0,0 +1,62 @@
+package stickycookie
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindTo(t *testing.T) {
+	binder := BindTo(func(req *http.Request) string { return req.Header.Get("X-Client") })
+
+	aesValue, err := NewAESValue([]byte("95Bx9JkKX3xbd7z3"), 0, binder)
+	require.NoError(t, err)
+
+	hashValue, err := NewHashValue("foo", binder)
+	require.NoError(t, err)
+
+	servers := []*url.URL{
+		{Scheme: "http", Host: "10.10.10.10", Path: "/"},
+		{Scheme: "http", Host: "10.10.10.11", Path: "/"},
+	}
+
+	clientA := httptest.NewRequest(http.MethodGet, "/", nil)
+	clientA.Header.Set("X-Client", "a")
+	clientB := httptest.NewRequest(http.MethodGet, "/", nil)
+	clientB.Header.Set("X-Client", "b")
+
+	for name, value := range map[string]BoundCookieValue{"aes": aesValue, "hash": hashValue} {
+		t.Run(name, func(t *testing.T) {
+			bound := value.GetFor(clientA, servers[1])
+
+			u, err := value.FindURLFor(clientA, bound, servers)
+			require.NoError(t, err)
+			assert.Equal(t, servers[1], u)
+
+			// another client.
+			u, err = value.FindURLFor(clientB, bound, servers)
+			require.NoError(t, err)
+			assert.Nil(t, u)
+
+			// the values set without binding are rejected.
+			u, err = value.FindURLFor(clientA, value.Get(servers[1]), servers)
+			require.NoError(t, err)
+			assert.Nil(t, u)
+		})
+	}
+}
+
+func TestBindTo_invalid(t *testing.T) {
+	_, err := NewHashValue("foo", BindTo(nil))
+	require.Error(t, err)
+
+	_, err = NewRawValue(BindTo(func(*http.Request) string { return "" }))
+	require.Error(t, err)
+
+	_, err = NewRawValue()
+	require.NoError(t, err)
+}
@@ -1,6 +1,10 @@
 package stickycookie
 
-import "net/url"
+import (
+	"net/url"
+
+	"github.com/vulcand/oxy/v2/internal/serverurl"
+)
 
 // CookieValue interface to manage the sticky cookie value format.
 // It will be used by the load balancer to generate the sticky cookie value and to retrieve the matching url.
@@ -13,11 +17,19 @@ type CookieValue interface {
 }
 
 // areURLEqual compare a string to a url and check if the string is the same as the url value.
+// The scheme, host and path are compared as in roundrobin.NormalizeURL,
+// so that a cookie keeps matching a server registered with another form of its URL.
 func areURLEqual(normalized string, u *url.URL) (bool, error) {
 	u1, err := url.Parse(normalized)
 	if err != nil {
 		return false, err
 	}
 
-	return u1.Scheme == u.Scheme && u1.Host == u.Host && u1.Path == u.Path, nil
+	return canonical(u1) == canonical(u), nil
+}
+
+// canonical returns the scheme, the host and the path of u in the form of roundrobin.NormalizeURL.
+func canonical(u *url.URL) string {
+	n := serverurl.Normalize(u)
+	return n.Scheme + "://" + n.Host + n.Path
 }
@@ -2,6 +2,7 @@ package stickycookie
 
 import (
 	"errors"
+	"net/http"
 	"net/url"
 )
 
@@ -35,3 +36,18 @@ func (v *FallbackValue) FindURL(raw string, urls []*url.URL) (*url.URL, error) {
 
 	return v.to.FindURL(raw, urls)
 }
+
+// GetFor hashes the sticky value, bound to the client of req when the target value supports it.
+func (v *FallbackValue) GetFor(req *http.Request, raw *url.URL) string {
+	return getFor(v.to, req, raw)
+}
+
+// FindURLFor gets url from array that match the value, bound to the client of req when the values support it.
+func (v *FallbackValue) FindURLFor(req *http.Request, raw string, urls []*url.URL) (*url.URL, error) {
+	findURL, err := findURLFor(v.from, req, raw, urls)
+	if findURL != nil {
+		return findURL, err
+	}
+
+	return findURLFor(v.to, req, raw, urls)
+}
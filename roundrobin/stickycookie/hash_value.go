@@ -1,6 +1,7 @@
 package stickycookie
 
 import (
+	"net/http"
 	"net/url"
 	"strconv"
 
@@ -11,17 +12,44 @@ import (
 type HashValue struct {
 	// Salt secret to anonymize the hashed cookie
 	Salt string
+
+	opts *options
+}
+
+// NewHashValue creates a new HashValue.
+// With BindTo, the binding is mixed into the hash: the cookies set without binding are ignored.
+func NewHashValue(salt string, opts ...Option) (*HashValue, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HashValue{Salt: salt, opts: o}, nil
 }
 
 // Get hashes the sticky value.
 func (v *HashValue) Get(raw *url.URL) string {
-	return v.hash(raw.String())
+	return v.hash(raw.String(), "")
+}
+
+// GetFor hashes the sticky value, bound to the client of req.
+func (v *HashValue) GetFor(req *http.Request, raw *url.URL) string {
+	return v.hash(raw.String(), v.opts.binding(req))
 }
 
 // FindURL gets url from array that match the value.
 func (v *HashValue) FindURL(raw string, urls []*url.URL) (*url.URL, error) {
+	return v.findURL(raw, urls, "")
+}
+
+// FindURLFor gets url from array that match the value, if the value is bound to the client of req.
+func (v *HashValue) FindURLFor(req *http.Request, raw string, urls []*url.URL) (*url.URL, error) {
+	return v.findURL(raw, urls, v.opts.binding(req))
+}
+
+func (v *HashValue) findURL(raw string, urls []*url.URL, binding string) (*url.URL, error) {
 	for _, u := range urls {
-		if raw == v.hash(normalized(u)) {
+		if raw == v.hash(normalized(u), binding) {
 			return u, nil
 		}
 	}
@@ -29,7 +57,11 @@ func (v *HashValue) FindURL(raw string, urls []*url.URL) (*url.URL, error) {
 	return nil, nil
 }
 
-func (v *HashValue) hash(input string) string {
+func (v *HashValue) hash(input, binding string) string {
+	if binding != "" {
+		// the binding is only mixed in when set, to keep the unbound values unchanged.
+		input += "\x00" + binding
+	}
 	return strconv.FormatUint(fnv1a.HashString64(v.Salt+input), 16)
 }
 
@@ -1,12 +1,28 @@
 package stickycookie
 
 import (
+	"errors"
 	"net/url"
 )
 
 // RawValue is a no-op that returns the raw strings as-is.
 type RawValue struct{}
 
+// NewRawValue creates a new RawValue.
+// The raw values can't be bound to the clients: BindTo is refused.
+func NewRawValue(opts ...Option) (*RawValue, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.binder != nil {
+		return nil, errors.New("raw value can't be bound to the clients")
+	}
+
+	return &RawValue{}, nil
+}
+
 // Get returns the raw value.
 func (v *RawValue) Get(raw *url.URL) string {
 	return raw.String()
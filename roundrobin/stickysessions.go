@@ -1,14 +1,21 @@
 package roundrobin
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/vulcand/oxy/v2/roundrobin/stickycookie"
+	"github.com/vulcand/oxy/v2/utils"
 )
 
+// defaultStickyStatusThreshold is the default status code from which the sticky cookie is not set.
+const defaultStickyStatusThreshold = http.StatusInternalServerError
+
 // CookieOptions has all the options one would like to set on the affinity cookie.
 type CookieOptions struct {
 	HTTPOnly bool
@@ -24,48 +31,139 @@ type CookieOptions struct {
 
 // StickySession is a mixin for load balancers that implements layer 7 (http cookie) session affinity.
 type StickySession struct {
-	cookieName  string
-	cookieValue stickycookie.CookieValue
-	options     CookieOptions
+	cookieName      string
+	cookieValue     stickycookie.CookieValue
+	options         CookieOptions
+	statusThreshold int
+	onTargetGone    func(req *http.Request, err *ErrStickyTargetGone)
 }
 
 // NewStickySession creates a new StickySession.
 func NewStickySession(cookieName string) *StickySession {
-	return &StickySession{cookieName: cookieName, cookieValue: &stickycookie.RawValue{}}
+	return &StickySession{cookieName: cookieName, cookieValue: &stickycookie.RawValue{}, statusThreshold: defaultStickyStatusThreshold}
 }
 
 // NewStickySessionWithOptions creates a new StickySession whilst allowing for options to
 // shape its affinity cookie such as "httpOnly" or "secure".
 func NewStickySessionWithOptions(cookieName string, options CookieOptions) *StickySession {
-	return &StickySession{cookieName: cookieName, options: options, cookieValue: &stickycookie.RawValue{}}
+	return &StickySession{cookieName: cookieName, options: options, cookieValue: &stickycookie.RawValue{}, statusThreshold: defaultStickyStatusThreshold}
 }
 
 // SetCookieValue set the CookieValue for the StickySession.
+// When the value implements stickycookie.BoundCookieValue (see stickycookie.BindTo),
+// the cookies are bound to the clients: a cookie presented by another client is ignored.
 func (s *StickySession) SetCookieValue(value stickycookie.CookieValue) *StickySession {
 	s.cookieValue = value
 	return s
 }
 
+// SetStatusThreshold sets the status code from which the load balancers do not set the cookie:
+// the client is only stuck to a backend that answered with a status code lower than code.
+// The default is 500, so that the network errors (502, 504) do not stick the client to a broken backend.
+func (s *StickySession) SetStatusThreshold(code int) *StickySession {
+	s.statusThreshold = code
+	return s
+}
+
+// OnTargetGone sets the function called by the load balancers when the sticky cookie of a request points to a server
+// which is not in the pool, before they select another server, e.g. to count the clients moved by the removal of a server.
+// The function is called synchronously and must not block.
+func (s *StickySession) OnTargetGone(fn func(req *http.Request, err *ErrStickyTargetGone)) *StickySession {
+	s.onTargetGone = fn
+	return s
+}
+
 // GetBackend returns the backend URL stored in the sticky cookie, iff the backend is still in the valid list of servers.
+// The error is an ErrCookieInvalid when the cookie can't be decoded.
 func (s *StickySession) GetBackend(req *http.Request, servers []*url.URL) (*url.URL, bool, error) {
+	server, present, err := s.getBackend(req, servers)
+
+	var errGone *ErrStickyTargetGone
+	if errors.As(err, &errGone) {
+		return nil, false, nil
+	}
+	return server, present, err
+}
+
+// getBackend is GetBackend, returning an ErrStickyTargetGone when the backend of the cookie is not in the list of servers.
+func (s *StickySession) getBackend(req *http.Request, servers []*url.URL) (*url.URL, bool, error) {
 	cookie, err := req.Cookie(s.cookieName)
 	if err != nil {
 		if errors.Is(err, http.ErrNoCookie) {
 			return nil, false, nil
 		}
 
-		return nil, false, err
+		return nil, false, &ErrCookieInvalid{Cause: err}
+	}
+
+	var server *url.URL
+	if bv, ok := s.cookieValue.(stickycookie.BoundCookieValue); ok {
+		server, err = bv.FindURLFor(req, cookie.Value, servers)
+	} else {
+		server, err = s.cookieValue.FindURL(cookie.Value, servers)
+	}
+
+	if err != nil {
+		return nil, false, &ErrCookieInvalid{Cause: err}
 	}
 
-	server, err := s.cookieValue.FindURL(cookie.Value, servers)
+	if server == nil {
+		return nil, false, &ErrStickyTargetGone{Target: s.target(cookie.Value)}
+	}
+
+	return server, true, nil
+}
+
+// target returns the backend of the cookie value, if the value reveals it.
+func (s *StickySession) target(value string) *url.URL {
+	if _, ok := s.cookieValue.(*stickycookie.RawValue); !ok {
+		return nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// handleError handles an error of GetBackend, and reports whether the request can be served by another backend.
+// The invalid cookies are passed to the error handler when fail is set, the missing servers to OnTargetGone.
+func (s *StickySession) handleError(w http.ResponseWriter, req *http.Request, err error, fail bool, errHandler utils.ErrorHandler, component string, log utils.Logger) bool {
+	var errGone *ErrStickyTargetGone
+	if errors.As(err, &errGone) && s.onTargetGone != nil {
+		s.onTargetGone(req, errGone)
+	}
+
+	var errCookie *ErrCookieInvalid
+	if !errors.As(err, &errCookie) {
+		log.Debug("vulcand/oxy/roundrobin: not using server from cookie: %v", err)
+		return true
+	}
+
+	if fail {
+		utils.ServeError(errHandler, w, req, component, err)
+		return false
+	}
 
-	return server, server != nil, err
+	log.Warn("vulcand/oxy/roundrobin: error using server from cookie: %v", err)
+	return true
 }
 
 // StickBackend creates and sets the cookie.
+// The cookie is not bound to a client, the load balancers bind it to the client of the request, see stickycookie.BindTo.
 func (s *StickySession) StickBackend(backend *url.URL, w http.ResponseWriter) {
+	s.stickBackend(backend, w, nil)
+}
+
+func (s *StickySession) stickBackend(backend *url.URL, w http.ResponseWriter, req *http.Request) {
 	opt := s.options
 
+	value := s.cookieValue.Get(backend)
+	if bv, ok := s.cookieValue.(stickycookie.BoundCookieValue); ok && req != nil {
+		value = bv.GetFor(req, backend)
+	}
+
 	cp := "/"
 	if opt.Path != "" {
 		cp = opt.Path
@@ -73,7 +171,7 @@ func (s *StickySession) StickBackend(backend *url.URL, w http.ResponseWriter) {
 
 	cookie := &http.Cookie{
 		Name:     s.cookieName,
-		Value:    s.cookieValue.Get(backend),
+		Value:    value,
 		Path:     cp,
 		Domain:   opt.Domain,
 		Expires:  opt.Expires,
@@ -84,3 +182,78 @@ func (s *StickySession) StickBackend(backend *url.URL, w http.ResponseWriter) {
 	}
 	http.SetCookie(w, cookie)
 }
+
+// stickyWriter returns a writer that sets the cookie sticking the client to backend
+// when the status code of the response is known, if it is lower than the status threshold.
+// The cookie is bound to the client of req.
+func (s *StickySession) stickyWriter(backend *url.URL, w http.ResponseWriter, req *http.Request) *stickyWriter {
+	return &stickyWriter{ResponseWriter: w, session: s, backend: backend, req: req}
+}
+
+type stickyWriter struct {
+	http.ResponseWriter
+
+	session *StickySession
+	backend *url.URL
+	req     *http.Request
+	decided bool
+}
+
+func (w *stickyWriter) stick(code int) {
+	if w.decided {
+		return
+	}
+	// informational responses are followed by the final one.
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		return
+	}
+	w.decided = true
+
+	if code < w.session.statusThreshold {
+		w.session.stickBackend(w.backend, w.ResponseWriter, w.req)
+	}
+}
+
+// finish takes the decision for the handlers that have not written anything,
+// in which case the server answers 200.
+func (w *stickyWriter) finish() {
+	w.stick(http.StatusOK)
+}
+
+func (w *stickyWriter) WriteHeader(code int) {
+	w.stick(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *stickyWriter) Write(buf []byte) (int, error) {
+	w.stick(http.StatusOK)
+	return w.ResponseWriter.Write(buf)
+}
+
+// Flush sends any buffered data to the client.
+func (w *stickyWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.stick(http.StatusOK)
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that receives at most a single value (true)
+// when the client connection has gone away.
+func (w *stickyWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack hijacks the connection, e.g. for websockets: the response headers, including the cookie,
+// are written by the caller after the hijack.
+func (w *stickyWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer wrapped in this proxy does not implement http.Hijacker. Its type is: %T", w.ResponseWriter)
+	}
+	w.stick(http.StatusSwitchingProtocols)
+	return hj.Hijack()
+}
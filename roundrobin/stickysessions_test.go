@@ -3,9 +3,11 @@ package roundrobin
 import (
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -399,6 +401,85 @@ func TestStickySession_removeRespondingServer(t *testing.T) {
 	}
 }
 
+func TestStickySession_noCookieOnError(t *testing.T) {
+	dead := testutils.NewResponder(t, "dead")
+	dead.Close()
+	b := testutils.NewResponder(t, "b")
+
+	fwd := forward.New(false)
+
+	sticky := NewStickySession("test")
+
+	lb, err := New(fwd, EnableStickySession(sticky))
+	require.NoError(t, err)
+
+	err = lb.UpsertServer(testutils.MustParseRequestURI(dead.URL))
+	require.NoError(t, err)
+	err = lb.UpsertServer(testutils.MustParseRequestURI(b.URL))
+	require.NoError(t, err)
+
+	testStickyOnSuccess(t, lb, b.URL)
+}
+
+func TestStickySession_statusThreshold(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	sticky := NewStickySession("test").SetStatusThreshold(http.StatusBadRequest)
+
+	lb, err := New(handler, EnableStickySession(sticky))
+	require.NoError(t, err)
+
+	err = lb.UpsertServer(testutils.MustParseRequestURI("http://localhost:8080"))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	lb.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	assert.Empty(t, rw.Header().Values("Set-Cookie"))
+}
+
+// testStickyOnSuccess checks that the client is only stuck to the healthy backend,
+// the first request being sent to a dead one.
+func testStickyOnSuccess(t *testing.T, lb http.Handler, healthyURL string) {
+	t.Helper()
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Empty(t, resp.Cookies())
+
+	resp, err = http.Get(proxy.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, resp.Cookies(), 1)
+	assert.Equal(t, healthyURL, resp.Cookies()[0].Value)
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+		require.NoError(t, err)
+		req.AddCookie(resp.Cookies()[0])
+
+		re, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(re.Body)
+		_ = re.Body.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "b", string(body))
+	}
+}
+
 func TestStickySession_removeAllServers(t *testing.T) {
 	a := testutils.NewResponder(t, "a")
 	b := testutils.NewResponder(t, "b")
@@ -653,3 +734,120 @@ func mustParse(t *testing.T, raw string) *url.URL {
 
 	return u
 }
+
+func TestStickySession_bindTo(t *testing.T) {
+	// binds the cookies to the /24 network of the client.
+	binder := stickycookie.BindTo(func(req *http.Request) string {
+		ip := net.ParseIP(strings.TrimSpace(strings.Split(req.Header.Get(forward.XForwardedFor), ",")[0]))
+		if ip == nil {
+			return ""
+		}
+		return ip.Mask(net.CIDRMask(24, 32)).String()
+	})
+
+	hashValue, err := stickycookie.NewHashValue("foo", binder)
+	require.NoError(t, err)
+
+	aesValue, err := stickycookie.NewAESValue([]byte("95Bx9JkKX3xbd7z3"), 0, binder)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc        string
+		cookieValue stickycookie.CookieValue
+	}{
+		{desc: "hash value", cookieValue: hashValue},
+		{desc: "aes value", cookieValue: aesValue},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			a := testutils.NewResponder(t, "a")
+			b := testutils.NewResponder(t, "b")
+
+			sticky := NewStickySession("test").SetCookieValue(test.cookieValue)
+
+			lb, err := New(forward.New(false), EnableStickySession(sticky))
+			require.NoError(t, err)
+
+			require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+			require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+
+			proxy := httptest.NewServer(lb)
+			t.Cleanup(proxy.Close)
+
+			get := func(clientIP string, cookie *http.Cookie) (string, *http.Cookie) {
+				t.Helper()
+
+				req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+				require.NoError(t, err)
+				req.Header.Set(forward.XForwardedFor, clientIP)
+				if cookie != nil {
+					req.AddCookie(cookie)
+				}
+
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				for _, c := range resp.Cookies() {
+					if c.Name == "test" {
+						return string(body), c
+					}
+				}
+				return string(body), nil
+			}
+
+			backendA, cookieA := get("10.0.0.1", nil)
+			require.NotNil(t, cookieA)
+
+			// the same client keeps its backend, also from another address of its network.
+			for _, ip := range []string{"10.0.0.1", "10.0.0.42", "10.0.0.1"} {
+				backend, cookie := get(ip, cookieA)
+				assert.Equal(t, backendA, backend)
+				assert.Nil(t, cookie)
+			}
+
+			// another client presenting the cookie is re-balanced, as if it had no cookie.
+			var backendsB []string
+			for i := 0; i < 2; i++ {
+				backend, cookie := get("10.9.9.9", cookieA)
+				require.NotNil(t, cookie)
+				assert.NotEqual(t, cookieA.Value, cookie.Value)
+				backendsB = append(backendsB, backend)
+			}
+			assert.ElementsMatch(t, []string{"a", "b"}, backendsB)
+		})
+	}
+}
+
+func TestStickySession_normalizedCookie(t *testing.T) {
+	aesValue, err := stickycookie.NewAESValue([]byte("95Bx9JkKX3xbd7z3"), 5*clock.Second)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc  string
+		value stickycookie.CookieValue
+	}{
+		{desc: "raw", value: &stickycookie.RawValue{}},
+		{desc: "aes", value: aesValue},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			lb, err := New(hostHandler, EnableStickySession(NewStickySession("test").SetCookieValue(test.value)))
+			require.NoError(t, err)
+			require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a")))
+			require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI("http://b")))
+
+			// The cookie stores another form of the URL of the server.
+			cookie := &http.Cookie{Name: "test", Value: test.value.Get(testutils.MustParseRequestURI("HTTP://B:80/"))}
+			for i := 0; i < 3; i++ {
+				rw := serveWithCookie(lb, cookie)
+				assert.Equal(t, "b", rw.Body.String())
+			}
+		})
+	}
+}
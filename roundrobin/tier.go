@@ -0,0 +1,162 @@
+package roundrobin
+
+import (
+	"net/url"
+	"sort"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// tieredBalancer is implemented by the balancers grouping their servers into priority tiers, e.g. RoundRobin.
+type tieredBalancer interface {
+	ActiveTier() int
+	ServerTier(u *url.URL) (int, bool)
+}
+
+// ActiveTier returns the tier the servers are selected from, see Tier.
+func (r *RoundRobin) ActiveTier() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.updateTier(clock.Now())
+	return r.activeTier
+}
+
+// ServerTier gets the tier of the server, see Tier.
+func (r *RoundRobin) ServerTier(u *url.URL) (int, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if s, _ := r.findServerByURL(u); s != nil {
+		return s.tier, true
+	}
+	return -1, false
+}
+
+// updateTier sets the active tier to the lowest tier having a server with a non-zero weight at now.
+// The failover to a higher tier is immediate, the failback to a lower one waits for it to keep its servers for the failback delay.
+// The active tier is kept while no tier has such a server.
+func (r *RoundRobin) updateTier(now clock.Time) {
+	if !r.tiered {
+		return
+	}
+
+	lowest, ok := r.lowestTier()
+	switch {
+	case !ok:
+	case lowest >= r.activeTier:
+		r.activeTier = lowest
+		r.failbackStart = clock.Time{}
+	case r.failbackDelay == 0:
+		r.activeTier = lowest
+	case r.failbackStart.IsZero() || lowest != r.failbackTier:
+		r.failbackTier = lowest
+		r.failbackStart = now
+	case now.Sub(r.failbackStart) >= r.failbackDelay:
+		r.activeTier = lowest
+		r.failbackStart = clock.Time{}
+	}
+}
+
+// lowestTier returns the lowest tier having a server with a non-zero weight, if any.
+func (r *RoundRobin) lowestTier() (int, bool) {
+	lowest, ok := 0, false
+	for _, srv := range r.servers {
+		if srv.weight != 0 && (!ok || srv.tier < lowest) {
+			lowest, ok = srv.tier, true
+		}
+	}
+	return lowest, ok
+}
+
+// tierOrder returns the tiers of the servers in the order the selection tries them:
+// the active tier, the higher tiers, then the lower ones still waiting for the failback delay.
+func (r *RoundRobin) tierOrder() []int {
+	if !r.tiered {
+		return []int{0}
+	}
+
+	var tiers []int
+	seen := make(map[int]bool)
+	for _, srv := range r.servers {
+		if !seen[srv.tier] {
+			seen[srv.tier] = true
+			tiers = append(tiers, srv.tier)
+		}
+	}
+
+	sort.Slice(tiers, func(i, j int) bool {
+		a, b := tiers[i], tiers[j]
+		if (a >= r.activeTier) != (b >= r.activeTier) {
+			return a >= r.activeTier
+		}
+		if a >= r.activeTier {
+			return a < b
+		}
+		return a > b
+	})
+	return tiers
+}
+
+// stickyServers returns the servers a sticky cookie can select:
+// all the servers, or the ones of the active tier when StickyAcrossTiers is disabled.
+func (r *RoundRobin) stickyServers() []*url.URL {
+	if !r.stickyInActiveTier {
+		return r.Servers()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.updateTier(clock.Now())
+
+	var out []*url.URL
+	for _, srv := range r.servers {
+		if srv.tier == r.activeTier {
+			out = append(out, srv.url)
+		}
+	}
+	return out
+}
+
+// activeServers returns the servers of the active tier of the wrapped balancer, all the servers if it has no tiers:
+// only the servers of the active tier get traffic, and have their weights adjusted.
+func (rb *Rebalancer) activeServers() []*rbServer {
+	if _, ok := rb.next.(tieredBalancer); !ok {
+		return rb.servers
+	}
+
+	var out []*rbServer
+	for _, srv := range rb.servers {
+		if srv.tier == rb.tier {
+			out = append(out, srv)
+		}
+	}
+	return out
+}
+
+// syncTier follows the active tier of the wrapped balancer, and reports whether it changed:
+// the weights of the servers are then reset to their original values.
+func (rb *Rebalancer) syncTier() bool {
+	tb, ok := rb.next.(tieredBalancer)
+	if !ok {
+		return false
+	}
+
+	tier := tb.ActiveTier()
+	if tier == rb.tier {
+		return false
+	}
+	rb.tier = tier
+	rb.reset()
+	return true
+}
+
+// serverTier returns the tier of the server, 0 if the wrapped balancer has no tiers.
+func (rb *Rebalancer) serverTier(u *url.URL) int {
+	if tb, ok := rb.next.(tieredBalancer); ok {
+		tier, _ := tb.ServerTier(u)
+		return tier
+	}
+	return 0
+}
@@ -0,0 +1,228 @@
+package roundrobin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+// selections returns the number of selections of each server among the n next ones of lb.
+func selections(t *testing.T, lb *RoundRobin, n int) map[string]int {
+	t.Helper()
+
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		u, err := lb.NextServer()
+		require.NoError(t, err)
+		counts[u.String()]++
+	}
+	return counts
+}
+
+func TestRoundRobin_tierFailover(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, err := New(nil, TierFailbackDelay(5*time.Second))
+	require.NoError(t, err)
+
+	a := testutils.MustParseRequestURI("http://a")
+	b := testutils.MustParseRequestURI("http://b")
+	c := testutils.MustParseRequestURI("http://c")
+	require.NoError(t, lb.UpsertServer(a))
+	require.NoError(t, lb.UpsertServer(b))
+	require.NoError(t, lb.UpsertServer(c, Tier(1)))
+
+	assert.Equal(t, map[string]int{"http://a": 50, "http://b": 50}, selections(t, lb, 100))
+	assert.Equal(t, 0, lb.ActiveTier())
+
+	require.NoError(t, lb.RemoveServer(a))
+	assert.Equal(t, map[string]int{"http://b": 100}, selections(t, lb, 100))
+
+	// The failover is immediate.
+	require.NoError(t, lb.RemoveServer(b))
+	assert.Equal(t, map[string]int{"http://c": 100}, selections(t, lb, 100))
+	assert.Equal(t, 1, lb.ActiveTier())
+
+	require.NoError(t, lb.UpsertServer(a))
+	assert.Equal(t, map[string]int{"http://c": 100}, selections(t, lb, 100))
+
+	clock.Advance(4 * time.Second)
+	assert.Equal(t, map[string]int{"http://c": 100}, selections(t, lb, 100))
+	assert.Equal(t, 1, lb.ActiveTier())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, map[string]int{"http://a": 100}, selections(t, lb, 100))
+	assert.Equal(t, 0, lb.ActiveTier())
+
+	tier, ok := lb.ServerTier(c)
+	assert.True(t, ok)
+	assert.Equal(t, 1, tier)
+
+	_, ok = lb.ServerTier(b)
+	assert.False(t, ok)
+}
+
+func TestRoundRobin_tierFlapping(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	lb, err := New(nil, TierFailbackDelay(5*time.Second))
+	require.NoError(t, err)
+
+	a := testutils.MustParseRequestURI("http://a")
+	c := testutils.MustParseRequestURI("http://c")
+	require.NoError(t, lb.UpsertServer(a))
+	require.NoError(t, lb.UpsertServer(c, Tier(1)))
+
+	require.NoError(t, lb.UpsertServer(a, Weight(0)))
+	assert.Equal(t, map[string]int{"http://c": 10}, selections(t, lb, 10))
+
+	// a recovers for 3s, the failback delay starts over on its next recovery.
+	require.NoError(t, lb.UpsertServer(a, Weight(1)))
+	assert.Equal(t, map[string]int{"http://c": 10}, selections(t, lb, 10))
+	clock.Advance(3 * time.Second)
+	require.NoError(t, lb.UpsertServer(a, Weight(0)))
+	assert.Equal(t, map[string]int{"http://c": 10}, selections(t, lb, 10))
+
+	require.NoError(t, lb.UpsertServer(a, Weight(1)))
+	assert.Equal(t, map[string]int{"http://c": 10}, selections(t, lb, 10))
+	clock.Advance(3 * time.Second)
+	assert.Equal(t, map[string]int{"http://c": 10}, selections(t, lb, 10))
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, map[string]int{"http://a": 10}, selections(t, lb, 10))
+}
+
+func TestRoundRobin_tierNoFailbackDelay(t *testing.T) {
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	a := testutils.MustParseRequestURI("http://a")
+	c := testutils.MustParseRequestURI("http://c")
+	require.NoError(t, lb.UpsertServer(c, Tier(2)))
+	assert.Equal(t, map[string]int{"http://c": 10}, selections(t, lb, 10))
+
+	require.NoError(t, lb.UpsertServer(a, Tier(1)))
+	assert.Equal(t, map[string]int{"http://a": 10}, selections(t, lb, 10))
+
+	// A request excluding the servers of the active tier is sent to the next tier.
+	u, err := lb.NextServerWith(context.Background(), Exclude(a))
+	require.NoError(t, err)
+	assert.Equal(t, "http://c", u.String())
+
+	// Without tiers, the active tier is 0.
+	require.NoError(t, lb.UpsertServer(a, Tier(0)))
+	require.NoError(t, lb.UpsertServer(c, Tier(0)))
+	assert.Equal(t, map[string]int{"http://a": 5, "http://c": 5}, selections(t, lb, 10))
+	assert.Equal(t, 0, lb.ActiveTier())
+}
+
+func TestRoundRobin_tierStickySession(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		keep     bool
+		expected string
+	}{
+		{desc: "sticky across tiers", keep: true, expected: "c"},
+		{desc: "sticky in active tier", keep: false, expected: "a"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			a := testutils.NewResponder(t, "a")
+			c := testutils.NewResponder(t, "c")
+
+			lb, err := New(forward.New(false), EnableStickySession(NewStickySession("test")), StickyAcrossTiers(test.keep))
+			require.NoError(t, err)
+
+			require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+			require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(c.URL), Tier(1)))
+
+			proxy := httptest.NewServer(lb)
+			t.Cleanup(proxy.Close)
+
+			// The client was pinned to c during a failover.
+			req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+			require.NoError(t, err)
+			req.AddCookie(&http.Cookie{Name: "test", Value: c.URL})
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = resp.Body.Close() })
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(body))
+		})
+	}
+}
+
+func TestRebalancer_tiers(t *testing.T) {
+	backends := make(map[string]string)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		backends[name] = testutils.NewResponder(t, name).URL
+	}
+
+	lb, err := New(forward.New(false))
+	require.NoError(t, err)
+
+	testutils.FreezeTime(t)
+
+	rb, err := NewRebalancer(lb, RebalancerMeter(func() (Meter, error) {
+		return &testMeter{}, nil
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(backends["a"])))
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(backends["b"])))
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(backends["c"]), Tier(1)))
+	require.NoError(t, rb.UpsertServer(testutils.MustParseRequestURI(backends["d"]), Tier(1)))
+
+	// c performs worse than the others, its tier being inactive.
+	rb.servers[2].meter.(*testMeter).rating = 0.3
+
+	proxy := httptest.NewServer(rb)
+	t.Cleanup(proxy.Close)
+
+	serve := func() {
+		for i := 0; i < 6; i++ {
+			_, _, err = testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			_, _, err = testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			clock.Advance(rb.backoffDuration + clock.Second)
+		}
+	}
+
+	serve()
+	for _, info := range rb.ServerInfos() {
+		assert.Equal(t, weightScale, info.WeightPermille, info.URL)
+	}
+
+	require.NoError(t, rb.RemoveServer(testutils.MustParseRequestURI(backends["a"])))
+	require.NoError(t, rb.RemoveServer(testutils.MustParseRequestURI(backends["b"])))
+
+	serve()
+	infos := rb.ServerInfos()
+	require.Len(t, infos, 2)
+	assert.Equal(t, 1, infos[0].Tier)
+	assert.Equal(t, weightScale, infos[0].WeightPermille)
+	assert.Equal(t, 1, infos[1].Tier)
+	assert.Equal(t, FSMMaxWeight*weightScale, infos[1].WeightPermille)
+}
+
+func TestRoundRobin_tierInvalidOptions(t *testing.T) {
+	_, err := New(nil, TierFailbackDelay(-time.Second))
+	require.Error(t, err)
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+	require.Error(t, lb.UpsertServer(testutils.MustParseRequestURI("http://a"), Tier(-1)))
+}
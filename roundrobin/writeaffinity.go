@@ -0,0 +1,131 @@
+package roundrobin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/roundrobin/stickycookie"
+)
+
+// defaultWriteMethods are the methods of the write requests, when WriteAffinityConfig.Methods is empty.
+var defaultWriteMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// WriteAffinityConfig configures the read-your-writes affinity, see WriteAffinity.
+type WriteAffinityConfig struct {
+	// Methods are the methods of the write requests, POST, PUT, PATCH and DELETE by default.
+	Methods []string
+	// Window is how long a client is pinned to the backend of its last write.
+	Window time.Duration
+	// CookieName is the name of the affinity cookie, it must differ from the name of the sticky session cookie.
+	CookieName string
+	// CookieValue encodes the backend in the cookie, stickycookie.RawValue by default.
+	CookieValue stickycookie.CookieValue
+}
+
+// writeAffinity pins the clients to the backend of their last write, with a cookie valid for the window.
+type writeAffinity struct {
+	methods map[string]struct{}
+	session *StickySession
+}
+
+func newWriteAffinity(cfg WriteAffinityConfig) (*writeAffinity, error) {
+	if cfg.Window <= 0 {
+		return nil, fmt.Errorf("invalid write affinity window: %v", cfg.Window)
+	}
+	if cfg.CookieName == "" {
+		return nil, errors.New("write affinity cookie name can't be empty")
+	}
+
+	methods := cfg.Methods
+	if len(methods) == 0 {
+		methods = defaultWriteMethods
+	}
+
+	value := cfg.CookieValue
+	if value == nil {
+		value = &stickycookie.RawValue{}
+	}
+
+	wa := &writeAffinity{methods: make(map[string]struct{}, len(methods))}
+	for _, m := range methods {
+		wa.methods[strings.ToUpper(m)] = struct{}{}
+	}
+
+	wa.session = NewStickySessionWithOptions(cfg.CookieName, CookieOptions{
+		Path:   "/",
+		MaxAge: int(math.Ceil(cfg.Window.Seconds())),
+	}).SetCookieValue(&windowValue{value: value, window: cfg.Window}).SetStatusThreshold(http.StatusBadRequest)
+
+	return wa, nil
+}
+
+// isWrite reports whether req is a write request, that pins its client once answered successfully.
+func (wa *writeAffinity) isWrite(req *http.Request) bool {
+	_, ok := wa.methods[req.Method]
+	return ok
+}
+
+// windowValue prefixes the cookie value of the write affinity with the end of the window, in milliseconds:
+// the cookie is ignored once the window is over, even if the client still sends it.
+type windowValue struct {
+	value  stickycookie.CookieValue
+	window time.Duration
+}
+
+func (v *windowValue) Get(raw *url.URL) string {
+	return v.wrap(v.value.Get(raw))
+}
+
+func (v *windowValue) GetFor(req *http.Request, raw *url.URL) string {
+	if bv, ok := v.value.(stickycookie.BoundCookieValue); ok {
+		return v.wrap(bv.GetFor(req, raw))
+	}
+	return v.Get(raw)
+}
+
+func (v *windowValue) FindURL(raw string, urls []*url.URL) (*url.URL, error) {
+	value, valid, err := v.unwrap(raw)
+	if err != nil || !valid {
+		return nil, err
+	}
+	return v.value.FindURL(value, urls)
+}
+
+func (v *windowValue) FindURLFor(req *http.Request, raw string, urls []*url.URL) (*url.URL, error) {
+	bv, ok := v.value.(stickycookie.BoundCookieValue)
+	if !ok {
+		return v.FindURL(raw, urls)
+	}
+
+	value, valid, err := v.unwrap(raw)
+	if err != nil || !valid {
+		return nil, err
+	}
+	return bv.FindURLFor(req, value, urls)
+}
+
+func (v *windowValue) wrap(value string) string {
+	return strconv.FormatInt(clock.Now().Add(v.window).UnixMilli(), 10) + "|" + value
+}
+
+// unwrap returns the value of the cookie, and whether its window is still open.
+func (v *windowValue) unwrap(raw string) (string, bool, error) {
+	end, value, found := strings.Cut(raw, "|")
+	if !found {
+		return "", false, errors.New("no write affinity window")
+	}
+
+	ms, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid write affinity window: %w", err)
+	}
+
+	return value, clock.Now().UnixMilli() < ms, nil
+}
@@ -0,0 +1,174 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/forward"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/roundrobin/stickycookie"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+func newWriteAffinityProxy(t *testing.T, opts []LBOption, backends ...string) string {
+	t.Helper()
+
+	lb, err := New(forward.New(false), opts...)
+	require.NoError(t, err)
+
+	for _, backend := range backends {
+		require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(backend)))
+	}
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	return proxy.URL
+}
+
+// affinityRequest sends a request with the cookies, and returns the body and the write affinity cookie of the response.
+func affinityRequest(t *testing.T, method, proxyURL string, cookies ...*http.Cookie) (string, *http.Cookie) {
+	t.Helper()
+
+	opts := []testutils.ReqOption{testutils.Method(method)}
+	for _, c := range cookies {
+		opts = append(opts, testutils.Header("Cookie", c.Name+"="+c.Value))
+	}
+
+	re, body, err := testutils.MakeRequest(proxyURL, opts...)
+	require.NoError(t, err)
+
+	for _, c := range re.Cookies() {
+		if c.Name == "oxy_wa" {
+			return string(body), c
+		}
+	}
+	return string(body), nil
+}
+
+func TestWriteAffinity(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+
+	proxyURL := newWriteAffinityProxy(t, []LBOption{WriteAffinity(WriteAffinityConfig{
+		Methods:    []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+		Window:     3 * time.Second,
+		CookieName: "oxy_wa",
+	})}, a.URL, b.URL)
+
+	body, cookie := affinityRequest(t, http.MethodPost, proxyURL)
+	assert.Equal(t, "a", body)
+	require.NotNil(t, cookie)
+	assert.Equal(t, 3, cookie.MaxAge)
+
+	// The reads are pinned within the window, without refreshing the cookie.
+	clock.Advance(clock.Second)
+	for i := 0; i < 3; i++ {
+		body, refreshed := affinityRequest(t, http.MethodGet, proxyURL, cookie)
+		assert.Equal(t, "a", body)
+		assert.Nil(t, refreshed)
+	}
+
+	// The pin is over with the window, even if the client still sends the cookie.
+	clock.Advance(2 * clock.Second)
+	var bodies []string
+	for i := 0; i < 3; i++ {
+		body, refreshed := affinityRequest(t, http.MethodGet, proxyURL, cookie)
+		bodies = append(bodies, body)
+		assert.Nil(t, refreshed)
+	}
+	assert.Equal(t, []string{"b", "a", "b"}, bodies)
+}
+
+func TestWriteAffinity_failedWrite(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	dead := testutils.NewResponder(t, "dead")
+	dead.Close()
+	b := testutils.NewResponder(t, "b")
+
+	proxyURL := newWriteAffinityProxy(t, []LBOption{WriteAffinity(WriteAffinityConfig{
+		Window:     3 * time.Second,
+		CookieName: "oxy_wa",
+	})}, dead.URL, b.URL)
+
+	re, _, err := testutils.Post(proxyURL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Empty(t, re.Cookies())
+
+	// The reads never set the cookie.
+	body, cookie := affinityRequest(t, http.MethodGet, proxyURL)
+	assert.Equal(t, "b", body)
+	assert.Nil(t, cookie)
+}
+
+func TestWriteAffinity_stickySession(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+
+	proxyURL := newWriteAffinityProxy(t, []LBOption{
+		EnableStickySession(NewStickySession("sticky")),
+		WriteAffinity(WriteAffinityConfig{Window: 3 * time.Second, CookieName: "oxy_wa"}),
+	}, a.URL, b.URL)
+
+	sticky := &http.Cookie{Name: "sticky", Value: b.URL}
+
+	// The write follows the sticky session, the affinity cookie pins the client to the same backend.
+	body, cookie := affinityRequest(t, http.MethodPut, proxyURL, sticky)
+	assert.Equal(t, "b", body)
+	require.NotNil(t, cookie)
+
+	// The affinity cookie takes precedence over the sticky session within the window.
+	pinA := &http.Cookie{
+		Name:  "oxy_wa",
+		Value: (&windowValue{value: &stickycookie.RawValue{}, window: 3 * time.Second}).Get(testutils.MustParseRequestURI(a.URL)),
+	}
+	body, _ = affinityRequest(t, http.MethodGet, proxyURL, sticky, pinA)
+	assert.Equal(t, "a", body)
+
+	clock.Advance(3 * clock.Second)
+	body, _ = affinityRequest(t, http.MethodGet, proxyURL, sticky, pinA)
+	assert.Equal(t, "b", body)
+}
+
+func TestWriteAffinity_removedServer(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	a := testutils.NewResponder(t, "a")
+	b := testutils.NewResponder(t, "b")
+
+	lb, err := New(forward.New(false), WriteAffinity(WriteAffinityConfig{Window: 3 * time.Second, CookieName: "oxy_wa"}))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.MustParseRequestURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	t.Cleanup(proxy.Close)
+
+	body, cookie := affinityRequest(t, http.MethodPost, proxy.URL)
+	assert.Equal(t, "a", body)
+	require.NotNil(t, cookie)
+
+	require.NoError(t, lb.RemoveServer(testutils.MustParseRequestURI(a.URL)))
+
+	body, refreshed := affinityRequest(t, http.MethodGet, proxy.URL, cookie)
+	assert.Equal(t, "b", body)
+	assert.Nil(t, refreshed)
+}
+
+func TestWriteAffinity_invalidConfig(t *testing.T) {
+	_, err := New(nil, WriteAffinity(WriteAffinityConfig{CookieName: "oxy_wa"}))
+	require.Error(t, err)
+
+	_, err = New(nil, WriteAffinity(WriteAffinityConfig{Window: time.Second}))
+	require.Error(t, err)
+}
@@ -27,11 +27,16 @@ Examples of a streaming middleware:
 	// Stream will literally pass through to the next handler without ANY buffering
 	// or validation of the data.
 	stream.New(handler)
+
+The requests are passed to the next handler with the original ResponseWriter, so that stream can be put
+in front of the websocket routes: the websocket upgrades are counted, see Stats.
 */
 package stream
 
 import (
 	"net/http"
+	"strings"
+	"sync/atomic"
 
 	"github.com/vulcand/oxy/v2/utils"
 )
@@ -50,9 +55,18 @@ type Stream struct {
 
 	verbose bool
 	log     utils.Logger
+
+	skipped atomic.Uint64
+}
+
+// Stats are the statistics of a stream.
+type Stats struct {
+	// SkippedRequests is the number of websocket upgrades passed as is to the next handler.
+	SkippedRequests uint64
 }
 
 // New returns a new streamer middleware. New() function supports optional functional arguments.
+// next can be nil, and set later with Wrap.
 func New(next http.Handler, setters ...Option) (*Stream, error) {
 	strm := &Stream{
 		next: next,
@@ -71,18 +85,52 @@ func New(next http.Handler, setters ...Option) (*Stream, error) {
 	return strm, nil
 }
 
-// Wrap sets the next handler to be called by stream handler.
+// Wrap sets the next handler to be called by stream handler, when it was created without.
 func (s *Stream) Wrap(next http.Handler) error {
+	if err := utils.CheckWrap(s.next, next); err != nil {
+		return err
+	}
 	s.next = next
 	return nil
 }
 
 func (s *Stream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if s.verbose {
+	if s.verbose && utils.DebugEnabled(s.log) {
 		dump := utils.DumpHTTPRequest(req)
 		s.log.Debug("vulcand/oxy/stream: begin ServeHttp on request: %s", dump)
 		defer s.log.Debug("vulcand/oxy/stream: completed ServeHttp on request: %s", dump)
 	}
 
+	if s.next == nil {
+		utils.ServeError(nil, w, req, "stream", &utils.ErrNotWired{Middleware: "stream"})
+		return
+	}
+
+	if isWebsocketUpgrade(req) {
+		s.skipped.Add(1)
+	}
+
+	// The writer is passed unchanged, with the Flusher and Hijacker it implements.
 	s.next.ServeHTTP(w, req)
 }
+
+// Stats returns the statistics of the stream.
+func (s *Stream) Stats() Stats {
+	return Stats{SkippedRequests: s.skipped.Load()}
+}
+
+func isWebsocketUpgrade(req *http.Request) bool {
+	return hasToken(req.Header, "Connection", "upgrade") && hasToken(req.Header, "Upgrade", "websocket")
+}
+
+// hasToken reports whether the comma-separated values of the header contain the token, case-insensitively.
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -46,9 +47,14 @@ func TestStream_simple(t *testing.T) {
 }
 
 func TestStream_chunkedEncodingSuccess(t *testing.T) {
+	testutils.FreezeTime(t)
+
 	var reqBody string
 	var contentLength int64
+	var done int32
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		defer atomic.StoreInt32(&done, 1)
+
 		body, err := io.ReadAll(req.Body)
 		require.NoError(t, err)
 		reqBody = string(body)
@@ -105,6 +111,8 @@ func TestStream_chunkedEncodingSuccess(t *testing.T) {
 	assert.Equal(t, int64(-1), contentLength)
 	assert.Equal(t, "testtest1test2", reqBody)
 	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+
+	testutils.AdvanceUntil(t, func() bool { return atomic.LoadInt32(&done) == 1 }, 500*clock.Millisecond, 5*clock.Second)
 }
 
 func TestStream_requestLimitReached(t *testing.T) {
@@ -302,3 +310,80 @@ func TestStream_preservesTLS(t *testing.T) {
 
 	assert.NotNil(t, cs)
 }
+
+func TestStream_websocket(t *testing.T) {
+	srv := testutils.NewWSEchoServer(t, testutils.WSAnyOrigin())
+
+	fwd := forward.New(false)
+
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.MustParseRequestURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := New(rdr)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	conn, err := testutils.WSRequest(
+		testutils.WSServer(proxy.Listener.Addr().String()),
+		testutils.WSPath("/ws"),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	require.NoError(t, conn.SendText("hello"))
+	require.NoError(t, conn.Expect("hello"))
+
+	assert.Equal(t, Stats{SkippedRequests: 1}, st.Stats())
+
+	// The other requests are not skipped.
+	re, _, err := testutils.Get(proxy.URL, testutils.Header("Connection", "Upgrade"), testutils.Header("Upgrade", "h2c"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, re.StatusCode)
+	assert.Equal(t, Stats{SkippedRequests: 1}, st.Stats())
+}
+
+func TestStream_originalWriter(t *testing.T) {
+	rw := httptest.NewRecorder()
+
+	var received http.ResponseWriter
+	st, err := New(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		received = w
+	}))
+	require.NoError(t, err)
+
+	st.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Same(t, rw, received)
+}
+
+func TestStream_hijack(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, ok := w.(http.Flusher)
+		assert.True(t, ok)
+
+		hj, ok := w.(http.Hijacker)
+		require.True(t, ok)
+
+		conn, rw, err := hj.Hijack()
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		_, _ = rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		_ = rw.Flush()
+	})
+
+	st, err := New(handler)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	t.Cleanup(proxy.Close)
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hijacked", string(body))
+	assert.Equal(t, Stats{}, st.Stats())
+}
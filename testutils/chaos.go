@@ -0,0 +1,230 @@
+package testutils
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+)
+
+// ChaosStats are the counters of a ChaosBackend.
+type ChaosStats struct {
+	// Requests is the number of requests received.
+	Requests int64
+	// InFlight is the number of requests being served.
+	InFlight int64
+	// ConnectionsReset is the number of connections reset, see ChaosBackend.ResetConnections.
+	ConnectionsReset int64
+}
+
+// ChaosBackend is a backend answering a fixed response, whose failures are injected mid-test.
+// Its methods are safe to call concurrently with the traffic.
+type ChaosBackend struct {
+	// URL is the base URL of the backend, of the form http://ipaddr:port with no trailing slash.
+	URL string
+
+	response string
+	server   *http.Server
+
+	mu            sync.Mutex
+	hang          chan struct{}
+	slowFirstByte time.Duration
+	reset         bool
+	failNext      int
+	failStatus    int
+	onRequest     func(*http.Request)
+
+	requests atomic.Int64
+	inFlight atomic.Int64
+	resets   atomic.Int64
+}
+
+// NewChaosBackend creates a new backend answering response, closed at the end of the test.
+// Like httptest.Server, it exposes its URL, so it can replace NewResponder in the existing tests.
+func NewChaosBackend(t *testing.T, response string) *ChaosBackend {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	b := &ChaosBackend{
+		URL:      "http://" + l.Addr().String(),
+		response: response,
+	}
+	b.server = &http.Server{Handler: b, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() { _ = b.server.Serve(&chaosListener{Listener: l, backend: b}) }()
+
+	t.Cleanup(b.Close)
+	return b
+}
+
+// Hang makes the backend accept the connections and read the requests, but never respond until Resume.
+func (b *ChaosBackend) Hang() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.hang == nil {
+		b.hang = make(chan struct{})
+	}
+}
+
+// SlowFirstByte delays the responses by d, measured with the clock: it is advanced by clock.Advance when the time is frozen.
+// A zero duration removes the delay.
+func (b *ChaosBackend) SlowFirstByte(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.slowFirstByte = d
+}
+
+// ResetConnections makes the backend reset the connections (RST) until Resume:
+// the new connections as soon as they are accepted, the open ones on their next request.
+func (b *ChaosBackend) ResetConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.reset = true
+}
+
+// FailNext makes the backend answer the next n requests with status.
+func (b *ChaosBackend) FailNext(n, status int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failNext = n
+	b.failStatus = status
+}
+
+// OnRequest calls fn with every request received, before it is answered, e.g. to check the headers sent by a proxy.
+func (b *ChaosBackend) OnRequest(fn func(req *http.Request)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.onRequest = fn
+}
+
+// Resume ends Hang, the hanging requests being answered, and ResetConnections.
+func (b *ChaosBackend) Resume() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.hang != nil {
+		close(b.hang)
+		b.hang = nil
+	}
+	b.reset = false
+}
+
+// Kill closes the listener and the open connections of the backend: the new connections are refused.
+func (b *ChaosBackend) Kill() {
+	_ = b.server.Close()
+}
+
+// Close kills the backend, and releases its hanging requests.
+func (b *ChaosBackend) Close() {
+	b.Kill()
+	b.Resume()
+}
+
+// Stats returns the counters of the backend.
+func (b *ChaosBackend) Stats() ChaosStats {
+	return ChaosStats{
+		Requests:         b.requests.Load(),
+		InFlight:         b.inFlight.Load(),
+		ConnectionsReset: b.resets.Load(),
+	}
+}
+
+func (b *ChaosBackend) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b.requests.Add(1)
+	b.inFlight.Add(1)
+	defer b.inFlight.Add(-1)
+
+	b.mu.Lock()
+	reset, hang, delay, onRequest := b.reset, b.hang, b.slowFirstByte, b.onRequest
+	status := http.StatusOK
+	if b.failNext > 0 {
+		b.failNext--
+		status = b.failStatus
+	}
+	b.mu.Unlock()
+
+	if onRequest != nil {
+		onRequest(req)
+	}
+
+	if reset {
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				b.resetConn(conn)
+				return
+			}
+		}
+	}
+
+	if hang != nil {
+		select {
+		case <-hang:
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	if delay > 0 {
+		timer := clock.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C():
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(http.StatusText(status)))
+		return
+	}
+	_, _ = w.Write([]byte(b.response))
+}
+
+// resetConn closes the connection with a RST rather than a FIN.
+func (b *ChaosBackend) resetConn(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	_ = conn.Close()
+	b.resets.Add(1)
+}
+
+// chaosListener resets the connections as soon as they are accepted, see ChaosBackend.ResetConnections.
+type chaosListener struct {
+	net.Listener
+	backend *ChaosBackend
+}
+
+func (l *chaosListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		l.backend.mu.Lock()
+		reset := l.backend.reset
+		l.backend.mu.Unlock()
+
+		if !reset {
+			return conn, nil
+		}
+		l.backend.resetConn(conn)
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
 	"github.com/vulcand/oxy/v2/utils"
@@ -189,3 +191,45 @@ func FreezeTime(t *testing.T) {
 
 	t.Cleanup(clock.Unfreeze)
 }
+
+// WithFrozenTime runs f with the time frozen to the predetermined time, and unfreezes it when f returns.
+func WithFrozenTime(t *testing.T, f func()) {
+	t.Helper()
+
+	clock.Freeze(clock.Date(2012, 3, 4, 5, 6, 7, 0, clock.UTC))
+	defer clock.Unfreeze()
+
+	f()
+}
+
+// AdvanceUntil advances the frozen time by step until cond returns true,
+// giving the goroutines blocked on real I/O the opportunity to run between the steps.
+// The test fails if cond is still false once the time has been advanced by max.
+//
+// It allows to test the handlers relying on timers (e.g. backoffs, pacing, delayed writes)
+// against real servers without sleeping:
+//
+//	testutils.FreezeTime(t)
+//	// start a request served by a handler waiting for 1s...
+//	testutils.AdvanceUntil(t, done, 100*time.Millisecond, 5*time.Second)
+func AdvanceUntil(t *testing.T, cond func() bool, step, max time.Duration) {
+	t.Helper()
+
+	for advanced := time.Duration(0); !cond(); advanced += step {
+		if advanced >= max {
+			t.Fatalf("condition not met after advancing the time by %v", advanced)
+		}
+		clock.Advance(step)
+
+		// gives the goroutines woken up by the timers the opportunity to run.
+		runtime.Gosched()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Wait4Scheduled blocks until count timers are scheduled on the frozen clock, or the timeout expires.
+// It returns false if the timeout expired.
+// It allows to synchronize with the timers started by a handler before advancing the time.
+func Wait4Scheduled(count int, timeout time.Duration) bool {
+	return clock.Wait4Scheduled(count, timeout)
+}
@@ -0,0 +1,269 @@
+package testutils
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultWSTimeout is the default timeout of the websocket dial, handshake and reads, see WSDialTimeout.
+const DefaultWSTimeout = 5 * time.Second
+
+// WSOpts websocket request options.
+type WSOpts struct {
+	ServerAddr  string
+	Path        string
+	Origin      string
+	Headers     http.Header
+	TLS         bool
+	DialTimeout time.Duration
+}
+
+// WSOption websocket request option type.
+type WSOption func(o *WSOpts)
+
+// WSServer sets the address (host:port) of the server.
+func WSServer(addr string) WSOption {
+	return func(o *WSOpts) {
+		o.ServerAddr = addr
+	}
+}
+
+// WSPath sets the path of the request, it can contain a query.
+func WSPath(path string) WSOption {
+	return func(o *WSOpts) {
+		o.Path = path
+	}
+}
+
+// WSOrigin sets the Origin header, it defaults to the address of the server.
+func WSOrigin(origin string) WSOption {
+	return func(o *WSOpts) {
+		o.Origin = origin
+	}
+}
+
+// WSHeader adds a header to the handshake request, e.g. Host or Authorization.
+func WSHeader(name, val string) WSOption {
+	return func(o *WSOpts) {
+		if o.Headers == nil {
+			o.Headers = make(http.Header)
+		}
+		o.Headers.Add(name, val)
+	}
+}
+
+// WSTLS connects to the server with TLS (wss), without verifying its certificate.
+func WSTLS() WSOption {
+	return func(o *WSOpts) {
+		o.TLS = true
+	}
+}
+
+// WSDialTimeout sets the timeout of the dial and of the handshake, it is also the timeout of Expect.
+func WSDialTimeout(timeout time.Duration) WSOption {
+	return func(o *WSOpts) {
+		o.DialTimeout = timeout
+	}
+}
+
+// ErrWSHandshake is returned by WSRequest when the server does not upgrade the connection.
+type ErrWSHandshake struct {
+	Response *http.Response
+}
+
+func (e *ErrWSHandshake) Error() string {
+	return fmt.Sprintf("websocket handshake failed: %s", e.Response.Status)
+}
+
+// WSConn is a client websocket connection, see WSRequest.
+// Close closes the underlying connection without sending a close frame, see CloseWithCode.
+type WSConn struct {
+	*websocket.Conn
+
+	resp    *http.Response
+	timeout time.Duration
+}
+
+// WSRequest opens a websocket connection to the server.
+// If the server answers the handshake without upgrading the connection, the error is an ErrWSHandshake.
+func WSRequest(opts ...WSOption) (*WSConn, error) {
+	o := &WSOpts{DialTimeout: DefaultWSTimeout}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	scheme, originScheme := "ws", "http"
+	if o.TLS {
+		scheme, originScheme = "wss", "https"
+	}
+
+	headers := make(http.Header)
+	for name, values := range o.Headers {
+		headers[name] = append([]string(nil), values...)
+	}
+	if o.Origin == "" {
+		o.Origin = originScheme + "://" + o.ServerAddr
+	}
+	headers.Set("Origin", o.Origin)
+
+	dialer := &websocket.Dialer{
+		NetDial:          (&net.Dialer{Timeout: o.DialTimeout}).Dial,
+		HandshakeTimeout: o.DialTimeout,
+		//nolint:gosec // test servers
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	conn, resp, err := dialer.Dial(scheme+"://"+o.ServerAddr+o.Path, headers)
+	if err != nil {
+		if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+			return nil, &ErrWSHandshake{Response: resp}
+		}
+		return nil, err
+	}
+
+	return &WSConn{Conn: conn, resp: resp, timeout: o.DialTimeout}, nil
+}
+
+// HandshakeResponse returns the response of the server to the handshake, e.g. to check its headers.
+func (c *WSConn) HandshakeResponse() *http.Response {
+	return c.resp
+}
+
+// SendText sends a text message.
+func (c *WSConn) SendText(text string) error {
+	return c.WriteMessage(websocket.TextMessage, []byte(text))
+}
+
+// ReadText reads the next message, it fails if no message is received within the dial timeout.
+func (c *WSConn) ReadText() (string, error) {
+	// The deadline is on the wall clock: the time may be frozen by the test.
+	if err := c.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return "", err
+	}
+	_, msg, err := c.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+// Expect reads the next message, and returns an error if it is not the given text.
+func (c *WSConn) Expect(text string) error {
+	msg, err := c.ReadText()
+	if err != nil {
+		return err
+	}
+	if msg != text {
+		return fmt.Errorf("expected message %q, got %q", text, msg)
+	}
+	return nil
+}
+
+// CloseWithCode sends a close frame with the code, e.g. websocket.CloseNormalClosure, and closes the connection.
+func (c *WSConn) CloseWithCode(code int) error {
+	msg := websocket.FormatCloseMessage(code, "")
+	err := c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.timeout))
+	if errClose := c.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// wsServerOpts websocket test server options.
+type wsServerOpts struct {
+	tls       bool
+	anyOrigin bool
+	onUpgrade func(*http.Request)
+}
+
+// WSServerOption websocket test server option type.
+type WSServerOption func(o *wsServerOpts)
+
+// WSServerTLS serves the websocket test server with TLS.
+func WSServerTLS() WSServerOption {
+	return func(o *wsServerOpts) {
+		o.tls = true
+	}
+}
+
+// WSAnyOrigin accepts the handshakes from any origin.
+// By default, the Origin must match the Host of the request.
+func WSAnyOrigin() WSServerOption {
+	return func(o *wsServerOpts) {
+		o.anyOrigin = true
+	}
+}
+
+// WSOnUpgrade sets a function called with every handshake request, e.g. to check its path or headers.
+func WSOnUpgrade(fn func(req *http.Request)) WSServerOption {
+	return func(o *wsServerOpts) {
+		o.onUpgrade = fn
+	}
+}
+
+// NewWSEchoServer creates a new Server upgrading every request to websocket, and sending every message back.
+func NewWSEchoServer(t *testing.T, opts ...WSServerOption) *httptest.Server {
+	t.Helper()
+
+	o := &wsServerOpts{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	upgrader := websocket.Upgrader{}
+	if o.anyOrigin {
+		upgrader.CheckOrigin = func(*http.Request) bool { return true }
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if o.onUpgrade != nil {
+			o.onUpgrade(req)
+		}
+
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	})
+
+	var server *httptest.Server
+	if o.tls {
+		server = httptest.NewTLSServer(handler)
+	} else {
+		server = httptest.NewServer(handler)
+	}
+
+	t.Cleanup(server.Close)
+	return server
+}
+
+// NewWSRejectServer creates a new Server answering every request, upgrades included, with the status code.
+func NewWSRejectServer(t *testing.T, status int) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}))
+
+	t.Cleanup(server.Close)
+	return server
+}
@@ -0,0 +1,196 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/memmetrics"
+)
+
+// OtherDimension is the dimension of the requests beyond the maximum number of dimensions of an interval, see Aggregate.
+const OtherDimension = "_other"
+
+const (
+	histMin                = 1
+	histMax                = 3600000000 // 1 hour in microseconds
+	histSignificantFigures = 2
+)
+
+// Summary is the structured record emitted for every dimension at the end of an interval in aggregate mode, see Aggregate.
+type Summary struct {
+	Dimension         string           `json:"dimension"`           // Dimension - value of the dimension of the requests
+	Start             time.Time        `json:"start"`               // Start - start of the interval
+	End               time.Time        `json:"end"`                 // End - end of the interval
+	Count             int64            `json:"count"`               // Count - number of requests
+	Codes             map[string]int64 `json:"codes"`               // Codes - number of requests by status class, e.g. "5xx"
+	Roundtrip         Quantiles        `json:"roundtrip"`           // Roundtrip - round trip time quantiles in milliseconds
+	RequestBodyBytes  int64            `json:"request_body_bytes"`  // RequestBodyBytes - total size of request bodies in bytes
+	ResponseBodyBytes int64            `json:"response_body_bytes"` // ResponseBodyBytes - total size of response bodies in bytes
+}
+
+// Quantiles contains the quantiles of a distribution of round trip times, in milliseconds.
+type Quantiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+type aggregateOptions struct {
+	interval      time.Duration
+	dimension     func(*http.Request) string
+	maxDimensions int
+}
+
+// aggregator accumulates the requests by dimension, and emits their summaries every interval.
+type aggregator struct {
+	opts aggregateOptions
+	t    *Tracer
+
+	mu    sync.Mutex
+	start clock.Time
+	dims  map[string]*aggregate
+
+	// flushMu serializes the summaries written by the ticker and by close.
+	flushMu sync.Mutex
+
+	ticker    clock.Ticker
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// aggregate is the accumulation of the requests of a dimension over an interval.
+type aggregate struct {
+	count             int64
+	codes             map[string]int64
+	latency           *memmetrics.HDRHistogram
+	requestBodyBytes  int64
+	responseBodyBytes int64
+}
+
+func newAggregator(t *Tracer, opts aggregateOptions) *aggregator {
+	a := &aggregator{
+		opts:    opts,
+		t:       t,
+		start:   clock.Now(),
+		dims:    make(map[string]*aggregate),
+		ticker:  clock.NewTicker(opts.interval),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *aggregator) run() {
+	defer close(a.stopped)
+	for {
+		select {
+		case <-a.ticker.C():
+			a.flush()
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// record accumulates a request in the aggregate of its dimension.
+func (a *aggregator) record(req *http.Request, code int, reqBytes, respBytes int64, diff time.Duration) error {
+	dim := a.opts.dimension(req)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	agg, ok := a.dims[dim]
+	if !ok {
+		if len(a.dims) >= a.opts.maxDimensions {
+			dim = OtherDimension
+			agg, ok = a.dims[dim]
+		}
+		if !ok {
+			h, err := memmetrics.NewHDRHistogram(histMin, histMax, histSignificantFigures)
+			if err != nil {
+				return err
+			}
+			agg = &aggregate{codes: make(map[string]int64), latency: h}
+			a.dims[dim] = agg
+		}
+	}
+
+	agg.count++
+	agg.codes[statusClass(code)]++
+	agg.requestBodyBytes += reqBytes
+	agg.responseBodyBytes += respBytes
+
+	if diff > histMax*clock.Microsecond {
+		diff = histMax * clock.Microsecond
+	}
+	return agg.latency.RecordLatencies(diff, 1)
+}
+
+// flush emits the summaries of the current interval, then starts a new one.
+func (a *aggregator) flush() {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+
+	a.mu.Lock()
+	dims, start, end := a.dims, a.start, clock.Now()
+	a.dims = make(map[string]*aggregate, len(dims))
+	a.start = end
+	a.mu.Unlock()
+
+	names := make([]string, 0, len(dims))
+	for name := range dims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	enc := json.NewEncoder(a.t.writer)
+	for _, name := range names {
+		if err := enc.Encode(dims[name].summary(name, start, end)); err != nil {
+			a.t.log.Error("Failed to marshal summary: %v", err)
+		}
+	}
+}
+
+// close stops the ticker and emits the summaries of the last, partial, interval.
+func (a *aggregator) close() {
+	a.closeOnce.Do(func() {
+		a.ticker.Stop()
+		close(a.done)
+		<-a.stopped
+		a.flush()
+	})
+}
+
+func (g *aggregate) summary(dimension string, start, end time.Time) *Summary {
+	return &Summary{
+		Dimension: dimension,
+		Start:     start,
+		End:       end,
+		Count:     g.count,
+		Codes:     g.codes,
+		Roundtrip: Quantiles{
+			P50: milliseconds(g.latency.LatencyAtQuantile(50)),
+			P90: milliseconds(g.latency.LatencyAtQuantile(90)),
+			P99: milliseconds(g.latency.LatencyAtQuantile(99)),
+			Max: milliseconds(g.latency.LatencyAtQuantile(100)),
+		},
+		RequestBodyBytes:  g.requestBodyBytes,
+		ResponseBodyBytes: g.responseBodyBytes,
+	}
+}
+
+func statusClass(code int) string {
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(clock.Millisecond)
+}
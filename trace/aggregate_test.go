@@ -0,0 +1,180 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
+	"github.com/vulcand/oxy/v2/testutils"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Summaries(t *testing.T) []Summary {
+	t.Helper()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var out []Summary
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		var s Summary
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &s))
+		out = append(out, s)
+	}
+	return out
+}
+
+// aggregateHandler answers with the status code of the X-Code header, after the latency in milliseconds of the X-Latency header.
+var aggregateHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	latency, _ := strconv.Atoi(req.Header.Get("X-Latency"))
+	clock.Advance(time.Duration(latency) * time.Millisecond)
+
+	code, _ := strconv.Atoi(req.Header.Get("X-Code"))
+	w.Header().Set("Content-Length", "5")
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte("hello"))
+})
+
+func byHost(req *http.Request) string {
+	return req.Host
+}
+
+func serveAggregated(t *testing.T, tr *Tracer, host string, code, latencyMs, repeat int) {
+	t.Helper()
+
+	for i := 0; i < repeat; i++ {
+		req := httptest.NewRequest(http.MethodPost, "http://"+host+"/", bytes.NewBufferString("abc"))
+		req.Header.Set("Content-Length", "3")
+		req.Header.Set("X-Code", strconv.Itoa(code))
+		req.Header.Set("X-Latency", strconv.Itoa(latencyMs))
+		tr.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func TestTracer_aggregate(t *testing.T) {
+	testutils.FreezeTime(t)
+	start := clock.Now()
+
+	out := &syncBuffer{}
+	tr, err := New(aggregateHandler, out, Aggregate(time.Minute, byHost, 10))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = tr.Close() })
+
+	serveAggregated(t, tr, "a", http.StatusOK, 1, 98)
+	serveAggregated(t, tr, "a", http.StatusInternalServerError, 100, 2)
+	serveAggregated(t, tr, "b", http.StatusNotFound, 10, 10)
+	assert.Empty(t, out.Summaries(t))
+
+	clock.Advance(start.Add(time.Minute).Sub(clock.Now()))
+	require.Eventually(t, func() bool { return len(out.Summaries(t)) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	summaries := out.Summaries(t)
+
+	a := summaries[0]
+	assert.Equal(t, "a", a.Dimension)
+	assert.True(t, start.Equal(a.Start))
+	assert.True(t, start.Add(time.Minute).Equal(a.End))
+	assert.EqualValues(t, 100, a.Count)
+	assert.Equal(t, map[string]int64{"2xx": 98, "5xx": 2}, a.Codes)
+	assert.InDelta(t, 1, a.Roundtrip.P50, 0.01)
+	assert.InDelta(t, 100, a.Roundtrip.P99, 1)
+	assert.EqualValues(t, 300, a.RequestBodyBytes)
+	assert.EqualValues(t, 500, a.ResponseBodyBytes)
+
+	b := summaries[1]
+	assert.Equal(t, "b", b.Dimension)
+	assert.EqualValues(t, 10, b.Count)
+	assert.Equal(t, map[string]int64{"4xx": 10}, b.Codes)
+	assert.InDelta(t, 10, b.Roundtrip.P99, 0.1)
+
+	// The next interval starts empty: only the active dimensions are emitted.
+	serveAggregated(t, tr, "b", http.StatusOK, 1, 1)
+	clock.Advance(start.Add(2 * time.Minute).Sub(clock.Now()))
+	require.Eventually(t, func() bool { return len(out.Summaries(t)) == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	b = out.Summaries(t)[2]
+	assert.Equal(t, "b", b.Dimension)
+	assert.EqualValues(t, 1, b.Count)
+	assert.Equal(t, map[string]int64{"2xx": 1}, b.Codes)
+}
+
+func TestTracer_aggregateClose(t *testing.T) {
+	testutils.FreezeTime(t)
+	start := clock.Now()
+
+	out := &syncBuffer{}
+	tr, err := New(aggregateHandler, out, Aggregate(time.Minute, byHost, 10))
+	require.NoError(t, err)
+
+	serveAggregated(t, tr, "a", http.StatusOK, 1, 3)
+	clock.Advance(10 * time.Second)
+
+	require.NoError(t, tr.Close())
+
+	summaries := out.Summaries(t)
+	require.Len(t, summaries, 1)
+	assert.Equal(t, "a", summaries[0].Dimension)
+	assert.EqualValues(t, 3, summaries[0].Count)
+	assert.True(t, start.Add(10*time.Second+3*time.Millisecond).Equal(summaries[0].End))
+
+	// Close is idempotent.
+	require.NoError(t, tr.Close())
+	assert.Len(t, out.Summaries(t), 1)
+}
+
+func TestTracer_aggregateOther(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	out := &syncBuffer{}
+	tr, err := New(aggregateHandler, out, Aggregate(time.Minute, byHost, 2))
+	require.NoError(t, err)
+
+	serveAggregated(t, tr, "a", http.StatusOK, 1, 1)
+	serveAggregated(t, tr, "b", http.StatusOK, 1, 2)
+	serveAggregated(t, tr, "c", http.StatusOK, 1, 3)
+	serveAggregated(t, tr, "d", http.StatusOK, 1, 4)
+	serveAggregated(t, tr, "a", http.StatusOK, 1, 1)
+
+	require.NoError(t, tr.Close())
+
+	counts := map[string]int64{}
+	for _, s := range out.Summaries(t) {
+		counts[s.Dimension] = s.Count
+	}
+	assert.Equal(t, map[string]int64{"a": 2, "b": 2, OtherDimension: 7}, counts)
+}
+
+func TestTracer_aggregateInvalid(t *testing.T) {
+	_, err := New(nil, &bytes.Buffer{}, Aggregate(0, byHost, 10))
+	require.Error(t, err)
+
+	_, err = New(nil, &bytes.Buffer{}, Aggregate(time.Minute, nil, 10))
+	require.Error(t, err)
+
+	_, err = New(nil, &bytes.Buffer{}, Aggregate(time.Minute, byHost, 0))
+	require.Error(t, err)
+
+	// The headers are only captured in the per-request records.
+	_, err = New(nil, &bytes.Buffer{}, Aggregate(time.Minute, byHost, 10), RequestHeaders("X-A"))
+	require.Error(t, err)
+}
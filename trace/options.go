@@ -1,6 +1,13 @@
 package trace
 
-import "github.com/vulcand/oxy/v2/utils"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vulcand/oxy/v2/utils"
+)
 
 // Option is a functional option setter for Tracer.
 type Option func(*Tracer) error
@@ -29,6 +36,46 @@ func ResponseHeaders(headers ...string) Option {
 	}
 }
 
+// ExtraFieldsFunc returns fields to add to the Record of a request, see ExtraFields.
+type ExtraFieldsFunc func(req *http.Request, pw *utils.ProxyWriter) map[string]any
+
+// ExtraFields adds the fields returned by fn to the Record.Extra of every request, e.g. a tenant parsed from the path.
+// fn is called after the next handler, with the request as seen by the Tracer and the response writer,
+// it can return nil to add nothing. The fields of the ExtraFields options are merged in order,
+// a key overriding the fields of the previous options. If fn panics, the panic is logged and the record is
+// emitted without its fields. The fields that can't be encoded in JSON (e.g. a NaN or a func) are logged and skipped.
+// It can't be used with Aggregate.
+func ExtraFields(fn ExtraFieldsFunc) Option {
+	return func(t *Tracer) error {
+		if fn == nil {
+			return errors.New("extra fields function can't be nil")
+		}
+		t.extraFields = append(t.extraFields, fn)
+		return nil
+	}
+}
+
+// Aggregate switches the Tracer to the aggregate mode: instead of a Record per request, it emits every interval
+// a Summary per dimension of the requests of the interval (e.g. per Host), with their counts by status class,
+// their round trip time quantiles and their body bytes.
+// The requests beyond maxDimensions distinct dimensions in an interval are accumulated in the OtherDimension.
+// It can't be used with RequestHeaders, ResponseHeaders and ExtraFields.
+func Aggregate(interval time.Duration, dimension func(*http.Request) string, maxDimensions int) Option {
+	return func(t *Tracer) error {
+		if interval <= 0 {
+			return fmt.Errorf("invalid aggregate interval: %v", interval)
+		}
+		if dimension == nil {
+			return errors.New("aggregate dimension can't be nil")
+		}
+		if maxDimensions < 1 {
+			return fmt.Errorf("max dimensions should be >= 1, got %d", maxDimensions)
+		}
+		t.aggregate = &aggregateOptions{interval: interval, dimension: dimension, maxDimensions: maxDimensions}
+		return nil
+	}
+}
+
 // Logger defines the logger the tracer will use.
 func Logger(l utils.Logger) Option {
 	return func(t *Tracer) error {
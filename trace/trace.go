@@ -1,9 +1,15 @@
-// Package trace implement structured logging of requests
+// Package trace implement structured logging of requests.
+//
+// By default, the Tracer emits a Record per request. At high request rates, the Aggregate mode
+// emits instead a Summary per dimension (e.g. per Host) every interval.
+// The requests are recorded even when the next handler panics or the client disconnects, see Record.Error.
 package trace
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,6 +20,19 @@ import (
 	"github.com/vulcand/oxy/v2/utils"
 )
 
+// StatusClientClosedRequest is the status code recorded when the client disconnects before the response is complete.
+const StatusClientClosedRequest = 499
+
+// The errors of the requests that did not complete normally, see Record.Error.
+const (
+	// ErrorPanic is recorded when the next handler panics, with the status code 500.
+	ErrorPanic = "panic"
+	// ErrorAborted is recorded when the next handler aborts the response with http.ErrAbortHandler.
+	ErrorAborted = "aborted"
+	// ErrorClientDisconnect is recorded when the client disconnects, with StatusClientClosedRequest.
+	ErrorClientDisconnect = "client_disconnect"
+)
+
 // Tracer records request and response emitting JSON structured data to the output.
 type Tracer struct {
 	errHandler  utils.ErrorHandler
@@ -22,12 +41,21 @@ type Tracer struct {
 	respHeaders []string
 	writer      io.Writer
 
+	// extraFields are the callbacks of the Record.Extra fields, see ExtraFields.
+	extraFields []ExtraFieldsFunc
+
+	// aggregate enables the aggregate mode, see Aggregate.
+	aggregate  *aggregateOptions
+	aggregator *aggregator
+
 	log utils.Logger
 }
 
 // New creates a new Tracer middleware that emits all the request/response information in structured format
 // to writer and passes the request to the next handler. It can optionally capture request and response headers,
 // see RequestHeaders and ResponseHeaders options for details.
+// In the aggregate mode (see Aggregate), the Tracer should be closed to stop emitting the summaries.
+// next can be nil, and set later with Wrap.
 func New(next http.Handler, writer io.Writer, opts ...Option) (*Tracer, error) {
 	t := &Tracer{
 		writer: writer,
@@ -43,38 +71,167 @@ func New(next http.Handler, writer io.Writer, opts ...Option) (*Tracer, error) {
 	if t.errHandler == nil {
 		t.errHandler = utils.DefaultHandler
 	}
+	if t.aggregate != nil {
+		if len(t.reqHeaders) != 0 || len(t.respHeaders) != 0 {
+			return nil, errors.New("headers can't be captured in the aggregate mode")
+		}
+		if len(t.extraFields) != 0 {
+			return nil, errors.New("extra fields can't be captured in the aggregate mode")
+		}
+		t.aggregator = newAggregator(t, *t.aggregate)
+	}
 	return t, nil
 }
 
+// Close stops the Tracer in the aggregate mode, emitting the summaries of the current interval.
+// It is a no-op otherwise.
+func (t *Tracer) Close() error {
+	if t.aggregator != nil {
+		t.aggregator.close()
+	}
+	return nil
+}
+
+// Wrap sets the next handler to be called by the tracer, when it was created without.
+func (t *Tracer) Wrap(next http.Handler) error {
+	if err := utils.CheckWrap(t.next, next); err != nil {
+		return err
+	}
+	t.next = next
+	return nil
+}
+
 func (t *Tracer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if t.next == nil {
+		utils.ServeError(t.errHandler, w, req, "trace", &utils.ErrNotWired{Middleware: "trace"})
+		return
+	}
+
 	start := clock.Now()
 	pw := utils.NewProxyWriterWithLogger(w, t.log)
+
+	// The request is recorded before the panic is passed on to the server.
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+
+		o := outcome{code: http.StatusInternalServerError, err: ErrorPanic, panicType: fmt.Sprintf("%T", recovered)}
+		if e, ok := recovered.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+			o = outcome{code: http.StatusInternalServerError, err: ErrorAborted}
+			if pw.HeaderWritten() {
+				o.code = pw.StatusCode()
+			}
+		}
+		t.emit(req, pw, o, clock.Since(start))
+		panic(recovered)
+	}()
+
 	t.next.ServeHTTP(pw, req)
 
-	l := t.newRecord(req, pw, clock.Since(start))
-	if err := json.NewEncoder(t.writer).Encode(l); err != nil {
+	o := outcome{code: pw.StatusCode()}
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		o = outcome{code: StatusClientClosedRequest, err: ErrorClientDisconnect}
+	}
+	t.emit(req, pw, o, clock.Since(start))
+}
+
+// outcome is how the request ended: its status code, and the error when it did not complete normally.
+type outcome struct {
+	code      int
+	err       string
+	panicType string
+}
+
+// emit records the request, synchronously.
+func (t *Tracer) emit(req *http.Request, pw *utils.ProxyWriter, o outcome, diff time.Duration) {
+	if t.aggregator != nil {
+		err := t.aggregator.record(req, o.code, bodyBytes(req.Header), bodyBytes(pw.Header()), diff)
+		if err != nil {
+			t.log.Error("Failed to record request: %v", err)
+		}
+		return
+	}
+
+	l := t.newRecord(req, pw, o, diff)
+	err := json.NewEncoder(t.writer).Encode(l)
+	if err != nil && l.Extra != nil {
+		// The record is emitted without the extra fields that can't be encoded, e.g. a NaN or a channel.
+		l.Extra = t.encodableExtra(l.Extra)
+		err = json.NewEncoder(t.writer).Encode(l)
+	}
+	if err != nil {
 		t.log.Error("Failed to marshal request: %v", err)
 	}
 }
 
-func (t *Tracer) newRecord(req *http.Request, pw *utils.ProxyWriter, diff time.Duration) *Record {
+// encodableExtra returns the extra fields that can be encoded in JSON, the others are logged and skipped.
+func (t *Tracer) encodableExtra(extra map[string]any) map[string]any {
+	out := make(map[string]any, len(extra))
+	for k, v := range extra {
+		if _, err := json.Marshal(v); err != nil {
+			t.log.Error("Failed to marshal extra field %q: %v", k, err)
+			continue
+		}
+		out[k] = v
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func (t *Tracer) newRecord(req *http.Request, pw *utils.ProxyWriter, o outcome, diff time.Duration) *Record {
+	requestID, _ := utils.RequestIDFromContext(req.Context())
+
 	return &Record{
+		RequestID: requestID,
 		Request: Request{
 			Method:    req.Method,
+			Proto:     req.Proto,
 			URL:       req.URL.String(),
 			TLS:       newTLS(req),
 			BodyBytes: bodyBytes(req.Header),
 			Headers:   captureHeaders(req.Header, t.reqHeaders),
 		},
 		Response: Response{
-			Code:      pw.StatusCode(),
+			Code:      o.code,
 			BodyBytes: bodyBytes(pw.Header()),
 			Roundtrip: float64(diff) / float64(clock.Millisecond),
 			Headers:   captureHeaders(pw.Header(), t.respHeaders),
 		},
+		Extra:     t.captureExtra(req, pw),
+		Error:     o.err,
+		PanicType: o.panicType,
 	}
 }
 
+// captureExtra merges the fields returned by the ExtraFields callbacks, the later ones overriding the earlier ones.
+func (t *Tracer) captureExtra(req *http.Request, pw *utils.ProxyWriter) map[string]any {
+	var extra map[string]any
+	for _, fn := range t.extraFields {
+		for k, v := range t.callExtraFields(fn, req, pw) {
+			if extra == nil {
+				extra = make(map[string]any)
+			}
+			extra[k] = v
+		}
+	}
+	return extra
+}
+
+// callExtraFields calls fn, a panic is logged and its fields are skipped: the record is emitted without them.
+func (t *Tracer) callExtraFields(fn ExtraFieldsFunc, req *http.Request, pw *utils.ProxyWriter) (fields map[string]any) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			t.log.Error("Failed to capture extra fields: %v", recovered)
+			fields = nil
+		}
+	}()
+	return fn(req, pw)
+}
+
 func captureHeaders(in http.Header, headers []string) http.Header {
 	if len(headers) == 0 || in == nil {
 		return nil
@@ -94,13 +251,22 @@ func captureHeaders(in http.Header, headers []string) http.Header {
 
 // Record represents a structured request and response record.
 type Record struct {
-	Request  Request  `json:"request"`
-	Response Response `json:"response"`
+	// RequestID is the ID of the request, e.g. set by the requestid middleware, see utils.WithRequestID.
+	RequestID string   `json:"request_id,omitempty"`
+	Request   Request  `json:"request"`
+	Response  Response `json:"response"`
+	// Extra contains the fields returned by the ExtraFields callbacks, if any.
+	Extra map[string]any `json:"extra,omitempty"`
+	// Error is set when the request did not complete normally: ErrorPanic, ErrorAborted or ErrorClientDisconnect.
+	Error string `json:"error,omitempty"`
+	// PanicType is the type of the value passed to panic, with ErrorPanic.
+	PanicType string `json:"panic_type,omitempty"`
 }
 
 // Request contains information about an HTTP request.
 type Request struct {
 	Method    string      `json:"method"`            // Method - request method
+	Proto     string      `json:"proto"`             // Proto - protocol of the client, e.g. HTTP/2.0
 	BodyBytes int64       `json:"body_bytes"`        // BodyBytes - size of request body in bytes
 	URL       string      `json:"url"`               // URL - Request URL
 	Headers   http.Header `json:"headers,omitempty"` // Headers - optional request headers, will be recorded if configured
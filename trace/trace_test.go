@@ -3,9 +3,11 @@ package trace
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
 	"github.com/vulcand/oxy/v2/testutils"
 	"github.com/vulcand/oxy/v2/utils"
 )
@@ -45,6 +48,123 @@ func TestTracer_simple(t *testing.T) {
 	assert.EqualValues(t, 5, r.Response.BodyBytes)
 }
 
+func TestTracer_wallClockStep(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// The wall clock goes back an hour, e.g. an NTP correction, while the request is served.
+		clock.Advance(100 * clock.Millisecond)
+		clock.StepWall(-clock.Hour)
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tr)
+	t.Cleanup(srv.Close)
+
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+	assert.Equal(t, float64(100), r.Response.Roundtrip)
+}
+
+func TestTracer_panic(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	handler := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		clock.Advance(20 * clock.Millisecond)
+		panic(fmt.Errorf("boom"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace)
+	require.NoError(t, err)
+
+	var recovered any
+	func() {
+		defer func() { recovered = recover() }()
+		tr.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/hello", nil))
+	}()
+
+	// The panic reaches the server.
+	require.Error(t, recovered.(error))
+	assert.Equal(t, "boom", recovered.(error).Error())
+
+	records := bytes.Split(bytes.TrimSpace(trace.Bytes()), []byte("\n"))
+	require.Len(t, records, 1)
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(records[0], &r))
+	assert.Equal(t, "http://localhost/hello", r.Request.URL)
+	assert.Equal(t, http.StatusInternalServerError, r.Response.Code)
+	assert.Equal(t, float64(20), r.Response.Roundtrip)
+	assert.Equal(t, ErrorPanic, r.Error)
+	assert.Equal(t, "*errors.errorString", r.PanicType)
+}
+
+func TestTracer_aborted(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		clock.Advance(15 * clock.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("hel"))
+		panic(http.ErrAbortHandler)
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace)
+	require.NoError(t, err)
+
+	var recovered any
+	func() {
+		defer func() { recovered = recover() }()
+		tr.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/hello", nil))
+	}()
+
+	// The server aborts the response silently.
+	assert.Equal(t, http.ErrAbortHandler, recovered)
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+	assert.Equal(t, http.StatusOK, r.Response.Code)
+	assert.Equal(t, ErrorAborted, r.Error)
+	assert.Empty(t, r.PanicType)
+	assert.Equal(t, float64(15), r.Response.Roundtrip)
+}
+
+func TestTracer_clientDisconnect(t *testing.T) {
+	testutils.FreezeTime(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	handler := http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		// The client goes away while the response is being prepared.
+		clock.Advance(5 * clock.Millisecond)
+		cancel()
+		<-req.Context().Done()
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace)
+	require.NoError(t, err)
+
+	tr.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/hello", nil).WithContext(ctx))
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+	assert.Equal(t, StatusClientClosedRequest, r.Response.Code)
+	assert.Equal(t, ErrorClientDisconnect, r.Error)
+	assert.Equal(t, float64(5), r.Response.Roundtrip)
+}
+
 func TestTracer_captureHeaders(t *testing.T) {
 	respHeaders := http.Header{
 		"X-Re-1": []string{"6", "7"},
@@ -109,3 +229,219 @@ func TestTracer_TLS(t *testing.T) {
 	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
 	assert.Equal(t, versionToString(state.Version), r.Request.TLS.Version)
 }
+
+func TestTracer_proto(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	for _, http2 := range []bool{true, false} {
+		trace := &bytes.Buffer{}
+		tr, err := New(handler, trace)
+		require.NoError(t, err)
+
+		srv := httptest.NewUnstartedServer(tr)
+		srv.EnableHTTP2 = http2
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+
+		re, err := srv.Client().Get(srv.URL)
+		require.NoError(t, err)
+		_ = re.Body.Close()
+
+		var r *Record
+		require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+		if http2 {
+			assert.Equal(t, "HTTP/2.0", r.Request.Proto)
+		} else {
+			assert.Equal(t, "HTTP/1.1", r.Request.Proto)
+		}
+	}
+}
+
+type tenantKey struct{}
+
+func TestTracer_extraFields(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Cache", "HIT")
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace, ExtraFields(func(req *http.Request, pw *utils.ProxyWriter) map[string]any {
+		return map[string]any{
+			"tenant":       req.Context().Value(tenantKey{}),
+			"cache_status": pw.Header().Get("X-Cache"),
+		}
+	}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tr.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), tenantKey{}, "acme")))
+	}))
+	t.Cleanup(srv.Close)
+
+	re, _, err := testutils.Get(srv.URL + "/hello")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+
+	assert.Equal(t, "/hello", r.Request.URL)
+	assert.Equal(t, map[string]any{"tenant": "acme", "cache_status": "HIT"}, r.Extra)
+}
+
+func TestTracer_extraFieldsOrder(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace,
+		ExtraFields(func(*http.Request, *utils.ProxyWriter) map[string]any {
+			return map[string]any{"a": "first", "b": "first"}
+		}),
+		ExtraFields(func(*http.Request, *utils.ProxyWriter) map[string]any {
+			return nil
+		}),
+		ExtraFields(func(*http.Request, *utils.ProxyWriter) map[string]any {
+			return map[string]any{"b": "second", "c": true}
+		}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tr)
+	t.Cleanup(srv.Close)
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+	assert.Equal(t, map[string]any{"a": "first", "b": "second", "c": true}, r.Extra)
+}
+
+func TestTracer_extraFieldsEmpty(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace, ExtraFields(func(*http.Request, *utils.ProxyWriter) map[string]any {
+		return map[string]any{}
+	}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tr)
+	t.Cleanup(srv.Close)
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	assert.NotContains(t, trace.String(), `"extra"`)
+}
+
+type errorLogger struct {
+	utils.NoopLogger
+
+	errors []string
+}
+
+func (l *errorLogger) Error(format string, args ...any) {
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func TestTracer_extraFieldsPanic(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	log := &errorLogger{}
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace,
+		Logger(log),
+		ExtraFields(func(*http.Request, *utils.ProxyWriter) map[string]any {
+			panic("boom")
+		}),
+		ExtraFields(func(*http.Request, *utils.ProxyWriter) map[string]any {
+			return map[string]any{"ok": true}
+		}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tr)
+	t.Cleanup(srv.Close)
+
+	re, _, err := testutils.Get(srv.URL + "/hello")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+	assert.Equal(t, "/hello", r.Request.URL)
+	assert.Equal(t, http.StatusOK, r.Response.Code)
+	assert.Equal(t, map[string]any{"ok": true}, r.Extra)
+	assert.Equal(t, []string{"Failed to capture extra fields: boom"}, log.errors)
+}
+
+func TestTracer_extraFieldsUnencodable(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	log := &errorLogger{}
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace,
+		Logger(log),
+		ExtraFields(func(*http.Request, *utils.ProxyWriter) map[string]any {
+			return map[string]any{"ratio": math.NaN(), "ok": true}
+		}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tr)
+	t.Cleanup(srv.Close)
+
+	re, _, err := testutils.Get(srv.URL + "/hello")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// The record is emitted without the field that can't be encoded.
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+	assert.Equal(t, "/hello", r.Request.URL)
+	assert.Equal(t, http.StatusOK, r.Response.Code)
+	assert.Equal(t, map[string]any{"ok": true}, r.Extra)
+	require.Len(t, log.errors, 1)
+	assert.Contains(t, log.errors[0], `Failed to marshal extra field "ratio"`)
+}
+
+func TestTracer_extraFieldsAggregate(t *testing.T) {
+	_, err := New(nil, &bytes.Buffer{},
+		Aggregate(clock.Second, func(*http.Request) string { return "" }, 1),
+		ExtraFields(func(*http.Request, *utils.ProxyWriter) map[string]any { return nil }))
+	require.Error(t, err)
+}
+
+func TestTracer_requestID(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	tr.ServeHTTP(httptest.NewRecorder(), req.WithContext(utils.WithRequestID(req.Context(), "abc")))
+	tr.ServeHTTP(httptest.NewRecorder(), req)
+
+	scanner := bufio.NewScanner(trace)
+
+	require.True(t, scanner.Scan())
+	var r *Record
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+	assert.Equal(t, "abc", r.RequestID)
+
+	// Without ID, the field is omitted.
+	require.True(t, scanner.Scan())
+	assert.NotContains(t, scanner.Text(), "request_id")
+}
@@ -0,0 +1,53 @@
+package utils
+
+import "sync"
+
+// DefaultBufferSize is the size of the buffers of the default BufferPool,
+// it matches the size of the buffers used by io.Copy.
+const DefaultBufferSize = 32 * 1024
+
+// DefaultBufferPool is the BufferPool shared by the handlers copying bodies.
+var DefaultBufferPool = NewBufferPool(DefaultBufferSize)
+
+// BufferPool is a pool of byte slices of a fixed size.
+// It implements httputil.BufferPool, and is safe for concurrent use.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool creates a pool of byte slices of the given size.
+// A size lower than or equal to 0 means DefaultBufferSize.
+func NewBufferPool(size int) *BufferPool {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+
+	b := &BufferPool{size: size}
+	b.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return b
+}
+
+// Size returns the size of the slices of the pool.
+func (b *BufferPool) Size() int {
+	return b.size
+}
+
+// Get returns a slice of Size bytes.
+// The slice is owned by the caller until it is given back with Put.
+func (b *BufferPool) Get() []byte {
+	return *(b.pool.Get().(*[]byte))
+}
+
+// Put gives back a slice obtained with Get.
+// Slices of another size are dropped.
+func (b *BufferPool) Put(buf []byte) {
+	if cap(buf) != b.size {
+		return
+	}
+	buf = buf[:b.size]
+	b.pool.Put(&buf)
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool(16)
+	assert.Equal(t, 16, pool.Size())
+
+	buf := pool.Get()
+	require.Len(t, buf, 16)
+
+	pool.Put(buf[:4])
+	assert.Len(t, pool.Get(), 16)
+
+	// Slices of another size are dropped.
+	pool.Put(make([]byte, 8))
+	assert.Len(t, pool.Get(), 16)
+}
+
+func TestBufferPool_defaultSize(t *testing.T) {
+	assert.Equal(t, DefaultBufferSize, NewBufferPool(0).Size())
+	assert.Equal(t, DefaultBufferSize, NewBufferPool(-1).Size())
+}
+
+func TestBufferPool_concurrent(t *testing.T) {
+	pool := NewBufferPool(64)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(b byte) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				buf := pool.Get()
+				for k := range buf {
+					buf[k] = b
+				}
+				assert.Equal(t, bytes.Repeat([]byte{b}, 64), buf)
+				pool.Put(buf)
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+}
@@ -7,6 +7,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"sort"
 )
 
 // SerializableHTTPRequest serializable HTTP request.
@@ -58,7 +59,130 @@ func (s *SerializableHTTPRequest) ToJSON() string {
 	return string(jsonVal)
 }
 
-// DumpHTTPRequest dump a HTTP request to JSON.
-func DumpHTTPRequest(req *http.Request) string {
-	return Clone(req).ToJSON()
+// DefaultRedactedHeaders are the headers whose values are redacted by DumpHTTPRequest, see RedactHeaders.
+var DefaultRedactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+// DefaultDumpMaxHeaderBytes is the default maximum size of the headers in a dump, see MaxHeaderBytes.
+const DefaultDumpMaxHeaderBytes = 4096
+
+const redacted = "[REDACTED]"
+
+// DumpOption provides options for DumpHTTPRequest.
+type DumpOption func(*dumpOptions)
+
+type dumpOptions struct {
+	maxHeaderBytes      int
+	redactHeaders       []string
+	includeBodyMetadata bool
+}
+
+// MaxHeaderBytes sets the maximum size of the header names and values in a dump (DefaultDumpMaxHeaderBytes by default).
+// The headers beyond the limit are dropped, and the dump is marked as truncated.
+// A value <= 0 means no limit.
+func MaxHeaderBytes(n int) DumpOption {
+	return func(o *dumpOptions) {
+		o.maxHeaderBytes = n
+	}
+}
+
+// RedactHeaders sets the headers whose values are replaced by "[REDACTED]" (DefaultRedactedHeaders by default).
+func RedactHeaders(names ...string) DumpOption {
+	return func(o *dumpOptions) {
+		o.redactHeaders = names
+	}
+}
+
+// IncludeBodyMetadata adds the content length and the transfer encoding of the body to the dump.
+// The body itself is never dumped.
+func IncludeBodyMetadata(include bool) DumpOption {
+	return func(o *dumpOptions) {
+		o.includeBodyMetadata = include
+	}
+}
+
+// requestDump is the JSON representation of a request in a dump.
+type requestDump struct {
+	Method           string
+	URL              string
+	Proto            string
+	Host             string
+	RemoteAddr       string
+	Header           http.Header
+	HeaderTruncated  bool     `json:",omitempty"`
+	ContentLength    *int64   `json:",omitempty"`
+	TransferEncoding []string `json:",omitempty"`
+}
+
+// DumpHTTPRequest dumps a HTTP request to JSON, e.g. for the debug logs.
+// The sensitive headers are redacted and the size of the headers is bounded, see the DumpOption.
+// As the dump allocates, it should only be built when the debug messages are written, see DebugEnabled.
+func DumpHTTPRequest(req *http.Request, opts ...DumpOption) string {
+	if req == nil {
+		return "null"
+	}
+
+	o := &dumpOptions{
+		maxHeaderBytes: DefaultDumpMaxHeaderBytes,
+		redactHeaders:  DefaultRedactedHeaders,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	d := requestDump{
+		Method:     req.Method,
+		Proto:      req.Proto,
+		Host:       req.Host,
+		RemoteAddr: req.RemoteAddr,
+	}
+	// The password of the URL is redacted, the raw request URI is left out as it may contain it.
+	if req.URL != nil {
+		d.URL = req.URL.Redacted()
+	}
+	d.Header, d.HeaderTruncated = dumpHeader(req.Header, o)
+
+	if o.includeBodyMetadata {
+		contentLength := req.ContentLength
+		d.ContentLength = &contentLength
+		d.TransferEncoding = req.TransferEncoding
+	}
+
+	jsonVal, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Sprintf("error marshaling request to json: %s", err)
+	}
+	return string(jsonVal)
+}
+
+// dumpHeader returns the redacted copy of h, truncated to the maximum size.
+func dumpHeader(h http.Header, o *dumpOptions) (http.Header, bool) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	redact := make(map[string]bool, len(o.redactHeaders))
+	for _, name := range o.redactHeaders {
+		redact[http.CanonicalHeaderKey(name)] = true
+	}
+
+	out := make(http.Header, len(h))
+	size := 0
+	for _, name := range names {
+		for _, value := range h[name] {
+			if redact[http.CanonicalHeaderKey(name)] {
+				value = redacted
+			}
+
+			size += len(name) + len(value)
+			if o.maxHeaderBytes > 0 && size > o.maxHeaderBytes {
+				return out, true
+			}
+
+			out[name] = append(out[name], value)
+		}
+	}
+
+	return out, false
 }
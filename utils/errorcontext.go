@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrorContext is the error passed by the middlewares to their error handler, see ServeError:
+// it wraps the original error with the name of the component it comes from,
+// e.g. "forward", "roundrobin" or "ratelimit".
+// The original error is still matched by errors.Is and errors.As, and its message is unchanged.
+type ErrorContext struct {
+	Component string
+	Err       error
+}
+
+func (e *ErrorContext) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrorContext) Unwrap() error {
+	return e.Err
+}
+
+// ErrorComponent returns the name of the component an error passed to an error handler comes from,
+// or an empty string if the error is not wrapped in an ErrorContext.
+func ErrorComponent(err error) string {
+	var ec *ErrorContext
+	if errors.As(err, &ec) {
+		return ec.Component
+	}
+	return ""
+}
+
+// ServeError calls h, or DefaultHandler if h is nil, with err wrapped in an ErrorContext naming the component.
+// An error that already carries its component (e.g. the error of a forwarder reported by a buffer) is passed as is.
+func ServeError(h ErrorHandler, w http.ResponseWriter, req *http.Request, component string, err error) {
+	if h == nil {
+		h = DefaultHandler
+	}
+
+	var ec *ErrorContext
+	if !errors.As(err, &ec) {
+		err = &ErrorContext{Component: component, Err: err}
+	}
+
+	h.ServeHTTP(w, req, err)
+}
+
+type nextErrorHandlerKey struct{}
+
+// ChainErrorHandlers returns an error handler calling the handlers in order until one of them handles the error:
+// a handler handles the error by writing the response, or passes it to the next handler with PassError,
+// e.g. after logging it. The last handler passes to DefaultHandler.
+func ChainErrorHandlers(h ...ErrorHandler) ErrorHandler {
+	var next ErrorHandler = DefaultHandler
+	for i := len(h) - 1; i >= 0; i-- {
+		next = chainedErrorHandler{handler: h[i], next: next}
+	}
+	return next
+}
+
+type chainedErrorHandler struct {
+	handler ErrorHandler
+	next    ErrorHandler
+}
+
+func (c chainedErrorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	ctx := context.WithValue(req.Context(), nextErrorHandlerKey{}, c.next)
+	c.handler.ServeHTTP(w, req.WithContext(ctx), err)
+}
+
+// PassError passes the error to the next handler of the chain, see ChainErrorHandlers.
+// Outside a chain, the error is passed to DefaultHandler.
+func PassError(w http.ResponseWriter, req *http.Request, err error) {
+	next, ok := req.Context().Value(nextErrorHandlerKey{}).(ErrorHandler)
+	if !ok {
+		next = DefaultHandler
+	}
+	next.ServeHTTP(w, req, err)
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeError(t *testing.T) {
+	cause := errors.New("boom")
+
+	var handled error
+	h := ErrorHandlerFunc(func(w http.ResponseWriter, _ *http.Request, err error) {
+		handled = err
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	w := httptest.NewRecorder()
+	ServeError(h, w, httptest.NewRequest(http.MethodGet, "/", nil), "inner", cause)
+
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.ErrorIs(t, handled, cause)
+	assert.Equal(t, "boom", handled.Error())
+	assert.Equal(t, "inner", ErrorComponent(handled))
+
+	// The component of an error is kept when it is reported again by an outer component.
+	outer := handled
+	ServeError(h, httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), "outer", outer)
+	assert.Equal(t, outer, handled)
+	assert.Equal(t, "inner", ErrorComponent(handled))
+
+	assert.Empty(t, ErrorComponent(cause))
+}
+
+func TestServeError_defaultHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	ServeError(nil, w, httptest.NewRequest(http.MethodGet, "/", nil), "test", errors.New("boom"))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestChainErrorHandlers(t *testing.T) {
+	var calls []string
+
+	logAndPass := ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		calls = append(calls, "log "+ErrorComponent(err))
+		PassError(w, req, err)
+	})
+	handleTeapot := ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		calls = append(calls, "teapot")
+		if ErrorComponent(err) != "teapot" {
+			PassError(w, req, err)
+			return
+		}
+		w.WriteHeader(http.StatusTeapot)
+	})
+	unreachable := ErrorHandlerFunc(func(http.ResponseWriter, *http.Request, error) {
+		calls = append(calls, "unreachable")
+	})
+
+	h := ChainErrorHandlers(logAndPass, handleTeapot)
+
+	w := httptest.NewRecorder()
+	ServeError(h, w, httptest.NewRequest(http.MethodGet, "/", nil), "teapot", errors.New("boom"))
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, []string{"log teapot", "teapot"}, calls)
+
+	// The error passed by the last handler is answered by DefaultHandler.
+	calls = nil
+	w = httptest.NewRecorder()
+	ServeError(h, w, httptest.NewRequest(http.MethodGet, "/", nil), "other", errors.New("boom"))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, []string{"log other", "teapot"}, calls)
+
+	// A handler that handles the error stops the chain.
+	calls = nil
+	w = httptest.NewRecorder()
+	ServeError(ChainErrorHandlers(handleTeapot, unreachable), w, httptest.NewRequest(http.MethodGet, "/", nil), "teapot", errors.New("boom"))
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, []string{"teapot"}, calls)
+
+	// Outside a chain, PassError answers with DefaultHandler.
+	w = httptest.NewRecorder()
+	PassError(w, httptest.NewRequest(http.MethodGet, "/", nil), errors.New("boom"))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
@@ -2,10 +2,12 @@ package utils
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 )
 
 // StatusClientClosedRequest non-standard HTTP status code for client disconnection.
@@ -15,6 +17,7 @@ const StatusClientClosedRequest = 499
 const StatusClientClosedRequestText = "Client Closed Request"
 
 // ErrorHandler error handler.
+// The middlewares pass their errors wrapped in an ErrorContext naming the middleware, see ServeError.
 type ErrorHandler interface {
 	ServeHTTP(w http.ResponseWriter, req *http.Request, err error)
 }
@@ -28,20 +31,7 @@ type StdHandler struct {
 }
 
 func (e *StdHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request, err error) {
-	statusCode := http.StatusInternalServerError
-
-	//nolint:errorlint // must be changed
-	if e, ok := err.(net.Error); ok {
-		if e.Timeout() {
-			statusCode = http.StatusGatewayTimeout
-		} else {
-			statusCode = http.StatusBadGateway
-		}
-	} else if errors.Is(err, io.EOF) {
-		statusCode = http.StatusBadGateway
-	} else if errors.Is(err, context.Canceled) {
-		statusCode = StatusClientClosedRequest
-	}
+	statusCode := errorStatusCode(err)
 
 	w.WriteHeader(statusCode)
 	_, _ = w.Write([]byte(statusText(statusCode)))
@@ -49,6 +39,59 @@ func (e *StdHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request, err error
 	e.log.Debug("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
 }
 
+// errorStatusCode returns the status code answered by the DefaultHandler to err.
+func errorStatusCode(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return http.StatusGatewayTimeout
+		}
+		return http.StatusBadGateway
+	case errors.Is(err, io.EOF):
+		return http.StatusBadGateway
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Problem is the problem details document (RFC 9457) written by the ProblemHandler.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Component is the component the error comes from, see ErrorComponent.
+	Component string `json:"component,omitempty"`
+	// RequestID is the ID of the request, see WithRequestID.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// ProblemHandler answers the errors with a problem details document (RFC 9457) of type application/problem+json,
+// with the status code of the DefaultHandler. The document carries the ID of the request, if any, see WithRequestID.
+// The message of the error is not disclosed.
+var ProblemHandler ErrorHandler = ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+	statusCode := errorStatusCode(err)
+
+	p := Problem{
+		Type:      "about:blank",
+		Title:     statusText(statusCode),
+		Status:    statusCode,
+		Component: ErrorComponent(err),
+	}
+	if req != nil {
+		p.RequestID, _ = RequestIDFromContext(req.Context())
+	}
+
+	body, _ := json.Marshal(p)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(body)
+})
+
 func statusText(statusCode int) string {
 	if statusCode == StatusClientClosedRequest {
 		return StatusClientClosedRequestText
@@ -2,6 +2,9 @@ package utils
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -30,3 +33,34 @@ func TestDefaultHandlerErrors(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadGateway, w.Code)
 }
+
+func TestProblemHandler(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(WithRequestID(req.Context(), "abc"))
+
+	w := httptest.NewRecorder()
+	ServeError(ProblemHandler, w, req, "forward", io.EOF)
+
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Bad Gateway","status":502,"component":"forward","request_id":"abc"}`, w.Body.String())
+
+	// Without ID nor component.
+	w = httptest.NewRecorder()
+	ProblemHandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), errors.New("boom"))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"type":"about:blank","title":"Internal Server Error","status":500}`, w.Body.String())
+}
+
+func TestRequestIDFromContext(t *testing.T) {
+	_, ok := RequestIDFromContext(context.Background())
+	assert.False(t, ok)
+
+	_, ok = RequestIDFromContext(WithRequestID(context.Background(), ""))
+	assert.False(t, ok)
+
+	id, ok := RequestIDFromContext(WithRequestID(context.Background(), "abc"))
+	assert.True(t, ok)
+	assert.Equal(t, "abc", id)
+}
@@ -22,3 +22,16 @@ func (*NoopLogger) Warn(string, ...interface{}) {}
 
 // Error noop.
 func (*NoopLogger) Error(string, ...interface{}) {}
+
+// DebugEnabled reports whether the debug messages of the logger are written,
+// to avoid building expensive messages (e.g. DumpHTTPRequest) for nothing.
+// A logger can tell it by implementing the DebugEnabled() bool method, otherwise the debug messages are assumed to be written.
+func DebugEnabled(l Logger) bool {
+	if d, ok := l.(interface{ DebugEnabled() bool }); ok {
+		return d.DebugEnabled()
+	}
+	return l != nil
+}
+
+// DebugEnabled always returns false: the noop logger discards all the messages.
+func (*NoopLogger) DebugEnabled() bool { return false }
@@ -8,13 +8,22 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"time"
+
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
 )
 
-// ProxyWriter calls recorder, used to debug logs.
+// ProxyWriter observes the response written by a handler: its status code, when it started, its length,
+// whether the connection was hijacked and the first error of its writes.
+// The middlewares share it instead of stacking their own response writers.
 type ProxyWriter struct {
-	w      http.ResponseWriter
-	code   int
-	length int64
+	w           http.ResponseWriter
+	code        int
+	length      int64
+	hijacked    bool
+	wroteHeader bool
+	firstByte   time.Time
+	writeErr    error
 
 	log Logger
 }
@@ -42,23 +51,75 @@ func (p *ProxyWriter) StatusCode() int {
 	return p.code
 }
 
-// GetLength gets content length.
+// Hijacked reports whether the connection was taken over by the caller, e.g. for websockets:
+// the status code and length do not describe the response then.
+func (p *ProxyWriter) Hijacked() bool {
+	return p.hijacked
+}
+
+// HeaderWritten reports whether the response has been started: its header can't be changed anymore.
+func (p *ProxyWriter) HeaderWritten() bool {
+	return p.wroteHeader
+}
+
+// FirstByteTime returns when the response was started, false if it has not been.
+// The informational (1xx) responses do not start it, except 101 Switching Protocols.
+func (p *ProxyWriter) FirstByteTime() (time.Time, bool) {
+	return p.firstByte, p.wroteHeader
+}
+
+// BytesWritten returns the number of bytes of the body written to the underlying writer.
+func (p *ProxyWriter) BytesWritten() int64 {
+	return p.length
+}
+
+// GetLength gets content length, see BytesWritten.
 func (p *ProxyWriter) GetLength() int64 {
 	return p.length
 }
 
+// WriteError returns the first error of Write or ReadFrom, e.g. when the client went away.
+func (p *ProxyWriter) WriteError() error {
+	return p.writeErr
+}
+
 // Header gets response header.
 func (p *ProxyWriter) Header() http.Header {
 	return p.w.Header()
 }
 
 func (p *ProxyWriter) Write(buf []byte) (int, error) {
-	p.length += int64(len(buf))
-	return p.w.Write(buf)
+	p.startResponse()
+	n, err := p.w.Write(buf)
+	p.length += int64(n)
+	p.recordError(err)
+	return n, err
+}
+
+// ReadFrom copies src to the response, it lets the underlying writer use sendfile
+// when it supports io.ReaderFrom (e.g. for file-backed bodies).
+func (p *ProxyWriter) ReadFrom(src io.Reader) (int64, error) {
+	p.startResponse()
+
+	var n int64
+	var err error
+	if rf, ok := p.w.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		buf := DefaultBufferPool.Get()
+		n, err = io.CopyBuffer(writerOnly{p.w}, src, buf)
+		DefaultBufferPool.Put(buf)
+	}
+	p.length += n
+	p.recordError(err)
+	return n, err
 }
 
 // WriteHeader writes status code.
 func (p *ProxyWriter) WriteHeader(code int) {
+	if code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		p.startResponse()
+	}
 	p.code = code
 	p.w.WriteHeader(code)
 }
@@ -66,6 +127,7 @@ func (p *ProxyWriter) WriteHeader(code int) {
 // Flush flush the writer.
 func (p *ProxyWriter) Flush() {
 	if f, ok := p.w.(http.Flusher); ok {
+		p.startResponse()
 		f.Flush()
 	}
 }
@@ -83,12 +145,36 @@ func (p *ProxyWriter) CloseNotify() <-chan bool {
 // Hijack lets the caller take over the connection.
 func (p *ProxyWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	if hi, ok := p.w.(http.Hijacker); ok {
-		return hi.Hijack()
+		conn, rw, err := hi.Hijack()
+		if err == nil {
+			p.hijacked = true
+		}
+		return conn, rw, err
 	}
 	p.log.Debug("Upstream ResponseWriter of type %v does not implement http.Hijacker. Returning dummy channel.", reflect.TypeOf(p.w))
 	return nil, nil, fmt.Errorf("the response writer that was wrapped in this proxy, does not implement http.Hijacker. It is of type: %v", reflect.TypeOf(p.w))
 }
 
+// startResponse records the start of the response, on its first write.
+func (p *ProxyWriter) startResponse() {
+	if !p.wroteHeader {
+		p.wroteHeader = true
+		p.firstByte = clock.Now()
+	}
+}
+
+// recordError keeps the first error of the writes.
+func (p *ProxyWriter) recordError(err error) {
+	if err != nil && p.writeErr == nil {
+		p.writeErr = err
+	}
+}
+
+// writerOnly hides the optional interfaces of a writer, to avoid io.CopyBuffer calling ReadFrom again.
+type writerOnly struct {
+	io.Writer
+}
+
 // NewBufferWriter creates a new BufferWriter.
 func NewBufferWriter(w io.WriteCloser, l Logger) *BufferWriter {
 	return &BufferWriter{
@@ -159,6 +245,7 @@ func NopWriteCloser(w io.Writer) io.WriteCloser {
 }
 
 // CopyURL provides update safe copy by avoiding shallow copying User field.
+// Every other field of the URL (e.g. Opaque, RawFragment, ForceQuery) is a value, copied as is.
 func CopyURL(i *url.URL) *url.URL {
 	out := *i
 	if i.User != nil {
@@ -170,9 +257,42 @@ func CopyURL(i *url.URL) *url.URL {
 
 // CopyHeaders copies http headers from source to destination, it
 // does not override, but adds multiple headers.
+// The values of the destination never share their backing array with the source.
 func CopyHeaders(dst http.Header, src http.Header) {
+	CopyHeadersFiltered(dst, src, nil)
+}
+
+// CopyHeadersFiltered copies the http headers from source to destination as CopyHeaders does,
+// except the headers whose key matches skip. A nil skip copies all the headers.
+func CopyHeadersFiltered(dst http.Header, src http.Header, skip func(key string) bool) {
+	// The values of the headers new to the destination share a single allocation, as in http.Header.Clone.
+	n := 0
 	for k, vv := range src {
-		dst[k] = append(dst[k], vv...)
+		if len(dst[k]) == 0 && (skip == nil || !skip(k)) {
+			n += len(vv)
+		}
+	}
+
+	var values []string
+	if n > 0 {
+		values = make([]string, n)
+	}
+
+	for k, vv := range src {
+		if skip != nil && skip(k) {
+			continue
+		}
+
+		// The values are added to the existing ones, and the keys without values are kept.
+		if len(dst[k]) != 0 || len(vv) == 0 {
+			dst[k] = append(dst[k], vv...)
+			continue
+		}
+
+		// The capacity is limited, so that appending to a header does not overwrite the next one.
+		c := copy(values, vv)
+		dst[k] = values[:c:c]
+		values = values[c:]
 	}
 }
 
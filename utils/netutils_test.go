@@ -1,11 +1,19 @@
 package utils
 
 import (
+	"errors"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/v2/internal/holsterv4/clock"
 )
 
 // Make sure copy does it right, so the copied url is safe to alter without modifying the other.
@@ -53,6 +61,61 @@ func TestCopyHeaders(t *testing.T) {
 	assert.Equal(t, "b", destination.Get("a"))
 }
 
+// Make sure every field of the URL is copied, including the ones added by future versions of the standard library.
+func TestCopyUrl_allFields(t *testing.T) {
+	in := &url.URL{}
+
+	v := reflect.ValueOf(in).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := v.Type().Field(i).Name
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(name)
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.Ptr:
+			require.Equal(t, reflect.TypeOf(&url.Userinfo{}), field.Type(), "field %s", name)
+			field.Set(reflect.ValueOf(url.UserPassword("user", "secret")))
+		default:
+			t.Fatalf("unexpected kind %s of the field %s, CopyURL may need to copy it", field.Kind(), name)
+		}
+	}
+
+	out := CopyURL(in)
+	assert.Equal(t, in, out)
+	assert.NotSame(t, in.User, out.User)
+}
+
+// Make sure the values of the copied headers can be altered without modifying the source.
+func TestCopyHeaders_independentValues(t *testing.T) {
+	source := http.Header{"A": {"1", "2"}, "B": {"3"}, "C": nil}
+	destination := http.Header{"B": {"0"}}
+
+	CopyHeaders(destination, source)
+
+	assert.Equal(t, http.Header{"A": {"1", "2"}, "B": {"0", "3"}, "C": nil}, destination)
+
+	destination["A"][0] = "changed"
+	destination["A"] = append(destination["A"], "appended")
+	destination.Add("B", "added")
+
+	assert.Equal(t, http.Header{"A": {"1", "2"}, "B": {"3"}, "C": nil}, source)
+	assert.Equal(t, []string{"changed", "2", "appended"}, destination["A"])
+	assert.Equal(t, []string{"0", "3", "added"}, destination["B"])
+}
+
+func TestCopyHeadersFiltered(t *testing.T) {
+	source := http.Header{"Connection": {"close"}, "Keep-Alive": {"timeout=5"}, "X-Custom": {"a", "b"}}
+	destination := make(http.Header)
+
+	hop := map[string]bool{"Connection": true, "Keep-Alive": true}
+	CopyHeadersFiltered(destination, source, func(key string) bool { return hop[key] })
+
+	assert.Equal(t, http.Header{"X-Custom": {"a", "b"}}, destination)
+}
+
 func TestHasHeaders(t *testing.T) {
 	source := make(http.Header)
 	source.Add("a", "b")
@@ -93,9 +156,230 @@ func BenchmarkCopyHeaders(b *testing.B) {
 		s.Add("Accept-Ranges", "bytes")
 		sourceHeaders = append(sourceHeaders, s)
 	}
+	b.ReportAllocs()
 	b.ResetTimer()
 
 	for n := 0; n < b.N; n++ {
 		CopyHeaders(dstHeaders[n], sourceHeaders[n])
 	}
 }
+
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder.Body, src)
+}
+
+func TestProxyWriter_ReadFrom(t *testing.T) {
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	pw := NewProxyWriter(rec)
+	n, err := io.Copy(pw, struct{ io.Reader }{strings.NewReader("hello")})
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 5, n)
+	assert.True(t, rec.readFrom)
+	assert.EqualValues(t, 5, pw.GetLength())
+	assert.Equal(t, "hello", rec.Body.String())
+
+	// Without io.ReaderFrom support, the body is copied through a pooled buffer.
+	plain := httptest.NewRecorder()
+
+	pw = NewProxyWriter(plain)
+	n, err = pw.ReadFrom(strings.NewReader("world"))
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 5, n)
+	assert.EqualValues(t, 5, pw.GetLength())
+	assert.Equal(t, "world", plain.Body.String())
+}
+
+func TestProxyWriter_Hijacked(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		pw := NewProxyWriter(w)
+		assert.False(t, pw.Hijacked())
+
+		conn, _, err := pw.Hijack()
+		require.NoError(t, err)
+		assert.True(t, pw.Hijacked())
+		_ = conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+
+	// The connection is closed without a response.
+	re, err := http.Get(srv.URL)
+	if err == nil {
+		_ = re.Body.Close()
+	}
+
+	// The hijack fails when the writer does not support it.
+	pw := NewProxyWriter(httptest.NewRecorder())
+	_, _, err = pw.Hijack()
+	require.Error(t, err)
+	assert.False(t, pw.Hijacked())
+}
+
+// failingWriter is a response writer whose writes fail, e.g. when the client went away.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+func (f *failingWriter) Write([]byte) (int, error) {
+	return 0, f.err
+}
+
+func TestProxyWriter_observer(t *testing.T) {
+	errClosed := errors.New("client gone")
+	start := clock.Date(2012, 3, 4, 5, 6, 7, 0, clock.UTC)
+
+	testCases := []struct {
+		desc  string
+		write func(pw *ProxyWriter)
+
+		expectedCode      int
+		expectedStarted   bool
+		expectedFirstByte time.Duration
+		expectedLength    int64
+		expectedErr       error
+	}{
+		{
+			desc:         "never written",
+			write:        func(*ProxyWriter) {},
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc: "informational response",
+			write: func(pw *ProxyWriter) {
+				pw.WriteHeader(http.StatusEarlyHints)
+			},
+			expectedCode: http.StatusEarlyHints,
+		},
+		{
+			desc: "normal",
+			write: func(pw *ProxyWriter) {
+				clock.Advance(time.Second)
+				pw.WriteHeader(http.StatusCreated)
+				clock.Advance(time.Second)
+				_, _ = pw.Write([]byte("hello"))
+				_, _ = pw.ReadFrom(strings.NewReader(" world"))
+			},
+			expectedCode:      http.StatusCreated,
+			expectedStarted:   true,
+			expectedFirstByte: time.Second,
+			expectedLength:    11,
+		},
+		{
+			desc: "implicit header",
+			write: func(pw *ProxyWriter) {
+				clock.Advance(time.Second)
+				_, _ = pw.Write([]byte("hello"))
+			},
+			expectedCode:      http.StatusOK,
+			expectedStarted:   true,
+			expectedFirstByte: time.Second,
+			expectedLength:    5,
+		},
+		{
+			desc: "error on write",
+			write: func(pw *ProxyWriter) {
+				pw.w = &failingWriter{ResponseRecorder: httptest.NewRecorder(), err: errClosed}
+				_, _ = pw.Write([]byte("hello"))
+				pw.w = &failingWriter{ResponseRecorder: httptest.NewRecorder(), err: errors.New("other")}
+				_, _ = pw.Write([]byte("hello"))
+			},
+			expectedCode:    http.StatusOK,
+			expectedStarted: true,
+			expectedErr:     errClosed,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			clock.Freeze(start)
+			t.Cleanup(clock.Unfreeze)
+
+			pw := NewProxyWriter(httptest.NewRecorder())
+			test.write(pw)
+
+			assert.Equal(t, test.expectedCode, pw.StatusCode())
+			assert.Equal(t, test.expectedStarted, pw.HeaderWritten())
+			assert.Equal(t, test.expectedLength, pw.BytesWritten())
+			assert.Equal(t, test.expectedErr, pw.WriteError())
+			assert.False(t, pw.Hijacked())
+
+			firstByte, ok := pw.FirstByteTime()
+			assert.Equal(t, test.expectedStarted, ok)
+			if ok {
+				assert.Equal(t, start.Add(test.expectedFirstByte), firstByte)
+			}
+		})
+	}
+}
+
+func TestProxyWriter_observerHijacked(t *testing.T) {
+	observed := make(chan *ProxyWriter, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		pw := NewProxyWriter(w)
+		defer func() { observed <- pw }()
+
+		conn, _, err := pw.Hijack()
+		require.NoError(t, err)
+		_ = conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+
+	re, err := http.Get(srv.URL)
+	if err == nil {
+		_ = re.Body.Close()
+	}
+
+	pw := <-observed
+	assert.True(t, pw.Hijacked())
+	assert.False(t, pw.HeaderWritten())
+	assert.Equal(t, int64(0), pw.BytesWritten())
+	assert.NoError(t, pw.WriteError())
+
+	_, ok := pw.FirstByteTime()
+	assert.False(t, ok)
+}
+
+// discardWriter is a response writer doing nothing, to measure the cost of the ProxyWriter alone.
+type discardWriter struct{ header http.Header }
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (discardWriter) Write(buf []byte) (int, error) { return len(buf), nil }
+func (discardWriter) WriteHeader(int)               {}
+
+func TestProxyWriter_allocations(t *testing.T) {
+	w := discardWriter{header: http.Header{}}
+	body := []byte("hello")
+
+	// At most the ProxyWriter itself is allocated.
+	allocs := testing.AllocsPerRun(100, func() {
+		pw := NewProxyWriter(w)
+		pw.WriteHeader(http.StatusOK)
+		_, _ = pw.Write(body)
+		_, _ = pw.FirstByteTime()
+	})
+	assert.LessOrEqual(t, allocs, float64(1))
+}
+
+func BenchmarkProxyWriter(b *testing.B) {
+	w := discardWriter{header: http.Header{}}
+	body := []byte("hello")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		pw := NewProxyWriter(w)
+		pw.WriteHeader(http.StatusOK)
+		_, _ = pw.Write(body)
+		_, _ = pw.FirstByteTime()
+	}
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// ErrPanicInHandler is passed to the error handler of a middleware when its next handler panics.
+// The default error handler answers 500.
+type ErrPanicInHandler struct {
+	// Recovered is the value passed to panic.
+	Recovered any
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *ErrPanicInHandler) Error() string {
+	return fmt.Sprintf("panic in handler: %v", e.Recovered)
+}
+
+// Unwrap returns the value passed to panic, if it is an error.
+func (e *ErrPanicInHandler) Unwrap() error {
+	err, _ := e.Recovered.(error)
+	return err
+}
+
+// ServeRecovered calls next, and returns the panic of next as an ErrPanicInHandler, if any.
+// http.ErrAbortHandler is panicked again untouched: the server relies on it to abort the response silently.
+func ServeRecovered(next http.Handler, w http.ResponseWriter, req *http.Request) (err *ErrPanicInHandler) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		if e, ok := recovered.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+			panic(recovered)
+		}
+		err = &ErrPanicInHandler{Recovered: recovered, Stack: debug.Stack()}
+	}()
+
+	next.ServeHTTP(w, req)
+	return nil
+}
+
+// RecoveryHandler returns a handler calling next, and onPanic with the recovered value if next panics.
+// http.ErrAbortHandler is not recovered, see ServeRecovered.
+func RecoveryHandler(next http.Handler, onPanic func(w http.ResponseWriter, req *http.Request, recovered any)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := ServeRecovered(next, w, req); err != nil {
+			onPanic(w, req, err.Recovered)
+		}
+	})
+}
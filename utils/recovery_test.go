@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeRecovered(t *testing.T) {
+	boom := errors.New("boom")
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(boom)
+	})
+
+	err := ServeRecovered(handler, httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	require.NotNil(t, err)
+	assert.Equal(t, boom, err.Recovered)
+	assert.ErrorIs(t, err, boom)
+	assert.Equal(t, "panic in handler: boom", err.Error())
+	assert.Contains(t, string(err.Stack), "TestServeRecovered")
+
+	ok := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	assert.Nil(t, ServeRecovered(ok, httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)))
+}
+
+func TestServeRecovered_abortHandler(t *testing.T) {
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		_ = ServeRecovered(handler, httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
+
+func TestRecoveryHandler(t *testing.T) {
+	handler := RecoveryHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	}), func(w http.ResponseWriter, _ *http.Request, recovered any) {
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte(recovered.(string)))
+	})
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusTeapot, rw.Code)
+	assert.Equal(t, "boom", rw.Body.String())
+}
+
+func TestProxyWriter_headerWritten(t *testing.T) {
+	pw := NewProxyWriter(httptest.NewRecorder())
+	assert.False(t, pw.HeaderWritten())
+
+	pw.WriteHeader(http.StatusEarlyHints)
+	assert.False(t, pw.HeaderWritten())
+
+	_, _ = pw.Write([]byte("hello"))
+	assert.True(t, pw.HeaderWritten())
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -43,11 +44,102 @@ func NewExtractor(variable string) (SourceExtractor, error) {
 }
 
 func extractClientIP(req *http.Request) (string, int64, error) {
-	vals := strings.SplitN(req.RemoteAddr, ":", 2)
-	if vals[0] == "" {
+	clientIP := ClientIP(req.RemoteAddr)
+	if clientIP == "" {
 		return "", 0, fmt.Errorf("failed to parse client IP: %v", req.RemoteAddr)
 	}
-	return vals[0], 1, nil
+	return clientIP, 1, nil
+}
+
+// ClientIP returns the IP address of a remote address, with or without port
+// (e.g. "10.0.0.1:1234", "[2001:db8::1]:1234", "2001:db8::1").
+// IPv6 addresses are returned bare: without brackets nor zone.
+func ClientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(remoteAddr, "["), "]")
+	}
+
+	// Remove the zone of IPv6 addresses, like "fe80::d806:a55d:eb1b:49cc%vEthernet (vmxnet3 Ethernet Adapter - Virtual Switch)".
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	return host
+}
+
+// NewTrustedProxyExtractor creates a SourceExtractor of the client IP that takes the trusted proxies into account:
+// when the request comes from a trusted proxy, the client IP is the rightmost address of the X-Forwarded-For header
+// that is not a trusted proxy, otherwise it is the remote address and the header, which may be spoofed, is ignored.
+// The trusted proxies are IPs or CIDRs (e.g. "10.0.0.0/8"). Without trusted proxies, the client IP is the remote address.
+func NewTrustedProxyExtractor(trustedProxies ...string) (SourceExtractor, error) {
+	var trusted []*net.IPNet
+	for _, proxy := range trustedProxies {
+		n, err := ParseNetwork(proxy)
+		if err != nil {
+			return nil, err
+		}
+		trusted = append(trusted, n)
+	}
+
+	isTrusted := func(ip net.IP) bool {
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		clientIP := ClientIP(req.RemoteAddr)
+		ip := net.ParseIP(clientIP)
+		if ip == nil {
+			return "", 0, fmt.Errorf("failed to parse client IP: %v", req.RemoteAddr)
+		}
+
+		if !isTrusted(ip) {
+			return ip.String(), 1, nil
+		}
+
+		var forwarded []string
+		for _, v := range req.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(v, ",")...)
+		}
+
+		for i := len(forwarded) - 1; i >= 0 && isTrusted(ip); i-- {
+			next := net.ParseIP(ClientIP(strings.TrimSpace(forwarded[i])))
+			if next == nil {
+				// the address added by the last trusted proxy is the most reliable one.
+				break
+			}
+			ip = next
+		}
+
+		return ip.String(), 1, nil
+	}), nil
+}
+
+// ParseNetwork parses an IP or a CIDR (e.g. "10.0.0.1" or "10.0.0.0/8") into a network,
+// an IP being a network of a single address.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP or CIDR: %q", s)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
 }
 
 func extractHost(req *http.Request) (string, int64, error) {
@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		remoteAddr string
+		expected   string
+	}{
+		{
+			desc:       "empty",
+			remoteAddr: "",
+			expected:   "",
+		},
+		{
+			desc:       "ipv4 localhost",
+			remoteAddr: "127.0.0.1",
+			expected:   "127.0.0.1",
+		},
+		{
+			desc:       "ipv4",
+			remoteAddr: "10.13.14.15",
+			expected:   "10.13.14.15",
+		},
+		{
+			desc:       "ipv4 with port",
+			remoteAddr: "10.13.14.15:1234",
+			expected:   "10.13.14.15",
+		},
+		{
+			desc:       "ipv6 zone",
+			remoteAddr: `fe80::d806:a55d:eb1b:49cc%vEthernet (vmxnet3 Ethernet Adapter - Virtual Switch)`,
+			expected:   "fe80::d806:a55d:eb1b:49cc",
+		},
+		{
+			desc:       "ipv6 zone with port",
+			remoteAddr: `[fe80::d806:a55d:eb1b:49cc%vEthernet (vmxnet3 Ethernet Adapter - Virtual Switch)]:64692`,
+			expected:   "fe80::d806:a55d:eb1b:49cc",
+		},
+		{
+			desc:       "ipv6 medium",
+			remoteAddr: `fe80::1`,
+			expected:   "fe80::1",
+		},
+		{
+			desc:       "ipv6 small",
+			remoteAddr: `2000::`,
+			expected:   "2000::",
+		},
+		{
+			desc:       "ipv6",
+			remoteAddr: `2001:3452:4952:2837::`,
+			expected:   "2001:3452:4952:2837::",
+		},
+		{
+			desc:       "ipv6 with brackets",
+			remoteAddr: `[2001:db8::1]`,
+			expected:   "2001:db8::1",
+		},
+		{
+			desc:       "ipv6 with port",
+			remoteAddr: `[2001:db8::1]:54321`,
+			expected:   "2001:db8::1",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, ClientIP(test.remoteAddr))
+		})
+	}
+}
+
+func TestExtractClientIP(t *testing.T) {
+	extractor, err := NewExtractor("client.ip")
+	require.NoError(t, err)
+
+	token, amount, err := extractor.Extract(&http.Request{RemoteAddr: "[2001:db8::1]:54321"})
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", token)
+	assert.Equal(t, int64(1), amount)
+
+	_, _, err = extractor.Extract(&http.Request{})
+	require.Error(t, err)
+}
+
+func TestTrustedProxyExtractor(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		trusted    []string
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{
+			desc:       "no trusted proxies",
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  []string{"1.2.3.4"},
+			expected:   "10.0.0.1",
+		},
+		{
+			desc:       "untrusted client spoofing the header",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "192.168.1.1:1234",
+			forwarded:  []string{"10.1.1.1"},
+			expected:   "192.168.1.1",
+		},
+		{
+			desc:       "trusted proxy",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  []string{"1.2.3.4"},
+			expected:   "1.2.3.4",
+		},
+		{
+			desc:       "chain of trusted proxies",
+			trusted:    []string{"10.0.0.0/8", "172.16.0.1"},
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  []string{"6.6.6.6, 1.2.3.4, 172.16.0.1", "10.0.0.2"},
+			expected:   "1.2.3.4",
+		},
+		{
+			desc:       "malformed entry",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  []string{"1.2.3.4, unknown"},
+			expected:   "10.0.0.1",
+		},
+		{
+			desc:       "only trusted proxies",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  []string{"10.0.0.3, 10.0.0.2"},
+			expected:   "10.0.0.3",
+		},
+		{
+			desc:       "ipv6",
+			trusted:    []string{"2001:db8::/32"},
+			remoteAddr: "[2001:db8::1]:1234",
+			forwarded:  []string{"2001:db9::1"},
+			expected:   "2001:db9::1",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			extractor, err := NewTrustedProxyExtractor(test.trusted...)
+			require.NoError(t, err)
+
+			req := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+			for _, v := range test.forwarded {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+
+			token, amount, err := extractor.Extract(req)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, token)
+			assert.Equal(t, int64(1), amount)
+		})
+	}
+}
+
+func TestTrustedProxyExtractor_invalid(t *testing.T) {
+	_, err := NewTrustedProxyExtractor("10.0.0.0/33")
+	require.Error(t, err)
+
+	_, err = NewTrustedProxyExtractor("proxy")
+	require.Error(t, err)
+
+	extractor, err := NewTrustedProxyExtractor()
+	require.NoError(t, err)
+
+	_, _, err = extractor.Extract(&http.Request{RemoteAddr: "unknown"})
+	require.Error(t, err)
+}
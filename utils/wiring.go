@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// The middlewares can be built before the handler they wrap, e.g. when loading a configuration:
+// they are created with a nil next handler, and wired later with their Wrap method.
+
+// ErrNotWired is passed to the error handler of a middleware served before its next handler is set with Wrap.
+// The default error handler answers 500.
+type ErrNotWired struct {
+	// Middleware is the name of the middleware, e.g. "buffer".
+	Middleware string
+}
+
+func (e *ErrNotWired) Error() string {
+	return fmt.Sprintf("vulcand/oxy/%s: next handler not set, see Wrap", e.Middleware)
+}
+
+// CheckWrap validates the next handler passed to the Wrap method of a middleware, current being its next handler:
+// next can't be nil, and the next handler of a middleware can only be set once.
+func CheckWrap(current, next http.Handler) error {
+	if next == nil {
+		return errors.New("next handler can't be nil")
+	}
+	if current != nil {
+		return fmt.Errorf("already bound to %T", current)
+	}
+	return nil
+}
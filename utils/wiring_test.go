@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckWrap(t *testing.T) {
+	next := http.NotFoundHandler()
+
+	require.NoError(t, CheckWrap(nil, next))
+	require.EqualError(t, CheckWrap(nil, nil), "next handler can't be nil")
+	require.EqualError(t, CheckWrap(next, next), "already bound to http.HandlerFunc")
+}
+
+func TestErrNotWired(t *testing.T) {
+	err := &ErrNotWired{Middleware: "buffer"}
+	assert.Equal(t, "vulcand/oxy/buffer: next handler not set, see Wrap", err.Error())
+
+	rw := httptest.NewRecorder()
+	DefaultHandler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil), err)
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+}